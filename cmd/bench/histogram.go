@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Latencies are bucketed log-linearly like the engine's latency tracking,
+// but finer: each power of two of nanoseconds is split into subBuckets
+// buckets, so a percentile is off by at most 1/subBuckets of its value.
+// Latencies of 2^maxExp nanoseconds (about 18 minutes) or more all land in
+// the last bucket.
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	maxExp        = 40
+	numBuckets    = (maxExp - subBucketBits + 1) * subBuckets
+)
+
+// histogram counts latencies. It isn't safe for concurrent use: each
+// worker records into its own and they are merged at the end.
+type histogram struct {
+	buckets [numBuckets]int64
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+}
+
+// add records one latency
+func (h *histogram) add(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	h.buckets[bucket(int64(latency))]++
+	h.count++
+	h.sum += latency
+	h.max = max(h.max, latency)
+}
+
+// merge adds the latencies recorded in other
+func (h *histogram) merge(other *histogram) {
+	for i, count := range other.buckets {
+		h.buckets[i] += count
+	}
+	h.count += other.count
+	h.sum += other.sum
+	h.max = max(h.max, other.max)
+}
+
+// mean returns the mean latency, 0 if none was recorded
+func (h *histogram) mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// percentile returns the latency q (between 0 and 1) of the recorded ones
+// are at or below: the upper bound of its bucket, capped at the maximum
+func (h *histogram) percentile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, count := range h.buckets {
+		if seen += count; seen >= rank {
+			return min(time.Duration(bucketBound(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+// bucket returns the bucket of a latency of ns nanoseconds. Below
+// subBuckets nanoseconds each has a bucket of its own; above, the bucket is
+// picked by the latency's highest bits.
+func bucket(ns int64) int {
+	if ns < subBuckets {
+		return int(ns)
+	}
+	exp := bits.Len64(uint64(ns)) // ns is in [2^(exp-1), 2^exp)
+	if exp > maxExp {
+		return numBuckets - 1
+	}
+	sub := int(ns>>(exp-1-subBucketBits)) & (subBuckets - 1)
+	return (exp-subBucketBits)*subBuckets + sub
+}
+
+// bucketBound returns the smallest latency, in nanoseconds, above those in
+// bucket b
+func bucketBound(b int) int64 {
+	next := b + 1
+	if next < subBuckets {
+		return int64(next)
+	}
+	exp := next/subBuckets + subBucketBits
+	sub := int64(next % subBuckets)
+	return (subBuckets + sub) << (exp - 1 - subBucketBits)
+}
@@ -0,0 +1,405 @@
+// Command bench runs a configurable workload against a database and
+// reports its throughput, latency percentiles, disk usage growth and
+// compaction and WAL activity, as text or as JSON for tracking regressions.
+// Run it with -h for its flags.
+package main
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1 // The benchmark couldn't run, or operations failed
+	exitUsage   = 2 // Bad flags
+)
+
+// opReport summarizes one operation of the workload
+type opReport struct {
+	Count     int64         `json:"count"`
+	Keys      int64         `json:"keys"` // Keys covered, more than Count for batches
+	OpsPerSec float64       `json:"ops_per_sec"`
+	Misses    int64         `json:"misses,omitempty"`
+	Errors    int64         `json:"errors,omitempty"`
+	Mean      time.Duration `json:"mean"`
+	P50       time.Duration `json:"p50"`
+	P90       time.Duration `json:"p90"`
+	P99       time.Duration `json:"p99"`
+	P999      time.Duration `json:"p999"`
+	Max       time.Duration `json:"max"`
+}
+
+// activity is what the storage and WAL did during the run
+type activity struct {
+	Compactions    int64  `json:"compactions"`
+	IndexSaves     int64  `json:"index_saves"`
+	DiskReads      int64  `json:"disk_reads"`
+	WALEntries     uint64 `json:"wal_entries,omitempty"`
+	WALBytes       uint64 `json:"wal_bytes_written,omitempty"`
+	WALSyncs       uint64 `json:"wal_syncs,omitempty"`
+	WALRotations   uint64 `json:"wal_rotations,omitempty"`
+	WALCheckpoints uint64 `json:"wal_checkpoints,omitempty"`
+}
+
+// compaction is the outcome of the compaction run after the workload
+type compaction struct {
+	Duration    time.Duration `json:"duration"`
+	BytesBefore int64         `json:"bytes_before"`
+	BytesAfter  int64         `json:"bytes_after"`
+}
+
+// report is the outcome of a benchmark run
+type report struct {
+	Workload   workload            `json:"workload"`
+	Preload    time.Duration       `json:"preload,omitempty"` // Time taken to write every key first
+	Elapsed    time.Duration       `json:"elapsed"`
+	Ops        int64               `json:"ops"`
+	OpsPerSec  float64             `json:"ops_per_sec"`
+	Errors     int64               `json:"errors"`
+	FirstError string              `json:"first_error,omitempty"`
+	Operations map[string]opReport `json:"operations"`
+	DiskBefore *engine.DiskUsage   `json:"disk_before,omitempty"` // Disk backends only, after preloading
+	DiskAfter  *engine.DiskUsage   `json:"disk_after,omitempty"`
+	DiskGrowth int64               `json:"disk_growth,omitempty"` // Bytes the database grew by
+	Activity   activity            `json:"activity"`
+	Compaction *compaction         `json:"compaction,omitempty"`
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the benchmark with args and returns its exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	w := workload{}
+	var dir, configPath string
+	var keep, jsonOut, compact bool
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&w.Backend, "backend", "memory", `storage: "memory", "disk", or "wal" for disk with the WAL`)
+	flags.StringVar(&w.Sync, "sync", "", `sync policy: a WAL sync policy (always, interval, everyN, never) for wal, "always" to fsync every write for disk`)
+	flags.StringVar(&dir, "dir", "", "data directory for disk backends (default a temporary one, removed afterwards)")
+	flags.BoolVar(&keep, "keep", false, "keep the temporary data directory")
+	flags.StringVar(&configPath, "config", "", "JSON config file to start from instead of the default config")
+	flags.IntVar(&w.Keys, "keys", 100000, "number of distinct keys")
+	flags.IntVar(&w.ValueSize, "value-size", 256, "mean value size in bytes")
+	flags.StringVar(&w.ValueDist, "value-dist", "fixed", `value size distribution: "fixed", "uniform" (1 to twice the mean) or "exponential"`)
+	flags.Float64Var(&w.Reads, "reads", 0.9, "fraction of operations that read")
+	flags.Float64Var(&w.Deletes, "deletes", 0, "fraction of writes that delete")
+	flags.StringVar(&w.KeyDist, "key-dist", "uniform", `key selection: "uniform" or "zipf"`)
+	flags.Float64Var(&w.ZipfS, "zipf-s", 1.1, "zipf skew, greater than 1; higher is more skewed")
+	flags.IntVar(&w.Concurrency, "concurrency", 8, "concurrent workers")
+	flags.DurationVar(&w.Duration, "duration", 10*time.Second, "how long to run the workload")
+	flags.IntVar(&w.Batch, "batch", 1, "keys per operation; above 1 the workload uses BatchGet, BatchSet and BatchDelete")
+	flags.DurationVar(&w.TTL, "ttl", 0, "TTL of values written with one")
+	flags.Float64Var(&w.TTLFraction, "ttl-fraction", 1, "fraction of values written with -ttl")
+	flags.BoolVar(&w.Preload, "preload", true, "write every key before the workload starts")
+	flags.Int64Var(&w.Seed, "seed", 1, "random seed")
+	flags.BoolVar(&compact, "compact", false, "compact the storage after the workload and time it")
+	flags.BoolVar(&jsonOut, "json", false, "print the report as JSON")
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "bench: unexpected arguments %q\n", flags.Args())
+		return exitUsage
+	}
+	if w.TTL == 0 {
+		w.TTLFraction = 0
+	}
+
+	config, err := benchConfig(&w, configPath)
+	if err == nil {
+		err = w.validate()
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "bench: %v\n", err)
+		return exitUsage
+	}
+
+	rep, err := benchmark(&w, config, dir, keep, compact, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "bench: %v\n", err)
+		return exitFailure
+	}
+
+	if jsonOut {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(rep); err != nil {
+			fmt.Fprintf(stderr, "bench: %v\n", err)
+			return exitFailure
+		}
+	} else {
+		printReport(stdout, rep)
+	}
+	if rep.Errors > 0 {
+		fmt.Fprintf(stderr, "bench: %d operations failed, the first with: %s\n", rep.Errors, rep.FirstError)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// benchConfig returns the config to open the database with for w: the
+// config file at path, or the default config, set up for the backend and
+// sync policy
+func benchConfig(w *workload, path string) (types.Config, error) {
+	config := types.DefaultConfig()
+	if path != "" {
+		loaded, err := types.LoadConfig(path)
+		if err != nil {
+			return types.Config{}, err
+		}
+		config = loaded
+	}
+	config.EnableTTL = config.EnableTTL || w.TTL > 0
+
+	switch w.Backend {
+	case "memory":
+		if w.Sync != "" {
+			return types.Config{}, errors.New("-sync only applies to the disk and wal backends")
+		}
+	case "disk":
+		config.WALEnabled = false
+		switch w.Sync {
+		case "":
+		case types.WALSyncAlways:
+			config.SyncOnWrite = true
+		case types.WALSyncNever:
+			config.SyncOnWrite = false
+		default:
+			return types.Config{}, fmt.Errorf("-sync for the disk backend is %q or %q, not %q", types.WALSyncAlways, types.WALSyncNever, w.Sync)
+		}
+	case "wal":
+		config.WALEnabled = true
+		if w.Sync != "" {
+			config.WALSyncPolicy = w.Sync
+		}
+	default:
+		return types.Config{}, fmt.Errorf("unknown -backend %q", w.Backend)
+	}
+	return config, nil
+}
+
+// benchmark opens the database, runs the workload on it and reports what
+// happened
+func benchmark(w *workload, config types.Config, dir string, keep, compact bool, stderr io.Writer) (*report, error) {
+	var db *engine.Database
+	var err error
+	if w.Backend == "memory" {
+		db, err = engine.OpenInMemory(engine.WithConfig(config))
+	} else {
+		if dir == "" {
+			if dir, err = os.MkdirTemp("", "bench-"); err != nil {
+				return nil, err
+			}
+			if keep {
+				fmt.Fprintf(stderr, "bench: data directory %s\n", dir)
+			} else {
+				defer os.RemoveAll(dir)
+			}
+		}
+		db, err = engine.Open(dir, engine.WithConfig(config))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	config = db.GetConfig()
+
+	rep := &report{Workload: *w, Operations: map[string]opReport{}}
+	if w.Preload {
+		if rep.Preload, err = preload(db, w, config.MaxValueSize); err != nil {
+			return nil, fmt.Errorf("preload failed: %w", err)
+		}
+	}
+
+	disk := w.Backend != "memory"
+	if disk {
+		if rep.DiskBefore, err = db.GetDiskUsageDetailed(); err != nil {
+			return nil, err
+		}
+	}
+	before, err := db.GetStats()
+	if err != nil {
+		return nil, err
+	}
+
+	recorded, elapsed := runWorkload(db, w, config.MaxValueSize)
+
+	after, err := db.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	if disk {
+		if rep.DiskAfter, err = db.GetDiskUsageDetailed(); err != nil {
+			return nil, err
+		}
+		rep.DiskGrowth = rep.DiskAfter.Total - rep.DiskBefore.Total
+	}
+	rep.Activity = statsActivity(before, after)
+
+	rep.Elapsed = elapsed
+	for o, stats := range recorded.ops {
+		if stats.latency.count == 0 {
+			continue
+		}
+		rep.Ops += stats.latency.count
+		rep.Errors += stats.errors
+		rep.Operations[opNames[o]] = opReport{
+			Count:     stats.latency.count,
+			Keys:      stats.keys,
+			OpsPerSec: ratio(float64(stats.latency.count), elapsed.Seconds()),
+			Misses:    stats.misses,
+			Errors:    stats.errors,
+			Mean:      stats.latency.mean(),
+			P50:       stats.latency.percentile(0.50),
+			P90:       stats.latency.percentile(0.90),
+			P99:       stats.latency.percentile(0.99),
+			P999:      stats.latency.percentile(0.999),
+			Max:       stats.latency.max,
+		}
+	}
+	rep.OpsPerSec = ratio(float64(rep.Ops), elapsed.Seconds())
+	if recorded.firstErr != nil {
+		rep.FirstError = recorded.firstErr.Error()
+	}
+
+	if compact && disk {
+		c := &compaction{BytesBefore: rep.DiskAfter.Total}
+		start := time.Now()
+		if err := db.Compact(); err != nil {
+			return nil, fmt.Errorf("compaction failed: %w", err)
+		}
+		c.Duration = time.Since(start)
+		usage, err := db.GetDiskUsageDetailed()
+		if err != nil {
+			return nil, err
+		}
+		c.BytesAfter = usage.Total
+		rep.Compaction = c
+	}
+	return rep, db.Close()
+}
+
+// statsActivity returns what the storage and WAL did between the stats
+// before and after
+func statsActivity(before, after *engine.Stats) activity {
+	var a activity
+	if before.Storage != nil && after.Storage != nil {
+		a.Compactions = after.Storage.Compactions - before.Storage.Compactions
+		a.IndexSaves = after.Storage.IndexSaves - before.Storage.IndexSaves
+		a.DiskReads = after.Storage.DiskReads - before.Storage.DiskReads
+	}
+	if before.WAL != nil && after.WAL != nil {
+		a.WALEntries = after.WAL.Entries - before.WAL.Entries
+		a.WALBytes = after.WAL.BytesWritten - before.WAL.BytesWritten
+		a.WALSyncs = after.WAL.Syncs - before.WAL.Syncs
+		a.WALRotations = after.WAL.Rotations - before.WAL.Rotations
+		a.WALCheckpoints = after.WAL.Checkpoints - before.WAL.Checkpoints
+	}
+	return a
+}
+
+// printReport writes rep as text
+func printReport(out io.Writer, rep *report) {
+	w := rep.Workload
+	keyDist := w.KeyDist
+	if keyDist == "zipf" {
+		keyDist = fmt.Sprintf("zipf(%g)", w.ZipfS)
+	}
+	backend := w.Backend
+	if w.Sync != "" {
+		backend += ", sync " + w.Sync
+	}
+	fmt.Fprintf(out, "workload: %s, %d keys, %s values (%s), %.0f%% reads, %s keys, %d workers, batch %d",
+		backend, w.Keys, formatBytes(int64(w.ValueSize)), w.ValueDist, w.Reads*100, keyDist, w.Concurrency, w.Batch)
+	if w.Deletes > 0 {
+		fmt.Fprintf(out, ", %.0f%% of writes delete", w.Deletes*100)
+	}
+	if w.TTL > 0 {
+		fmt.Fprintf(out, ", %.0f%% of writes with TTL %s", w.TTLFraction*100, w.TTL)
+	}
+	fmt.Fprintln(out)
+	if w.Preload {
+		fmt.Fprintf(out, "preload: %d keys in %s\n", w.Keys, rep.Preload.Round(time.Millisecond))
+	}
+	fmt.Fprintf(out, "ran %d operations in %s: %.0f ops/s, %d errors\n\n",
+		rep.Ops, rep.Elapsed.Round(time.Millisecond), rep.OpsPerSec, rep.Errors)
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "op\tcount\tops/s\tmean\tp50\tp90\tp99\tp99.9\tmax\tmisses\terrors\t")
+	for _, name := range opNames {
+		op, ok := rep.Operations[name]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%d\t%.0f\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t\n", name, op.Count, op.OpsPerSec,
+			formatLatency(op.Mean), formatLatency(op.P50), formatLatency(op.P90), formatLatency(op.P99),
+			formatLatency(op.P999), formatLatency(op.Max), op.Misses, op.Errors)
+	}
+	table.Flush()
+
+	if rep.DiskBefore != nil {
+		fmt.Fprintf(out, "\ndisk usage: %s -> %s (%+d bytes); data file %s -> %s, WAL %s -> %s\n",
+			formatBytes(rep.DiskBefore.Total), formatBytes(rep.DiskAfter.Total), rep.DiskGrowth,
+			formatBytes(rep.DiskBefore.DataFileSize), formatBytes(rep.DiskAfter.DataFileSize),
+			formatBytes(rep.DiskBefore.WALSize+rep.DiskBefore.ArchivedWALSize),
+			formatBytes(rep.DiskAfter.WALSize+rep.DiskAfter.ArchivedWALSize))
+		a := rep.Activity
+		fmt.Fprintf(out, "activity: %d compactions, %d index saves, %d disk reads", a.Compactions, a.IndexSaves, a.DiskReads)
+		if w.Backend == "wal" {
+			fmt.Fprintf(out, "; WAL %d entries, %s written, %d syncs, %d rotations, %d checkpoints",
+				a.WALEntries, formatBytes(int64(a.WALBytes)), a.WALSyncs, a.WALRotations, a.WALCheckpoints)
+		}
+		fmt.Fprintln(out)
+	}
+	if c := rep.Compaction; c != nil {
+		fmt.Fprintf(out, "compaction: %s, %s -> %s\n", c.Duration.Round(time.Millisecond), formatBytes(c.BytesBefore), formatBytes(c.BytesAfter))
+	}
+}
+
+// formatLatency rounds d to three significant digits or so
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d >= time.Microsecond:
+		return d.Round(100 * time.Nanosecond).String()
+	default:
+		return d.String()
+	}
+}
+
+// formatBytes formats n bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffix := float64(n), ""
+	for _, s := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		suffix = s
+		if value < unit && value > -unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	var h histogram
+	assert.Equal(t, time.Duration(0), h.percentile(0.5))
+
+	r := rand.New(rand.NewSource(1))
+	latencies := make([]time.Duration, 10000)
+	for i := range latencies {
+		latencies[i] = time.Duration(r.ExpFloat64() * float64(time.Millisecond))
+		h.add(latencies[i])
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		exact := latencies[int(q*float64(len(latencies)))-1]
+		got := h.percentile(q)
+		// The bucket's upper bound is at most 1/subBuckets above the exact value
+		assert.GreaterOrEqual(t, got, exact, "p%g", q*100)
+		assert.LessOrEqual(t, float64(got), float64(exact)*(1+1.0/subBuckets)+1, "p%g", q*100)
+	}
+	assert.Equal(t, latencies[len(latencies)-1], h.max)
+	assert.Equal(t, h.max, h.percentile(1))
+
+	var merged histogram
+	merged.merge(&h)
+	merged.merge(&h)
+	assert.Equal(t, 2*h.count, merged.count)
+	assert.Equal(t, h.mean(), merged.mean())
+	assert.Equal(t, h.percentile(0.99), merged.percentile(0.99))
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	for _, ns := range []int64{0, 1, 15, 16, 17, 31, 32, 1000, 123456789, 1 << 39} {
+		b := bucket(ns)
+		assert.Less(t, ns, bucketBound(b), "ns %d", ns)
+		if b > 0 {
+			assert.GreaterOrEqual(t, ns, bucketBound(b-1), "ns %d", ns)
+		}
+	}
+	assert.Equal(t, numBuckets-1, bucket(1<<50))
+}
+
+func TestUsageErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-keys", "0"},
+		{"-reads", "1.5"},
+		{"-backend", "tape"},
+		{"-key-dist", "zipf", "-zipf-s", "1"},
+		{"-value-dist", "normal"},
+		{"-backend", "memory", "-sync", "always"},
+		{"-backend", "disk", "-sync", "everyN"},
+		{"-no-such-flag"},
+		{"extra"},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, exitUsage, run(args, &stdout, &stderr), "args %q", args)
+		assert.NotEmpty(t, stderr.String(), "args %q", args)
+	}
+}
+
+// runJSON runs the benchmark briefly with args and returns its JSON report
+func runJSON(t *testing.T, args ...string) report {
+	t.Helper()
+	args = append([]string{"-json", "-duration", "100ms", "-keys", "200", "-concurrency", "4", "-value-size", "64"}, args...)
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, exitOK, run(args, &stdout, &stderr), stderr.String())
+
+	var rep report
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &rep))
+	assert.Positive(t, rep.Ops)
+	assert.Positive(t, rep.OpsPerSec)
+	assert.Zero(t, rep.Errors)
+	return rep
+}
+
+func TestMemoryWorkload(t *testing.T) {
+	rep := runJSON(t, "-reads", "0.5", "-key-dist", "zipf", "-value-dist", "uniform")
+	assert.Nil(t, rep.DiskBefore)
+	for _, name := range []string{"get", "set"} {
+		op, ok := rep.Operations[name]
+		require.True(t, ok, name)
+		assert.Positive(t, op.Count, name)
+		assert.Equal(t, op.Count, op.Keys, name)
+		assert.LessOrEqual(t, op.P50, op.P99, name)
+		assert.LessOrEqual(t, op.P99, op.Max, name)
+	}
+	// Every key was preloaded and none is deleted
+	assert.Zero(t, rep.Operations["get"].Misses)
+}
+
+func TestDiskWorkload(t *testing.T) {
+	rep := runJSON(t, "-backend", "disk", "-sync", "never", "-reads", "0.2", "-deletes", "0.5", "-compact")
+	require.NotNil(t, rep.DiskBefore)
+	require.NotNil(t, rep.DiskAfter)
+	assert.Equal(t, rep.DiskAfter.Total-rep.DiskBefore.Total, rep.DiskGrowth)
+	assert.Positive(t, rep.Operations["delete"].Count)
+	require.NotNil(t, rep.Compaction)
+	assert.LessOrEqual(t, rep.Compaction.BytesAfter, rep.Compaction.BytesBefore)
+}
+
+func TestWALBatchTTLWorkload(t *testing.T) {
+	rep := runJSON(t, "-backend", "wal", "-sync", "never", "-batch", "10", "-reads", "0.5", "-deletes", "0.2",
+		"-ttl", "1ms", "-ttl-fraction", "0.5", "-value-dist", "exponential")
+	assert.Equal(t, "wal", rep.Workload.Backend)
+	assert.Equal(t, time.Millisecond, rep.Workload.TTL)
+	for _, name := range []string{"batch_get", "batch_set", "batch_delete"} {
+		op, ok := rep.Operations[name]
+		require.True(t, ok, name)
+		assert.Equal(t, 10*op.Count, op.Keys, name)
+	}
+	_, ok := rep.Operations["get"]
+	assert.False(t, ok)
+	assert.Positive(t, rep.Activity.WALEntries)
+	assert.Positive(t, rep.Activity.WALBytes)
+	// Deletes and expiring values leave keys to miss
+	assert.Positive(t, rep.Operations["batch_get"].Misses)
+}
+
+func TestTextReport(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"-backend", "wal", "-duration", "50ms", "-keys", "100", "-concurrency", "2", "-sync", "never"}
+	require.Equal(t, exitOK, run(args, &stdout, &stderr), stderr.String())
+	out := stdout.String()
+	assert.Contains(t, out, "workload: wal, sync never, 100 keys")
+	assert.Contains(t, out, "preload: 100 keys")
+	assert.True(t, strings.Contains(out, " get ") || strings.Contains(out, " set "), out)
+	assert.Contains(t, out, "disk usage: ")
+	assert.Contains(t, out, "WAL ")
+}
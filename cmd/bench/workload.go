@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations the workload performs, in the order they are reported
+type op int
+
+const (
+	opGet op = iota
+	opSet
+	opDelete
+	opBatchGet
+	opBatchSet
+	opBatchDelete
+	numOps
+)
+
+var opNames = [numOps]string{"get", "set", "delete", "batch_get", "batch_set", "batch_delete"}
+
+// workload describes what the benchmark does
+type workload struct {
+	Backend     string        `json:"backend"`        // "memory", "disk" or "wal"
+	Sync        string        `json:"sync,omitempty"` // WAL sync policy, or "always" for fsync on every disk write
+	Keys        int           `json:"keys"`
+	ValueSize   int           `json:"value_size"` // Mean value size in bytes
+	ValueDist   string        `json:"value_dist"` // "fixed", "uniform" or "exponential"
+	Reads       float64       `json:"reads"`      // Fraction of operations that read
+	Deletes     float64       `json:"deletes"`    // Fraction of writes that delete
+	KeyDist     string        `json:"key_dist"`   // "uniform" or "zipf"
+	ZipfS       float64       `json:"zipf_s,omitempty"`
+	Concurrency int           `json:"concurrency"`
+	Duration    time.Duration `json:"duration"`
+	Batch       int           `json:"batch"`                  // Keys per operation; batch operations above 1
+	TTL         time.Duration `json:"ttl,omitempty"`          // TTL of the values written with one
+	TTLFraction float64       `json:"ttl_fraction,omitempty"` // Fraction of the values written with a TTL
+	Preload     bool          `json:"preload"`
+	Seed        int64         `json:"seed"`
+}
+
+// validate checks the workload's settings make sense together
+func (w *workload) validate() error {
+	switch {
+	case w.Keys <= 0:
+		return errors.New("-keys must be positive")
+	case w.ValueSize <= 0:
+		return errors.New("-value-size must be positive")
+	case w.ValueDist != "fixed" && w.ValueDist != "uniform" && w.ValueDist != "exponential":
+		return fmt.Errorf("unknown -value-dist %q", w.ValueDist)
+	case w.Reads < 0 || w.Reads > 1:
+		return errors.New("-reads must be between 0 and 1")
+	case w.Deletes < 0 || w.Deletes > 1:
+		return errors.New("-deletes must be between 0 and 1")
+	case w.KeyDist != "uniform" && w.KeyDist != "zipf":
+		return fmt.Errorf("unknown -key-dist %q", w.KeyDist)
+	case w.KeyDist == "zipf" && w.ZipfS <= 1:
+		return errors.New("-zipf-s must be greater than 1")
+	case w.Concurrency <= 0:
+		return errors.New("-concurrency must be positive")
+	case w.Duration <= 0:
+		return errors.New("-duration must be positive")
+	case w.Batch <= 0:
+		return errors.New("-batch must be positive")
+	case w.TTL < 0:
+		return errors.New("-ttl can't be negative")
+	case w.TTLFraction < 0 || w.TTLFraction > 1:
+		return errors.New("-ttl-fraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// opStats is what a worker recorded for one operation
+type opStats struct {
+	latency histogram
+	keys    int64 // Keys the operations covered, more than their count for batches
+	misses  int64 // Keys read that were missing or expired
+	errors  int64
+}
+
+// recorder is what a worker recorded, merged into one at the end
+type recorder struct {
+	ops      [numOps]opStats
+	firstErr error
+}
+
+// record records an operation on keys keys that took latency and failed
+// with err, if it isn't nil
+func (r *recorder) record(o op, keys int, latency time.Duration, err error) {
+	stats := &r.ops[o]
+	stats.latency.add(latency)
+	stats.keys += int64(keys)
+	if err != nil {
+		stats.errors++
+		if r.firstErr == nil {
+			r.firstErr = fmt.Errorf("%s: %w", opNames[o], err)
+		}
+	}
+}
+
+// merge adds what other recorded
+func (r *recorder) merge(other *recorder) {
+	for i := range r.ops {
+		r.ops[i].latency.merge(&other.ops[i].latency)
+		r.ops[i].keys += other.ops[i].keys
+		r.ops[i].misses += other.ops[i].misses
+		r.ops[i].errors += other.ops[i].errors
+	}
+	if r.firstErr == nil {
+		r.firstErr = other.firstErr
+	}
+}
+
+// generator picks the keys, values and operations of one worker
+type generator struct {
+	w      *workload
+	rand   *rand.Rand
+	zipf   *rand.Zipf
+	order  []int  // Key numbers by popularity, for zipf
+	data   []byte // Random bytes values are cut from
+	maxLen int
+}
+
+// newGenerator returns a generator for worker n. order is shared by the
+// workers and only read.
+func newGenerator(w *workload, n int, order []int, maxValueSize int) *generator {
+	g := &generator{
+		w:      w,
+		rand:   rand.New(rand.NewSource(w.Seed + int64(n))),
+		order:  order,
+		maxLen: maxValueSize,
+	}
+	if w.KeyDist == "zipf" {
+		g.zipf = rand.NewZipf(g.rand, w.ZipfS, 1, uint64(w.Keys-1))
+	}
+	// Values are slices of this at random offsets, so they differ from
+	// each other without generating each one
+	g.data = make([]byte, 2*min(g.maxLen, 4*w.ValueSize+1024))
+	g.rand.Read(g.data)
+	return g
+}
+
+// keyName returns the key numbered i
+func keyName(i int) types.Key {
+	return types.Key(fmt.Sprintf("key:%010d", i))
+}
+
+// key picks a key, the most popular more often under zipf
+func (g *generator) key() types.Key {
+	if g.zipf != nil {
+		return keyName(g.order[g.zipf.Uint64()])
+	}
+	return keyName(g.rand.Intn(g.w.Keys))
+}
+
+// value returns a value with a size drawn from the value distribution
+func (g *generator) value() types.Value {
+	size := g.w.ValueSize
+	switch g.w.ValueDist {
+	case "uniform":
+		size = 1 + g.rand.Intn(2*g.w.ValueSize-1)
+	case "exponential":
+		size = 1 + int(g.rand.ExpFloat64()*float64(g.w.ValueSize-1))
+	}
+	size = min(size, g.maxLen, len(g.data)/2)
+	offset := g.rand.Intn(len(g.data) - size + 1)
+	return types.Value(g.data[offset : offset+size])
+}
+
+// ttl returns the TTL of a value being written, 0 for none
+func (g *generator) ttl() time.Duration {
+	if g.w.TTL > 0 && g.rand.Float64() < g.w.TTLFraction {
+		return g.w.TTL
+	}
+	return 0
+}
+
+// entry returns an entry to write
+func (g *generator) entry() types.Entry {
+	entry := types.Entry{Key: g.key(), Value: g.value()}
+	if ttl := g.ttl(); ttl > 0 {
+		entry.TTL = &ttl
+	}
+	return entry
+}
+
+// keyOrder returns the key numbers in a random order, which zipf ranks
+// popularity by so hot keys are spread over the key space
+func keyOrder(w *workload) []int {
+	if w.KeyDist != "zipf" {
+		return nil
+	}
+	return rand.New(rand.NewSource(w.Seed)).Perm(w.Keys)
+}
+
+// preload writes every key once, so reads find them, and returns how long
+// it took
+func preload(db *engine.Database, w *workload, maxValueSize int) (time.Duration, error) {
+	const chunk = 1000
+	g := newGenerator(w, -1, nil, maxValueSize)
+	start := time.Now()
+	entries := make([]types.Entry, 0, chunk)
+	for i := 0; i < w.Keys; i++ {
+		entries = append(entries, types.Entry{Key: keyName(i), Value: g.value()})
+		if len(entries) == chunk || i == w.Keys-1 {
+			if err := db.BatchSet(entries); err != nil {
+				return 0, err
+			}
+			entries = entries[:0]
+		}
+	}
+	return time.Since(start), nil
+}
+
+// runWorkload runs w against db with w.Concurrency workers for
+// w.Duration, and returns what they recorded and how long they ran
+func runWorkload(db *engine.Database, w *workload, maxValueSize int) (*recorder, time.Duration) {
+	order := keyOrder(w)
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	recorders := make([]*recorder, w.Concurrency)
+
+	start := time.Now()
+	timer := time.AfterFunc(w.Duration, func() { stop.Store(true) })
+	defer timer.Stop()
+	for n := 0; n < w.Concurrency; n++ {
+		n := n
+		recorders[n] = &recorder{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g := newGenerator(w, n, order, maxValueSize)
+			for !stop.Load() {
+				step(db, g, recorders[n])
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	total := &recorder{}
+	for _, r := range recorders {
+		total.merge(r)
+	}
+	return total, elapsed
+}
+
+// missing reports whether err means the key read wasn't there
+func missing(err error) bool {
+	return errors.Is(err, types.ErrKeyNotFound) || errors.Is(err, types.ErrKeyExpired)
+}
+
+// step performs one operation of the workload
+func step(db *engine.Database, g *generator, r *recorder) {
+	w := g.w
+	read := g.rand.Float64() < w.Reads
+	del := !read && g.rand.Float64() < w.Deletes
+
+	if w.Batch == 1 {
+		switch {
+		case read:
+			key := g.key()
+			start := time.Now()
+			_, err := db.Get(key)
+			latency := time.Since(start)
+			if missing(err) {
+				r.ops[opGet].misses++
+				err = nil
+			}
+			r.record(opGet, 1, latency, err)
+		case del:
+			key := g.key()
+			start := time.Now()
+			err := db.Delete(key)
+			r.record(opDelete, 1, time.Since(start), err)
+		default:
+			entry := g.entry()
+			start := time.Now()
+			var err error
+			if entry.TTL != nil {
+				err = db.SetWithTTL(entry.Key, entry.Value, *entry.TTL)
+			} else {
+				err = db.Set(entry.Key, entry.Value)
+			}
+			r.record(opSet, 1, time.Since(start), err)
+		}
+		return
+	}
+
+	switch {
+	case read:
+		keys := make([]types.Key, w.Batch)
+		for i := range keys {
+			keys[i] = g.key()
+		}
+		start := time.Now()
+		values, err := db.BatchGet(keys)
+		latency := time.Since(start)
+		if err == nil {
+			r.ops[opBatchGet].misses += int64(countMissing(keys, values))
+		}
+		r.record(opBatchGet, len(keys), latency, err)
+	case del:
+		keys := make([]types.Key, w.Batch)
+		for i := range keys {
+			keys[i] = g.key()
+		}
+		start := time.Now()
+		err := db.BatchDelete(keys)
+		r.record(opBatchDelete, len(keys), time.Since(start), err)
+	default:
+		entries := make([]types.Entry, w.Batch)
+		for i := range entries {
+			entries[i] = g.entry()
+		}
+		start := time.Now()
+		err := db.BatchSet(entries)
+		r.record(opBatchSet, len(entries), time.Since(start), err)
+	}
+}
+
+// countMissing returns how many of keys have no value in values
+func countMissing(keys []types.Key, values map[types.Key]types.Value) int {
+	n := 0
+	for _, key := range keys {
+		if _, ok := values[key]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// ratio returns n/d, 0 when d is 0
+func ratio(n, d float64) float64 {
+	if d == 0 {
+		return 0
+	}
+	r := n / d
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		return 0
+	}
+	return r
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database_engine/engine"
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// keyValue is the JSON output of get. Values that aren't UTF-8 are given
+// base64 encoded instead.
+type keyValue struct {
+	Key         types.Key   `json:"key"`
+	Value       *string     `json:"value,omitempty"`
+	ValueBase64 types.Value `json:"value_base64,omitempty"`
+}
+
+func runGet(c *cli, args []string) error {
+	args, err := parseFlags("get", args, 1, 1, nil)
+	if err != nil {
+		return err
+	}
+	key := types.Key(args[0])
+
+	return c.withDB(false, func(db *engine.Database) error {
+		value, err := db.Get(key)
+		if errors.Is(err, types.ErrKeyNotFound) || errors.Is(err, types.ErrKeyExpired) {
+			return &exitError{code: exitNotFound, err: err}
+		}
+		if err != nil {
+			return err
+		}
+
+		out := keyValue{Key: key}
+		if utf8.Valid(value) {
+			s := string(value)
+			out.Value = &s
+		} else {
+			out.ValueBase64 = value
+		}
+		return c.print(out, func(w io.Writer) {
+			w.Write(value)
+			fmt.Fprintln(w)
+		})
+	})
+}
+
+func runSet(c *cli, args []string) error {
+	var ttl time.Duration
+	args, err := parseFlags("set", args, 1, 2, func(flags *flag.FlagSet) {
+		flags.DurationVar(&ttl, "ttl", 0, "")
+	})
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return usageError("--ttl can't be negative")
+	}
+	key := types.Key(args[0])
+
+	var value types.Value
+	if len(args) == 2 {
+		value = types.Value(args[1])
+	} else if value, err = io.ReadAll(c.stdin); err != nil {
+		return fmt.Errorf("failed to read value: %w", err)
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		if ttl > 0 {
+			err = db.SetWithTTL(key, value, ttl)
+		} else {
+			err = db.Set(key, value)
+		}
+		if err != nil {
+			return err
+		}
+		return c.print(map[string]any{"key": key, "value_bytes": len(value)}, func(w io.Writer) {
+			fmt.Fprintln(w, "OK")
+		})
+	})
+}
+
+func runDel(c *cli, args []string) error {
+	args, err := parseFlags("del", args, 1, -1, nil)
+	if err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		deleted := 0
+		for _, arg := range args {
+			key := types.Key(arg)
+			exists, err := db.Exists(key)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			if err := db.Delete(key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return c.print(map[string]int{"deleted": deleted}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted %d\n", deleted)
+		})
+	})
+}
+
+func runKeys(c *cli, args []string) error {
+	var prefix string
+	if _, err := parseFlags("keys", args, 0, 0, func(flags *flag.FlagSet) {
+		flags.StringVar(&prefix, "prefix", "", "")
+	}); err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		keys, err := db.KeysWithPrefix(types.Key(prefix))
+		if err != nil {
+			return err
+		}
+		if keys == nil {
+			keys = []types.Key{}
+		}
+		return c.print(keys, func(w io.Writer) {
+			for _, key := range keys {
+				fmt.Fprintln(w, key)
+			}
+		})
+	})
+}
+
+func runSize(c *cli, args []string) error {
+	if _, err := parseFlags("size", args, 0, 0, nil); err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		size, err := db.Size()
+		if err != nil {
+			return err
+		}
+		return c.print(map[string]int64{"keys": size}, func(w io.Writer) {
+			fmt.Fprintln(w, size)
+		})
+	})
+}
+
+// info is the output of info
+type info struct {
+	Dir       string            `json:"dir"`
+	Keys      int64             `json:"keys"`
+	Config    types.Config      `json:"config"`
+	DiskUsage *engine.DiskUsage `json:"disk_usage"`
+}
+
+func runInfo(c *cli, args []string) error {
+	if _, err := parseFlags("info", args, 0, 0, nil); err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		size, err := db.Size()
+		if err != nil {
+			return err
+		}
+		usage, err := db.GetDiskUsageDetailed()
+		if err != nil {
+			return err
+		}
+		out := info{Dir: c.dir, Keys: size, Config: db.GetConfig(), DiskUsage: usage}
+		return c.print(out, func(w io.Writer) {
+			printFields(w, "", out)
+		})
+	})
+}
+
+func runCompact(c *cli, args []string) error {
+	if _, err := parseFlags("compact", args, 0, 0, nil); err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		before, err := db.GetDiskUsage()
+		if err != nil {
+			return err
+		}
+		if err := db.Compact(); err != nil {
+			return err
+		}
+		after, err := db.GetDiskUsage()
+		if err != nil {
+			return err
+		}
+		return c.print(map[string]int64{"bytes_before": before, "bytes_after": after}, func(w io.Writer) {
+			fmt.Fprintf(w, "compacted %d bytes to %d\n", before, after)
+		})
+	})
+}
+
+func runCleanupExpired(c *cli, args []string) error {
+	if _, err := parseFlags("cleanup-expired", args, 0, 0, nil); err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		removed := db.CleanupExpired()
+		return c.print(map[string]int{"removed": removed}, func(w io.Writer) {
+			fmt.Fprintf(w, "removed %d expired entries\n", removed)
+		})
+	})
+}
+
+func runBackupCreate(c *cli, args []string) error {
+	var description string
+	if _, err := parseFlags("backup create", args, 0, 0, func(flags *flag.FlagSet) {
+		flags.StringVar(&description, "description", "", "")
+	}); err != nil {
+		return err
+	}
+
+	return c.withDB(true, func(db *engine.Database) error {
+		metadata, err := db.CreateBackup(description)
+		if err != nil {
+			return err
+		}
+		return c.print(metadata, func(w io.Writer) {
+			fmt.Fprintf(w, "created backup %s (%d entries)\n", metadata.Name, metadata.EntryCount)
+		})
+	})
+}
+
+func runBackupList(c *cli, args []string) error {
+	if _, err := parseFlags("backup list", args, 0, 0, nil); err != nil {
+		return err
+	}
+
+	return c.withDB(true, func(db *engine.Database) error {
+		backups, err := db.ListBackups()
+		if err != nil {
+			return err
+		}
+		if backups == nil {
+			backups = []persistence.BackupMetadata{}
+		}
+		return c.print(backups, func(w io.Writer) {
+			table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(table, "NAME\tCREATED\tENTRIES\tBYTES\tDESCRIPTION")
+			for _, backup := range backups {
+				fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%s\n", backup.Name, backup.Timestamp.Format(time.RFC3339),
+					backup.EntryCount, backup.DataSize+backup.IndexSize+backup.WALSize, backup.Description)
+			}
+			table.Flush()
+		})
+	})
+}
+
+func runBackupRestore(c *cli, args []string) error {
+	args, err := parseFlags("backup restore", args, 1, 1, nil)
+	if err != nil {
+		return err
+	}
+	name := args[0]
+
+	return c.withDB(true, func(db *engine.Database) error {
+		if err := db.RestoreFromBackup(name); err != nil {
+			return err
+		}
+		return c.print(map[string]string{"restored": name}, func(w io.Writer) {
+			fmt.Fprintf(w, "restored backup %s\n", name)
+		})
+	})
+}
+
+func runBackupDelete(c *cli, args []string) error {
+	args, err := parseFlags("backup delete", args, 1, 1, nil)
+	if err != nil {
+		return err
+	}
+	name := args[0]
+
+	return c.withDB(true, func(db *engine.Database) error {
+		if err := db.DeleteBackup(name); err != nil {
+			return err
+		}
+		return c.print(map[string]string{"deleted": name}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted backup %s\n", name)
+		})
+	})
+}
+
+func runBackupVerify(c *cli, args []string) error {
+	var deep bool
+	args, err := parseFlags("backup verify", args, 1, 1, func(flags *flag.FlagSet) {
+		flags.BoolVar(&deep, "deep", false, "")
+	})
+	if err != nil {
+		return err
+	}
+	name := args[0]
+
+	return c.withDB(true, func(db *engine.Database) error {
+		verification, err := db.VerifyBackup(name, deep)
+		if err != nil {
+			return err
+		}
+		if verification.Discrepancies == nil {
+			verification.Discrepancies = []string{}
+		}
+		if err := c.print(verification, func(w io.Writer) {
+			if verification.Healthy() {
+				fmt.Fprintf(w, "backup %s is healthy (%d files checked)\n", name, verification.FilesChecked)
+			}
+			for _, discrepancy := range verification.Discrepancies {
+				fmt.Fprintln(w, discrepancy)
+			}
+		}); err != nil {
+			return err
+		}
+		if !verification.Healthy() {
+			return &exitError{code: exitUnhealthy, err: fmt.Errorf("backup %s has %d discrepancies", name, len(verification.Discrepancies))}
+		}
+		return nil
+	})
+}
+
+// runWALDump prints the WAL files without opening the database, since
+// opening replays and checkpoints them
+func runWALDump(c *cli, args []string) error {
+	if _, err := parseFlags("wal dump", args, 0, 0, nil); err != nil {
+		return err
+	}
+	config, err := c.config()
+	if err != nil {
+		return err
+	}
+	lock, err := c.lockDir()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	walPath := config.WALFilePath()
+	segments, err := wal.ArchivedSegments(vfs.OS, walPath)
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		paths = append(paths, segment.Path)
+	}
+	if _, err := os.Stat(walPath); err == nil {
+		paths = append(paths, walPath)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no WAL in %s", c.dir)
+	}
+
+	format := wal.DumpText
+	if c.json {
+		format = wal.DumpJSON
+	}
+	for _, path := range paths {
+		if err := wal.DumpFile(vfs.OS, path, c.stdout, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReport is the JSON output of check
+type checkReport struct {
+	Healthy bool     `json:"healthy"`
+	Issues  []string `json:"issues"`
+	*storage.IntegrityReport
+}
+
+func runCheck(c *cli, args []string) error {
+	if _, err := parseFlags("check", args, 0, 0, nil); err != nil {
+		return err
+	}
+
+	return c.withDB(false, func(db *engine.Database) error {
+		report, err := db.CheckIntegrity()
+		if err != nil {
+			return err
+		}
+		out := checkReport{Healthy: report.Healthy(), Issues: report.Issues(), IntegrityReport: report}
+		if out.Issues == nil {
+			out.Issues = []string{}
+		}
+		if err := c.print(out, func(w io.Writer) {
+			fmt.Fprintf(w, "data file: %d bytes, %d valid records (%d live, %d stale, %d tombstones)\n",
+				report.DataFileSize, report.ValidRecords, report.LiveRecords, report.StaleRecords, report.Tombstones)
+			fmt.Fprintf(w, "index: %d entries\n", report.IndexEntries)
+			if len(report.OrphanedRecords) > 0 {
+				fmt.Fprintf(w, "orphaned records: %d\n", len(report.OrphanedRecords))
+			}
+			for _, issue := range out.Issues {
+				fmt.Fprintln(w, issue)
+			}
+			if out.Healthy {
+				fmt.Fprintln(w, "healthy")
+			}
+		}); err != nil {
+			return err
+		}
+		if !out.Healthy {
+			return &exitError{code: exitUnhealthy, err: fmt.Errorf("found %d problems", len(out.Issues))}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,307 @@
+// Command dbcli inspects and maintains the data directory of a disk
+// database from the shell. Run it without arguments for its usage.
+package main
+
+import (
+	"database_engine/engine"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Exit codes
+const (
+	exitOK        = 0
+	exitFailure   = 1 // The command failed
+	exitUsage     = 2 // Bad flags or arguments
+	exitNotFound  = 3 // get of a key that doesn't exist
+	exitLocked    = 4 // Another process has the data directory open
+	exitUnhealthy = 5 // check or backup verify found problems
+)
+
+// exitError is an error that ends dbcli with code instead of exitFailure
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// usageError returns an error ending dbcli with exitUsage
+func usageError(format string, args ...any) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// command is a dbcli subcommand
+type command struct {
+	name     string // One or two words, like "get" or "backup create"
+	args     string // Its flags and arguments, for the usage
+	help     string
+	writable bool // It changes the data, or opens backups, which runs recovery; not allowed with --read-only
+	run      func(c *cli, args []string) error
+}
+
+var commands = []command{
+	{name: "get", args: "KEY", help: "print the value of KEY", run: runGet},
+	{name: "set", args: "[--ttl DURATION] KEY [VALUE]", help: "set KEY to VALUE, read from stdin without it", writable: true, run: runSet},
+	{name: "del", args: "KEY...", help: "delete keys", writable: true, run: runDel},
+	{name: "keys", args: "[--prefix PREFIX]", help: "list the keys in order", run: runKeys},
+	{name: "size", help: "print the number of keys", run: runSize},
+	{name: "info", help: "print the config and disk usage", run: runInfo},
+	{name: "compact", help: "rewrite the data file without dead records", writable: true, run: runCompact},
+	{name: "cleanup-expired", help: "remove expired entries", writable: true, run: runCleanupExpired},
+	{name: "backup create", args: "[--description TEXT]", help: "back up the database", writable: true, run: runBackupCreate},
+	{name: "backup list", help: "list the backups", writable: true, run: runBackupList},
+	{name: "backup restore", args: "NAME", help: "restore the database from a backup", writable: true, run: runBackupRestore},
+	{name: "backup delete", args: "NAME", help: "delete a backup", writable: true, run: runBackupDelete},
+	{name: "backup verify", args: "[--deep] NAME", help: "check a backup against its digests", writable: true, run: runBackupVerify},
+	{name: "wal dump", help: "print every record of the WAL", run: runWALDump},
+	{name: "check", help: "scan the data file against the index", run: runCheck},
+}
+
+// cli holds the global flags and output of a dbcli run
+type cli struct {
+	dir        string
+	configPath string
+	readOnly   bool
+	json       bool
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs dbcli with args and returns its exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	flags := flag.NewFlagSet("dbcli", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&c.dir, "dir", "", "data directory of the database")
+	flags.StringVar(&c.configPath, "config", "", "JSON config file to open the database with")
+	flags.BoolVar(&c.readOnly, "read-only", false, "open without writing or locking the directory, even if another process has it open")
+	flags.BoolVar(&c.json, "json", false, "print JSON instead of text")
+	flags.Usage = func() { printUsage(stderr, flags) }
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	cmd, cmdArgs, ok := findCommand(flags.Args())
+	if !ok || c.dir == "" {
+		if ok {
+			fmt.Fprintln(stderr, "dbcli: --dir is required")
+		}
+		flags.Usage()
+		return exitUsage
+	}
+
+	err := c.runCommand(cmd, cmdArgs)
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "dbcli %s: %v\n", cmd.name, err)
+	var exit *exitError
+	if errors.As(err, &exit) {
+		return exit.code
+	}
+	if errors.Is(err, vfs.ErrLocked) {
+		fmt.Fprintln(stderr, "another process has the database open; pass --read-only to read it anyway")
+		return exitLocked
+	}
+	return exitFailure
+}
+
+// findCommand returns the command args start with and the arguments after
+// its name
+func findCommand(args []string) (command, []string, bool) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+// runCommand checks the global flags for cmd and runs it
+func (c *cli) runCommand(cmd command, args []string) error {
+	if c.readOnly && cmd.writable {
+		return usageError("needs a writable database, so it can't run with --read-only")
+	}
+	info, err := os.Stat(c.dir)
+	if err != nil {
+		return fmt.Errorf("no database in %s: %w", c.dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", c.dir)
+	}
+	return cmd.run(c, args)
+}
+
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: dbcli --dir DIR [--read-only] [--json] [--config FILE] COMMAND [ARGS]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-45s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.help)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	flags.PrintDefaults()
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Exit codes: %d ok, %d failure, %d usage, %d key not found, %d directory in use, %d check failed\n",
+		exitOK, exitFailure, exitUsage, exitNotFound, exitLocked, exitUnhealthy)
+}
+
+// parseFlags parses the flags of cmd, which defines them with define, and
+// returns its arguments, checking there are between min and max of them
+// (max < 0 for any number)
+func parseFlags(cmd string, args []string, min, max int, define func(flags *flag.FlagSet)) ([]string, error) {
+	flags := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	if define != nil {
+		define(flags)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, usageError("%v", err)
+	}
+	rest := flags.Args()
+	if len(rest) < min || (max >= 0 && len(rest) > max) {
+		return nil, usageError("wrong number of arguments")
+	}
+	return rest, nil
+}
+
+// config returns the config to open the database with: the --config file
+// or the default config, for --dir
+func (c *cli) config() (types.Config, error) {
+	config := types.DefaultConfig()
+	if c.configPath != "" {
+		loaded, err := types.LoadConfig(c.configPath)
+		if err != nil {
+			return types.Config{}, err
+		}
+		config = loaded
+	}
+	config.DataDirectory = c.dir
+	return config, nil
+}
+
+// open opens the database, with backups if backups is set. Unless
+// --read-only is set it is opened writable, which fails if another process
+// has it open, and with the WAL if the directory has one, so writes not
+// checkpointed yet are replayed. A read-only open shows the data as of the
+// last checkpoint.
+func (c *cli) open(backups bool) (*engine.Database, error) {
+	config, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.readOnly {
+		config.ReadOnly = true
+		config.WALEnabled = false
+		return engine.Open(c.dir, engine.WithConfig(config))
+	}
+
+	if _, err := os.Stat(config.WALFilePath()); err == nil {
+		config.WALEnabled = true
+	}
+	opts := []engine.Option{engine.WithConfig(config)}
+	if backups {
+		opts = append(opts, engine.WithBackups())
+	}
+	return engine.Open(c.dir, opts...)
+}
+
+// withDB opens the database, runs fn on it and closes it
+func (c *cli) withDB(backups bool, fn func(db *engine.Database) error) error {
+	db, err := c.open(backups)
+	if err != nil {
+		return err
+	}
+	if err := fn(db); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// lockDir locks the data directory the way opening the database does,
+// unless --read-only is set, for commands that read its files directly
+func (c *cli) lockDir() (io.Closer, error) {
+	if c.readOnly {
+		return io.NopCloser(nil), nil
+	}
+	config, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := vfs.Lock(vfs.OS, filepath.Join(c.dir, storage.LockFileName), config.FilePermissions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock data directory %s: %w", c.dir, err)
+	}
+	return lock, nil
+}
+
+// print writes v as JSON with --json, or calls text to write it otherwise
+func (c *cli) print(v any, text func(w io.Writer)) error {
+	if c.json {
+		encoder := json.NewEncoder(c.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	text(c.stdout)
+	return nil
+}
+
+// printFields writes v, which must marshal to a JSON object, as a
+// "name: value" line per field in name order, naming nested fields with
+// dots
+func printFields(w io.Writer, prefix string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintf(w, "%s: %v\n", strings.TrimSuffix(prefix, "."), err)
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		fmt.Fprintf(w, "%s: %s\n", strings.TrimSuffix(prefix, "."), data)
+		return
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := fields[name]
+		if len(value) > 0 && value[0] == '{' {
+			printFields(w, prefix+name+".", value)
+			continue
+		}
+		var s string
+		if json.Unmarshal(value, &s) == nil {
+			value = []byte(s)
+		}
+		fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+	}
+}
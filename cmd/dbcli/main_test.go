@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runMainEnv makes the test binary run dbcli's main instead of the tests,
+// so the tests can drive it as a separate process
+const runMainEnv = "DBCLI_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// result is what a dbcli run printed and its exit code
+type result struct {
+	stdout string
+	stderr string
+	code   int
+}
+
+// dbcli runs dbcli with args and stdin as its input
+func dbcli(t *testing.T, stdin string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	err := cmd.Run()
+	res := result{stdout: stdout.String(), stderr: stderr.String()}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		res.code = exitErr.ExitCode()
+	} else {
+		require.NoError(t, err)
+	}
+	return res
+}
+
+// dbcliJSON runs dbcli with --json and args, checks it succeeded and
+// decodes its output into v
+func dbcliJSON(t *testing.T, v any, args ...string) {
+	t.Helper()
+	res := dbcli(t, "", append([]string{"--json"}, args...)...)
+	require.Equal(t, 0, res.code, res.stderr)
+	require.NoError(t, json.Unmarshal([]byte(res.stdout), v), res.stdout)
+}
+
+// newDir returns a data directory holding a database with keys a, b and
+// c:1
+func newDir(t *testing.T) string {
+	dir := t.TempDir()
+	db, err := engine.Open(dir)
+	require.NoError(t, err)
+	for _, key := range []types.Key{"a", "b", "c:1"} {
+		require.NoError(t, db.Set(key, types.Value("value of "+key)))
+	}
+	require.NoError(t, db.Close())
+	return dir
+}
+
+func TestUsage(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"help", []string{"-h"}, 0},
+		{"no command", []string{"--dir", dir}, 2},
+		{"unknown command", []string{"--dir", dir, "frobnicate"}, 2},
+		{"unknown subcommand", []string{"--dir", dir, "backup", "frobnicate"}, 2},
+		{"unknown flag", []string{"--dir", dir, "--frobnicate", "size"}, 2},
+		{"no dir", []string{"size"}, 2},
+		{"missing argument", []string{"--dir", dir, "get"}, 2},
+		{"extra argument", []string{"--dir", dir, "size", "extra"}, 2},
+		{"unknown command flag", []string{"--dir", dir, "keys", "--frobnicate"}, 2},
+		{"write while read-only", []string{"--dir", dir, "--read-only", "set", "key", "value"}, 2},
+		{"missing dir", []string{"--dir", filepath.Join(dir, "missing"), "size"}, 1},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			res := dbcli(t, "", tt.args...)
+			assert.Equal(t, tt.code, res.code, res.stderr)
+			if tt.code == 2 && len(tt.args) < 3 {
+				assert.Contains(t, res.stderr, "usage: dbcli")
+			}
+		})
+	}
+
+	// A missing directory isn't created
+	_, err := os.Stat(filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestKeyCommands(t *testing.T) {
+	dir := newDir(t)
+
+	res := dbcli(t, "", "--dir", dir, "get", "a")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Equal(t, "value of a\n", res.stdout)
+	res = dbcli(t, "", "--dir", dir, "get", "missing")
+	assert.Equal(t, 3, res.code)
+	assert.Contains(t, res.stderr, "key not found")
+
+	res = dbcli(t, "", "--dir", dir, "set", "d", "new")
+	require.Equal(t, 0, res.code, res.stderr)
+	res = dbcli(t, "from stdin", "--dir", dir, "set", "--ttl", "1h", "e")
+	require.Equal(t, 0, res.code, res.stderr)
+	var value struct{ Key, Value string }
+	dbcliJSON(t, &value, "--dir", dir, "get", "e")
+	assert.Equal(t, "e", value.Key)
+	assert.Equal(t, "from stdin", value.Value)
+
+	res = dbcli(t, "", "--dir", dir, "keys")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Equal(t, "a\nb\nc:1\nd\ne\n", res.stdout)
+	var keys []string
+	dbcliJSON(t, &keys, "--dir", dir, "keys", "--prefix", "c:")
+	assert.Equal(t, []string{"c:1"}, keys)
+
+	var deleted struct{ Deleted int }
+	dbcliJSON(t, &deleted, "--dir", dir, "del", "a", "d", "missing")
+	assert.Equal(t, 2, deleted.Deleted)
+	res = dbcli(t, "", "--dir", dir, "size")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Equal(t, "3\n", res.stdout)
+
+	// The changes are in the database
+	db, err := engine.Open(dir, engine.WithReadOnly())
+	require.NoError(t, err)
+	defer db.Close()
+	keys = nil
+	all, err := db.Keys()
+	require.NoError(t, err)
+	for _, key := range all {
+		keys = append(keys, string(key))
+	}
+	assert.ElementsMatch(t, []string{"b", "c:1", "e"}, keys)
+}
+
+func TestInfoAndMaintenance(t *testing.T) {
+	dir := newDir(t)
+
+	var info struct {
+		Keys      int64
+		Config    types.Config
+		DiskUsage engine.DiskUsage `json:"disk_usage"`
+	}
+	dbcliJSON(t, &info, "--dir", dir, "info")
+	assert.Equal(t, int64(3), info.Keys)
+	assert.Equal(t, dir, info.Config.DataDirectory)
+	assert.Positive(t, info.DiskUsage.DataFileSize)
+	res := dbcli(t, "", "--dir", dir, "info")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Contains(t, res.stdout, "keys: 3\n")
+	assert.Contains(t, res.stdout, "config.data_directory: "+dir+"\n")
+	assert.Contains(t, res.stdout, "disk_usage.data_file_size: ")
+
+	// Overwrites leave dead records for compact to drop
+	for i := 0; i < 3; i++ {
+		res = dbcli(t, "", "--dir", dir, "set", "a", strings.Repeat("x", 100))
+		require.Equal(t, 0, res.code, res.stderr)
+	}
+	var compacted struct {
+		Before int64 `json:"bytes_before"`
+		After  int64 `json:"bytes_after"`
+	}
+	dbcliJSON(t, &compacted, "--dir", dir, "compact")
+	assert.Less(t, compacted.After, compacted.Before)
+
+	res = dbcli(t, "", "--dir", dir, "set", "--ttl", "1ms", "short", "lived")
+	require.Equal(t, 0, res.code, res.stderr)
+	time.Sleep(10 * time.Millisecond)
+	res = dbcli(t, "", "--dir", dir, "cleanup-expired")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Equal(t, "removed 1 expired entries\n", res.stdout)
+}
+
+func TestBackupCommands(t *testing.T) {
+	dir := newDir(t)
+
+	var metadata struct{ Name, Description string }
+	dbcliJSON(t, &metadata, "--dir", dir, "backup", "create", "--description", "before")
+	require.NotEmpty(t, metadata.Name)
+	assert.Equal(t, "before", metadata.Description)
+
+	res := dbcli(t, "", "--dir", dir, "backup", "list")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Contains(t, res.stdout, metadata.Name)
+	assert.Contains(t, res.stdout, "before")
+
+	var verification struct {
+		Deep          bool
+		Discrepancies []string
+	}
+	dbcliJSON(t, &verification, "--dir", dir, "backup", "verify", "--deep", metadata.Name)
+	assert.True(t, verification.Deep)
+	assert.Empty(t, verification.Discrepancies)
+
+	res = dbcli(t, "", "--dir", dir, "del", "a")
+	require.Equal(t, 0, res.code, res.stderr)
+	res = dbcli(t, "", "--dir", dir, "backup", "restore", metadata.Name)
+	require.Equal(t, 0, res.code, res.stderr)
+	res = dbcli(t, "", "--dir", dir, "get", "a")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Equal(t, "value of a\n", res.stdout)
+
+	// A damaged backup fails verification
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "backups", metadata.Name, "data.db"), []byte("damaged"), 0644))
+	res = dbcli(t, "", "--dir", dir, "backup", "verify", metadata.Name)
+	assert.Equal(t, 5, res.code, res.stderr)
+
+	res = dbcli(t, "", "--dir", dir, "backup", "delete", metadata.Name)
+	require.Equal(t, 0, res.code, res.stderr)
+	var backups []json.RawMessage
+	dbcliJSON(t, &backups, "--dir", dir, "backup", "list")
+	assert.Empty(t, backups)
+}
+
+func TestCheck(t *testing.T) {
+	dir := newDir(t)
+
+	var report struct {
+		Healthy      bool
+		Issues       []string
+		IndexEntries int `json:"index_entries"`
+	}
+	dbcliJSON(t, &report, "--dir", dir, "check")
+	assert.True(t, report.Healthy)
+	assert.Empty(t, report.Issues)
+	assert.Equal(t, 3, report.IndexEntries)
+
+	// Damage the record of a key the index still points at
+	dataPath := filepath.Join(dir, "data.db")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)-5] ^= 0xff
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	res := dbcli(t, "", "--dir", dir, "check")
+	assert.Equal(t, 5, res.code, res.stderr)
+	assert.NotContains(t, res.stdout, "healthy")
+	assert.Contains(t, res.stderr, "problems")
+}
+
+func TestLockedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no advisory locks")
+	}
+	dir := t.TempDir()
+	db, err := engine.Open(dir, engine.WithWAL(0))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Sync())
+
+	res := dbcli(t, "", "--dir", dir, "set", "key", "other")
+	assert.Equal(t, 4, res.code)
+	assert.Contains(t, res.stderr, "--read-only")
+	res = dbcli(t, "", "--dir", dir, "wal", "dump")
+	assert.Equal(t, 4, res.code)
+
+	// Reads can go ahead without the lock
+	res = dbcli(t, "", "--dir", dir, "--read-only", "get", "key")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Equal(t, "value\n", res.stdout)
+	res = dbcli(t, "", "--dir", dir, "--read-only", "wal", "dump")
+	require.Equal(t, 0, res.code, res.stderr)
+	assert.Contains(t, res.stdout, `op=set key="key" value="value"`)
+
+	require.NoError(t, db.Close())
+	res = dbcli(t, "", "--dir", dir, "set", "key", "other")
+	assert.Equal(t, 0, res.code, res.stderr)
+}
@@ -0,0 +1,176 @@
+// Command dbload loads NDJSON or CSV files into the data directory of a
+// disk database with BulkLoadFrom, which skips the WAL and saves the index
+// once at the end rather than as it goes. Run it with -h for its usage.
+package main
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Exit codes, matching dbcli's
+const (
+	exitOK      = 0
+	exitFailure = 1 // The load failed, though it may have stored some entries
+	exitUsage   = 2 // Bad flags or arguments
+	exitLocked  = 4 // Another process has the data directory open
+)
+
+// summary is what a load did
+type summary struct {
+	Entries       int           `json:"entries"`
+	Files         []string      `json:"files"`
+	Elapsed       time.Duration `json:"elapsed"`
+	EntriesPerSec float64       `json:"entries_per_sec"`
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs dbload with args and returns its exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var dir, configPath string
+	var jsonOut bool
+	var progress time.Duration
+	r := &reader{stdin: stdin}
+	flags := flag.NewFlagSet("dbload", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&dir, "dir", "", "data directory of the database, created if it doesn't exist")
+	flags.StringVar(&configPath, "config", "", "JSON config file to open the database with")
+	flags.StringVar(&r.format, "format", "", `input format, "ndjson" or "csv" (default from each file's extension)`)
+	flags.BoolVar(&r.csvHeader, "header", false, "CSV files start with a header row to skip")
+	flags.DurationVar(&r.ttl, "ttl", 0, "TTL of the entries that don't have one of their own")
+	flags.DurationVar(&progress, "progress", 0, "print how many entries are loaded this often")
+	flags.BoolVar(&jsonOut, "json", false, "print the summary as JSON")
+	flags.Usage = func() { printUsage(stderr, flags) }
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	r.paths = flags.Args()
+	var usageErr error
+	switch {
+	case dir == "":
+		usageErr = errors.New("--dir is required")
+	case len(r.paths) == 0:
+		usageErr = errors.New("no files to load")
+	case r.format != "" && r.format != formatNDJSON && r.format != formatCSV:
+		usageErr = fmt.Errorf("unknown --format %q", r.format)
+	case r.ttl < 0:
+		usageErr = errors.New("--ttl can't be negative")
+	}
+	if usageErr != nil {
+		fmt.Fprintf(stderr, "dbload: %v\n", usageErr)
+		flags.Usage()
+		return exitUsage
+	}
+	for _, path := range r.paths {
+		if _, err := fileFormat(path, r.format); err != nil {
+			fmt.Fprintf(stderr, "dbload: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	files := r.paths
+	loaded, elapsed, err := load(dir, configPath, r, progress, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "dbload: %v\n", err)
+		if errors.Is(err, vfs.ErrLocked) {
+			fmt.Fprintln(stderr, "another process has the database open; stop it before loading")
+			return exitLocked
+		}
+		if loaded > 0 {
+			fmt.Fprintf(stderr, "dbload: %d entries were loaded before the failure and kept\n", loaded)
+		}
+		return exitFailure
+	}
+
+	s := summary{Entries: loaded, Files: files, Elapsed: elapsed}
+	if elapsed > 0 {
+		s.EntriesPerSec = float64(loaded) / elapsed.Seconds()
+	}
+	if jsonOut {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(s); err != nil {
+			fmt.Fprintf(stderr, "dbload: %v\n", err)
+			return exitFailure
+		}
+	} else {
+		fmt.Fprintf(stdout, "loaded %d entries from %d files in %s (%.0f entries/s)\n",
+			s.Entries, len(s.Files), s.Elapsed.Round(time.Millisecond), s.EntriesPerSec)
+	}
+	return exitOK
+}
+
+// load opens the database in dir and loads the entries r reads into it,
+// printing progress to stderr every progress if it is set. It returns how
+// many entries it stored, even if it fails, and how long that took.
+func load(dir, configPath string, r *reader, progress time.Duration, stderr io.Writer) (int, time.Duration, error) {
+	defer r.close()
+	config := types.DefaultConfig()
+	if configPath != "" {
+		loaded, err := types.LoadConfig(configPath)
+		if err != nil {
+			return 0, 0, err
+		}
+		config = loaded
+	}
+	config.DataDirectory = dir
+	config.EnableTTL = config.EnableTTL || r.ttl > 0
+	// Writes the WAL holds that weren't checkpointed yet are replayed before
+	// the load, which checkpoints past them
+	if _, err := os.Stat(config.WALFilePath()); err == nil {
+		config.WALEnabled = true
+	}
+
+	db, err := engine.Open(dir, engine.WithConfig(config))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := time.Now()
+	next := r.next
+	if progress > 0 {
+		last := start
+		next = func() (types.Entry, bool, error) {
+			if now := time.Now(); now.Sub(last) >= progress {
+				last = now
+				fmt.Fprintf(stderr, "dbload: read %d entries in %s\n", r.read, now.Sub(start).Round(time.Second))
+			}
+			return r.next()
+		}
+	}
+	loaded, err := db.BulkLoadFrom(next)
+	elapsed := time.Since(start)
+	if closeErr := db.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	return loaded, elapsed, err
+}
+
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "usage: dbload --dir DIR [--format ndjson|csv] [--header] [--ttl DURATION] [--json] FILE...")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Loads the entries of each FILE, "-" for stdin, in order; a later entry for a`)
+	fmt.Fprintln(w, `key replaces an earlier one. NDJSON lines are {"key": ..., "value": ...}, with`)
+	fmt.Fprintln(w, `"value_base64" instead of "value" for binary values and an optional "ttl" like`)
+	fmt.Fprintln(w, `"1h". CSV rows are key,value or key,value,ttl.`)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	flags.PrintDefaults()
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Exit codes: %d ok, %d failure, %d usage, %d directory in use\n", exitOK, exitFailure, exitUsage, exitLocked)
+}
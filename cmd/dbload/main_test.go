@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runMainEnv makes the test binary run dbload's main instead of the tests,
+// so the tests can drive it as a separate process
+const runMainEnv = "DBLOAD_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// result is what a dbload run printed and its exit code
+type result struct {
+	stdout string
+	stderr string
+	code   int
+}
+
+// dbload runs dbload in-process with args and stdin as its input
+func dbload(stdin string, args ...string) result {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return result{stdout: stdout.String(), stderr: stderr.String(), code: code}
+}
+
+// writeFile writes content to name in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+// openDB opens the database in dir, closing it when the test ends
+func openDB(t *testing.T, dir string) *engine.Database {
+	t.Helper()
+	db, err := engine.Open(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestUsage(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{},
+		{"data.csv"},
+		{"--dir", dir},
+		{"--dir", dir, "--format", "xml", "data.csv"},
+		{"--dir", dir, "--ttl", "-1s", "data.csv"},
+		{"--dir", dir, "data.txt"},
+		{"--no-such-flag"},
+	} {
+		res := dbload("", args...)
+		assert.Equal(t, exitUsage, res.code, "args %q", args)
+		assert.NotEmpty(t, res.stderr, "args %q", args)
+	}
+	assert.Equal(t, exitOK, dbload("", "-h").code)
+}
+
+func TestLoadFiles(t *testing.T) {
+	inputs := t.TempDir()
+	ndjson := writeFile(t, inputs, "a.ndjson", `{"key": "a", "value": "one"}
+
+{"key": "b", "value_base64": "AAEC", "ttl": "1h"}
+{"key": "a", "value": "replaced"}
+`)
+	csvFile := writeFile(t, inputs, "b.csv", "key,value,ttl\nc,\"two, with a comma\",\nd,\"multi\nline\",10m\ne,three\n")
+
+	dir := filepath.Join(t.TempDir(), "new")
+	res := dbload("", "--dir", dir, "--header", "--json", ndjson, csvFile)
+	require.Equal(t, exitOK, res.code, res.stderr)
+	var s summary
+	require.NoError(t, json.Unmarshal([]byte(res.stdout), &s))
+	assert.Equal(t, 6, s.Entries)
+	assert.Equal(t, []string{ndjson, csvFile}, s.Files)
+
+	db := openDB(t, dir)
+	for key, want := range map[types.Key]string{
+		"a": "replaced",
+		"b": "\x00\x01\x02",
+		"c": "two, with a comma",
+		"d": "multi\nline",
+		"e": "three",
+	} {
+		value, err := db.Get(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, want, string(value), key)
+	}
+	_, remaining, hasTTL, err := db.GetWithTTL("d")
+	require.NoError(t, err)
+	assert.True(t, hasTTL)
+	assert.InDelta(t, float64(10*time.Minute), float64(remaining), float64(time.Minute))
+	_, _, hasTTL, err = db.GetWithTTL("e")
+	require.NoError(t, err)
+	assert.False(t, hasTTL)
+}
+
+func TestLoadStdinWithDefaultTTL(t *testing.T) {
+	dir := t.TempDir()
+	res := dbload("x,1\ny,2,5m\n", "--dir", dir, "--format", "csv", "--ttl", "1h", "-")
+	require.Equal(t, exitOK, res.code, res.stderr)
+	assert.Contains(t, res.stdout, "loaded 2 entries from 1 files")
+
+	db := openDB(t, dir)
+	_, remaining, hasTTL, err := db.GetWithTTL("x")
+	require.NoError(t, err)
+	assert.True(t, hasTTL)
+	assert.Greater(t, remaining, 50*time.Minute)
+	_, remaining, _, err = db.GetWithTTL("y")
+	require.NoError(t, err)
+	assert.LessOrEqual(t, remaining, 5*time.Minute)
+}
+
+func TestLoadErrors(t *testing.T) {
+	inputs := t.TempDir()
+	for _, tc := range []struct {
+		name    string
+		content string
+		loaded  int
+		err     string
+	}{
+		{"bad.ndjson", "{\"key\": \"a\", \"value\": \"1\"}\nnot json\n", 1, "bad.ndjson:2: invalid character"},
+		{"unknown.ndjson", `{"key": "a", "val": "1"}`, 0, `unknown field "val"`},
+		{"both.ndjson", `{"key": "a", "value": "1", "value_base64": "AA=="}`, 0, "not both"},
+		{"missing.ndjson", `{"key": "a"}`, 0, "missing value"},
+		{"ttl.csv", "a,1,soon\n", 0, `ttl.csv:1: invalid ttl "soon"`},
+		{"fields.csv", "a,1\nb\n", 1, "fields.csv:2: want key,value"},
+		{"quote.csv", "a,\"1\n", 0, "quote.csv:1:"},
+		{"key.csv", ",1\n", 0, "invalid key"},
+	} {
+		path := writeFile(t, inputs, tc.name, tc.content)
+		dir := t.TempDir()
+		res := dbload("", "--dir", dir, path)
+		assert.Equal(t, exitFailure, res.code, tc.name)
+		assert.Contains(t, res.stderr, tc.err, tc.name)
+		if tc.loaded > 0 {
+			assert.Contains(t, res.stderr, fmt.Sprintf("%d entries were loaded", tc.loaded), tc.name)
+		}
+
+		db := openDB(t, dir)
+		size, err := db.Size()
+		require.NoError(t, err)
+		assert.Equal(t, int64(tc.loaded), size, tc.name)
+	}
+
+	res := dbload("", "--dir", t.TempDir(), filepath.Join(inputs, "absent.csv"))
+	assert.Equal(t, exitFailure, res.code)
+	assert.Contains(t, res.stderr, "absent.csv")
+}
+
+func TestLoadSkipsWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.Open(dir, engine.WithWAL(0))
+	require.NoError(t, err)
+	require.NoError(t, db.Set("before", types.Value("logged")))
+	require.NoError(t, db.Close())
+
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&input, "{\"key\": \"key%04d\", \"value\": \"%s\"}\n", i, strings.Repeat("v", 100))
+	}
+	res := dbload(input.String(), "--dir", dir, "--format", "ndjson", "-")
+	require.Equal(t, exitOK, res.code, res.stderr)
+
+	db, err = engine.Open(dir, engine.WithWAL(0))
+	require.NoError(t, err)
+	defer db.Close()
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1001), size)
+	stats, err := db.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.LastLSN)
+}
+
+func TestLockedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no advisory locks")
+	}
+	dir := t.TempDir()
+	db := openDB(t, dir)
+	require.NoError(t, db.Set("key", types.Value("value")))
+
+	cmd := exec.Command(os.Args[0], "--dir", dir, "--format", "csv", "-")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	cmd.Stdin = strings.NewReader("a,1\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(err, &exitErr), "dbload ran: %v", err)
+	assert.Equal(t, exitLocked, exitErr.ExitCode())
+	assert.Contains(t, stderr.String(), "another process has the database open")
+
+	exists, err := db.Exists("a")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database_engine/types"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Input formats
+const (
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// maxLineBytes is the longest NDJSON line read, which bounds the values it
+// can hold
+const maxLineBytes = 256 << 20
+
+// fileFormat returns the format of the file at path: format if it is set,
+// or the one its extension names
+func fileFormat(path, format string) (string, error) {
+	if format != "" {
+		return format, nil
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl", ".json":
+		return formatNDJSON, nil
+	case ".csv":
+		return formatCSV, nil
+	}
+	return "", fmt.Errorf("can't tell the format of %s from its extension; pass --format", path)
+}
+
+// record is a line of NDJSON input, with its value in one of Value or
+// ValueBase64 and an optional TTL like "30s"
+type record struct {
+	Key         types.Key   `json:"key"`
+	Value       *string     `json:"value"`
+	ValueBase64 types.Value `json:"value_base64"`
+	TTL         string      `json:"ttl"`
+}
+
+// entry returns the entry r describes
+func (r *record) entry() (types.Entry, error) {
+	entry := types.Entry{Key: r.Key}
+	switch {
+	case r.Value != nil && r.ValueBase64 != nil:
+		return entry, errors.New("give value or value_base64, not both")
+	case r.Value != nil:
+		entry.Value = types.Value(*r.Value)
+	case r.ValueBase64 != nil:
+		entry.Value = r.ValueBase64
+	default:
+		return entry, errors.New("missing value")
+	}
+	return entry, setTTL(&entry, r.TTL)
+}
+
+// setTTL gives entry the TTL ttl names, if it isn't empty
+func setTTL(entry *types.Entry, ttl string) error {
+	if ttl == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid ttl %q: must be a positive duration", ttl)
+	}
+	entry.TTL = &d
+	return nil
+}
+
+// reader reads the entries of the input files one after the other
+type reader struct {
+	paths     []string
+	format    string // Format of every file, or "" to go by their extensions
+	csvHeader bool   // CSV files start with a header row to skip
+	ttl       time.Duration
+	stdin     io.Reader
+
+	file   io.ReadCloser
+	path   string
+	line   int
+	lines  *bufio.Scanner
+	csv    *csv.Reader
+	header bool // The current file's next CSV row is its header
+	read   int  // Entries read from every file so far
+}
+
+// next returns the next entry, false once every file is read
+func (r *reader) next() (types.Entry, bool, error) {
+	for {
+		if r.file == nil {
+			if len(r.paths) == 0 {
+				return types.Entry{}, false, nil
+			}
+			if err := r.open(r.paths[0]); err != nil {
+				return types.Entry{}, false, err
+			}
+			r.paths = r.paths[1:]
+		}
+
+		entry, ok, err := r.nextInFile()
+		if err != nil {
+			return types.Entry{}, false, fmt.Errorf("%s:%d: %w", r.path, r.line, err)
+		}
+		if ok {
+			if entry.TTL == nil && r.ttl > 0 {
+				ttl := r.ttl
+				entry.TTL = &ttl
+			}
+			r.read++
+			return entry, true, nil
+		}
+		if err := r.close(); err != nil {
+			return types.Entry{}, false, err
+		}
+	}
+}
+
+// open starts reading the file at path, "-" for stdin
+func (r *reader) open(path string) error {
+	format, err := fileFormat(path, r.format)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		r.file = io.NopCloser(r.stdin)
+	} else if r.file, err = os.Open(path); err != nil {
+		return err
+	}
+	r.path, r.line = path, 0
+	r.lines, r.csv = nil, nil
+
+	if format == formatCSV {
+		r.csv = csv.NewReader(bufio.NewReader(r.file))
+		r.csv.FieldsPerRecord = -1
+		r.csv.ReuseRecord = true
+		r.header = r.csvHeader
+		return nil
+	}
+	r.lines = bufio.NewScanner(r.file)
+	r.lines.Buffer(make([]byte, 64*1024), maxLineBytes)
+	return nil
+}
+
+// close finishes reading the current file, if there is one
+func (r *reader) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// nextInFile returns the next entry of the current file, false at its end
+func (r *reader) nextInFile() (types.Entry, bool, error) {
+	if r.csv != nil {
+		return r.nextCSV()
+	}
+	for r.lines.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.lines.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec record
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rec); err != nil {
+			return types.Entry{}, false, err
+		}
+		entry, err := rec.entry()
+		return entry, err == nil, err
+	}
+	return types.Entry{}, false, r.lines.Err()
+}
+
+// nextCSV returns the next entry of the current CSV file, whose rows are
+// key,value or key,value,ttl
+func (r *reader) nextCSV() (types.Entry, bool, error) {
+	for {
+		fields, err := r.csv.Read()
+		if err == io.EOF {
+			return types.Entry{}, false, nil
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				r.line = parseErr.Line
+				err = parseErr.Err
+			}
+			return types.Entry{}, false, err
+		}
+		r.line, _ = r.csv.FieldPos(0)
+		if r.header {
+			r.header = false
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return types.Entry{}, false, fmt.Errorf("want key,value or key,value,ttl, got %d fields", len(fields))
+		}
+
+		entry := types.Entry{Key: types.Key(fields[0]), Value: types.Value(fields[1])}
+		if len(fields) == 3 {
+			if err := setTTL(&entry, fields[2]); err != nil {
+				return types.Entry{}, false, err
+			}
+		}
+		return entry, true, nil
+	}
+}
@@ -46,12 +46,15 @@ func main() {
 }
 
 func demoInMemoryDB() {
-	db := engine.NewInMemoryDB()
+	db, err := engine.OpenInMemory()
+	if err != nil {
+		log.Fatalf("Error creating in-memory database: %v", err)
+	}
 	defer db.Close()
 
 	// Basic operations
 	fmt.Println("Basic Operations:")
-	err := db.Set("memory-key", []byte("memory-value"))
+	err = db.Set("memory-key", []byte("memory-value"))
 	if err != nil {
 		log.Fatalf("Error setting key: %v", err)
 	}
@@ -76,7 +79,10 @@ func demoDiskDB() {
 	tempDir := filepath.Join(os.TempDir(), "database_engine_demo")
 	defer os.RemoveAll(tempDir)
 
-	db, err := engine.NewDiskDB(tempDir)
+	db, err := engine.Open(tempDir,
+		engine.WithCache(8<<20),
+		engine.WithTTLCleanup(time.Minute),
+	)
 	if err != nil {
 		log.Fatalf("Error creating disk database: %v", err)
 	}
@@ -120,7 +126,7 @@ func demoPersistence() {
 
 	// Create database and add data
 	fmt.Println("Creating database and adding data...")
-	db1, err := engine.NewDiskDB(tempDir)
+	db1, err := engine.Open(tempDir)
 	if err != nil {
 		log.Fatalf("Error creating database: %v", err)
 	}
@@ -150,9 +156,9 @@ func demoPersistence() {
 		log.Fatalf("Error closing database: %v", err)
 	}
 
-	// Create new database instance
-	fmt.Println("Reopening database...")
-	db2, err := engine.NewDiskDB(tempDir)
+	// Reopen it read-only; reads work and nothing in the directory changes
+	fmt.Println("Reopening database read-only...")
+	db2, err := engine.Open(tempDir, engine.WithReadOnly())
 	if err != nil {
 		log.Fatalf("Error reopening database: %v", err)
 	}
@@ -215,7 +221,7 @@ func demoPerformanceComparison() {
 
 	// Test disk performance
 	fmt.Println("Testing disk performance...")
-	diskDB, err := engine.NewDiskDB(tempDir)
+	diskDB, err := engine.Open(tempDir)
 	if err != nil {
 		log.Fatalf("Error creating disk database: %v", err)
 	}
@@ -115,6 +115,23 @@ func main() {
 	fmt.Println("\n5. Testing Recovery Operations")
 	fmt.Println("-------------------------------")
 
+	// Run recovery and show what it did
+	report, err := db.PerformRecovery()
+	if err != nil {
+		log.Printf("Recovery failed: %v", err)
+	} else {
+		fmt.Printf("Recovery phases: %v\n", report.Phases)
+		fmt.Printf("WAL entries replayed: %d (%d corrupt skipped)\n", report.WALReplayed, report.WALSkipped)
+		if report.BackupRecovery {
+			fmt.Printf("Restored backup: %s\n", report.Backup)
+		}
+		fmt.Printf("Recovery took: %v\n", report.Duration)
+		fmt.Printf("Remaining issues: %d\n", len(report.Issues))
+		for _, issue := range report.Issues {
+			fmt.Printf("  - %s\n", issue)
+		}
+	}
+
 	// Get recovery state
 	recoveryState := db.GetRecoveryState()
 	if recoveryState != nil {
@@ -159,7 +176,7 @@ func main() {
 
 	// Restore from backup
 	if len(backups) > 0 {
-		backupName := backups[0].Timestamp.Format("20060102_150405")
+		backupName := backups[0].Name
 		fmt.Printf("\nRestoring from backup: %s\n", backupName)
 
 		err = db.RestoreFromBackup(backupName)
@@ -212,7 +229,7 @@ func main() {
 	fmt.Println("-----------------------------")
 
 	if len(backups) > 0 {
-		backupName := backups[0].Timestamp.Format("20060102_150405")
+		backupName := backups[0].Name
 		info, err := db.GetBackupInfo(backupName)
 		if err != nil {
 			log.Printf("Error getting backup info: %v", err)
@@ -228,6 +245,19 @@ func main() {
 			fmt.Printf("  Backup Type: %s\n", info.BackupType)
 			fmt.Printf("  Description: %s\n", info.Description)
 		}
+
+		verification, err := db.VerifyBackup(backupName, true)
+		if err != nil {
+			log.Printf("Error verifying backup: %v", err)
+		} else {
+			fmt.Printf("Deep verification of %s:\n", backupName)
+			fmt.Printf("  Files Checked: %d\n", verification.FilesChecked)
+			fmt.Printf("  Entries Read: %d of %d\n", verification.EntriesRead, verification.EntryCount)
+			fmt.Printf("  Healthy: %t\n", verification.Healthy())
+			for _, discrepancy := range verification.Discrepancies {
+				fmt.Printf("  - %s\n", discrepancy)
+			}
+		}
 	}
 
 	// Test 9: File Structure
@@ -252,6 +282,20 @@ func main() {
 		}
 	}
 
+	// Disk usage breakdown
+	usage, err := db.GetDiskUsageDetailed()
+	if err != nil {
+		log.Printf("Error getting disk usage: %v", err)
+	} else {
+		fmt.Println("\nDisk usage by component:")
+		fmt.Printf("  Data file: %d bytes (%d live, %d dead)\n", usage.DataFileSize, usage.LiveBytes, usage.DeadBytes)
+		fmt.Printf("  Index: %d bytes\n", usage.IndexSize)
+		fmt.Printf("  WAL: %d bytes (+%d bytes in %d archived files)\n", usage.WALSize, usage.ArchivedWALSize, usage.ArchivedWALFiles)
+		fmt.Printf("  Blobs: %d bytes in %d files\n", usage.BlobSize, usage.BlobFiles)
+		fmt.Printf("  Backups: %d bytes\n", usage.BackupSize)
+		fmt.Printf("  Total: %d bytes\n", usage.Total)
+	}
+
 	// Test 10: Cleanup
 	fmt.Println("\n10. Testing Backup Cleanup")
 	fmt.Println("--------------------------")
@@ -266,7 +310,7 @@ func main() {
 
 	// Delete a backup (if we have more than one)
 	if len(backupsBefore) > 1 {
-		backupToDelete := backupsBefore[0].Timestamp.Format("20060102_150405")
+		backupToDelete := backupsBefore[0].Name
 		fmt.Printf("Deleting backup: %s\n", backupToDelete)
 
 		err = db.DeleteBackup(backupToDelete)
@@ -291,6 +335,7 @@ func main() {
 	fmt.Println("- Data integrity validation")
 	fmt.Println("- Recovery point creation")
 	fmt.Println("- Backup restore operations")
+	fmt.Println("- Deep backup verification")
 	fmt.Println("- Recovery mode management")
 	fmt.Println("- Comprehensive error handling")
 	fmt.Println("- File structure and cleanup")
@@ -125,35 +125,25 @@ func main() {
 	defer db3.Close()
 
 	fmt.Println("Adding data to trigger WAL rotation...")
-	
-	// Add data until WAL rotation is needed
+
+	// The WAL is rotated and checkpointed automatically once it reaches
+	// its maximum size
 	for i := 0; i < 20; i++ {
 		key := types.Key(fmt.Sprintf("key-%d", i))
 		value := fmt.Sprintf("value-%d-with-some-additional-data-to-make-it-larger", i)
-		
+
 		err = db3.Set(key, []byte(value))
 		if err != nil {
 			log.Printf("Error setting %s: %v", key, err)
 		}
-		
-		walSize, err := db3.GetWALSize()
-		if err != nil {
-			log.Printf("Error getting WAL size: %v", err)
-		} else {
-			fmt.Printf("WAL Size: %d bytes\n", walSize)
-		}
-		
-		// Check if rotation is needed
-		if walSize >= 100 {
-			fmt.Println("WAL rotation needed, performing rotation...")
-			err = db3.RotateWAL()
-			if err != nil {
-				log.Printf("Error rotating WAL: %v", err)
-			} else {
-				fmt.Println("WAL rotated successfully")
-			}
-			break
-		}
+	}
+
+	walStats, err := db3.GetWALStats()
+	if err != nil {
+		log.Printf("Error getting WAL stats: %v", err)
+	} else {
+		fmt.Printf("WAL Size: %d bytes, %d rotations, %d checkpoints\n",
+			walStats.Size, walStats.Rotations, walStats.Checkpoints)
 	}
 
 	// Test 4: WAL Clear
@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AccessOrder selects how TopKeys ranks keys
+type AccessOrder int
+
+const (
+	ByReads  AccessOrder = iota // Most read keys first
+	ByWrites                    // Most written keys first
+)
+
+// KeyStats are the access statistics recorded for a key
+type KeyStats struct {
+	Key        types.Key `json:"key"`
+	Reads      uint64    `json:"reads"`
+	Writes     uint64    `json:"writes"`
+	LastAccess time.Time `json:"last_access"` // Zero if the key isn't tracked
+}
+
+const (
+	accessStatsShards = 16 // Lock shards of the access tracker
+	accessStatsSample = 5  // Keys compared when picking one to stop tracking
+)
+
+// accessTracker counts reads and writes per key. Each shard holds at most
+// maxPerShard keys; to make room for a new key, the least used of a few
+// keys picked at random is dropped, so hot keys stay tracked while cold
+// ones come and go. A nil tracker records nothing.
+type accessTracker struct {
+	shards      [accessStatsShards]accessShard
+	maxPerShard int
+}
+
+type accessShard struct {
+	mu   sync.Mutex
+	keys map[types.Key]*KeyStats
+}
+
+// newAccessTracker returns a tracker configured from config, or nil when
+// access statistics are disabled
+func newAccessTracker(config types.Config) *accessTracker {
+	if !config.TrackAccessStats {
+		return nil
+	}
+
+	t := &accessTracker{maxPerShard: keysPerShard(config.AccessStatsMaxKeys)}
+	for i := range t.shards {
+		t.shards[i].keys = make(map[types.Key]*KeyStats)
+	}
+	return t
+}
+
+// keysPerShard returns how many keys each shard tracks for the tracker to
+// track maxKeys
+func keysPerShard(maxKeys int) int {
+	if maxKeys <= 0 {
+		maxKeys = types.DefaultAccessStatsMaxKeys
+	}
+	return (maxKeys + accessStatsShards - 1) / accessStatsShards
+}
+
+// resize changes how many keys the tracker tracks, dropping cold keys until
+// each shard is within the new limit. record reads maxPerShard under db.mu
+// held shared, so the caller must hold db.mu exclusively.
+func (t *accessTracker) resize(maxKeys int) {
+	t.maxPerShard = keysPerShard(maxKeys)
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for len(shard.keys) > t.maxPerShard {
+			shard.dropColdest()
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// shardFor hashes a key with FNV-1a to pick its shard
+func (t *accessTracker) shardFor(key types.Key) *accessShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &t.shards[hash%accessStatsShards]
+}
+
+// record adds reads and writes to key's counts
+func (t *accessTracker) record(key types.Key, reads, writes uint64) {
+	if t == nil {
+		return
+	}
+
+	shard := t.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	stats, ok := shard.keys[key]
+	if !ok {
+		if len(shard.keys) >= t.maxPerShard {
+			shard.dropColdest()
+		}
+		stats = &KeyStats{Key: key}
+		shard.keys[key] = stats
+	}
+	stats.Reads += reads
+	stats.Writes += writes
+	stats.LastAccess = time.Now()
+}
+
+func (t *accessTracker) read(key types.Key)  { t.record(key, 1, 0) }
+func (t *accessTracker) write(key types.Key) { t.record(key, 0, 1) }
+
+// dropColdest stops tracking the least used of a sample of keys. The
+// caller must hold shard.mu.
+func (shard *accessShard) dropColdest() {
+	var coldest *KeyStats
+	sampled := 0
+	for _, stats := range shard.keys {
+		if coldest == nil || stats.Reads+stats.Writes < coldest.Reads+coldest.Writes ||
+			(stats.Reads+stats.Writes == coldest.Reads+coldest.Writes && stats.LastAccess.Before(coldest.LastAccess)) {
+			coldest = stats
+		}
+		if sampled++; sampled == accessStatsSample {
+			break
+		}
+	}
+	if coldest != nil {
+		delete(shard.keys, coldest.Key)
+	}
+}
+
+// stats returns a copy of key's statistics
+func (t *accessTracker) stats(key types.Key) KeyStats {
+	shard := t.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if stats, ok := shard.keys[key]; ok {
+		return *stats
+	}
+	return KeyStats{Key: key}
+}
+
+// hits returns the total accesses recorded for key
+func (t *accessTracker) hits(key types.Key) uint64 {
+	stats := t.stats(key)
+	return stats.Reads + stats.Writes
+}
+
+// top returns the n tracked keys with the most reads or writes
+func (t *accessTracker) top(n int, order AccessOrder) []KeyStats {
+	count := func(stats *KeyStats) uint64 {
+		if order == ByWrites {
+			return stats.Writes
+		}
+		return stats.Reads
+	}
+
+	var all []KeyStats
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for _, stats := range shard.keys {
+			if count(stats) > 0 {
+				all = append(all, *stats)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if ci, cj := count(&all[i]), count(&all[j]); ci != cj {
+			return ci > cj
+		}
+		return all[i].Key < all[j].Key
+	})
+	if n >= 0 && n < len(all) {
+		all = all[:n]
+	}
+	return all
+}
+
+// setAccessTracking starts or stops recording access statistics to match
+// config, keeping the counts gathered so far while tracking stays on. An
+// in-memory storage's LFU eviction then starts keys off with their recorded
+// access counts. The caller must hold db.mu or own db exclusively.
+func (db *Database) setAccessTracking(config types.Config) {
+	if config.TrackAccessStats == (db.accessStats != nil) {
+		if db.accessStats != nil {
+			db.accessStats.resize(config.AccessStatsMaxKeys)
+		}
+		return
+	}
+
+	db.accessStats = newAccessTracker(config)
+	if inMemoryStorage, ok := db.storage.(*storage.InMemoryStorage); ok {
+		if db.accessStats != nil {
+			inMemoryStorage.SetAccessCounts(db.accessStats.hits)
+		} else {
+			inMemoryStorage.SetAccessCounts(nil)
+		}
+	}
+}
+
+// KeyStats returns the read and write counts recorded for key. Keys that
+// were never accessed, or dropped to keep the tracker within
+// Config.AccessStatsMaxKeys, report zero counts.
+func (db *Database) KeyStats(key types.Key) (KeyStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return KeyStats{}, types.ErrDatabaseClosed
+	}
+
+	if db.accessStats == nil {
+		return KeyStats{}, fmt.Errorf("access statistics are not enabled")
+	}
+
+	return db.accessStats.stats(key), nil
+}
+
+// TopKeys returns up to n of the tracked keys with the most reads or writes,
+// busiest first. A negative n returns every tracked key that has been read
+// or written.
+func (db *Database) TopKeys(n int, order AccessOrder) ([]KeyStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if db.accessStats == nil {
+		return nil, fmt.Errorf("access statistics are not enabled")
+	}
+
+	return db.accessStats.top(n, order), nil
+}
@@ -0,0 +1,186 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAccessStatsDB(t *testing.T, maxKeys int) *engine.Database {
+	config := types.DefaultConfig()
+	config.TrackAccessStats = true
+	config.AccessStatsMaxKeys = maxKeys
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	return db
+}
+
+func TestKeyStats(t *testing.T) {
+	db := newAccessStatsDB(t, 0)
+	defer db.Close()
+
+	before := time.Now()
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.BatchSet([]types.Entry{{Key: "key", Value: types.Value("batch")}}))
+	for i := 0; i < 3; i++ {
+		_, err := db.Get("key")
+		require.NoError(t, err)
+	}
+	_, err := db.BatchGet([]types.Key{"key", "missing"})
+	require.NoError(t, err)
+	_, err = db.Exists("key")
+	require.NoError(t, err)
+
+	stats, err := db.KeyStats("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Key("key"), stats.Key)
+	assert.Equal(t, uint64(5), stats.Reads)
+	assert.Equal(t, uint64(2), stats.Writes)
+	assert.False(t, stats.LastAccess.Before(before))
+
+	// Failed reads aren't counted
+	_, err = db.Get("missing")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+	stats, err = db.KeyStats("missing")
+	require.NoError(t, err)
+	assert.Zero(t, stats.Reads)
+	assert.True(t, stats.LastAccess.IsZero())
+}
+
+func TestKeyStatsDisabled(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	_, err := db.KeyStats("key")
+	assert.Error(t, err)
+	_, err = db.TopKeys(10, engine.ByReads)
+	assert.Error(t, err)
+
+	// Tracking can be switched on at runtime
+	config := db.GetConfig()
+	config.TrackAccessStats = true
+	require.NoError(t, db.SetConfig(config))
+	_, err = db.Get("key")
+	require.NoError(t, err)
+
+	stats, err := db.KeyStats("key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Reads)
+
+	// Changing other settings keeps the counts
+	config.MaxKeySize = 512
+	require.NoError(t, db.SetConfig(config))
+	stats, err = db.KeyStats("key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Reads)
+
+	config.TrackAccessStats = false
+	require.NoError(t, db.SetConfig(config))
+	_, err = db.KeyStats("key")
+	assert.Error(t, err)
+}
+
+func TestTopKeys(t *testing.T) {
+	db := newAccessStatsDB(t, 0)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		key := types.Key(fmt.Sprintf("key-%d", i))
+		for j := 0; j <= i; j++ {
+			require.NoError(t, db.Set(key, types.Value("value")))
+		}
+		for j := 0; j < 5-i; j++ {
+			_, err := db.Get(key)
+			require.NoError(t, err)
+		}
+	}
+
+	top, err := db.TopKeys(2, engine.ByReads)
+	require.NoError(t, err)
+	require.Len(t, top, 2)
+	assert.Equal(t, types.Key("key-0"), top[0].Key)
+	assert.Equal(t, uint64(5), top[0].Reads)
+	assert.Equal(t, types.Key("key-1"), top[1].Key)
+
+	top, err = db.TopKeys(2, engine.ByWrites)
+	require.NoError(t, err)
+	require.Len(t, top, 2)
+	assert.Equal(t, types.Key("key-4"), top[0].Key)
+	assert.Equal(t, uint64(5), top[0].Writes)
+	assert.Equal(t, types.Key("key-3"), top[1].Key)
+
+	all, err := db.TopKeys(-1, engine.ByWrites)
+	require.NoError(t, err)
+	assert.Len(t, all, 5)
+}
+
+func TestAccessStatsBounded(t *testing.T) {
+	const maxKeys = 160
+	db := newAccessStatsDB(t, maxKeys)
+	defer db.Close()
+
+	require.NoError(t, db.Set("hot", types.Value("value")))
+	for i := 0; i < 100; i++ {
+		_, err := db.Get("hot")
+		require.NoError(t, err)
+	}
+
+	// A stream of cold keys never pushes out the hot one
+	for i := 0; i < 10000; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("cold-%d", i)), types.Value("value")))
+	}
+
+	all, err := db.TopKeys(-1, engine.ByWrites)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(all), maxKeys)
+
+	stats, err := db.KeyStats("hot")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), stats.Reads)
+}
+
+func TestAccessStatsLFUEviction(t *testing.T) {
+	value := types.Value("0123456789")
+	entrySize := int64(len("key-00")+len(value)) + 64
+
+	for _, tracked := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Tracked=%v", tracked), func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.MaxMemorySize = 10 * entrySize
+			config.EvictionPolicy = types.EvictionLFU
+			config.TrackAccessStats = tracked
+			db, err := engine.NewInMemoryDBWithConfig(config)
+			require.NoError(t, err)
+			defer db.Close()
+
+			// A busy key is deleted and written again, resetting the
+			// storage's own hit count
+			require.NoError(t, db.Set("hot-00", value))
+			for i := 0; i < 5; i++ {
+				_, err := db.Get("hot-00")
+				require.NoError(t, err)
+			}
+			require.NoError(t, db.Delete("hot-00"))
+			require.NoError(t, db.Set("hot-00", value))
+
+			for i := 0; i < 10; i++ {
+				require.NoError(t, db.Set(types.Key(fmt.Sprintf("key-%02d", i)), value))
+			}
+
+			// With recorded counts LFU keeps the busy key; without them it
+			// is just the oldest key used once
+			exists, err := db.Exists("hot-00")
+			require.NoError(t, err)
+			assert.Equal(t, tracked, exists)
+			exists, err = db.Exists("key-00")
+			require.NoError(t, err)
+			assert.Equal(t, !tracked, exists)
+		})
+	}
+}
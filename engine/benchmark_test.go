@@ -5,6 +5,7 @@ import (
 	"database_engine/types"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func BenchmarkSet(b *testing.B) {
@@ -128,3 +129,90 @@ func BenchmarkConcurrentGet(b *testing.B) {
 		}
 	})
 }
+
+// The ordered backend trades slower point operations for cheap range scans;
+// compare with BenchmarkSet, BenchmarkGet and the hash map range fallback.
+
+func BenchmarkOrderedSet(b *testing.B) {
+	db := engine.NewOrderedInMemoryDB()
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := types.Key(fmt.Sprintf("key-%d", i))
+		value := types.Value(fmt.Sprintf("value-%d", i))
+		db.Set(key, value)
+	}
+}
+
+func BenchmarkOrderedGet(b *testing.B) {
+	db := engine.NewOrderedInMemoryDB()
+	defer db.Close()
+
+	// Pre-populate with data
+	for i := 0; i < 1000; i++ {
+		key := types.Key(fmt.Sprintf("key-%d", i))
+		value := types.Value(fmt.Sprintf("value-%d", i))
+		db.Set(key, value)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := types.Key(fmt.Sprintf("key-%d", i%1000))
+		db.Get(key)
+	}
+}
+
+func benchmarkRange(b *testing.B, db *engine.Database) {
+	defer db.Close()
+
+	// Pre-populate with data
+	for i := 0; i < 10000; i++ {
+		key := types.Key(fmt.Sprintf("key-%05d", i))
+		value := types.Value(fmt.Sprintf("value-%d", i))
+		db.Set(key, value)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := types.Key(fmt.Sprintf("key-%05d", (i*100)%9900))
+		db.Range(start, "", 100)
+	}
+}
+
+func BenchmarkRange(b *testing.B) {
+	benchmarkRange(b, engine.NewInMemoryDB())
+}
+
+func BenchmarkOrderedRange(b *testing.B) {
+	benchmarkRange(b, engine.NewOrderedInMemoryDB())
+}
+
+// BenchmarkCleanupExpired removes 10,000 expired entries from 1,000,000,
+// the rest of which don't expire
+func BenchmarkCleanupExpired(b *testing.B) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	const keys, expiring = 1000000, 10000
+	entries := make([]types.Entry, 0, keys-expiring)
+	for i := expiring; i < keys; i++ {
+		entries = append(entries, types.Entry{Key: types.Key(fmt.Sprintf("key-%d", i)), Value: types.Value("value")})
+	}
+	if err := db.BatchSet(entries); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < expiring; j++ {
+			db.SetWithTTL(types.Key(fmt.Sprintf("key-%d", j)), types.Value("value"), time.Nanosecond)
+		}
+		b.StartTimer()
+
+		if removed := db.CleanupExpired(); removed != expiring {
+			b.Fatalf("removed %d entries, want %d", removed, expiring)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetConfigRejectsImmutableFields(t *testing.T) {
+	db, err := engine.NewDiskDB(t.TempDir())
+	require.NoError(t, err)
+	defer db.Close()
+	opened := db.GetConfig()
+
+	tests := []struct {
+		field  string
+		modify func(c *types.Config)
+	}{
+		{"EnablePersistence", func(c *types.Config) { c.EnablePersistence = !c.EnablePersistence }},
+		{"DataDirectory", func(c *types.Config) { c.DataDirectory = t.TempDir() }},
+		{"WALEnabled", func(c *types.Config) { c.WALEnabled = !c.WALEnabled }},
+		{"WALSyncPolicy", func(c *types.Config) { c.WALSyncPolicy = types.WALSyncNever }},
+		{"Compression", func(c *types.Config) { c.Compression = types.CompressionGzip }},
+		{"WriteBufferSize", func(c *types.Config) { c.WriteBufferSize = 4096 }},
+		{"FileMode", func(c *types.Config) { c.FileMode = 0600 }},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.field, func(t *testing.T) {
+			config := db.GetConfig()
+			test.modify(&config)
+			// A mutable change alongside is rejected with it
+			config.MaxKeySize = 16
+
+			err := db.SetConfig(config)
+			assert.ErrorIs(t, err, types.ErrConfigImmutable)
+			var immutable *types.ImmutableConfigError
+			require.True(t, errors.As(err, &immutable))
+			assert.Equal(t, []string{test.field}, immutable.Fields)
+			assert.Equal(t, opened, db.GetConfig())
+		})
+	}
+
+	// Setting fixed fields to the values they have is fine
+	config := db.GetConfig()
+	config.MaxKeySize = 16
+	require.NoError(t, db.SetConfig(config))
+	assert.Equal(t, 16, db.GetConfig().MaxKeySize)
+}
+
+func TestSetConfigMutableFields(t *testing.T) {
+	t.Run("MaxKeySize", func(t *testing.T) {
+		db := engine.NewInMemoryDB()
+		defer db.Close()
+		long := types.Key(strings.Repeat("k", 100))
+		require.NoError(t, db.Set(long, types.Value("value")))
+
+		config := db.GetConfig()
+		config.MaxKeySize = 50
+		require.NoError(t, db.SetConfig(config))
+
+		// Longer keys can't be written, but those already stored can still
+		// be read and deleted
+		assert.ErrorIs(t, db.Set(types.Key(strings.Repeat("n", 100)), types.Value("value")), types.ErrInvalidKey)
+		value, err := db.Get(long)
+		require.NoError(t, err)
+		assert.Equal(t, types.Value("value"), value)
+		exists, err := db.Exists(long)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		require.NoError(t, db.Delete(long))
+	})
+
+	t.Run("MaxValueSize", func(t *testing.T) {
+		db := engine.NewInMemoryDB()
+		defer db.Close()
+		require.NoError(t, db.Set("big", make(types.Value, 1000)))
+
+		config := db.GetConfig()
+		config.MaxKeySize = 100
+		config.MaxValueSize = 500
+		require.NoError(t, db.SetConfig(config))
+
+		assert.ErrorIs(t, db.Set("bigger", make(types.Value, 1000)), types.ErrInvalidValue)
+		value, err := db.Get("big")
+		require.NoError(t, err)
+		assert.Len(t, value, 1000)
+	})
+
+	t.Run("MaxMemorySize", func(t *testing.T) {
+		db := engine.NewInMemoryDB()
+		defer db.Close()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%03d", i)), make(types.Value, 1000)))
+		}
+
+		// Lowering the limit evicts right away
+		config := db.GetConfig()
+		config.MaxMemorySize = 20 * 1000
+		require.NoError(t, db.SetConfig(config))
+		size, err := db.Size()
+		require.NoError(t, err)
+		assert.Less(t, size, int64(20))
+	})
+
+	t.Run("CleanupInterval", func(t *testing.T) {
+		config := types.DefaultConfig()
+		config.CleanupInterval = 0
+		db, err := engine.NewInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		defer db.Close()
+		expired := recordExpiries(t, db)
+		require.NoError(t, db.SetWithTTL("session", types.Value("s"), 10*time.Millisecond))
+
+		// Nothing reads the key; the janitor started by SetConfig removes it
+		config.CleanupInterval = 10 * time.Millisecond
+		require.NoError(t, db.SetConfig(config))
+		got := receiveExpiries(t, expired, 1)
+		assert.Equal(t, map[types.Key]string{"session": "s"}, got)
+	})
+
+	t.Run("AccessStatsMaxKeys", func(t *testing.T) {
+		db := newAccessStatsDB(t, 1600)
+		defer db.Close()
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%04d", i)), types.Value("value")))
+		}
+
+		config := db.GetConfig()
+		config.AccessStatsMaxKeys = 160
+		require.NoError(t, db.SetConfig(config))
+		all, err := db.TopKeys(-1, engine.ByWrites)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(all), 160)
+	})
+
+	t.Run("EnableTTL", func(t *testing.T) {
+		db := engine.NewInMemoryDB()
+		defer db.Close()
+
+		config := db.GetConfig()
+		config.EnableTTL = false
+		require.NoError(t, db.SetConfig(config))
+		assert.ErrorIs(t, db.SetWithTTL("key", types.Value("value"), time.Minute), types.ErrTTLDisabled)
+	})
+}
@@ -0,0 +1,339 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceBackends lists every storage backend the conformance suite runs
+// against
+var conformanceBackends = []struct {
+	name  string
+	newDB func(t *testing.T) *engine.Database
+}{
+	{"Memory", func(t *testing.T) *engine.Database { return engine.NewInMemoryDB() }},
+	{"OrderedMemory", func(t *testing.T) *engine.Database { return engine.NewOrderedInMemoryDB() }},
+	{"Disk", func(t *testing.T) *engine.Database {
+		db, err := engine.NewDiskDB(t.TempDir())
+		require.NoError(t, err)
+		return db
+	}},
+}
+
+// conformanceTests is the behavior every StorageEngine must share
+var conformanceTests = []struct {
+	name string
+	run  func(t *testing.T, db *engine.Database)
+}{
+	{"BasicOperations", testConformanceBasicOperations},
+	{"Overwrite", testConformanceOverwrite},
+	{"TTL", testConformanceTTL},
+	{"TTLDisabled", testConformanceTTLDisabled},
+	{"GetWithTTL", testConformanceGetWithTTL},
+	{"ExpireBatch", testConformanceExpireBatch},
+	{"BatchOperations", testConformanceBatchOperations},
+	{"Clear", testConformanceClear},
+	{"Range", testConformanceRange},
+	{"Closed", testConformanceClosed},
+}
+
+func TestStorageConformance(t *testing.T) {
+	for _, backend := range conformanceBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range conformanceTests {
+				test := test
+				t.Run(test.name, func(t *testing.T) {
+					db := backend.newDB(t)
+					defer db.Close()
+					test.run(t, db)
+				})
+			}
+		})
+	}
+}
+
+func testConformanceBasicOperations(t *testing.T, db *engine.Database) {
+	_, err := db.Get("missing")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+
+	value, err := db.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	exists, err := db.Exists("key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	keys, err := db.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Key{"key"}, keys)
+
+	require.NoError(t, db.Delete("key"))
+	_, err = db.Get("key")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	// Deleting a missing key is not an error
+	assert.NoError(t, db.Delete("key"))
+
+	size, err := db.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func testConformanceOverwrite(t *testing.T, db *engine.Database) {
+	require.NoError(t, db.Set("key", types.Value("first")))
+	require.NoError(t, db.Set("key", types.Value("second")))
+
+	value, err := db.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("second"), value)
+
+	size, err := db.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+}
+
+func testConformanceTTL(t *testing.T, db *engine.Database) {
+	require.NoError(t, db.SetWithTTL("short", types.Value("value"), 10*time.Millisecond))
+	require.NoError(t, db.SetWithTTL("long", types.Value("value"), time.Hour))
+
+	value, err := db.Get("short")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	time.Sleep(20 * time.Millisecond)
+
+	exists, err := db.Exists("short")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	size, err := db.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+
+	keys, err := db.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Key{"long"}, keys)
+
+	values, err := db.BatchGet([]types.Key{"short", "long"})
+	assert.NoError(t, err)
+	assert.Len(t, values, 1)
+
+	_, err = db.Get("short")
+	assert.Error(t, err)
+}
+
+func testConformanceTTLDisabled(t *testing.T, db *engine.Database) {
+	require.NoError(t, db.SetWithTTL("short", types.Value("value"), 10*time.Millisecond))
+
+	// Disabled before the entry expires, so the background cleanup, which
+	// wakes up when it does, doesn't remove it first
+	config := db.GetConfig()
+	config.EnableTTL = false
+	require.NoError(t, db.SetConfig(config))
+	time.Sleep(20 * time.Millisecond)
+
+	// TTL writes are refused, and nothing of a refused batch is stored
+	assert.ErrorIs(t, db.SetWithTTL("ttl", types.Value("value"), time.Hour), types.ErrTTLDisabled)
+	ttl := time.Hour
+	err := db.BatchSet([]types.Entry{
+		{Key: "plain", Value: types.Value("value")},
+		{Key: "ttl", Value: types.Value("value"), TTL: &ttl},
+	})
+	assert.ErrorIs(t, err, types.ErrTTLDisabled)
+	exists, err := db.Exists("plain")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	require.NoError(t, db.BatchSet([]types.Entry{{Key: "plain", Value: types.Value("value")}}))
+
+	// The stored TTL is ignored rather than expiring the entry
+	value, err := db.Get("short")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	assert.Zero(t, db.CleanupExpired())
+	keys, err := db.Keys()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []types.Key{"plain", "short"}, keys)
+
+	// and applies again once TTLs are enabled
+	config.EnableTTL = true
+	require.NoError(t, db.SetConfig(config))
+	_, err = db.Get("short")
+	assert.Error(t, err)
+	require.NoError(t, db.SetWithTTL("ttl", types.Value("value"), time.Hour))
+}
+
+func testConformanceGetWithTTL(t *testing.T, db *engine.Database) {
+	_, _, _, err := db.GetWithTTL("missing")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	require.NoError(t, db.Set("plain", types.Value("plain")))
+	value, remaining, hasTTL, err := db.GetWithTTL("plain")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("plain"), value)
+	assert.False(t, hasTTL)
+	assert.Zero(t, remaining)
+
+	require.NoError(t, db.SetWithTTL("session", types.Value("session"), time.Hour))
+	value, remaining, hasTTL, err = db.GetWithTTL("session")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("session"), value)
+	assert.True(t, hasTTL)
+	assert.InDelta(t, time.Hour, remaining, float64(time.Minute))
+
+	// Overwriting without a TTL takes the TTL away with the old value
+	require.NoError(t, db.Set("session", types.Value("kept")))
+	value, _, hasTTL, err = db.GetWithTTL("session")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("kept"), value)
+	assert.False(t, hasTTL)
+
+	require.NoError(t, db.SetWithTTL("short", types.Value("value"), 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	_, _, _, err = db.GetWithTTL("short")
+	assert.Error(t, err)
+}
+
+func testConformanceExpireBatch(t *testing.T, db *engine.Database) {
+	require.NoError(t, db.BatchSet([]types.Entry{
+		{Key: "tenant1:a", Value: types.Value("a")},
+		{Key: "tenant1:b", Value: types.Value("b")},
+		{Key: "tenant2:a", Value: types.Value("c")},
+	}))
+	require.NoError(t, db.SetWithTTL("gone", types.Value("value"), 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+
+	// Values are kept, missing and expired keys are reported, and a key
+	// listed twice counts once
+	touched, missing, err := db.ExpireBatch([]types.Key{"tenant1:a", "tenant1:a", "missing", "gone"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, touched)
+	assert.ElementsMatch(t, []types.Key{"missing", "gone"}, missing)
+	value, remaining, hasTTL, err := db.GetWithTTL("tenant1:a")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("a"), value)
+	assert.True(t, hasTTL)
+	assert.InDelta(t, time.Hour, remaining, float64(time.Minute))
+
+	touched, err = db.ExpireByPrefix("tenant1:", 2*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, touched)
+	_, remaining, _, err = db.GetWithTTL("tenant1:b")
+	require.NoError(t, err)
+	assert.InDelta(t, 2*time.Hour, remaining, float64(time.Minute))
+	_, _, hasTTL, err = db.GetWithTTL("tenant2:a")
+	require.NoError(t, err)
+	assert.False(t, hasTTL)
+
+	// A TTL of zero or less deletes the keys
+	touched, err = db.ExpireByPrefix("tenant1:", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, touched)
+	touched, missing, err = db.ExpireBatch([]types.Key{"tenant2:a"}, -time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, 1, touched)
+	assert.Empty(t, missing)
+	keys, err := db.Keys()
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func testConformanceBatchOperations(t *testing.T, db *engine.Database) {
+	ttl := time.Hour
+	entries := []types.Entry{
+		{Key: "key1", Value: types.Value("value1")},
+		{Key: "key2", Value: types.Value("value2"), TTL: &ttl},
+		{Key: "key3", Value: types.Value("value3")},
+	}
+	require.NoError(t, db.BatchSet(entries))
+
+	values, err := db.BatchGet([]types.Key{"key1", "key2", "key3", "missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[types.Key]types.Value{
+		"key1": types.Value("value1"),
+		"key2": types.Value("value2"),
+		"key3": types.Value("value3"),
+	}, values)
+
+	require.NoError(t, db.BatchDelete([]types.Key{"key1", "key2", "missing"}))
+
+	keys, err := db.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []types.Key{"key3"}, keys)
+}
+
+func testConformanceClear(t *testing.T, db *engine.Database) {
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key-%d", i)), types.Value("value")))
+	}
+
+	require.NoError(t, db.Clear())
+
+	size, err := db.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+
+	// The database stays usable after a clear
+	require.NoError(t, db.Set("key", types.Value("value")))
+	value, err := db.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+}
+
+func testConformanceRange(t *testing.T, db *engine.Database) {
+	for _, key := range []types.Key{"user:3", "order:1", "user:1", "user:2", "users", "order:2"} {
+		require.NoError(t, db.Set(key, types.Value("value-"+key)))
+	}
+	require.NoError(t, db.SetWithTTL("user:0", types.Value("expired"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	entries, err := db.Range("user:", "user;", 0)
+	require.NoError(t, err)
+	var keys []types.Key
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+		assert.Equal(t, types.Value("value-"+entry.Key), entry.Value)
+	}
+	assert.Equal(t, []types.Key{"user:1", "user:2", "user:3"}, keys)
+
+	entries, err = db.Range("order:2", "", 2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, types.Key("order:2"), entries[0].Key)
+	assert.Equal(t, types.Key("user:1"), entries[1].Key)
+
+	keys, err = db.KeysWithPrefix("user")
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"user:1", "user:2", "user:3", "users"}, keys)
+
+	keys, err = db.KeysWithPrefix("missing")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func testConformanceClosed(t *testing.T, db *engine.Database) {
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Close())
+	assert.True(t, db.IsClosed())
+
+	_, err := db.Get("key")
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
+	assert.ErrorIs(t, db.Set("key", types.Value("value")), types.ErrDatabaseClosed)
+	assert.ErrorIs(t, db.Delete("key"), types.ErrDatabaseClosed)
+	_, err = db.Range("", "", 0)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
+	_, err = db.KeysWithPrefix("")
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
+
+	// Closing again is a no-op
+	assert.NoError(t, db.Close())
+}
@@ -1,9 +1,11 @@
 package engine_test
 
 import (
+	"crypto/rand"
 	"database_engine/engine"
 	"database_engine/types"
 	"fmt"
+	"sync/atomic"
 	"testing"
 )
 
@@ -23,6 +25,27 @@ func BenchmarkDiskSet(b *testing.B) {
 	}
 }
 
+func BenchmarkDiskSetBuffered(b *testing.B) {
+	tempDir := b.TempDir()
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = tempDir
+	config.WriteBufferSize = 64 * 1024
+
+	db, err := engine.NewDiskDBWithConfig(config)
+	if err != nil {
+		b.Fatalf("Failed to create disk database: %v", err)
+	}
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := types.Key(fmt.Sprintf("disk-key-%d", i))
+		value := types.Value(fmt.Sprintf("disk-value-%d", i))
+		db.Set(key, value)
+	}
+}
+
 func BenchmarkDiskGet(b *testing.B) {
 	tempDir := b.TempDir()
 	db, err := engine.NewDiskDB(tempDir)
@@ -45,6 +68,32 @@ func BenchmarkDiskGet(b *testing.B) {
 	}
 }
 
+func BenchmarkDiskBinaryValues1KB(b *testing.B) {
+	tempDir := b.TempDir()
+	db, err := engine.NewDiskDB(tempDir)
+	if err != nil {
+		b.Fatalf("Failed to create disk database: %v", err)
+	}
+	defer db.Close()
+
+	value := make([]byte, 1024)
+	rand.Read(value)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := types.Key(fmt.Sprintf("binary-key-%d", i))
+		db.BatchSet([]types.Entry{{Key: key, Value: value}})
+		db.Get(key)
+	}
+	b.StopTimer()
+
+	usage, err := db.GetDiskUsage()
+	if err != nil {
+		b.Fatalf("Failed to get disk usage: %v", err)
+	}
+	b.ReportMetric(float64(usage)/float64(b.N), "disk-bytes/entry")
+}
+
 func BenchmarkDiskDelete(b *testing.B) {
 	tempDir := b.TempDir()
 	db, err := engine.NewDiskDB(tempDir)
@@ -111,6 +160,33 @@ func BenchmarkDiskBatchGet(b *testing.B) {
 	}
 }
 
+func BenchmarkDiskBatchGetScattered(b *testing.B) {
+	tempDir := b.TempDir()
+	db, err := engine.NewDiskDB(tempDir)
+	if err != nil {
+		b.Fatalf("Failed to create disk database: %v", err)
+	}
+	defer db.Close()
+
+	// Pre-populate with data
+	for i := 0; i < 1000; i++ {
+		key := types.Key(fmt.Sprintf("disk-key-%d", i))
+		value := types.Value(fmt.Sprintf("disk-value-%d", i))
+		db.Set(key, value)
+	}
+
+	// Batches whose keys are spread across the whole data file
+	keys := make([]types.Key, 100)
+	for j := range keys {
+		keys[j] = types.Key(fmt.Sprintf("disk-key-%d", (j*397)%1000))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.BatchGet(keys)
+	}
+}
+
 func BenchmarkDiskConcurrentSet(b *testing.B) {
 	tempDir := b.TempDir()
 	db, err := engine.NewDiskDB(tempDir)
@@ -256,3 +332,193 @@ func BenchmarkInMemoryVsDiskGet(b *testing.B) {
 		}
 	})
 }
+
+// BenchmarkDiskOpen measures how long reopening a database with a million
+// keys takes when the index is loaded from index.db and from a hint file
+func BenchmarkDiskOpen(b *testing.B) {
+	const numKeys = 1000000
+
+	for _, bm := range []struct {
+		name         string
+		hintInterval int64
+	}{
+		{"Index", 0},
+		{"Hint", 16 * 1024 * 1024},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			config := types.DefaultConfig()
+			config.EnablePersistence = true
+			config.DataDirectory = b.TempDir()
+			config.WALEnabled = false
+			config.IndexHintInterval = bm.hintInterval
+
+			db, err := engine.NewDiskDBWithConfig(config)
+			if err != nil {
+				b.Fatalf("Failed to create disk database: %v", err)
+			}
+			for i := 0; i < numKeys; i += 10000 {
+				entries := make([]types.Entry, 0, 10000)
+				for j := i; j < i+10000; j++ {
+					entries = append(entries, types.Entry{
+						Key:   types.Key(fmt.Sprintf("disk-key-%d", j)),
+						Value: types.Value(fmt.Sprintf("disk-value-%d", j)),
+					})
+				}
+				if err := db.BatchSet(entries); err != nil {
+					b.Fatalf("Failed to populate database: %v", err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				b.Fatalf("Failed to close database: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db, err := engine.NewDiskDBWithConfig(config)
+				if err != nil {
+					b.Fatalf("Failed to open disk database: %v", err)
+				}
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkDiskWALConcurrentSet(b *testing.B) {
+	for _, policy := range []string{
+		types.WALSyncAlways,
+		types.WALSyncInterval,
+		types.WALSyncEveryN,
+		types.WALSyncNever,
+	} {
+		b.Run(policy, func(b *testing.B) {
+			config := types.DefaultConfig()
+			config.EnablePersistence = true
+			config.DataDirectory = b.TempDir()
+			config.WALEnabled = true
+			config.WALSyncPolicy = policy
+
+			db, err := engine.NewDiskDBWithConfig(config)
+			if err != nil {
+				b.Fatalf("Failed to create disk database: %v", err)
+			}
+			defer db.Close()
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					key := types.Key(fmt.Sprintf("disk-wal-key-%d", i))
+					value := types.Value(fmt.Sprintf("disk-wal-value-%d", i))
+					if err := db.Set(key, value); err != nil {
+						b.Errorf("Failed to set key: %v", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			stats, err := db.GetWALStats()
+			if err != nil {
+				b.Fatalf("Failed to get WAL stats: %v", err)
+			}
+			b.ReportMetric(float64(stats.Syncs)/float64(b.N), "fsyncs/op")
+		})
+	}
+}
+
+// BenchmarkDiskWALLoad compares loading 10,000 entries of 1KB into a new
+// database with WAL-logged Set and BatchSet calls and with BulkLoad and
+// BulkLoadFrom, which skip the WAL. Closing the database, which makes each
+// durable, is included.
+func BenchmarkDiskWALLoad(b *testing.B) {
+	const count, batchSize = 10000, 1000
+	value := make(types.Value, 1024)
+	rand.Read(value)
+	entries := make([]types.Entry, count)
+	for i := range entries {
+		entries[i] = types.Entry{Key: types.Key(fmt.Sprintf("disk-load-key-%d", i)), Value: value}
+	}
+
+	for _, name := range []string{"Set", "BatchSet", "BulkLoad", "BulkLoadFrom"} {
+		name := name
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(count * len(value)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				config := types.DefaultConfig()
+				config.EnablePersistence = true
+				config.DataDirectory = b.TempDir()
+				config.WALEnabled = true
+				db, err := engine.NewDiskDBWithConfig(config)
+				if err != nil {
+					b.Fatalf("Failed to create disk database: %v", err)
+				}
+				b.StartTimer()
+
+				switch name {
+				case "Set":
+					for j := 0; j < count && err == nil; j++ {
+						err = db.Set(entries[j].Key, entries[j].Value)
+					}
+				case "BatchSet":
+					for start := 0; start < count && err == nil; start += batchSize {
+						err = db.BatchSet(entries[start : start+batchSize])
+					}
+				case "BulkLoad":
+					err = db.BulkLoad(entries)
+				case "BulkLoadFrom":
+					j := 0
+					_, err = db.BulkLoadFrom(func() (types.Entry, bool, error) {
+						if j == count {
+							return types.Entry{}, false, nil
+						}
+						j++
+						return entries[j-1], true, nil
+					})
+				}
+				if err != nil {
+					b.Fatalf("Failed to load entries: %v", err)
+				}
+				if err := db.Close(); err != nil {
+					b.Fatalf("Failed to close database: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDiskConcurrentCommit runs read-modify-write loops with
+// SetIfVersion from parallel goroutines, each on keys of its own, so the
+// version checks never conflict and only the appends are serialized.
+func BenchmarkDiskConcurrentCommit(b *testing.B) {
+	tempDir := b.TempDir()
+	db, err := engine.NewDiskDB(tempDir)
+	if err != nil {
+		b.Fatalf("Failed to create disk database: %v", err)
+	}
+	defer db.Close()
+
+	var goroutines atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		g := goroutines.Add(1)
+		i := 0
+		for pb.Next() {
+			key := types.Key(fmt.Sprintf("disk-commit-key-%d-%d", g, i%100))
+			var version uint64
+			if entry, err := db.GetEntry(key); err == nil {
+				version = entry.Version
+			}
+			value := types.Value(fmt.Sprintf("disk-commit-value-%d", i))
+			if err := db.SetIfVersion(key, value, version); err != nil {
+				b.Errorf("Failed to commit key: %v", err)
+				return
+			}
+			i++
+		}
+	})
+}
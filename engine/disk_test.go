@@ -1,10 +1,20 @@
 package engine_test
 
 import (
+	"bytes"
+	"context"
 	"database_engine/engine"
+	"database_engine/persistence"
+	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/vfs"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -96,7 +106,7 @@ func TestDiskDBBasicOperations(t *testing.T) {
 	// Test Get after delete
 	_, err = db.Get(key)
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrKeyNotFound, err)
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
 	
 	// Test Exists after delete
 	exists, err = db.Exists(key)
@@ -191,6 +201,52 @@ func TestDiskDBGetDiskUsage(t *testing.T) {
 	assert.Greater(t, usage2, usage1)
 }
 
+func TestDiskDBGetDiskUsageDetailed(t *testing.T) {
+	tempDir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(tempDir, 1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	require.NoError(t, db.Set("key0", []byte("overwritten")))
+	_, err = db.CreateBackup("usage")
+	require.NoError(t, err)
+	require.NoError(t, db.RotateWAL())
+
+	usage, err := db.GetDiskUsageDetailed()
+	require.NoError(t, err)
+
+	assert.Greater(t, usage.DataFileSize, int64(0))
+	assert.Greater(t, usage.IndexSize, int64(0))
+	assert.Equal(t, 1, usage.ArchivedWALFiles)
+	assert.Greater(t, usage.ArchivedWALSize, int64(0))
+	assert.Greater(t, usage.BackupSize, int64(0))
+	assert.Greater(t, usage.DeadBytes, int64(0)) // The overwritten record
+	assert.Equal(t, usage.DiskUsage.Total()+usage.BackupSize, usage.Total)
+
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, "disk", stats.StorageType)
+	assert.Equal(t, int64(10), stats.Keys)
+	require.NotNil(t, stats.DiskUsage)
+	assert.Equal(t, usage.LiveBytes, stats.DiskUsage.LiveBytes)
+	require.NotNil(t, stats.Storage)
+	assert.Equal(t, int64(11), stats.Storage.Writes)
+	assert.Positive(t, stats.Storage.IndexSaves)
+
+	// In-memory databases have no disk usage
+	memDB := engine.NewInMemoryDB()
+	defer memDB.Close()
+	memStats, err := memDB.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, "memory", memStats.StorageType)
+	assert.Nil(t, memStats.DiskUsage)
+	_, err = memDB.GetDiskUsageDetailed()
+	assert.Error(t, err)
+}
+
 func TestDiskDBCleanupExpired(t *testing.T) {
 	tempDir := t.TempDir()
 	db, err := engine.NewDiskDB(tempDir)
@@ -311,37 +367,571 @@ func TestDiskDBClosedOperations(t *testing.T) {
 	// Test operations on closed database
 	_, err = db.Get("key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	err = db.Set("key", []byte("value"))
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	err = db.Delete("key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	_, err = db.Exists("key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	err = db.Clear()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	_, err = db.Size()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	_, err = db.Keys()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	err = db.Compact()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 	
 	_, err = db.GetDiskUsage()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
+}
+
+func TestDiskDBReadOnly(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = t.TempDir()
+	config.WriteBufferSize = 0
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	db, err := engine.NewWithStorage(diskStorage, config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Ping())
+
+	fsys.InjectWriteFault(vfs.WriteFault{Torn: true, Sticky: true})
+	assert.Error(t, db.Set("full", types.Value("value")))
+
+	err = db.Ping()
+	assert.True(t, errors.Is(err, types.ErrReadOnly))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.True(t, stats.ReadOnly)
+	assert.NotEmpty(t, stats.ReadOnlyReason)
+
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	fsys.ClearWriteFault()
+	require.NoError(t, db.Ping())
+	stats, err = db.GetStats()
+	require.NoError(t, err)
+	assert.False(t, stats.ReadOnly)
+	require.NoError(t, db.Set("full", types.Value("value")))
+
+	require.NoError(t, db.Close())
+	assert.ErrorIs(t, db.Ping(), types.ErrDatabaseClosed)
+	assert.NoError(t, engine.NewInMemoryDB().Ping())
+}
+
+func TestDiskDBCheckpoint(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := engine.NewDiskDBWithWAL(tempDir, 10*1024*1024)
+	require.NoError(t, err)
+	require.NoError(t, db.Set("before", []byte("value")))
+	require.NoError(t, db.Checkpoint())
+	require.NoError(t, db.Set("after", []byte("value")))
+
+	// Only the write after the checkpoint is left to replay
+	stats, err := db.GetWALStats()
+	require.NoError(t, err)
+	require.Len(t, stats.Segments, 1)
+	assert.Equal(t, uint64(1), stats.Checkpoint)
+	require.NoError(t, db.Close())
+
+	db, err = engine.NewDiskDBWithWAL(tempDir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, key := range []types.Key{"before", "after"} {
+		value, err := db.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, types.Value("value"), value)
+	}
+
+	memDB := engine.NewInMemoryDB()
+	defer memDB.Close()
+	assert.Error(t, memDB.Checkpoint())
+}
+
+func TestDiskDBSubscribe(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, err := db.Subscribe(ctx, 1)
+	require.NoError(t, err)
+
+	// Every write reaches the subscriber once, in the order it committed
+	const total = 100
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < total; i++ {
+			var err error
+			key := types.Key(fmt.Sprintf("key%03d", i))
+			if i%10 == 9 {
+				err = db.Delete(types.Key(fmt.Sprintf("key%03d", i-1)))
+			} else {
+				err = db.Set(key, []byte("value"))
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	for i := 0; i < total; i++ {
+		entry, err := sub.Next()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), entry.LSN)
+		if i%10 == 9 {
+			assert.Equal(t, types.Key(fmt.Sprintf("key%03d", i-1)), entry.Key)
+		} else {
+			assert.Equal(t, types.Key(fmt.Sprintf("key%03d", i)), entry.Key)
+		}
+	}
+	require.NoError(t, <-errs)
+	assert.Equal(t, uint64(total), sub.Position())
+
+	memDB := engine.NewInMemoryDB()
+	defer memDB.Close()
+	_, err = memDB.Subscribe(ctx, 1)
+	assert.Error(t, err)
+}
+
+func TestDiskDBWALStats(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	require.NoError(t, db.RotateWAL())
+	require.NoError(t, db.Set("key5", []byte("value")))
+
+	walStats, err := db.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), walStats.Entries)
+	assert.Equal(t, uint64(walStats.TotalSize), walStats.BytesWritten)
+	assert.Equal(t, 1, walStats.ArchivedSegments)
+	assert.Equal(t, walStats.TotalSize-walStats.Size, walStats.ArchivedSize)
+	assert.False(t, walStats.LastRotation.IsZero())
+	assert.Greater(t, walStats.AvgAppendLatency, time.Duration(0))
+	assert.Zero(t, walStats.CheckpointLSN)
+
+	require.NoError(t, db.Checkpoint())
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	require.NotNil(t, stats.WAL)
+	assert.Equal(t, uint64(6), stats.WAL.CheckpointLSN)
+	assert.Equal(t, uint64(6), stats.WAL.LastLSN)
+
+	// A disk database without a WAL reports none
+	plainDB, err := engine.NewDiskDB(t.TempDir())
+	require.NoError(t, err)
+	defer plainDB.Close()
+	stats, err = plainDB.GetStats()
+	require.NoError(t, err)
+	assert.Nil(t, stats.WAL)
+}
+
+func TestDiskDBPrunedBackupsStats(t *testing.T) {
+	tempDir := t.TempDir()
+	partial := filepath.Join(tempDir, types.BackupDirName, "backup_20240101_120000.000000000")
+	require.NoError(t, os.MkdirAll(partial, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(partial, "data.db"), []byte("half a data file"), 0644))
+
+	db, err := engine.NewDiskDBWithWAL(tempDir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.PrunedBackups)
+	assert.NoDirExists(t, partial)
+}
+
+func TestDiskDBReopenDoesNotReplayWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	dataPath := filepath.Join(tempDir, "data.db")
+
+	db, err := engine.NewDiskDBWithWAL(tempDir, 10*1024*1024)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	require.NoError(t, db.Delete("key0"))
+	require.NoError(t, db.Close())
+	info, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	size := info.Size()
+
+	// Reopening without writing leaves the data file as it was
+	for i := 0; i < 5; i++ {
+		db, err = engine.NewDiskDBWithWAL(tempDir, 10*1024*1024)
+		require.NoError(t, err)
+		keys, err := db.Keys()
+		require.NoError(t, err)
+		assert.Len(t, keys, 19)
+		require.NoError(t, db.Close())
+
+		info, err := os.Stat(dataPath)
+		require.NoError(t, err)
+		assert.Equal(t, size, info.Size(), "data.db grew on reopen %d", i+1)
+	}
+}
+
+func TestDiskDBDumpWAL(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Set("key1", []byte("value1")))
+	require.NoError(t, db.Delete("key1"))
+
+	var out bytes.Buffer
+	require.NoError(t, db.DumpWAL(&out))
+	assert.Contains(t, out.String(), `lsn=1 op=set key="key1" value="value1"`)
+	assert.Contains(t, out.String(), `lsn=2 op=delete key="key1"`)
+
+	require.NoError(t, db.Close())
+	assert.ErrorIs(t, db.DumpWAL(&out), types.ErrDatabaseClosed)
+
+	memDB := engine.NewInMemoryDB()
+	defer memDB.Close()
+	assert.Error(t, memDB.DumpWAL(&out))
+}
+
+func TestDiskDBBulkLoad(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Set("key000", []byte("old")))
+	var entries []types.Entry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, types.Entry{Key: types.Key(fmt.Sprintf("key%03d", i)), Value: []byte("loaded")})
+	}
+	require.NoError(t, db.BulkLoad(entries))
+
+	// The load skips the WAL
+	stats, err := db.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.LastLSN)
+	assert.Error(t, db.BulkLoad([]types.Entry{{Key: "", Value: []byte("value")}}))
+	require.NoError(t, db.Close())
+
+	db, err = engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), size)
+	value, err := db.Get("key000")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("loaded"), value)
+
+	// Storage without a WAL stores the entries as a batch
+	memDB := engine.NewInMemoryDB()
+	defer memDB.Close()
+	require.NoError(t, memDB.BulkLoad(entries))
+	size, err = memDB.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), size)
+}
+
+// bulkLoadIter returns an iterator over count entries of 10KB, failing with
+// err after failAt of them if err isn't nil
+func bulkLoadIter(count, failAt int, err error) func() (types.Entry, bool, error) {
+	value := make(types.Value, 10*1024)
+	i := 0
+	return func() (types.Entry, bool, error) {
+		if err != nil && i == failAt {
+			return types.Entry{}, false, err
+		}
+		if i == count {
+			return types.Entry{}, false, nil
+		}
+		i++
+		return types.Entry{Key: types.Key(fmt.Sprintf("key%04d", i-1)), Value: value}, true, nil
+	}
+}
+
+func TestDiskDBBulkLoadFrom(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+
+	// 10MB of entries take several chunks
+	loaded, err := db.BulkLoadFrom(bulkLoadIter(1000, 0, nil))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, loaded)
+	stats, err := db.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), stats.LastLSN)
+
+	// An error from the iterator stops the load after what came before it
+	readErr := errors.New("bad line")
+	require.NoError(t, db.Clear())
+	loaded, err = db.BulkLoadFrom(bulkLoadIter(1000, 600, readErr))
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, 600, loaded)
+
+	// An invalid entry fails its chunk
+	invalid := []types.Entry{{Key: "next", Value: types.Value("value")}, {Key: "", Value: types.Value("value")}}
+	loaded, err = db.BulkLoadFrom(func() (types.Entry, bool, error) {
+		if len(invalid) == 0 {
+			return types.Entry{}, false, nil
+		}
+		entry := invalid[0]
+		invalid = invalid[1:]
+		return entry, true, nil
+	})
+	assert.ErrorIs(t, err, types.ErrInvalidKey)
+	assert.Equal(t, 0, loaded)
+	require.NoError(t, db.Close())
+
+	_, err = db.BulkLoadFrom(bulkLoadIter(1, 0, nil))
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
+
+	db, err = engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(600), size)
+	exists, err := db.Exists("next")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Storage without a WAL stores each chunk as a batch
+	memDB := engine.NewInMemoryDB()
+	defer memDB.Close()
+	loaded, err = memDB.BulkLoadFrom(bulkLoadIter(1000, 0, nil))
+	require.NoError(t, err)
+	assert.Equal(t, 1000, loaded)
+	size, err = memDB.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), size)
+}
+
+func TestDiskDBBackupDuringWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Set(types.Key(fmt.Sprintf("key%d", i%500)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+				t.Errorf("Set failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	var backupLSN uint64
+	for i := 0; i < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		metadata, err := db.CreateBackup(fmt.Sprintf("online %d", i))
+		require.NoError(t, err)
+		assert.Greater(t, metadata.WALLSN, backupLSN)
+		backupLSN = metadata.WALLSN
+
+		// Every index entry of the copy resolves to a record in its data file
+		backupName := metadata.Name
+		report, err := storage.CheckIntegrity(filepath.Join(dir, "backups", backupName))
+		require.NoError(t, err)
+		assert.True(t, report.Healthy(), report.Issues())
+		assert.Equal(t, int(metadata.EntryCount), report.IndexEntries)
+		verification, err := db.VerifyBackup(backupName, true)
+		require.NoError(t, err)
+		assert.True(t, verification.Healthy(), verification.Discrepancies)
+		assert.Equal(t, int(metadata.EntryCount), verification.EntriesRead)
+	}
+	backups, err := db.ListBackups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 3)
+
+	// Writes carried on past the last snapshot
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	<-done
+	stats, err := db.GetWALStats()
+	require.NoError(t, err)
+	assert.Greater(t, stats.LastLSN, backupLSN)
+}
+
+func TestDiskDBRestoreFromBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%02d", i)), []byte("before")))
+	}
+	metadata, err := db.CreateBackup("restore point")
+	require.NoError(t, err)
+	backupName := metadata.Name
+
+	// Grow the data file well past the backup's
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("extra%03d", i)), bytes.Repeat([]byte("x"), 100)))
+	}
+	require.NoError(t, db.Set("key00", []byte("after")))
+
+	// The database serves the restored files straight away
+	require.NoError(t, db.RestoreFromBackup(backupName))
+	value, err := db.Get("key00")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("before"), value)
+	_, err = db.Get("extra000")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), size)
+
+	require.NoError(t, db.Set("key01", []byte("changed")))
+	require.NoError(t, db.Set("new", []byte("value")))
+	value, err = db.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	// A stream restore works the same way
+	var stream bytes.Buffer
+	_, err = db.WriteBackup(&stream, "stream")
+	require.NoError(t, err)
+	require.NoError(t, db.Delete("new"))
+	_, err = db.RestoreBackup(&stream)
+	require.NoError(t, err)
+	value, err = db.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	// And so does an encrypted one, given the right passphrase
+	var encrypted bytes.Buffer
+	enc := persistence.BackupEncryption{Passphrase: "secret"}
+	_, err = db.WriteEncryptedBackup(&encrypted, "encrypted", enc)
+	require.NoError(t, err)
+	require.NoError(t, db.Delete("new"))
+	_, err = db.RestoreEncryptedBackup(bytes.NewReader(encrypted.Bytes()), persistence.BackupEncryption{Passphrase: "guess"})
+	assert.ErrorIs(t, err, persistence.ErrBackupKey)
+	_, err = db.Get("new")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+	_, err = db.RestoreEncryptedBackup(&encrypted, enc)
+	require.NoError(t, err)
+	value, err = db.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	// What was written after the restore survives a reopen
+	require.NoError(t, db.Close())
+	db, err = engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	value, err = db.Get("key01")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("changed"), value)
+	value, err = db.Get("key00")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("before"), value)
+	size, err = db.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(51), size)
+}
+
+func TestDiskDBRestoreToDirectory(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%02d", i)), []byte("before")))
+	}
+	metadata, err := db.CreateBackup("investigation")
+	require.NoError(t, err)
+	require.NoError(t, db.Set("key00", []byte("after")))
+
+	// The restored copy opens as a database of its own next to the live one
+	restoredDir, err := db.RestoreToDirectory(metadata.Name, filepath.Join(t.TempDir(), "restored"))
+	require.NoError(t, err)
+	restored, err := engine.NewDiskDB(restoredDir)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	value, err := restored.Get("key00")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("before"), value)
+	size, err := restored.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), size)
+
+	value, err = db.Get("key00")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("after"), value)
+}
+
+func TestDiskDBReopenWithTTLDisabled(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = t.TempDir()
+	config.WALEnabled = true
+
+	db, err := engine.NewDiskDBWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, db.SetWithTTL("session", []byte("active"), 10*time.Millisecond))
+	require.NoError(t, db.Close())
+	time.Sleep(20 * time.Millisecond)
+
+	// A directory written with TTLs keeps its entries when reopened without
+	// them, and neither reads nor compaction expire them
+	config.EnableTTL = false
+	db, err = engine.NewDiskDBWithConfig(config)
+	require.NoError(t, err)
+	value, err := db.Get("session")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("active"), value)
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Close())
+
+	config.EnableTTL = true
+	db, err = engine.NewDiskDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get("session")
+	assert.Error(t, err)
 }
@@ -0,0 +1,235 @@
+package engine
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrDiskUsage is wrapped by the errors of Ping, and of writes while
+// Config.DiskUsageReadOnly holds them, when disk usage is at the error
+// threshold
+var ErrDiskUsage = errors.New("disk usage above the error threshold")
+
+// DiskUsageLevel is how disk usage compares with the thresholds of the
+// config
+type DiskUsageLevel string
+
+const (
+	DiskUsageOK    DiskUsageLevel = "ok"    // Below every threshold
+	DiskUsageWarn  DiskUsageLevel = "warn"  // At a warn threshold
+	DiskUsageError DiskUsageLevel = "error" // At an error threshold
+)
+
+// diskCheckWriteSize is the size from which a write triggers a disk usage
+// check without waiting for the next one
+const diskCheckWriteSize = 64 * 1024
+
+// DiskUsageStatus is the outcome of a disk usage check
+type DiskUsageStatus struct {
+	Level      DiskUsageLevel `json:"level"`
+	Used       int64          `json:"used"`                  // Bytes the data directory, WAL and backups take
+	VolumeUsed float64        `json:"volume_used,omitempty"` // Fraction of their volume in use, 0 if the filesystem can't tell
+	Reason     string         `json:"reason,omitempty"`      // The threshold crossed, unless Level is DiskUsageOK
+	CheckedAt  time.Time      `json:"checked_at"`
+}
+
+// diskMonitor checks disk usage against the thresholds of the config, in
+// the background every Config.DiskUsageCheckInterval and when a large write
+// asks it to, and tells the OnDiskUsage callbacks when the level changes
+type diskMonitor struct {
+	checkMu   sync.Mutex // Held for a whole check, so callbacks run one at a time
+	mu        sync.Mutex // Guards status and callbacks
+	status    DiskUsageStatus
+	callbacks []func(status DiskUsageStatus)
+	wake      chan struct{} // Asks for a check; holds at most one request
+	stop      chan struct{}
+}
+
+// startDiskMonitor starts checking disk usage if the database is on disk
+// and the config sets a threshold. The caller must own db.
+func (db *Database) startDiskMonitor(config types.Config) {
+	if _, ok := db.storage.(*storage.DiskStorage); !ok {
+		return
+	}
+	if config.DiskUsageWarnBytes <= 0 && config.DiskUsageErrorBytes <= 0 &&
+		config.DiskUsageWarnFraction <= 0 && config.DiskUsageErrorFraction <= 0 {
+		return
+	}
+
+	db.disk = &diskMonitor{
+		status: DiskUsageStatus{Level: DiskUsageOK},
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go db.runDiskMonitor(config.DiskUsageCheckInterval)
+}
+
+// stopDiskMonitor stops the background checks, if they are running
+func (db *Database) stopDiskMonitor() {
+	if db.disk != nil {
+		close(db.disk.stop)
+	}
+}
+
+// runDiskMonitor checks disk usage right away, then every interval and
+// whenever woken, until the monitor is stopped
+func (db *Database) runDiskMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := db.CheckDiskUsage(); errors.Is(err, types.ErrDatabaseClosed) {
+			return
+		} else if err != nil {
+			db.log.Error("failed to check disk usage", "error", err)
+		}
+
+		select {
+		case <-db.disk.stop:
+			return
+		case <-ticker.C:
+		case <-db.disk.wake:
+		}
+	}
+}
+
+// wrote asks for a disk usage check after a write of size bytes, if it is
+// large enough. It is a no-op without a monitor.
+func (m *diskMonitor) wrote(size int) {
+	if size >= diskCheckWriteSize {
+		m.poke()
+	}
+}
+
+// poke asks for a disk usage check without waiting for it. It is a no-op
+// without a monitor.
+func (m *diskMonitor) poke() {
+	if m == nil {
+		return
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// current returns the status of the last check
+func (m *diskMonitor) current() DiskUsageStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// OnDiskUsage registers fn to be called with the new status whenever a
+// check finds disk usage at a different level than the last one: crossing
+// a threshold up or dropping back below it. Calls come one at a time from
+// the goroutine that made the check, normally the background monitor; fn
+// must not call CheckDiskUsage. It fails unless the database is on disk
+// and the config sets a disk usage threshold.
+func (db *Database) OnDiskUsage(fn func(status DiskUsageStatus)) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+	if db.disk == nil {
+		return fmt.Errorf("disk usage monitoring is not enabled")
+	}
+
+	db.disk.mu.Lock()
+	defer db.disk.mu.Unlock()
+	db.disk.callbacks = append(db.disk.callbacks, fn)
+	return nil
+}
+
+// CheckDiskUsage checks disk usage against the thresholds now rather than
+// waiting for the next background check, and returns the status. Like the
+// background checks, it calls the OnDiskUsage callbacks if the level
+// changed and, with Config.DiskUsageReadOnly, holds or releases writes.
+func (db *Database) CheckDiskUsage() (DiskUsageStatus, error) {
+	if db.disk == nil {
+		return DiskUsageStatus{}, fmt.Errorf("disk usage monitoring is not enabled")
+	}
+	db.disk.checkMu.Lock()
+	defer db.disk.checkMu.Unlock()
+
+	status, err := db.measureDiskUsage()
+	if err != nil {
+		return DiskUsageStatus{}, err
+	}
+
+	db.disk.mu.Lock()
+	previous := db.disk.status.Level
+	db.disk.status = status
+	callbacks := db.disk.callbacks
+	db.disk.mu.Unlock()
+
+	if status.Level != previous {
+		switch status.Level {
+		case DiskUsageError:
+			db.log.Error("disk usage above the error threshold", "used", status.Used, "volume_used", status.VolumeUsed, "reason", status.Reason)
+		case DiskUsageWarn:
+			db.log.Warn("disk usage above the warn threshold", "used", status.Used, "volume_used", status.VolumeUsed, "reason", status.Reason)
+		default:
+			db.log.Info("disk usage back below the thresholds", "used", status.Used, "volume_used", status.VolumeUsed)
+		}
+		for _, fn := range callbacks {
+			fn(status)
+		}
+	}
+	return status, nil
+}
+
+// measureDiskUsage measures disk usage, holding writes while it is at the
+// error threshold if the config asks for that, and returns the status
+func (db *Database) measureDiskUsage() (DiskUsageStatus, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return DiskUsageStatus{}, types.ErrDatabaseClosed
+	}
+	diskStorage, ok := db.storage.(*storage.DiskStorage)
+	if !ok {
+		return DiskUsageStatus{}, fmt.Errorf("disk usage monitoring not supported for this storage type")
+	}
+
+	usage, err := db.diskUsageDetailed()
+	if err != nil {
+		return DiskUsageStatus{}, err
+	}
+	status := DiskUsageStatus{Level: DiskUsageOK, Used: usage.Total, CheckedAt: time.Now()}
+	if free, total, err := diskStorage.VolumeSpace(); err == nil && total > 0 {
+		status.VolumeUsed = float64(total-min(free, total)) / float64(total)
+	}
+
+	config := db.config
+	switch {
+	case config.DiskUsageErrorBytes > 0 && status.Used >= config.DiskUsageErrorBytes:
+		status.Level = DiskUsageError
+		status.Reason = fmt.Sprintf("%d bytes used, error threshold %d", status.Used, config.DiskUsageErrorBytes)
+	case config.DiskUsageErrorFraction > 0 && status.VolumeUsed >= config.DiskUsageErrorFraction:
+		status.Level = DiskUsageError
+		status.Reason = fmt.Sprintf("%.1f%% of the volume used, error threshold %.1f%%", status.VolumeUsed*100, config.DiskUsageErrorFraction*100)
+	case config.DiskUsageWarnBytes > 0 && status.Used >= config.DiskUsageWarnBytes:
+		status.Level = DiskUsageWarn
+		status.Reason = fmt.Sprintf("%d bytes used, warn threshold %d", status.Used, config.DiskUsageWarnBytes)
+	case config.DiskUsageWarnFraction > 0 && status.VolumeUsed >= config.DiskUsageWarnFraction:
+		status.Level = DiskUsageWarn
+		status.Reason = fmt.Sprintf("%.1f%% of the volume used, warn threshold %.1f%%", status.VolumeUsed*100, config.DiskUsageWarnFraction*100)
+	}
+
+	if config.DiskUsageReadOnly {
+		if status.Level == DiskUsageError {
+			diskStorage.HoldWrites(fmt.Errorf("%w: %s", ErrDiskUsage, status.Reason))
+		} else {
+			diskStorage.ReleaseWrites()
+		}
+	}
+	return status, nil
+}
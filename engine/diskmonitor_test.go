@@ -0,0 +1,168 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// diskUsageConfig is a config checking disk usage against small thresholds,
+// in the background only when asked to
+func diskUsageConfig() types.Config {
+	config := types.DefaultConfig()
+	config.WriteBufferSize = 0
+	config.DiskUsageWarnBytes = 20 * 1024
+	config.DiskUsageErrorBytes = 200 * 1024
+	config.DiskUsageCheckInterval = time.Hour
+	return config
+}
+
+// nextDiskUsage waits for a status from an OnDiskUsage callback
+func nextDiskUsage(t *testing.T, statuses <-chan engine.DiskUsageStatus) engine.DiskUsageStatus {
+	select {
+	case status := <-statuses:
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatal("no disk usage callback")
+		return engine.DiskUsageStatus{}
+	}
+}
+
+func TestDiskUsageThresholds(t *testing.T) {
+	db, err := engine.Open(t.TempDir(), engine.WithConfig(diskUsageConfig()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	statuses := make(chan engine.DiskUsageStatus, 10)
+	require.NoError(t, db.OnDiskUsage(func(status engine.DiskUsageStatus) { statuses <- status }))
+
+	status, err := db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageOK, status.Level)
+
+	require.NoError(t, db.Set("small", make(types.Value, 30*1024)))
+	status, err = db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageWarn, status.Level)
+	assert.GreaterOrEqual(t, status.Used, int64(30*1024))
+	assert.Contains(t, status.Reason, "warn threshold")
+	assert.Equal(t, engine.DiskUsageWarn, nextDiskUsage(t, statuses).Level)
+	require.NoError(t, db.Ping())
+
+	// A large write checks without waiting for the next interval
+	require.NoError(t, db.Set("large", make(types.Value, 256*1024)))
+	status = nextDiskUsage(t, statuses)
+	assert.Equal(t, engine.DiskUsageError, status.Level)
+	assert.ErrorIs(t, db.Ping(), engine.ErrDiskUsage)
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	require.NotNil(t, stats.DiskUsageStatus)
+	assert.Equal(t, engine.DiskUsageError, stats.DiskUsageStatus.Level)
+	// Without DiskUsageReadOnly writes go on
+	assert.False(t, stats.ReadOnly)
+	require.NoError(t, db.Set("more", types.Value("value")))
+
+	require.NoError(t, db.Delete("large"))
+	require.NoError(t, db.Delete("small"))
+	require.NoError(t, db.Compact())
+	status, err = db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageOK, status.Level)
+	assert.Equal(t, engine.DiskUsageOK, nextDiskUsage(t, statuses).Level)
+	require.NoError(t, db.Ping())
+
+	require.NoError(t, db.Close())
+	_, err = db.CheckDiskUsage()
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
+}
+
+func TestDiskUsageReadOnly(t *testing.T) {
+	config := diskUsageConfig()
+	config.DiskUsageReadOnly = true
+	db, err := engine.Open(t.TempDir(), engine.WithConfig(config))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("large", make(types.Value, 256*1024)))
+	status, err := db.CheckDiskUsage()
+	require.NoError(t, err)
+	require.Equal(t, engine.DiskUsageError, status.Level)
+
+	// Writes adding data are refused rather than failing halfway
+	err = db.Set("key", types.Value("value"))
+	assert.ErrorIs(t, err, types.ErrReadOnly)
+	assert.ErrorIs(t, err, engine.ErrDiskUsage)
+	assert.ErrorIs(t, db.BatchSet([]types.Entry{{Key: "key", Value: types.Value("value")}}), types.ErrReadOnly)
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.True(t, stats.ReadOnly)
+	value, err := db.Get("large")
+	require.NoError(t, err)
+	assert.Len(t, value, 256*1024)
+
+	// Freeing space is allowed, and lets writes through again
+	require.NoError(t, db.Delete("large"))
+	require.NoError(t, db.Compact())
+	status, err = db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageOK, status.Level)
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Ping())
+}
+
+func TestDiskUsageVolumeFraction(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = t.TempDir()
+	config.DiskUsageWarnFraction = 0.8
+	config.DiskUsageErrorFraction = 0.95
+	config.DiskUsageCheckInterval = time.Hour
+	fsys := vfs.NewFaultFS(vfs.OS)
+	fsys.SetTotalSpace(1000)
+	fsys.SetFreeSpace(500)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	db, err := engine.NewWithStorage(diskStorage, config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	status, err := db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageOK, status.Level)
+	assert.InDelta(t, 0.5, status.VolumeUsed, 0.001)
+
+	fsys.SetFreeSpace(150)
+	status, err = db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageWarn, status.Level)
+	assert.Contains(t, status.Reason, "85.0% of the volume used")
+
+	fsys.SetFreeSpace(10)
+	status, err = db.CheckDiskUsage()
+	require.NoError(t, err)
+	assert.Equal(t, engine.DiskUsageError, status.Level)
+	assert.ErrorIs(t, db.Ping(), engine.ErrDiskUsage)
+}
+
+func TestDiskUsageNotEnabled(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+	assert.Error(t, db.OnDiskUsage(func(engine.DiskUsageStatus) {}))
+	_, err := db.CheckDiskUsage()
+	assert.Error(t, err)
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Nil(t, stats.DiskUsageStatus)
+
+	// Nor on disk without thresholds
+	disk, err := engine.Open(t.TempDir())
+	require.NoError(t, err)
+	defer disk.Close()
+	assert.Error(t, disk.OnDiskUsage(func(engine.DiskUsageStatus) {}))
+}
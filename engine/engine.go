@@ -1,15 +1,25 @@
 package engine
 
 import (
+	"context"
 	"database_engine/persistence"
 	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/wal"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Database represents the main database implementation
+// Database represents the main database implementation.
+//
+// mu guards closed, config and the storage handle. Storage engines
+// synchronize access to their own data, so reads and writes only take the
+// read lock and don't serialize on the database.
 type Database struct {
 	storage         types.StorageEngine
 	config          types.Config
@@ -17,147 +27,616 @@ type Database struct {
 	closed          bool
 	backupManager   *persistence.BackupManager
 	recoveryManager *persistence.RecoveryManager
+	accessStats     *accessTracker       // nil unless Config.TrackAccessStats is set
+	latency         *latencyTracker      // nil unless Config.EnableLatencyTracking is set
+	slowOps         atomic.Int64         // Operations that took Config.SlowOpThreshold or longer
+	expiry          *expiryNotifier      // nil until OnExpire is first called
+	janitorStop     chan struct{}        // Closed to stop the background cleanup
+	transactions    transactionSet       // Open transactions, rolled back by Close
+	expvars         []*expvarPublication // Prefixes PublishExpvar published db under
+	hooks           []Hook               // Called around core operations; replaced, never changed, by AddHook
+	events          *eventJournal        // nil unless Config.EventJournalSize is set and there is no WAL
+	disk            *diskMonitor         // nil unless on disk with a disk usage threshold set
+	statsLog        *statsLog            // nil unless on disk with Config.StatsSnapshotInterval set
+	logs            *logOutput           // Where log and the storage's logger write
+	log             *slog.Logger
 }
 
 // NewInMemoryDB creates a new in-memory database
 func NewInMemoryDB() *Database {
 	config := types.DefaultConfig()
-	storage := storage.NewInMemoryStorage()
+	return newDatabase(storage.NewInMemoryStorageWithConfig(config), config)
+}
 
-	return &Database{
-		storage: storage,
-		config:  config,
-		closed:  false,
-	}
+// NewInMemoryDBWithConfig creates a new in-memory database with custom
+// config. Zero values are replaced by defaults as by Config.ApplyDefaults,
+// and the config must then pass Config.Validate.
+func NewInMemoryDBWithConfig(config types.Config) (*Database, error) {
+	return OpenInMemory(WithConfig(config))
 }
 
-// NewInMemoryDBWithConfig creates a new in-memory database with custom config
-func NewInMemoryDBWithConfig(config types.Config) *Database {
-	storage := storage.NewInMemoryStorage()
+// NewOrderedInMemoryDB creates a new in-memory database that keeps keys
+// sorted, making Range and KeysWithPrefix cheap at the cost of slower point
+// operations
+func NewOrderedInMemoryDB() *Database {
+	return newDatabase(storage.NewOrderedInMemoryStorage(), types.DefaultConfig())
+}
 
-	return &Database{
-		storage: storage,
-		config:  config,
-		closed:  false,
+// NewOrderedInMemoryDBWithConfig creates a new ordered in-memory database
+// with custom config, checked like NewInMemoryDBWithConfig's.
+// MaxMemorySize is not enforced by the ordered backend.
+func NewOrderedInMemoryDBWithConfig(config types.Config) (*Database, error) {
+	return OpenInMemory(WithConfig(config), WithOrdered())
+}
+
+// NewWithStorage creates a database on top of any StorageEngine, including
+// ones implemented outside this module. Optional features such as TTLs,
+// compaction and disk usage reporting are available when the engine
+// implements the matching capability interface from the types package.
+// config is checked like NewInMemoryDBWithConfig's.
+func NewWithStorage(s types.StorageEngine, config types.Config) (*Database, error) {
+	config, err := checkConfig(config)
+	if err != nil {
+		return nil, err
 	}
+	return newDatabase(s, config), nil
 }
 
 // NewDiskDB creates a new disk-based database
 func NewDiskDB(dataDir string) (*Database, error) {
-	config := types.DefaultConfig()
-	config.EnablePersistence = true
-	config.DataDirectory = dataDir
+	return Open(dataDir)
+}
 
-	storage, err := storage.NewDiskStorage(dataDir)
-	if err != nil {
-		return nil, err
+// NewDiskDBWithConfig creates a new disk-based database with custom config,
+// checked like NewInMemoryDBWithConfig's. Config.WriteBufferSize only takes
+// effect with Config.WALEnabled.
+func NewDiskDBWithConfig(config types.Config) (*Database, error) {
+	if !config.EnablePersistence {
+		return nil, fmt.Errorf("persistence must be enabled for disk-based storage")
 	}
+	return Open(config.DataDirectory, WithConfig(config))
+}
+
+// NewDiskDBWithWAL creates a new disk-based database with WAL enabled
+func NewDiskDBWithWAL(dataDir string, maxWALSize int64) (*Database, error) {
+	return Open(dataDir, WithWAL(maxWALSize), WithBackups())
+}
 
-	return &Database{
+// newDatabase returns a database on storage with a checked config, starting
+// what the config turns on
+func newDatabase(storage types.StorageEngine, config types.Config) *Database {
+	return newDatabaseWithLogs(storage, config, newLogOutput(config))
+}
+
+// newDatabaseWithLogs is newDatabase logging to logs, which the storage
+// was opened with
+func newDatabaseWithLogs(storage types.StorageEngine, config types.Config, logs *logOutput) *Database {
+	db := &Database{
 		storage: storage,
 		config:  config,
 		closed:  false,
-	}, nil
+		logs:    logs,
+		log:     logs.logger(),
+	}
+	db.setAccessTracking(config)
+	db.setLatencyTracking(config)
+	if _, ok := db.walJournal(); !ok {
+		db.events = newEventJournal(config.EventJournalSize)
+	}
+	db.setTTLEnabled(config)
+	db.startJanitor(config)
+	db.startDiskMonitor(config)
+	db.startStatsLog(config)
+
+	return db
 }
 
-// NewDiskDBWithConfig creates a new disk-based database with custom config
-func NewDiskDBWithConfig(config types.Config) (*Database, error) {
-	if !config.EnablePersistence {
-		return nil, fmt.Errorf("persistence must be enabled for disk-based storage")
+// Get retrieves a value by key
+func (db *Database) Get(key types.Key) (value types.Value, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startOp(latencyGet, key, 1, 0)
+	defer func() {
+		call.info.ValueSize = len(value)
+		db.finishOp(&call, err)
+	}()
+
+	if db.closed {
+		return nil, types.NewOpError("Get", key, types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateLookupKey(key); err != nil {
+		return nil, types.NewOpError("Get", key, err)
 	}
 
-	storage, err := storage.NewDiskStorage(config.DataDirectory)
+	value, err = db.storage.Get(key)
+	db.trace("Get", key, err)
 	if err != nil {
-		return nil, err
+		return nil, types.NewOpError("Get", key, err)
 	}
+	db.accessStats.read(key)
+	return value, nil
+}
 
-	return &Database{
-		storage: storage,
-		config:  config,
-		closed:  false,
-	}, nil
+// Set stores a key-value pair
+func (db *Database) Set(key types.Key, value types.Value) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startOp(latencySet, key, 1, len(value))
+	defer func() { db.finishOp(&call, err) }()
+
+	if db.closed {
+		return types.NewOpError("Set", key, types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateKey(key); err != nil {
+		return types.NewOpError("Set", key, err)
+	}
+
+	if err := db.validateValue(value); err != nil {
+		return types.NewOpError("Set", key, err)
+	}
+
+	unlock := db.events.lock()
+	err = db.storage.Set(key, value)
+	if err == nil {
+		db.events.set(key, value, time.Time{})
+	}
+	unlock()
+	db.disk.wrote(len(value))
+	db.trace("Set", key, err)
+	if err != nil {
+		return types.NewOpError("Set", key, err)
+	}
+	db.accessStats.write(key)
+	return nil
 }
 
-// NewDiskDBWithWAL creates a new disk-based database with WAL enabled
-func NewDiskDBWithWAL(dataDir string, maxWALSize int64) (*Database, error) {
-	config := types.DefaultConfig()
-	config.EnablePersistence = true
-	config.DataDirectory = dataDir
-	config.WALEnabled = true
+// SetWithTTL stores a key-value pair with a time-to-live, moved at random by
+// up to Config.TTLJitterFraction of it
+func (db *Database) SetWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	storage, err := storage.NewDiskStorageWithWAL(dataDir, true, maxWALSize)
+	if db.closed {
+		return types.NewOpError("SetWithTTL", key, types.ErrDatabaseClosed)
+	}
+
+	if !db.config.EnableTTL {
+		return types.NewOpError("SetWithTTL", key, types.ErrTTLDisabled)
+	}
+
+	if err := db.validateKey(key); err != nil {
+		return types.NewOpError("SetWithTTL", key, err)
+	}
+
+	if err := db.validateValue(value); err != nil {
+		return types.NewOpError("SetWithTTL", key, err)
+	}
+
+	ttlStorage, ok := db.storage.(types.TTLStorage)
+	if !ok {
+		return fmt.Errorf("TTL not supported for this storage type")
+	}
+
+	ttl = jitterTTL(ttl, db.config.TTLJitterFraction)
+	unlock := db.events.lock()
+	err := ttlStorage.SetWithTTL(key, value, ttl)
+	if err == nil {
+		db.events.set(key, value, time.Now().Add(ttl))
+	}
+	unlock()
+	db.disk.wrote(len(value))
+	db.trace("SetWithTTL", key, err)
 	if err != nil {
-		return nil, err
+		return types.NewOpError("SetWithTTL", key, err)
 	}
+	db.accessStats.write(key)
+	return nil
+}
 
-	// Initialize persistence managers
-	backupManager, err := persistence.NewBackupManager(dataDir)
+// GetWithTTL retrieves a value by key along with how long it has left to
+// live, read together so a concurrent write can't pair the value with
+// another write's TTL. hasTTL is false, and remaining zero, for entries
+// that don't expire or while TTLs are disabled. Expired keys fail with
+// ErrKeyExpired like Get.
+func (db *Database) GetWithTTL(key types.Key) (value types.Value, remaining time.Duration, hasTTL bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, 0, false, types.NewOpError("GetWithTTL", key, types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateLookupKey(key); err != nil {
+		return nil, 0, false, types.NewOpError("GetWithTTL", key, err)
+	}
+
+	reader, ok := db.storage.(types.EntryReader)
+	if !ok {
+		return nil, 0, false, fmt.Errorf("reading entries with their TTL not supported for this storage type")
+	}
+
+	entry, err := reader.GetEntry(key)
 	if err != nil {
-		storage.Close()
-		return nil, fmt.Errorf("failed to create backup manager: %w", err)
+		return nil, 0, false, types.NewOpError("GetWithTTL", key, err)
+	}
+	db.accessStats.read(key)
+
+	expiry := entry.Expiry()
+	if !db.config.EnableTTL || expiry.IsZero() {
+		return entry.Value, 0, false, nil
+	}
+	// Storage found it live, but it may have expired since
+	remaining = time.Until(expiry)
+	if remaining <= 0 {
+		return nil, 0, false, types.NewOpError("GetWithTTL", key, types.ErrKeyExpired)
+	}
+	return entry.Value, remaining, true, nil
+}
+
+// GetEntry retrieves a copy of the whole entry stored for key: its value
+// along with when the key was created and last updated, how many times it
+// was written, its expiry and its Version, which SetIfVersion and
+// optimistic transactions check to detect writes made since it was read
+func (db *Database) GetEntry(key types.Key) (*types.Entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.NewOpError("GetEntry", key, types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateLookupKey(key); err != nil {
+		return nil, types.NewOpError("GetEntry", key, err)
 	}
 
-	recoveryManager, err := persistence.NewRecoveryManager(dataDir)
+	reader, ok := db.storage.(types.EntryReader)
+	if !ok {
+		return nil, fmt.Errorf("reading entries not supported for this storage type")
+	}
+
+	entry, err := reader.GetEntry(key)
 	if err != nil {
-		storage.Close()
-		return nil, fmt.Errorf("failed to create recovery manager: %w", err)
+		return nil, types.NewOpError("GetEntry", key, err)
 	}
+	db.accessStats.read(key)
+	return entry, nil
+}
 
-	db := &Database{
-		storage:         storage,
-		config:          config,
-		closed:          false,
-		backupManager:   backupManager,
-		recoveryManager: recoveryManager,
+// Delete removes a key-value pair
+func (db *Database) Delete(key types.Key) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startOp(latencyDelete, key, 1, 0)
+	defer func() { db.finishOp(&call, err) }()
+
+	if db.closed {
+		return types.NewOpError("Delete", key, types.ErrDatabaseClosed)
 	}
 
-	// Perform automatic recovery on startup
-	if err := db.recoveryManager.PerformRecovery(); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to perform recovery: %w", err)
+	if err := db.validateLookupKey(key); err != nil {
+		return types.NewOpError("Delete", key, err)
 	}
 
-	return db, nil
+	unlock := db.events.lock()
+	err = db.storage.Delete(key)
+	if err == nil {
+		db.events.batch(nil, []types.Key{key})
+	}
+	unlock()
+	db.trace("Delete", key, err)
+	if err != nil {
+		return types.NewOpError("Delete", key, err)
+	}
+	db.accessStats.write(key)
+	return nil
 }
 
-// Get retrieves a value by key
-func (db *Database) Get(key types.Key) (types.Value, error) {
+// Exists checks if a key exists
+func (db *Database) Exists(key types.Key) (bool, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	if db.closed {
-		return nil, types.ErrDatabaseClosed
+		return false, types.NewOpError("Exists", key, types.ErrDatabaseClosed)
 	}
 
-	if err := db.validateKey(key); err != nil {
+	if err := db.validateLookupKey(key); err != nil {
+		return false, types.NewOpError("Exists", key, err)
+	}
+
+	exists, err := db.storage.Exists(key)
+	if err != nil {
+		return false, types.NewOpError("Exists", key, err)
+	}
+	db.accessStats.read(key)
+	return exists, nil
+}
+
+// BatchGet retrieves multiple values by keys. Invalid keys fail it with a
+// *types.MultiError listing each of them.
+func (db *Database) BatchGet(keys []types.Key) (values map[types.Key]types.Value, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startOp(latencyBatchGet, "", len(keys), 0)
+	defer func() {
+		call.info.ValueSize = valuesSize(values)
+		db.finishOp(&call, err)
+	}()
+
+	if db.closed {
+		return nil, types.NewOpError("BatchGet", "", types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateLookupKeys("BatchGet", keys); err != nil {
 		return nil, err
 	}
 
-	return db.storage.Get(key)
+	values, err = db.storage.BatchGet(keys)
+	db.traceBatch("BatchGet", len(keys), err)
+	if err != nil {
+		return nil, types.NewOpError("BatchGet", "", err)
+	}
+	if db.accessStats != nil {
+		for key := range values {
+			db.accessStats.read(key)
+		}
+	}
+	return values, nil
 }
 
-// Set stores a key-value pair
-func (db *Database) Set(key types.Key, value types.Value) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// BatchSet stores multiple key-value pairs. Entries with a TTL or expiry
+// time are refused with ErrTTLDisabled when the config disables TTLs, and
+// TTLs are jittered like SetWithTTL's. Entries that can't be written fail
+// the whole batch with a *types.MultiError listing each of them.
+func (db *Database) BatchSet(entries []types.Entry) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startOp(latencyBatchSet, "", len(entries), entriesSize(entries))
+	defer func() { db.finishOp(&call, err) }()
 
 	if db.closed {
-		return types.ErrDatabaseClosed
+		return types.NewOpError("BatchSet", "", types.ErrDatabaseClosed)
 	}
 
-	if err := db.validateKey(key); err != nil {
+	return db.batchSet("BatchSet", db.jitterTTLs(entries))
+}
+
+// checkEntries returns a *types.MultiError for op listing the entries that
+// can't be written: those with invalid keys or values, and those that
+// expire while the config disables TTLs. The caller must hold db.mu.
+func (db *Database) checkEntries(op string, entries []types.Entry) error {
+	failed := &types.MultiError{Op: op}
+	for i := range entries {
+		entry := &entries[i]
+		if err := db.validateKey(entry.Key); err != nil {
+			failed.Add(entry.Key, err)
+		} else if err := db.validateValue(entry.Value); err != nil {
+			failed.Add(entry.Key, err)
+		} else if !db.config.EnableTTL && !entry.Expiry().IsZero() {
+			failed.Add(entry.Key, fmt.Errorf("%w: the entry has a TTL", types.ErrTTLDisabled))
+		}
+	}
+	return failed.Err()
+}
+
+// setTTLEnabled turns the storage's expiry on or off to match config, so
+// that with TTLs disabled stored ones are ignored rather than expiring
+// entries. The caller must hold db.mu or own db exclusively.
+func (db *Database) setTTLEnabled(config types.Config) {
+	if toggler, ok := db.storage.(types.TTLToggler); ok {
+		toggler.SetTTLEnabled(config.EnableTTL)
+	}
+}
+
+// batchSet validates and stores entries for op and records the writes; the
+// caller must hold db.mu
+func (db *Database) batchSet(op string, entries []types.Entry) error {
+	if err := db.checkEntries(op, entries); err != nil {
 		return err
 	}
 
-	if err := db.validateValue(value); err != nil {
+	entries = withoutVersions(entries)
+	unlock := db.events.lock()
+	err := db.storage.BatchSet(entries)
+	if err == nil {
+		db.events.batch(entries, nil)
+	}
+	unlock()
+	db.disk.wrote(entriesSize(entries))
+	db.traceBatch(op, len(entries), err)
+	if err != nil {
+		return types.NewOpError(op, "", err)
+	}
+	if db.accessStats != nil {
+		for _, entry := range entries {
+			db.accessStats.write(entry.Key)
+		}
+	}
+	return nil
+}
+
+// withoutVersions returns entries, or copies of them without the versions
+// and revisions they were read with if any has one, so storage gives them
+// new ones rather than keeping ones replays and restores of its own files
+// carry
+func withoutVersions(entries []types.Entry) []types.Entry {
+	for i := range entries {
+		if entries[i].Version != 0 || entries[i].Revision != 0 {
+			copied := make([]types.Entry, len(entries))
+			for j, entry := range entries {
+				entry.Version = 0
+				entry.Revision = 0
+				copied[j] = entry
+			}
+			return copied
+		}
+	}
+	return entries
+}
+
+// BulkLoad stores entries without logging them to the WAL, for loading
+// large amounts of data quickly. Disk storage writes them straight to the
+// data file and checkpoints before and after, so the load is durable once
+// BulkLoad returns; a crash before then loses some or all of it. Storage
+// without a WAL stores them with BatchSet.
+func (db *Database) BulkLoad(entries []types.Entry) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return types.NewOpError("BulkLoad", "", types.ErrDatabaseClosed)
+	}
+
+	if err := db.checkEntries("BulkLoad", entries); err != nil {
 		return err
 	}
+	_, err := db.bulkLoad(func() (types.Entry, bool, error) {
+		if len(entries) == 0 {
+			return types.Entry{}, false, nil
+		}
+		entry := entries[0]
+		entries = entries[1:]
+		return entry, true, nil
+	})
+	return err
+}
 
-	return db.storage.Set(key, value)
+// bulkLoadChunkSize is about how many bytes of entries BulkLoadFrom
+// validates and stores at a time
+const bulkLoadChunkSize = 4 << 20
+
+// BulkLoadFrom is BulkLoad for loads too large to hold in memory: it stores
+// the entries next returns until it returns false, validating and writing
+// them about 4MB at a time, and returns how many it stored. Disk storage
+// checkpoints once before and once after the whole load. Other writes wait
+// until it is done, so next must not write to the database.
+//
+// An error from next ends the load once the entries it returned before are
+// stored. An invalid entry ends it without storing the chunk it is in. The
+// entries stored either way are kept and checkpointed, and the error is
+// returned with their count.
+func (db *Database) BulkLoadFrom(next func() (types.Entry, bool, error)) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, types.NewOpError("BulkLoad", "", types.ErrDatabaseClosed)
+	}
+	return db.bulkLoad(next)
 }
 
-// SetWithTTL stores a key-value pair with a time-to-live
-func (db *Database) SetWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+// bulkLoad stores the entries next returns a chunk at a time and records
+// the writes; the caller must hold db.mu
+func (db *Database) bulkLoad(next func() (types.Entry, bool, error)) (int, error) {
+	// Writes that would record events wait on the storage, so the journal
+	// stays locked for the whole load
+	unlock := db.events.lock()
+	defer unlock()
+
+	load, finish := db.storage.BatchSet, func() error { return nil }
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		loader, err := diskStorage.StartBulkLoad()
+		if err != nil {
+			return 0, types.NewOpError("BulkLoad", "", err)
+		}
+		load, finish = loader.Load, loader.Finish
+	}
+
+	loaded := 0
+	for more := true; more; {
+		var chunk []types.Entry
+		var nextErr error
+		for size := 0; size < bulkLoadChunkSize; {
+			entry, ok, err := next()
+			if err != nil || !ok {
+				more, nextErr = false, err
+				break
+			}
+			chunk = append(chunk, entry)
+			size += len(entry.Key) + len(entry.Value)
+		}
+
+		err := db.loadChunk(chunk, load)
+		if err == nil {
+			loaded += len(chunk)
+			err = nextErr
+		}
+		if err != nil {
+			finish()
+			return loaded, err
+		}
+	}
+
+	if err := finish(); err != nil {
+		return loaded, types.NewOpError("BulkLoad", "", err)
+	}
+	return loaded, nil
+}
+
+// loadChunk validates and stores a chunk of a bulk load with load and
+// records the writes
+func (db *Database) loadChunk(chunk []types.Entry, load func([]types.Entry) error) error {
+	if len(chunk) == 0 {
+		return nil
+	}
+	if err := db.checkEntries("BulkLoad", chunk); err != nil {
+		return err
+	}
+	entries := withoutVersions(db.jitterTTLs(chunk))
+	err := load(entries)
+	if err == nil {
+		db.events.batch(entries, nil)
+	}
+	db.disk.wrote(entriesSize(entries))
+	if err != nil {
+		return types.NewOpError("BulkLoad", "", err)
+	}
+	if db.accessStats != nil {
+		for _, entry := range entries {
+			db.accessStats.write(entry.Key)
+		}
+	}
+	return nil
+}
+
+// BatchDelete removes multiple key-value pairs. Invalid keys fail it with a
+// *types.MultiError listing each of them.
+func (db *Database) BatchDelete(keys []types.Key) (err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startOp(latencyBatchDelete, "", len(keys), 0)
+	defer func() { db.finishOp(&call, err) }()
+
+	if db.closed {
+		return types.NewOpError("BatchDelete", "", types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateLookupKeys("BatchDelete", keys); err != nil {
+		return err
+	}
+
+	unlock := db.events.lock()
+	err = db.storage.BatchDelete(keys)
+	if err == nil {
+		db.events.batch(nil, keys)
+	}
+	unlock()
+	if err != nil {
+		return types.NewOpError("BatchDelete", "", err)
+	}
+	if db.accessStats != nil {
+		for _, key := range keys {
+			db.accessStats.write(key)
+		}
+	}
+	return nil
+}
+
+// Clear removes all key-value pairs. With
+// Config.AutoBackupBeforeDestructive set, a recovery point is made first.
+func (db *Database) Clear() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -165,19 +644,71 @@ func (db *Database) SetWithTTL(key types.Key, value types.Value, ttl time.Durati
 		return types.ErrDatabaseClosed
 	}
 
-	if err := db.validateKey(key); err != nil {
+	if err := db.backupBeforeDestructive("Clear"); err != nil {
 		return err
 	}
 
-	if err := db.validateValue(value); err != nil {
+	unlock := db.events.lock()
+	defer unlock()
+	if err := db.storage.Clear(); err != nil {
 		return err
 	}
+	db.events.clear()
+	return nil
+}
+
+// backupBeforeDestructive makes a recovery point before operation if
+// Config.AutoBackupBeforeDestructive asks for one and the storage can be
+// backed up. The operation mustn't go ahead if it fails. The caller holds
+// mu.
+func (db *Database) backupBeforeDestructive(operation string) error {
+	if !db.config.AutoBackupBeforeDestructive || db.backupManager == nil {
+		return nil
+	}
 
-	return db.storage.SetWithTTL(key, value, ttl)
+	options := persistence.BackupOptions{
+		Description: "Recovery point: before " + operation,
+		Reason:      "before " + operation,
+		Tags:        map[string]string{persistence.BackupTagKind: persistence.BackupKindRecoveryPoint},
+	}
+	if _, err := db.createBackup(context.Background(), options, nil); err != nil {
+		return fmt.Errorf("failed to back up before %s: %w", operation, err)
+	}
+	return nil
 }
 
-// Delete removes a key-value pair
-func (db *Database) Delete(key types.Key) error {
+// Size returns the number of key-value pairs
+func (db *Database) Size() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+
+	return db.storage.Size()
+}
+
+// Keys returns all keys in the database
+func (db *Database) Keys() ([]types.Key, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.storage.Keys()
+}
+
+// SetConfig updates the database configuration. Zero values are replaced
+// by defaults as by Config.ApplyDefaults; a config that then fails
+// Config.Validate, or changes fields fixed once the database is open (see
+// types.IsMutableConfigField) with a *types.ImmutableConfigError, is
+// rejected, leaving the current one in place. The memory limit, access
+// statistics, TTL settings and cleanup interval take effect right away;
+// lowering MaxKeySize or MaxValueSize only limits later writes.
+func (db *Database) SetConfig(config types.Config) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -185,70 +716,186 @@ func (db *Database) Delete(key types.Key) error {
 		return types.ErrDatabaseClosed
 	}
 
-	if err := db.validateKey(key); err != nil {
+	config, err := checkConfig(config)
+	if err != nil {
 		return err
 	}
+	if fields := db.config.ImmutableChanges(config); len(fields) > 0 {
+		return &types.ImmutableConfigError{Fields: fields}
+	}
 
-	return db.storage.Delete(key)
+	// Apply the memory limit to in-memory storage
+	if inMemoryStorage, ok := db.storage.(*storage.InMemoryStorage); ok {
+		if err := inMemoryStorage.SetMemoryLimit(config.MaxMemorySize, config.EvictionPolicy); err != nil {
+			return err
+		}
+	}
+
+	db.setAccessTracking(config)
+	db.setLatencyTracking(config)
+	db.setTTLEnabled(config)
+	db.logs.set(config)
+	if config.CleanupInterval != db.config.CleanupInterval {
+		db.stopJanitor()
+		db.startJanitor(config)
+	}
+	db.config = config
+	return nil
 }
 
-// Exists checks if a key exists
-func (db *Database) Exists(key types.Key) (bool, error) {
+// GetConfig returns the current database configuration
+func (db *Database) GetConfig() types.Config {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
+	return db.config
+}
+
+// Close rolls back any open transactions and closes the database
+func (db *Database) Close() error {
+	_, err := db.Shutdown()
+	return err
+}
+
+// Shutdown closes the database like Close and returns how many open
+// transactions it rolled back. Their operations fail with
+// types.ErrTransactionAborted from then on.
+func (db *Database) Shutdown() (int, error) {
+	aborted := db.transactions.abortAll()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if db.closed {
-		return false, types.ErrDatabaseClosed
+		return aborted, nil
 	}
 
-	if err := db.validateKey(key); err != nil {
-		return false, err
+	db.freezeExpvars()
+	db.closed = true
+	db.stopJanitor()
+	db.stopDiskMonitor()
+	db.stopStatsLog()
+	if db.expiry != nil {
+		db.expiry.close()
 	}
+	return aborted, db.storage.Close()
+}
 
-	return db.storage.Exists(key)
+// IsClosed returns true if the database is closed
+func (db *Database) IsClosed() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.closed
 }
 
-// BatchGet retrieves multiple values by keys
-func (db *Database) BatchGet(keys []types.Key) (map[types.Key]types.Value, error) {
+// Ping checks that the database is open and accepting writes. After a write
+// failure such as a full disk, disk storage turns read-only and Ping returns
+// an error wrapping types.ErrReadOnly until the storage has recovered. It
+// also fails, wrapping ErrDiskUsage, while the last disk usage check found
+// usage at an error threshold.
+func (db *Database) Ping() error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	if db.closed {
-		return nil, types.ErrDatabaseClosed
+		return types.ErrDatabaseClosed
+	}
+
+	if healthChecker, ok := db.storage.(types.HealthChecker); ok {
+		if err := healthChecker.Health(); err != nil {
+			return err
+		}
+	}
+	if db.disk != nil {
+		if status := db.disk.current(); status.Level == DiskUsageError {
+			return fmt.Errorf("%w: %s", ErrDiskUsage, status.Reason)
+		}
+	}
+
+	return nil
+}
+
+// checkConfig returns config with its defaults applied, or an error
+// listing its problems if it isn't valid
+func checkConfig(config types.Config) (types.Config, error) {
+	config.ApplyDefaults()
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// validateLookupKey validates a key being read or deleted. Keys longer than
+// MaxKeySize pass, so keys written before SetConfig lowered it can still be
+// read and deleted.
+func (db *Database) validateLookupKey(key types.Key) error {
+	if len(key) == 0 {
+		return types.ErrInvalidKey
 	}
 
+	return nil
+}
+
+// validateLookupKeys validates the keys of a batch read or delete for op,
+// returning a *types.MultiError listing the invalid ones
+func (db *Database) validateLookupKeys(op string, keys []types.Key) error {
+	failed := &types.MultiError{Op: op}
 	for _, key := range keys {
-		if err := db.validateKey(key); err != nil {
-			return nil, err
+		if err := db.validateLookupKey(key); err != nil {
+			failed.Add(key, err)
 		}
 	}
+	return failed.Err()
+}
+
+// validateKey validates a key being written
+func (db *Database) validateKey(key types.Key) error {
+	if len(key) == 0 {
+		return types.ErrInvalidKey
+	}
+
+	if len(key) > db.config.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes is longer than MaxKeySize %d", types.ErrInvalidKey, len(key), db.config.MaxKeySize)
+	}
+
+	return nil
+}
+
+// validateValue validates a value
+func (db *Database) validateValue(value types.Value) error {
+	if len(value) > db.config.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes is longer than MaxValueSize %d", types.ErrInvalidValue, len(value), db.config.MaxValueSize)
+	}
 
-	return db.storage.BatchGet(keys)
+	return nil
 }
 
-// BatchSet stores multiple key-value pairs
-func (db *Database) BatchSet(entries []types.Entry) error {
+// Compact performs garbage collection on disk-based storage. With
+// Config.AutoBackupBeforeDestructive set, a recovery point is made first.
+func (db *Database) Compact() (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	call := db.startOp(latencyCompact, "", 0, 0)
+	defer func() { db.finishOp(&call, err) }()
 
 	if db.closed {
 		return types.ErrDatabaseClosed
 	}
 
-	for _, entry := range entries {
-		if err := db.validateKey(entry.Key); err != nil {
-			return err
-		}
-		if err := db.validateValue(entry.Value); err != nil {
+	// Check if storage supports compaction
+	if compacter, ok := db.storage.(types.Compacter); ok {
+		if err := db.backupBeforeDestructive("Compact"); err != nil {
 			return err
 		}
+		return compacter.Compact()
 	}
 
-	return db.storage.BatchSet(entries)
+	return fmt.Errorf("compaction not supported for this storage type")
 }
 
-// BatchDelete removes multiple key-value pairs
-func (db *Database) BatchDelete(keys []types.Key) error {
+// Sync flushes buffered writes to disk for disk-based storage
+func (db *Database) Sync() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -256,29 +903,137 @@ func (db *Database) BatchDelete(keys []types.Key) error {
 		return types.ErrDatabaseClosed
 	}
 
-	for _, key := range keys {
-		if err := db.validateKey(key); err != nil {
-			return err
-		}
+	return db.syncStorage()
+}
+
+// syncStorage flushes and fsyncs disk-based storage; a no-op for other storage types
+func (db *Database) syncStorage() error {
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.Sync()
 	}
 
-	return db.storage.BatchDelete(keys)
+	return nil
 }
 
-// Clear removes all key-value pairs
-func (db *Database) Clear() error {
+// GetDiskUsage returns disk usage for disk-based storage
+func (db *Database) GetDiskUsage() (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+
+	// Check if storage supports disk usage reporting
+	if diskUsager, ok := db.storage.(types.DiskUsager); ok {
+		return diskUsager.GetDiskUsage()
+	}
+
+	return 0, fmt.Errorf("disk usage reporting not supported for this storage type")
+}
+
+// GetCompressionStats returns raw versus stored value sizes for disk-based storage
+func (db *Database) GetCompressionStats() (storage.CompressionStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return storage.CompressionStats{}, types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.GetCompressionStats()
+	}
+
+	return storage.CompressionStats{}, fmt.Errorf("compression not supported for this storage type")
+}
+
+// CheckIntegrity scans the data file and cross-checks the index for disk-based storage
+func (db *Database) CheckIntegrity() (*storage.IntegrityReport, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.CheckIntegrity()
+	}
+
+	return nil, fmt.Errorf("integrity checking not supported for this storage type")
+}
+
+// Repair rebuilds the data file from its readable records for disk-based storage
+func (db *Database) Repair() (*storage.RepairSummary, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.Repair()
+	}
+
+	return nil, fmt.Errorf("repair not supported for this storage type")
+}
+
+// CleanupExpired removes expired entries
+func (db *Database) CleanupExpired() int {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return 0
+	}
+
+	// Check if storage supports cleanup
+	if cleaner, ok := db.storage.(types.ExpiredCleaner); ok {
+		return cleaner.CleanupExpired()
+	}
+
+	return 0
+}
+
+// SetEvictionCallback registers fn to be called with the key and value of
+// every entry evicted to stay under Config.MaxMemorySize (in-memory storage
+// only). Pass nil to remove the callback.
+func (db *Database) SetEvictionCallback(fn func(key types.Key, value types.Value)) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	if db.closed {
 		return types.ErrDatabaseClosed
 	}
 
-	return db.storage.Clear()
+	if inMemoryStorage, ok := db.storage.(*storage.InMemoryStorage); ok {
+		inMemoryStorage.SetEvictionCallback(fn)
+		return nil
+	}
+
+	return fmt.Errorf("eviction not supported for this storage type")
 }
 
-// Size returns the number of key-value pairs
-func (db *Database) Size() (int64, error) {
+// IsWALEnabled returns true if WAL is enabled
+func (db *Database) IsWALEnabled() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return false
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.IsWALEnabled()
+	}
+
+	return false
+}
+
+// GetWALSize returns the current WAL size if enabled
+func (db *Database) GetWALSize() (int64, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -286,11 +1041,34 @@ func (db *Database) Size() (int64, error) {
 		return 0, types.ErrDatabaseClosed
 	}
 
-	return db.storage.Size()
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.GetWALSize(), nil
+	}
+
+	return 0, fmt.Errorf("WAL not supported for this storage type")
 }
 
-// Keys returns all keys in the database
-func (db *Database) Keys() ([]types.Key, error) {
+// GetWALStats returns the WAL's sync policy and entry and fsync counts if enabled
+func (db *Database) GetWALStats() (wal.Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return wal.Stats{}, types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.GetWALStats()
+	}
+
+	return wal.Stats{}, fmt.Errorf("WAL not supported for this storage type")
+}
+
+// Subscribe streams every committed write from fromLSN on, as logged to the
+// WAL, until ctx is done or the database is closed. It needs the WAL to be
+// enabled. The LSN of the last entry a subscriber processed is where it
+// resumes from after a restart, plus one.
+func (db *Database) Subscribe(ctx context.Context, fromLSN uint64) (*wal.Tailer, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -298,24 +1076,32 @@ func (db *Database) Keys() ([]types.Key, error) {
 		return nil, types.ErrDatabaseClosed
 	}
 
-	return db.storage.Keys()
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.TailWAL(ctx, fromLSN)
+	}
+
+	return nil, fmt.Errorf("WAL not supported for this storage type")
 }
 
-// Begin starts a new transaction (placeholder for future implementation)
-func (db *Database) Begin() (types.Transaction, error) {
+// DumpWAL prints every record of the WAL files on disk to w, one line per
+// record, for debugging recovery. It needs the WAL to be enabled.
+func (db *Database) DumpWAL(w io.Writer) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	if db.closed {
-		return nil, types.ErrDatabaseClosed
+		return types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.DumpWAL(w, wal.DumpText)
 	}
 
-	// TODO: Implement transaction support
-	return nil, types.ErrTransactionAborted
+	return fmt.Errorf("WAL not supported for this storage type")
 }
 
-// SetConfig updates the database configuration
-func (db *Database) SetConfig(config types.Config) error {
+// RotateWAL rotates the WAL if enabled
+func (db *Database) RotateWAL() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -323,185 +1109,286 @@ func (db *Database) SetConfig(config types.Config) error {
 		return types.ErrDatabaseClosed
 	}
 
-	db.config = config
-	return nil
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.RotateWAL()
+	}
+
+	return fmt.Errorf("WAL not supported for this storage type")
 }
 
-// GetConfig returns the current database configuration
-func (db *Database) GetConfig() types.Config {
+// Checkpoint makes the data durable and trims the WAL entries it holds, so
+// recovery only replays what was logged after it
+func (db *Database) Checkpoint() error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	return db.config
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.Checkpoint()
+	}
+
+	return fmt.Errorf("checkpoint not supported for this storage type")
 }
 
-// Close closes the database
-func (db *Database) Close() error {
+// ClearWAL clears the WAL if enabled
+func (db *Database) ClearWAL() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	if db.closed {
-		return nil
+		return types.ErrDatabaseClosed
 	}
 
-	db.closed = true
-	return db.storage.Close()
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		return diskStorage.ClearWAL()
+	}
+
+	return fmt.Errorf("WAL not supported for this storage type")
 }
 
-// IsClosed returns true if the database is closed
-func (db *Database) IsClosed() bool {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// Backup and Recovery Methods
 
-	return db.closed
+// CreateBackup creates a full backup of the database. Disk storage is
+// backed up online: writes are held only while it is flushed and a
+// snapshot taken, and the backup records the WAL LSN it was taken at.
+func (db *Database) CreateBackup(description string) (*persistence.BackupMetadata, error) {
+	return db.CreateBackupContext(context.Background(), description, nil)
 }
 
-// validateKey validates a key
-func (db *Database) validateKey(key types.Key) error {
-	if len(key) == 0 {
-		return types.ErrInvalidKey
+// CreateBackupContext is CreateBackup reporting its progress to progress,
+// if it isn't nil, and giving up once ctx is done, without leaving a
+// partial backup behind
+func (db *Database) CreateBackupContext(ctx context.Context, description string, progress persistence.ProgressFunc) (*persistence.BackupMetadata, error) {
+	return db.CreateBackupWithOptions(ctx, persistence.BackupOptions{Description: description}, progress)
+}
+
+// CreateBackupWithOptions is CreateBackupContext recording the reason and
+// tags in options as well as the description
+func (db *Database) CreateBackupWithOptions(ctx context.Context, options persistence.BackupOptions, progress persistence.ProgressFunc) (metadata *persistence.BackupMetadata, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startHookedOp(ctx, "Backup")
+	defer func() { db.finishHookedOp(&call, err) }()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
 	}
 
-	if len(key) > db.config.MaxKeySize {
-		return types.ErrInvalidKey
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return nil
+	return db.createBackup(ctx, options, progress)
 }
 
-// validateValue validates a value
-func (db *Database) validateValue(value types.Value) error {
-	if len(value) > db.config.MaxValueSize {
-		return types.ErrInvalidValue
+// createBackup implements CreateBackupWithOptions. The caller holds mu.
+func (db *Database) createBackup(ctx context.Context, options persistence.BackupOptions, progress persistence.ProgressFunc) (*persistence.BackupMetadata, error) {
+	// Disk storage is copied from a snapshot, so writes can carry on
+	// during the copy without making it inconsistent
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		snapshot, err := diskStorage.OpenSnapshot()
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot storage: %w", err)
+		}
+		defer snapshot.Close()
+
+		return db.backupManager.CreateSnapshotBackupWithOptions(ctx, snapshot, options, progress)
 	}
 
-	return nil
+	// Buffered writes must be on disk before the files are copied
+	if err := db.syncStorage(); err != nil {
+		return nil, err
+	}
+
+	return db.backupManager.CreateFullBackupWithOptions(ctx, options, progress)
+}
+
+// RestoreFromBackup restores the database from a backup
+func (db *Database) RestoreFromBackup(backupName string) error {
+	return db.RestoreFromBackupContext(context.Background(), backupName, nil)
 }
 
-// Compact performs garbage collection on disk-based storage
-func (db *Database) Compact() error {
+// RestoreFromBackupContext is RestoreFromBackup reporting its progress to
+// progress, if it isn't nil, and giving up once ctx is done, leaving the
+// data as it was
+func (db *Database) RestoreFromBackupContext(ctx context.Context, backupName string, progress persistence.ProgressFunc) (err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	call := db.startHookedOp(ctx, "Restore")
+	defer func() { db.finishHookedOp(&call, err) }()
 
 	if db.closed {
 		return types.ErrDatabaseClosed
 	}
 
-	// Check if storage supports compaction
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.Compact()
+	if db.backupManager == nil {
+		return fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return fmt.Errorf("compaction not supported for this storage type")
+	return db.restoreStorage(func() error {
+		return db.backupManager.RestoreFromBackupContext(ctx, backupName, progress)
+	})
 }
 
-// GetDiskUsage returns disk usage for disk-based storage
-func (db *Database) GetDiskUsage() (int64, error) {
+// RestoreToDirectory restores a backup into destDir, leaving the
+// database's own data alone, and returns the absolute path of destDir for
+// NewDiskDB to open
+func (db *Database) RestoreToDirectory(backupName, destDir string) (string, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
 	if db.closed {
-		return 0, types.ErrDatabaseClosed
+		return "", types.ErrDatabaseClosed
 	}
 
-	// Check if storage supports disk usage reporting
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.GetDiskUsage()
+	if db.backupManager == nil {
+		return "", fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return 0, fmt.Errorf("disk usage reporting not supported for this storage type")
+	return db.backupManager.RestoreToDirectory(backupName, destDir)
 }
 
-// CleanupExpired removes expired entries
-func (db *Database) CleanupExpired() int {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	if db.closed {
-		return 0
-	}
-
-	// Check if storage supports cleanup
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.CleanupExpired()
+// restoreStorage runs restore, which replaces the files of disk storage,
+// with the storage closed, and then opens it again, so it serves the
+// restored data file, index and WAL instead of carrying on with the state
+// of the files they replaced. The storage is reopened whether or not the
+// restore succeeds; a failed one leaves the files as they were. Tailers of
+// the old WAL stop with wal.ErrClosed. The caller holds mu exclusively.
+func (db *Database) restoreStorage(restore func() error) error {
+	db.events.reset()
+	diskStorage, ok := db.storage.(*storage.DiskStorage)
+	if !ok {
+		return restore()
+	}
+
+	// Closing syncs and checkpoints, so no WAL entry of the replaced data
+	// is replayed on top of the restored files
+	var restoreErr error
+	if err := diskStorage.Close(); err != nil {
+		restoreErr = fmt.Errorf("failed to close storage for restore: %w", err)
+	} else {
+		restoreErr = restore()
+	}
+
+	reopened, err := storage.NewDiskStorageWithConfig(db.logs.configure(db.config))
+	if err != nil {
+		// There is no storage left to serve requests
+		db.closed = true
+		return errors.Join(restoreErr, fmt.Errorf("failed to reopen storage after restore: %w", err))
 	}
-
-	// For in-memory storage, we can implement cleanup here
-	if inMemoryStorage, ok := db.storage.(*storage.InMemoryStorage); ok {
-		return inMemoryStorage.CleanupExpired()
+	db.storage = reopened
+	db.setTTLEnabled(db.config)
+	// The reopened storage doesn't hold writes until the next check
+	db.disk.poke()
+	db.setExpiryCallback()
+	if db.recoveryManager != nil {
+		db.recoveryManager.SetStorage(reopened)
 	}
 
-	return 0
+	return restoreErr
 }
 
-// IsWALEnabled returns true if WAL is enabled
-func (db *Database) IsWALEnabled() bool {
+// WriteBackup streams a full backup of the database to w, for instance an
+// upload to remote storage, without keeping a copy in the backup directory
+func (db *Database) WriteBackup(w io.Writer, description string) (metadata *persistence.BackupMetadata, err error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
+	call := db.startHookedOp(context.Background(), "Backup")
+	defer func() { db.finishHookedOp(&call, err) }()
 
 	if db.closed {
-		return false
+		return nil, types.ErrDatabaseClosed
 	}
 
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.IsWALEnabled()
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return false
+	// Buffered writes must be on disk before the files are streamed
+	if err := db.syncStorage(); err != nil {
+		return nil, err
+	}
+
+	return db.backupManager.WriteBackup(w, description)
 }
 
-// GetWALSize returns the current WAL size if enabled
-func (db *Database) GetWALSize() (int64, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+// RestoreBackup restores the database from a backup stream written by
+// WriteBackup
+func (db *Database) RestoreBackup(r io.Reader) (metadata *persistence.BackupMetadata, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	call := db.startHookedOp(context.Background(), "Restore")
+	defer func() { db.finishHookedOp(&call, err) }()
 
 	if db.closed {
-		return 0, types.ErrDatabaseClosed
+		return nil, types.ErrDatabaseClosed
 	}
 
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.GetWALSize(), nil
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return 0, fmt.Errorf("WAL not supported for this storage type")
+	err = db.restoreStorage(func() error {
+		var err error
+		metadata, err = db.backupManager.RestoreBackup(r)
+		return err
+	})
+	return metadata, err
 }
 
-// RotateWAL rotates the WAL if enabled
-func (db *Database) RotateWAL() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// WriteEncryptedBackup is WriteBackup with the stream encrypted under enc,
+// for backups copied off the machine
+func (db *Database) WriteEncryptedBackup(w io.Writer, description string, enc persistence.BackupEncryption) (metadata *persistence.BackupMetadata, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	call := db.startHookedOp(context.Background(), "Backup")
+	defer func() { db.finishHookedOp(&call, err) }()
 
 	if db.closed {
-		return types.ErrDatabaseClosed
+		return nil, types.ErrDatabaseClosed
 	}
 
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.RotateWAL()
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return fmt.Errorf("WAL not supported for this storage type")
+	if err := db.syncStorage(); err != nil {
+		return nil, err
+	}
+
+	return db.backupManager.WriteEncryptedBackup(w, description, enc)
 }
 
-// ClearWAL clears the WAL if enabled
-func (db *Database) ClearWAL() error {
+// RestoreEncryptedBackup restores the database from a backup stream
+// written by WriteEncryptedBackup, failing with persistence.ErrBackupKey
+// if enc is the wrong key
+func (db *Database) RestoreEncryptedBackup(r io.Reader, enc persistence.BackupEncryption) (metadata *persistence.BackupMetadata, err error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	call := db.startHookedOp(context.Background(), "Restore")
+	defer func() { db.finishHookedOp(&call, err) }()
 
 	if db.closed {
-		return types.ErrDatabaseClosed
+		return nil, types.ErrDatabaseClosed
 	}
 
-	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
-		return diskStorage.ClearWAL()
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return fmt.Errorf("WAL not supported for this storage type")
+	err = db.restoreStorage(func() error {
+		var err error
+		metadata, err = db.backupManager.RestoreEncryptedBackup(r, enc)
+		return err
+	})
+	return metadata, err
 }
 
-// Backup and Recovery Methods
-
-// CreateBackup creates a full backup of the database
-func (db *Database) CreateBackup(description string) (*persistence.BackupMetadata, error) {
+// ListBackups returns a list of available backups, most recent first
+func (db *Database) ListBackups() ([]persistence.BackupMetadata, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -513,27 +1400,29 @@ func (db *Database) CreateBackup(description string) (*persistence.BackupMetadat
 		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return db.backupManager.CreateFullBackup(description)
+	return db.backupManager.ListBackups()
 }
 
-// RestoreFromBackup restores the database from a backup
-func (db *Database) RestoreFromBackup(backupName string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// ListBackupsWithFilter returns the available backups that pass filter,
+// most recent first
+func (db *Database) ListBackupsWithFilter(filter persistence.BackupFilter) ([]persistence.BackupMetadata, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
 	if db.closed {
-		return types.ErrDatabaseClosed
+		return nil, types.ErrDatabaseClosed
 	}
 
 	if db.backupManager == nil {
-		return fmt.Errorf("backup not supported for this storage type")
+		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return db.backupManager.RestoreFromBackup(backupName)
+	return db.backupManager.ListBackupsWithFilter(filter)
 }
 
-// ListBackups returns a list of available backups
-func (db *Database) ListBackups() ([]persistence.BackupMetadata, error) {
+// FindBackups returns the backups matching filter on their tags,
+// description and time range, most recent first
+func (db *Database) FindBackups(filter persistence.BackupFilter) ([]persistence.BackupMetadata, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -545,7 +1434,7 @@ func (db *Database) ListBackups() ([]persistence.BackupMetadata, error) {
 		return nil, fmt.Errorf("backup not supported for this storage type")
 	}
 
-	return db.backupManager.ListBackups()
+	return db.backupManager.FindBackups(filter)
 }
 
 // DeleteBackup removes a backup
@@ -580,6 +1469,24 @@ func (db *Database) GetBackupInfo(backupName string) (*persistence.BackupMetadat
 	return db.backupManager.GetBackupInfo(backupName)
 }
 
+// VerifyBackup checks the files of a backup against the digests recorded
+// when it was made and, if deep, restores it into a scratch directory and
+// reads back every entry, without touching the live data
+func (db *Database) VerifyBackup(backupName string, deep bool) (*persistence.BackupVerification, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
+	}
+
+	return db.backupManager.VerifyBackup(backupName, deep)
+}
+
 // CreateRecoveryPoint creates a recovery point before risky operations
 func (db *Database) CreateRecoveryPoint(description string) (*persistence.BackupMetadata, error) {
 	db.mu.RLock()
@@ -596,36 +1503,94 @@ func (db *Database) CreateRecoveryPoint(description string) (*persistence.Backup
 	return db.recoveryManager.CreateRecoveryPoint(description)
 }
 
-// PerformRecovery performs automatic recovery
-func (db *Database) PerformRecovery() error {
+// PerformRecovery performs automatic recovery and reports what it did
+func (db *Database) PerformRecovery() (*persistence.RecoveryReport, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	if db.closed {
-		return types.ErrDatabaseClosed
+		return nil, types.ErrDatabaseClosed
 	}
 
 	if db.recoveryManager == nil {
-		return fmt.Errorf("recovery not supported for this storage type")
+		return nil, fmt.Errorf("recovery not supported for this storage type")
 	}
 
 	return db.recoveryManager.PerformRecovery()
 }
 
-// ForceRecoveryFromBackup forces recovery from a specific backup
-func (db *Database) ForceRecoveryFromBackup(backupName string) error {
+// PerformRecoveryDryRun reports what PerformRecovery would do without
+// changing anything
+func (db *Database) PerformRecoveryDryRun() (*persistence.RecoveryReport, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if db.recoveryManager == nil {
+		return nil, fmt.Errorf("recovery not supported for this storage type")
+	}
+
+	return db.recoveryManager.PerformRecoveryDryRun()
+}
+
+// RecoverToTime recovers the database to how it was at target from the
+// newest backup made at or before it and the WAL entries logged since,
+// which must still be on disk: checkpoints, including the one closing the
+// database, delete the segments beyond Config.WALRetainSegments. The
+// storage is closed around the recovery and serves the recovered data once
+// it returns.
+func (db *Database) RecoverToTime(target time.Time) (*persistence.RecoveryReport, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
 	if db.closed {
-		return types.ErrDatabaseClosed
+		return nil, types.ErrDatabaseClosed
 	}
 
 	if db.recoveryManager == nil {
-		return fmt.Errorf("recovery not supported for this storage type")
+		return nil, fmt.Errorf("recovery not supported for this storage type")
+	}
+
+	// The WAL entries are read while the storage is open, since closing it
+	// deletes the checkpointed segments holding them
+	recovery, err := db.recoveryManager.PrepareRecoveryToTime(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var report *persistence.RecoveryReport
+	err = db.restoreStorage(func() error {
+		var err error
+		report, err = db.recoveryManager.ApplyRecoveryToTime(recovery)
+		return err
+	})
+	return report, err
+}
+
+// ForceRecoveryFromBackup forces recovery from a specific backup, saving
+// the current data as a recovery point first, and reports what it did
+func (db *Database) ForceRecoveryFromBackup(backupName string) (*persistence.RecoveryReport, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if db.recoveryManager == nil {
+		return nil, fmt.Errorf("recovery not supported for this storage type")
 	}
 
-	return db.recoveryManager.ForceRecoveryFromBackup(backupName)
+	var report *persistence.RecoveryReport
+	err := db.restoreStorage(func() error {
+		var err error
+		report, err = db.recoveryManager.ForceRecoveryFromBackup(backupName)
+		return err
+	})
+	return report, err
 }
 
 // GetRecoveryState returns the current recovery state
@@ -672,6 +1637,40 @@ func (db *Database) ValidateDataIntegrity() (bool, []string, error) {
 	return db.recoveryManager.ValidateDataIntegrity()
 }
 
+// ListQuarantined returns the sets of data files recovery replaced and
+// kept in quarantine, most recent first
+func (db *Database) ListQuarantined() ([]persistence.QuarantinedData, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if db.recoveryManager == nil {
+		return nil, fmt.Errorf("recovery not supported for this storage type")
+	}
+
+	return db.recoveryManager.ListQuarantined()
+}
+
+// PurgeQuarantine removes every quarantined set of data files and returns
+// how many there were
+func (db *Database) PurgeQuarantine() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+
+	if db.recoveryManager == nil {
+		return 0, fmt.Errorf("recovery not supported for this storage type")
+	}
+
+	return db.recoveryManager.PurgeQuarantine()
+}
+
 // IsBackupSupported returns true if backup is supported
 func (db *Database) IsBackupSupported() bool {
 	db.mu.RLock()
@@ -687,3 +1686,12 @@ func (db *Database) IsRecoverySupported() bool {
 
 	return db.recoveryManager != nil
 }
+
+// IsCompactionSupported returns true if the storage supports Compact
+func (db *Database) IsCompactionSupported() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, ok := db.storage.(types.Compacter)
+	return ok
+}
@@ -5,8 +5,10 @@ import (
 	"database_engine/types"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewInMemoryDB(t *testing.T) {
@@ -30,7 +32,8 @@ func TestNewInMemoryDBWithConfig(t *testing.T) {
 		EnableTTL:    true,
 	}
 
-	db := engine.NewInMemoryDBWithConfig(config)
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
 	assert.NotNil(t, db)
 	assert.False(t, db.IsClosed())
 
@@ -40,7 +43,7 @@ func TestNewInMemoryDBWithConfig(t *testing.T) {
 	assert.Equal(t, config.MaxValueSize, retrievedConfig.MaxValueSize)
 	assert.Equal(t, config.EnableTTL, retrievedConfig.EnableTTL)
 
-	err := db.Close()
+	err = db.Close()
 	assert.NoError(t, err)
 }
 
@@ -83,7 +86,7 @@ func TestBasicOperations(t *testing.T) {
 	// Test Get after delete
 	_, err = db.Get(key)
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrKeyNotFound, err)
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
 
 	// Test Exists after delete
 	exists, err = db.Exists(key)
@@ -175,19 +178,19 @@ func TestValidation(t *testing.T) {
 	// Test empty key
 	err := db.Set("", []byte("value"))
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrInvalidKey, err)
+	assert.ErrorIs(t, err, types.ErrInvalidKey)
 
 	// Test key too large
 	largeKey := string(make([]byte, 2048)) // Larger than default MaxKeySize
 	err = db.Set(types.Key(largeKey), []byte("value"))
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrInvalidKey, err)
+	assert.ErrorIs(t, err, types.ErrInvalidKey)
 
 	// Test value too large
 	largeValue := make([]byte, 2*1024*1024) // Larger than default MaxValueSize
 	err = db.Set("key", largeValue)
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrInvalidValue, err)
+	assert.ErrorIs(t, err, types.ErrInvalidValue)
 }
 
 func TestClosedDatabase(t *testing.T) {
@@ -201,42 +204,31 @@ func TestClosedDatabase(t *testing.T) {
 	// Test operations on closed database
 	_, err = db.Get("key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 
 	err = db.Set("key", []byte("value"))
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 
 	err = db.Delete("key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 
 	_, err = db.Exists("key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 
 	err = db.Clear()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 
 	_, err = db.Size()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 
 	_, err = db.Keys()
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrDatabaseClosed, err)
-}
-
-func TestTransactionPlaceholder(t *testing.T) {
-	db := engine.NewInMemoryDB()
-	defer db.Close()
-
-	// Test transaction begin (should return error as not implemented)
-	tx, err := db.Begin()
-	assert.Error(t, err)
-	assert.Equal(t, types.ErrTransactionAborted, err)
-	assert.Nil(t, tx)
+	assert.ErrorIs(t, err, types.ErrDatabaseClosed)
 }
 
 func TestConcurrentOperations(t *testing.T) {
@@ -273,6 +265,189 @@ func TestConcurrentOperations(t *testing.T) {
 	assert.Equal(t, int64(10), size)
 }
 
+func TestShardedConcurrentOperations(t *testing.T) {
+	config := types.DefaultConfig()
+	config.InMemoryShards = 3 // Rounded up to 4
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	done := make(chan bool, 8)
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			var batch []types.Entry
+			for i := 0; i < 50; i++ {
+				key := types.Key(fmt.Sprintf("worker-%d-key-%d", w, i))
+				assert.NoError(t, db.Set(key, types.Value("value")))
+				batch = append(batch, types.Entry{Key: key + "-batch", Value: types.Value("value")})
+			}
+			assert.NoError(t, db.BatchSet(batch))
+			assert.NoError(t, db.Delete(types.Key(fmt.Sprintf("worker-%d-key-0", w))))
+			done <- true
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		<-done
+	}
+
+	size, err := db.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8*99), size)
+
+	keys, err := db.Keys()
+	assert.NoError(t, err)
+	assert.Len(t, keys, 8*99)
+
+	assert.NoError(t, db.Clear())
+	size, err = db.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), size)
+}
+
+func TestMemoryLimitEviction(t *testing.T) {
+	const limit = 100 * 1024
+	config := types.DefaultConfig()
+	config.MaxMemorySize = limit
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var evicted []types.Key
+	assert.NoError(t, db.SetEvictionCallback(func(key types.Key, value types.Value) {
+		evicted = append(evicted, key)
+	}))
+
+	// Each entry is about 1KB, so 200 of them is twice the limit
+	value := make(types.Value, 1024)
+	for i := 0; i < 200; i++ {
+		key := types.Key(fmt.Sprintf("key-%03d", i))
+		assert.NoError(t, db.Set(key, value))
+
+		// Keep key-000 in use so it survives
+		_, err := db.Get("key-000")
+		assert.NoError(t, err)
+	}
+
+	stats, err := db.GetStats()
+	assert.NoError(t, err)
+	assert.NotNil(t, stats.Memory)
+	assert.LessOrEqual(t, stats.Memory.UsedBytes, int64(limit))
+	assert.Equal(t, types.EvictionLRU, stats.Memory.Policy)
+	assert.Equal(t, int64(len(evicted)), stats.Memory.Evictions)
+	assert.Equal(t, 200-int(stats.Keys), len(evicted))
+
+	// The most recently used keys survive, the oldest were evicted
+	for i := 150; i < 200; i++ {
+		exists, err := db.Exists(types.Key(fmt.Sprintf("key-%03d", i)))
+		assert.NoError(t, err)
+		assert.True(t, exists, "key-%03d should survive", i)
+	}
+	exists, err := db.Exists("key-000")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = db.Exists("key-001")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, types.Key("key-001"), evicted[0])
+}
+
+func TestMemoryLimitPolicies(t *testing.T) {
+	value := make(types.Value, 1024)
+	entrySize := int64(len("key-00") + len(value) + 64)
+
+	t.Run("Reject", func(t *testing.T) {
+		config := types.DefaultConfig()
+		config.MaxMemorySize = 10 * entrySize
+		config.EvictionPolicy = types.EvictionReject
+		db, err := engine.NewInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, db.Set(types.Key(fmt.Sprintf("key-%02d", i)), value))
+		}
+		err = db.Set("key-10", value)
+		assert.ErrorIs(t, err, types.ErrMemoryLimitExceeded)
+
+		// Overwriting with a value of the same size still fits
+		assert.NoError(t, db.Set("key-00", value))
+
+		stats, err := db.GetStats()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), stats.Keys)
+		assert.Equal(t, int64(0), stats.Memory.Evictions)
+	})
+
+	t.Run("LFU", func(t *testing.T) {
+		config := types.DefaultConfig()
+		config.MaxMemorySize = 10 * entrySize
+		config.EvictionPolicy = types.EvictionLFU
+		db, err := engine.NewInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			key := types.Key(fmt.Sprintf("key-%02d", i))
+			assert.NoError(t, db.Set(key, value))
+			if i != 3 {
+				_, err := db.Get(key)
+				assert.NoError(t, err)
+			}
+		}
+		assert.NoError(t, db.Set("key-10", value))
+
+		exists, err := db.Exists("key-03")
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		exists, err = db.Exists("key-00")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("ExpiredFirst", func(t *testing.T) {
+		config := types.DefaultConfig()
+		config.MaxMemorySize = 10 * entrySize
+		config.EvictionPolicy = types.EvictionExpiredFirst
+		db, err := engine.NewInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 9; i++ {
+			assert.NoError(t, db.Set(types.Key(fmt.Sprintf("key-%02d", i)), value))
+		}
+		assert.NoError(t, db.SetWithTTL("key-09", value, time.Millisecond))
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, db.Set("key-10", value))
+
+		size, err := db.Size()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), size)
+		exists, err := db.Exists("key-00")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		config := types.DefaultConfig()
+		config.MaxMemorySize = entrySize
+		db, err := engine.NewInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		defer db.Close()
+
+		err = db.Set("key", make(types.Value, 2*len(value)))
+		assert.ErrorIs(t, err, types.ErrMemoryLimitExceeded)
+	})
+
+	t.Run("UnknownPolicy", func(t *testing.T) {
+		db := engine.NewInMemoryDB()
+		defer db.Close()
+
+		config := types.DefaultConfig()
+		config.EvictionPolicy = "random"
+		assert.Error(t, db.SetConfig(config))
+	})
+}
+
 func TestConfigUpdate(t *testing.T) {
 	db := engine.NewInMemoryDB()
 	defer db.Close()
@@ -281,11 +456,10 @@ func TestConfigUpdate(t *testing.T) {
 	initialConfig := db.GetConfig()
 
 	// Update config
-	newConfig := types.Config{
-		MaxKeySize:   256,
-		MaxValueSize: 512,
-		EnableTTL:    false,
-	}
+	newConfig := db.GetConfig()
+	newConfig.MaxKeySize = 256
+	newConfig.MaxValueSize = 512
+	newConfig.EnableTTL = false
 
 	err := db.SetConfig(newConfig)
 	assert.NoError(t, err)
@@ -298,6 +472,45 @@ func TestConfigUpdate(t *testing.T) {
 	assert.NotEqual(t, initialConfig.MaxKeySize, updatedConfig.MaxKeySize)
 }
 
+func TestSetConfigValidates(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	// A zero MaxKeySize gets the default instead of refusing every key
+	config := db.GetConfig()
+	config.MaxKeySize = 0
+	config.MaxValueSize = 4096
+	require.NoError(t, db.SetConfig(config))
+	assert.Equal(t, types.DefaultConfig().MaxKeySize, db.GetConfig().MaxKeySize)
+	require.NoError(t, db.Set("key", []byte("value")))
+
+	// An invalid config is rejected whole, leaving the current one
+	config = db.GetConfig()
+	config.MaxKeySize = -1
+	config.LogLevel = "loud"
+	err := db.SetConfig(config)
+	assert.ErrorContains(t, err, "MaxKeySize must be positive")
+	assert.ErrorContains(t, err, `unknown LogLevel "loud"`)
+	assert.Equal(t, 4096, db.GetConfig().MaxValueSize)
+	assert.Equal(t, types.DefaultConfig().MaxKeySize, db.GetConfig().MaxKeySize)
+}
+
+func TestConstructorsValidateConfig(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EvictionPolicy = "fifo"
+
+	_, err := engine.NewInMemoryDBWithConfig(config)
+	assert.ErrorContains(t, err, `unknown EvictionPolicy "fifo"`)
+	_, err = engine.NewOrderedInMemoryDBWithConfig(config)
+	assert.ErrorContains(t, err, `unknown EvictionPolicy "fifo"`)
+
+	config = types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = ""
+	_, err = engine.NewDiskDBWithConfig(config)
+	assert.ErrorContains(t, err, "DataDirectory must be set")
+}
+
 func TestErrorHandling(t *testing.T) {
 	db := engine.NewInMemoryDB()
 	defer db.Close()
@@ -305,7 +518,7 @@ func TestErrorHandling(t *testing.T) {
 	// Test getting non-existent key
 	_, err := db.Get("non-existent-key")
 	assert.Error(t, err)
-	assert.Equal(t, types.ErrKeyNotFound, err)
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
 
 	// Test deleting non-existent key (should not error)
 	err = db.Delete("non-existent-key")
@@ -0,0 +1,129 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/persistence"
+	"database_engine/types"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireOpError checks err is an *types.OpError for op and key wrapping
+// target
+func requireOpError(t *testing.T, err error, op string, key types.Key, target error) {
+	t.Helper()
+	var opErr *types.OpError
+	require.True(t, errors.As(err, &opErr), "%v is not an *OpError", err)
+	assert.Equal(t, op, opErr.Op)
+	assert.Equal(t, key, opErr.Key)
+	assert.ErrorIs(t, err, target)
+}
+
+func TestOpErrors(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	_, err := db.Get("missing")
+	requireOpError(t, err, "Get", "missing", types.ErrKeyNotFound)
+	assert.EqualError(t, err, `Get "missing": key not found`)
+
+	err = db.Set(types.Key(strings.Repeat("k", 2000)), types.Value("value"))
+	requireOpError(t, err, "Set", types.Key(strings.Repeat("k", 2000)), types.ErrInvalidKey)
+	assert.ErrorContains(t, err, "2000 bytes is longer than MaxKeySize 1024")
+
+	err = db.Set("big", make(types.Value, 2<<20))
+	requireOpError(t, err, "Set", "big", types.ErrInvalidValue)
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	entry, err := db.GetEntry("key")
+	require.NoError(t, err)
+	err = db.SetIfVersion("key", types.Value("other"), entry.Version+1)
+	requireOpError(t, err, "SetIfVersion", "key", types.ErrConflict)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, tx.Delete("key"))
+	_, err = tx.Get("key")
+	requireOpError(t, err, "Tx.Get", "key", types.ErrKeyNotFound)
+	require.NoError(t, tx.Rollback())
+
+	require.NoError(t, db.Close())
+	requireOpError(t, db.Delete("key"), "Delete", "key", types.ErrDatabaseClosed)
+	requireOpError(t, db.BatchSet(nil), "BatchSet", "", types.ErrDatabaseClosed)
+}
+
+func TestBatchMultiError(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	err := db.BatchSet([]types.Entry{
+		{Key: "good", Value: types.Value("value")},
+		{Key: "", Value: types.Value("value")},
+		{Key: "big", Value: make(types.Value, 2<<20)},
+	})
+	var multiErr *types.MultiError
+	require.True(t, errors.As(err, &multiErr), "%v is not a *MultiError", err)
+	assert.Equal(t, "BatchSet", multiErr.Op)
+	require.Len(t, multiErr.Errors, 2)
+	assert.Equal(t, types.Key(""), multiErr.Errors[0].Key)
+	assert.ErrorIs(t, multiErr.Errors[0], types.ErrInvalidKey)
+	assert.Equal(t, types.Key("big"), multiErr.Errors[1].Key)
+	assert.ErrorIs(t, multiErr.Errors[1], types.ErrInvalidValue)
+	// errors.Is matches any key's error
+	assert.ErrorIs(t, err, types.ErrInvalidKey)
+	assert.ErrorIs(t, err, types.ErrInvalidValue)
+	assert.ErrorContains(t, err, `BatchSet: 2 keys failed: "": invalid key; "big": invalid value`)
+
+	// The batch fails as a whole
+	_, err = db.Get("good")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	err = db.BatchDelete([]types.Key{"a", ""})
+	require.True(t, errors.As(err, &multiErr))
+	assert.Equal(t, "BatchDelete", multiErr.Op)
+	require.Len(t, multiErr.Errors, 1)
+	assert.EqualError(t, err, `BatchDelete: 1 key failed: "": invalid key`)
+
+	config := db.GetConfig()
+	config.EnableTTL = false
+	require.NoError(t, db.SetConfig(config))
+	ttl := time.Minute
+	err = db.BatchSet([]types.Entry{{Key: "session", Value: types.Value("s"), TTL: &ttl}})
+	require.True(t, errors.As(err, &multiErr))
+	assert.Equal(t, types.Key("session"), multiErr.Errors[0].Key)
+	assert.ErrorIs(t, err, types.ErrTTLDisabled)
+}
+
+func TestPersistenceErrorsPassThrough(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.NewDiskDBWithWAL(dir, 0)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Set("key", types.Value("value")))
+
+	const missing = "backup_19700101_000000"
+	assert.ErrorIs(t, db.RestoreFromBackup(missing), persistence.ErrBackupNotFound)
+	_, err = db.GetBackupInfo(missing)
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+	_, err = db.RestoreKeys(missing, []types.Key{"key"})
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+
+	metadata, err := db.CreateBackup("test")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(db.GetConfig().BackupPath(), metadata.Name, "data.db")))
+	err = db.RestoreFromBackup(metadata.Name)
+	var corrupt *persistence.BackupCorruptError
+	require.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, "data.db", corrupt.File)
+
+	_, err = db.ForceRecoveryFromBackup(metadata.Name)
+	assert.ErrorIs(t, err, persistence.ErrRecoveryFailed)
+	assert.ErrorAs(t, err, &corrupt)
+}
@@ -0,0 +1,315 @@
+package engine
+
+import (
+	"bytes"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/wal"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrEventsEvicted is returned by Events when some of the events after the
+// sequence number asked for are gone, so a consumer can't catch up from it
+// and has to rebuild from a fresh read of the database instead
+var ErrEventsEvicted = errors.New("events no longer available")
+
+// EventType is the kind of change an Event records
+type EventType string
+
+const (
+	EventSet    EventType = "set"    // Key was set to Value
+	EventDelete EventType = "delete" // Key was deleted
+	EventClear  EventType = "clear"  // Every key was removed
+)
+
+// Event is a change made to a database. The events of one write, such as
+// a batch or a transaction, share its sequence number.
+type Event struct {
+	Seq       uint64      `json:"seq"`
+	Type      EventType   `json:"type"`
+	Key       types.Key   `json:"key,omitempty"`
+	Value     types.Value `json:"value,omitempty"`
+	ExpiresAt time.Time   `json:"expires_at"` // EventSet, zero if the key doesn't expire
+	Time      time.Time   `json:"time"`       // When the write was journaled
+}
+
+// eventJournal keeps the events of the last capacity writes in a ring, for
+// databases without a WAL to read them from. Writes hold its lock from
+// applying a change to storage until it is journaled, so the journal has
+// the writes of each key in the order storage applied them. A nil journal
+// keeps nothing.
+type eventJournal struct {
+	mu      sync.Mutex
+	writes  [][]Event // Ring of the events of each write
+	oldest  int       // Index of the oldest write in writes
+	count   int       // Writes in the ring
+	nextSeq uint64
+}
+
+// newEventJournal returns a journal of capacity writes, or nil if capacity
+// is 0
+func newEventJournal(capacity int) *eventJournal {
+	if capacity <= 0 {
+		return nil
+	}
+	return &eventJournal{writes: make([][]Event, capacity), nextSeq: 1}
+}
+
+// noUnlock is the unlock function of a nil journal
+func noUnlock() {}
+
+// lock locks the journal for a write and returns a function unlocking it
+func (j *eventJournal) lock() func() {
+	if j == nil {
+		return noUnlock
+	}
+	j.mu.Lock()
+	return j.mu.Unlock
+}
+
+// add journals the events of a write under the next sequence number,
+// evicting the oldest write if the ring is full. The caller holds j.mu.
+func (j *eventJournal) add(events []Event) {
+	now := time.Now()
+	for i := range events {
+		events[i].Seq = j.nextSeq
+		events[i].Time = now
+	}
+	j.nextSeq++
+
+	if j.count == len(j.writes) {
+		j.writes[j.oldest] = events
+		j.oldest = (j.oldest + 1) % len(j.writes)
+		return
+	}
+	j.writes[(j.oldest+j.count)%len(j.writes)] = events
+	j.count++
+}
+
+// set journals key being set to value, expiring at expiresAt. The caller
+// holds j.mu.
+func (j *eventJournal) set(key types.Key, value types.Value, expiresAt time.Time) {
+	if j == nil {
+		return
+	}
+	j.add([]Event{{Type: EventSet, Key: key, Value: bytes.Clone(value), ExpiresAt: expiresAt}})
+}
+
+// batch journals sets and deletes as one write. The caller holds j.mu.
+func (j *eventJournal) batch(sets []types.Entry, deletes []types.Key) {
+	if j == nil {
+		return
+	}
+	now := time.Now()
+	events := make([]Event, 0, len(sets)+len(deletes))
+	for _, entry := range sets {
+		events = append(events, Event{Type: EventSet, Key: entry.Key, Value: bytes.Clone(entry.Value), ExpiresAt: entryExpiry(entry, now)})
+	}
+	for _, key := range deletes {
+		events = append(events, Event{Type: EventDelete, Key: key})
+	}
+	if len(events) > 0 {
+		j.add(events)
+	}
+}
+
+// clear journals every key being removed. The caller holds j.mu.
+func (j *eventJournal) clear() {
+	if j == nil {
+		return
+	}
+	j.add([]Event{{Type: EventClear}})
+}
+
+// reset drops every event and skips a sequence number, so consumers find
+// the events after their position gone, for writes that replace the data
+// wholesale like restores
+func (j *eventJournal) reset() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	clear(j.writes)
+	j.oldest, j.count = 0, 0
+	j.nextSeq++
+}
+
+// lastSeq returns the sequence number of the last write journaled
+func (j *eventJournal) lastSeq() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.nextSeq - 1
+}
+
+// since returns copies of the events after seq, failing with
+// ErrEventsEvicted if some are gone
+func (j *eventJournal) since(seq uint64) ([]Event, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := checkEventSeq(seq, j.nextSeq-1); err != nil {
+		return nil, err
+	}
+	oldest := j.nextSeq
+	if j.count > 0 {
+		oldest = j.writes[j.oldest][0].Seq
+	}
+	if seq+1 < oldest {
+		return nil, fmt.Errorf("%w: the oldest kept is %d, wanted %d", ErrEventsEvicted, oldest, seq+1)
+	}
+
+	var events []Event
+	for i := 0; i < j.count; i++ {
+		write := j.writes[(j.oldest+i)%len(j.writes)]
+		if write[0].Seq <= seq {
+			continue
+		}
+		for _, event := range write {
+			event.Value = bytes.Clone(event.Value)
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// checkEventSeq fails with ErrEventsEvicted for a sequence number after
+// last, which was handed out before the events were dropped wholesale, for
+// instance by a restart of an in-memory journal
+func checkEventSeq(seq, last uint64) error {
+	if seq > last {
+		return fmt.Errorf("%w: sequence %d is after the last, %d", ErrEventsEvicted, seq, last)
+	}
+	return nil
+}
+
+// entryExpiry returns when entry, written at written, expires
+func entryExpiry(entry types.Entry, written time.Time) time.Time {
+	if entry.ExpiresAt.IsZero() && entry.TTL != nil && entry.UpdatedAt.IsZero() {
+		return written.Add(*entry.TTL)
+	}
+	return entry.Expiry()
+}
+
+// walEvents returns the events of the entries diskStorage's WAL logged
+// after seq, an LSN, failing with ErrEventsEvicted if some of those
+// entries are gone from disk
+func walEvents(diskStorage *storage.DiskStorage, seq uint64) ([]Event, error) {
+	// Every entry up to last has been written before the read below
+	last := diskStorage.LastWALLSN()
+	if err := checkEventSeq(seq, last); err != nil {
+		return nil, err
+	}
+	entries, err := diskStorage.ReadWALFrom(seq + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	next := seq + 1
+	for _, entry := range entries {
+		if entry.LSN == 0 {
+			continue
+		}
+		if entry.LSN != next {
+			return nil, fmt.Errorf("%w: the oldest kept is %d, wanted %d", ErrEventsEvicted, entry.LSN, next)
+		}
+		next++
+		events = appendWALEvents(events, entry)
+	}
+	if next <= last {
+		return nil, fmt.Errorf("%w: WAL entries up to %d were removed", ErrEventsEvicted, last)
+	}
+	return events, nil
+}
+
+// appendWALEvents appends the events of a WAL entry to events
+func appendWALEvents(events []Event, entry *wal.WALEntry) []Event {
+	event := Event{Seq: entry.LSN, Time: entry.Timestamp}
+	switch entry.Type {
+	case wal.OpSet:
+		event.Type, event.Key, event.Value = EventSet, entry.Key, entry.Value
+		if entry.ExpiresAt != nil {
+			event.ExpiresAt = *entry.ExpiresAt
+		} else if entry.TTL != nil {
+			event.ExpiresAt = entry.Timestamp.Add(*entry.TTL)
+		}
+		events = append(events, event)
+	case wal.OpDelete:
+		event.Type, event.Key = EventDelete, entry.Key
+		events = append(events, event)
+	case wal.OpClear:
+		event.Type = EventClear
+		events = append(events, event)
+	case wal.OpBatchSet, wal.OpBatchDelete, wal.OpCommit:
+		for _, set := range entry.Entries {
+			event.Type, event.Key, event.Value = EventSet, set.Key, set.Value
+			event.ExpiresAt = entryExpiry(set, entry.Timestamp)
+			events = append(events, event)
+		}
+		for _, key := range entry.Keys {
+			event.Type, event.Key, event.Value, event.ExpiresAt = EventDelete, key, nil, time.Time{}
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// walJournal returns the disk storage whose WAL Events reads, if there is
+// one. The caller holds db.mu.
+func (db *Database) walJournal() (*storage.DiskStorage, bool) {
+	diskStorage, ok := db.storage.(*storage.DiskStorage)
+	return diskStorage, ok && diskStorage.IsWALEnabled()
+}
+
+// Events returns the changes made to the database after sequence number
+// seq, in the order they were made; Events(0) returns every change still
+// kept. A consumer keeping a copy of the data passes the Seq of the last
+// event it applied to get the ones it hasn't seen. If some of those are
+// gone it fails with ErrEventsEvicted, and the consumer has to read the
+// data afresh, starting from LastEventSeq taken before that read.
+//
+// With the WAL enabled the events are read from it, sequence numbers are
+// LSNs, and changes are kept across restarts for as long as their segments
+// are: checkpoints, including the one Close makes, keep only the newest
+// Config.WALRetainSegments, and ClearWAL removes them all. Otherwise
+// Config.EventJournalSize must be set, and the last that many writes are
+// kept in memory, numbered afresh each time the database is opened.
+func (db *Database) Events(seq uint64) ([]Event, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.walJournal(); ok {
+		return walEvents(diskStorage, seq)
+	}
+	if db.events == nil {
+		return nil, fmt.Errorf("event journal is not enabled")
+	}
+	return db.events.since(seq)
+}
+
+// LastEventSeq returns the sequence number of the last change made, 0 if
+// there is none
+func (db *Database) LastEventSeq() (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+
+	if diskStorage, ok := db.walJournal(); ok {
+		return diskStorage.LastWALLSN(), nil
+	}
+	if db.events == nil {
+		return 0, fmt.Errorf("event journal is not enabled")
+	}
+	return db.events.lastSeq(), nil
+}
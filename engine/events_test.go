@@ -0,0 +1,238 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// projection is a downstream copy of a database kept up to date from its
+// events
+type projection struct {
+	data map[types.Key]string
+	seq  uint64 // Seq of the last event applied
+}
+
+// catchUp applies the events after the projection's position, rebuilding
+// it from a fresh read if they are gone
+func (p *projection) catchUp(t *testing.T, db *engine.Database) {
+	events, err := db.Events(p.seq)
+	if err != nil {
+		require.ErrorIs(t, err, engine.ErrEventsEvicted)
+		p.snapshot(t, db)
+		events, err = db.Events(p.seq)
+		require.NoError(t, err)
+	}
+	for _, event := range events {
+		switch event.Type {
+		case engine.EventSet:
+			p.data[event.Key] = string(event.Value)
+		case engine.EventDelete:
+			delete(p.data, event.Key)
+		case engine.EventClear:
+			p.data = map[types.Key]string{}
+		}
+		p.seq = event.Seq
+	}
+}
+
+// snapshot rebuilds the projection from the database's current data
+func (p *projection) snapshot(t *testing.T, db *engine.Database) {
+	seq, err := db.LastEventSeq()
+	require.NoError(t, err)
+	keys, err := db.Keys()
+	require.NoError(t, err)
+	p.data = map[types.Key]string{}
+	for _, key := range keys {
+		value, err := db.Get(key)
+		require.NoError(t, err)
+		p.data[key] = string(value)
+	}
+	p.seq = seq
+}
+
+// contents returns what db holds, like projection.data
+func contents(t *testing.T, db *engine.Database) map[types.Key]string {
+	keys, err := db.Keys()
+	require.NoError(t, err)
+	data := map[types.Key]string{}
+	for _, key := range keys {
+		value, err := db.Get(key)
+		require.NoError(t, err)
+		data[key] = string(value)
+	}
+	return data
+}
+
+func TestEventsJournal(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EventJournalSize = 4
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	value := types.Value("a1")
+	require.NoError(t, db.Set("a", value))
+	// The journal keeps its own copy
+	value[1] = '9'
+	require.NoError(t, db.BatchSet([]types.Entry{
+		{Key: "b", Value: types.Value("b1")},
+		{Key: "c", Value: types.Value("c1")},
+	}))
+	require.NoError(t, db.Delete("a"))
+
+	events, err := db.Events(0)
+	require.NoError(t, err)
+	require.Len(t, events, 4)
+	assert.Equal(t, engine.Event{Seq: 1, Type: engine.EventSet, Key: "a", Value: types.Value("a1"), Time: events[0].Time}, events[0])
+	// A batch is one write
+	assert.Equal(t, uint64(2), events[1].Seq)
+	assert.Equal(t, uint64(2), events[2].Seq)
+	assert.Equal(t, engine.EventDelete, events[3].Type)
+	assert.Equal(t, uint64(3), events[3].Seq)
+
+	events, err = db.Events(2)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, types.Key("a"), events[0].Key)
+	seq, err := db.LastEventSeq()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+	events, err = db.Events(3)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	// Past the journal's capacity the oldest writes are evicted
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Set("d", types.Value(fmt.Sprint(i))))
+	}
+	_, err = db.Events(0)
+	assert.ErrorIs(t, err, engine.ErrEventsEvicted)
+	events, err = db.Events(2)
+	require.NoError(t, err)
+	assert.Len(t, events, 4)
+	// So is a position the journal never handed out
+	_, err = db.Events(100)
+	assert.ErrorIs(t, err, engine.ErrEventsEvicted)
+
+	require.NoError(t, db.Clear())
+	events, err = db.Events(6)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, engine.EventClear, events[0].Type)
+
+	// Without a journal or a WAL there are no events
+	plain := engine.NewInMemoryDB()
+	defer plain.Close()
+	_, err = plain.Events(0)
+	assert.Error(t, err)
+}
+
+func TestEventsConsumerResume(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EventJournalSize = 8
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	consumer := &projection{data: map[types.Key]string{}}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 5; i++ {
+			key := types.Key(fmt.Sprintf("key%d", (round+i)%7))
+			if i == 4 {
+				require.NoError(t, db.Delete(key))
+			} else {
+				require.NoError(t, db.Set(key, types.Value(fmt.Sprintf("%d-%d", round, i))))
+			}
+		}
+		consumer.catchUp(t, db)
+		assert.Equal(t, contents(t, db), consumer.data)
+	}
+
+	// A consumer that falls too far behind rebuilds and carries on
+	stale := &projection{data: map[types.Key]string{}, seq: consumer.seq}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("late%d", i)), types.Value("v")))
+	}
+	_, err = db.Events(stale.seq)
+	require.ErrorIs(t, err, engine.ErrEventsEvicted)
+	stale.catchUp(t, db)
+	assert.Equal(t, contents(t, db), stale.data)
+	require.NoError(t, db.Set("after", types.Value("v")))
+	stale.catchUp(t, db)
+	assert.Equal(t, contents(t, db), stale.data)
+}
+
+func TestEventsConcurrentWritesKeepKeyOrder(t *testing.T) {
+	config := types.DefaultConfig()
+	config.EventJournalSize = 10000
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := types.Key(fmt.Sprintf("key%d", i%5))
+				assert.NoError(t, db.Set(key, types.Value(fmt.Sprintf("%d-%d", w, i))))
+			}
+		}()
+	}
+	wg.Wait()
+
+	consumer := &projection{data: map[types.Key]string{}}
+	consumer.catchUp(t, db)
+	assert.Equal(t, contents(t, db), consumer.data)
+}
+
+func TestEventsFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	config := types.DefaultConfig()
+	// Closing checkpoints the WAL, so its segments must be retained
+	config.WALRetainSegments = 10
+	db, err := engine.Open(dir, engine.WithConfig(config), engine.WithWAL(0))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Set("a", types.Value("1")))
+	require.NoError(t, db.BatchSet([]types.Entry{
+		{Key: "b", Value: types.Value("2")},
+		{Key: "c", Value: types.Value("3")},
+	}))
+	consumer := &projection{data: map[types.Key]string{}}
+	consumer.catchUp(t, db)
+	assert.Equal(t, contents(t, db), consumer.data)
+	assert.Equal(t, uint64(2), consumer.seq)
+
+	// The WAL keeps the events across a restart, so the consumer resumes
+	// where it stopped
+	require.NoError(t, db.Delete("a"))
+	require.NoError(t, db.Close())
+	db, err = engine.Open(dir, engine.WithConfig(config), engine.WithWAL(0))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Set("d", types.Value("4")))
+	events, err := db.Events(consumer.seq)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, engine.EventDelete, events[0].Type)
+	consumer.catchUp(t, db)
+	assert.Equal(t, contents(t, db), consumer.data)
+
+	// Once the WAL is cleared the events the consumer hasn't seen are gone
+	require.NoError(t, db.Set("e", types.Value("5")))
+	require.NoError(t, db.ClearWAL())
+	require.NoError(t, db.Set("f", types.Value("6")))
+	_, err = db.Events(consumer.seq)
+	assert.ErrorIs(t, err, engine.ErrEventsEvicted)
+	consumer.catchUp(t, db)
+	assert.Equal(t, contents(t, db), consumer.data)
+}
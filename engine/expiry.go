@@ -0,0 +1,319 @@
+package engine
+
+import (
+	"database_engine/types"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expiryQueueSize is how many expired entries can wait for the OnExpire
+// callbacks before further ones are dropped
+const expiryQueueSize = 1024
+
+// expiredEntry is an entry removed because it expired, waiting for the
+// OnExpire callbacks
+type expiredEntry struct {
+	key   types.Key
+	value types.Value
+}
+
+// expiryNotifier passes the entries storage removes because they expired
+// to the OnExpire callbacks, which a single worker goroutine calls in
+// order. Storage only queues them, so a slow callback never holds up a
+// read; once the queue is full further expiries are dropped and counted.
+type expiryNotifier struct {
+	mu        sync.RWMutex
+	callbacks []func(key types.Key, value types.Value)
+	queue     chan expiredEntry
+	dropped   atomic.Int64
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// newExpiryNotifier creates a notifier and starts its worker
+func newExpiryNotifier() *expiryNotifier {
+	n := &expiryNotifier{
+		queue: make(chan expiredEntry, expiryQueueSize),
+		stop:  make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// add registers fn alongside the callbacks already registered
+func (n *expiryNotifier) add(fn func(key types.Key, value types.Value)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.callbacks = append(n.callbacks, fn)
+}
+
+// enqueue queues an expired entry for the callbacks without blocking. It is
+// the storage's expiry callback, so it may run with storage locks held.
+func (n *expiryNotifier) enqueue(key types.Key, value types.Value) {
+	select {
+	case n.queue <- expiredEntry{key: key, value: value}:
+	default:
+		n.dropped.Add(1)
+	}
+}
+
+// run delivers queued entries until close, then delivers whatever was
+// already queued and returns
+func (n *expiryNotifier) run() {
+	for {
+		select {
+		case entry := <-n.queue:
+			n.deliver(entry)
+		case <-n.stop:
+			for {
+				select {
+				case entry := <-n.queue:
+					n.deliver(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver calls every callback with entry
+func (n *expiryNotifier) deliver(entry expiredEntry) {
+	n.mu.RLock()
+	callbacks := n.callbacks
+	n.mu.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(entry.key, entry.value)
+	}
+}
+
+// close stops the worker once the entries already queued are delivered,
+// without waiting for it
+func (n *expiryNotifier) close() {
+	n.stopOnce.Do(func() { close(n.stop) })
+}
+
+// OnExpire registers fn to be called with the key and value of every entry
+// removed because it expired: found expired by Get or Exists, removed by
+// CleanupExpired or the background cleanup every Config.CleanupInterval,
+// or dropped by compaction. Callbacks are called one at a time, in the
+// order entries expired, from a worker goroutine rather than the one that
+// removed the entry, so they can't slow down reads; a callback that takes
+// long delays the ones after it instead. Each expiry is delivered at most
+// once: when expiryQueueSize expiries are already waiting, further ones
+// are dropped and counted in Stats.ExpiryDropped. Entries removed before
+// the first callback is registered aren't delivered. The value is the
+// whole stored value, which may be large, and must not be modified.
+func (db *Database) OnExpire(fn func(key types.Key, value types.Value)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	if _, ok := db.storage.(types.ExpiryNotifier); !ok {
+		return fmt.Errorf("expiry callbacks not supported for this storage type")
+	}
+
+	if db.expiry == nil {
+		db.expiry = newExpiryNotifier()
+		db.setExpiryCallback()
+	}
+	db.expiry.add(fn)
+	return nil
+}
+
+// setExpiryCallback points the storage's expiry callback at the notifier,
+// if any callbacks are registered. The caller must hold db.mu exclusively.
+func (db *Database) setExpiryCallback() {
+	if db.expiry == nil {
+		return
+	}
+	if notifier, ok := db.storage.(types.ExpiryNotifier); ok {
+		notifier.SetExpiryCallback(db.expiry.enqueue)
+	}
+}
+
+// startJanitor starts removing expired entries in the background, until the
+// database is closed or the interval changes. It wakes up every
+// config.CleanupInterval, or sooner when storage implementing
+// types.ExpiryScheduler has an entry expiring before then. A non-positive
+// interval leaves expired entries to be removed when they are read or by
+// CleanupExpired. The caller must hold db.mu exclusively or own db.
+func (db *Database) startJanitor(config types.Config) {
+	if config.CleanupInterval <= 0 {
+		return
+	}
+	if _, ok := db.storage.(types.ExpiredCleaner); !ok {
+		return
+	}
+
+	stop := make(chan struct{})
+	db.janitorStop = stop
+	go db.runJanitor(config.CleanupInterval, stop)
+}
+
+// stopJanitor stops the background cleanup, if it is running. The caller
+// must hold db.mu exclusively.
+func (db *Database) stopJanitor() {
+	if db.janitorStop != nil {
+		close(db.janitorStop)
+		db.janitorStop = nil
+	}
+}
+
+// runJanitor calls CleanupExpired until stop is closed, waiting as long as
+// janitorWait says in between
+func (db *Database) runJanitor(interval time.Duration, stop <-chan struct{}) {
+	timer := time.NewTimer(db.janitorWait(interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			db.CleanupExpired()
+			timer.Reset(db.janitorWait(interval))
+		}
+	}
+}
+
+// janitorWait returns how long the janitor waits for the next cleanup:
+// until the next entry expires if the storage knows when that is, but no
+// longer than interval, since entries set in the meantime may expire
+// sooner. A millisecond at least keeps it from spinning.
+func (db *Database) janitorWait(interval time.Duration) time.Duration {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	scheduler, ok := db.storage.(types.ExpiryScheduler)
+	if db.closed || !ok {
+		return interval
+	}
+	next, ok := scheduler.NextExpiry()
+	if !ok {
+		return interval
+	}
+	return min(max(time.Until(next), time.Millisecond), interval)
+}
+
+// ExpireBatch gives each of keys that exists ttl to live from now, keeping
+// its value, or deletes it if ttl <= 0. The keys are changed as one write:
+// storage locks them once, disk storage saves its index once, and the WAL
+// logs a single batch entry, so recovery applies all of them or none. It
+// returns how many keys were changed and the keys that weren't found;
+// expired keys count as missing. TTLs aren't jittered, and with TTLs
+// disabled it fails with ErrTTLDisabled.
+func (db *Database) ExpireBatch(keys []types.Key, ttl time.Duration) (int, []types.Key, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, nil, types.NewOpError("ExpireBatch", "", types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateLookupKeys("ExpireBatch", keys); err != nil {
+		return 0, nil, err
+	}
+
+	touched, missing, err := db.expireBatch(keys, ttl)
+	return touched, missing, types.NewOpError("ExpireBatch", "", err)
+}
+
+// ExpireByPrefix gives every key starting with prefix ttl to live from now,
+// or deletes them if ttl <= 0, as a single write like ExpireBatch, and
+// returns how many keys were changed. Keys written under the prefix while
+// it runs may be left out.
+func (db *Database) ExpireByPrefix(prefix types.Key, ttl time.Duration) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return 0, types.NewOpError("ExpireByPrefix", prefix, types.ErrDatabaseClosed)
+	}
+
+	keys, err := db.keysWithPrefix(prefix)
+	if err != nil {
+		return 0, types.NewOpError("ExpireByPrefix", prefix, err)
+	}
+
+	// Keys deleted since they were listed are simply not counted
+	touched, _, err := db.expireBatch(keys, ttl)
+	return touched, types.NewOpError("ExpireByPrefix", prefix, err)
+}
+
+// expireBatch implements ExpireBatch for keys that are already validated;
+// the caller must hold db.mu
+func (db *Database) expireBatch(keys []types.Key, ttl time.Duration) (int, []types.Key, error) {
+	if !db.config.EnableTTL {
+		return 0, nil, types.ErrTTLDisabled
+	}
+
+	expirer, ok := db.storage.(types.Expirer)
+	if !ok {
+		return 0, nil, fmt.Errorf("batch expiry not supported for this storage type")
+	}
+
+	// Each key is changed once however often it is listed
+	unique := make([]types.Key, 0, len(keys))
+	seen := make(map[types.Key]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+
+	missing, err := expirer.ExpireBatch(unique, ttl)
+	if err != nil {
+		return 0, nil, err
+	}
+	if db.accessStats != nil {
+		missed := make(map[types.Key]bool, len(missing))
+		for _, key := range missing {
+			missed[key] = true
+		}
+		for _, key := range unique {
+			if !missed[key] {
+				db.accessStats.write(key)
+			}
+		}
+	}
+	return len(unique) - len(missing), missing, nil
+}
+
+// jitterTTL moves ttl by a random amount of up to fraction of it either way,
+// so that keys written with the same TTL at the same time don't all expire
+// at once. A non-positive fraction leaves ttl as it is.
+func jitterTTL(ttl time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || ttl <= 0 {
+		return ttl
+	}
+	fraction = min(fraction, 1)
+	return ttl + time.Duration((2*rand.Float64()-1)*fraction*float64(ttl))
+}
+
+// jitterTTLs applies Config.TTLJitterFraction to the entries written with a
+// TTL rather than an expiry time. entries is left as it is; the entries
+// returned share their keys and values. The caller must hold db.mu.
+func (db *Database) jitterTTLs(entries []types.Entry) []types.Entry {
+	if db.config.TTLJitterFraction <= 0 {
+		return entries
+	}
+
+	jittered := make([]types.Entry, len(entries))
+	for i, entry := range entries {
+		if entry.TTL != nil && entry.ExpiresAt.IsZero() {
+			ttl := jitterTTL(*entry.TTL, db.config.TTLJitterFraction)
+			entry.TTL = &ttl
+		}
+		jittered[i] = entry
+	}
+	return jittered
+}
@@ -0,0 +1,245 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expiryBackends opens each storage backend with a given config
+var expiryBackends = []struct {
+	name  string
+	newDB func(t *testing.T, config types.Config) *engine.Database
+}{
+	{"Memory", func(t *testing.T, config types.Config) *engine.Database {
+		db, err := engine.NewInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		return db
+	}},
+	{"OrderedMemory", func(t *testing.T, config types.Config) *engine.Database {
+		db, err := engine.NewOrderedInMemoryDBWithConfig(config)
+		require.NoError(t, err)
+		return db
+	}},
+	{"Disk", func(t *testing.T, config types.Config) *engine.Database {
+		config.EnablePersistence = true
+		config.DataDirectory = t.TempDir()
+		db, err := engine.NewDiskDBWithConfig(config)
+		require.NoError(t, err)
+		return db
+	}},
+}
+
+// recordExpiries registers an OnExpire callback and returns the channel it
+// sends each expired key and value on
+func recordExpiries(t *testing.T, db *engine.Database) <-chan types.Entry {
+	t.Helper()
+
+	expired := make(chan types.Entry, 16)
+	require.NoError(t, db.OnExpire(func(key types.Key, value types.Value) {
+		expired <- types.Entry{Key: key, Value: value}
+	}))
+	return expired
+}
+
+// receiveExpiries waits for n expiries and checks that no more follow
+func receiveExpiries(t *testing.T, expired <-chan types.Entry, n int) map[types.Key]string {
+	t.Helper()
+
+	got := make(map[types.Key]string)
+	for i := 0; i < n; i++ {
+		select {
+		case entry := <-expired:
+			_, seen := got[entry.Key]
+			assert.False(t, seen, "%s delivered twice", entry.Key)
+			got[entry.Key] = string(entry.Value)
+		case <-time.After(2 * time.Second):
+			require.Failf(t, "missing expiries", "got %v, want %d", got, n)
+		}
+	}
+	select {
+	case entry := <-expired:
+		assert.Failf(t, "unexpected expiry", "%s", entry.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return got
+}
+
+func TestOnExpire(t *testing.T) {
+	for _, backend := range expiryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Run("Lazy", func(t *testing.T) {
+				config := types.DefaultConfig()
+				config.CleanupInterval = 0
+				db := backend.newDB(t, config)
+				defer db.Close()
+				expired := recordExpiries(t, db)
+
+				require.NoError(t, db.SetWithTTL("read", types.Value("r"), 10*time.Millisecond))
+				require.NoError(t, db.SetWithTTL("checked", types.Value("c"), 10*time.Millisecond))
+				require.NoError(t, db.SetWithTTL("live", types.Value("l"), time.Hour))
+				time.Sleep(20 * time.Millisecond)
+
+				// Concurrent reads of the same expired key deliver it once
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := db.Get("read")
+						assert.Error(t, err)
+					}()
+				}
+				wg.Wait()
+				exists, err := db.Exists("checked")
+				require.NoError(t, err)
+				assert.False(t, exists)
+				_, err = db.Get("live")
+				require.NoError(t, err)
+
+				got := receiveExpiries(t, expired, 2)
+				assert.Equal(t, map[types.Key]string{"read": "r", "checked": "c"}, got)
+			})
+
+			t.Run("Janitor", func(t *testing.T) {
+				config := types.DefaultConfig()
+				config.CleanupInterval = 10 * time.Millisecond
+				db := backend.newDB(t, config)
+				defer db.Close()
+				expired := recordExpiries(t, db)
+
+				require.NoError(t, db.SetWithTTL("session", types.Value("s"), 10*time.Millisecond))
+				require.NoError(t, db.Set("plain", types.Value("p")))
+
+				// Nothing reads the key; the background cleanup removes it
+				got := receiveExpiries(t, expired, 1)
+				assert.Equal(t, map[types.Key]string{"session": "s"}, got)
+				exists, err := db.Exists("session")
+				require.NoError(t, err)
+				assert.False(t, exists)
+			})
+		})
+	}
+}
+
+func TestOnExpireSlowCallback(t *testing.T) {
+	config := types.DefaultConfig()
+	config.CleanupInterval = 0
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	delivered := 0
+	require.NoError(t, db.OnExpire(func(key types.Key, value types.Value) {
+		<-release
+		mu.Lock()
+		delivered++
+		mu.Unlock()
+	}))
+
+	const keys = 2000
+	for i := 0; i < keys; i++ {
+		require.NoError(t, db.SetWithTTL(types.Key(fmt.Sprintf("key%04d", i)), types.Value("v"), time.Millisecond))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Reads don't wait for the blocked callback, and the expiries that
+	// don't fit in the queue are dropped
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < keys; i++ {
+			_, err := db.Get(types.Key(fmt.Sprintf("key%04d", i)))
+			assert.ErrorIs(t, err, types.ErrKeyExpired)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads blocked on the expiry callback")
+	}
+
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Positive(t, stats.ExpiryDropped)
+	close(release)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return int64(delivered)+stats.ExpiryDropped == keys
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestTTLJitter(t *testing.T) {
+	config := types.DefaultConfig()
+	config.TTLJitterFraction = 0.1
+	db, err := engine.NewInMemoryDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	const keys = 2000
+	ttl := time.Hour
+	batch := make([]types.Entry, 0, keys/2)
+	for i := 0; i < keys; i++ {
+		key := types.Key(fmt.Sprintf("key%04d", i))
+		if i%2 == 0 {
+			require.NoError(t, db.SetWithTTL(key, types.Value("v"), ttl))
+		} else {
+			batch = append(batch, types.Entry{Key: key, Value: types.Value("v"), TTL: &ttl})
+		}
+	}
+	require.NoError(t, db.BatchSet(batch))
+	assert.Equal(t, time.Hour, ttl, "the caller's TTL is left as it is")
+
+	// Remaining lifetimes fall within ±10% of the TTL, spread evenly enough
+	// that each tenth of that window gets a fair share of them
+	low, high := 54*time.Minute, 66*time.Minute
+	buckets := make([]int, 10)
+	for i := 0; i < keys; i++ {
+		_, remaining, hasTTL, err := db.GetWithTTL(types.Key(fmt.Sprintf("key%04d", i)))
+		require.NoError(t, err)
+		require.True(t, hasTTL)
+		require.GreaterOrEqual(t, remaining, low-time.Second)
+		require.LessOrEqual(t, remaining, high)
+		bucket := int((remaining - low) * 10 / (high - low))
+		buckets[max(0, min(bucket, 9))]++
+	}
+	for i, count := range buckets {
+		assert.Greater(t, count, keys/20, "bucket %d of %v", i, buckets)
+	}
+}
+
+func TestTTLJitterPersisted(t *testing.T) {
+	dir := t.TempDir()
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = dir
+	config.TTLJitterFraction = 0.5
+
+	db, err := engine.NewDiskDBWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, db.SetWithTTL("key", types.Value("v"), time.Hour))
+	_, before, _, err := db.GetWithTTL("key")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// The jittered TTL is the one stored, so reopening doesn't draw a new one
+	config.TTLJitterFraction = 0
+	db, err = engine.NewDiskDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+	_, after, hasTTL, err := db.GetWithTTL("key")
+	require.NoError(t, err)
+	assert.True(t, hasTTL)
+	assert.InDelta(t, before, after, float64(time.Second))
+}
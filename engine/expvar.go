@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"database_engine/persistence"
+	"database_engine/types"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// ErrExpvarPrefixTaken is returned by PublishExpvar for a prefix another
+// open database, or something other than a database, already publishes
+// under
+var ErrExpvarPrefixTaken = errors.New("expvar prefix already in use")
+
+// expvarNames are the variables PublishExpvar publishes, each named prefix
+// + "." + name
+var expvarNames = []string{"entries", "disk_usage", "wal_size", "stats", "last_backup"}
+
+// expvarPublished maps each prefix published under to the publication its
+// variables read. expvar can't unregister a variable, so a prefix stays
+// published for the life of the process and can pass to another database
+// once its database closes.
+var (
+	expvarMu        sync.Mutex
+	expvarPublished = make(map[string]*expvarPublication)
+)
+
+// expvarPublication is what the variables under one prefix report: the
+// values of the open database publishing them, or those frozen when it
+// closed
+type expvarPublication struct {
+	mu     sync.Mutex
+	db     *Database      // nil once the database closes
+	frozen map[string]any // Values when db closed
+}
+
+// PublishExpvar publishes the database's entry count, disk usage and WAL
+// size in bytes, its Stats and the time of its last backup as expvar
+// variables named prefix + ".entries", ".disk_usage", ".wal_size",
+// ".stats" and ".last_backup", served as JSON by expvar's /debug/vars
+// handler. Values that don't apply to the storage, such as the disk usage
+// of an in-memory database, are null. The values are read each time they
+// are served until the database closes, from then on they keep their
+// values at Close. A prefix another open database publishes under fails
+// with ErrExpvarPrefixTaken; one left by a closed database is taken over.
+func (db *Database) PublishExpvar(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("expvar prefix must not be empty")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+
+	publication, ok := expvarPublished[prefix]
+	if !ok {
+		for _, name := range expvarNames {
+			if expvar.Get(prefix+"."+name) != nil {
+				return fmt.Errorf("%w: %q is published by something else", ErrExpvarPrefixTaken, prefix+"."+name)
+			}
+		}
+		publication = &expvarPublication{}
+		for _, name := range expvarNames {
+			name := name
+			expvar.Publish(prefix+"."+name, expvar.Func(func() any {
+				return publication.value(name)
+			}))
+		}
+		expvarPublished[prefix] = publication
+	}
+
+	publication.mu.Lock()
+	defer publication.mu.Unlock()
+
+	switch publication.db {
+	case db:
+		return nil
+	case nil:
+		publication.db = db
+		publication.frozen = nil
+		db.expvars = append(db.expvars, publication)
+		return nil
+	default:
+		return fmt.Errorf("%w: %q is published by another database", ErrExpvarPrefixTaken, prefix)
+	}
+}
+
+// value returns the current value of the variable name
+func (p *expvarPublication) value(name string) any {
+	p.mu.Lock()
+	db := p.db
+	p.mu.Unlock()
+
+	// p.mu isn't held while reading db, since Close holds db.mu while
+	// freezing p
+	if db != nil {
+		values, err := db.expvarValues()
+		if err == nil {
+			return values[name]
+		}
+		if !errors.Is(err, types.ErrDatabaseClosed) {
+			return err.Error()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.frozen[name]
+}
+
+// expvarValues returns the values of the published variables, by name
+func (db *Database) expvarValues() (map[string]any, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.expvarSnapshot()
+}
+
+// expvarSnapshot implements expvarValues. The caller must hold db.mu.
+func (db *Database) expvarSnapshot() (map[string]any, error) {
+	stats, err := db.stats()
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]any{
+		"entries":     stats.Keys,
+		"disk_usage":  nil,
+		"wal_size":    nil,
+		"stats":       stats,
+		"last_backup": nil,
+	}
+	if stats.DiskUsage != nil {
+		values["disk_usage"] = stats.DiskUsage.Total
+		values["wal_size"] = stats.DiskUsage.WALSize
+	}
+	if db.backupManager != nil {
+		backups, err := db.backupManager.ListBackupsWithFilter(persistence.BackupFilter{Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(backups) > 0 {
+			values["last_backup"] = backups[0].Timestamp
+		}
+	}
+	return values, nil
+}
+
+// freezeExpvars makes the variables db publishes keep their current
+// values, and frees their prefixes for other databases. The caller must
+// hold db.mu for writing.
+func (db *Database) freezeExpvars() {
+	if len(db.expvars) == 0 {
+		return
+	}
+
+	// A failed snapshot leaves the variables null
+	values, _ := db.expvarSnapshot()
+	for _, publication := range db.expvars {
+		publication.mu.Lock()
+		if publication.db == db {
+			publication.db = nil
+			publication.frozen = values
+		}
+		publication.mu.Unlock()
+	}
+	db.expvars = nil
+}
@@ -0,0 +1,92 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readExpvars fetches the variables expvar's handler serves
+func readExpvars(t *testing.T) map[string]json.RawMessage {
+	recorder := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/vars", nil))
+	require.Equal(t, 200, recorder.Code)
+
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &vars))
+	return vars
+}
+
+func TestPublishExpvar(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("a", types.Value("1")))
+	require.NoError(t, db.Set("b", types.Value("2")))
+	backup, err := db.CreateBackup("expvar")
+	require.NoError(t, err)
+	require.NoError(t, db.PublishExpvar("diskdb"))
+	// Publishing again under the same prefix is a no-op
+	require.NoError(t, db.PublishExpvar("diskdb"))
+
+	vars := readExpvars(t)
+	for _, name := range []string{"entries", "disk_usage", "wal_size", "stats", "last_backup"} {
+		assert.Contains(t, vars, "diskdb."+name)
+	}
+	assert.JSONEq(t, "2", string(vars["diskdb.entries"]))
+	var diskUsage, walSize int64
+	require.NoError(t, json.Unmarshal(vars["diskdb.disk_usage"], &diskUsage))
+	require.NoError(t, json.Unmarshal(vars["diskdb.wal_size"], &walSize))
+	assert.Positive(t, diskUsage)
+	assert.Positive(t, walSize)
+	var stats engine.Stats
+	require.NoError(t, json.Unmarshal(vars["diskdb.stats"], &stats))
+	assert.Equal(t, "disk", stats.StorageType)
+	require.NotNil(t, stats.Storage)
+	assert.Equal(t, int64(2), stats.Storage.Writes)
+	expected, err := json.Marshal(backup.Timestamp)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(vars["diskdb.last_backup"]))
+
+	// The values are read each time they are served
+	require.NoError(t, db.Set("c", types.Value("3")))
+	assert.JSONEq(t, "3", string(readExpvars(t)["diskdb.entries"]))
+
+	// Once closed, they keep their last values
+	require.NoError(t, db.Close())
+	assert.JSONEq(t, "3", string(readExpvars(t)["diskdb.entries"]))
+}
+
+func TestPublishExpvarPrefixTaken(t *testing.T) {
+	first := engine.NewInMemoryDB()
+	defer first.Close()
+	second := engine.NewInMemoryDB()
+	defer second.Close()
+
+	require.NoError(t, first.Set("key", types.Value("value")))
+	require.NoError(t, first.PublishExpvar("memdb"))
+	assert.ErrorIs(t, second.PublishExpvar("memdb"), engine.ErrExpvarPrefixTaken)
+
+	vars := readExpvars(t)
+	assert.JSONEq(t, "1", string(vars["memdb.entries"]))
+	assert.JSONEq(t, "null", string(vars["memdb.disk_usage"]))
+	assert.JSONEq(t, "null", string(vars["memdb.last_backup"]))
+
+	// A closed database's prefix can be taken over
+	require.NoError(t, first.Close())
+	require.NoError(t, second.PublishExpvar("memdb"))
+	assert.JSONEq(t, "0", string(readExpvars(t)["memdb.entries"]))
+
+	// But not a name published by something other than a database
+	if expvar.Get("taken.entries") == nil {
+		expvar.NewInt("taken.entries")
+	}
+	assert.ErrorIs(t, second.PublishExpvar("taken"), engine.ErrExpvarPrefixTaken)
+}
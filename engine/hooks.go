@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"context"
+	"database_engine/types"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// OpInfo describes an operation to hooks. It is passed by value and holds
+// no keys or values of the operation itself, so hooks can't change what it
+// reads or writes.
+type OpInfo struct {
+	Op        string        // Get, Set, Delete, BatchGet, BatchSet, BatchDelete, Compact, Backup or Restore
+	Key       types.Key     // The key of single-key operations
+	Keys      int           // How many keys the operation is on
+	ValueSize int           // Bytes written, or read once the operation is done
+	Storage   string        // The storage backend: disk, memory or ordered-memory
+	WAL       bool          // Whether the operation goes through the WAL: writes, backups and restores of a database with one
+	Duration  time.Duration // How long the operation took; zero in BeforeOp
+}
+
+// Hook observes the core operations of a database. BeforeOp is called
+// before each operation starts and returns the context AfterOp is called
+// with once it is done, with the error it returns. Both run on the
+// operation's goroutine while it holds the database lock, so they must be
+// quick and must not call the database. A hook that panics is recovered
+// and logged at error level; the operation goes on.
+//
+// The first BeforeOp gets the caller's context for Backup and Restore,
+// which take one, and context.Background() for the other operations.
+type Hook interface {
+	BeforeOp(ctx context.Context, info OpInfo) context.Context
+	AfterOp(ctx context.Context, info OpInfo, err error)
+}
+
+// AddHook adds h to the hooks called around Get, Set, Delete, BatchGet,
+// BatchSet, BatchDelete and Compact, and around backups and restores as
+// Backup and Restore. Hooks are called in the order they were added before
+// an operation, and in reverse order after it.
+func (db *Database) AddHook(h Hook) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+	if h == nil {
+		return fmt.Errorf("hook is nil")
+	}
+	// Copied so a running operation keeps the hooks it started with
+	hooks := make([]Hook, len(db.hooks), len(db.hooks)+1)
+	copy(hooks, db.hooks)
+	db.hooks = append(hooks, h)
+	return nil
+}
+
+// opCall is an operation in progress
+type opCall struct {
+	op    latencyOp
+	info  OpInfo
+	start time.Time       // Zero if nothing needs the operation timed
+	ctx   context.Context // Passed to the first BeforeOp, then returned by the last
+	hooks []Hook
+}
+
+// startHookedOp starts an operation named op that only hooks observe, such
+// as a backup, passing ctx to the first BeforeOp. The caller must hold
+// db.mu.
+func (db *Database) startHookedOp(ctx context.Context, op string) opCall {
+	call := opCall{info: OpInfo{Op: op}, ctx: ctx, hooks: db.hooks}
+	if len(call.hooks) > 0 {
+		call.info.Storage = db.storageBackend()
+		_, call.info.WAL = db.walJournal()
+		db.beforeHooks(&call)
+		call.start = time.Now()
+	}
+	return call
+}
+
+// finishHookedOp calls the hooks' AfterOp for call, started by
+// startHookedOp, with err. The caller must hold db.mu.
+func (db *Database) finishHookedOp(call *opCall, err error) {
+	if len(call.hooks) > 0 {
+		call.info.Duration = time.Since(call.start)
+		db.afterHooks(call, err)
+	}
+}
+
+// beforeHooks calls the BeforeOp of each hook of call, recovering panics
+func (db *Database) beforeHooks(call *opCall) {
+	if call.ctx == nil {
+		call.ctx = context.Background()
+	}
+	for _, h := range call.hooks {
+		if ctx := db.beforeHook(h, call); ctx != nil {
+			call.ctx = ctx
+		}
+	}
+}
+
+// beforeHook calls h.BeforeOp, returning nil if it panics
+func (db *Database) beforeHook(h Hook, call *opCall) (ctx context.Context) {
+	defer db.recoverHook(h, "BeforeOp", call.info)
+	return h.BeforeOp(call.ctx, call.info)
+}
+
+// afterHooks calls the AfterOp of each hook of call in reverse order,
+// recovering panics
+func (db *Database) afterHooks(call *opCall, err error) {
+	for i := len(call.hooks) - 1; i >= 0; i-- {
+		db.afterHook(call.hooks[i], call, err)
+	}
+}
+
+// afterHook calls h.AfterOp
+func (db *Database) afterHook(h Hook, call *opCall, err error) {
+	defer db.recoverHook(h, "AfterOp", call.info)
+	h.AfterOp(call.ctx, call.info, err)
+}
+
+// recoverHook logs the panic of the hook method called, if it panicked
+func (db *Database) recoverHook(h Hook, method string, info OpInfo) {
+	if r := recover(); r != nil {
+		db.log.Error("hook panicked", "hook", fmt.Sprintf("%T", h), "method", method, "op", info.Op, "panic", r)
+	}
+}
+
+// entriesSize is the number of value bytes in entries
+func entriesSize(entries []types.Entry) int {
+	size := 0
+	for _, entry := range entries {
+		size += len(entry.Value)
+	}
+	return size
+}
+
+// valuesSize is the number of bytes in values
+func valuesSize(values map[types.Key]types.Value) int {
+	size := 0
+	for _, value := range values {
+		size += len(value)
+	}
+	return size
+}
+
+// AuditHook is a Hook writing a JSON line for each operation to an
+// io.Writer, once it is done:
+//
+//	{"time":"2024-05-01T12:00:00Z","op":"Set","key":"user:1","keys":1,"value_size":42,"duration":15300}
+//
+// Durations are in nanoseconds, and failed operations have an "error".
+// Lines are written whole even when operations run concurrently.
+type AuditHook struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// auditRecord is a line of an audit log
+type auditRecord struct {
+	Time      time.Time     `json:"time"`
+	Op        string        `json:"op"`
+	Key       types.Key     `json:"key,omitempty"`
+	Keys      int           `json:"keys"`
+	ValueSize int           `json:"value_size"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// NewAuditHook returns a hook writing an audit log to w
+func NewAuditHook(w io.Writer) *AuditHook {
+	return &AuditHook{w: w}
+}
+
+// BeforeOp does nothing; operations are logged once done
+func (h *AuditHook) BeforeOp(ctx context.Context, info OpInfo) context.Context {
+	return ctx
+}
+
+// AfterOp writes the line of the operation
+func (h *AuditHook) AfterOp(ctx context.Context, info OpInfo, err error) {
+	record := auditRecord{
+		Time:      time.Now().UTC(),
+		Op:        info.Op,
+		Key:       info.Key,
+		Keys:      info.Keys,
+		ValueSize: info.ValueSize,
+		Duration:  info.Duration,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		h.fail(marshalErr)
+		return
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, writeErr := h.w.Write(line); writeErr != nil && h.err == nil {
+		h.err = writeErr
+	}
+}
+
+// fail keeps err if it is the first error
+func (h *AuditHook) fail(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err == nil {
+		h.err = err
+	}
+}
+
+// Err returns the first error writing the log, which lines written after
+// it may be missing from
+func (h *AuditHook) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
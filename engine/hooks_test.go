@@ -0,0 +1,221 @@
+package engine_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type hookKey struct{}
+
+// recordingHook keeps the operations it sees, tagging the context BeforeOp
+// returns with its name
+type recordingHook struct {
+	name   string
+	calls  *[]string
+	after  []engine.OpInfo
+	errors []error
+}
+
+func (h *recordingHook) BeforeOp(ctx context.Context, info engine.OpInfo) context.Context {
+	*h.calls = append(*h.calls, h.name+" before "+info.Op)
+	return context.WithValue(ctx, hookKey{}, h.name)
+}
+
+func (h *recordingHook) AfterOp(ctx context.Context, info engine.OpInfo, err error) {
+	*h.calls = append(*h.calls, h.name+" after "+info.Op+" "+ctx.Value(hookKey{}).(string))
+	h.after = append(h.after, info)
+	h.errors = append(h.errors, err)
+}
+
+// panickingHook panics in every call
+type panickingHook struct{}
+
+func (panickingHook) BeforeOp(context.Context, engine.OpInfo) context.Context { panic("before") }
+func (panickingHook) AfterOp(context.Context, engine.OpInfo, error)           { panic("after") }
+
+func TestHooks(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	var calls []string
+	first := &recordingHook{name: "first", calls: &calls}
+	second := &recordingHook{name: "second", calls: &calls}
+	require.NoError(t, db.AddHook(first))
+	require.NoError(t, db.AddHook(second))
+	assert.Error(t, db.AddHook(nil))
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	assert.Equal(t, []string{
+		"first before Set",
+		"second before Set",
+		"second after Set second",
+		"first after Set second",
+	}, calls)
+
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	_, err = db.Get("missing")
+	require.Error(t, err)
+	require.NoError(t, db.BatchSet([]types.Entry{
+		{Key: "a", Value: types.Value("1")},
+		{Key: "b", Value: types.Value("22")},
+	}))
+	values, err := db.BatchGet([]types.Key{"a", "b"})
+	require.NoError(t, err)
+	assert.Len(t, values, 2)
+	require.NoError(t, db.BatchDelete([]types.Key{"a", "b"}))
+	require.NoError(t, db.Delete("key"))
+
+	require.Len(t, first.after, 7)
+	ops := make([]string, len(first.after))
+	for i, info := range first.after {
+		ops[i] = info.Op
+		assert.Positive(t, info.Duration)
+	}
+	assert.Equal(t, []string{"Set", "Get", "Get", "BatchSet", "BatchGet", "BatchDelete", "Delete"}, ops)
+	assert.Equal(t, engine.OpInfo{Op: "Set", Key: "key", Keys: 1, ValueSize: 5, Storage: "memory", Duration: first.after[0].Duration}, first.after[0])
+	assert.Equal(t, 5, first.after[1].ValueSize)
+	assert.ErrorIs(t, first.errors[2], types.ErrKeyNotFound)
+	assert.Equal(t, engine.OpInfo{Op: "BatchSet", Keys: 2, ValueSize: 3, Storage: "memory", Duration: first.after[3].Duration}, first.after[3])
+	assert.Equal(t, 3, first.after[4].ValueSize)
+	assert.Equal(t, 2, first.after[5].Keys)
+	assert.Equal(t, second.after, first.after)
+}
+
+func TestHookPanicRecovered(t *testing.T) {
+	logs := &logRecorder{}
+	db, err := engine.OpenInMemory(engine.WithLogger(slog.New(logs)))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var calls []string
+	recording := &recordingHook{name: "recording", calls: &calls}
+	require.NoError(t, db.AddHook(panickingHook{}))
+	require.NoError(t, db.AddHook(recording))
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	assert.Len(t, recording.after, 2)
+
+	panics := logs.find("hook panicked")
+	require.Len(t, panics, 4)
+	assert.Equal(t, slog.LevelError, panics[0].Level)
+	assert.Equal(t, "BeforeOp", attr(panics[0], "method").String())
+	assert.Equal(t, "Set", attr(panics[0], "op").String())
+	assert.Equal(t, "after", attr(panics[1], "panic").Any())
+}
+
+type callerKey struct{}
+
+// callerHook keeps the value under callerKey of the contexts BeforeOp gets
+type callerHook struct {
+	callers []any
+}
+
+func (h *callerHook) BeforeOp(ctx context.Context, info engine.OpInfo) context.Context {
+	h.callers = append(h.callers, ctx.Value(callerKey{}))
+	return ctx
+}
+
+func (h *callerHook) AfterOp(context.Context, engine.OpInfo, error) {}
+
+func TestHooksBackupRestore(t *testing.T) {
+	db, err := engine.Open(t.TempDir(), engine.WithWAL(0), engine.WithBackups())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var calls []string
+	recording := &recordingHook{name: "recording", calls: &calls}
+	caller := &callerHook{}
+	require.NoError(t, db.AddHook(caller))
+	require.NoError(t, db.AddHook(recording))
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	ctx := context.WithValue(context.Background(), callerKey{}, "caller")
+	metadata, err := db.CreateBackupContext(ctx, "hooked", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.RestoreFromBackupContext(ctx, metadata.Name, nil))
+	var stream bytes.Buffer
+	_, err = db.WriteBackup(&stream, "streamed")
+	require.NoError(t, err)
+	_, err = db.RestoreBackup(&stream)
+	require.NoError(t, err)
+
+	require.Len(t, recording.after, 6)
+	ops := make([]string, len(recording.after))
+	for i, info := range recording.after {
+		ops[i] = info.Op
+		assert.Equal(t, "disk", info.Storage)
+	}
+	assert.Equal(t, []string{"Set", "Get", "Backup", "Restore", "Backup", "Restore"}, ops)
+	assert.True(t, recording.after[0].WAL)
+	assert.False(t, recording.after[1].WAL)
+	assert.True(t, recording.after[2].WAL)
+	// Backup and Restore pass the caller's context on
+	assert.Equal(t, []any{nil, nil, "caller", "caller", nil, nil}, caller.callers)
+
+	_, err = db.RestoreBackup(bytes.NewReader([]byte("not a backup")))
+	require.Error(t, err)
+	assert.Equal(t, err, recording.errors[6])
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestAuditHook(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	var log bytes.Buffer
+	audit := engine.NewAuditHook(&log)
+	require.NoError(t, db.AddHook(audit))
+	require.NoError(t, db.Set("user:1", types.Value("alice")))
+	_, err := db.Get("user:2")
+	require.Error(t, err)
+	require.NoError(t, db.BatchDelete([]types.Key{"user:1", "user:2"}))
+	require.NoError(t, audit.Err())
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&log)
+	for scanner.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "Set", lines[0]["op"])
+	assert.Equal(t, "user:1", lines[0]["key"])
+	assert.Equal(t, float64(5), lines[0]["value_size"])
+	assert.Contains(t, lines[0], "time")
+	assert.Contains(t, lines[0], "duration")
+	assert.NotContains(t, lines[0], "error")
+	assert.Equal(t, "Get", lines[1]["op"])
+	assert.Contains(t, lines[1]["error"], "not found")
+	assert.Equal(t, "BatchDelete", lines[2]["op"])
+	assert.NotContains(t, lines[2], "key")
+	assert.Equal(t, float64(2), lines[2]["keys"])
+
+	// Write errors are kept, not returned by the operations
+	failing := engine.NewAuditHook(failingWriter{})
+	require.NoError(t, db.AddHook(failing))
+	require.NoError(t, db.Set("user:1", types.Value("bob")))
+	assert.EqualError(t, failing.Err(), "disk full")
+}
@@ -0,0 +1,517 @@
+// Package httpserver serves a database over HTTP with a small JSON API, for
+// internal tools that would otherwise each write their own handlers.
+//
+// Routes:
+//
+//	GET    /keys/{key}                    the value of key
+//	PUT    /keys/{key}[?ttl=30s]          set key to the request body
+//	DELETE /keys/{key}                    delete key
+//	GET    /keys[?prefix=&cursor=&limit=] list keys in order, a page at a time
+//	POST   /batch                         set, delete and get many keys
+//	GET    /stats                         the database's Stats
+//	POST   /backups                       create a backup
+//	GET    /backups                       list the backups
+//	POST   /compact                       compact the storage
+//
+// Values are given as a JSON string in "value", or in "value_base64" if
+// they aren't UTF-8; PUT takes the raw bytes as its body. Errors are
+// {"error": "..."} with a status matching the cause: 404 for a missing key,
+// 410 for one that expired but hasn't been cleaned up yet, 413 for a value
+// larger than Config.MaxValueSize.
+package httpserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"database_engine/engine"
+	"database_engine/persistence"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Listing limits
+const (
+	DefaultLimit = 100  // Keys listed per page without ?limit
+	MaxLimit     = 1000 // Most keys listed per page
+)
+
+// DefaultMaxRequestBytes is the largest /batch or /backups request body
+// accepted by default
+const DefaultMaxRequestBytes = 32 << 20
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithBearerToken requires every request to carry the header
+// "Authorization: Bearer <token>", failing the others with 401
+func WithBearerToken(token string) Option {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithMaxRequestBytes limits /batch and /backups request bodies to n bytes,
+// failing larger ones with 413. PUT bodies are limited by
+// Config.MaxValueSize instead.
+func WithMaxRequestBytes(n int64) Option {
+	return func(s *Server) {
+		s.maxRequestBytes = n
+	}
+}
+
+// Server is an http.Handler serving a database
+type Server struct {
+	db              *engine.Database
+	token           string
+	maxRequestBytes int64
+	mux             *http.ServeMux
+}
+
+// New returns a server for db. Closing db is left to the caller.
+func New(db *engine.Database, opts ...Option) *Server {
+	s := &Server{db: db, maxRequestBytes: DefaultMaxRequestBytes, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux.HandleFunc("/keys", s.route(map[string]http.HandlerFunc{http.MethodGet: s.listKeys}))
+	s.mux.HandleFunc("/keys/", s.route(map[string]http.HandlerFunc{
+		http.MethodGet:    s.getKey,
+		http.MethodPut:    s.putKey,
+		http.MethodDelete: s.deleteKey,
+	}))
+	s.mux.HandleFunc("/batch", s.route(map[string]http.HandlerFunc{http.MethodPost: s.batch}))
+	s.mux.HandleFunc("/stats", s.route(map[string]http.HandlerFunc{http.MethodGet: s.stats}))
+	s.mux.HandleFunc("/backups", s.route(map[string]http.HandlerFunc{
+		http.MethodGet:  s.listBackups,
+		http.MethodPost: s.createBackup,
+	}))
+	s.mux.HandleFunc("/compact", s.route(map[string]http.HandlerFunc{http.MethodPost: s.compact}))
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+	})
+	return s
+}
+
+// ServeHTTP checks the request's token and serves it
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="database_engine"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// route returns a handler dispatching to the handler for the request's
+// method, failing other methods with 405
+func (s *Server) route(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	allowed := make([]string, 0, len(handlers))
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// keyValue is a key with its value, as the JSON responses give it
+type keyValue struct {
+	Key         types.Key   `json:"key"`
+	Value       *string     `json:"value,omitempty"`
+	ValueBase64 types.Value `json:"value_base64,omitempty"`
+}
+
+// newKeyValue returns key and value, with value as a string if it is UTF-8
+func newKeyValue(key types.Key, value types.Value) keyValue {
+	if !utf8.Valid(value) {
+		return keyValue{Key: key, ValueBase64: value}
+	}
+	s := string(value)
+	return keyValue{Key: key, Value: &s}
+}
+
+// pathKey returns the key of a /keys/{key} request
+func pathKey(r *http.Request) types.Key {
+	return types.Key(strings.TrimPrefix(r.URL.Path, "/keys/"))
+}
+
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request) {
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	key := pathKey(r)
+	value, err := s.db.Get(key)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newKeyValue(key, value))
+}
+
+func (s *Server) putKey(w http.ResponseWriter, r *http.Request) {
+	var ttl time.Duration
+	if param := r.URL.Query().Get("ttl"); param != "" {
+		var err error
+		if ttl, err = time.ParseDuration(param); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q: must be a positive duration", param))
+			return
+		}
+	}
+
+	// A body past MaxValueSize fails the read, without buffering it all
+	limit := int64(s.db.GetConfig().MaxValueSize)
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	key := pathKey(r)
+	if ttl > 0 {
+		err = s.db.SetWithTTL(key, value, ttl)
+	} else {
+		err = s.db.Set(key, value)
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "value_bytes": len(value)})
+}
+
+func (s *Server) deleteKey(w http.ResponseWriter, r *http.Request) {
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	key := pathKey(r)
+	exists, err := s.db.Exists(key)
+	if err == nil && !exists {
+		err = types.NewOpError("Delete", key, types.ErrKeyNotFound)
+	}
+	if err == nil {
+		err = s.db.Delete(key)
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"key": key, "deleted": true})
+}
+
+// keyPage is the response of GET /keys. NextCursor is set when there are
+// more keys, and lists them when passed as ?cursor.
+type keyPage struct {
+	Keys       []types.Key `json:"keys"`
+	NextCursor types.Key   `json:"next_cursor,omitempty"`
+}
+
+// listKeys lists the keys with ?prefix in order, starting after the key
+// ?cursor names, at most ?limit of them
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := DefaultLimit
+	if param := query.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q: must be a positive integer", param))
+			return
+		}
+		limit = min(n, MaxLimit)
+	}
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	keys, err := s.db.KeysWithPrefix(types.Key(query.Get("prefix")))
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if cursor := types.Key(query.Get("cursor")); cursor != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > cursor }):]
+	}
+
+	page := keyPage{Keys: keys}
+	if len(keys) > limit {
+		page.Keys = keys[:limit]
+		page.NextCursor = page.Keys[limit-1]
+	}
+	if page.Keys == nil {
+		page.Keys = []types.Key{}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// batchRequest is the body of POST /batch. The sets are applied first, as
+// one BatchSet, then the deletes, as one BatchDelete, then the gets.
+type batchRequest struct {
+	Set    []batchEntry `json:"set"`
+	Delete []types.Key  `json:"delete"`
+	Get    []types.Key  `json:"get"`
+}
+
+// batchEntry is a key to set in a batch, with its value given in one of
+// Value or ValueBase64 and an optional TTL, like "30s"
+type batchEntry struct {
+	Key         types.Key   `json:"key"`
+	Value       *string     `json:"value"`
+	ValueBase64 types.Value `json:"value_base64"`
+	TTL         string      `json:"ttl"`
+}
+
+// batchResponse is the response of POST /batch
+type batchResponse struct {
+	Set     int         `json:"set"`
+	Deleted int         `json:"deleted"`
+	Values  []keyValue  `json:"values"`  // The keys got that exist, in the order asked for
+	Missing []types.Key `json:"missing"` // The keys got that don't
+}
+
+// entries returns the entries the request sets
+func (req *batchRequest) entries() ([]types.Entry, error) {
+	entries := make([]types.Entry, len(req.Set))
+	for i, set := range req.Set {
+		entry := types.Entry{Key: set.Key}
+		switch {
+		case set.Value != nil && set.ValueBase64 != nil:
+			return nil, fmt.Errorf("set %q: give value or value_base64, not both", set.Key)
+		case set.Value != nil:
+			entry.Value = types.Value(*set.Value)
+		case set.ValueBase64 != nil:
+			entry.Value = set.ValueBase64
+		default:
+			return nil, fmt.Errorf("set %q: missing value", set.Key)
+		}
+		if set.TTL != "" {
+			ttl, err := time.ParseDuration(set.TTL)
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("set %q: invalid ttl %q: must be a positive duration", set.Key, set.TTL)
+			}
+			entry.TTL = &ttl
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+func (s *Server) batch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if !s.decodeBody(w, r, &req, false) {
+		return
+	}
+	entries, err := req.entries()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := r.Context()
+	resp := batchResponse{Values: []keyValue{}, Missing: []types.Key{}}
+	if len(entries) > 0 {
+		if err := ctx.Err(); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if err := s.db.BatchSet(entries); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		resp.Set = len(entries)
+	}
+	if len(req.Delete) > 0 {
+		if err := ctx.Err(); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if err := s.db.BatchDelete(req.Delete); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		resp.Deleted = len(req.Delete)
+	}
+	if len(req.Get) > 0 {
+		if err := ctx.Err(); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		values, err := s.db.BatchGet(req.Get)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		for _, key := range req.Get {
+			if value, ok := values[key]; ok {
+				resp.Values = append(resp.Values, newKeyValue(key, value))
+			} else {
+				resp.Missing = append(resp.Missing, key)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) stats(w http.ResponseWriter, r *http.Request) {
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	stats, err := s.db.GetStats()
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// backupRequest is the optional body of POST /backups
+type backupRequest struct {
+	Description string            `json:"description"`
+	Reason      string            `json:"reason"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// createBackup makes a backup, giving up if the request is canceled first
+func (s *Server) createBackup(w http.ResponseWriter, r *http.Request) {
+	var req backupRequest
+	if !s.decodeBody(w, r, &req, true) {
+		return
+	}
+	if !s.db.IsBackupSupported() {
+		writeError(w, http.StatusNotImplemented, errors.New("backups are not enabled for this database"))
+		return
+	}
+
+	options := persistence.BackupOptions{Description: req.Description, Reason: req.Reason, Tags: req.Tags}
+	metadata, err := s.db.CreateBackupWithOptions(r.Context(), options, nil)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, metadata)
+}
+
+func (s *Server) listBackups(w http.ResponseWriter, r *http.Request) {
+	if !s.db.IsBackupSupported() {
+		writeError(w, http.StatusNotImplemented, errors.New("backups are not enabled for this database"))
+		return
+	}
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	backups, err := s.db.ListBackups()
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if backups == nil {
+		backups = []persistence.BackupMetadata{}
+	}
+	writeJSON(w, http.StatusOK, backups)
+}
+
+func (s *Server) compact(w http.ResponseWriter, r *http.Request) {
+	if !s.db.IsCompactionSupported() {
+		writeError(w, http.StatusNotImplemented, errors.New("compaction not supported for this storage type"))
+		return
+	}
+	if err := r.Context().Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := s.db.Compact(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"compacted": true})
+}
+
+// decodeBody decodes the JSON body of r into v, up to maxRequestBytes of
+// it, writing the error and returning false if it can't. An empty body
+// leaves v as it is if optional is set.
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, v any, optional bool) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxRequestBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == io.EOF && optional {
+		return true
+	}
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		writeDBError(w, err)
+		return false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+// status returns the HTTP status of a failed database operation
+func status(err error) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.Is(err, types.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, types.ErrKeyExpired):
+		return http.StatusGone
+	case errors.Is(err, types.ErrInvalidValue), errors.As(err, &maxBytes):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, types.ErrInvalidKey), errors.Is(err, types.ErrTTLDisabled):
+		return http.StatusBadRequest
+	case errors.Is(err, types.ErrMemoryLimitExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, types.ErrReadOnly), errors.Is(err, types.ErrDatabaseClosed), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeDBError writes err with the status matching it
+func writeDBError(w http.ResponseWriter, err error) {
+	writeError(w, status(err), err)
+}
+
+// writeError writes err as the JSON body of a response with status
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeJSON writes v as the JSON body of a response with status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,376 @@
+package httpserver_test
+
+import (
+	"context"
+	"database_engine/engine"
+	"database_engine/engine/httpserver"
+	"database_engine/types"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// do serves a request for method and target with body through handler and
+// returns the response
+func do(t *testing.T, handler http.Handler, method, target, body string) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, reader))
+	return recorder.Result()
+}
+
+// decode checks resp has status and decodes its JSON body into v
+func decode(t *testing.T, resp *http.Response, status int, v any) {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, status, resp.StatusCode, string(body))
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(body, v), string(body))
+}
+
+// errorOf checks resp has status and returns its error message
+func errorOf(t *testing.T, resp *http.Response, status int) string {
+	t.Helper()
+	var body struct{ Error string }
+	decode(t, resp, status, &body)
+	return body.Error
+}
+
+// newMemoryServer returns a server for an in-memory database with config
+func newMemoryServer(t *testing.T, config types.Config, opts ...httpserver.Option) (*engine.Database, http.Handler) {
+	db, err := engine.OpenInMemory(engine.WithConfig(config))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db, httpserver.New(db, opts...)
+}
+
+// keyValue is a key with its value as responses give it
+type keyValue struct {
+	Key         string `json:"key"`
+	Value       *string
+	ValueBase64 []byte `json:"value_base64"`
+}
+
+func TestKeyRoutes(t *testing.T) {
+	config := types.DefaultConfig()
+	config.MaxKeySize, config.MaxValueSize = 16, 16
+	db, server := newMemoryServer(t, config)
+
+	var put struct {
+		Key        string
+		ValueBytes int `json:"value_bytes"`
+	}
+	decode(t, do(t, server, http.MethodPut, "/keys/user:1", "alice"), http.StatusOK, &put)
+	assert.Equal(t, "user:1", put.Key)
+	assert.Equal(t, 5, put.ValueBytes)
+
+	var got keyValue
+	decode(t, do(t, server, http.MethodGet, "/keys/user:1", ""), http.StatusOK, &got)
+	assert.Equal(t, "user:1", got.Key)
+	require.NotNil(t, got.Value)
+	assert.Equal(t, "alice", *got.Value)
+
+	// Keys may hold slashes and escapes, and values needn't be UTF-8
+	decode(t, do(t, server, http.MethodPut, "/keys/dir/a%20b", "\xff\x00"), http.StatusOK, &put)
+	got = keyValue{}
+	decode(t, do(t, server, http.MethodGet, "/keys/dir/a%20b", ""), http.StatusOK, &got)
+	assert.Equal(t, "dir/a b", got.Key)
+	assert.Nil(t, got.Value)
+	assert.Equal(t, []byte("\xff\x00"), got.ValueBase64)
+
+	var deleted struct {
+		Key     string
+		Deleted bool
+	}
+	decode(t, do(t, server, http.MethodDelete, "/keys/user:1", ""), http.StatusOK, &deleted)
+	assert.True(t, deleted.Deleted)
+	exists, err := db.Exists("user:1")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Contains(t, errorOf(t, do(t, server, http.MethodGet, "/keys/user:1", ""), http.StatusNotFound), "key not found")
+	errorOf(t, do(t, server, http.MethodDelete, "/keys/user:1", ""), http.StatusNotFound)
+	errorOf(t, do(t, server, http.MethodGet, "/keys/", ""), http.StatusBadRequest)
+	assert.Contains(t, errorOf(t, do(t, server, http.MethodPut, "/keys/big", strings.Repeat("x", 17)), http.StatusRequestEntityTooLarge), "too large")
+	errorOf(t, do(t, server, http.MethodPut, "/keys/", "value"), http.StatusBadRequest)
+}
+
+func TestKeyTTL(t *testing.T) {
+	// Without background cleanup the expired key is still there to be read
+	config := types.DefaultConfig()
+	config.CleanupInterval = 0
+	_, server := newMemoryServer(t, config)
+
+	decode(t, do(t, server, http.MethodPut, "/keys/session?ttl=30ms", "token"), http.StatusOK, &struct{}{})
+	decode(t, do(t, server, http.MethodGet, "/keys/session", ""), http.StatusOK, &struct{}{})
+	time.Sleep(50 * time.Millisecond)
+	assert.Contains(t, errorOf(t, do(t, server, http.MethodGet, "/keys/session", ""), http.StatusGone), "expired")
+
+	for _, ttl := range []string{"soon", "-1s", "0s"} {
+		assert.Contains(t, errorOf(t, do(t, server, http.MethodPut, "/keys/session?ttl="+ttl, "token"), http.StatusBadRequest), "invalid ttl")
+	}
+
+	config = types.DefaultConfig()
+	config.EnableTTL = false
+	_, noTTL := newMemoryServer(t, config)
+	errorOf(t, do(t, noTTL, http.MethodPut, "/keys/session?ttl=1m", "token"), http.StatusBadRequest)
+}
+
+func TestListKeys(t *testing.T) {
+	db, server := newMemoryServer(t, types.DefaultConfig())
+	for _, key := range []types.Key{"user:3", "user:1", "user:2", "order:1", "user:4"} {
+		require.NoError(t, db.Set(key, types.Value("v")))
+	}
+
+	type page struct {
+		Keys       []string
+		NextCursor string `json:"next_cursor"`
+	}
+	var all page
+	decode(t, do(t, server, http.MethodGet, "/keys", ""), http.StatusOK, &all)
+	assert.Equal(t, []string{"order:1", "user:1", "user:2", "user:3", "user:4"}, all.Keys)
+	assert.Empty(t, all.NextCursor)
+
+	// Page through the users two at a time
+	var keys []string
+	target := "/keys?prefix=user:&limit=2"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		var p page
+		decode(t, do(t, server, http.MethodGet, target, ""), http.StatusOK, &p)
+		keys = append(keys, p.Keys...)
+		if p.NextCursor == "" {
+			break
+		}
+		target = "/keys?prefix=user:&limit=2&cursor=" + p.NextCursor
+	}
+	assert.Equal(t, []string{"user:1", "user:2", "user:3", "user:4"}, keys)
+
+	var none page
+	decode(t, do(t, server, http.MethodGet, "/keys?prefix=missing:", ""), http.StatusOK, &none)
+	assert.Equal(t, []string{}, none.Keys)
+
+	for _, limit := range []string{"0", "-1", "many"} {
+		assert.Contains(t, errorOf(t, do(t, server, http.MethodGet, "/keys?limit="+limit, ""), http.StatusBadRequest), "invalid limit")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	config := types.DefaultConfig()
+	config.MaxKeySize, config.MaxValueSize = 16, 16
+	db, server := newMemoryServer(t, config, httpserver.WithMaxRequestBytes(512))
+	require.NoError(t, db.Set("old", types.Value("gone soon")))
+
+	var resp struct {
+		Set     int
+		Deleted int
+		Values  []keyValue
+		Missing []string
+	}
+	decode(t, do(t, server, http.MethodPost, "/batch", `{
+		"set": [
+			{"key": "a", "value": "1"},
+			{"key": "b", "value_base64": "/wA="},
+			{"key": "c", "value": "3", "ttl": "30ms"}
+		],
+		"delete": ["old"],
+		"get": ["a", "b", "old", "c"]
+	}`), http.StatusOK, &resp)
+	assert.Equal(t, 3, resp.Set)
+	assert.Equal(t, 1, resp.Deleted)
+	assert.Equal(t, []string{"old"}, resp.Missing)
+	require.Len(t, resp.Values, 3)
+	assert.Equal(t, "1", *resp.Values[0].Value)
+	assert.Equal(t, []byte("\xff\x00"), resp.Values[1].ValueBase64)
+	assert.Equal(t, "c", resp.Values[2].Key)
+
+	// The TTL applies
+	time.Sleep(50 * time.Millisecond)
+	_, err := db.Get("c")
+	assert.Error(t, err)
+
+	for _, tt := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"not json", `{`, http.StatusBadRequest},
+		{"unknown field", `{"put": []}`, http.StatusBadRequest},
+		{"no value", `{"set": [{"key": "a"}]}`, http.StatusBadRequest},
+		{"both values", `{"set": [{"key": "a", "value": "1", "value_base64": "MQ=="}]}`, http.StatusBadRequest},
+		{"bad ttl", `{"set": [{"key": "a", "value": "1", "ttl": "soon"}]}`, http.StatusBadRequest},
+		{"empty key", `{"delete": [""]}`, http.StatusBadRequest},
+		{"oversized value", `{"set": [{"key": "a", "value": "` + strings.Repeat("x", 17) + `"}]}`, http.StatusRequestEntityTooLarge},
+		{"oversized body", `{"get": ["` + strings.Repeat("x", 512) + `"]}`, http.StatusRequestEntityTooLarge},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			errorOf(t, do(t, server, http.MethodPost, "/batch", tt.body), tt.status)
+		})
+	}
+	value, err := db.Get("a")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("1"), value)
+}
+
+func TestStats(t *testing.T) {
+	db, server := newMemoryServer(t, types.DefaultConfig())
+	require.NoError(t, db.Set("key", types.Value("value")))
+
+	var stats engine.Stats
+	decode(t, do(t, server, http.MethodGet, "/stats", ""), http.StatusOK, &stats)
+	assert.Equal(t, "memory", stats.StorageType)
+	assert.Equal(t, int64(1), stats.Keys)
+}
+
+func TestBackupsAndCompact(t *testing.T) {
+	db, err := engine.Open(t.TempDir(), engine.WithBackups())
+	require.NoError(t, err)
+	defer db.Close()
+	server := httpserver.New(db)
+	require.NoError(t, db.Set("key", types.Value("value")))
+
+	var backups []struct{ Name, Description string }
+	decode(t, do(t, server, http.MethodGet, "/backups", ""), http.StatusOK, &backups)
+	assert.Empty(t, backups)
+
+	var metadata struct {
+		Name        string
+		Description string
+		Tags        map[string]string
+	}
+	decode(t, do(t, server, http.MethodPost, "/backups", `{"description": "nightly", "tags": {"env": "test"}}`), http.StatusCreated, &metadata)
+	assert.NotEmpty(t, metadata.Name)
+	assert.Equal(t, "nightly", metadata.Description)
+	assert.Equal(t, "test", metadata.Tags["env"])
+	// The body is optional
+	decode(t, do(t, server, http.MethodPost, "/backups", ""), http.StatusCreated, &metadata)
+
+	decode(t, do(t, server, http.MethodGet, "/backups", ""), http.StatusOK, &backups)
+	assert.Len(t, backups, 2)
+	errorOf(t, do(t, server, http.MethodPost, "/backups", `{"name": "x"}`), http.StatusBadRequest)
+
+	var compacted struct{ Compacted bool }
+	decode(t, do(t, server, http.MethodPost, "/compact", ""), http.StatusOK, &compacted)
+	assert.True(t, compacted.Compacted)
+
+	// In-memory databases have neither
+	_, memory := newMemoryServer(t, types.DefaultConfig())
+	errorOf(t, do(t, memory, http.MethodGet, "/backups", ""), http.StatusNotImplemented)
+	errorOf(t, do(t, memory, http.MethodPost, "/backups", ""), http.StatusNotImplemented)
+	errorOf(t, do(t, memory, http.MethodPost, "/compact", ""), http.StatusNotImplemented)
+}
+
+func TestBearerToken(t *testing.T) {
+	_, server := newMemoryServer(t, types.DefaultConfig(), httpserver.WithBearerToken("secret"))
+
+	for _, header := range []string{"", "Bearer wrong", "Basic secret", "secret"} {
+		request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		resp := recorder.Result()
+		assert.Equal(t, `Bearer realm="database_engine"`, resp.Header.Get("WWW-Authenticate"))
+		errorOf(t, resp, http.StatusUnauthorized)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	decode(t, recorder.Result(), http.StatusOK, &engine.Stats{})
+}
+
+func TestRoutingErrors(t *testing.T) {
+	_, server := newMemoryServer(t, types.DefaultConfig())
+
+	resp := do(t, server, http.MethodPost, "/keys/a", "value")
+	assert.Equal(t, "DELETE, GET, PUT", resp.Header.Get("Allow"))
+	errorOf(t, resp, http.StatusMethodNotAllowed)
+	for _, route := range []struct{ method, path string }{
+		{http.MethodPost, "/keys"},
+		{http.MethodGet, "/batch"},
+		{http.MethodPost, "/stats"},
+		{http.MethodDelete, "/backups"},
+		{http.MethodGet, "/compact"},
+	} {
+		errorOf(t, do(t, server, route.method, route.path, ""), http.StatusMethodNotAllowed)
+	}
+	errorOf(t, do(t, server, http.MethodGet, "/nowhere", ""), http.StatusNotFound)
+}
+
+func TestCanceledRequests(t *testing.T) {
+	db, server := newMemoryServer(t, types.DefaultConfig())
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	for _, route := range []struct{ method, path, body string }{
+		{http.MethodGet, "/keys/a", ""},
+		{http.MethodPut, "/keys/a", "value"},
+		{http.MethodDelete, "/keys/a", ""},
+		{http.MethodGet, "/keys", ""},
+		{http.MethodPost, "/batch", `{"set": [{"key": "a", "value": "1"}]}`},
+		{http.MethodGet, "/stats", ""},
+	} {
+		for _, ctx := range []struct {
+			ctx    context.Context
+			status int
+		}{
+			{canceled, http.StatusServiceUnavailable},
+			{expired, http.StatusGatewayTimeout},
+		} {
+			request := httptest.NewRequest(route.method, route.path, strings.NewReader(route.body)).WithContext(ctx.ctx)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			errorOf(t, recorder.Result(), ctx.status)
+		}
+	}
+
+	// Nothing was written
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Zero(t, size)
+}
+
+func TestBackupCanceled(t *testing.T) {
+	db, err := engine.Open(t.TempDir(), engine.WithBackups())
+	require.NoError(t, err)
+	defer db.Close()
+	server := httpserver.New(db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/backups", nil).WithContext(ctx))
+	errorOf(t, recorder.Result(), http.StatusServiceUnavailable)
+
+	backups, err := db.ListBackups()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+}
+
+func TestClosedDatabase(t *testing.T) {
+	db, server := newMemoryServer(t, types.DefaultConfig())
+	require.NoError(t, db.Close())
+
+	errorOf(t, do(t, server, http.MethodGet, "/keys/a", ""), http.StatusServiceUnavailable)
+	errorOf(t, do(t, server, http.MethodPut, "/keys/a", "value"), http.StatusServiceUnavailable)
+}
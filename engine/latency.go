@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"database_engine/types"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// latencyOp is an operation whose latency is tracked
+type latencyOp int
+
+const (
+	latencyGet latencyOp = iota
+	latencySet
+	latencyDelete
+	latencyBatchGet
+	latencyBatchSet
+	latencyBatchDelete
+	latencyCompact
+	latencyOps // Number of tracked operations
+)
+
+// latencyOpNames are the names latency statistics are reported under
+var latencyOpNames = [latencyOps]string{"Get", "Set", "Delete", "BatchGet", "BatchSet", "BatchDelete", "Compact"}
+
+// Latencies are bucketed log-linearly: each power of two of nanoseconds is
+// split into latencySubBuckets buckets, so a percentile is off by at most a
+// quarter of its value. Latencies of 2^latencyMaxExp nanoseconds (about 18
+// minutes) or more all land in the last bucket.
+const (
+	latencySubBuckets = 4
+	latencyMaxExp     = 40
+	latencyBuckets    = (latencyMaxExp - 1) * latencySubBuckets
+)
+
+// LatencyStats summarizes the latencies recorded for an operation. The
+// percentiles are upper bounds of the histogram buckets they fall in.
+type LatencyStats struct {
+	Count int64         `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// latencyHistogram counts the latencies of one operation. Every field is
+// updated with atomics, so concurrent operations record without a lock.
+type latencyHistogram struct {
+	buckets [latencyBuckets]atomic.Int64
+	sum     atomic.Int64 // Nanoseconds
+	max     atomic.Int64 // Nanoseconds
+}
+
+// latencyTracker keeps a histogram per tracked operation. A nil tracker
+// records nothing.
+type latencyTracker struct {
+	ops [latencyOps]latencyHistogram
+}
+
+// newLatencyTracker returns a tracker if config enables latency tracking,
+// and nil otherwise
+func newLatencyTracker(config types.Config) *latencyTracker {
+	if !config.EnableLatencyTracking {
+		return nil
+	}
+	return &latencyTracker{}
+}
+
+// record adds a latency of op
+func (t *latencyTracker) record(op latencyOp, latency time.Duration) {
+	if t == nil {
+		return
+	}
+	t.ops[op].add(latency)
+}
+
+// reset drops every recorded latency. Operations finishing during a reset
+// may be partly kept.
+func (t *latencyTracker) reset() {
+	for op := range t.ops {
+		h := &t.ops[op]
+		for i := range h.buckets {
+			h.buckets[i].Store(0)
+		}
+		h.sum.Store(0)
+		h.max.Store(0)
+	}
+}
+
+// stats summarizes the operations that have recorded latencies, keyed by
+// operation name
+func (t *latencyTracker) stats() map[string]LatencyStats {
+	stats := make(map[string]LatencyStats)
+	for op := range t.ops {
+		if summary := t.ops[op].summarize(); summary.Count > 0 {
+			stats[latencyOpNames[op]] = summary
+		}
+	}
+	return stats
+}
+
+// add records one latency
+func (h *latencyHistogram) add(latency time.Duration) {
+	ns := int64(latency)
+	if ns < 0 {
+		ns = 0
+	}
+	h.buckets[latencyBucket(ns)].Add(1)
+	h.sum.Add(ns)
+	for {
+		current := h.max.Load()
+		if ns <= current || h.max.CompareAndSwap(current, ns) {
+			break
+		}
+	}
+}
+
+// summarize returns the count, mean, percentiles and maximum of the
+// recorded latencies
+func (h *latencyHistogram) summarize() LatencyStats {
+	var counts [latencyBuckets]int64
+	var total int64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return LatencyStats{}
+	}
+
+	longest := time.Duration(h.max.Load())
+	percentile := func(q float64) time.Duration {
+		rank := int64(q*float64(total) + 0.5)
+		if rank < 1 {
+			rank = 1
+		}
+		var seen int64
+		for i, count := range counts {
+			if seen += count; seen >= rank {
+				return min(time.Duration(latencyBucketBound(i)), longest)
+			}
+		}
+		return longest
+	}
+
+	return LatencyStats{
+		Count: total,
+		Mean:  time.Duration(h.sum.Load() / total),
+		P50:   percentile(0.50),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+		Max:   longest,
+	}
+}
+
+// latencyBucket returns the bucket of a latency of ns nanoseconds. Below
+// latencySubBuckets nanoseconds each has a bucket of its own; above, the
+// bucket is picked by the latency's highest bits.
+func latencyBucket(ns int64) int {
+	if ns < latencySubBuckets {
+		return int(ns)
+	}
+	exp := bits.Len64(uint64(ns)) // ns is in [2^(exp-1), 2^exp)
+	if exp > latencyMaxExp {
+		return latencyBuckets - 1
+	}
+	sub := int(ns>>(exp-3)) & (latencySubBuckets - 1)
+	return (exp-2)*latencySubBuckets + sub
+}
+
+// latencyBucketBound returns the smallest latency, in nanoseconds, above
+// those in bucket
+func latencyBucketBound(bucket int) int64 {
+	next := bucket + 1
+	if next < latencySubBuckets {
+		return int64(next)
+	}
+	exp := next/latencySubBuckets + 2
+	sub := int64(next % latencySubBuckets)
+	return (latencySubBuckets + sub) << (exp - 3)
+}
+
+// setLatencyTracking starts or stops recording latencies to match config,
+// keeping the histograms while tracking stays on. The caller must hold
+// db.mu or own db exclusively.
+func (db *Database) setLatencyTracking(config types.Config) {
+	if config.EnableLatencyTracking != (db.latency != nil) {
+		db.latency = newLatencyTracker(config)
+	}
+}
+
+// ResetLatencyStats drops the latencies recorded so far, so GetStats
+// reports only those of later operations
+func (db *Database) ResetLatencyStats() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	if db.latency == nil {
+		return fmt.Errorf("latency tracking is not enabled")
+	}
+
+	db.latency.reset()
+	return nil
+}
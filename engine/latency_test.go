@@ -0,0 +1,100 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyStats(t *testing.T) {
+	config := types.DefaultConfig()
+	config.DataDirectory = t.TempDir()
+	config.EnablePersistence = true
+	config.EnableLatencyTracking = true
+	db, err := engine.NewDiskDBWithConfig(config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Set(types.Key(fmt.Sprintf("key%d", i)), types.Value("value")))
+	}
+	for i := 0; i < 20; i++ {
+		_, err := db.Get(types.Key(fmt.Sprintf("key%d", i%10)))
+		require.NoError(t, err)
+	}
+	// Failed operations take time too and are counted
+	_, err = db.Get("missing")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Delete(types.Key(fmt.Sprintf("key%d", i))))
+	}
+	require.NoError(t, db.BatchSet([]types.Entry{{Key: "a", Value: types.Value("1")}, {Key: "b", Value: types.Value("2")}}))
+	_, err = db.BatchGet([]types.Key{"a", "b"})
+	require.NoError(t, err)
+	require.NoError(t, db.Compact())
+
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	counts := make(map[string]int64)
+	for op, latency := range stats.Latency {
+		counts[op] = latency.Count
+		assert.LessOrEqual(t, latency.P50, latency.P95, op)
+		assert.LessOrEqual(t, latency.P95, latency.P99, op)
+		assert.LessOrEqual(t, latency.P99, latency.Max, op)
+		assert.LessOrEqual(t, latency.Mean, latency.Max, op)
+		assert.Positive(t, latency.Max, op)
+	}
+	assert.Equal(t, map[string]int64{
+		"Get":      21,
+		"Set":      10,
+		"Delete":   3,
+		"BatchGet": 1,
+		"BatchSet": 1,
+		"Compact":  1,
+	}, counts)
+
+	// Resetting drops what was recorded so far
+	require.NoError(t, db.ResetLatencyStats())
+	stats, err = db.GetStats()
+	require.NoError(t, err)
+	assert.Empty(t, stats.Latency)
+	_, err = db.Get("a")
+	require.NoError(t, err)
+	stats, err = db.GetStats()
+	require.NoError(t, err)
+	require.Len(t, stats.Latency, 1)
+	assert.Equal(t, int64(1), stats.Latency["Get"].Count)
+}
+
+func TestLatencyStatsDisabled(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Nil(t, stats.Latency)
+	assert.Error(t, db.ResetLatencyStats())
+
+	// SetConfig turns tracking on and off
+	config := db.GetConfig()
+	config.EnableLatencyTracking = true
+	require.NoError(t, db.SetConfig(config))
+	_, err = db.Get("key")
+	require.NoError(t, err)
+	stats, err = db.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Latency["Get"].Count)
+
+	config.EnableLatencyTracking = false
+	require.NoError(t, db.SetConfig(config))
+	_, err = db.Get("key")
+	require.NoError(t, err)
+	stats, err = db.GetStats()
+	require.NoError(t, err)
+	assert.Nil(t, stats.Latency)
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"database_engine/types"
+	"log/slog"
+	"sync/atomic"
+)
+
+// logOutput is where a database and its storage log: records at or above
+// Config.LogLevel go to the handler of Config.Logger, and are dropped
+// without a Logger. SetConfig changes both while the storage keeps the
+// logger it was opened with.
+type logOutput struct {
+	level   slog.LevelVar
+	handler atomic.Pointer[slog.Handler] // nil drops every record
+}
+
+// newLogOutput returns the output config selects
+func newLogOutput(config types.Config) *logOutput {
+	output := &logOutput{}
+	output.set(config)
+	return output
+}
+
+// set switches the output to the level and logger of config
+func (o *logOutput) set(config types.Config) {
+	o.level.Set(types.SlogLevel(config.LogLevel))
+	if config.Logger == nil {
+		o.handler.Store(nil)
+		return
+	}
+	handler := config.Logger.Handler()
+	o.handler.Store(&handler)
+}
+
+// logger returns a logger writing to o
+func (o *logOutput) logger() *slog.Logger {
+	return slog.New(&logHandler{output: o})
+}
+
+// configure returns config with its Logger replaced by one writing to o,
+// for the storage and managers opened with it
+func (o *logOutput) configure(config types.Config) types.Config {
+	config.Logger = o.logger()
+	return config
+}
+
+// logHandler is the slog.Handler of a logOutput's loggers. Handlers derived
+// with WithAttrs and WithGroup replay them on whichever handler the output
+// has when a record is handled.
+type logHandler struct {
+	output *logOutput
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level < h.output.level.Level() {
+		return false
+	}
+	handler := h.output.handler.Load()
+	return handler != nil && (*handler).Enabled(ctx, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, record slog.Record) error {
+	current := h.output.handler.Load()
+	if current == nil {
+		return nil
+	}
+	handler := *current
+	for _, derive := range h.derive {
+		handler = derive(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+// with returns a handler applying derive after h's own
+func (h *logHandler) with(derive func(slog.Handler) slog.Handler) *logHandler {
+	return &logHandler{output: h.output, derive: append(h.derive[:len(h.derive):len(h.derive)], derive)}
+}
+
+// trace logs an operation on key at debug level, with its error if it
+// failed. It is a no-op unless debug logging is on.
+func (db *Database) trace(op string, key types.Key, err error) {
+	if !db.log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if err != nil {
+		db.log.Debug("operation failed", "op", op, "key", key, "error", err)
+		return
+	}
+	db.log.Debug("operation", "op", op, "key", key)
+}
+
+// traceBatch logs a batch operation on n keys like trace
+func (db *Database) traceBatch(op string, n int, err error) {
+	if !db.log.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if err != nil {
+		db.log.Debug("operation failed", "op", op, "keys", n, "error", err)
+		return
+	}
+	db.log.Debug("operation", "op", op, "keys", n)
+}
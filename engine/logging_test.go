@@ -0,0 +1,144 @@
+package engine_test
+
+import (
+	"context"
+	"database_engine/engine"
+	"database_engine/types"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logRecorder is a slog.Handler keeping the records it handles
+type logRecorder struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (r *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+
+func (r *logRecorder) Handle(_ context.Context, record slog.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record.Clone())
+	return nil
+}
+
+func (r *logRecorder) WithAttrs([]slog.Attr) slog.Handler { return r }
+func (r *logRecorder) WithGroup(string) slog.Handler      { return r }
+
+// find returns the records logged with message
+func (r *logRecorder) find(message string) []slog.Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []slog.Record
+	for _, record := range r.records {
+		if record.Message == message {
+			found = append(found, record)
+		}
+	}
+	return found
+}
+
+// attr returns the value of the attribute key of record
+func attr(record slog.Record, key string) slog.Value {
+	var value slog.Value
+	record.Attrs(func(a slog.Attr) bool {
+		if a.Key == key {
+			value = a.Value
+			return false
+		}
+		return true
+	})
+	return value
+}
+
+func TestLogging(t *testing.T) {
+	dir := t.TempDir()
+	logs := &logRecorder{}
+	db, err := engine.Open(dir, engine.WithWAL(0), engine.WithBackups(), engine.WithLogger(slog.New(logs)))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Operations are only traced at debug level
+	require.NoError(t, db.Set("key", types.Value("value")))
+	assert.Empty(t, logs.find("operation"))
+
+	config := db.GetConfig()
+	config.LogLevel = types.LogLevelDebug
+	require.NoError(t, db.SetConfig(config))
+	require.NoError(t, db.Set("key", types.Value("value")))
+	_, err = db.Get("missing")
+	require.Error(t, err)
+	traces := logs.find("operation")
+	require.Len(t, traces, 1)
+	assert.Equal(t, slog.LevelDebug, traces[0].Level)
+	assert.Equal(t, "Set", attr(traces[0], "op").String())
+	assert.Equal(t, "key", attr(traces[0], "key").String())
+	failed := logs.find("operation failed")
+	require.Len(t, failed, 1)
+	assert.Equal(t, "Get", attr(failed[0], "op").String())
+
+	// Backup and compaction lifecycle events are logged at info level
+	backup, err := db.CreateBackup("logged")
+	require.NoError(t, err)
+	created := logs.find("created backup")
+	require.Len(t, created, 1)
+	assert.Equal(t, slog.LevelInfo, created[0].Level)
+	assert.Equal(t, backup.Name, attr(created[0], "backup").String())
+	require.NoError(t, db.Compact())
+	require.Len(t, logs.find("compacted data file"), 1)
+	require.NoError(t, db.Checkpoint())
+	assert.NotEmpty(t, logs.find("rotated WAL"))
+
+	// A backup that can't be read is skipped with an error, not silently
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "backups", "backup_broken"), 0755))
+	backups, err := db.ListBackups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+	skipped := logs.find("skipping backup with unreadable metadata")
+	require.Len(t, skipped, 1)
+	assert.Equal(t, slog.LevelError, skipped[0].Level)
+
+	// Raising the level drops info records
+	config.LogLevel = types.LogLevelError
+	require.NoError(t, db.SetConfig(config))
+	_, err = db.CreateBackup("unlogged")
+	require.NoError(t, err)
+	assert.Len(t, logs.find("created backup"), 1)
+
+	// So does removing the logger
+	config.LogLevel = types.LogLevelDebug
+	config.Logger = nil
+	require.NoError(t, db.SetConfig(config))
+	require.NoError(t, db.Set("key", types.Value("value")))
+	assert.Len(t, logs.find("operation"), 1)
+}
+
+func TestLoggingRecoveredCorruption(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Close())
+	// Without the hint file the damaged index.db is the only index left
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.db"), []byte("not an index"), 0644))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "index.hint")))
+
+	logs := &logRecorder{}
+	db, err = engine.Open(dir, engine.WithLogger(slog.New(logs)))
+	require.NoError(t, err)
+	defer db.Close()
+
+	rebuilt := logs.find("rebuilding corrupt index from the data file")
+	require.Len(t, rebuilt, 1)
+	assert.Equal(t, slog.LevelWarn, rebuilt[0].Level)
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+}
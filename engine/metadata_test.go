@@ -0,0 +1,49 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntryMetadataSurvivesBackup(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", types.Value("first")))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, db.Set("key", types.Value("second")))
+	before, err := db.GetEntry("key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), before.Revision)
+	metadata, err := db.CreateBackup("metadata")
+	require.NoError(t, err)
+
+	require.NoError(t, db.Delete("key"))
+	require.NoError(t, db.RestoreFromBackup(metadata.Name))
+	restored, err := db.GetEntry("key")
+	require.NoError(t, err)
+	assert.True(t, before.CreatedAt.Equal(restored.CreatedAt))
+	assert.True(t, before.UpdatedAt.Equal(restored.UpdatedAt))
+	assert.Equal(t, before.Revision, restored.Revision)
+
+	// Range comes with the metadata too, even without ordered storage
+	entries, err := db.Range("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, before.Revision, entries[0].Revision)
+	assert.True(t, before.CreatedAt.Equal(entries[0].CreatedAt))
+
+	// Writing back an entry that was read gives it the next revision
+	// rather than the one it was read with
+	require.NoError(t, db.BatchSet([]types.Entry{*restored}))
+	rewritten, err := db.GetEntry("key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), rewritten.Revision)
+	assert.True(t, before.CreatedAt.Equal(rewritten.CreatedAt))
+}
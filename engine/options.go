@@ -0,0 +1,226 @@
+package engine
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Option configures a database opened by Open or OpenInMemory. Options
+// adjust a types.Config, so everything they set can also be set through
+// WithConfig.
+type Option func(o *options) error
+
+// options collects what the options passed to Open or OpenInMemory set
+type options struct {
+	config    types.Config
+	configSet bool     // WithConfig replaced the default config
+	applied   int      // Options applied so far
+	ordered   bool     // WithOrdered
+	backups   bool     // WithBackups
+	diskOnly  []string // Options given that only apply to Open
+}
+
+// applyOptions applies opts to config and returns the result, with the
+// errors of every option that rejected its input
+func applyOptions(config types.Config, opts []Option) (*options, []error) {
+	o := &options{config: config}
+	var errs []error
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			errs = append(errs, err)
+		}
+		o.applied++
+	}
+	return o, errs
+}
+
+// WithConfig starts from config instead of the default config. It replaces
+// the whole config, so it must come before any other option.
+func WithConfig(config types.Config) Option {
+	return func(o *options) error {
+		if o.applied > 0 {
+			return fmt.Errorf("WithConfig must come first, or it undoes the options before it")
+		}
+		o.config = config
+		o.configSet = true
+		return nil
+	}
+}
+
+// WithWAL logs every write to a write-ahead log rotated at maxSize bytes (0
+// selects the default size). Writes to the data file are then buffered,
+// since the WAL keeps them durable.
+func WithWAL(maxSize int64) Option {
+	return func(o *options) error {
+		if maxSize < 0 {
+			return fmt.Errorf("WithWAL: max size can't be negative, got %d", maxSize)
+		}
+		o.config.WALEnabled = true
+		o.config.MaxWALSize = maxSize
+		o.diskOnly = append(o.diskOnly, "WithWAL")
+		return nil
+	}
+}
+
+// WithBackups sets up backups and recovery: Open checks the data and
+// recovers it from the WAL or the latest backup if needed, and the backup
+// and restore methods become available
+func WithBackups() Option {
+	return func(o *options) error {
+		o.backups = true
+		o.diskOnly = append(o.diskOnly, "WithBackups")
+		return nil
+	}
+}
+
+// WithReadOnly opens an existing data directory without ever writing to it;
+// writes fail with types.ErrReadOnly. It can't be combined with WithWAL or
+// WithBackups, which write when the database is opened.
+func WithReadOnly() Option {
+	return func(o *options) error {
+		o.config.ReadOnly = true
+		o.diskOnly = append(o.diskOnly, "WithReadOnly")
+		return nil
+	}
+}
+
+// WithCache keeps up to size bytes of recently read entries in memory, so
+// reads of hot keys don't go to the data file
+func WithCache(size int64) Option {
+	return func(o *options) error {
+		if size <= 0 {
+			return fmt.Errorf("WithCache: size must be positive, got %d", size)
+		}
+		o.config.CacheSize = size
+		o.diskOnly = append(o.diskOnly, "WithCache")
+		return nil
+	}
+}
+
+// WithTTLCleanup enables TTLs and removes expired entries in the background
+// at least every interval (0 leaves them to reads and CleanupExpired)
+func WithTTLCleanup(interval time.Duration) Option {
+	return func(o *options) error {
+		if interval < 0 {
+			return fmt.Errorf("WithTTLCleanup: interval can't be negative, got %s", interval)
+		}
+		o.config.EnableTTL = true
+		o.config.CleanupInterval = interval
+		return nil
+	}
+}
+
+// WithLogger logs recovery, compaction, WAL and backup events and failures
+// that operations don't return to logger, dropping records below
+// Config.LogLevel. Without it nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) error {
+		o.config.Logger = logger
+		return nil
+	}
+}
+
+// WithOrdered makes OpenInMemory keep keys sorted, like
+// NewOrderedInMemoryDB
+func WithOrdered() Option {
+	return func(o *options) error {
+		o.ordered = true
+		return nil
+	}
+}
+
+// Open opens the disk database in dataDir, creating it if needed, with the
+// default config adjusted by opts. Writes are only buffered with the WAL
+// enabled, since buffered writes could otherwise be lost on a crash. Every
+// invalid option, conflict between options and config problem is reported
+// in one joined error.
+func Open(dataDir string, opts ...Option) (*Database, error) {
+	o, errs := applyOptions(types.DefaultConfig(), opts)
+	if o.ordered {
+		errs = append(errs, fmt.Errorf("WithOrdered only applies to OpenInMemory"))
+	}
+
+	config := o.config
+	config.EnablePersistence = true
+	config.DataDirectory = dataDir
+	if !o.configSet && !config.WALEnabled {
+		config.WriteBufferSize = 0
+	}
+	if config.ReadOnly && o.backups {
+		errs = append(errs, fmt.Errorf("WithReadOnly can't be combined with WithBackups, since recovery writes"))
+	}
+	config, err := checkConfig(config)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	// The storage and managers log through the database's output, so
+	// SetConfig can change where they log
+	logs := newLogOutput(config)
+	storageConfig := logs.configure(config)
+
+	storage, err := storage.NewDiskStorageWithConfig(storageConfig)
+	if err != nil {
+		return nil, err
+	}
+	if !o.backups {
+		return newDatabaseWithLogs(storage, config, logs), nil
+	}
+
+	backupManager, err := persistence.NewBackupManagerWithConfig(storageConfig)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to create backup manager: %w", err)
+	}
+
+	recoveryManager, err := persistence.NewRecoveryManagerWithConfig(storageConfig)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to create recovery manager: %w", err)
+	}
+	recoveryManager.SetStorage(storage)
+
+	db := newDatabaseWithLogs(storage, config, logs)
+	db.backupManager = backupManager
+	db.recoveryManager = recoveryManager
+
+	// Perform automatic recovery on startup
+	if _, err := db.recoveryManager.PerformRecovery(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to perform recovery: %w", err)
+	}
+
+	return db, nil
+}
+
+// OpenInMemory opens an in-memory database with the default config adjusted
+// by opts. Options that need a data directory, like WithWAL, are rejected.
+func OpenInMemory(opts ...Option) (*Database, error) {
+	o, errs := applyOptions(types.DefaultConfig(), opts)
+	for _, name := range o.diskOnly {
+		errs = append(errs, fmt.Errorf("%s only applies to Open", name))
+	}
+	if o.config.ReadOnly && len(o.diskOnly) == 0 {
+		errs = append(errs, fmt.Errorf("in-memory databases can't be read-only"))
+	}
+	config, err := checkConfig(o.config)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if o.ordered {
+		return newDatabase(storage.NewOrderedInMemoryStorage(), config), nil
+	}
+	return newDatabase(storage.NewInMemoryStorageWithConfig(config), config), nil
+}
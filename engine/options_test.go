@@ -0,0 +1,138 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.Open(dir,
+		engine.WithWAL(16<<20),
+		engine.WithCache(64<<20),
+		engine.WithTTLCleanup(time.Minute),
+	)
+	require.NoError(t, err)
+
+	config := db.GetConfig()
+	assert.True(t, config.EnablePersistence)
+	assert.Equal(t, dir, config.DataDirectory)
+	assert.True(t, config.WALEnabled)
+	assert.Equal(t, int64(16<<20), config.MaxWALSize)
+	assert.Equal(t, types.DefaultConfig().WriteBufferSize, config.WriteBufferSize)
+	assert.Equal(t, int64(64<<20), config.CacheSize)
+	assert.True(t, config.EnableTTL)
+	assert.Equal(t, time.Minute, config.CleanupInterval)
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Close())
+
+	// Without a WAL writes aren't buffered
+	db, err = engine.Open(dir)
+	require.NoError(t, err)
+	assert.Zero(t, db.GetConfig().WriteBufferSize)
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	require.NoError(t, db.Close())
+}
+
+func TestOpenPreset(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.Open(dir, engine.WithConfig(types.DurableConfig()))
+	require.NoError(t, err)
+	defer db.Close()
+
+	config := db.GetConfig()
+	assert.Equal(t, dir, config.DataDirectory)
+	assert.True(t, config.SyncOnWrite)
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, types.ProfileDurable, stats.Profile)
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := engine.Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Set("key", types.Value("value")))
+	require.NoError(t, db.Close())
+
+	db, err = engine.Open(dir, engine.WithReadOnly(), engine.WithCache(1<<20))
+	require.NoError(t, err)
+	defer db.Close()
+
+	value, err := db.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	assert.ErrorIs(t, db.Set("other", types.Value("value")), types.ErrReadOnly)
+	assert.ErrorIs(t, db.Delete("key"), types.ErrReadOnly)
+	assert.ErrorIs(t, db.Clear(), types.ErrReadOnly)
+
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.True(t, stats.ReadOnly)
+
+	// A read-only open needs an existing database
+	_, err = engine.Open(filepath.Join(dir, "missing"), engine.WithReadOnly())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOpenRejectsOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []engine.Option
+		want []string // Parts of the error
+	}{
+		{"negative WAL size", []engine.Option{engine.WithWAL(-1)}, []string{"WithWAL: max size can't be negative"}},
+		{"zero cache", []engine.Option{engine.WithCache(0)}, []string{"WithCache: size must be positive"}},
+		{"negative cleanup interval", []engine.Option{engine.WithTTLCleanup(-time.Second)}, []string{"WithTTLCleanup: interval can't be negative"}},
+		{"WAL and read-only", []engine.Option{engine.WithWAL(0), engine.WithReadOnly()}, []string{"ReadOnly can't be combined with WALEnabled"}},
+		{"backups and read-only", []engine.Option{engine.WithReadOnly(), engine.WithBackups()}, []string{"WithReadOnly can't be combined with WithBackups"}},
+		{"ordered", []engine.Option{engine.WithOrdered()}, []string{"WithOrdered only applies to OpenInMemory"}},
+		{"config after options", []engine.Option{engine.WithCache(1 << 20), engine.WithConfig(types.DefaultConfig())}, []string{"WithConfig must come first"}},
+		{"invalid config", []engine.Option{engine.WithConfig(types.Config{LogLevel: "loud"})}, []string{`unknown LogLevel "loud"`}},
+		{"every problem", []engine.Option{engine.WithCache(-1), engine.WithWAL(-1), engine.WithOrdered()}, []string{"WithCache", "WithWAL", "WithOrdered"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "db")
+			db, err := engine.Open(dir, test.opts...)
+			require.Error(t, err)
+			assert.Nil(t, db)
+			for _, want := range test.want {
+				assert.ErrorContains(t, err, want)
+			}
+
+			// Nothing was created
+			_, err = os.Stat(dir)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestOpenInMemory(t *testing.T) {
+	db, err := engine.OpenInMemory(engine.WithOrdered(), engine.WithTTLCleanup(0))
+	require.NoError(t, err)
+	defer db.Close()
+	assert.Zero(t, db.GetConfig().CleanupInterval)
+
+	for _, key := range []types.Key{"c", "a", "b"} {
+		require.NoError(t, db.Set(key, types.Value("value")))
+	}
+	keys, err := db.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"a", "b", "c"}, keys)
+
+	_, err = engine.OpenInMemory(engine.WithWAL(0), engine.WithCache(1<<20))
+	assert.ErrorContains(t, err, "WithWAL only applies to Open")
+	assert.ErrorContains(t, err, "WithCache only applies to Open")
+}
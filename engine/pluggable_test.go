@@ -0,0 +1,117 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/storage"
+	"database_engine/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readThroughStorage is a minimal third-party backend: it caches values in
+// another StorageEngine and loads misses from a slower source. It only
+// implements the Compacter and ExpiredCleaner capabilities.
+type readThroughStorage struct {
+	types.StorageEngine
+	source   map[types.Key]types.Value
+	loads    int
+	compacts int
+	cleanups int
+}
+
+func newReadThroughStorage(source map[types.Key]types.Value) *readThroughStorage {
+	return &readThroughStorage{StorageEngine: storage.NewInMemoryStorage(), source: source}
+}
+
+func (s *readThroughStorage) Get(key types.Key) (types.Value, error) {
+	value, err := s.StorageEngine.Get(key)
+	if err != types.ErrKeyNotFound {
+		return value, err
+	}
+
+	value, ok := s.source[key]
+	if !ok {
+		return nil, types.ErrKeyNotFound
+	}
+	s.loads++
+	if err := s.StorageEngine.Set(key, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *readThroughStorage) Compact() error {
+	s.compacts++
+	return nil
+}
+
+func (s *readThroughStorage) CleanupExpired() int {
+	s.cleanups++
+	return 0
+}
+
+func TestNewWithStorage(t *testing.T) {
+	backend := newReadThroughStorage(map[types.Key]types.Value{"remote": types.Value("value")})
+	db, err := engine.NewWithStorage(backend, types.DefaultConfig())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Reads fall through to the source once, then hit the cache
+	for i := 0; i < 2; i++ {
+		value, err := db.Get("remote")
+		require.NoError(t, err)
+		assert.Equal(t, types.Value("value"), value)
+	}
+	assert.Equal(t, 1, backend.loads)
+
+	require.NoError(t, db.Set("local", types.Value("value")))
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), size)
+
+	// Implemented capabilities are used
+	require.NoError(t, db.Compact())
+	assert.Equal(t, 1, backend.compacts)
+	assert.Equal(t, 0, db.CleanupExpired())
+	assert.Equal(t, 1, backend.cleanups)
+
+	// Missing ones are reported as unsupported
+	assert.Error(t, db.SetWithTTL("key", types.Value("value"), time.Hour))
+	_, err = db.GetDiskUsage()
+	assert.Error(t, err)
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Nil(t, stats.Storage)
+
+	require.NoError(t, db.Close())
+	assert.True(t, backend.IsClosed())
+}
+
+func TestBuiltinStorageCapabilities(t *testing.T) {
+	diskStorage, err := storage.NewDiskStorage(t.TempDir())
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	backends := map[string]types.StorageEngine{
+		"Memory":        storage.NewInMemoryStorage(),
+		"OrderedMemory": storage.NewOrderedInMemoryStorage(),
+		"Disk":          diskStorage,
+	}
+	for name, backend := range backends {
+		_, ok := backend.(types.TTLStorage)
+		assert.True(t, ok, "%s should support TTLs", name)
+		_, ok = backend.(types.ExpiredCleaner)
+		assert.True(t, ok, "%s should clean up expired entries", name)
+		_, ok = backend.(types.Compacter)
+		assert.Equal(t, name == "Disk", ok, "%s compaction support", name)
+		_, ok = backend.(types.DiskUsager)
+		assert.Equal(t, name == "Disk", ok, "%s disk usage support", name)
+		_, ok = backend.(types.OrderedStorageEngine)
+		assert.Equal(t, name == "OrderedMemory", ok, "%s ordering support", name)
+		_, ok = backend.(types.StatsReporter)
+		assert.True(t, ok, "%s should count its operations", name)
+	}
+}
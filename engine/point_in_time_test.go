@@ -0,0 +1,55 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverToTime(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", []byte("backed up")))
+	metadata, err := db.CreateBackup("base")
+	require.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, db.Set("key", []byte("good")))
+	time.Sleep(5 * time.Millisecond)
+	target := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, db.Set("key", []byte("bad")))
+	require.NoError(t, db.Set("other", []byte("bad")))
+
+	report, err := db.RecoverToTime(target)
+	require.NoError(t, err)
+	assert.Equal(t, metadata.Name, report.Backup)
+	assert.Equal(t, 1, report.WALReplayed)
+
+	// The files replaced are kept in quarantine until purged
+	quarantined, err := db.ListQuarantined()
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	assert.Equal(t, report.Quarantine, quarantined[0].Path)
+	assert.Equal(t, report.Quarantine, db.GetRecoveryState().LastQuarantine)
+	purged, err := db.PurgeQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	// The storage is open again on the recovered data
+	assertValue(t, db, "key", "good")
+	_, err = db.Get("other")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+	require.NoError(t, db.Set("other", []byte("after recovery")))
+	assertValue(t, db, "other", "after recovery")
+
+	_, err = db.RecoverToTime(time.Now().Add(-time.Hour))
+	assert.Error(t, err)
+	assertValue(t, db, "key", "good")
+}
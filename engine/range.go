@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"database_engine/types"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Range returns the entries with keys in [start, end) in ascending key
+// order. An empty end means no upper bound and a limit of zero or less means
+// no limit. Ordered storage serves this directly; other backends fall back
+// to scanning and sorting every key.
+func (db *Database) Range(start, end types.Key, limit int) ([]types.Entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if ordered, ok := db.storage.(types.OrderedStorageEngine); ok {
+		return ordered.Range(start, end, limit)
+	}
+
+	keys, err := db.scanKeys(func(key types.Key) bool {
+		return key >= start && (end == "" || key < end)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if reader, ok := db.storage.(types.EntryReader); ok {
+		return readEntries(reader, keys, limit)
+	}
+
+	values, err := db.storage.BatchGet(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []types.Entry
+	for _, key := range keys {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		// Keys that expired or were deleted since the scan are skipped
+		if value, ok := values[key]; ok {
+			entries = append(entries, types.Entry{Key: key, Value: value})
+		}
+	}
+
+	return entries, nil
+}
+
+// readEntries reads the whole entries stored for keys, up to limit of them,
+// so they come with their metadata like ordered storage's do. Keys that
+// expired or were deleted since they were listed are skipped.
+func readEntries(reader types.EntryReader, keys []types.Key, limit int) ([]types.Entry, error) {
+	var entries []types.Entry
+	for _, key := range keys {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		entry, err := reader.GetEntry(key)
+		if errors.Is(err, types.ErrKeyNotFound) || errors.Is(err, types.ErrKeyExpired) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+
+	return entries, nil
+}
+
+// KeysWithPrefix returns the keys starting with prefix in ascending order
+func (db *Database) KeysWithPrefix(prefix types.Key) ([]types.Key, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.keysWithPrefix(prefix)
+}
+
+// keysWithPrefix implements KeysWithPrefix; the caller must hold db.mu
+func (db *Database) keysWithPrefix(prefix types.Key) ([]types.Key, error) {
+	if ordered, ok := db.storage.(types.OrderedStorageEngine); ok {
+		return ordered.KeysWithPrefix(prefix)
+	}
+
+	return db.scanKeys(func(key types.Key) bool {
+		return strings.HasPrefix(string(key), string(prefix))
+	})
+}
+
+// scanKeys returns the sorted keys matching fn by visiting every key; the
+// caller must hold db.mu
+func (db *Database) scanKeys(fn func(key types.Key) bool) ([]types.Key, error) {
+	all, err := db.storage.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []types.Key
+	for _, key := range all {
+		if fn(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	return keys, nil
+}
@@ -0,0 +1,87 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/persistence"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForceRecoveryFromBackupCanBeUndone(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", []byte("old")))
+	old, err := db.CreateBackup("old")
+	require.NoError(t, err)
+	require.NoError(t, db.Set("key", []byte("current")))
+
+	// The wrong backup is restored, then the safety backup undoes it
+	report, err := db.ForceRecoveryFromBackup(old.Name)
+	require.NoError(t, err)
+	assert.Equal(t, old.Name, report.Backup)
+	require.NotEmpty(t, report.SafetyBackup)
+	assert.Empty(t, report.SafetyBackupSkipped)
+	assertValue(t, db, "key", "old")
+
+	safety, err := db.GetBackupInfo(report.SafetyBackup)
+	require.NoError(t, err)
+	assert.Contains(t, safety.Description, old.Name)
+
+	report, err = db.ForceRecoveryFromBackup(safety.Name)
+	require.NoError(t, err)
+	assertValue(t, db, "key", "current")
+
+	// A backup that doesn't exist fails before anything is backed up
+	backups, err := db.ListBackups()
+	require.NoError(t, err)
+	_, err = db.ForceRecoveryFromBackup("backup_19700101_000000")
+	assert.Error(t, err)
+	after, err := db.ListBackups()
+	require.NoError(t, err)
+	assert.Len(t, after, len(backups))
+}
+
+func TestAutoBackupBeforeDestructive(t *testing.T) {
+	db, err := engine.NewDiskDBWithWAL(t.TempDir(), 10*1024*1024)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", []byte("value")))
+
+	// Off by default
+	require.NoError(t, db.Compact())
+	backups, err := db.ListBackups()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+
+	config := db.GetConfig()
+	config.AutoBackupBeforeDestructive = true
+	require.NoError(t, db.SetConfig(config))
+
+	require.NoError(t, db.Compact())
+	require.NoError(t, db.Clear())
+	size, err := db.Size()
+	require.NoError(t, err)
+	assert.Zero(t, size)
+
+	backups, err = db.ListBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	assert.Equal(t, "Recovery point: before Clear", backups[0].Description)
+	assert.Equal(t, "Recovery point: before Compact", backups[1].Description)
+	assert.Equal(t, "before Clear", backups[0].Reason)
+
+	found, err := db.FindBackups(persistence.BackupFilter{
+		Tags: map[string]string{persistence.BackupTagKind: persistence.BackupKindRecoveryPoint},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, backups, found)
+
+	// The recovery point holds what Clear removed
+	require.NoError(t, db.RestoreFromBackup(backups[0].Name))
+	assertValue(t, db, "key", "value")
+}
@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"database_engine/types"
+	"fmt"
+	"strings"
+)
+
+// SelectiveRestore reports what RestoreKeys or RestoreByPrefix put back
+type SelectiveRestore struct {
+	Restored []types.Key // Keys written back from the backup, in ascending order
+	Missing  []types.Key // Requested keys without a live entry in the backup, in the order requested
+}
+
+// RestoreKeys writes the entries a backup holds for keys back into the
+// database with one BatchSet, logged to the WAL like any other write, and
+// leaves every other key as it is. Requested keys the backup has no live
+// entry for are reported as missing and keep their current value.
+func (db *Database) RestoreKeys(backupName string, keys []types.Key) (*SelectiveRestore, error) {
+	wanted := make(map[types.Key]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+
+	restore, err := db.restoreMatching("RestoreKeys", backupName, func(key types.Key) bool {
+		return wanted[key]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[types.Key]bool, len(restore.Restored))
+	for _, key := range restore.Restored {
+		found[key] = true
+	}
+	for _, key := range keys {
+		if !found[key] {
+			restore.Missing = append(restore.Missing, key)
+			found[key] = true
+		}
+	}
+	return restore, nil
+}
+
+// RestoreByPrefix is RestoreKeys for every key in the backup starting with
+// prefix, such as one tenant's data. Keys with the prefix that were written
+// since the backup and aren't in it are left alone.
+func (db *Database) RestoreByPrefix(backupName string, prefix types.Key) (*SelectiveRestore, error) {
+	return db.restoreMatching("RestoreByPrefix", backupName, func(key types.Key) bool {
+		return strings.HasPrefix(string(key), string(prefix))
+	})
+}
+
+// restoreMatching writes the live entries of a backup whose keys match back
+// into the database for op
+func (db *Database) restoreMatching(op, backupName string, match func(key types.Key) bool) (*SelectiveRestore, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	if db.backupManager == nil {
+		return nil, fmt.Errorf("backup not supported for this storage type")
+	}
+
+	entries, err := db.backupManager.ReadBackupEntries(backupName, match)
+	if err != nil {
+		return nil, err
+	}
+
+	restore := &SelectiveRestore{}
+	if len(entries) == 0 {
+		return restore, nil
+	}
+	if err := db.batchSet(op, entries); err != nil {
+		return nil, fmt.Errorf("failed to write restored entries: %w", err)
+	}
+
+	for _, entry := range entries {
+		restore.Restored = append(restore.Restored, entry.Key)
+	}
+	return restore, nil
+}
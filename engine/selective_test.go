@@ -0,0 +1,112 @@
+package engine_test
+
+import (
+	"bytes"
+	"database_engine/engine"
+	"database_engine/persistence"
+	"database_engine/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSelectiveRestoreDB opens a disk database with a WAL in dir and returns
+// it with the name of a backup holding two tenants' data
+func newSelectiveRestoreDB(t *testing.T, dir string) (*engine.Database, string) {
+	t.Helper()
+
+	db, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	require.NoError(t, db.Set("tenant1/a", []byte("a1")))
+	require.NoError(t, db.Set("tenant1/b", []byte("b1")))
+	require.NoError(t, db.Set("tenant1/large", bytes.Repeat([]byte("x"), 2048)))
+	require.NoError(t, db.SetWithTTL("tenant1/session", []byte("s1"), time.Hour))
+	require.NoError(t, db.Set("tenant2/a", []byte("a2")))
+	require.NoError(t, db.Set("backup-only", []byte("old")))
+	metadata, err := db.CreateBackup("tenants")
+	require.NoError(t, err)
+
+	// Damage tenant1, move tenant2 on and add keys the backup doesn't have
+	require.NoError(t, db.Set("tenant1/a", []byte("damaged")))
+	require.NoError(t, db.Delete("tenant1/b"))
+	require.NoError(t, db.Set("tenant1/large", []byte("damaged")))
+	require.NoError(t, db.Delete("tenant1/session"))
+	require.NoError(t, db.Set("tenant1/new", []byte("written since")))
+	require.NoError(t, db.Set("tenant2/a", []byte("a2 updated")))
+	require.NoError(t, db.Delete("backup-only"))
+	require.NoError(t, db.Set("live-only", []byte("new")))
+
+	return db, metadata.Name
+}
+
+func assertValue(t *testing.T, db *engine.Database, key types.Key, expected string) {
+	t.Helper()
+
+	value, err := db.Get(key)
+	require.NoError(t, err, key)
+	assert.Equal(t, types.Value(expected), value, key)
+}
+
+func TestRestoreKeys(t *testing.T) {
+	db, backupName := newSelectiveRestoreDB(t, t.TempDir())
+
+	restore, err := db.RestoreKeys(backupName, []types.Key{"tenant1/b", "backup-only", "tenant1/a", "live-only", "absent", "absent"})
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"backup-only", "tenant1/a", "tenant1/b"}, restore.Restored)
+	assert.Equal(t, []types.Key{"live-only", "absent"}, restore.Missing)
+
+	// In the backup only, or in both: back as they were
+	assertValue(t, db, "backup-only", "old")
+	assertValue(t, db, "tenant1/a", "a1")
+	assertValue(t, db, "tenant1/b", "b1")
+
+	// In the live data only, or not requested: untouched
+	assertValue(t, db, "live-only", "new")
+	assertValue(t, db, "tenant1/large", "damaged")
+	assertValue(t, db, "tenant2/a", "a2 updated")
+	_, err = db.Get("absent")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	_, err = db.RestoreKeys("backup_missing", []types.Key{"tenant1/a"})
+	assert.Error(t, err)
+	_, err = db.RestoreKeys("../"+backupName, []types.Key{"tenant1/a"})
+	assert.ErrorIs(t, err, persistence.ErrInvalidBackupName)
+}
+
+func TestRestoreByPrefix(t *testing.T) {
+	dir := t.TempDir()
+	db, backupName := newSelectiveRestoreDB(t, dir)
+
+	restore, err := db.RestoreByPrefix(backupName, "tenant1/")
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"tenant1/a", "tenant1/b", "tenant1/large", "tenant1/session"}, restore.Restored)
+	assert.Empty(t, restore.Missing)
+
+	assertValue(t, db, "tenant1/a", "a1")
+	assertValue(t, db, "tenant1/b", "b1")
+	assertValue(t, db, "tenant1/large", string(bytes.Repeat([]byte("x"), 2048)))
+	assertValue(t, db, "tenant1/session", "s1")
+
+	// The rest of tenant1 and everyone else keep their current data
+	assertValue(t, db, "tenant1/new", "written since")
+	assertValue(t, db, "tenant2/a", "a2 updated")
+	assertValue(t, db, "live-only", "new")
+	_, err = db.Get("backup-only")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	// The restored writes are durable like any other
+	require.NoError(t, db.Close())
+	reopened, err := engine.NewDiskDBWithWAL(dir, 10*1024*1024)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assertValue(t, reopened, "tenant1/a", "a1")
+
+	// A prefix nothing in the backup starts with restores nothing
+	restore, err = reopened.RestoreByPrefix(backupName, "tenant3/")
+	require.NoError(t, err)
+	assert.Empty(t, restore.Restored)
+}
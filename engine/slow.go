@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"fmt"
+	"time"
+)
+
+// startOp starts op on key, or on keys keys writing valueSize bytes,
+// calling the hooks' BeforeOp. The clock is only read if latency tracking,
+// slow operation logging or a hook needs it. The caller must hold db.mu.
+func (db *Database) startOp(op latencyOp, key types.Key, keys, valueSize int) opCall {
+	call := opCall{
+		op:    op,
+		info:  OpInfo{Op: latencyOpNames[op], Key: key, Keys: keys, ValueSize: valueSize},
+		hooks: db.hooks,
+	}
+	if len(call.hooks) > 0 {
+		call.info.Storage = db.storageBackend()
+		call.info.WAL = db.walLogged(op)
+		db.beforeHooks(&call)
+	}
+	if db.latency != nil || db.config.SlowOpThreshold > 0 || len(call.hooks) > 0 {
+		call.start = time.Now()
+	}
+	return call
+}
+
+// finishOp records the latency of call, logs and counts it if it took
+// Config.SlowOpThreshold or longer, and calls the hooks' AfterOp with err.
+// The caller must hold db.mu.
+func (db *Database) finishOp(call *opCall, err error) {
+	if call.start.IsZero() {
+		return
+	}
+	elapsed := time.Since(call.start)
+	db.latency.record(call.op, elapsed)
+	if threshold := db.config.SlowOpThreshold; threshold > 0 && elapsed >= threshold {
+		db.slowOp(call.op, call.info.Key, elapsed)
+	}
+	if len(call.hooks) > 0 {
+		call.info.Duration = elapsed
+		db.afterHooks(call, err)
+	}
+}
+
+// slowOp logs and counts an operation that took elapsed
+func (db *Database) slowOp(op latencyOp, key types.Key, elapsed time.Duration) {
+	db.slowOps.Add(1)
+
+	attrs := []any{
+		"op", latencyOpNames[op],
+		"duration", elapsed,
+		"threshold", db.config.SlowOpThreshold,
+		"storage", db.storageBackend(),
+		"wal_fsync", db.walFsyncs(op),
+	}
+	if key != "" {
+		attrs = append(attrs, "key", key)
+	}
+	db.log.Warn("slow operation", attrs...)
+}
+
+// storageBackend names the kind of storage the database runs on
+func (db *Database) storageBackend() string {
+	switch db.storage.(type) {
+	case *storage.DiskStorage:
+		return "disk"
+	case *storage.InMemoryStorage:
+		return "memory"
+	case *storage.OrderedInMemoryStorage:
+		return "ordered-memory"
+	default:
+		return fmt.Sprintf("%T", db.storage)
+	}
+}
+
+// walLogged reports whether op is logged to the WAL: a write to disk
+// storage with the WAL enabled
+func (db *Database) walLogged(op latencyOp) bool {
+	switch op {
+	case latencySet, latencyDelete, latencyBatchSet, latencyBatchDelete:
+	default:
+		return false
+	}
+	_, ok := db.walJournal()
+	return ok
+}
+
+// walFsyncs reports whether op waits for the WAL to be fsynced: a write
+// logged to a WAL synced on every write
+func (db *Database) walFsyncs(op latencyOp) bool {
+	return db.walLogged(op) && db.config.WALSyncPolicy == types.WALSyncAlways
+}
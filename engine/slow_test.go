@@ -0,0 +1,89 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/storage"
+	"database_engine/types"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stallingStorage delays writes of keys starting with "slow/", like a
+// stalled fsync would
+type stallingStorage struct {
+	types.StorageEngine
+	delay time.Duration
+}
+
+func (s *stallingStorage) Set(key types.Key, value types.Value) error {
+	if strings.HasPrefix(string(key), "slow/") {
+		time.Sleep(s.delay)
+	}
+	return s.StorageEngine.Set(key, value)
+}
+
+func TestSlowOpLogging(t *testing.T) {
+	logs := &logRecorder{}
+	config := types.DefaultConfig()
+	config.SlowOpThreshold = 20 * time.Millisecond
+	config.Logger = slog.New(logs)
+	db, err := engine.NewWithStorage(&stallingStorage{StorageEngine: storage.NewInMemoryStorage(), delay: 50 * time.Millisecond}, config)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("fast", types.Value("value")))
+	require.NoError(t, db.Set("slow/1", types.Value("value")))
+	_, err = db.Get("slow/1")
+	require.NoError(t, err)
+
+	slow := logs.find("slow operation")
+	require.Len(t, slow, 1)
+	assert.Equal(t, slog.LevelWarn, slow[0].Level)
+	assert.Equal(t, "Set", attr(slow[0], "op").String())
+	assert.Equal(t, "slow/1", attr(slow[0], "key").String())
+	assert.GreaterOrEqual(t, attr(slow[0], "duration").Duration(), 50*time.Millisecond)
+	assert.Equal(t, "*engine_test.stallingStorage", attr(slow[0], "storage").String())
+	assert.False(t, attr(slow[0], "wal_fsync").Bool())
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.SlowOps)
+
+	// Zero disables it
+	config = db.GetConfig()
+	config.SlowOpThreshold = 0
+	require.NoError(t, db.SetConfig(config))
+	require.NoError(t, db.Set("slow/2", types.Value("value")))
+	assert.Len(t, logs.find("slow operation"), 1)
+	stats, err = db.GetStats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.SlowOps)
+}
+
+func TestSlowOpWALFsync(t *testing.T) {
+	logs := &logRecorder{}
+	config := types.DefaultConfig()
+	config.WALSyncPolicy = types.WALSyncAlways
+	// Every operation takes at least a nanosecond
+	config.SlowOpThreshold = time.Nanosecond
+	config.Logger = slog.New(logs)
+	db, err := engine.Open(t.TempDir(), engine.WithConfig(config), engine.WithWAL(0))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	_, err = db.Get("key")
+	require.NoError(t, err)
+
+	slow := logs.find("slow operation")
+	require.Len(t, slow, 2)
+	assert.Equal(t, "Set", attr(slow[0], "op").String())
+	assert.Equal(t, "disk", attr(slow[0], "storage").String())
+	assert.True(t, attr(slow[0], "wal_fsync").Bool())
+	assert.Equal(t, "Get", attr(slow[1], "op").String())
+	assert.False(t, attr(slow[1], "wal_fsync").Bool())
+}
@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/wal"
+	"errors"
+	"fmt"
+)
+
+// DiskUsage breaks down the space used by a disk database per component,
+// including the backups kept alongside the data
+type DiskUsage struct {
+	storage.DiskUsage
+	BackupSize int64 `json:"backup_size"`
+	Total      int64 `json:"total"`
+}
+
+// Stats is a point-in-time snapshot of the database
+type Stats struct {
+	StorageType string               `json:"storage_type"`      // "memory" or "disk"
+	Profile     string               `json:"profile,omitempty"` // Config.Profile of the database
+	Keys        int64                `json:"keys"`
+	DiskUsage   *DiskUsage           `json:"disk_usage,omitempty"` // Only set for disk-based storage
+	Memory      *storage.MemoryStats `json:"memory,omitempty"`     // Only set for in-memory storage
+	WAL         *wal.Stats           `json:"wal,omitempty"`        // Only set when the WAL is enabled
+
+	// Storage holds the storage engine's own counters, for engines that
+	// keep them (see types.StatsReporter)
+	Storage *types.StorageStats `json:"storage,omitempty"`
+
+	// Latency holds latency percentiles per operation ("Get", "Set",
+	// "Delete", "BatchGet", "BatchSet", "Compact") recorded since the
+	// database opened or ResetLatencyStats, when
+	// Config.EnableLatencyTracking is set
+	Latency map[string]LatencyStats `json:"latency,omitempty"`
+
+	// SlowOps counts the operations that took Config.SlowOpThreshold or
+	// longer since the database opened
+	SlowOps int64 `json:"slow_ops,omitempty"`
+
+	// PrunedBackups counts the incomplete backups, left by a process that
+	// died while making them, removed when the database was opened
+	PrunedBackups int `json:"pruned_backups,omitempty"`
+
+	// ExpiryDropped counts the expiries not passed to the OnExpire
+	// callbacks because too many were already waiting for them
+	ExpiryDropped int64 `json:"expiry_dropped,omitempty"`
+
+	// StatsSnapshotsDropped counts the snapshots not written to the stats
+	// log because writing the ones before was still in progress
+	StatsSnapshotsDropped int64 `json:"stats_snapshots_dropped,omitempty"`
+
+	// ReadOnly is set while the storage refuses writes after a write
+	// failure, with the failure in ReadOnlyReason
+	ReadOnly       bool   `json:"read_only"`
+	ReadOnlyReason string `json:"read_only_reason,omitempty"`
+
+	// DiskUsageStatus is the outcome of the last disk usage check, when a
+	// disk usage threshold is set
+	DiskUsageStatus *DiskUsageStatus `json:"disk_usage_status,omitempty"`
+}
+
+// GetStats returns a snapshot of the database
+func (db *Database) GetStats() (*Stats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.stats()
+}
+
+// stats implements GetStats. The caller must hold db.mu.
+func (db *Database) stats() (*Stats, error) {
+	keys, err := db.storage.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{StorageType: "memory", Profile: db.config.Profile, Keys: keys}
+	if inMemoryStorage, ok := db.storage.(*storage.InMemoryStorage); ok {
+		memory := inMemoryStorage.GetMemoryStats()
+		stats.Memory = &memory
+	}
+	if diskStorage, ok := db.storage.(*storage.DiskStorage); ok {
+		stats.StorageType = "disk"
+
+		usage, err := db.diskUsageDetailed()
+		if err != nil {
+			return nil, err
+		}
+		stats.DiskUsage = usage
+
+		if diskStorage.IsWALEnabled() {
+			walStats, err := diskStorage.GetWALStats()
+			if err != nil {
+				return nil, err
+			}
+			stats.WAL = &walStats
+		}
+	}
+	if reporter, ok := db.storage.(types.StatsReporter); ok {
+		storageStats := reporter.Stats()
+		stats.Storage = &storageStats
+	}
+	if db.latency != nil {
+		stats.Latency = db.latency.stats()
+	}
+	stats.SlowOps = db.slowOps.Load()
+	if db.backupManager != nil {
+		stats.PrunedBackups = db.backupManager.GetPrunedBackupCount()
+	}
+	if db.expiry != nil {
+		stats.ExpiryDropped = db.expiry.dropped.Load()
+	}
+	stats.StatsSnapshotsDropped = db.statsLog.droppedSnapshots()
+	if db.disk != nil {
+		status := db.disk.current()
+		stats.DiskUsageStatus = &status
+	}
+	if healthChecker, ok := db.storage.(types.HealthChecker); ok {
+		if err := healthChecker.Health(); errors.Is(err, types.ErrReadOnly) {
+			stats.ReadOnly = true
+			stats.ReadOnlyReason = err.Error()
+		}
+	}
+
+	return stats, nil
+}
+
+// GetDiskUsageDetailed returns the per-component disk usage for disk-based storage
+func (db *Database) GetDiskUsageDetailed() (*DiskUsage, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.diskUsageDetailed()
+}
+
+// diskUsageDetailed aggregates the storage breakdown with the backup
+// directory; the caller must hold db.mu
+func (db *Database) diskUsageDetailed() (*DiskUsage, error) {
+	diskStorage, ok := db.storage.(*storage.DiskStorage)
+	if !ok {
+		return nil, fmt.Errorf("disk usage reporting not supported for this storage type")
+	}
+
+	storageUsage, err := diskStorage.GetDiskUsageDetailed()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &DiskUsage{DiskUsage: storageUsage}
+	if db.backupManager != nil {
+		backupSize, err := db.backupManager.GetBackupDirSize()
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure backups: %w", err)
+		}
+		usage.BackupSize = backupSize
+	}
+	usage.Total = storageUsage.Total() + usage.BackupSize
+
+	return usage, nil
+}
@@ -0,0 +1,290 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"database_engine/storage"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsLogName is the file in the data directory stats snapshots are
+// appended to. Rotated logs are named after it with a number appended,
+// stats.log.1 being the newest.
+const StatsLogName = "stats.log"
+
+// statsLogQueue is how many snapshots can wait for the writer before new
+// ones are dropped
+const statsLogQueue = 4
+
+// StatsSnapshot is a line of the stats log: the stats of the database at
+// Time
+type StatsSnapshot struct {
+	Time time.Time `json:"time"`
+	Stats
+}
+
+// statsLog takes a snapshot of the stats every Config.StatsSnapshotInterval
+// and has a writer goroutine append it to the stats log, so a slow disk
+// never holds up the database: snapshots the writer hasn't caught up with
+// are dropped and counted instead
+type statsLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	perm     os.FileMode
+	log      *slog.Logger
+
+	queue   chan StatsSnapshot
+	stop    chan struct{}
+	done    chan struct{} // Closed once the writer has closed the file
+	dropped atomic.Int64
+}
+
+// startStatsLog starts writing stats snapshots if the database is on disk,
+// writable, and the config sets an interval. The caller must own db.
+func (db *Database) startStatsLog(config types.Config) {
+	if config.StatsSnapshotInterval <= 0 || config.ReadOnly {
+		return
+	}
+	if _, ok := db.storage.(*storage.DiskStorage); !ok {
+		return
+	}
+
+	db.statsLog = &statsLog{
+		path:     filepath.Join(config.DataDirectory, StatsLogName),
+		maxSize:  config.StatsLogMaxSize,
+		maxFiles: config.StatsLogMaxFiles,
+		perm:     config.FilePermissions(),
+		log:      db.log,
+		queue:    make(chan StatsSnapshot, statsLogQueue),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go db.statsLog.write()
+	go db.runStatsSnapshots(config.StatsSnapshotInterval)
+}
+
+// stopStatsLog stops taking snapshots and waits for the writer to write
+// those already taken and close the log, if it is running. The caller
+// holds db.mu, which the writer doesn't need.
+func (db *Database) stopStatsLog() {
+	if db.statsLog != nil {
+		close(db.statsLog.stop)
+		<-db.statsLog.done
+	}
+}
+
+// runStatsSnapshots queues a snapshot of the stats for the writer every
+// interval, until the database is closed
+func (db *Database) runStatsSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.statsLog.stop:
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := db.GetStats()
+		if errors.Is(err, types.ErrDatabaseClosed) {
+			return
+		} else if err != nil {
+			db.log.Warn("failed to take stats snapshot", "error", err)
+			continue
+		}
+
+		select {
+		case db.statsLog.queue <- StatsSnapshot{Time: time.Now().UTC(), Stats: *stats}:
+		default:
+			db.statsLog.dropped.Add(1)
+		}
+	}
+}
+
+// droppedSnapshots returns how many snapshots were dropped because the
+// writer was behind. It is 0 without a stats log.
+func (l *statsLog) droppedSnapshots() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// write appends the queued snapshots to the log until stopped, then writes
+// what is still queued and closes it
+func (l *statsLog) write() {
+	defer close(l.done)
+
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for {
+		var snapshot StatsSnapshot
+		select {
+		case snapshot = <-l.queue:
+		case <-l.stop:
+			for {
+				select {
+				case snapshot = <-l.queue:
+					file = l.append(file, snapshot)
+				default:
+					return
+				}
+			}
+		}
+		file = l.append(file, snapshot)
+	}
+}
+
+// append writes snapshot as a line of the log open in file, opening it if
+// file is nil and rotating it first if the line would take it past maxSize,
+// and returns the file to write the next line to. Failures are logged; the
+// file is nil after one, so the next line opens it again.
+func (l *statsLog) append(file *os.File, snapshot StatsSnapshot) *os.File {
+	line, err := json.Marshal(snapshot)
+	if err != nil {
+		l.log.Warn("failed to write stats snapshot", "path", l.path, "error", err)
+		return file
+	}
+	line = append(line, '\n')
+
+	if file == nil {
+		if file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, l.perm); err != nil {
+			l.log.Warn("failed to write stats snapshot", "path", l.path, "error", err)
+			return nil
+		}
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > l.maxSize {
+		file.Close()
+		file = nil
+		if err = l.rotate(); err == nil {
+			file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, l.perm)
+		}
+	}
+	if err == nil {
+		_, err = file.Write(line)
+	}
+	if err != nil {
+		l.log.Warn("failed to write stats snapshot", "path", l.path, "error", err)
+		if file != nil {
+			file.Close()
+		}
+		return nil
+	}
+	return file
+}
+
+// rotate renames the log to stats.log.1, moving each rotated log up a
+// number and removing those past maxFiles
+func (l *statsLog) rotate() error {
+	rotated := func(n int) string { return l.path + "." + strconv.Itoa(n) }
+
+	if err := os.Remove(rotated(l.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(rotated(n), rotated(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(l.path, rotated(1))
+}
+
+// ReadStatsHistory reads back the stats snapshots written to the stats log
+// of the database in dataDir and its rotated logs, oldest first. It works
+// on the directory alone, so tools can read it while the database is
+// closed or held open by another process. A line cut short by a crash at
+// the end of a log is skipped; any other line that doesn't parse fails
+// with its file and line number. With no stats log at all it fails with an
+// error matching os.ErrNotExist.
+func ReadStatsHistory(dataDir string) ([]StatsSnapshot, error) {
+	path := filepath.Join(dataDir, StatsLogName)
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	// Rotated logs from the highest number, the oldest, down to the
+	// current one
+	numbers := make(map[string]int)
+	var paths []string
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimPrefix(match, path+"."))
+		if err != nil || n < 1 {
+			continue
+		}
+		numbers[match] = n
+		paths = append(paths, match)
+	}
+	sort.Slice(paths, func(i, j int) bool { return numbers[paths[i]] > numbers[paths[j]] })
+	paths = append(paths, path)
+
+	var snapshots []StatsSnapshot
+	found := false
+	for _, path := range paths {
+		read, err := readStatsLog(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		snapshots = append(snapshots, read...)
+	}
+	if !found {
+		return nil, fmt.Errorf("no stats log in %s: %w", dataDir, os.ErrNotExist)
+	}
+	return snapshots, nil
+}
+
+// readStatsLog reads the snapshots of one stats log
+func readStatsLog(path string) ([]StatsSnapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var snapshots []StatsSnapshot
+	reader := bufio.NewReader(file)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A last line without its newline was cut short
+			return snapshots, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var snapshot StatsSnapshot
+		if err := json.Unmarshal(line, &snapshot); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+}
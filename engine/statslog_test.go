@@ -0,0 +1,140 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	config := types.DefaultConfig()
+	config.StatsSnapshotInterval = 5 * time.Millisecond
+	config.StatsLogMaxSize = 2048
+	config.StatsLogMaxFiles = 2
+	db, err := engine.Open(dir, engine.WithConfig(config), engine.WithWAL(0))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	logPath := filepath.Join(dir, engine.StatsLogName)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(logPath + ".2")
+		return err == nil
+	}, 5*time.Second, 5*time.Millisecond)
+	// Wait for one more rotation, so the oldest log has been removed
+	info, err := os.Stat(logPath + ".2")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		rotated, err := os.Stat(logPath + ".2")
+		return err == nil && !os.SameFile(info, rotated)
+	}, 5*time.Second, 5*time.Millisecond)
+	require.NoError(t, db.Close())
+
+	for _, name := range []string{engine.StatsLogName, engine.StatsLogName + ".1", engine.StatsLogName + ".2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), config.StatsLogMaxSize, name)
+	}
+	_, err = os.Stat(logPath + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	snapshots, err := engine.ReadStatsHistory(dir)
+	require.NoError(t, err)
+	require.Greater(t, len(snapshots), 2)
+	for i, snapshot := range snapshots {
+		assert.Equal(t, "disk", snapshot.StorageType)
+		assert.Equal(t, int64(1), snapshot.Keys)
+		require.NotNil(t, snapshot.DiskUsage)
+		require.NotNil(t, snapshot.WAL)
+		if i > 0 {
+			assert.False(t, snapshot.Time.Before(snapshots[i-1].Time))
+		}
+	}
+
+	// Nothing is written once the database is closed
+	last := snapshots[len(snapshots)-1]
+	time.Sleep(20 * time.Millisecond)
+	snapshots, err = engine.ReadStatsHistory(dir)
+	require.NoError(t, err)
+	assert.Equal(t, last.Time, snapshots[len(snapshots)-1].Time)
+}
+
+// writeStatsLog writes snapshots of a database with keys keys, taken a
+// second apart from start, as the stats log called name in dir
+func writeStatsLog(t *testing.T, dir, name string, start time.Time, keys ...int64) {
+	var data []byte
+	for i, n := range keys {
+		line, err := json.Marshal(engine.StatsSnapshot{
+			Time:  start.Add(time.Duration(i) * time.Second),
+			Stats: engine.Stats{StorageType: "disk", Keys: n, SlowOps: n * 2},
+		})
+		require.NoError(t, err)
+		data = append(append(data, line...), '\n')
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+}
+
+func TestReadStatsHistory(t *testing.T) {
+	dir := t.TempDir()
+	_, err := engine.ReadStatsHistory(dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	writeStatsLog(t, dir, "stats.log.2", start, 1, 2)
+	writeStatsLog(t, dir, "stats.log.1", start.Add(time.Minute), 3)
+	writeStatsLog(t, dir, "stats.log", start.Add(2*time.Minute), 4, 5)
+	// Files that aren't rotated logs are ignored
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stats.log.bak"), []byte("junk"), 0644))
+
+	// A crash cut the last line short
+	file, err := os.OpenFile(filepath.Join(dir, "stats.log"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"time":"2024-05-01T12:05:00Z","storage_ty`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	snapshots, err := engine.ReadStatsHistory(dir)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 5)
+	for i, snapshot := range snapshots {
+		assert.Equal(t, int64(i+1), snapshot.Keys)
+		assert.Equal(t, int64(2*(i+1)), snapshot.SlowOps)
+		assert.Equal(t, "disk", snapshot.StorageType)
+	}
+	assert.Equal(t, start, snapshots[0].Time)
+	assert.Equal(t, start.Add(2*time.Minute+time.Second), snapshots[4].Time)
+
+	// A damaged line anywhere else is an error naming it
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stats.log.1"), []byte("{}\nnot json\n{}\n"), 0644))
+	_, err = engine.ReadStatsHistory(dir)
+	assert.ErrorContains(t, err, fmt.Sprintf("%s:2:", filepath.Join(dir, "stats.log.1")))
+}
+
+func TestStatsLogDisabled(t *testing.T) {
+	dir := t.TempDir()
+	config := types.DefaultConfig()
+	config.StatsSnapshotInterval = time.Millisecond
+	// In-memory databases have no data directory to write to
+	memory, err := engine.OpenInMemory(engine.WithConfig(config))
+	require.NoError(t, err)
+	defer memory.Close()
+
+	db, err := engine.Open(dir)
+	require.NoError(t, err)
+	defer db.Close()
+	time.Sleep(10 * time.Millisecond)
+	stats, err := db.GetStats()
+	require.NoError(t, err)
+	assert.Zero(t, stats.StatsSnapshotsDropped)
+	_, err = engine.ReadStatsHistory(dir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,576 @@
+package engine
+
+import (
+	"context"
+	"database_engine/types"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// transaction is a types.Transaction on a Database. Reads go to the
+// transaction's own writes first and then to a storage read view taken at
+// Begin, so they never see writes other goroutines commit meanwhile. Writes
+// are buffered until Commit. An optimistic transaction also remembers the
+// version of every key it read from the view, to check them on Commit. A
+// transaction with a context is rolled back as soon as the context is done.
+// Each savepoint starts a new layer of writes on top of the ones before it,
+// so rolling back to it only has to drop the layers from it on.
+type transaction struct {
+	db     *Database
+	view   types.ReadView
+	ctx    context.Context    // nil without a timeout or context
+	cancel context.CancelFunc // Releases the timeout's timer
+	stop   func() bool        // Stops watching ctx
+
+	mu         sync.Mutex
+	writes     map[types.Key]txWrite // Writes before the first savepoint
+	savepoints []savepoint           // Oldest first
+	reads      map[types.Key]uint64  // nil unless optimistic; 0 for keys read missing
+	ended      error                 // Returned by operations once the transaction has ended
+}
+
+// savepoint is a named point in a transaction and the writes made since it,
+// up to the next savepoint
+type savepoint struct {
+	name   string
+	writes map[types.Key]txWrite
+}
+
+// txWrite is a buffered write; deleted writes remove the key
+type txWrite struct {
+	value   types.Value
+	deleted bool
+}
+
+// Begin starts a transaction with snapshot isolation: its reads see the
+// database as it was when it began, plus its own writes, however long it
+// runs and whatever others write meanwhile. Its writes are only applied on
+// Commit. An open transaction costs memory: in-memory storage keeps the
+// previous entry of every key written while it is open, and disk storage a
+// copy of its index, so long transactions should be committed or rolled
+// back promptly, or begun with BeginWithOptions and a timeout. Storage must
+// implement types.SnapshotReader.
+func (db *Database) Begin() (types.Transaction, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.begin(types.TxOptions{})
+}
+
+// BeginOptimistic starts a transaction like Begin that also detects
+// conflicting writes: Commit fails with ErrConflict, writing nothing, if
+// any key the transaction read from the database has been written or
+// deleted since it began, so of two transactions that read and write the
+// same key only the first to commit succeeds. Keys it only wrote aren't
+// checked. Storage must implement types.VersionedStorage as well.
+func (db *Database) BeginOptimistic() (types.Transaction, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.begin(types.TxOptions{Optimistic: true})
+}
+
+// BeginWithOptions starts a transaction like Begin, or BeginOptimistic if
+// options.Optimistic is set, that is rolled back automatically once it has
+// been open for options.Timeout or options.Context is done, so one that is
+// forgotten doesn't hold on to its snapshot. Its operations fail with
+// types.ErrTransactionExpired from then on.
+func (db *Database) BeginWithOptions(options types.TxOptions) (types.Transaction, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	return db.begin(options)
+}
+
+// begin starts a transaction; the caller must hold db.mu
+func (db *Database) begin(options types.TxOptions) (types.Transaction, error) {
+	reader, ok := db.storage.(types.SnapshotReader)
+	if !ok {
+		return nil, fmt.Errorf("transactions not supported for this storage type")
+	}
+	if _, ok := db.storage.(types.VersionedStorage); options.Optimistic && !ok {
+		return nil, fmt.Errorf("optimistic transactions not supported for this storage type")
+	}
+
+	view, err := reader.ReadView()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &transaction{
+		db:     db,
+		view:   view,
+		writes: make(map[types.Key]txWrite),
+	}
+	if options.Optimistic {
+		tx.reads = make(map[types.Key]uint64)
+	}
+	if err := db.transactions.add(tx); err != nil {
+		view.Close()
+		return nil, err
+	}
+
+	if options.Context != nil || options.Timeout > 0 {
+		tx.ctx = options.Context
+		if tx.ctx == nil {
+			tx.ctx = context.Background()
+		}
+		if options.Timeout > 0 {
+			tx.ctx, tx.cancel = context.WithTimeout(tx.ctx, options.Timeout)
+		}
+		tx.stop = context.AfterFunc(tx.ctx, tx.expire)
+	}
+	return tx, nil
+}
+
+// expire rolls the transaction back because its context is done
+func (tx *transaction) expire() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.active()
+}
+
+// abort rolls the transaction back because the database is closing and
+// reports whether it was still open
+func (tx *transaction) abort() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.active() != nil {
+		return false
+	}
+	tx.end(fmt.Errorf("%w: %w", types.ErrTransactionAborted, types.ErrDatabaseClosed))
+	return true
+}
+
+// active returns nil while the transaction is open and otherwise the error
+// its operations fail with, rolling it back first if its context is done
+// but the watch hasn't got to it yet; the caller must hold tx.mu
+func (tx *transaction) active() error {
+	if tx.ended == nil && tx.ctx != nil && tx.ctx.Err() != nil {
+		tx.end(fmt.Errorf("%w: %w", types.ErrTransactionExpired, context.Cause(tx.ctx)))
+	}
+	return tx.ended
+}
+
+// end ends the transaction, after which its operations fail with err, and
+// releases its read view; the caller must hold tx.mu
+func (tx *transaction) end(err error) error {
+	tx.ended = err
+	tx.writes = nil
+	tx.savepoints = nil
+	if tx.stop != nil {
+		tx.stop()
+	}
+	if tx.cancel != nil {
+		tx.cancel()
+	}
+	tx.db.transactions.remove(tx)
+	return tx.view.Close()
+}
+
+// Get returns the value the transaction last wrote for key, or else the
+// value key had when the transaction began
+func (tx *transaction) Get(key types.Key) (types.Value, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return nil, types.NewOpError("Tx.Get", key, err)
+	}
+	if err := tx.validateLookup(key); err != nil {
+		return nil, types.NewOpError("Tx.Get", key, err)
+	}
+
+	if write, ok := tx.lookup(key); ok {
+		if write.deleted {
+			return nil, types.NewOpError("Tx.Get", key, types.ErrKeyNotFound)
+		}
+		return write.value, nil
+	}
+
+	entry, err := tx.view.GetEntry(key)
+	if tx.reads != nil {
+		switch {
+		case err == nil:
+			tx.reads[key] = entry.Version
+		case errors.Is(err, types.ErrKeyNotFound) || errors.Is(err, types.ErrKeyExpired):
+			// Commit checks it is still missing
+			tx.reads[key] = 0
+		}
+	}
+	if err != nil {
+		return nil, types.NewOpError("Tx.Get", key, err)
+	}
+	return entry.Value, nil
+}
+
+// Set buffers a write of key until Commit
+func (tx *transaction) Set(key types.Key, value types.Value) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return types.NewOpError("Tx.Set", key, err)
+	}
+	if err := tx.validate(key, value); err != nil {
+		return types.NewOpError("Tx.Set", key, err)
+	}
+
+	tx.top()[key] = txWrite{value: value}
+	return nil
+}
+
+// Delete buffers the removal of key until Commit
+func (tx *transaction) Delete(key types.Key) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return types.NewOpError("Tx.Delete", key, err)
+	}
+	if err := tx.validateLookup(key); err != nil {
+		return types.NewOpError("Tx.Delete", key, err)
+	}
+
+	tx.top()[key] = txWrite{deleted: true}
+	return nil
+}
+
+// lookup returns the last write of key, searching the newest savepoint's
+// writes first
+func (tx *transaction) lookup(key types.Key) (txWrite, bool) {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if write, ok := tx.savepoints[i].writes[key]; ok {
+			return write, true
+		}
+	}
+	write, ok := tx.writes[key]
+	return write, ok
+}
+
+// top returns the writes new writes go to: the newest savepoint's, or the
+// transaction's before its first savepoint
+func (tx *transaction) top() map[types.Key]txWrite {
+	if len(tx.savepoints) == 0 {
+		return tx.writes
+	}
+	return tx.savepoints[len(tx.savepoints)-1].writes
+}
+
+// merged returns the last write of every key written
+func (tx *transaction) merged() map[types.Key]txWrite {
+	if len(tx.savepoints) == 0 {
+		return tx.writes
+	}
+	writes := make(map[types.Key]txWrite, len(tx.writes))
+	for key, write := range tx.writes {
+		writes[key] = write
+	}
+	for _, sp := range tx.savepoints {
+		for key, write := range sp.writes {
+			writes[key] = write
+		}
+	}
+	return writes
+}
+
+// Savepoint marks the transaction's writes so far with name, so
+// RollbackTo(name) can undo only the writes made after it. Savepoints
+// nest; a name used twice refers to the newer savepoint until it is
+// released or rolled back past.
+func (tx *transaction) Savepoint(name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return err
+	}
+
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, writes: make(map[types.Key]txWrite)})
+	return nil
+}
+
+// RollbackTo discards the writes made since the savepoint name and the
+// savepoints made after it. The savepoint itself stays, so the transaction
+// can roll back to it again.
+func (tx *transaction) RollbackTo(name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return err
+	}
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	tx.savepoints[i].writes = make(map[types.Key]txWrite)
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// ReleaseSavepoint forgets the savepoint name and the savepoints made after
+// it, keeping the writes made since
+func (tx *transaction) ReleaseSavepoint(name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return err
+	}
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+
+	below := tx.writes
+	if i > 0 {
+		below = tx.savepoints[i-1].writes
+	}
+	for _, sp := range tx.savepoints[i:] {
+		for key, write := range sp.writes {
+			below[key] = write
+		}
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+// findSavepoint returns the index of the newest savepoint called name
+func (tx *transaction) findSavepoint(name string) (int, error) {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", types.ErrSavepointNotFound, name)
+}
+
+// validate checks a key and value being written against the database's
+// limits
+func (tx *transaction) validate(key types.Key, value types.Value) error {
+	tx.db.mu.RLock()
+	defer tx.db.mu.RUnlock()
+
+	if tx.db.closed {
+		return types.ErrDatabaseClosed
+	}
+	if err := tx.db.validateKey(key); err != nil {
+		return err
+	}
+	return tx.db.validateValue(value)
+}
+
+// validateLookup checks a key being read or deleted
+func (tx *transaction) validateLookup(key types.Key) error {
+	tx.db.mu.RLock()
+	defer tx.db.mu.RUnlock()
+
+	if tx.db.closed {
+		return types.ErrDatabaseClosed
+	}
+	return tx.db.validateLookupKey(key)
+}
+
+// Commit applies the transaction's writes and ends it. Storage implementing
+// types.VersionedStorage applies them all as a single write; otherwise the
+// keys set are applied as one batch, then the keys deleted as another. A
+// transaction started with Begin overwrites writes others committed since,
+// without detecting them; one started with BeginOptimistic fails with
+// ErrConflict instead if they touched keys it read.
+func (tx *transaction) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return err
+	}
+	writes := tx.merged()
+	defer tx.end(types.ErrTransactionDone)
+
+	keys := make([]types.Key, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var sets []types.Entry
+	var deletes []types.Key
+	for _, key := range keys {
+		if write := writes[key]; write.deleted {
+			deletes = append(deletes, key)
+		} else {
+			sets = append(sets, types.Entry{Key: key, Value: write.value})
+		}
+	}
+
+	return tx.db.commit(tx.reads, sets, deletes)
+}
+
+// commit applies the writes of a transaction that read keys at the
+// versions in expected
+func (db *Database) commit(expected map[types.Key]uint64, sets []types.Entry, deletes []types.Key) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	if versioned, ok := db.storage.(types.VersionedStorage); ok {
+		return db.commitIfVersions(versioned, expected, sets, deletes)
+	}
+
+	if len(sets) > 0 {
+		if err := db.batchSet("Commit", sets); err != nil {
+			return err
+		}
+	}
+	if len(deletes) > 0 {
+		unlock := db.events.lock()
+		err := db.storage.BatchDelete(deletes)
+		if err == nil {
+			db.events.batch(nil, deletes)
+		}
+		unlock()
+		if err != nil {
+			return types.NewOpError("Commit", "", err)
+		}
+		for _, key := range deletes {
+			db.accessStats.write(key)
+		}
+	}
+	return nil
+}
+
+// SetIfVersion stores value for key only if the key is still at
+// expectedVersion, the Version GetEntry returned for it, or with
+// expectedVersion 0 only if it doesn't exist. Otherwise it fails with
+// ErrConflict and stores nothing, so a read-modify-write loop can retry
+// from a fresh read. Storage must implement types.VersionedStorage.
+func (db *Database) SetIfVersion(key types.Key, value types.Value, expectedVersion uint64) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return types.NewOpError("SetIfVersion", key, types.ErrDatabaseClosed)
+	}
+
+	if err := db.validateKey(key); err != nil {
+		return types.NewOpError("SetIfVersion", key, err)
+	}
+	if err := db.validateValue(value); err != nil {
+		return types.NewOpError("SetIfVersion", key, err)
+	}
+
+	versioned, ok := db.storage.(types.VersionedStorage)
+	if !ok {
+		return fmt.Errorf("versioned writes not supported for this storage type")
+	}
+	expected := map[types.Key]uint64{key: expectedVersion}
+	err := db.commitIfVersions(versioned, expected, []types.Entry{{Key: key, Value: value}}, nil)
+	return types.NewOpError("SetIfVersion", key, err)
+}
+
+// commitIfVersions applies sets and deletes as one write if the keys in
+// expected are at the versions given, and records the writes; the caller
+// must hold db.mu
+func (db *Database) commitIfVersions(versioned types.VersionedStorage, expected map[types.Key]uint64, sets []types.Entry, deletes []types.Key) error {
+	unlock := db.events.lock()
+	err := versioned.CommitIfVersions(expected, sets, deletes)
+	if err == nil {
+		db.events.batch(sets, deletes)
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+	for _, entry := range sets {
+		db.accessStats.write(entry.Key)
+	}
+	for _, key := range deletes {
+		db.accessStats.write(key)
+	}
+	return nil
+}
+
+// Rollback discards the transaction's writes and ends it
+func (tx *transaction) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err := tx.active(); err != nil {
+		return err
+	}
+	return tx.end(types.ErrTransactionDone)
+}
+
+// transactionSet tracks a database's open transactions so Close can roll
+// them back
+type transactionSet struct {
+	mu      sync.Mutex
+	open    map[*transaction]struct{}
+	closing bool // Set by Close; no transactions begin after it
+}
+
+// add tracks tx, unless the database is closing
+func (s *transactionSet) add(tx *transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return types.ErrDatabaseClosed
+	}
+	if s.open == nil {
+		s.open = make(map[*transaction]struct{})
+	}
+	s.open[tx] = struct{}{}
+	return nil
+}
+
+// remove stops tracking tx once it has ended
+func (s *transactionSet) remove(tx *transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.open, tx)
+}
+
+// abortAll stops transactions from beginning, rolls back the open ones and
+// returns how many it rolled back. It must be called without db.mu held,
+// since a transaction committing holds its own lock while it waits for
+// db.mu.
+func (s *transactionSet) abortAll() int {
+	s.mu.Lock()
+	s.closing = true
+	open := make([]*transaction, 0, len(s.open))
+	for tx := range s.open {
+		open = append(open, tx)
+	}
+	s.mu.Unlock()
+
+	aborted := 0
+	for _, tx := range open {
+		if tx.abort() {
+			aborted++
+		}
+	}
+	return aborted
+}
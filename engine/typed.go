@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"bytes"
+	"database_engine/types"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// typedPageSize is how many values TypedStore.ForEach reads at a time
+const typedPageSize = 256
+
+// Codec turns the values of a TypedStore into the bytes stored for them
+// and back
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes values with encoding/json. It is the default codec of
+// a TypedStore.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes values with encoding/gob. Each value is encoded on its
+// own, so it carries its type description with it.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// ErrDecode is matched by a *DecodeError
+var ErrDecode = errors.New("failed to decode value")
+
+// DecodeError reports a stored value a TypedStore's codec couldn't decode,
+// such as one written by another codec or for another type
+type DecodeError struct {
+	Key types.Key
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode value of %q: %v", e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrDecode) true for a *DecodeError
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// TypedStore reads and writes values of type T in a Database, encoding them
+// with its codec. Errors are those of the Database, apart from values that
+// can't be encoded or decoded.
+type TypedStore[T any] struct {
+	db    *Database
+	codec Codec
+}
+
+// NewTypedStore returns a TypedStore of db's values, which codec encodes.
+// A nil codec means JSONCodec.
+func NewTypedStore[T any](db *Database, codec Codec) *TypedStore[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &TypedStore[T]{db: db, codec: codec}
+}
+
+// Get retrieves and decodes the value stored for key
+func (s *TypedStore[T]) Get(key types.Key) (T, error) {
+	var value T
+	data, err := s.db.Get(key)
+	if err != nil {
+		return value, err
+	}
+	return s.decode(key, data)
+}
+
+// Set encodes and stores value for key
+func (s *TypedStore[T]) Set(key types.Key, value T) error {
+	data, err := s.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return s.db.Set(key, data)
+}
+
+// SetWithTTL encodes and stores value for key with a time-to-live, like
+// Database.SetWithTTL
+func (s *TypedStore[T]) SetWithTTL(key types.Key, value T, ttl time.Duration) error {
+	data, err := s.encode(key, value)
+	if err != nil {
+		return err
+	}
+	return s.db.SetWithTTL(key, data, ttl)
+}
+
+// BatchGet retrieves and decodes the values stored for keys. Keys without a
+// value are left out of the result, as Database.BatchGet leaves them out.
+// A value that can't be decoded fails the whole batch.
+func (s *TypedStore[T]) BatchGet(keys []types.Key) (map[types.Key]T, error) {
+	stored, err := s.db.BatchGet(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[types.Key]T, len(stored))
+	for key, data := range stored {
+		value, err := s.decode(key, data)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// ForEach calls fn with each key starting with prefix and its decoded
+// value, in ascending key order, until fn returns false. Keys deleted or
+// expired while it runs are skipped. A value that can't be decoded stops it
+// with a *DecodeError.
+func (s *TypedStore[T]) ForEach(prefix types.Key, fn func(key types.Key, value T) bool) error {
+	keys, err := s.db.KeysWithPrefix(prefix)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		page := keys[:min(len(keys), typedPageSize)]
+		keys = keys[len(page):]
+
+		stored, err := s.db.BatchGet(page)
+		if err != nil {
+			return err
+		}
+		for _, key := range page {
+			data, ok := stored[key]
+			if !ok {
+				continue
+			}
+			value, err := s.decode(key, data)
+			if err != nil {
+				return err
+			}
+			if !fn(key, value) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// encode encodes the value to be stored for key
+func (s *TypedStore[T]) encode(key types.Key, value T) (types.Value, error) {
+	data, err := s.codec.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode value of %q: %w", key, err)
+	}
+	return data, nil
+}
+
+// decode decodes the value stored for key
+func (s *TypedStore[T]) decode(key types.Key, data types.Value) (T, error) {
+	var value T
+	if err := s.codec.Unmarshal(data, &value); err != nil {
+		var zero T
+		return zero, &DecodeError{Key: key, Err: err}
+	}
+	return value, nil
+}
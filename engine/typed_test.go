@@ -0,0 +1,138 @@
+package engine_test
+
+import (
+	"database_engine/engine"
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type account struct {
+	Owner   string
+	Balance int
+}
+
+func TestTypedStore(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+	accounts := engine.NewTypedStore[account](db, nil)
+
+	require.NoError(t, accounts.Set("acct/1", account{Owner: "ada", Balance: 10}))
+	require.NoError(t, accounts.Set("acct/2", account{Owner: "bob", Balance: 20}))
+	require.NoError(t, accounts.SetWithTTL("acct/3", account{Owner: "cy", Balance: 30}, time.Hour))
+	require.NoError(t, db.Set("other", types.Value("untyped")))
+
+	got, err := accounts.Get("acct/1")
+	require.NoError(t, err)
+	assert.Equal(t, account{Owner: "ada", Balance: 10}, got)
+	raw, err := db.Get("acct/1")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"Owner":"ada","Balance":10}`, string(raw))
+
+	_, err = accounts.Get("missing")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	values, err := accounts.BatchGet([]types.Key{"acct/2", "acct/3", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, map[types.Key]account{
+		"acct/2": {Owner: "bob", Balance: 20},
+		"acct/3": {Owner: "cy", Balance: 30},
+	}, values)
+
+	var keys []types.Key
+	total := 0
+	require.NoError(t, accounts.ForEach("acct/", func(key types.Key, value account) bool {
+		keys = append(keys, key)
+		total += value.Balance
+		return true
+	}))
+	assert.Equal(t, []types.Key{"acct/1", "acct/2", "acct/3"}, keys)
+	assert.Equal(t, 60, total)
+
+	// Returning false stops the iteration
+	keys = nil
+	require.NoError(t, accounts.ForEach("acct/", func(key types.Key, _ account) bool {
+		keys = append(keys, key)
+		return false
+	}))
+	assert.Equal(t, []types.Key{"acct/1"}, keys)
+
+	// A value that isn't an account can't be decoded
+	_, err = accounts.Get("other")
+	var decodeErr *engine.DecodeError
+	require.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, types.Key("other"), decodeErr.Key)
+	assert.ErrorIs(t, accounts.ForEach("", func(types.Key, account) bool { return true }), engine.ErrDecode)
+}
+
+func TestTypedStoreCodecMismatch(t *testing.T) {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	written := engine.NewTypedStore[account](db, engine.GobCodec{})
+	require.NoError(t, written.Set("acct", account{Owner: "ada", Balance: 10}))
+	got, err := written.Get("acct")
+	require.NoError(t, err)
+	assert.Equal(t, account{Owner: "ada", Balance: 10}, got)
+
+	read := engine.NewTypedStore[account](db, engine.JSONCodec{})
+	_, err = read.Get("acct")
+	assert.ErrorIs(t, err, engine.ErrDecode)
+	var decodeErr *engine.DecodeError
+	require.ErrorAs(t, err, &decodeErr)
+	assert.Equal(t, types.Key("acct"), decodeErr.Key)
+	var syntaxErr *json.SyntaxError
+	assert.ErrorAs(t, err, &syntaxErr)
+
+	_, err = read.BatchGet([]types.Key{"acct"})
+	assert.ErrorIs(t, err, engine.ErrDecode)
+}
+
+// temperature is stored as a string such as "21.5C"
+type temperature struct {
+	Celsius float64
+}
+
+func (t temperature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%.1fC", t.Celsius))
+}
+
+func (t *temperature) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(s, "C") {
+		return errors.New("temperature without a unit")
+	}
+	_, err := fmt.Sscanf(strings.TrimSuffix(s, "C"), "%g", &t.Celsius)
+	return err
+}
+
+func ExampleNewTypedStore() {
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+
+	readings := engine.NewTypedStore[temperature](db, nil)
+	readings.Set("kitchen", temperature{Celsius: 21.5})
+	readings.Set("garden", temperature{Celsius: 12})
+
+	raw, _ := db.Get("kitchen")
+	fmt.Println(string(raw))
+
+	readings.ForEach("", func(room types.Key, t temperature) bool {
+		fmt.Println(room, t.Celsius)
+		return true
+	})
+	// Output:
+	// "21.5C"
+	// garden 12
+	// kitchen 21.5
+}
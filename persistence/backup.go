@@ -1,18 +1,30 @@
 package persistence
 
 import (
+	"context"
+	"crypto/sha256"
+	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 // BackupMetadata contains information about a backup
 type BackupMetadata struct {
+	Name        string    `json:"name"` // Directory name, to restore or delete the backup by; empty for a streamed backup
 	Timestamp   time.Time `json:"timestamp"`
 	Version     string    `json:"version"`
 	EntryCount  int64     `json:"entry_count"`
@@ -22,29 +34,99 @@ type BackupMetadata struct {
 	Checksum    string    `json:"checksum"`
 	BackupType  string    `json:"backup_type"` // "full", "incremental"
 	Description string    `json:"description"`
+	WALLSN      uint64    `json:"wal_lsn,omitempty"` // Last WAL entry the data holds, for snapshot backups
+
+	// Reason says why the backup was made and Tags label it, for
+	// FindBackups to match on. Backups made before they were recorded
+	// have neither.
+	Reason string            `json:"reason,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+
+	// Files maps the path of each file in the backup, relative to it and
+	// slash-separated, to the hex SHA-256 digest of its contents. Backups
+	// made before digests were recorded have none. With Sizes, it is the
+	// manifest of the backup, which a restore reproduces.
+	Files map[string]string `json:"files,omitempty"`
+
+	// Sizes maps the same paths to each file's size in bytes. Backups made
+	// before sizes were recorded have none.
+	Sizes map[string]int64 `json:"sizes,omitempty"`
 }
 
+// BackupOptions describe a backup to make
+type BackupOptions struct {
+	Description string
+	Reason      string            // Why the backup is made, e.g. "before the v2 migration"
+	Tags        map[string]string // Labels to find the backup by, e.g. "release": "v2"
+}
+
+// BackupTagKind is the tag naming what made a backup, such as
+// BackupKindRecoveryPoint
+const BackupTagKind = "kind"
+
+// BackupKindRecoveryPoint is the kind of the backups made as recovery
+// points, by CreateRecoveryPoint and before destructive operations
+const BackupKindRecoveryPoint = "recovery-point"
+
+// backupNameLayout is the timestamp in the name of a backup directory. The
+// fraction keeps backups made within the same second apart; backups made
+// before it was added are named down to the second.
+const backupNameLayout = "20060102_150405.000000000"
+
+// blobDirName is the data directory subdirectory where disk storage keeps
+// values spilled to blob files
+const blobDirName = "blobs"
+
 // BackupManager handles backup and restore operations
 type BackupManager struct {
+	fs          vfs.FS
 	dataDir     string
+	walPath     string
 	backupDir   string
 	mu          sync.RWMutex
 	lastBackup  *BackupMetadata
 	backupCount int
+	pruned      int          // Incomplete backups removed when the manager was created
+	log         *slog.Logger // Config.Logger, or a logger discarding everything
 }
 
 // NewBackupManager creates a new backup manager
 func NewBackupManager(dataDir string) (*BackupManager, error) {
-	backupDir := filepath.Join(dataDir, "backups")
+	config := types.DefaultConfig()
+	config.DataDirectory = dataDir
+	return NewBackupManagerWithConfig(config)
+}
+
+// NewBackupManagerWithConfig creates a new backup manager for the data
+// directory, WAL path, backup directory and file permissions in config
+func NewBackupManagerWithConfig(config types.Config) (*BackupManager, error) {
+	return NewBackupManagerWithFS(config, vfs.OS)
+}
+
+// NewBackupManagerWithFS is NewBackupManagerWithConfig with every file
+// accessed through fsys
+func NewBackupManagerWithFS(config types.Config, fsys vfs.FS) (*BackupManager, error) {
+	if err := config.ValidatePermissions(); err != nil {
+		return nil, err
+	}
+	fsys = vfs.WithModes(fsys, config.FilePermissions(), config.DirPermissions())
+	backupDir := config.BackupPath()
 
 	// Create backup directory if it doesn't exist
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
+	if err := fsys.MkdirAll(backupDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create backup directory: %w", err)
 	}
 
 	bm := &BackupManager{
-		dataDir:   dataDir,
+		fs:        fsys,
+		dataDir:   config.DataDirectory,
+		walPath:   config.WALFilePath(),
 		backupDir: backupDir,
+		log:       types.LoggerOrDiscard(config.Logger),
+	}
+
+	if err := bm.pruneIncompleteBackups(); err != nil {
+		return nil, fmt.Errorf("failed to prune incomplete backups: %w", err)
 	}
 
 	// Load existing backup metadata
@@ -57,39 +139,98 @@ func NewBackupManager(dataDir string) (*BackupManager, error) {
 
 // CreateFullBackup creates a complete backup of the database
 func (bm *BackupManager) CreateFullBackup(description string) (*BackupMetadata, error) {
+	return bm.CreateFullBackupContext(context.Background(), description, nil)
+}
+
+// CreateFullBackupContext is CreateFullBackup reporting its progress to
+// progress, if it isn't nil, and giving up once ctx is done. A backup
+// given up on, or failing, leaves no backup directory behind.
+func (bm *BackupManager) CreateFullBackupContext(ctx context.Context, description string, progress ProgressFunc) (*BackupMetadata, error) {
+	return bm.CreateFullBackupWithOptions(ctx, BackupOptions{Description: description}, progress)
+}
+
+// CreateFullBackupWithOptions is CreateFullBackupContext recording the
+// reason and tags in options as well as the description
+func (bm *BackupManager) CreateFullBackupWithOptions(ctx context.Context, options BackupOptions, progress ProgressFunc) (*BackupMetadata, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	t := newTransfer(ctx, progress, bm.liveSize())
+	return bm.createBackup(t, options, 0, bm.copyLiveFiles)
+}
+
+// CreateSnapshotBackup creates a complete backup of an open DiskStorage
+// from a snapshot of it, which stays consistent however the storage is
+// written to while the files are copied. The metadata records the
+// snapshot's WAL LSN.
+func (bm *BackupManager) CreateSnapshotBackup(snapshot *storage.Snapshot, description string) (*BackupMetadata, error) {
+	return bm.CreateSnapshotBackupContext(context.Background(), snapshot, description, nil)
+}
+
+// CreateSnapshotBackupContext is CreateSnapshotBackup reporting its
+// progress to progress, if it isn't nil, and giving up once ctx is done
+func (bm *BackupManager) CreateSnapshotBackupContext(ctx context.Context, snapshot *storage.Snapshot, description string, progress ProgressFunc) (*BackupMetadata, error) {
+	return bm.CreateSnapshotBackupWithOptions(ctx, snapshot, BackupOptions{Description: description}, progress)
+}
+
+// CreateSnapshotBackupWithOptions is CreateSnapshotBackupContext recording
+// the reason and tags in options as well as the description
+func (bm *BackupManager) CreateSnapshotBackupWithOptions(ctx context.Context, snapshot *storage.Snapshot, options BackupOptions, progress ProgressFunc) (*BackupMetadata, error) {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
+	var totalBytes int64
+	for _, file := range snapshot.Files {
+		totalBytes += file.Size
+	}
+
+	t := newTransfer(ctx, progress, totalBytes)
+	return bm.createBackup(t, options, snapshot.LSN, func(t *transfer, backupPath string) (int64, error) {
+		var totalSize int64
+		var blobs bool
+		for _, file := range snapshot.Files {
+			if err := bm.copySnapshotFile(t, file, filepath.Join(backupPath, filepath.FromSlash(file.Name))); err != nil {
+				return 0, fmt.Errorf("failed to copy %s: %w", file.Name, err)
+			}
+			totalSize += file.Size
+			blobs = blobs || strings.HasPrefix(file.Name, blobDirName+"/")
+		}
+		if blobs {
+			return totalSize, bm.syncDirs(filepath.Join(backupPath, blobDirName))
+		}
+		return totalSize, nil
+	})
+}
+
+// createBackup creates a backup directory, fills it with copyFiles, which
+// returns the total size of the files it copied through t, and records the
+// backup's metadata. The caller holds mu.
+func (bm *BackupManager) createBackup(t *transfer, options BackupOptions, walLSN uint64, copyFiles func(t *transfer, backupPath string) (int64, error)) (*BackupMetadata, error) {
 	timestamp := time.Now()
-	backupName := fmt.Sprintf("backup_%s", timestamp.Format("20060102_150405"))
+	backupName := bm.newBackupName(timestamp)
 	backupPath := filepath.Join(bm.backupDir, backupName)
 
 	// Create backup directory
-	if err := os.MkdirAll(backupPath, 0755); err != nil {
+	if err := bm.fs.MkdirAll(backupPath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create backup directory: %w", err)
 	}
 
-	// Copy data files
-	dataFiles := []string{"data.db", "index.db", "wal.log"}
-	var totalSize int64
-	var entryCount int64
-
-	for _, file := range dataFiles {
-		srcPath := filepath.Join(bm.dataDir, file)
-		dstPath := filepath.Join(backupPath, file)
-
-		if err := bm.copyFile(srcPath, dstPath); err != nil {
-			// File might not exist, that's okay
-			continue
+	// Don't leave a partial backup behind if any step fails
+	complete := false
+	defer func() {
+		if !complete {
+			bm.fs.RemoveAll(backupPath)
 		}
+	}()
 
-		// Get file size
-		if stat, err := os.Stat(dstPath); err == nil {
-			totalSize += stat.Size()
-		}
+	// Copy data files
+	totalSize, err := copyFiles(t, backupPath)
+	if err != nil {
+		return nil, err
 	}
 
 	// Count entries from index file
+	var entryCount int64
 	if indexPath := filepath.Join(backupPath, "index.db"); bm.fileExists(indexPath) {
 		if count, err := bm.countEntriesFromIndex(indexPath); err == nil {
 			entryCount = count
@@ -98,6 +239,7 @@ func (bm *BackupManager) CreateFullBackup(description string) (*BackupMetadata,
 
 	// Create metadata
 	metadata := &BackupMetadata{
+		Name:        backupName,
 		Timestamp:   timestamp,
 		Version:     "1.0.0",
 		EntryCount:  entryCount,
@@ -106,33 +248,55 @@ func (bm *BackupManager) CreateFullBackup(description string) (*BackupMetadata,
 		WALSize:     0, // Will be calculated
 		Checksum:    "", // Will be calculated
 		BackupType:  "full",
-		Description: description,
+		Description: options.Description,
+		WALLSN:      walLSN,
+		Reason:      options.Reason,
+		Tags:        options.Tags,
 	}
 
 	// Calculate checksum (excluding metadata.json)
 	metadata.Checksum = bm.calculateChecksum(backupPath)
+	if metadata.Files, err = bm.fileDigests(t.context(), backupPath); err != nil {
+		return nil, fmt.Errorf("failed to checksum backup: %w", err)
+	}
+	if metadata.Sizes, err = bm.fileSizes(backupPath); err != nil {
+		return nil, fmt.Errorf("failed to size backup: %w", err)
+	}
 
 	// Save metadata
 	if err := bm.saveBackupMetadata(backupPath, metadata); err != nil {
 		return nil, fmt.Errorf("failed to save backup metadata: %w", err)
 	}
 
+	// Make the new files and the backup directory itself durable
+	if err := bm.syncDirs(backupPath, bm.backupDir); err != nil {
+		return nil, fmt.Errorf("failed to sync backup directory: %w", err)
+	}
+
+	complete = true
 	bm.lastBackup = metadata
 	bm.backupCount++
+	bm.log.Info("created backup", "backup", backupName, "entries", entryCount, "size", totalSize, "reason", options.Reason)
 
 	return metadata, nil
 }
 
 // RestoreFromBackup restores the database from a backup
 func (bm *BackupManager) RestoreFromBackup(backupName string) error {
+	return bm.RestoreFromBackupContext(context.Background(), backupName, nil)
+}
+
+// RestoreFromBackupContext is RestoreFromBackup reporting the progress of
+// copying the backup's files into place to progress, if it isn't nil, and
+// giving up once ctx is done. A restore given up on puts the live files
+// back as they were.
+func (bm *BackupManager) RestoreFromBackupContext(ctx context.Context, backupName string, progress ProgressFunc) error {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
-	backupPath := filepath.Join(bm.backupDir, backupName)
-
-	// Check if backup exists
-	if !bm.fileExists(backupPath) {
-		return fmt.Errorf("backup %s not found", backupName)
+	backupPath, err := bm.existingBackupPath(backupName)
+	if err != nil {
+		return err
 	}
 
 	// Load backup metadata
@@ -141,71 +305,376 @@ func (bm *BackupManager) RestoreFromBackup(backupName string) error {
 		return fmt.Errorf("failed to load backup metadata: %w", err)
 	}
 
+	return bm.restore(ctx, progress, backupPath, metadata)
+}
+
+// RestoreToDirectory restores a backup into destDir instead of the data
+// directory, for opening it next to the live database, and returns the
+// absolute path of destDir. destDir is created if needed and must not hold
+// anything yet. The backup is verified first, and any WAL entries it holds
+// are checkpointed into its data file, so engine.NewDiskDB opens the
+// restored state directly, with or without a WAL. Every backup is full, so
+// no other backup is needed to complete it. The data directory is never
+// touched.
+func (bm *BackupManager) RestoreToDirectory(backupName, destDir string) (string, error) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	destDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return "", err
+	}
+	if dataDir, err := filepath.Abs(bm.dataDir); err == nil && dataDir == destDir {
+		return "", fmt.Errorf("cannot restore into the data directory %s", destDir)
+	}
+
+	backupPath, err := bm.existingBackupPath(backupName)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := bm.loadBackupMetadataFromPath(backupPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to load backup metadata: %w", err)
+	}
+
+	if err := bm.verifyBackupIntegrity(context.Background(), backupPath, metadata); err != nil {
+		return "", fmt.Errorf("backup integrity check failed: %w", err)
+	}
+
+	if entries, err := bm.fs.ReadDir(destDir); err == nil && len(entries) > 0 {
+		return "", fmt.Errorf("destination %s is not empty", destDir)
+	}
+	if err := bm.fs.MkdirAll(destDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create destination: %w", err)
+	}
+
+	// Don't leave a partial restore behind if any step fails
+	complete := false
+	defer func() {
+		if !complete {
+			bm.fs.RemoveAll(destDir)
+		}
+	}()
+
+	if err := bm.copyBackupFiles(backupPath, destDir); err != nil {
+		return "", err
+	}
+
+	restored, err := bm.openRestored(destDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open restored backup: %w", err)
+	}
+	if err := restored.Close(); err != nil {
+		return "", fmt.Errorf("failed to checkpoint restored backup: %w", err)
+	}
+
+	complete = true
+	return destDir, nil
+}
+
+// copyBackupFiles copies the files of the backup at backupPath into dir
+// under the names a data directory gives them, the WAL and its segments
+// included
+func (bm *BackupManager) copyBackupFiles(backupPath, dir string) error {
+	files, err := bm.manifestFiles(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to list backup files: %w", err)
+	}
+	for _, file := range files {
+		if err := bm.copyFile(nil, filepath.Join(backupPath, file), filepath.Join(dir, file), file); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", file, err)
+		}
+	}
+	if _, err := bm.copyDir(nil, filepath.Join(backupPath, blobDirName), filepath.Join(dir, blobDirName), blobDirName); err != nil {
+		return fmt.Errorf("failed to restore blobs: %w", err)
+	}
+	return bm.syncDirs(dir)
+}
+
+// openRestored opens the backup copied into dir as disk storage, with its
+// WAL if it has one, which replays it as a restore would
+func (bm *BackupManager) openRestored(dir string) (*storage.DiskStorage, error) {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = dir
+	config.WALEnabled = bm.fileExists(config.WALFilePath())
+	return storage.NewDiskStorageWithFS(config, bm.fs)
+}
+
+// restore verifies the backup at backupPath against metadata and replaces
+// the live files with its own, putting them back if that fails or ctx is
+// done first. The copies into place are reported to progress. The caller
+// holds mu.
+func (bm *BackupManager) restore(ctx context.Context, progress ProgressFunc, backupPath string, metadata *BackupMetadata) error {
 	// Verify backup integrity
-	if err := bm.verifyBackupIntegrity(backupPath, metadata); err != nil {
+	if err := bm.verifyBackupIntegrity(ctx, backupPath, metadata); err != nil {
 		return fmt.Errorf("backup integrity check failed: %w", err)
 	}
 
 	// Create temporary directory for current data
 	tempDir := filepath.Join(bm.dataDir, "temp_restore")
-	if err := os.MkdirAll(tempDir, 0755); err != nil {
+	if err := bm.fs.MkdirAll(tempDir, 0755); err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
-	defer os.RemoveAll(tempDir)
+	defer bm.fs.RemoveAll(tempDir)
 
 	// Backup current data
-	if err := bm.backupCurrentData(tempDir); err != nil {
+	if err := bm.backupCurrentData(newTransfer(ctx, nil, 0), tempDir); err != nil {
 		return fmt.Errorf("failed to backup current data: %w", err)
 	}
 
 	// Restore from backup
-	if err := bm.restoreBackupFiles(backupPath); err != nil {
+	t := newTransfer(ctx, progress, bm.backupSize(backupPath))
+	if err := bm.restoreBackupFiles(t, backupPath); err != nil {
 		// Restore current data if restore fails
-		bm.restoreCurrentData(tempDir)
+		if restoreErr := bm.restoreCurrentData(tempDir); restoreErr != nil {
+			bm.log.Error("failed to put live data back after a failed restore", "backup", filepath.Base(backupPath), "error", restoreErr)
+		}
 		return fmt.Errorf("failed to restore backup: %w", err)
 	}
 
+	bm.log.Info("restored backup", "backup", filepath.Base(backupPath), "entries", metadata.EntryCount)
 	return nil
 }
 
-// ListBackups returns a list of available backups
+// BackupFilter selects the backups ListBackupsWithFilter returns. Zero
+// fields don't filter.
+type BackupFilter struct {
+	Since       time.Time // Made at or after
+	Until       time.Time // Made before
+	BackupType  string    // "full", "incremental"
+	Description string    // Contained in the description
+	Limit       int       // Most recent backups returned, 0 for all
+
+	// Tags the backup must have, each with the value given
+	Tags map[string]string
+}
+
+// matches reports whether metadata passes every filter but the limit
+func (f BackupFilter) matches(metadata *BackupMetadata) bool {
+	if !f.Since.IsZero() && metadata.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !metadata.Timestamp.Before(f.Until) {
+		return false
+	}
+	if f.BackupType != "" && metadata.BackupType != f.BackupType {
+		return false
+	}
+	for key, value := range f.Tags {
+		if tag, ok := metadata.Tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return strings.Contains(metadata.Description, f.Description)
+}
+
+// ListBackups returns a list of available backups, most recent first
 func (bm *BackupManager) ListBackups() ([]BackupMetadata, error) {
+	return bm.ListBackupsWithFilter(BackupFilter{})
+}
+
+// FindBackups returns the backups matching filter on their tags,
+// description and time range, most recent first, as ListBackupsWithFilter
+// does. It is the way to find a backup by what it was made for, such as
+// the one tagged "release": "v2" before a migration.
+func (bm *BackupManager) FindBackups(filter BackupFilter) ([]BackupMetadata, error) {
+	return bm.ListBackupsWithFilter(filter)
+}
+
+// ListBackupsWithFilter returns the available backups that pass filter,
+// most recent first. Entries of the backup directory that aren't backups,
+// or whose metadata can't be read, are skipped.
+func (bm *BackupManager) ListBackupsWithFilter(filter BackupFilter) ([]BackupMetadata, error) {
 	bm.mu.RLock()
 	defer bm.mu.RUnlock()
 
+	return bm.listBackups(filter)
+}
+
+// listBackups implements ListBackupsWithFilter. The caller holds mu.
+func (bm *BackupManager) listBackups(filter BackupFilter) ([]BackupMetadata, error) {
 	var backups []BackupMetadata
 
-	entries, err := os.ReadDir(bm.backupDir)
+	entries, err := bm.fs.ReadDir(bm.backupDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read backup directory: %w", err)
 	}
 
 	for _, entry := range entries {
-		if entry.IsDir() && entry.Name()[:7] == "backup_" {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "backup_") {
 			backupPath := filepath.Join(bm.backupDir, entry.Name())
 			metadata, err := bm.loadBackupMetadataFromPath(backupPath)
 			if err != nil {
-				continue // Skip invalid backups
+				bm.log.Error("skipping backup with unreadable metadata", "backup", entry.Name(), "error", err)
+				continue
 			}
-			backups = append(backups, *metadata)
+			if filter.matches(metadata) {
+				backups = append(backups, *metadata)
+			}
+		}
+	}
+
+	// Most recent first, by name where timestamps tie, so the order is stable
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].Timestamp.Equal(backups[j].Timestamp) {
+			return backups[i].Timestamp.After(backups[j].Timestamp)
 		}
+		return backups[i].Name > backups[j].Name
+	})
+	if filter.Limit > 0 && len(backups) > filter.Limit {
+		backups = backups[:filter.Limit]
 	}
 
 	return backups, nil
 }
 
-// DeleteBackup removes a backup
+// DeleteBackup removes a backup. A name that isn't one ListBackups could
+// return fails with ErrInvalidBackupName, so nothing outside the backup
+// directory is removed, and one of a backup that doesn't exist with
+// ErrBackupNotFound.
 func (bm *BackupManager) DeleteBackup(backupName string) error {
 	bm.mu.Lock()
 	defer bm.mu.Unlock()
 
-	backupPath := filepath.Join(bm.backupDir, backupName)
+	backupPath, err := bm.existingBackupPath(backupName)
+	if err != nil {
+		return err
+	}
+
+	if err := bm.fs.RemoveAll(backupPath); err != nil {
+		return err
+	}
+	bm.log.Info("deleted backup", "backup", backupName)
 
+	// The count and the most recent backup are what is left on disk
+	return bm.loadBackupMetadata()
+}
+
+// backupNamePattern matches the names backups are given, which are also
+// the only names ListBackups returns
+var backupNamePattern = regexp.MustCompile(`^backup_[A-Za-z0-9._-]+$`)
+
+// backupPath returns the directory of the backup named backupName. Names
+// come from callers, so anything but a name a backup could have, such as
+// one with a separator or "..", fails with ErrInvalidBackupName rather
+// than being joined into a path outside the backup directory.
+func (bm *BackupManager) backupPath(backupName string) (string, error) {
+	if !backupNamePattern.MatchString(backupName) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidBackupName, backupName)
+	}
+	return filepath.Join(bm.backupDir, backupName), nil
+}
+
+// existingBackupPath is backupPath for a backup that must exist, failing
+// with ErrBackupNotFound if it doesn't
+func (bm *BackupManager) existingBackupPath(backupName string) (string, error) {
+	backupPath, err := bm.backupPath(backupName)
+	if err != nil {
+		return "", err
+	}
 	if !bm.fileExists(backupPath) {
-		return fmt.Errorf("backup %s not found", backupName)
+		return "", fmt.Errorf("%w: %s", ErrBackupNotFound, backupName)
+	}
+	return backupPath, nil
+}
+
+// newBackupName returns a name for a backup made at timestamp that no
+// backup in the backup directory has. The caller holds mu.
+func (bm *BackupManager) newBackupName(timestamp time.Time) string {
+	name := fmt.Sprintf("backup_%s", timestamp.Format(backupNameLayout))
+	for n := 2; bm.fileExists(filepath.Join(bm.backupDir, name)); n++ {
+		name = fmt.Sprintf("backup_%s_%d", timestamp.Format(backupNameLayout), n)
+	}
+	return name
+}
+
+// liveSize returns the total size of the files a backup copies from where
+// the database keeps them
+func (bm *BackupManager) liveSize() int64 {
+	var total int64
+	files, _ := bm.liveFiles()
+	for _, file := range files {
+		if info, err := bm.fs.Stat(bm.livePath(file)); err == nil {
+			total += info.Size()
+		}
 	}
+	vfs.Walk(bm.fs, filepath.Join(bm.dataDir, blobDirName), func(path string, info os.FileInfo) error {
+		total += info.Size()
+		return nil
+	})
+	return total
+}
 
-	return os.RemoveAll(backupPath)
+// backupSize returns the total size of the files of the backup at
+// backupPath but its metadata
+func (bm *BackupManager) backupSize(backupPath string) int64 {
+	var total int64
+	vfs.Walk(bm.fs, backupPath, func(path string, info os.FileInfo) error {
+		if path != filepath.Join(backupPath, "metadata.json") {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// copyLiveFiles copies the database files and blobs from where the
+// database keeps them into backupPath through t and returns their total
+// size
+func (bm *BackupManager) copyLiveFiles(t *transfer, backupPath string) (int64, error) {
+	files, err := bm.liveFiles()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files to back up: %w", err)
+	}
+
+	var totalSize int64
+	for _, file := range files {
+		srcPath := bm.livePath(file)
+		dstPath := filepath.Join(backupPath, file)
+
+		if err := bm.copyFile(t, srcPath, dstPath, file); err != nil {
+			return 0, fmt.Errorf("failed to copy %s: %w", file, err)
+		}
+
+		// Get file size
+		if stat, err := bm.fs.Stat(dstPath); err == nil {
+			totalSize += stat.Size()
+		}
+	}
+
+	// Copy values spilled to blob files
+	blobSize, err := bm.copyDir(t, filepath.Join(bm.dataDir, blobDirName), filepath.Join(backupPath, blobDirName), blobDirName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy blobs: %w", err)
+	}
+	return totalSize + blobSize, nil
+}
+
+// copySnapshotFile copies a snapshot file to dst through t and fsyncs the
+// copy
+func (bm *BackupManager) copySnapshotFile(t *transfer, file storage.SnapshotFile, dst string) error {
+	if err := bm.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	destFile, err := vfs.Create(bm.fs, dst)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if err := t.copy(destFile, io.LimitReader(src, file.Size), file.Name, file.Size); err != nil {
+		return err
+	}
+	return destFile.Sync()
 }
 
 // GetBackupInfo returns information about a specific backup
@@ -213,36 +682,123 @@ func (bm *BackupManager) GetBackupInfo(backupName string) (*BackupMetadata, erro
 	bm.mu.RLock()
 	defer bm.mu.RUnlock()
 
-	backupPath := filepath.Join(bm.backupDir, backupName)
+	backupPath, err := bm.existingBackupPath(backupName)
+	if err != nil {
+		return nil, err
+	}
 	return bm.loadBackupMetadataFromPath(backupPath)
 }
 
 // Helper methods
 
-func (bm *BackupManager) copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+// backupFiles are the data files a backup holds, by their name inside the
+// backup. liveFiles adds the WAL segments and recovery metadata. Restoring
+// a backup without a hint file removes the live one, which describes the
+// data file being replaced.
+var backupFiles = []string{"data.db", "index.db", "index.hint", types.WALFileName}
+
+// livePath returns where the database keeps the backup file named file:
+// the WAL, its segments and its checkpoint marker where Config.WALPath
+// puts them, anything else in the data directory
+func (bm *BackupManager) livePath(file string) string {
+	if file == types.WALFileName {
+		return bm.walPath
+	}
+	if file == walCheckpointName {
+		return wal.CheckpointPath(bm.walPath)
+	}
+	if n, ok := wal.SegmentNumber(types.WALFileName, file); ok {
+		return wal.SegmentPath(bm.walPath, n)
+	}
+	return filepath.Join(bm.dataDir, file)
+}
+
+// copyFile copies src, the file name in a backup, to dst through t and
+// fsyncs the copy
+func (bm *BackupManager) copyFile(t *transfer, src, dst, name string) error {
+	sourceFile, err := vfs.Open(bm.fs, src)
 	if err != nil {
 		return err
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(dst)
+	var size int64
+	if info, err := sourceFile.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	destFile, err := vfs.Create(bm.fs, dst)
 	if err != nil {
 		return err
 	}
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
+	if err := t.copy(destFile, sourceFile, name, size); err != nil {
+		return err
+	}
+	return destFile.Sync()
+}
+
+// copyDir copies the regular files of src, the directory name in a backup,
+// into dst through t and returns the number of bytes copied. A missing src
+// is not an error.
+func (bm *BackupManager) copyDir(t *transfer, src, dst, name string) (int64, error) {
+	entries, err := bm.fs.ReadDir(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if err := bm.fs.MkdirAll(dst, 0755); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := bm.copyFile(t, filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), path.Join(name, entry.Name())); err != nil {
+			return total, err
+		}
+		if info, err := entry.Info(); err == nil {
+			total += info.Size()
+		}
+	}
+
+	return total, bm.syncDirs(dst)
+}
+
+// syncDirs fsyncs each of dirs, so the files created in them survive a
+// power failure
+func (bm *BackupManager) syncDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := vfs.SyncDir(bm.fs, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceDir replaces dst with a copy of src, the directory name in a
+// backup, made through t, or removes it when src doesn't exist
+func (bm *BackupManager) replaceDir(t *transfer, src, dst, name string) error {
+	if err := bm.fs.RemoveAll(dst); err != nil {
+		return err
+	}
+	_, err := bm.copyDir(t, src, dst, name)
 	return err
 }
 
 func (bm *BackupManager) fileExists(path string) bool {
-	_, err := os.Stat(path)
+	_, err := bm.fs.Stat(path)
 	return !os.IsNotExist(err)
 }
 
 func (bm *BackupManager) countEntriesFromIndex(indexPath string) (int64, error) {
-	file, err := os.Open(indexPath)
+	file, err := vfs.Open(bm.fs, indexPath)
 	if err != nil {
 		return 0, err
 	}
@@ -260,24 +816,60 @@ func (bm *BackupManager) countEntriesFromIndex(indexPath string) (int64, error)
 func (bm *BackupManager) calculateChecksum(backupPath string) string {
 	// Simple checksum calculation - in production, use crypto/sha256
 	var checksum int64
-	
-	filepath.Walk(backupPath, func(path string, info os.FileInfo, err error) error {
+
+	vfs.Walk(bm.fs, backupPath, func(path string, info os.FileInfo) error {
+		if filepath.Base(path) != "metadata.json" {
+			checksum += info.Size()
+		}
+		return nil
+	})
+
+	return fmt.Sprintf("%x", checksum)
+}
+
+// fileDigests returns the SHA-256 digest of every file in the backup at
+// backupPath except its metadata, keyed by the file's path within it
+func (bm *BackupManager) fileDigests(ctx context.Context, backupPath string) (map[string]string, error) {
+	digests := make(map[string]string)
+	err := vfs.Walk(bm.fs, backupPath, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(backupPath, path)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && filepath.Base(path) != "metadata.json" {
-			checksum += info.Size()
+		if rel == "metadata.json" {
+			return nil
 		}
+
+		digest, err := bm.fileDigest(ctx, path)
+		if err != nil {
+			return err
+		}
+		digests[filepath.ToSlash(rel)] = digest
 		return nil
 	})
+	return digests, err
+}
 
-	return fmt.Sprintf("%x", checksum)
+// fileDigest returns the hex SHA-256 digest of the file at path, giving up
+// once ctx is done
+func (bm *BackupManager) fileDigest(ctx context.Context, path string) (string, error) {
+	file, err := vfs.Open(bm.fs, path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if err := copyChunks(ctx, hash, file, func(int64) {}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func (bm *BackupManager) saveBackupMetadata(backupPath string, metadata *BackupMetadata) error {
 	metadataPath := filepath.Join(backupPath, "metadata.json")
 
-	file, err := os.Create(metadataPath)
+	file, err := vfs.Create(bm.fs, metadataPath)
 	if err != nil {
 		return err
 	}
@@ -288,24 +880,20 @@ func (bm *BackupManager) saveBackupMetadata(backupPath string, metadata *BackupM
 	return encoder.Encode(metadata)
 }
 
+// loadBackupMetadata sets the backup count and the most recent backup from
+// the backups in the backup directory. The caller holds mu, or is the
+// constructor.
 func (bm *BackupManager) loadBackupMetadata() error {
-	// Load the most recent backup metadata
-	backups, err := bm.ListBackups()
+	backups, err := bm.listBackups(BackupFilter{})
 	if err != nil {
 		return err
 	}
 
+	bm.lastBackup = nil
 	if len(backups) > 0 {
-		// Find the most recent backup
-		var latest *BackupMetadata
-		for i := range backups {
-			if latest == nil || backups[i].Timestamp.After(latest.Timestamp) {
-				latest = &backups[i]
-			}
-		}
-		bm.lastBackup = latest
-		bm.backupCount = len(backups)
+		bm.lastBackup = &backups[0] // Most recent first
 	}
+	bm.backupCount = len(backups)
 
 	return nil
 }
@@ -313,7 +901,7 @@ func (bm *BackupManager) loadBackupMetadata() error {
 func (bm *BackupManager) loadBackupMetadataFromPath(backupPath string) (*BackupMetadata, error) {
 	metadataPath := filepath.Join(backupPath, "metadata.json")
 
-	file, err := os.Open(metadataPath)
+	file, err := vfs.Open(bm.fs, metadataPath)
 	if err != nil {
 		return nil, err
 	}
@@ -325,79 +913,158 @@ func (bm *BackupManager) loadBackupMetadataFromPath(backupPath string) (*BackupM
 		return nil, err
 	}
 
+	// The directory names the backup, including one made before the name
+	// was recorded
+	metadata.Name = filepath.Base(backupPath)
+
 	return &metadata, nil
 }
 
-func (bm *BackupManager) verifyBackupIntegrity(backupPath string, metadata *BackupMetadata) error {
-	// Verify checksum
-	calculatedChecksum := bm.calculateChecksum(backupPath)
-	if calculatedChecksum != metadata.Checksum {
-		return fmt.Errorf("checksum mismatch: expected %s, got %s", metadata.Checksum, calculatedChecksum)
+// verifyBackupIntegrity checks the files of the backup at backupPath
+// against metadata: each one's digest, or for a legacy backup without
+// digests, only their total size. The first file that doesn't match fails
+// it with a *BackupCorruptError. It gives up once ctx is done.
+func (bm *BackupManager) verifyBackupIntegrity(ctx context.Context, backupPath string, metadata *BackupMetadata) error {
+	discrepancies, err := bm.checkBackupFiles(ctx, backupPath, metadata)
+	if err != nil {
+		return err
+	}
+	if len(discrepancies) > 0 {
+		return discrepancies[0]
+	}
+	return nil
+}
+
+// checkBackupFiles is verifyBackupIntegrity describing every file that
+// doesn't match metadata instead of stopping at the first
+func (bm *BackupManager) checkBackupFiles(ctx context.Context, backupPath string, metadata *BackupMetadata) ([]*BackupCorruptError, error) {
+	var discrepancies []*BackupCorruptError
+	if metadata.Files != nil {
+		digests, err := bm.fileDigests(ctx, backupPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to checksum backup: %w", err)
+		}
+		for _, name := range sortedNames(metadata.Files) {
+			expected := metadata.Files[name]
+			digest, ok := digests[name]
+			if !ok {
+				discrepancies = append(discrepancies, &BackupCorruptError{File: name, Expected: expected})
+			} else if digest != expected {
+				discrepancies = append(discrepancies, &BackupCorruptError{File: name, Expected: expected, Got: digest})
+			}
+		}
+		for _, name := range sortedNames(digests) {
+			if _, ok := metadata.Files[name]; !ok {
+				discrepancies = append(discrepancies, &BackupCorruptError{File: name, Got: digests[name]})
+			}
+		}
+	} else {
+		bm.log.Warn("backup has no file digests, only its size is checked", "backup", filepath.Base(backupPath))
+
+		// Verify checksum
+		calculatedChecksum := bm.calculateChecksum(backupPath)
+		if calculatedChecksum != metadata.Checksum {
+			discrepancies = append(discrepancies, &BackupCorruptError{Expected: metadata.Checksum, Got: calculatedChecksum})
+		}
 	}
 
 	// Verify required files exist
 	requiredFiles := []string{"metadata.json"}
 	for _, file := range requiredFiles {
 		if !bm.fileExists(filepath.Join(backupPath, file)) {
-			return fmt.Errorf("required file %s not found in backup", file)
+			discrepancies = append(discrepancies, &BackupCorruptError{File: file})
 		}
 	}
 
-	return nil
+	return discrepancies, nil
 }
 
-func (bm *BackupManager) backupCurrentData(tempDir string) error {
-	files := []string{"data.db", "index.db", "wal.log"}
+// sortedNames returns the keys of files in order
+func sortedNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
+// backupCurrentData copies the live files a restore replaces into tempDir
+// through t, under their names in a backup
+func (bm *BackupManager) backupCurrentData(t *transfer, tempDir string) error {
+	files, err := bm.liveFiles()
+	if err != nil {
+		return err
+	}
 	for _, file := range files {
-		srcPath := filepath.Join(bm.dataDir, file)
-		dstPath := filepath.Join(tempDir, file)
-
-		if bm.fileExists(srcPath) {
-			if err := bm.copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
+		if err := bm.copyFile(t, bm.livePath(file), filepath.Join(tempDir, file), file); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	_, err = bm.copyDir(t, filepath.Join(bm.dataDir, blobDirName), filepath.Join(tempDir, blobDirName), blobDirName)
+	return err
 }
 
-func (bm *BackupManager) restoreBackupFiles(backupPath string) error {
-	files := []string{"data.db", "index.db", "wal.log"}
+// restoreBackupFiles replaces the live files with those of the backup at
+// backupPath through t
+func (bm *BackupManager) restoreBackupFiles(t *transfer, backupPath string) error {
+	return bm.restoreFiles(t, backupPath)
+}
 
-	for _, file := range files {
-		srcPath := filepath.Join(backupPath, file)
-		dstPath := filepath.Join(bm.dataDir, file)
+// restoreCurrentData puts back the live files backupCurrentData copied
+// into tempDir
+func (bm *BackupManager) restoreCurrentData(tempDir string) error {
+	return bm.restoreFiles(nil, tempDir)
+}
 
-		if bm.fileExists(srcPath) {
-			if err := bm.copyFile(srcPath, dstPath); err != nil {
-				return err
-			}
-		} else {
-			// Remove file if it doesn't exist in backup
-			os.Remove(dstPath)
-		}
-	}
+// GetBackupDirSize returns the total size of every file in the backup directory
+func (bm *BackupManager) GetBackupDirSize() (int64, error) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
 
-	return nil
+	var total int64
+	err := vfs.Walk(bm.fs, bm.backupDir, func(path string, info os.FileInfo) error {
+		total += info.Size()
+		return nil
+	})
+
+	return total, err
 }
 
-func (bm *BackupManager) restoreCurrentData(tempDir string) error {
-	files := []string{"data.db", "index.db", "wal.log"}
+// GetBackupsTotalSize returns the total size of every backup in the backup
+// directory, metadata included. Unlike GetBackupDirSize it leaves out
+// whatever else the directory holds.
+func (bm *BackupManager) GetBackupsTotalSize() (int64, error) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
 
-	for _, file := range files {
-		srcPath := filepath.Join(tempDir, file)
-		dstPath := filepath.Join(bm.dataDir, file)
+	entries, err := bm.fs.ReadDir(bm.backupDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read backup directory: %w", err)
+	}
 
-		if bm.fileExists(srcPath) {
-			if err := bm.copyFile(srcPath, dstPath); err != nil {
-				return err
+	var total int64
+	for _, entry := range entries {
+		if !backupNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		if !entry.IsDir() {
+			// An archive of a backup, such as one written by WriteBackup
+			if info, err := entry.Info(); err == nil {
+				total += info.Size()
 			}
+			continue
+		}
+		err := vfs.Walk(bm.fs, filepath.Join(bm.backupDir, entry.Name()), func(path string, info os.FileInfo) error {
+			total += info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to size backup %s: %w", entry.Name(), err)
 		}
 	}
-
-	return nil
+	return total, nil
 }
 
 // GetLastBackup returns the most recent backup metadata
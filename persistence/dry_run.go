@@ -0,0 +1,78 @@
+package persistence
+
+import (
+	"database_engine/wal"
+	"os"
+	"time"
+)
+
+// PerformRecoveryDryRun reports what PerformRecovery would do without
+// doing it: the phases it would run, how many WAL entries it would replay
+// and skip, and which backup it would restore and how old that is. Issues
+// lists the problems found now, before any recovery. Nothing is written:
+// the WAL is read without being opened, so a damaged tail isn't
+// truncated, and neither the data files, the backups nor the recovery
+// state are touched.
+//
+// The plan assumes each phase that can read its input succeeds. A replay
+// that fails while applying the entries, or a restore that fails partway,
+// makes PerformRecovery fall back where the dry run didn't.
+func (rm *RecoveryManager) PerformRecoveryDryRun() (*RecoveryReport, error) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	report := &RecoveryReport{DryRun: true, Started: time.Now()}
+
+	report.Phases = append(report.Phases, PhaseIntegrityCheck)
+	if err := rm.checkDataIntegrity(); err != nil {
+		if !rm.planWALRecovery(report) && !rm.planBackupRecovery(report) {
+			report.DataIntegrity = true // An empty directory needs no recovery
+		}
+	} else {
+		report.DataIntegrity = true
+		rm.planWALRecovery(report)
+	}
+
+	report.Issues = rm.validateDataIntegrity()
+	report.Duration = time.Since(report.Started)
+	return report, nil
+}
+
+// planWALRecovery adds what tryWALRecovery would replay and skip to report
+// and reports whether the WAL could be read
+func (rm *RecoveryManager) planWALRecovery(report *RecoveryReport) bool {
+	if _, err := os.Stat(rm.walPath); os.IsNotExist(err) {
+		return false
+	}
+
+	report.Phases = append(report.Phases, PhaseWALReplay)
+	entries, skipped, err := wal.PendingEntries(rm.walPath, wal.Options{
+		MaxSize:      rm.config.MaxWALSize,
+		SkipCorrupt:  rm.config.WALSkipCorrupt,
+		MaxKeySize:   rm.config.MaxKeySize,
+		MaxValueSize: rm.config.MaxValueSize,
+	})
+	report.WALSkipped = skipped
+	if err != nil {
+		return false
+	}
+
+	report.WALRecovery = true
+	report.WALReplayed = len(entries)
+	return true
+}
+
+// planBackupRecovery adds the backup tryBackupRecovery would restore to
+// report and reports whether there is one
+func (rm *RecoveryManager) planBackupRecovery(report *RecoveryReport) bool {
+	backups, err := rm.backupManager.ListBackupsWithFilter(BackupFilter{Limit: 1})
+	if err != nil || len(backups) == 0 {
+		return false
+	}
+
+	report.Phases = append(report.Phases, PhaseBackupRestore)
+	report.BackupRecovery = true
+	report.Backup = backups[0].Name
+	report.BackupAge = report.Started.Sub(backups[0].Timestamp)
+	return true
+}
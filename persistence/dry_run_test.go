@@ -0,0 +1,142 @@
+package persistence_test
+
+import (
+	"bytes"
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/wal"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readTree returns the contents of every file under dir by relative path
+func readTree(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files[rel] = data
+		return err
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestPerformRecoveryDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, config types.Config, rm *persistence.RecoveryManager)
+		phases   []persistence.RecoveryPhase
+		replayed int
+		skipped  int
+	}{
+		{
+			name: "wal replay",
+			setup: func(t *testing.T, config types.Config, rm *persistence.RecoveryManager) {
+				diskStorage, err := storage.NewDiskStorage(config.DataDirectory)
+				require.NoError(t, err)
+				require.NoError(t, diskStorage.Set("stored", []byte("data")))
+				require.NoError(t, diskStorage.Close())
+
+				w, err := wal.NewWAL(config.WALFilePath(), 1024*1024)
+				require.NoError(t, err)
+				for _, key := range []types.Key{"a", "b", "c"} {
+					_, err = w.LogSet(key, []byte("value"), nil)
+					require.NoError(t, err)
+				}
+				require.NoError(t, w.Close())
+
+				// Damage the middle entry and tear the tail, which opening
+				// the WAL would truncate
+				data, err := os.ReadFile(config.WALFilePath())
+				require.NoError(t, err)
+				at := bytes.Index(data, []byte(`"key":"b"`))
+				require.Positive(t, at)
+				data[at+7] = 'x'
+				data = append(data, 0x01, 0x02, 0x03)
+				require.NoError(t, os.WriteFile(config.WALFilePath(), data, 0644))
+				require.NoError(t, os.Remove(filepath.Join(config.DataDirectory, "index.db")))
+			},
+			phases:   []persistence.RecoveryPhase{persistence.PhaseIntegrityCheck, persistence.PhaseWALReplay},
+			replayed: 2,
+			skipped:  1,
+		},
+		{
+			name: "backup restore",
+			setup: func(t *testing.T, config types.Config, rm *persistence.RecoveryManager) {
+				diskStorage, err := storage.NewDiskStorage(config.DataDirectory)
+				require.NoError(t, err)
+				require.NoError(t, diskStorage.Set("backed_up", []byte("data")))
+				require.NoError(t, diskStorage.Close())
+				_, err = rm.CreateRecoveryPoint("before damage")
+				require.NoError(t, err)
+				tick()
+
+				require.NoError(t, os.Remove(filepath.Join(config.DataDirectory, "index.db")))
+				require.NoError(t, os.WriteFile(config.WALFilePath(), []byte("KVWL\x63\x00\x00\x00"), 0644))
+			},
+			phases: []persistence.RecoveryPhase{
+				persistence.PhaseIntegrityCheck,
+				persistence.PhaseWALReplay,
+				persistence.PhaseBackupRestore,
+			},
+		},
+		{
+			name:   "empty directory",
+			setup:  func(t *testing.T, config types.Config, rm *persistence.RecoveryManager) {},
+			phases: []persistence.RecoveryPhase{persistence.PhaseIntegrityCheck},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.DataDirectory = t.TempDir()
+			config.WALSkipCorrupt = true
+			rm, err := persistence.NewRecoveryManagerWithConfig(config)
+			require.NoError(t, err)
+			tt.setup(t, config, rm)
+
+			before := readTree(t, config.DataDirectory)
+			plan, err := rm.PerformRecoveryDryRun()
+			require.NoError(t, err)
+			assert.True(t, plan.DryRun)
+			assert.Equal(t, tt.phases, plan.Phases)
+			assert.Equal(t, tt.replayed, plan.WALReplayed)
+			assert.Equal(t, tt.skipped, plan.WALSkipped)
+
+			// Nothing on disk changed, and the recovery state wasn't saved
+			assert.Equal(t, before, readTree(t, config.DataDirectory))
+			assert.Zero(t, rm.GetRecoveryState().RecoveryCount)
+
+			report, err := rm.PerformRecovery()
+			require.NoError(t, err)
+			assert.False(t, report.DryRun)
+			assert.Equal(t, plan.Phases, report.Phases)
+			assert.Equal(t, plan.DataIntegrity, report.DataIntegrity)
+			assert.Equal(t, plan.WALRecovery, report.WALRecovery)
+			assert.Equal(t, plan.WALReplayed, report.WALReplayed)
+			assert.Equal(t, plan.WALSkipped, report.WALSkipped)
+			assert.Equal(t, plan.BackupRecovery, report.BackupRecovery)
+			assert.Equal(t, plan.Backup, report.Backup)
+			assert.LessOrEqual(t, plan.BackupAge, report.BackupAge)
+			if plan.BackupRecovery {
+				assert.Positive(t, plan.BackupAge)
+			}
+		})
+	}
+}
@@ -0,0 +1,387 @@
+package persistence
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrBackupKey is returned when an encrypted backup stream is restored
+// with a key or passphrase other than the one it was written with
+var ErrBackupKey = errors.New("wrong backup key")
+
+// ErrBackupEncrypted is returned when an encrypted backup stream is
+// restored without a key
+var ErrBackupEncrypted = errors.New("backup stream is encrypted")
+
+// BackupEncryption is the key WriteEncryptedBackup encrypts a backup stream
+// with and RestoreEncryptedBackup decrypts it with
+type BackupEncryption struct {
+	Key        []byte // AES key of 16, 24 or 32 bytes, used as is
+	Passphrase string // Derived into a 32 byte key with scrypt if Key is empty
+}
+
+// encryptedStreamMagic starts an encrypted backup stream, ahead of its
+// header
+const encryptedStreamMagic = "DBEBACKUP1\n"
+
+// encryptedChunkSize is how much of the archive each sealed chunk of an
+// encrypted stream holds
+const encryptedChunkSize = 64 << 10
+
+// The scrypt cost passphrases are derived with, as recommended for
+// interactive use in 2017
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// maxEncryptionHeaderSize bounds the header read back, so a damaged length
+// doesn't allocate without limit
+const maxEncryptionHeaderSize = 64 << 10
+
+// encryptionHeader is the clear part of an encrypted stream: how to derive
+// the key and the nonce the chunks' nonces are made from. Nothing about the
+// backup itself is in it.
+type encryptionHeader struct {
+	Cipher    string `json:"cipher"`
+	KDF       string `json:"kdf"` // "scrypt" for a passphrase, "none" for a key
+	Salt      []byte `json:"salt,omitempty"`
+	N         int    `json:"n,omitempty"`
+	R         int    `json:"r,omitempty"`
+	P         int    `json:"p,omitempty"`
+	Nonce     []byte `json:"nonce"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+// WriteEncryptedBackup is WriteBackup with the stream encrypted with
+// AES-GCM under enc, for backups leaving the machine whether or not the
+// data directory is encrypted. The stream is a clear header holding only
+// the key derivation parameters and nonce, followed by the archive sealed
+// in chunks; RestoreEncryptedBackup reads it back with the same key.
+func (bm *BackupManager) WriteEncryptedBackup(w io.Writer, description string, enc BackupEncryption) (*BackupMetadata, error) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	ew, err := newEncryptedWriter(w, enc)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := bm.writeBackup(ew, description)
+	if err != nil {
+		return nil, err
+	}
+	if err := ew.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish encrypted backup stream: %w", err)
+	}
+	return metadata, nil
+}
+
+// RestoreEncryptedBackup restores the database from a backup stream
+// written by WriteEncryptedBackup, like RestoreBackup. It fails with
+// ErrBackupKey if enc isn't the key the stream was written with, and the
+// live data is only replaced once the whole stream has been authenticated.
+func (bm *BackupManager) RestoreEncryptedBackup(r io.Reader, enc BackupEncryption) (*BackupMetadata, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	dr, err := newEncryptedReader(r, enc)
+	if err != nil {
+		return nil, err
+	}
+	return bm.restoreStream(dr, dr.finish)
+}
+
+// newBackupCipher derives the key for header from enc and returns the
+// AES-GCM cipher using it
+func newBackupCipher(header *encryptionHeader, enc BackupEncryption) (cipher.AEAD, error) {
+	key := enc.Key
+	switch header.KDF {
+	case "none":
+		if len(key) == 0 {
+			return nil, fmt.Errorf("%w: the stream is encrypted with a key, not a passphrase", ErrBackupKey)
+		}
+	case "scrypt":
+		if enc.Passphrase == "" || len(enc.Key) > 0 {
+			return nil, fmt.Errorf("%w: the stream is encrypted with a passphrase", ErrBackupKey)
+		}
+		derived, err := scrypt.Key([]byte(enc.Passphrase), header.Salt, header.N, header.R, header.P, scryptKeyLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive backup key: %w", err)
+		}
+		key = derived
+	default:
+		return nil, fmt.Errorf("unsupported backup key derivation %q", header.KDF)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk numbered n: the stream's nonce
+// with n xored into its last 8 bytes. Chunk 0 seals the key check.
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := append([]byte(nil), base...)
+	tail := nonce[len(nonce)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^n)
+	return nonce
+}
+
+// chunkAD is the additional data a chunk is sealed with, which marks the
+// last one so a truncated stream doesn't authenticate
+func chunkAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptedWriter seals what is written to it in chunks of
+// encryptedChunkSize, each written as its length and the sealed bytes.
+// Close seals the rest as the last chunk.
+type encryptedWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	chunk  uint64
+	buffer []byte
+}
+
+func newEncryptedWriter(w io.Writer, enc BackupEncryption) (*encryptedWriter, error) {
+	header := &encryptionHeader{Cipher: "AES-GCM", KDF: "none", ChunkSize: encryptedChunkSize}
+	if len(enc.Key) == 0 {
+		if enc.Passphrase == "" {
+			return nil, fmt.Errorf("backup encryption needs a key or passphrase")
+		}
+		header.KDF, header.N, header.R, header.P = "scrypt", scryptN, scryptR, scryptP
+		header.Salt = make([]byte, 16)
+		if _, err := rand.Read(header.Salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+	}
+
+	aead, err := newBackupCipher(header, enc)
+	if err != nil {
+		return nil, err
+	}
+	header.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(header.Nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal encryption header: %w", err)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := io.WriteString(w, encryptedStreamMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(length[:], data...)); err != nil {
+		return nil, err
+	}
+
+	// The key check authenticates the header itself, so a wrong key is told
+	// apart from damaged data before any of the archive is read
+	ew := &encryptedWriter{w: w, aead: aead, nonce: header.Nonce, buffer: make([]byte, 0, encryptedChunkSize)}
+	if err := ew.writeChunk(aead.Seal(nil, chunkNonce(ew.nonce, 0), nil, data)); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (ew *encryptedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(ew.buffer[len(ew.buffer):cap(ew.buffer)], p)
+		ew.buffer = ew.buffer[:len(ew.buffer)+n]
+		p = p[n:]
+		written += n
+
+		if len(ew.buffer) == cap(ew.buffer) {
+			if err := ew.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close seals what is buffered as the last chunk. It doesn't close the
+// underlying writer.
+func (ew *encryptedWriter) Close() error {
+	return ew.seal(true)
+}
+
+func (ew *encryptedWriter) seal(last bool) error {
+	ew.chunk++
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.nonce, ew.chunk), ew.buffer, chunkAD(last))
+	ew.buffer = ew.buffer[:0]
+	return ew.writeChunk(sealed)
+}
+
+func (ew *encryptedWriter) writeChunk(sealed []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := ew.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// encryptedReader opens the chunks of an encrypted stream as they are
+// read
+type encryptedReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	nonce     []byte
+	chunkSize int
+	chunk     uint64
+	plain     []byte
+	done      bool
+}
+
+func newEncryptedReader(r io.Reader, enc BackupEncryption) (*encryptedReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(encryptedStreamMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != encryptedStreamMagic {
+		return nil, fmt.Errorf("backup stream is not encrypted")
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(br, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxEncryptionHeaderSize {
+		return nil, fmt.Errorf("encryption header of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	header := &encryptionHeader{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, fmt.Errorf("failed to decode encryption header: %w", err)
+	}
+	if err := header.validate(); err != nil {
+		return nil, err
+	}
+
+	aead, err := newBackupCipher(header, enc)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encryption header: nonce of %d bytes", len(header.Nonce))
+	}
+
+	er := &encryptedReader{r: br, aead: aead, nonce: header.Nonce, chunkSize: header.ChunkSize}
+	check, err := er.readChunk()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key check: %w", err)
+	}
+	if _, err := aead.Open(nil, chunkNonce(er.nonce, 0), check, data); err != nil {
+		return nil, ErrBackupKey
+	}
+	return er, nil
+}
+
+// validate bounds what a header asks of the reader, which reads it before
+// anything has been authenticated
+func (h *encryptionHeader) validate() error {
+	if h.Cipher != "AES-GCM" {
+		return fmt.Errorf("unsupported backup cipher %q", h.Cipher)
+	}
+	if h.ChunkSize <= 0 || h.ChunkSize > 16<<20 {
+		return fmt.Errorf("invalid encryption header: chunk size %d", h.ChunkSize)
+	}
+	if h.KDF == "scrypt" && (h.N > 1<<20 || h.R > 32 || h.P > 16) {
+		return fmt.Errorf("invalid encryption header: scrypt cost N=%d r=%d p=%d", h.N, h.R, h.P)
+	}
+	return nil
+}
+
+func (er *encryptedReader) Read(p []byte) (int, error) {
+	for len(er.plain) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.plain)
+	er.plain = er.plain[n:]
+	return n, nil
+}
+
+// open reads and opens the next chunk
+func (er *encryptedReader) open() error {
+	sealed, err := er.readChunk()
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("encrypted backup stream is truncated")
+	}
+	if err != nil {
+		return err
+	}
+
+	er.chunk++
+	nonce := chunkNonce(er.nonce, er.chunk)
+	if er.plain, err = er.aead.Open(er.plain[:0], nonce, sealed, chunkAD(false)); err == nil {
+		return nil
+	}
+	if er.plain, err = er.aead.Open(er.plain[:0], nonce, sealed, chunkAD(true)); err != nil {
+		return fmt.Errorf("encrypted backup stream is damaged at chunk %d", er.chunk)
+	}
+	er.done = true
+	return nil
+}
+
+func (er *encryptedReader) readChunk() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(er.r, length[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(length[:]))
+	if size > er.chunkSize+er.aead.Overhead() {
+		return nil, fmt.Errorf("encrypted backup chunk of %d bytes is too large", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(er.r, sealed); err != nil {
+		return nil, io.EOF
+	}
+	return sealed, nil
+}
+
+// finish reads the rest of the stream, which the archive ends before, so
+// its last chunk is authenticated before anything is restored
+func (er *encryptedReader) finish() error {
+	_, err := io.Copy(io.Discard, er)
+	return err
+}
+
+// isEncryptedStream reports whether r, which it doesn't consume, starts
+// like an encrypted backup stream
+func isEncryptedStream(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(encryptedStreamMagic))
+	return string(magic) == encryptedStreamMagic
+}
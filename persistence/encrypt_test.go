@@ -0,0 +1,109 @@
+package persistence_test
+
+import (
+	"bytes"
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedBackupRoundTrip(t *testing.T) {
+	source := streamTestConfig(t)
+	writeStreamTestData(t, source, "secret-alpha", "secret-beta", "blob")
+	sourceBM, err := persistence.NewBackupManagerWithConfig(source)
+	require.NoError(t, err)
+
+	for name, enc := range map[string]persistence.BackupEncryption{
+		"passphrase": {Passphrase: "correct horse battery staple"},
+		"key":        {Key: bytes.Repeat([]byte{7}, 32)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			metadata, err := sourceBM.WriteEncryptedBackup(&buf, "Encrypted backup", enc)
+			require.NoError(t, err)
+
+			// Neither the keys, the values nor the metadata are readable
+			assert.NotContains(t, buf.String(), "secret-alpha")
+			assert.NotContains(t, buf.String(), "value of")
+			assert.NotContains(t, buf.String(), "Encrypted backup")
+			assert.NotContains(t, buf.String(), "metadata.json")
+
+			target := streamTestConfig(t)
+			writeStreamTestData(t, target, "other", "blob")
+			targetBM, err := persistence.NewBackupManagerWithConfig(target)
+			require.NoError(t, err)
+
+			restored, err := targetBM.RestoreEncryptedBackup(&buf, enc)
+			require.NoError(t, err)
+			assert.Equal(t, metadata.Files, restored.Files)
+			assert.Equal(t, "Encrypted backup", restored.Description)
+
+			diskStorage, err := storage.NewDiskStorageWithConfig(target)
+			require.NoError(t, err)
+			defer diskStorage.Close()
+
+			keys, err := diskStorage.Keys()
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []types.Key{"secret-alpha", "secret-beta", "blob"}, keys)
+			value, err := diskStorage.Get("blob")
+			require.NoError(t, err)
+			assert.Equal(t, types.Value(bytes.Repeat([]byte("b"), 4096)), value)
+		})
+	}
+}
+
+func TestEncryptedBackupRejectsWrongKey(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "blob")
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+
+	var withPassphrase, withKey bytes.Buffer
+	_, err = bm.WriteEncryptedBackup(&withPassphrase, "", persistence.BackupEncryption{Passphrase: "right"})
+	require.NoError(t, err)
+	_, err = bm.WriteEncryptedBackup(&withKey, "", persistence.BackupEncryption{Key: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+
+	_, err = bm.WriteEncryptedBackup(&bytes.Buffer{}, "", persistence.BackupEncryption{})
+	assert.Error(t, err)
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("modified", []byte("new data")))
+	require.NoError(t, diskStorage.Close())
+
+	_, err = bm.RestoreEncryptedBackup(bytes.NewReader(withPassphrase.Bytes()), persistence.BackupEncryption{Passphrase: "wrong"})
+	assert.ErrorIs(t, err, persistence.ErrBackupKey)
+	_, err = bm.RestoreEncryptedBackup(bytes.NewReader(withKey.Bytes()), persistence.BackupEncryption{Key: bytes.Repeat([]byte{2}, 32)})
+	assert.ErrorIs(t, err, persistence.ErrBackupKey)
+	_, err = bm.RestoreEncryptedBackup(bytes.NewReader(withKey.Bytes()), persistence.BackupEncryption{Passphrase: "right"})
+	assert.ErrorIs(t, err, persistence.ErrBackupKey)
+
+	// Restored without a key, the stream is recognized rather than parsed
+	_, err = bm.RestoreBackup(bytes.NewReader(withKey.Bytes()))
+	assert.ErrorIs(t, err, persistence.ErrBackupEncrypted)
+
+	// Damaged or cut short, even with the right key
+	stream := withKey.Bytes()
+	damaged := bytes.Clone(stream)
+	damaged[len(damaged)/2] ^= 0xFF
+	_, err = bm.RestoreEncryptedBackup(bytes.NewReader(damaged), persistence.BackupEncryption{Key: bytes.Repeat([]byte{1}, 32)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "damaged")
+	_, err = bm.RestoreEncryptedBackup(bytes.NewReader(stream[:len(stream)-10]), persistence.BackupEncryption{Key: bytes.Repeat([]byte{1}, 32)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "truncated")
+
+	// The live data is untouched by all of them
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("modified")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("new data"), value)
+}
@@ -0,0 +1,50 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidBackupName is returned for a backup name that no backup could
+// have, such as one holding a path separator or "..", before it is used in
+// a path
+var ErrInvalidBackupName = errors.New("invalid backup name")
+
+// ErrBackupNotFound is returned for a backup name that is valid but names
+// no backup in the backup directory
+var ErrBackupNotFound = errors.New("backup not found")
+
+// ErrBackupCorrupt is matched by a *BackupCorruptError
+var ErrBackupCorrupt = errors.New("backup is corrupt")
+
+// ErrRecoveryFailed wraps the cause of a recovery that couldn't restore the
+// data, so errors.Is matches both it and the cause, such as
+// ErrBackupNotFound or a *BackupCorruptError
+var ErrRecoveryFailed = errors.New("recovery failed")
+
+// BackupCorruptError describes a backup file that doesn't match the
+// backup's metadata. A file missing from the backup has an empty Got, and
+// a file the metadata doesn't list an empty Expected.
+type BackupCorruptError struct {
+	File     string // File inside the backup; empty for a legacy backup's overall checksum
+	Expected string // Digest the metadata records
+	Got      string // Digest of the file found
+}
+
+func (e *BackupCorruptError) Error() string {
+	switch {
+	case e.File == "":
+		return fmt.Sprintf("checksum mismatch: expected %s, got %s", e.Expected, e.Got)
+	case e.Got == "":
+		return fmt.Sprintf("file %s missing from backup", e.File)
+	case e.Expected == "":
+		return fmt.Sprintf("unexpected file %s in backup", e.File)
+	default:
+		return fmt.Sprintf("checksum mismatch for %s: expected %s, got %s", e.File, e.Expected, e.Got)
+	}
+}
+
+// Is makes errors.Is(err, ErrBackupCorrupt) true for a *BackupCorruptError
+func (e *BackupCorruptError) Is(target error) bool {
+	return target == ErrBackupCorrupt
+}
@@ -0,0 +1,78 @@
+package persistence_test
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupNotFound(t *testing.T) {
+	bm, err := persistence.NewBackupManager(t.TempDir())
+	require.NoError(t, err)
+
+	const missing = "backup_19700101_000000"
+	_, err = bm.GetBackupInfo(missing)
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+	assert.ErrorIs(t, bm.RestoreFromBackup(missing), persistence.ErrBackupNotFound)
+	assert.ErrorIs(t, bm.DeleteBackup(missing), persistence.ErrBackupNotFound)
+	_, err = bm.VerifyBackup(missing, false)
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+	_, err = bm.RestoreToDirectory(missing, t.TempDir())
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+	_, err = bm.ReadBackupEntries(missing, func(types.Key) bool { return true })
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+
+	// A name no backup could have is invalid rather than missing
+	_, err = bm.GetBackupInfo("../data")
+	assert.ErrorIs(t, err, persistence.ErrInvalidBackupName)
+	assert.NotErrorIs(t, err, persistence.ErrBackupNotFound)
+}
+
+func TestBackupCorruptError(t *testing.T) {
+	dataDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorage(dataDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("value")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(dataDir)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("test")
+	require.NoError(t, err)
+	backupDir := filepath.Join(dataDir, "backups", metadata.Name)
+
+	// A file the metadata doesn't list
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "stray.db"), []byte("stray"), 0644))
+	err = bm.RestoreFromBackup(metadata.Name)
+	var corrupt *persistence.BackupCorruptError
+	require.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, "stray.db", corrupt.File)
+	assert.Empty(t, corrupt.Expected)
+	assert.NotEmpty(t, corrupt.Got)
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "stray.db")))
+
+	// A file missing from the backup
+	require.NoError(t, os.Remove(filepath.Join(backupDir, "index.db")))
+	err = bm.RestoreFromBackup(metadata.Name)
+	assert.ErrorIs(t, err, persistence.ErrBackupCorrupt)
+	require.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, &persistence.BackupCorruptError{File: "index.db", Expected: metadata.Files["index.db"]}, corrupt)
+	assert.EqualError(t, corrupt, "file index.db missing from backup")
+
+	// Recovery from it fails with the cause wrapped
+	rm, err := persistence.NewRecoveryManager(dataDir)
+	require.NoError(t, err)
+	_, err = rm.ForceRecoveryFromBackup(metadata.Name)
+	assert.ErrorIs(t, err, persistence.ErrRecoveryFailed)
+	assert.ErrorIs(t, err, persistence.ErrBackupCorrupt)
+
+	_, err = rm.ForceRecoveryFromBackup("backup_19700101_000000")
+	assert.ErrorIs(t, err, persistence.ErrRecoveryFailed)
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+}
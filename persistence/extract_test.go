@@ -0,0 +1,45 @@
+package persistence_test
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBackupEntries(t *testing.T) {
+	config := streamTestConfig(t)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("a/1", []byte("one")))
+	require.NoError(t, diskStorage.SetWithTTL("a/2", []byte("two"), time.Hour))
+	require.NoError(t, diskStorage.SetWithTTL("a/expired", []byte("gone"), time.Millisecond))
+	require.NoError(t, diskStorage.Set("b/1", []byte("other")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Entries backup")
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	entries, err := bm.ReadBackupEntries(metadata.Name, func(key types.Key) bool {
+		return strings.HasPrefix(string(key), "a/")
+	})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, types.Key("a/1"), entries[0].Key)
+	assert.Equal(t, types.Value("one"), entries[0].Value)
+	assert.Nil(t, entries[0].TTL)
+
+	// The TTL and the time it runs from come along with the value
+	assert.Equal(t, types.Key("a/2"), entries[1].Key)
+	require.NotNil(t, entries[1].TTL)
+	assert.Equal(t, time.Hour, *entries[1].TTL)
+	assert.False(t, entries[1].UpdatedAt.IsZero())
+}
@@ -0,0 +1,139 @@
+package persistence
+
+import (
+	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// recoveryStateName is the file in the data directory where a
+// RecoveryManager keeps its state
+const recoveryStateName = "recovery_state.json"
+
+// walCheckpointName is the name of the WAL checkpoint marker in a backup
+var walCheckpointName = filepath.Base(wal.CheckpointPath(types.WALFileName))
+
+// liveFiles returns the names, inside a backup, of the files a backup of
+// the data directory holds as it is now, blobs aside: those of
+// backupFiles that exist, the archived WAL segments and the WAL checkpoint
+// marker, which point-in-time recovery reads, and the recovery state.
+// Segments are named after wal.log in a backup, whatever the live WAL is
+// called.
+func (bm *BackupManager) liveFiles() ([]string, error) {
+	var files []string
+	for _, file := range backupFiles {
+		if bm.fileExists(bm.livePath(file)) {
+			files = append(files, file)
+		}
+	}
+
+	segments, err := wal.ArchivedSegments(bm.fs, bm.walPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		files = append(files, filepath.Base(wal.SegmentPath(types.WALFileName, segment.Number)))
+	}
+
+	for _, file := range []string{walCheckpointName, recoveryStateName} {
+		if bm.fileExists(bm.livePath(file)) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// isBackupFile reports whether name is one liveFiles could return
+func isBackupFile(name string) bool {
+	for _, file := range backupFiles {
+		if name == file {
+			return true
+		}
+	}
+	if name == walCheckpointName || name == recoveryStateName {
+		return true
+	}
+	_, ok := wal.SegmentNumber(types.WALFileName, name)
+	return ok
+}
+
+// manifestFiles returns the names of the files directly in dir, a backup
+// or a copy of the live files, that a restore puts in place, blobs aside
+func (bm *BackupManager) manifestFiles(dir string) ([]string, error) {
+	entries, err := bm.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isBackupFile(entry.Name()) {
+			files = append(files, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// restoreFiles makes the live files those of dir, a backup or a copy of
+// the live files, copied through t: each one is copied into place, and
+// live files dir doesn't hold are removed, so no hint, WAL segment or
+// checkpoint marker is left behind to be read with data it doesn't
+// describe. The blobs directory is replaced with dir's.
+func (bm *BackupManager) restoreFiles(t *transfer, dir string) error {
+	files, err := bm.manifestFiles(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list backup files: %w", err)
+	}
+	live, err := bm.liveFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list live files: %w", err)
+	}
+
+	keep := make(map[string]bool, len(files))
+	for _, file := range files {
+		keep[file] = true
+	}
+	for _, file := range live {
+		if keep[file] {
+			continue
+		}
+		if err := bm.fs.Remove(bm.livePath(file)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", file, err)
+		}
+	}
+
+	for _, file := range files {
+		if err := bm.copyFile(t, filepath.Join(dir, file), bm.livePath(file), file); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", file, err)
+		}
+	}
+
+	if err := bm.replaceDir(t, filepath.Join(dir, blobDirName), filepath.Join(bm.dataDir, blobDirName), blobDirName); err != nil {
+		return err
+	}
+	dirs := []string{bm.dataDir}
+	if walDir := filepath.Dir(bm.walPath); walDir != filepath.Clean(bm.dataDir) {
+		dirs = append(dirs, walDir)
+	}
+	return bm.syncDirs(dirs...)
+}
+
+// fileSizes returns the size of every file in the backup at backupPath
+// except its metadata, keyed as fileDigests keys their digests
+func (bm *BackupManager) fileSizes(backupPath string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	err := vfs.Walk(bm.fs, backupPath, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(backupPath, path)
+		if err != nil {
+			return err
+		}
+		if rel != "metadata.json" {
+			sizes[filepath.ToSlash(rel)] = info.Size()
+		}
+		return nil
+	})
+	return sizes, err
+}
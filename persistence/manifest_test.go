@@ -0,0 +1,106 @@
+package persistence_test
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotateWAL logs keys to the WAL at walPath, archiving a segment after each
+func rotateWAL(t *testing.T, walPath string, keys ...types.Key) {
+	t.Helper()
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	for _, key := range keys {
+		_, err = w.LogSet(key, []byte("logged"), nil)
+		require.NoError(t, err)
+		require.NoError(t, w.Rotate())
+	}
+	require.NoError(t, w.Close())
+}
+
+func TestBackupManifest(t *testing.T) {
+	tempDir := t.TempDir()
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = filepath.Join(tempDir, "data")
+	config.WALEnabled = true
+	config.WALPath = filepath.Join(tempDir, "journal", "journal.wal")
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("stored", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+	rotateWAL(t, config.WALPath, "first")
+	hint := filepath.Join(config.DataDirectory, "index.hint")
+	require.NoError(t, os.Remove(hint))
+
+	rm, err := persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, rm.SetRecoveryMode("manual"))
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("manifest")
+	require.NoError(t, err)
+
+	// The archived segments, checkpoint marker and recovery state are in
+	// the backup, the segments named after wal.log
+	segments, err := wal.ArchivedSegments(vfs.OS, config.WALPath)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	segment := segments[0].Path
+	live := map[string]string{
+		"data.db":  filepath.Join(config.DataDirectory, "data.db"),
+		"index.db": filepath.Join(config.DataDirectory, "index.db"),
+		"wal.log":  config.WALPath,
+		filepath.Base(wal.SegmentPath("wal.log", segments[0].Number)): segment,
+		"wal.checkpoint":      wal.CheckpointPath(config.WALPath),
+		"recovery_state.json": filepath.Join(config.DataDirectory, "recovery_state.json"),
+	}
+	for name, path := range live {
+		info, err := os.Stat(path)
+		require.NoError(t, err, name)
+		assert.Contains(t, metadata.Files, name)
+		assert.Equal(t, info.Size(), metadata.Sizes[name], name)
+	}
+	assert.Len(t, metadata.Sizes, len(metadata.Files))
+	assert.NotContains(t, metadata.Files, "index.hint")
+
+	// Files written since, and ones the backup doesn't hold, are gone once
+	// it is restored
+	rotateWAL(t, config.WALPath, "second")
+	require.NoError(t, rm.SetRecoveryMode("backup"))
+	require.NoError(t, os.Remove(segment))
+	require.NoError(t, os.WriteFile(hint, []byte("stale"), 0644))
+
+	require.NoError(t, bm.RestoreFromBackup(metadata.Name))
+
+	for name, path := range live {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err, name)
+		assert.Equal(t, metadata.Sizes[name], int64(len(data)), name)
+	}
+	assert.NoFileExists(t, wal.SegmentPath(config.WALPath, segments[0].Number+1))
+	assert.NoFileExists(t, hint)
+
+	rm, err = persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+	assert.Equal(t, "manual", rm.GetRecoveryState().RecoveryMode)
+
+	// The entry logged before the backup is still to be replayed, and the
+	// one logged after it is gone
+	entries, _, err := wal.PendingEntries(config.WALPath, wal.Options{})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, types.Key("first"), entries[0].Key)
+}
@@ -1,11 +1,19 @@
 package persistence_test
 
 import (
+	"bytes"
 	"database_engine/persistence"
 	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -61,7 +69,7 @@ func TestCreateFullBackup(t *testing.T) {
 	assert.DirExists(t, backupDir)
 
 	// Verify metadata file exists
-	backupName := fmt.Sprintf("backup_%s", metadata.Timestamp.Format("20060102_150405"))
+	backupName := metadata.Name
 	metadataFile := filepath.Join(backupDir, backupName, "metadata.json")
 	assert.FileExists(t, metadataFile)
 }
@@ -103,6 +111,63 @@ func TestListBackups(t *testing.T) {
 	}
 }
 
+func TestListBackupsWithFilter(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("test", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+
+	first, err := bm.CreateFullBackup("nightly 1")
+	require.NoError(t, err)
+	second, err := bm.CreateFullBackup("manual")
+	require.NoError(t, err)
+	third, err := bm.CreateFullBackup("nightly 2")
+	require.NoError(t, err)
+
+	// Foreign entries in the backup directory are skipped
+	backupDir := filepath.Join(tempDir, "backups")
+	require.NoError(t, os.Mkdir(filepath.Join(backupDir, "x"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(backupDir, "tmp"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(backupDir, "backup_broken"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "backup_file"), []byte("x"), 0644))
+
+	names := func(filter persistence.BackupFilter) []string {
+		backups, err := bm.ListBackupsWithFilter(filter)
+		require.NoError(t, err)
+		var names []string
+		for _, backup := range backups {
+			names = append(names, backup.Name)
+		}
+		return names
+	}
+
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 3)
+	assert.Equal(t, third.Name, backups[0].Name)
+	assert.Equal(t, "nightly 2", backups[0].Description)
+
+	assert.Equal(t, []string{third.Name, second.Name, first.Name}, names(persistence.BackupFilter{}))
+	assert.Equal(t, []string{third.Name, second.Name}, names(persistence.BackupFilter{Since: second.Timestamp}))
+	assert.Equal(t, []string{first.Name}, names(persistence.BackupFilter{Until: second.Timestamp}))
+	assert.Equal(t, []string{second.Name}, names(persistence.BackupFilter{Since: second.Timestamp, Until: third.Timestamp}))
+	assert.Equal(t, []string{third.Name, first.Name}, names(persistence.BackupFilter{Description: "nightly"}))
+	assert.Equal(t, []string{third.Name}, names(persistence.BackupFilter{Description: "nightly", Limit: 1}))
+	assert.Len(t, names(persistence.BackupFilter{BackupType: "full"}), 3)
+	assert.Empty(t, names(persistence.BackupFilter{BackupType: "incremental"}))
+
+	// A manager opened on the directory picks the most recent backup
+	bm, err = persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, 3, bm.GetBackupCount())
+	assert.Equal(t, third.Name, bm.GetLastBackup().Name)
+}
+
 func TestRestoreFromBackup(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -132,7 +197,7 @@ func TestRestoreFromBackup(t *testing.T) {
 	require.NoError(t, err)
 
 	// Restore from backup
-	backupName := fmt.Sprintf("backup_%s", metadata.Timestamp.Format("20060102_150405"))
+	backupName := metadata.Name
 	err = bm.RestoreFromBackup(backupName)
 	assert.NoError(t, err)
 
@@ -154,6 +219,69 @@ func TestRestoreFromBackup(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestCreateFullBackupNames(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("first", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+
+	// Backups made back to back each get their own directory
+	first, err := bm.CreateFullBackup("First")
+	require.NoError(t, err)
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("second", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	second, err := bm.CreateFullBackup("Second")
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Name, second.Name)
+	assert.DirExists(t, filepath.Join(tempDir, "backups", first.Name))
+
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	var names []string
+	for _, backup := range backups {
+		names = append(names, backup.Name)
+	}
+	assert.ElementsMatch(t, []string{first.Name, second.Name}, names)
+
+	require.NoError(t, bm.RestoreFromBackup(first.Name))
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	_, err = diskStorage.Get("second")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+	require.NoError(t, diskStorage.Close())
+
+	// A backup named down to the second, without a recorded name, is still
+	// found under its directory name
+	legacyName := "backup_" + first.Timestamp.Format("20060102_150405")
+	legacyPath := filepath.Join(tempDir, "backups", legacyName)
+	require.NoError(t, os.Rename(filepath.Join(tempDir, "backups", second.Name), legacyPath))
+	second.Name = ""
+	data, err := json.Marshal(second)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(legacyPath, "metadata.json"), data, 0644))
+
+	info, err := bm.GetBackupInfo(legacyName)
+	require.NoError(t, err)
+	assert.Equal(t, legacyName, info.Name)
+	require.NoError(t, bm.RestoreFromBackup(legacyName))
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+	value, err := diskStorage.Get("second")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("data"), value)
+}
+
 func TestDeleteBackup(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -178,7 +306,7 @@ func TestDeleteBackup(t *testing.T) {
 	assert.Len(t, backups, 1)
 
 	// Delete backup
-	backupName := fmt.Sprintf("backup_%s", metadata.Timestamp.Format("20060102_150405"))
+	backupName := metadata.Name
 	err = bm.DeleteBackup(backupName)
 	assert.NoError(t, err)
 
@@ -188,6 +316,56 @@ func TestDeleteBackup(t *testing.T) {
 	assert.Len(t, backups, 0)
 }
 
+func TestBackupCountAfterDelete(t *testing.T) {
+	tempDir := t.TempDir()
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("test", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	first, err := bm.CreateFullBackup("first")
+	require.NoError(t, err)
+	second, err := bm.CreateFullBackup("second")
+	require.NoError(t, err)
+	assert.Equal(t, 2, bm.GetBackupCount())
+	assert.Equal(t, second.Name, bm.GetLastBackup().Name)
+
+	total, err := bm.GetBackupsTotalSize()
+	require.NoError(t, err)
+	assert.Greater(t, total, first.DataSize+second.DataSize)
+
+	// Deleting the most recent backup makes the one before it the last
+	require.NoError(t, bm.DeleteBackup(second.Name))
+	assert.Equal(t, 1, bm.GetBackupCount())
+	assert.Equal(t, first.Name, bm.GetLastBackup().Name)
+	remaining, err := bm.GetBackupsTotalSize()
+	require.NoError(t, err)
+	assert.Less(t, remaining, total)
+
+	require.NoError(t, bm.DeleteBackup(first.Name))
+	assert.Zero(t, bm.GetBackupCount())
+	assert.Nil(t, bm.GetLastBackup())
+	remaining, err = bm.GetBackupsTotalSize()
+	require.NoError(t, err)
+	assert.Zero(t, remaining)
+
+	// Files in the backup directory that aren't backups don't count
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, types.BackupDirName, "notes.txt"), []byte("not a backup"), 0644))
+	third, err := bm.CreateFullBackup("third")
+	require.NoError(t, err)
+	assert.Equal(t, 1, bm.GetBackupCount())
+	assert.Equal(t, third.Name, bm.GetLastBackup().Name)
+	total, err = bm.GetBackupsTotalSize()
+	require.NoError(t, err)
+	dirSize, err := bm.GetBackupDirSize()
+	require.NoError(t, err)
+	assert.Equal(t, dirSize-int64(len("not a backup")), total)
+}
+
 func TestGetBackupInfo(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -207,7 +385,7 @@ func TestGetBackupInfo(t *testing.T) {
 	require.NoError(t, err)
 
 	// Get backup info
-	backupName := fmt.Sprintf("backup_%s", metadata.Timestamp.Format("20060102_150405"))
+	backupName := metadata.Name
 	info, err := bm.GetBackupInfo(backupName)
 	assert.NoError(t, err)
 	assert.NotNil(t, info)
@@ -216,6 +394,68 @@ func TestGetBackupInfo(t *testing.T) {
 	assert.Equal(t, "full", info.BackupType)
 }
 
+func TestBackupNamesStayInBackupDirectory(t *testing.T) {
+	root := t.TempDir()
+	dataDir := filepath.Join(root, "data")
+
+	diskStorage, err := storage.NewDiskStorage(dataDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("test", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(dataDir)
+	require.NoError(t, err)
+	_, err = bm.CreateFullBackup("Backup next to the victim")
+	require.NoError(t, err)
+
+	// A directory outside the backup directory that looks like a backup
+	victim := filepath.Join(root, "victim")
+	require.NoError(t, os.MkdirAll(victim, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(victim, "metadata.json"), []byte(`{"backup_type":"full"}`), 0644))
+
+	names := []string{
+		"",
+		".",
+		"..",
+		"../..",
+		"../../victim",
+		"backup_x/../../../victim",
+		victim,
+		"/etc",
+		"backup_a/b",
+		`backup_a\b`,
+		"victim",
+	}
+	for _, name := range names {
+		err := bm.DeleteBackup(name)
+		assert.ErrorIs(t, err, persistence.ErrInvalidBackupName, name)
+		_, err = bm.GetBackupInfo(name)
+		assert.ErrorIs(t, err, persistence.ErrInvalidBackupName, name)
+		err = bm.RestoreFromBackup(name)
+		assert.ErrorIs(t, err, persistence.ErrInvalidBackupName, name)
+		_, err = bm.RestoreToDirectory(name, filepath.Join(root, "restored"))
+		assert.ErrorIs(t, err, persistence.ErrInvalidBackupName, name)
+		_, err = bm.VerifyBackup(name, true)
+		assert.ErrorIs(t, err, persistence.ErrInvalidBackupName, name)
+		_, err = bm.ReadBackupEntries(name, func(types.Key) bool { return true })
+		assert.ErrorIs(t, err, persistence.ErrInvalidBackupName, name)
+	}
+
+	// Nothing outside the backup directory was touched, and the data and
+	// its backup are still there
+	assert.FileExists(t, filepath.Join(victim, "metadata.json"))
+	assert.FileExists(t, filepath.Join(dataDir, "data.db"))
+	assert.NoDirExists(t, filepath.Join(root, "restored"))
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	// A name a backup could have is looked up as usual
+	err = bm.DeleteBackup("backup_19700101_000000")
+	assert.NotErrorIs(t, err, persistence.ErrInvalidBackupName)
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+}
+
 func TestNewRecoveryManager(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -245,13 +485,147 @@ func TestPerformRecovery(t *testing.T) {
 	require.NoError(t, err)
 
 	// Perform recovery on directory with data
-	err = rm.PerformRecovery()
-	assert.NoError(t, err)
+	report, err := rm.PerformRecovery()
+	require.NoError(t, err)
+
+	// The index checks out and there is no WAL to replay
+	assert.Equal(t, []persistence.RecoveryPhase{persistence.PhaseIntegrityCheck}, report.Phases)
+	assert.True(t, report.DataIntegrity)
+	assert.False(t, report.WALRecovery)
+	assert.False(t, report.BackupRecovery)
+	assert.Empty(t, report.Issues)
+	assert.Positive(t, report.Duration)
 
 	// Check recovery state
 	state := rm.GetRecoveryState()
 	assert.Equal(t, 1, state.RecoveryCount)
-	assert.False(t, state.LastRecovery.IsZero())
+	assert.Equal(t, report.Started, state.LastRecovery)
+	assert.True(t, state.DataIntegrity)
+}
+
+func TestPerformRecoveryReplaysWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	config := types.DefaultConfig()
+	config.DataDirectory = tempDir
+
+	// The data file holds one key and the WAL two more, as if the process
+	// died before it applied them
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("stored", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	w, err := wal.NewWAL(config.WALFilePath(), 1024*1024)
+	require.NoError(t, err)
+	_, err = w.LogSet("logged", []byte("data"), nil)
+	require.NoError(t, err)
+	_, err = w.LogSet("stored", []byte("newer"), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Losing the index fails the integrity check, so the WAL is replayed
+	require.NoError(t, os.Remove(filepath.Join(tempDir, "index.db")))
+	rm, err := persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+	report, err := rm.PerformRecovery()
+	require.NoError(t, err)
+
+	assert.Equal(t, []persistence.RecoveryPhase{persistence.PhaseIntegrityCheck, persistence.PhaseWALReplay}, report.Phases)
+	assert.False(t, report.DataIntegrity)
+	assert.True(t, report.WALRecovery)
+	assert.Equal(t, 2, report.WALReplayed)
+	assert.Zero(t, report.WALSkipped)
+	assert.False(t, report.BackupRecovery)
+	assert.Empty(t, report.Issues)
+
+	state := rm.GetRecoveryState()
+	assert.True(t, state.WALRecovery)
+	assert.Equal(t, 2, state.WALReplayed)
+
+	// The replayed entries were checkpointed, so they aren't applied again
+	report, err = rm.PerformRecovery()
+	require.NoError(t, err)
+	assert.True(t, report.DataIntegrity)
+	assert.True(t, report.WALRecovery)
+	assert.Zero(t, report.WALReplayed)
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+	value, err := diskStorage.Get("stored")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("newer"), []byte(value))
+	value, err = diskStorage.Get("logged")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), []byte(value))
+}
+
+func TestPerformRecoverySkipsCorruptWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	config := types.DefaultConfig()
+	config.DataDirectory = tempDir
+	config.WALSkipCorrupt = true
+
+	w, err := wal.NewWAL(config.WALFilePath(), 1024*1024)
+	require.NoError(t, err)
+	for _, key := range []types.Key{"a", "b", "c"} {
+		_, err = w.LogSet(key, []byte("value"), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	// Damage the middle entry
+	data, err := os.ReadFile(config.WALFilePath())
+	require.NoError(t, err)
+	at := bytes.Index(data, []byte(`"key":"b"`))
+	require.Positive(t, at)
+	data[at+7] = 'x'
+	require.NoError(t, os.WriteFile(config.WALFilePath(), data, 0644))
+
+	rm, err := persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+	report, err := rm.PerformRecovery()
+	require.NoError(t, err)
+	assert.True(t, report.WALRecovery)
+	assert.Equal(t, 2, report.WALReplayed)
+	assert.Equal(t, 1, report.WALSkipped)
+}
+
+func TestPerformRecoveryFallsBackToBackup(t *testing.T) {
+	tempDir := t.TempDir()
+
+	rm, err := persistence.NewRecoveryManager(tempDir)
+	require.NoError(t, err)
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("backed_up", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+	_, err = rm.CreateRecoveryPoint("before damage")
+	require.NoError(t, err)
+
+	// Neither the index nor the WAL can be used
+	require.NoError(t, os.Remove(filepath.Join(tempDir, "index.db")))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, types.WALFileName), []byte("KVWL\x63\x00\x00\x00"), 0644))
+
+	report, err := rm.PerformRecovery()
+	require.NoError(t, err)
+	assert.Equal(t, []persistence.RecoveryPhase{
+		persistence.PhaseIntegrityCheck,
+		persistence.PhaseWALReplay,
+		persistence.PhaseBackupRestore,
+	}, report.Phases)
+	assert.False(t, report.WALRecovery)
+	assert.True(t, report.BackupRecovery)
+	assert.NotEmpty(t, report.Backup)
+	assert.Equal(t, report.Backup, rm.GetRecoveryState().LastBackup)
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+	value, err := diskStorage.Get("backed_up")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), []byte(value))
 }
 
 func TestCreateRecoveryPoint(t *testing.T) {
@@ -326,6 +700,32 @@ func TestValidateDataIntegrity(t *testing.T) {
 	assert.Empty(t, issues)
 }
 
+func TestValidateDataIntegrityCorruptRecord(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, diskStorage.Set(types.Key(fmt.Sprintf("key%d", i)), []byte("data")))
+	}
+	require.NoError(t, diskStorage.Close())
+
+	// Both files still exist, but a record no longer passes its checksum
+	dataPath := filepath.Join(tempDir, "data.db")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)-2] ^= 0xFF
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	rm, err := persistence.NewRecoveryManager(tempDir)
+	require.NoError(t, err)
+
+	isValid, issues, err := rm.ValidateDataIntegrity()
+	assert.NoError(t, err)
+	assert.False(t, isValid)
+	assert.NotEmpty(t, issues)
+}
+
 func TestForceRecoveryFromBackup(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -355,9 +755,13 @@ func TestForceRecoveryFromBackup(t *testing.T) {
 	require.NoError(t, err)
 
 	// Force recovery from backup
-	backupName := fmt.Sprintf("backup_%s", metadata.Timestamp.Format("20060102_150405"))
-	err = rm.ForceRecoveryFromBackup(backupName)
-	assert.NoError(t, err)
+	backupName := metadata.Name
+	report, err := rm.ForceRecoveryFromBackup(backupName)
+	require.NoError(t, err)
+	assert.Equal(t, backupName, report.Backup)
+	assert.Equal(t, []persistence.RecoveryPhase{persistence.PhaseBackupRestore}, report.Phases)
+	assert.NotEmpty(t, report.SafetyBackup)
+	assert.Empty(t, report.SafetyBackupSkipped)
 
 	// Check recovery state
 	state := rm.GetRecoveryState()
@@ -367,6 +771,37 @@ func TestForceRecoveryFromBackup(t *testing.T) {
 	assert.True(t, state.DataIntegrity)
 }
 
+func TestForceRecoveryFromBackupWithoutData(t *testing.T) {
+	tempDir := t.TempDir()
+
+	rm, err := persistence.NewRecoveryManager(tempDir)
+	require.NoError(t, err)
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+	metadata, err := rm.CreateRecoveryPoint("Only backup")
+	require.NoError(t, err)
+
+	// The data files are gone, so there is nothing to save first
+	for _, file := range []string{"data.db", "index.db", "index.hint", types.WALFileName} {
+		require.NoError(t, os.RemoveAll(filepath.Join(tempDir, file)))
+	}
+
+	report, err := rm.ForceRecoveryFromBackup(metadata.Name)
+	require.NoError(t, err)
+	assert.Empty(t, report.SafetyBackup)
+	assert.Equal(t, "no data to back up", report.SafetyBackupSkipped)
+	assert.True(t, report.BackupRecovery)
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+}
+
 func TestRecoveryConcurrency(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -387,7 +822,7 @@ func TestRecoveryConcurrency(t *testing.T) {
 
 	for i := 0; i < 5; i++ {
 		go func(i int) {
-			err := rm.PerformRecovery()
+			_, err := rm.PerformRecovery()
 			assert.NoError(t, err)
 			done <- true
 		}(i)
@@ -423,7 +858,7 @@ func TestBackupIntegrity(t *testing.T) {
 	require.NoError(t, err)
 
 	// Verify backup integrity by restoring
-	backupName := fmt.Sprintf("backup_%s", metadata.Timestamp.Format("20060102_150405"))
+	backupName := metadata.Name
 	err = bm.RestoreFromBackup(backupName)
 	assert.NoError(t, err)
 
@@ -438,3 +873,342 @@ func TestBackupIntegrity(t *testing.T) {
 	err = diskStorage.Close()
 	require.NoError(t, err)
 }
+
+func TestRestoreFromCorruptBackup(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("original", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Corrupt backup")
+	require.NoError(t, err)
+	assert.Contains(t, metadata.Files, "data.db")
+	assert.Contains(t, metadata.Files, "index.db")
+	assert.NotContains(t, metadata.Files, "metadata.json")
+
+	backupName := metadata.Name
+	verification, err := bm.VerifyBackup(backupName, false)
+	require.NoError(t, err)
+	assert.True(t, verification.Healthy(), verification.Discrepancies)
+
+	// Flip one byte of the backed-up data file, which keeps its size
+	dataPath := filepath.Join(tempDir, "backups", backupName, "data.db")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xFF
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	verification, err = bm.VerifyBackup(backupName, false)
+	require.NoError(t, err)
+	require.Len(t, verification.Discrepancies, 1)
+	assert.Contains(t, verification.Discrepancies[0], "data.db")
+
+	// The restore refuses it and leaves the live data alone
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("modified", []byte("new data")))
+	require.NoError(t, diskStorage.Close())
+
+	err = bm.RestoreFromBackup(backupName)
+	assert.ErrorIs(t, err, persistence.ErrBackupCorrupt)
+	var corrupt *persistence.BackupCorruptError
+	require.ErrorAs(t, err, &corrupt)
+	assert.Equal(t, "data.db", corrupt.File)
+	assert.NotEmpty(t, corrupt.Expected)
+	assert.NotEqual(t, corrupt.Expected, corrupt.Got)
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("modified")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("new data"), value)
+}
+
+func TestRestoreFromLegacyBackup(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("original", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Legacy backup")
+	require.NoError(t, err)
+
+	// Rewrite the metadata as a backup made before digests were recorded
+	backupName := metadata.Name
+	metadataPath := filepath.Join(tempDir, "backups", backupName, "metadata.json")
+	metadata.Files = nil
+	data, err := json.Marshal(metadata)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metadataPath, data, 0644))
+
+	// It only has its size checked, so it still verifies and restores
+	verification, err := bm.VerifyBackup(backupName, false)
+	require.NoError(t, err)
+	assert.True(t, verification.Healthy(), verification.Discrepancies)
+	assert.Equal(t, 0, verification.FilesChecked)
+	require.NoError(t, bm.RestoreFromBackup(backupName))
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("original")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("data"), value)
+}
+
+func TestRestoreFromBackupWithBlobs(t *testing.T) {
+	tempDir := t.TempDir()
+
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = tempDir
+	config.WriteBufferSize = 0
+	config.BlobThreshold = 1024
+
+	large := bytes.Repeat([]byte("blob"), 1024)
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("large", large))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+
+	metadata, err := bm.CreateFullBackup("Blob backup")
+	require.NoError(t, err)
+
+	// Overwriting after the backup collects the blob from the data directory
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("large", []byte("small")))
+	require.NoError(t, diskStorage.Close())
+
+	backupName := metadata.Name
+	require.NoError(t, bm.RestoreFromBackup(backupName))
+
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("large")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(large), value)
+}
+
+func TestCreateFullBackupWriteFailure(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key1", []byte("value1")))
+	require.NoError(t, diskStorage.Close())
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	config := types.DefaultConfig()
+	config.DataDirectory = tempDir
+	bm, err := persistence.NewBackupManagerWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// The disk fills up while the data file is copied
+	fsys.InjectWriteFault(vfs.WriteFault{})
+	_, err = bm.CreateFullBackup("Failed backup")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+	// No partial backup is left behind to be restored later
+	entries, err := os.ReadDir(filepath.Join(tempDir, "backups"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, 0, bm.GetBackupCount())
+
+	metadata, err := bm.CreateFullBackup("Retried backup")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), metadata.EntryCount)
+	assert.Equal(t, 1, bm.GetBackupCount())
+}
+
+func TestBackupFileLayout(t *testing.T) {
+	tempDir := t.TempDir()
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = filepath.Join(tempDir, "data")
+	config.WALEnabled = true
+	config.WALPath = filepath.Join(tempDir, "wal", "wal.log")
+	config.BackupDirectory = filepath.Join(tempDir, "backups")
+	config.FileMode = 0600
+	config.DirMode = 0700
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("original", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Layout backup")
+	require.NoError(t, err)
+
+	// The backup goes to the configured directory, WAL included
+	backupName := metadata.Name
+	backupPath := filepath.Join(config.BackupDirectory, backupName)
+	assert.NoDirExists(t, filepath.Join(config.DataDirectory, "backups"))
+	for _, name := range []string{"data.db", "index.db", "wal.log", "metadata.json"} {
+		info, err := os.Stat(filepath.Join(backupPath, name))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), name)
+	}
+	info, err := os.Stat(backupPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// Restoring puts the WAL back at its configured path, so the write
+	// made after the backup isn't replayed
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("modified", []byte("new data")))
+	require.NoError(t, diskStorage.Close())
+
+	require.NoError(t, bm.RestoreFromBackup(backupName))
+
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("original")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("data"), value)
+
+	_, err = diskStorage.Get("modified")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+}
+
+func TestBackupSyncsDirectories(t *testing.T) {
+	tempDir := t.TempDir()
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = filepath.Join(tempDir, "data")
+	config.WALEnabled = true
+	config.WALPath = filepath.Join(tempDir, "wal", "wal.log")
+	config.BackupDirectory = filepath.Join(tempDir, "backups")
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key1", []byte("value1")))
+	require.NoError(t, diskStorage.Close())
+
+	require.NoError(t, os.MkdirAll(config.BackupDirectory, 0755))
+	fsys := vfs.NewFaultFS(vfs.OS)
+	bm, err := persistence.NewBackupManagerWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// Every directory the backup created files in is synced, including
+	// the one it was created in
+	metadata, err := bm.CreateFullBackup("Synced backup")
+	require.NoError(t, err)
+	assert.Empty(t, fsys.UnsyncedDirs())
+
+	// So is the WAL directory a restore recreates the WAL in
+	require.NoError(t, os.Remove(config.WALPath))
+	backupName := metadata.Name
+	require.NoError(t, bm.RestoreFromBackup(backupName))
+	assert.FileExists(t, config.WALPath)
+	assert.NotContains(t, fsys.UnsyncedDirs(), filepath.Dir(config.WALPath))
+}
+
+// dataDirContents reads every file under dir but the backups, by path
+func dataDirContents(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	contents := make(map[string]string)
+	require.NoError(t, vfs.Walk(vfs.OS, dir, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || strings.HasPrefix(rel, types.BackupDirName) {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		contents[rel] = string(data)
+		return err
+	}))
+	return contents
+}
+
+func TestRestoreToDirectory(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "beta", "blob")
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Investigation backup")
+	require.NoError(t, err)
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("modified", []byte("new data")))
+	require.NoError(t, diskStorage.Delete("alpha"))
+	require.NoError(t, diskStorage.Close())
+	before := dataDirContents(t, config.DataDirectory)
+
+	destDir := filepath.Join(t.TempDir(), "restored")
+	restoredPath, err := bm.RestoreToDirectory(metadata.Name, destDir)
+	require.NoError(t, err)
+	assert.Equal(t, destDir, restoredPath)
+
+	// The data directory is exactly as it was
+	assert.Equal(t, before, dataDirContents(t, config.DataDirectory))
+
+	// The copy opens on its own, without a WAL, as the backup was
+	restored, err := storage.NewDiskStorage(restoredPath)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	keys, err := restored.Keys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []types.Key{"alpha", "beta", "blob"}, keys)
+	value, err := restored.Get("blob")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(bytes.Repeat([]byte("b"), 4096)), value)
+
+	// Destinations that already hold something, or are the data directory,
+	// are refused
+	_, err = bm.RestoreToDirectory(metadata.Name, destDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not empty")
+	_, err = bm.RestoreToDirectory(metadata.Name, config.DataDirectory)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data directory")
+	assert.Equal(t, before, dataDirContents(t, config.DataDirectory))
+}
+
+func TestRestoreToDirectoryFromCorruptBackup(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "blob")
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Corrupt backup")
+	require.NoError(t, err)
+
+	dataPath := filepath.Join(config.DataDirectory, types.BackupDirName, metadata.Name, "data.db")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xFF
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	destDir := filepath.Join(t.TempDir(), "restored")
+	_, err = bm.RestoreToDirectory(metadata.Name, destDir)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "data.db")
+	assert.NoDirExists(t, destDir)
+}
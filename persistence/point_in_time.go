@@ -0,0 +1,190 @@
+package persistence
+
+import (
+	"database_engine/storage"
+	"database_engine/wal"
+	"fmt"
+	"time"
+)
+
+// PointInTimeRecovery is a recovery to a point in time prepared by
+// PrepareRecoveryToTime: the backup to restore and the WAL entries to replay
+// onto it, read while they were still on disk
+type PointInTimeRecovery struct {
+	Target  time.Time
+	Backup  BackupMetadata
+	Entries []*wal.WALEntry // Oldest first
+}
+
+// RecoverToTime recovers the data directory to how it was at target: it
+// restores the newest backup made at or before target and replays the WAL
+// entries logged after the backup's LSN, from the archived segments and
+// the active file, up to the last one timestamped at or before target.
+// A backup that doesn't record its LSN has the entries logged since it was
+// made replayed instead. Every failure to recover, including there being no
+// backup old enough, wraps ErrRecoveryFailed.
+//
+// The entries are read before anything is restored, and recovery fails
+// without touching the data if some of them are no longer on disk. The data
+// directory must not be open; closing it checkpoints the WAL, which deletes
+// segments beyond Config.WALRetainSegments, so a Database prepares the
+// recovery with its storage open and closes the storage around
+// ApplyRecoveryToTime instead. The data files the backup replaces are
+// quarantined first. The replayed entries are logged to the WAL again and
+// checkpointed, so the recovered state is what opens next.
+func (rm *RecoveryManager) RecoverToTime(target time.Time) (*RecoveryReport, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	recovery, err := rm.prepareRecoveryToTime(target)
+	if err != nil {
+		return nil, err
+	}
+	return rm.applyRecoveryToTime(recovery)
+}
+
+// PrepareRecoveryToTime picks the backup RecoverToTime would restore and
+// reads the WAL entries it would replay, through the storage set with
+// SetStorage if it has the WAL open, without changing anything
+func (rm *RecoveryManager) PrepareRecoveryToTime(target time.Time) (*PointInTimeRecovery, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.prepareRecoveryToTime(target)
+}
+
+// ApplyRecoveryToTime restores the backup of a prepared recovery and
+// replays its WAL entries onto it. The data directory must not be open.
+func (rm *RecoveryManager) ApplyRecoveryToTime(recovery *PointInTimeRecovery) (*RecoveryReport, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	return rm.applyRecoveryToTime(recovery)
+}
+
+func (rm *RecoveryManager) prepareRecoveryToTime(target time.Time) (*PointInTimeRecovery, error) {
+	backups, err := rm.backupManager.ListBackupsWithFilter(BackupFilter{Until: target.Add(time.Nanosecond), Limit: 1})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("%w: %w: none made at or before %s", ErrRecoveryFailed, ErrBackupNotFound, target.Format(time.RFC3339Nano))
+	}
+
+	recovery := &PointInTimeRecovery{Target: target, Backup: backups[0]}
+	recovery.Entries, err = rm.walEntriesSince(&recovery.Backup, target)
+	if err != nil {
+		return nil, err
+	}
+	return recovery, nil
+}
+
+func (rm *RecoveryManager) applyRecoveryToTime(recovery *PointInTimeRecovery) (*RecoveryReport, error) {
+	backup, entries := recovery.Backup, recovery.Entries
+	report := &RecoveryReport{Started: time.Now(), TargetTime: recovery.Target}
+
+	report.Phases = append(report.Phases, PhaseBackupRestore)
+	quarantine, err := rm.quarantine(fmt.Sprintf("recovery to %s from backup %s", recovery.Target.Format(time.RFC3339Nano), backup.Name))
+	if err != nil {
+		return nil, err
+	}
+	report.Quarantine = quarantine
+	if err := rm.backupManager.RestoreFromBackup(backup.Name); err != nil {
+		return nil, fmt.Errorf("%w: failed to restore backup %s: %w", ErrRecoveryFailed, backup.Name, err)
+	}
+	report.BackupRecovery = true
+	report.Backup = backup.Name
+	report.BackupAge = report.Started.Sub(backup.Timestamp)
+
+	report.Phases = append(report.Phases, PhaseWALReplay)
+	if err := rm.replayOnto(entries); err != nil {
+		return report, fmt.Errorf("%w: failed to replay WAL onto backup %s: %w", ErrRecoveryFailed, backup.Name, err)
+	}
+	report.WALRecovery = true
+	report.WALReplayed = len(entries)
+	if len(entries) > 0 {
+		report.WALFirstLSN = entries[0].LSN
+		report.WALLastLSN = entries[len(entries)-1].LSN
+		report.WALLastTime = entries[len(entries)-1].Timestamp
+	}
+
+	report.DataIntegrity = true
+	report.Issues = rm.validateDataIntegrity()
+	report.Duration = time.Since(report.Started)
+
+	rm.state.record(report)
+	if err := rm.saveRecoveryState(); err != nil {
+		return report, fmt.Errorf("failed to save recovery state: %w", err)
+	}
+
+	return report, nil
+}
+
+// walEntriesSince returns the WAL entries logged after backup up to the
+// last one timestamped at or before target, oldest first
+func (rm *RecoveryManager) walEntriesSince(backup *BackupMetadata, target time.Time) ([]*wal.WALEntry, error) {
+	all, lastLSN, err := rm.readWALFrom(backup.WALLSN + 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL entries: %w", err)
+	}
+
+	// Every entry after the backup's must still be on disk
+	if backup.WALLSN > 0 && lastLSN > backup.WALLSN && (len(all) == 0 || all[0].LSN != backup.WALLSN+1) {
+		return nil, fmt.Errorf("%w: WAL entries after LSN %d, where backup %s was made, are no longer available", ErrRecoveryFailed, backup.WALLSN, backup.Name)
+	}
+
+	var entries []*wal.WALEntry
+	for _, entry := range all {
+		if entry.Timestamp.After(target) {
+			break
+		}
+		if backup.WALLSN == 0 && entry.Timestamp.Before(backup.Timestamp) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// readWALFrom returns the WAL entries with an LSN of at least lsn and the
+// last LSN logged. An open DiskStorage reads its own WAL; otherwise the WAL
+// files are opened.
+func (rm *RecoveryManager) readWALFrom(lsn uint64) ([]*wal.WALEntry, uint64, error) {
+	if diskStorage, ok := rm.storage.(*storage.DiskStorage); ok && diskStorage.IsWALEnabled() {
+		entries, err := diskStorage.ReadWALFrom(lsn)
+		return entries, diskStorage.LastWALLSN(), err
+	}
+
+	w, err := wal.NewWALWithOptions(rm.walPath, wal.Options{
+		MaxSize:      rm.config.MaxWALSize,
+		SkipCorrupt:  rm.config.WALSkipCorrupt,
+		MaxKeySize:   rm.config.MaxKeySize,
+		MaxValueSize: rm.config.MaxValueSize,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer w.Close()
+
+	entries, err := w.ReadEntriesFrom(lsn)
+	return entries, w.LastLSN(), err
+}
+
+// replayOnto opens the restored data directory with its WAL, which
+// replays the restored active file, applies entries on top and closes it
+// again, which checkpoints them
+func (rm *RecoveryManager) replayOnto(entries []*wal.WALEntry) error {
+	config := rm.config
+	config.EnablePersistence = true
+	config.WALEnabled = true
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	if err := wal.Replay(entries, diskStorage); err != nil {
+		diskStorage.Close()
+		return err
+	}
+	return diskStorage.Close()
+}
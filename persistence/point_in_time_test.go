@@ -0,0 +1,136 @@
+package persistence_test
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pointInTimeConfig is a WAL-enabled config keeping every checkpointed
+// WAL segment, as point-in-time recovery needs
+func pointInTimeConfig(t *testing.T) types.Config {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = t.TempDir()
+	config.WALEnabled = true
+	config.WALRetainSegments = 100
+	return config
+}
+
+// tick waits long enough for the next WAL entry to be timestamped after
+// the time it returns
+func tick() time.Time {
+	time.Sleep(5 * time.Millisecond)
+	now := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	return now
+}
+
+func TestRecoverToTime(t *testing.T) {
+	config := pointInTimeConfig(t)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("before", []byte("backed up")))
+	require.NoError(t, diskStorage.Set("changed", []byte("v1")))
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	snapshot, err := diskStorage.OpenSnapshot()
+	require.NoError(t, err)
+	metadata, err := bm.CreateSnapshotBackup(snapshot, "Base backup")
+	require.NoError(t, snapshot.Close())
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), metadata.WALLSN)
+
+	// Writes after the backup, across a rotation and a checkpoint
+	tick()
+	require.NoError(t, diskStorage.Set("earlier", []byte("present")))
+	require.NoError(t, diskStorage.Set("changed", []byte("v2")))
+	require.NoError(t, diskStorage.RotateWAL())
+	require.NoError(t, diskStorage.Delete("before"))
+	require.NoError(t, diskStorage.Checkpoint())
+	target := tick()
+	require.NoError(t, diskStorage.Set("later", []byte("absent")))
+	require.NoError(t, diskStorage.Set("changed", []byte("v3")))
+	require.NoError(t, diskStorage.Close())
+
+	rm, err := persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+	report, err := rm.RecoverToTime(target)
+	require.NoError(t, err)
+	assert.Equal(t, metadata.Name, report.Backup)
+	assert.True(t, report.BackupRecovery)
+	assert.True(t, report.WALRecovery)
+	assert.Equal(t, []persistence.RecoveryPhase{persistence.PhaseBackupRestore, persistence.PhaseWALReplay}, report.Phases)
+	assert.Equal(t, 3, report.WALReplayed)
+	assert.Equal(t, uint64(3), report.WALFirstLSN)
+	assert.Equal(t, uint64(5), report.WALLastLSN)
+	assert.False(t, report.WALLastTime.After(target))
+	assert.Equal(t, target, report.TargetTime)
+	assert.Empty(t, report.Issues)
+
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("earlier")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("present"), value)
+	value, err = diskStorage.Get("changed")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("v2"), value)
+	_, err = diskStorage.Get("later")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+	_, err = diskStorage.Get("before")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+}
+
+func TestRecoverToTimeNeedsBackupAndWAL(t *testing.T) {
+	config := pointInTimeConfig(t)
+	config.WALRetainSegments = 0
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+
+	beforeBackup := tick()
+	require.NoError(t, diskStorage.Set("key", []byte("backed up")))
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	snapshot, err := diskStorage.OpenSnapshot()
+	require.NoError(t, err)
+	_, err = bm.CreateSnapshotBackup(snapshot, "Base backup")
+	require.NoError(t, snapshot.Close())
+	require.NoError(t, err)
+
+	// The checkpoint deletes the segment holding the entry after the backup
+	require.NoError(t, diskStorage.Set("key", []byte("after backup")))
+	require.NoError(t, diskStorage.Checkpoint())
+	target := tick()
+	require.NoError(t, diskStorage.Close())
+
+	rm, err := persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+
+	_, err = rm.RecoverToTime(beforeBackup)
+	assert.ErrorIs(t, err, persistence.ErrRecoveryFailed)
+	assert.ErrorIs(t, err, persistence.ErrBackupNotFound)
+
+	_, err = rm.RecoverToTime(target)
+	assert.ErrorIs(t, err, persistence.ErrRecoveryFailed)
+	assert.Contains(t, err.Error(), "no longer available")
+
+	// Neither touched the data
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("after backup"), value)
+}
@@ -0,0 +1,91 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// BackupProgress reports how far a backup or restore has got copying files
+type BackupProgress struct {
+	File       string // File being copied, by its path within the backup
+	FileBytes  int64  // Bytes of File copied so far
+	FileSize   int64
+	Bytes      int64 // Bytes copied so far, over every file
+	TotalBytes int64
+}
+
+// ProgressFunc receives the progress of a backup or restore after every
+// chunk it copies. It is called on the goroutine doing the copying, so it
+// should return quickly.
+type ProgressFunc func(BackupProgress)
+
+// copyChunkSize is how much a backup or restore copies between checks of
+// its context and progress reports
+const copyChunkSize = 1 << 20
+
+// transfer tracks the files one backup or restore copies, checking its
+// context between chunks and reporting its progress. A nil transfer copies
+// without either, as a restore does when it puts the live files back.
+type transfer struct {
+	ctx        context.Context
+	progress   ProgressFunc
+	bytes      int64
+	totalBytes int64
+}
+
+func newTransfer(ctx context.Context, progress ProgressFunc, totalBytes int64) *transfer {
+	return &transfer{ctx: ctx, progress: progress, totalBytes: totalBytes}
+}
+
+// context returns the context the transfer is canceled by
+func (t *transfer) context() context.Context {
+	if t == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// copy copies src, the file name of size bytes, to dst until src ends
+func (t *transfer) copy(dst io.Writer, src io.Reader, name string, size int64) error {
+	if t == nil {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	var fileBytes int64
+	return copyChunks(t.ctx, dst, src, func(n int64) {
+		fileBytes += n
+		t.bytes += n
+		if t.progress != nil {
+			t.progress(BackupProgress{
+				File:       name,
+				FileBytes:  fileBytes,
+				FileSize:   size,
+				Bytes:      t.bytes,
+				TotalBytes: t.totalBytes,
+			})
+		}
+	})
+}
+
+// copyChunks copies src to dst copyChunkSize bytes at a time until src
+// ends, calling copied after each chunk. It stops with ctx's error once
+// ctx is done.
+func copyChunks(ctx context.Context, dst io.Writer, src io.Reader, copied func(n int64)) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := io.CopyN(dst, src, copyChunkSize)
+		if n > 0 {
+			copied(n)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
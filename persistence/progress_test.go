@@ -0,0 +1,137 @@
+package persistence_test
+
+import (
+	"bytes"
+	"context"
+	"database_engine/persistence"
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syntheticDataSize is the size of the data file writeSyntheticData writes,
+// large enough to take several chunks to copy
+const syntheticDataSize = 8 << 20
+
+// writeSyntheticData fills dataDir with a data file of syntheticDataSize
+// bytes of fill and a small index file
+func writeSyntheticData(t *testing.T, dataDir string, fill byte) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "data.db"), bytes.Repeat([]byte{fill}, syntheticDataSize), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "index.db"), []byte("{}"), 0644))
+}
+
+func TestCreateFullBackupContextProgress(t *testing.T) {
+	tempDir := t.TempDir()
+	writeSyntheticData(t, tempDir, 'a')
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+
+	var reports []persistence.BackupProgress
+	metadata, err := bm.CreateFullBackupContext(context.Background(), "Progress backup", func(p persistence.BackupProgress) {
+		reports = append(reports, p)
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, reports)
+
+	// Bytes only grow, and the last report accounts for every file copied
+	var previous int64
+	for _, p := range reports {
+		assert.GreaterOrEqual(t, p.Bytes, previous)
+		assert.LessOrEqual(t, p.FileBytes, p.FileSize, p.File)
+		assert.Equal(t, metadata.DataSize, p.TotalBytes)
+		previous = p.Bytes
+	}
+	last := reports[len(reports)-1]
+	assert.Equal(t, "index.db", last.File)
+	assert.Equal(t, metadata.DataSize, last.Bytes)
+
+	dataReports := 0
+	for _, p := range reports {
+		if p.File == "data.db" {
+			dataReports++
+		}
+	}
+	assert.Equal(t, 8, dataReports)
+}
+
+func TestCreateFullBackupContextCanceled(t *testing.T) {
+	tempDir := t.TempDir()
+	writeSyntheticData(t, tempDir, 'a')
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+
+	// Cancel halfway through the data file
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var copied int64
+	_, err = bm.CreateFullBackupContext(ctx, "Canceled backup", func(p persistence.BackupProgress) {
+		copied = p.Bytes
+		if p.FileBytes >= syntheticDataSize/2 {
+			cancel()
+		}
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int64(syntheticDataSize/2), copied)
+
+	// The partial backup is gone
+	entries, err := os.ReadDir(filepath.Join(tempDir, types.BackupDirName))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+	assert.Equal(t, 0, bm.GetBackupCount())
+
+	// A context done before the backup starts stops it before any copying
+	_, err = bm.CreateFullBackupContext(ctx, "Canceled backup", nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRestoreFromBackupContextCanceled(t *testing.T) {
+	tempDir := t.TempDir()
+	writeSyntheticData(t, tempDir, 'a')
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Restore backup")
+	require.NoError(t, err)
+
+	// Replace the data after the backup
+	writeSyntheticData(t, tempDir, 'b')
+
+	// Cancel halfway through copying the backup's data file into place
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = bm.RestoreFromBackupContext(ctx, metadata.Name, func(p persistence.BackupProgress) {
+		assert.Equal(t, metadata.DataSize, p.TotalBytes)
+		if p.FileBytes >= syntheticDataSize/2 {
+			cancel()
+		}
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The live data is as it was before the restore
+	data, err := os.ReadFile(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{'b'}, syntheticDataSize), data)
+	assert.NoDirExists(t, filepath.Join(tempDir, "temp_restore"))
+
+	// Without canceling, the restore completes
+	var restored int64
+	err = bm.RestoreFromBackupContext(context.Background(), metadata.Name, func(p persistence.BackupProgress) {
+		restored = p.Bytes
+	})
+	require.NoError(t, err)
+	assert.Equal(t, metadata.DataSize, restored)
+	data, err = os.ReadFile(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{'a'}, syntheticDataSize), data)
+}
@@ -0,0 +1,45 @@
+package persistence
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// pruneIncompleteBackups removes the backup directories in the backup
+// directory whose metadata is missing or can't be read. A backup's
+// metadata is the last file written to it, so those are backups the
+// process died in the middle of making; no restore can use them. Each one
+// removed is logged and counted in GetPrunedBackupCount. Only backups made
+// by this process may be in progress when the manager is created, so a
+// backup directory must not be shared with another database.
+func (bm *BackupManager) pruneIncompleteBackups() error {
+	entries, err := bm.fs.ReadDir(bm.backupDir)
+	if err != nil {
+		return fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !backupNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		backupPath := filepath.Join(bm.backupDir, entry.Name())
+		if _, err := bm.loadBackupMetadataFromPath(backupPath); err == nil {
+			continue
+		}
+
+		if err := bm.fs.RemoveAll(backupPath); err != nil {
+			return fmt.Errorf("failed to remove incomplete backup %s: %w", entry.Name(), err)
+		}
+		bm.log.Warn("removed incomplete backup without readable metadata", "backup", entry.Name())
+		bm.pruned++
+	}
+	return nil
+}
+
+// GetPrunedBackupCount returns how many incomplete backups were removed
+// when the manager was created
+func (bm *BackupManager) GetPrunedBackupCount() int {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	return bm.pruned
+}
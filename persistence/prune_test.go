@@ -0,0 +1,59 @@
+package persistence_test
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneIncompleteBackups(t *testing.T) {
+	tempDir := t.TempDir()
+	backupDir := filepath.Join(tempDir, types.BackupDirName)
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("value")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	complete, err := bm.CreateFullBackup("complete")
+	require.NoError(t, err)
+	assert.Zero(t, bm.GetPrunedBackupCount())
+
+	// A backup the process died copying, one it died writing the metadata
+	// of, and a directory that isn't a backup
+	partial := filepath.Join(backupDir, "backup_20240101_120000.000000000")
+	require.NoError(t, os.MkdirAll(partial, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(partial, "data.db"), []byte("half a data file"), 0644))
+	torn := filepath.Join(backupDir, "backup_20240101_130000.000000000")
+	require.NoError(t, os.MkdirAll(torn, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(torn, "metadata.json"), []byte(`{"name": "backup_2024`), 0644))
+	other := filepath.Join(backupDir, "notes")
+	require.NoError(t, os.MkdirAll(other, 0755))
+
+	bm, err = persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bm.GetPrunedBackupCount())
+	assert.NoDirExists(t, partial)
+	assert.NoDirExists(t, torn)
+	assert.DirExists(t, other)
+
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, complete.Name, backups[0].Name)
+	assert.Equal(t, 1, bm.GetBackupCount())
+	require.NoError(t, bm.RestoreFromBackup(complete.Name))
+
+	// Nothing is left to prune the next time
+	bm, err = persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	assert.Zero(t, bm.GetPrunedBackupCount())
+}
@@ -0,0 +1,152 @@
+package persistence
+
+import (
+	"database_engine/types"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// QuarantinedData describes a set of data files that recovery put aside
+// before restoring over them
+type QuarantinedData struct {
+	Name    string    `json:"name"` // Directory name under the quarantine directory
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Reason  string    `json:"reason"` // The recovery that replaced the files
+	Size    int64     `json:"size"`   // Total size of the files
+}
+
+// quarantineInfoName is the file in a quarantine directory describing it
+const quarantineInfoName = "quarantine.json"
+
+// ListQuarantined returns the sets of data files recovery has put aside,
+// most recent first
+func (rm *RecoveryManager) ListQuarantined() ([]QuarantinedData, error) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+
+	return rm.listQuarantined()
+}
+
+// PurgeQuarantine removes every quarantined set of data files and returns
+// how many there were
+func (rm *RecoveryManager) PurgeQuarantine() (int, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	quarantined, err := rm.listQuarantined()
+	if err != nil {
+		return 0, err
+	}
+	for i, q := range quarantined {
+		if err := os.RemoveAll(q.Path); err != nil {
+			return i, fmt.Errorf("failed to remove quarantine %s: %w", q.Name, err)
+		}
+	}
+	return len(quarantined), nil
+}
+
+// quarantine copies the data files a restore is about to replace, the
+// same ones it would put back if it failed, into a new directory under
+// the quarantine directory, so what recovery replaced can still be looked
+// into or restored by hand. It returns the directory, or "" if there was
+// nothing to keep or Config.QuarantineRetain is 0, and removes the oldest
+// quarantines beyond the retention. The caller holds mu.
+func (rm *RecoveryManager) quarantine(reason string) (string, error) {
+	if rm.config.QuarantineRetain <= 0 || !rm.hasLiveData() {
+		return "", nil
+	}
+
+	bm := rm.backupManager
+	created := time.Now()
+	root := filepath.Join(rm.dataDir, types.QuarantineDirName)
+	name := created.Format(backupNameLayout)
+	for n := 2; bm.fileExists(filepath.Join(root, name)); n++ {
+		name = fmt.Sprintf("%s_%d", created.Format(backupNameLayout), n)
+	}
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, rm.config.DirPermissions()); err != nil {
+		return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	if err := bm.backupCurrentData(nil, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to quarantine data files: %w", err)
+	}
+
+	info := QuarantinedData{Name: name, Created: created, Reason: reason, Size: bm.backupSize(dir)}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, quarantineInfoName), data, rm.fileMode)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to record quarantine: %w", err)
+	}
+
+	quarantined, err := rm.listQuarantined()
+	if err != nil {
+		return dir, err
+	}
+	for _, q := range quarantined[min(rm.config.QuarantineRetain, len(quarantined)):] {
+		if err := os.RemoveAll(q.Path); err != nil {
+			return dir, fmt.Errorf("failed to remove quarantine %s: %w", q.Name, err)
+		}
+	}
+	return dir, nil
+}
+
+// hasLiveData reports whether the data directory holds any of the files a
+// restore replaces
+func (rm *RecoveryManager) hasLiveData() bool {
+	bm := rm.backupManager
+	for _, file := range backupFiles {
+		if bm.fileExists(bm.livePath(file)) {
+			return true
+		}
+	}
+	return bm.fileExists(filepath.Join(rm.dataDir, blobDirName))
+}
+
+// listQuarantined implements ListQuarantined. Directories without a
+// readable quarantine.json are skipped. The caller holds mu.
+func (rm *RecoveryManager) listQuarantined() ([]QuarantinedData, error) {
+	root := filepath.Join(rm.dataDir, types.QuarantineDirName)
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine directory: %w", err)
+	}
+
+	var quarantined []QuarantinedData
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(root, entry.Name())
+		data, err := os.ReadFile(filepath.Join(path, quarantineInfoName))
+		if err != nil {
+			continue
+		}
+		var info QuarantinedData
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		info.Name, info.Path = entry.Name(), path
+		quarantined = append(quarantined, info)
+	}
+
+	sort.Slice(quarantined, func(i, j int) bool {
+		if !quarantined[i].Created.Equal(quarantined[j].Created) {
+			return quarantined[i].Created.After(quarantined[j].Created)
+		}
+		return quarantined[i].Name > quarantined[j].Name
+	})
+	return quarantined, nil
+}
@@ -0,0 +1,111 @@
+package persistence_test
+
+import (
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRecoveryQuarantinesDamagedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+
+	rm, err := persistence.NewRecoveryManager(tempDir)
+	require.NoError(t, err)
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("backed_up", []byte("data")))
+	require.NoError(t, diskStorage.Close())
+	_, err = rm.CreateRecoveryPoint("before damage")
+	require.NoError(t, err)
+
+	// Neither the index nor the WAL can be used
+	damagedData, err := os.ReadFile(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	damagedWAL := []byte("KVWL\x63\x00\x00\x00")
+	hint, err := os.Stat(filepath.Join(tempDir, "index.hint"))
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(filepath.Join(tempDir, "index.db")))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, types.WALFileName), damagedWAL, 0644))
+
+	report, err := rm.PerformRecovery()
+	require.NoError(t, err)
+	require.True(t, report.BackupRecovery)
+	require.NotEmpty(t, report.Quarantine)
+	assert.Equal(t, report.Quarantine, rm.GetRecoveryState().LastQuarantine)
+
+	// The files as they were before the restore are kept for a post-mortem
+	data, err := os.ReadFile(filepath.Join(report.Quarantine, "data.db"))
+	require.NoError(t, err)
+	assert.Equal(t, damagedData, data)
+	wal, err := os.ReadFile(filepath.Join(report.Quarantine, types.WALFileName))
+	require.NoError(t, err)
+	assert.Equal(t, damagedWAL, wal)
+	assert.NoFileExists(t, filepath.Join(report.Quarantine, "index.db"))
+
+	quarantined, err := rm.ListQuarantined()
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	assert.Equal(t, report.Quarantine, quarantined[0].Path)
+	assert.Equal(t, filepath.Join(tempDir, types.QuarantineDirName, quarantined[0].Name), quarantined[0].Path)
+	assert.Contains(t, quarantined[0].Reason, report.Backup)
+	assert.Equal(t, int64(len(damagedData)+len(damagedWAL))+hint.Size(), quarantined[0].Size)
+	assert.False(t, quarantined[0].Created.IsZero())
+}
+
+func TestQuarantineRetention(t *testing.T) {
+	tempDir := t.TempDir()
+	config := types.DefaultConfig()
+	config.DataDirectory = tempDir
+	config.QuarantineRetain = 2
+
+	rm, err := persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("backed up")))
+	require.NoError(t, diskStorage.Close())
+	metadata, err := rm.CreateRecoveryPoint("retention")
+	require.NoError(t, err)
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		_, err := rm.ForceRecoveryFromBackup(metadata.Name)
+		require.NoError(t, err)
+		paths = append(paths, rm.GetRecoveryState().LastQuarantine)
+	}
+
+	// Only the newest two are kept, most recent first
+	quarantined, err := rm.ListQuarantined()
+	require.NoError(t, err)
+	require.Len(t, quarantined, 2)
+	assert.Equal(t, paths[2], quarantined[0].Path)
+	assert.Equal(t, paths[1], quarantined[1].Path)
+	assert.NoDirExists(t, paths[0])
+	assert.FileExists(t, filepath.Join(paths[2], "data.db"))
+
+	purged, err := rm.PurgeQuarantine()
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	quarantined, err = rm.ListQuarantined()
+	require.NoError(t, err)
+	assert.Empty(t, quarantined)
+	assert.NoDirExists(t, paths[2])
+
+	// With no retention nothing is quarantined
+	config.QuarantineRetain = 0
+	rm, err = persistence.NewRecoveryManagerWithConfig(config)
+	require.NoError(t, err)
+	_, err = rm.ForceRecoveryFromBackup(metadata.Name)
+	require.NoError(t, err)
+	quarantined, err = rm.ListQuarantined()
+	require.NoError(t, err)
+	assert.Empty(t, quarantined)
+}
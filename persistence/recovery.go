@@ -1,13 +1,16 @@
 package persistence
 
 import (
+	"context"
+	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/wal"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
 	"time"
 )
@@ -20,25 +23,89 @@ type RecoveryState struct {
 	RecoveryMode   string    `json:"recovery_mode"` // "auto", "manual", "backup"
 	DataIntegrity  bool      `json:"data_integrity"`
 	WALRecovery    bool      `json:"wal_recovery"`
+	WALReplayed    int       `json:"wal_replayed"` // WAL entries the last WAL recovery applied
 	BackupRecovery bool      `json:"backup_recovery"`
+	LastQuarantine string    `json:"last_quarantine,omitempty"` // Where the last restore put the files it replaced
+}
+
+// RecoveryPhase is a step of PerformRecovery
+type RecoveryPhase string
+
+const (
+	PhaseIntegrityCheck RecoveryPhase = "integrity_check" // Check the index is present and readable
+	PhaseWALReplay      RecoveryPhase = "wal_replay"      // Replay the WAL into the storage
+	PhaseBackupRestore  RecoveryPhase = "backup_restore"  // Restore the most recent backup
+)
+
+// RecoveryReport describes what a PerformRecovery, RecoverToTime or
+// ForceRecoveryFromBackup run did, or what PerformRecovery would do for
+// PerformRecoveryDryRun
+type RecoveryReport struct {
+	DryRun         bool            `json:"dry_run,omitempty"` // Nothing was changed; the report is a plan
+	Phases         []RecoveryPhase `json:"phases"`            // The phases that ran, in order
+	DataIntegrity  bool            `json:"data_integrity"`
+	WALRecovery    bool            `json:"wal_recovery"`    // The WAL was replayed
+	WALReplayed    int             `json:"wal_replayed"`    // WAL entries applied
+	WALSkipped     int             `json:"wal_skipped"`     // Corrupt WAL entries skipped under Config.WALSkipCorrupt
+	BackupRecovery bool            `json:"backup_recovery"` // A backup was restored
+	Backup         string          `json:"backup,omitempty"`
+	BackupAge      time.Duration   `json:"backup_age,omitempty"` // How old the backup was when recovery started
+	Quarantine     string          `json:"quarantine,omitempty"` // Where the data files the backup replaced were put aside
+	Started        time.Time       `json:"started"`
+	Duration       time.Duration   `json:"duration"`
+
+	// Set by ForceRecoveryFromBackup: the recovery point made of the data
+	// before it was replaced, or why none was made
+	SafetyBackup        string `json:"safety_backup,omitempty"`
+	SafetyBackupSkipped string `json:"safety_backup_skipped,omitempty"`
+
+	// Set by RecoverToTime: the time recovered to, and the LSNs and
+	// timestamp of the first and last WAL entries replayed on top of the
+	// backup, which are zero if there were none
+	TargetTime  time.Time `json:"target_time,omitempty"`
+	WALFirstLSN uint64    `json:"wal_first_lsn,omitempty"`
+	WALLastLSN  uint64    `json:"wal_last_lsn,omitempty"`
+	WALLastTime time.Time `json:"wal_last_time,omitempty"`
+
+	// Issues lists the problems ValidateDataIntegrity still finds once
+	// recovery is done
+	Issues []string `json:"issues,omitempty"`
 }
 
 // RecoveryManager handles database recovery operations
 type RecoveryManager struct {
 	dataDir       string
+	walPath       string
 	stateFile     string
+	fileMode      os.FileMode
 	mu            sync.RWMutex
 	state         *RecoveryState
 	backupManager *BackupManager
+	config        types.Config
+	storage       types.StorageEngine // Replayed into by WAL recovery, nil to open the data directory
+	log           *slog.Logger        // Config.Logger, or a logger discarding everything
 }
 
 // NewRecoveryManager creates a new recovery manager
 func NewRecoveryManager(dataDir string) (*RecoveryManager, error) {
-	stateFile := filepath.Join(dataDir, "recovery_state.json")
+	config := types.DefaultConfig()
+	config.DataDirectory = dataDir
+	return NewRecoveryManagerWithConfig(config)
+}
+
+// NewRecoveryManagerWithConfig creates a new recovery manager for the file
+// layout in config
+func NewRecoveryManagerWithConfig(config types.Config) (*RecoveryManager, error) {
+	dataDir := config.DataDirectory
+	stateFile := filepath.Join(dataDir, recoveryStateName)
 
 	rm := &RecoveryManager{
 		dataDir:   dataDir,
+		walPath:   config.WALFilePath(),
 		stateFile: stateFile,
+		fileMode:  config.FilePermissions(),
+		config:    config,
+		log:       types.LoggerOrDiscard(config.Logger),
 		state: &RecoveryState{
 			RecoveryMode: "auto",
 		},
@@ -53,7 +120,7 @@ func NewRecoveryManager(dataDir string) (*RecoveryManager, error) {
 	}
 
 	// Initialize backup manager
-	backupManager, err := NewBackupManager(dataDir)
+	backupManager, err := NewBackupManagerWithConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create backup manager: %w", err)
 	}
@@ -62,74 +129,145 @@ func NewRecoveryManager(dataDir string) (*RecoveryManager, error) {
 	return rm, nil
 }
 
-// PerformRecovery performs automatic recovery based on available data
-func (rm *RecoveryManager) PerformRecovery() error {
+// SetStorage makes WAL recovery replay into storage, which is open on the
+// data directory, instead of opening the data directory itself. A database
+// sets the storage it has open, which mustn't be opened a second time.
+func (rm *RecoveryManager) SetStorage(storage types.StorageEngine) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
-	rm.state.RecoveryCount++
-	rm.state.LastRecovery = time.Now()
+	rm.storage = storage
+}
+
+// PerformRecovery performs automatic recovery based on available data and
+// reports what it did. The index is checked first; the WAL is replayed
+// either way, and if the index is damaged and the replay fails the most
+// recent backup is restored. The recovery state is updated from the report.
+func (rm *RecoveryManager) PerformRecovery() (*RecoveryReport, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	report := &RecoveryReport{Started: time.Now()}
 
 	// Check data integrity
+	report.Phases = append(report.Phases, PhaseIntegrityCheck)
 	if err := rm.checkDataIntegrity(); err != nil {
-		rm.state.DataIntegrity = false
-		
+		rm.log.Warn("data integrity check failed, recovering", "dir", rm.dataDir, "error", err)
 		// Try WAL recovery first
-		if rm.state.WALRecovery = rm.tryWALRecovery(); !rm.state.WALRecovery {
+		if !rm.tryWALRecovery(report) {
 			// Try backup recovery
-			if rm.state.BackupRecovery = rm.tryBackupRecovery(); !rm.state.BackupRecovery {
+			if !rm.tryBackupRecovery(report) {
 				// If all recovery methods failed, it might be an empty directory
 				// This is not necessarily an error for a new database
-				rm.state.DataIntegrity = true // Mark as valid for empty state
+				report.DataIntegrity = true // Mark as valid for empty state
 			}
 		}
 	} else {
-		rm.state.DataIntegrity = true
+		report.DataIntegrity = true
 		// Still try WAL recovery for consistency
-		rm.state.WALRecovery = rm.tryWALRecovery()
+		rm.tryWALRecovery(report)
 	}
 
+	report.Issues = rm.validateDataIntegrity()
+	report.Duration = time.Since(report.Started)
+
 	// Save recovery state
+	rm.state.record(report)
 	if err := rm.saveRecoveryState(); err != nil {
-		return fmt.Errorf("failed to save recovery state: %w", err)
+		return report, fmt.Errorf("failed to save recovery state: %w", err)
 	}
 
-	return nil
+	return report, nil
 }
 
-// ForceRecoveryFromBackup forces recovery from a specific backup
-func (rm *RecoveryManager) ForceRecoveryFromBackup(backupName string) error {
+// record updates the state with what a recovery reported
+func (state *RecoveryState) record(report *RecoveryReport) {
+	state.RecoveryCount++
+	state.LastRecovery = report.Started
+	state.DataIntegrity = report.DataIntegrity
+	state.WALRecovery = report.WALRecovery
+	state.WALReplayed = report.WALReplayed
+	state.BackupRecovery = report.BackupRecovery
+	if report.Backup != "" {
+		state.LastBackup = report.Backup
+	}
+	if report.Quarantine != "" {
+		state.LastQuarantine = report.Quarantine
+	}
+}
+
+// ForceRecoveryFromBackup forces recovery from a specific backup and
+// reports what it did. The current data is saved as a recovery point
+// first, so restoring the wrong backup can be undone, and the data files
+// it replaces are quarantined. Data too damaged to be backed up is
+// restored over anyway, with the reason the recovery point was skipped in
+// the report. A backup that can't be restored fails it with
+// ErrRecoveryFailed wrapping the cause.
+func (rm *RecoveryManager) ForceRecoveryFromBackup(backupName string) (*RecoveryReport, error) {
 	rm.mu.Lock()
 	defer rm.mu.Unlock()
 
-	rm.state.RecoveryMode = "backup"
-	rm.state.LastBackup = backupName
-	rm.state.RecoveryCount++
-	rm.state.LastRecovery = time.Now()
+	// A name that was mistyped fails before anything is backed up
+	backup, err := rm.backupManager.GetBackupInfo(backupName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRecoveryFailed, err)
+	}
+
+	report := &RecoveryReport{Started: time.Now()}
+	if !rm.hasLiveData() {
+		report.SafetyBackupSkipped = "no data to back up"
+	} else if metadata, err := rm.createRecoveryPoint(fmt.Sprintf("before forced recovery from backup %s", backupName)); err != nil {
+		report.SafetyBackupSkipped = fmt.Sprintf("current data could not be backed up: %v", err)
+	} else {
+		report.SafetyBackup = metadata.Name
+	}
+
+	quarantine, err := rm.quarantine(fmt.Sprintf("forced recovery from backup %s", backupName))
+	if err != nil {
+		return report, err
+	}
+	report.Quarantine = quarantine
 
 	// Restore from backup
+	report.Phases = append(report.Phases, PhaseBackupRestore)
 	if err := rm.backupManager.RestoreFromBackup(backupName); err != nil {
-		return fmt.Errorf("failed to restore from backup: %w", err)
+		return report, fmt.Errorf("%w: failed to restore from backup: %w", ErrRecoveryFailed, err)
 	}
+	report.BackupRecovery = true
+	report.Backup = backupName
+	report.BackupAge = report.Started.Sub(backup.Timestamp)
+	report.DataIntegrity = true
+	report.Issues = rm.validateDataIntegrity()
+	report.Duration = time.Since(report.Started)
 
-	rm.state.BackupRecovery = true
-	rm.state.DataIntegrity = true
+	rm.state.RecoveryMode = "backup"
+	rm.state.record(report)
 
 	// Save recovery state
 	if err := rm.saveRecoveryState(); err != nil {
-		return fmt.Errorf("failed to save recovery state: %w", err)
+		return report, fmt.Errorf("failed to save recovery state: %w", err)
 	}
 
-	return nil
+	return report, nil
 }
 
-// CreateRecoveryPoint creates a recovery point (backup) before risky operations
+// CreateRecoveryPoint creates a recovery point (backup) before risky
+// operations, with description as its reason and tagged with BackupTagKind
+// BackupKindRecoveryPoint
 func (rm *RecoveryManager) CreateRecoveryPoint(description string) (*BackupMetadata, error) {
 	rm.mu.RLock()
 	defer rm.mu.RUnlock()
 
-	desc := fmt.Sprintf("Recovery point: %s", description)
-	return rm.backupManager.CreateFullBackup(desc)
+	return rm.createRecoveryPoint(description)
+}
+
+// createRecoveryPoint implements CreateRecoveryPoint. The caller holds mu.
+func (rm *RecoveryManager) createRecoveryPoint(description string) (*BackupMetadata, error) {
+	return rm.backupManager.CreateFullBackupWithOptions(context.Background(), BackupOptions{
+		Description: fmt.Sprintf("Recovery point: %s", description),
+		Reason:      description,
+		Tags:        map[string]string{BackupTagKind: BackupKindRecoveryPoint},
+	}, nil)
 }
 
 // GetRecoveryState returns the current recovery state
@@ -176,6 +314,14 @@ func (rm *RecoveryManager) ValidateDataIntegrity() (bool, []string, error) {
 	rm.mu.RLock()
 	defer rm.mu.RUnlock()
 
+	issues := rm.validateDataIntegrity()
+	isValid := len(issues) == 0
+	return isValid, issues, nil
+}
+
+// validateDataIntegrity implements ValidateDataIntegrity. The caller holds
+// mu.
+func (rm *RecoveryManager) validateDataIntegrity() []string {
 	var issues []string
 
 	// Check if data files exist and are readable
@@ -192,6 +338,14 @@ func (rm *RecoveryManager) ValidateDataIntegrity() (bool, []string, error) {
 	// Check index consistency
 	if err := rm.checkIndexConsistency(); err != nil {
 		issues = append(issues, fmt.Sprintf("Index consistency issue: %v", err))
+	} else if _, err := os.Stat(filepath.Join(rm.dataDir, "data.db")); err == nil {
+		// Scan the data file and check every index entry resolves to a record
+		report, err := storage.CheckIntegrityWithConfig(rm.config)
+		if err != nil {
+			issues = append(issues, fmt.Sprintf("Data file scan failed: %v", err))
+		} else {
+			issues = append(issues, report.Issues()...)
+		}
 	}
 
 	// Check WAL consistency
@@ -199,8 +353,7 @@ func (rm *RecoveryManager) ValidateDataIntegrity() (bool, []string, error) {
 		issues = append(issues, fmt.Sprintf("WAL consistency issue: %v", err))
 	}
 
-	isValid := len(issues) == 0
-	return isValid, issues, nil
+	return issues
 }
 
 // Helper methods
@@ -217,7 +370,7 @@ func (rm *RecoveryManager) loadRecoveryState() error {
 }
 
 func (rm *RecoveryManager) saveRecoveryState() error {
-	file, err := os.Create(rm.stateFile)
+	file, err := os.OpenFile(rm.stateFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, rm.fileMode)
 	if err != nil {
 		return err
 	}
@@ -245,16 +398,14 @@ func (rm *RecoveryManager) checkDataIntegrity() error {
 func (rm *RecoveryManager) checkIndexConsistency() error {
 	indexPath := filepath.Join(rm.dataDir, "index.db")
 
-	file, err := os.Open(indexPath)
+	data, err := os.ReadFile(indexPath)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	// Try to decode the index
-	var index map[types.Key]int64
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&index); err != nil {
+	// Try to decode the index and verify its checksum
+	index, err := storage.DecodeIndex(data)
+	if err != nil {
 		return fmt.Errorf("index file corrupted: %w", err)
 	}
 
@@ -267,9 +418,7 @@ func (rm *RecoveryManager) checkIndexConsistency() error {
 }
 
 func (rm *RecoveryManager) checkWALConsistency() error {
-	walPath := filepath.Join(rm.dataDir, "wal.log")
-
-	file, err := os.Open(walPath)
+	file, err := os.Open(rm.walPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil // WAL file doesn't exist, that's okay
@@ -300,52 +449,128 @@ func (rm *RecoveryManager) checkWALConsistency() error {
 	return nil
 }
 
-func (rm *RecoveryManager) tryWALRecovery() bool {
-	walPath := filepath.Join(rm.dataDir, "wal.log")
-
+// tryWALRecovery replays the WAL entries after the last checkpoint into
+// the storage and adds what it applied and skipped to report. It fails, so
+// backup recovery is tried next, if there is no WAL or the replay fails.
+func (rm *RecoveryManager) tryWALRecovery(report *RecoveryReport) bool {
 	// Check if WAL file exists
-	if _, err := os.Stat(walPath); os.IsNotExist(err) {
+	if _, err := os.Stat(rm.walPath); os.IsNotExist(err) {
 		return false // No WAL to recover from
 	}
 
-	// In a real implementation, you would replay the WAL here
-	// For now, we'll just check if the file is readable
-	file, err := os.Open(walPath)
+	report.Phases = append(report.Phases, PhaseWALReplay)
+	replayed, skipped, err := rm.replayWAL()
+	report.WALSkipped = skipped
+	if skipped > 0 {
+		rm.log.Warn("skipped corrupt WAL entries during recovery", "skipped", skipped)
+	}
 	if err != nil {
+		rm.log.Error("WAL recovery failed", "error", err)
 		return false
 	}
-	defer file.Close()
 
-	// Try to read at least one entry
-	var length uint32
-	if err := readUint32(file, &length); err != nil {
-		return false
+	report.WALRecovery = true
+	report.WALReplayed = replayed
+	if replayed > 0 {
+		rm.log.Info("recovered from WAL", "replayed", replayed)
 	}
-
 	return true
 }
 
-func (rm *RecoveryManager) tryBackupRecovery() bool {
-	// Get available backups
-	backups, err := rm.backupManager.ListBackups()
-	if err != nil || len(backups) == 0 {
-		return false
+// replayWAL replays the WAL and returns how many entries it applied and
+// how many corrupt ones it skipped. An open DiskStorage replays its own
+// WAL. Without a storage the data directory is opened with the WAL
+// disabled, so the replayed operations aren't logged again, and the WAL is
+// checkpointed once they are synced.
+func (rm *RecoveryManager) replayWAL() (int, int, error) {
+	if diskStorage, ok := rm.storage.(*storage.DiskStorage); ok {
+		before, err := diskStorage.GetWALStats()
+		if err != nil {
+			return 0, 0, err
+		}
+		replayed, err := diskStorage.ReplayWAL()
+		after, _ := diskStorage.GetWALStats()
+		return replayed, int(after.CorruptSkipped - before.CorruptSkipped), err
 	}
 
-	// Sort backups by timestamp (most recent first)
-	sort.Slice(backups, func(i, j int) bool {
-		return backups[i].Timestamp.After(backups[j].Timestamp)
+	w, err := wal.NewWALWithOptions(rm.walPath, wal.Options{
+		MaxSize:      rm.config.MaxWALSize,
+		SkipCorrupt:  rm.config.WALSkipCorrupt,
+		MaxKeySize:   rm.config.MaxKeySize,
+		MaxValueSize: rm.config.MaxValueSize,
 	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer w.Close()
+
+	before := w.Stats().CorruptSkipped
+	entries, err := w.ReadEntries()
+	skipped := int(w.Stats().CorruptSkipped - before)
+	if err != nil {
+		return 0, skipped, fmt.Errorf("failed to read WAL entries: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return 0, skipped, nil
+	}
+	if rm.storage != nil {
+		return len(entries), skipped, wal.Replay(entries, rm.storage)
+	}
+
+	config := rm.config
+	config.EnablePersistence = true
+	config.WALEnabled = false
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	if err != nil {
+		return 0, skipped, fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer diskStorage.Close()
+
+	if err := wal.Replay(entries, diskStorage); err != nil {
+		return 0, skipped, err
+	}
+	if err := diskStorage.Sync(); err != nil {
+		return 0, skipped, fmt.Errorf("failed to sync replayed WAL entries: %w", err)
+	}
+	if err := w.Checkpoint(); err != nil {
+		return 0, skipped, fmt.Errorf("failed to checkpoint replayed WAL: %w", err)
+	}
+
+	return len(entries), skipped, nil
+}
+
+// tryBackupRecovery quarantines the data files, restores the most recent
+// backup and records its name and the quarantine in report. It fails if
+// there is no backup or the quarantine or restore does.
+func (rm *RecoveryManager) tryBackupRecovery(report *RecoveryReport) bool {
+	// Get the most recent backup
+	backups, err := rm.backupManager.ListBackupsWithFilter(BackupFilter{Limit: 1})
+	if err != nil || len(backups) == 0 {
+		return false
+	}
+	report.Phases = append(report.Phases, PhaseBackupRestore)
 
 	// Try to restore from the most recent backup
-	latestBackup := backups[0]
-	backupName := fmt.Sprintf("backup_%s", latestBackup.Timestamp.Format("20060102_150405"))
+	backupName := backups[0].Name
+
+	// The damaged files are kept for a post-mortem
+	quarantine, err := rm.quarantine(fmt.Sprintf("automatic recovery from backup %s", backupName))
+	if err != nil {
+		rm.log.Error("backup recovery failed", "backup", backupName, "error", err)
+		return false
+	}
+	report.Quarantine = quarantine
 
 	if err := rm.backupManager.RestoreFromBackup(backupName); err != nil {
+		rm.log.Error("backup recovery failed", "backup", backupName, "error", err)
 		return false
 	}
 
-	rm.state.LastBackup = backupName
+	report.BackupRecovery = true
+	report.Backup = backupName
+	report.BackupAge = report.Started.Sub(backups[0].Timestamp)
+	rm.log.Warn("recovered damaged data from backup", "backup", backupName, "backup_age", report.BackupAge, "quarantine", quarantine)
 	return true
 }
 
@@ -0,0 +1,271 @@
+package persistence
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database_engine/vfs"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// streamMetadataName is the name of the last entry of a backup stream,
+// which holds its metadata
+const streamMetadataName = "metadata.json"
+
+// streamRestoreDir is the data directory subdirectory RestoreBackup
+// unpacks a stream into before restoring it
+const streamRestoreDir = "stream_restore"
+
+// WriteBackup streams a full backup of the database to w, without making a
+// copy in the backup directory, and returns its metadata. The stream is a
+// tar archive of the files CreateFullBackup copies, under the names they
+// have in a backup directory, followed by metadata.json with the digest of
+// each file as it was streamed. RestoreBackup reads it back. The backup
+// doesn't count towards GetBackupCount or GetLastBackup, which describe the
+// backup directory.
+func (bm *BackupManager) WriteBackup(w io.Writer, description string) (*BackupMetadata, error) {
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+
+	return bm.writeBackup(w, description)
+}
+
+// writeBackup streams a full backup to w. The caller holds bm.mu.
+func (bm *BackupManager) writeBackup(w io.Writer, description string) (*BackupMetadata, error) {
+	metadata := &BackupMetadata{
+		Timestamp:   time.Now(),
+		Version:     "1.0.0",
+		BackupType:  "full",
+		Description: description,
+		Files:       make(map[string]string),
+		Sizes:       make(map[string]int64),
+	}
+
+	// Count the entries before the index is streamed, as near its copy as
+	// a backup directory's count is
+	if indexPath := bm.livePath("index.db"); bm.fileExists(indexPath) {
+		if count, err := bm.countEntriesFromIndex(indexPath); err == nil {
+			metadata.EntryCount = count
+		}
+	}
+
+	files, err := bm.liveFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files to back up: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		if err := bm.writeStreamFile(tw, bm.livePath(file), file, metadata); err != nil {
+			return nil, fmt.Errorf("failed to stream %s: %w", file, err)
+		}
+	}
+
+	// Stream values spilled to blob files
+	blobDir := filepath.Join(bm.dataDir, blobDirName)
+	entries, err := bm.fs.ReadDir(blobDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		name := path.Join(blobDirName, entry.Name())
+		if err := bm.writeStreamFile(tw, filepath.Join(blobDir, entry.Name()), name, metadata); err != nil {
+			return nil, fmt.Errorf("failed to stream %s: %w", name, err)
+		}
+	}
+
+	// The size checksum legacy restores compare, as calculateChecksum
+	// would compute it for a backup directory
+	metadata.Checksum = fmt.Sprintf("%x", metadata.DataSize)
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal backup metadata: %w", err)
+	}
+	header := &tar.Header{
+		Name:     streamMetadataName,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  metadata.Timestamp,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to stream backup metadata: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to stream backup metadata: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish backup stream: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// writeStreamFile writes the file at srcPath to tw as the entry name and
+// records its size and digest in metadata. A file that grows while it is
+// streamed is cut at the size it had when it was opened.
+func (bm *BackupManager) writeStreamFile(tw *tar.Writer, srcPath, name string, metadata *BackupMetadata) error {
+	file, err := vfs.Open(bm.fs, srcPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, hash), file, info.Size()); err != nil {
+		return err
+	}
+
+	metadata.Files[name] = hex.EncodeToString(hash.Sum(nil))
+	metadata.Sizes[name] = info.Size()
+	metadata.DataSize += info.Size()
+	return nil
+}
+
+// RestoreBackup restores the database from a backup stream written by
+// WriteBackup and returns its metadata. The stream is unpacked into a
+// directory next to the data files first, since its digests only arrive at
+// its end, and restored from there once every file checks out, like
+// RestoreFromBackup. A truncated or damaged stream leaves the live data
+// alone. A stream written by WriteEncryptedBackup fails with
+// ErrBackupEncrypted.
+func (bm *BackupManager) RestoreBackup(r io.Reader) (*BackupMetadata, error) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	br := bufio.NewReader(r)
+	if isEncryptedStream(br) {
+		return nil, ErrBackupEncrypted
+	}
+	return bm.restoreStream(br, nil)
+}
+
+// restoreStream unpacks the backup stream r and restores it. finish, if
+// not nil, is called once the archive has been read and must succeed for
+// the restore to go ahead. The caller holds bm.mu.
+func (bm *BackupManager) restoreStream(r io.Reader, finish func() error) (*BackupMetadata, error) {
+	// Clear out what an interrupted restore left behind
+	stagingPath := filepath.Join(bm.dataDir, streamRestoreDir)
+	if err := bm.fs.RemoveAll(stagingPath); err != nil {
+		return nil, fmt.Errorf("failed to clear restore directory: %w", err)
+	}
+	if err := bm.fs.MkdirAll(stagingPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer bm.fs.RemoveAll(stagingPath)
+
+	metadata, err := bm.readStream(r, stagingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup stream: %w", err)
+	}
+	if finish != nil {
+		if err := finish(); err != nil {
+			return nil, fmt.Errorf("failed to read backup stream: %w", err)
+		}
+	}
+
+	if err := bm.restore(context.Background(), nil, stagingPath, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// readStream unpacks the backup stream r into dir, metadata.json included,
+// and returns the stream's metadata
+func (bm *BackupManager) readStream(r io.Reader, dir string) (*BackupMetadata, error) {
+	tr := tar.NewReader(r)
+	var metadata *BackupMetadata
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if metadata != nil {
+			return nil, fmt.Errorf("unexpected entry %s after %s", header.Name, streamMetadataName)
+		}
+		if header.Typeflag != tar.TypeReg || !isStreamEntry(header.Name) {
+			return nil, fmt.Errorf("unexpected entry %s", header.Name)
+		}
+
+		if header.Name == streamMetadataName {
+			metadata = &BackupMetadata{}
+			if err := json.NewDecoder(tr).Decode(metadata); err != nil {
+				return nil, fmt.Errorf("failed to decode backup metadata: %w", err)
+			}
+			if err := bm.saveBackupMetadata(dir, metadata); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := bm.unpackStreamFile(tr, filepath.Join(dir, filepath.FromSlash(header.Name))); err != nil {
+			return nil, fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+		}
+	}
+
+	if metadata == nil {
+		return nil, fmt.Errorf("stream ends without %s", streamMetadataName)
+	}
+	return metadata, nil
+}
+
+// unpackStreamFile writes the contents of the current entry of tr to dst
+func (bm *BackupManager) unpackStreamFile(tr *tar.Reader, dst string) error {
+	if err := bm.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	file, err := vfs.Create(bm.fs, dst)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, tr)
+	return err
+}
+
+// isStreamEntry reports whether name is one a backup stream may hold: a
+// backup file, a blob or the metadata. Anything else, a path leading out
+// of the restore directory in particular, is refused.
+func isStreamEntry(name string) bool {
+	if name == streamMetadataName || isBackupFile(name) {
+		return true
+	}
+
+	dir, file := path.Split(name)
+	return dir == blobDirName+"/" && file != "" && file != "." && file != ".."
+}
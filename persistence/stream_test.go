@@ -0,0 +1,213 @@
+package persistence_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowReader hands out at most chunk bytes per Read and pauses before each,
+// like a consumer on a slow link
+type slowReader struct {
+	r     io.Reader
+	chunk int
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	if len(p) > s.chunk {
+		p = p[:s.chunk]
+	}
+	return s.r.Read(p)
+}
+
+// writeStreamTestData fills the data directory of config with an entry per
+// key, the last one large enough to be spilled to a blob file
+func writeStreamTestData(t *testing.T, config types.Config, keys ...types.Key) {
+	t.Helper()
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	for _, key := range keys[:len(keys)-1] {
+		require.NoError(t, diskStorage.Set(key, types.Value("value of "+key)))
+	}
+	require.NoError(t, diskStorage.Set(keys[len(keys)-1], bytes.Repeat([]byte("b"), 4096)))
+	require.NoError(t, diskStorage.Close())
+}
+
+func streamTestConfig(t *testing.T) types.Config {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = t.TempDir()
+	config.WALEnabled = true
+	config.BlobThreshold = 1024
+	return config
+}
+
+func TestWriteBackupToBuffer(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "beta", "blob")
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	metadata, err := bm.WriteBackup(&buf, "Streamed backup")
+	require.NoError(t, err)
+	assert.Equal(t, "Streamed backup", metadata.Description)
+	assert.Equal(t, int64(3), metadata.EntryCount)
+	assert.Contains(t, metadata.Files, "data.db")
+	assert.Contains(t, metadata.Files, "index.db")
+	assert.Contains(t, metadata.Files, types.WALFileName)
+
+	// Nothing is left in the backup directory
+	assert.Equal(t, 0, bm.GetBackupCount())
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+
+	// The stream holds the files, blobs included, then the metadata
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	require.NotEmpty(t, names)
+	assert.Equal(t, "metadata.json", names[len(names)-1])
+	blobs := 0
+	for _, name := range names {
+		if strings.HasPrefix(name, "blobs/") {
+			blobs++
+		}
+	}
+	assert.Equal(t, 1, blobs)
+	assert.Len(t, metadata.Files, len(names)-1)
+
+	// Change the data, then restore the stream over it
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("modified", []byte("new data")))
+	require.NoError(t, diskStorage.Delete("alpha"))
+	require.NoError(t, diskStorage.Close())
+
+	restored, err := bm.RestoreBackup(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, metadata.Files, restored.Files)
+	assert.Equal(t, metadata.Timestamp.Unix(), restored.Timestamp.Unix())
+	assert.NoDirExists(t, filepath.Join(config.DataDirectory, "stream_restore"))
+
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("alpha")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value of alpha"), value)
+	value, err = diskStorage.Get("blob")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(bytes.Repeat([]byte("b"), 4096)), value)
+	_, err = diskStorage.Get("modified")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+}
+
+func TestWriteBackupThroughPipe(t *testing.T) {
+	source := streamTestConfig(t)
+	writeStreamTestData(t, source, "alpha", "beta", "blob")
+	target := streamTestConfig(t)
+	writeStreamTestData(t, target, "other", "blob")
+
+	sourceBM, err := persistence.NewBackupManagerWithConfig(source)
+	require.NoError(t, err)
+	targetBM, err := persistence.NewBackupManagerWithConfig(target)
+	require.NoError(t, err)
+
+	// The writer can only get ahead of the slow reader by the pipe, which
+	// has no buffer, so both sides run at the reader's pace
+	pr, pw := io.Pipe()
+	written := make(chan *persistence.BackupMetadata, 1)
+	go func() {
+		metadata, err := sourceBM.WriteBackup(pw, "Piped backup")
+		pw.CloseWithError(err)
+		written <- metadata
+	}()
+
+	restored, err := targetBM.RestoreBackup(&slowReader{r: pr, chunk: 512, delay: time.Millisecond})
+	require.NoError(t, err)
+	metadata := <-written
+	require.NotNil(t, metadata)
+	assert.Equal(t, metadata.Files, restored.Files)
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(target)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	keys, err := diskStorage.Keys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []types.Key{"alpha", "beta", "blob"}, keys)
+}
+
+func TestRestoreBackupRejectsDamagedStream(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "blob")
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = bm.WriteBackup(&buf, "Damaged backup")
+	require.NoError(t, err)
+	stream := buf.Bytes()
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("modified", []byte("new data")))
+	require.NoError(t, diskStorage.Close())
+
+	// Cut before the metadata
+	_, err = bm.RestoreBackup(bytes.NewReader(stream[:len(stream)/2]))
+	assert.Error(t, err)
+
+	// A byte of the first file's contents, which follow its 512-byte header,
+	// flipped
+	damaged := bytes.Clone(stream)
+	damaged[512] ^= 0xFF
+	_, err = bm.RestoreBackup(bytes.NewReader(damaged))
+	assert.ErrorIs(t, err, persistence.ErrBackupCorrupt)
+
+	// An entry that would land outside the data directory
+	var escape bytes.Buffer
+	tw := tar.NewWriter(&escape)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}))
+	_, err = tw.Write([]byte("x"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	_, err = bm.RestoreBackup(&escape)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected entry")
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(config.DataDirectory), "outside"))
+
+	// The live data is untouched by all of them
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("modified")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("new data"), value)
+}
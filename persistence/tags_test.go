@@ -0,0 +1,82 @@
+package persistence_test
+
+import (
+	"context"
+	"database_engine/persistence"
+	"database_engine/storage"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindBackupsByTags(t *testing.T) {
+	tempDir := t.TempDir()
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("value")))
+	require.NoError(t, diskStorage.Close())
+
+	bm, err := persistence.NewBackupManager(tempDir)
+	require.NoError(t, err)
+	rm, err := persistence.NewRecoveryManager(tempDir)
+	require.NoError(t, err)
+
+	nightly, err := bm.CreateFullBackup("Nightly backup")
+	require.NoError(t, err)
+	migration, err := bm.CreateFullBackupWithOptions(context.Background(), persistence.BackupOptions{
+		Description: "Before the v2 migration",
+		Reason:      "schema change",
+		Tags:        map[string]string{"release": "v2", "env": "prod"},
+	}, nil)
+	require.NoError(t, err)
+	since := tick()
+	point, err := rm.CreateRecoveryPoint("before compaction")
+	require.NoError(t, err)
+
+	assert.Equal(t, "schema change", migration.Reason)
+	assert.Equal(t, map[string]string{persistence.BackupTagKind: persistence.BackupKindRecoveryPoint}, point.Tags)
+	assert.Equal(t, "before compaction", point.Reason)
+
+	names := func(filter persistence.BackupFilter) []string {
+		backups, err := bm.FindBackups(filter)
+		require.NoError(t, err)
+		var names []string
+		for _, backup := range backups {
+			names = append(names, backup.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{migration.Name}, names(persistence.BackupFilter{Tags: map[string]string{"release": "v2"}}))
+	assert.Equal(t, []string{migration.Name}, names(persistence.BackupFilter{Tags: map[string]string{"release": "v2", "env": "prod"}}))
+	assert.Empty(t, names(persistence.BackupFilter{Tags: map[string]string{"release": "v2", "env": "staging"}}))
+	assert.Equal(t, []string{point.Name}, names(persistence.BackupFilter{
+		Tags: map[string]string{persistence.BackupTagKind: persistence.BackupKindRecoveryPoint},
+	}))
+	assert.Equal(t, []string{migration.Name}, names(persistence.BackupFilter{Description: "v2 migration"}))
+	assert.Equal(t, []string{point.Name}, names(persistence.BackupFilter{Since: since}))
+	assert.Equal(t, []string{migration.Name, nightly.Name}, names(persistence.BackupFilter{Until: since}))
+
+	// Metadata written before tags were recorded still parses, without any
+	legacy, err := json.Marshal(map[string]any{
+		"timestamp":   nightly.Timestamp,
+		"version":     "1.0.0",
+		"backup_type": "full",
+		"description": "Nightly backup",
+		"checksum":    nightly.Checksum,
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "backups", nightly.Name, "metadata.json"), legacy, 0644))
+
+	info, err := bm.GetBackupInfo(nightly.Name)
+	require.NoError(t, err)
+	assert.Empty(t, info.Tags)
+	assert.Empty(t, info.Reason)
+	assert.Equal(t, []string{nightly.Name}, names(persistence.BackupFilter{Description: "Nightly"}))
+	assert.Empty(t, names(persistence.BackupFilter{Description: "Nightly", Tags: map[string]string{"release": "v2"}}))
+}
@@ -0,0 +1,125 @@
+package persistence_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database_engine/persistence"
+	"database_engine/storage"
+	"database_engine/types"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteBackupFile replaces a file of a backup and records its new digest,
+// as though the backup had been made with it
+func rewriteBackupFile(t *testing.T, backupPath, name string, data []byte) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(filepath.Join(backupPath, name), data, 0644))
+
+	metadataPath := filepath.Join(backupPath, "metadata.json")
+	raw, err := os.ReadFile(metadataPath)
+	require.NoError(t, err)
+	var metadata persistence.BackupMetadata
+	require.NoError(t, json.Unmarshal(raw, &metadata))
+	digest := sha256.Sum256(data)
+	metadata.Files[name] = hex.EncodeToString(digest[:])
+	raw, err = json.Marshal(metadata)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metadataPath, raw, 0644))
+}
+
+func TestVerifyBackupDeep(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "beta", "blob")
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Verified backup")
+	require.NoError(t, err)
+
+	verification, err := bm.VerifyBackup(metadata.Name, false)
+	require.NoError(t, err)
+	assert.True(t, verification.Healthy(), verification.Discrepancies)
+	assert.False(t, verification.Deep)
+	assert.Equal(t, len(metadata.Files), verification.FilesChecked)
+	assert.Equal(t, 0, verification.EntriesRead)
+
+	verification, err = bm.VerifyBackup(metadata.Name, true)
+	require.NoError(t, err)
+	assert.True(t, verification.Healthy(), verification.Discrepancies)
+	assert.True(t, verification.Deep)
+	assert.Equal(t, int64(3), verification.EntryCount)
+	assert.Equal(t, 3, verification.IndexEntries)
+	assert.Equal(t, 3, verification.EntriesRead)
+
+	// The scratch copy is gone and isn't listed as a backup
+	backupDir := filepath.Join(config.DataDirectory, types.BackupDirName)
+	assert.NoDirExists(t, filepath.Join(backupDir, "scratch_restore"))
+	backups, err := bm.ListBackups()
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	_, err = bm.VerifyBackup("backup_missing", true)
+	assert.Error(t, err)
+}
+
+func TestVerifyBackupDeepFindsDamage(t *testing.T) {
+	config := streamTestConfig(t)
+	writeStreamTestData(t, config, "alpha", "beta", "blob")
+
+	bm, err := persistence.NewBackupManagerWithConfig(config)
+	require.NoError(t, err)
+	metadata, err := bm.CreateFullBackup("Damaged backup")
+	require.NoError(t, err)
+	backupPath := filepath.Join(config.DataDirectory, types.BackupDirName, metadata.Name)
+
+	// A value damaged before the backup was made, so every digest matches
+	// and only reading the data back finds it
+	data, err := os.ReadFile(filepath.Join(backupPath, "data.db"))
+	require.NoError(t, err)
+	at := bytes.Index(data, []byte("value of alpha"))
+	require.Positive(t, at)
+	data[at] ^= 0xFF
+	rewriteBackupFile(t, backupPath, "data.db", data)
+
+	verification, err := bm.VerifyBackup(metadata.Name, false)
+	require.NoError(t, err)
+	assert.True(t, verification.Healthy(), verification.Discrepancies)
+
+	verification, err = bm.VerifyBackup(metadata.Name, true)
+	require.NoError(t, err)
+	assert.False(t, verification.Healthy())
+	assert.Equal(t, 2, verification.EntriesRead)
+	assert.NotEmpty(t, verification.Discrepancies)
+
+	// Metadata that miscounts the entries
+	metadataPath := filepath.Join(backupPath, "metadata.json")
+	raw, err := os.ReadFile(metadataPath)
+	require.NoError(t, err)
+	var recorded persistence.BackupMetadata
+	require.NoError(t, json.Unmarshal(raw, &recorded))
+	recorded.EntryCount = 5
+	raw, err = json.Marshal(recorded)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metadataPath, raw, 0644))
+
+	verification, err = bm.VerifyBackup(metadata.Name, true)
+	require.NoError(t, err)
+	assert.Contains(t, verification.Discrepancies, "index holds 3 entries, metadata records 5")
+
+	// The live data is untouched throughout
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err := diskStorage.Get("alpha")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value of alpha"), value)
+}
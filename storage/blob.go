@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// blobDirName is the data directory subdirectory holding spilled values
+const blobDirName = "blobs"
+
+// ErrBlobChecksumMismatch is returned when a blob file doesn't match the
+// size and digest recorded in its data file reference
+var ErrBlobChecksumMismatch = fmt.Errorf("%w: blob checksum mismatch", ErrCorruptRecord)
+
+// blobRef is what a data file record stores in place of a spilled value.
+// Blobs are content-addressed: the file name is the hex SHA-256 of the
+// value, so the digest doubles as the path and the checksum.
+type blobRef struct {
+	digest [sha256.Size]byte
+	size   uint64
+}
+
+const blobRefSize = sha256.Size + 8
+
+func newBlobRef(value []byte) blobRef {
+	return blobRef{digest: sha256.Sum256(value), size: uint64(len(value))}
+}
+
+// name returns the blob's file name inside the blobs directory
+func (r blobRef) name() string {
+	return hex.EncodeToString(r.digest[:])
+}
+
+func (r blobRef) encode() []byte {
+	buf := make([]byte, 0, blobRefSize)
+	buf = append(buf, r.digest[:]...)
+	return binary.LittleEndian.AppendUint64(buf, r.size)
+}
+
+func decodeBlobRef(data []byte) (blobRef, error) {
+	var ref blobRef
+	if len(data) != blobRefSize {
+		return ref, fmt.Errorf("%w: malformed blob reference", ErrCorruptRecord)
+	}
+	copy(ref.digest[:], data[:sha256.Size])
+	ref.size = binary.LittleEndian.Uint64(data[sha256.Size:])
+	return ref, nil
+}
+
+// blobStore manages the blob files of a data directory. Blobs are shared by
+// every key holding the same value, so the store tracks which blob each key
+// references and only removes a file once nothing references it and the
+// index that dropped the last reference has been saved.
+type blobStore struct {
+	fs        vfs.FS
+	dir       string
+	threshold int                   // Values larger than this are spilled, 0 disables spilling
+	keys      map[types.Key]blobRef // Blob referenced by each blob-backed key
+	refs      map[string]int        // Live references per blob name
+	pending   []string              // Unreferenced blobs awaiting removal
+	pinned    map[string]int        // Blobs open snapshots still read, kept until unpinned
+}
+
+func newBlobStore(fsys vfs.FS, dataDir string, threshold int) *blobStore {
+	return &blobStore{
+		fs:        fsys,
+		dir:       filepath.Join(dataDir, blobDirName),
+		threshold: threshold,
+		keys:      make(map[types.Key]blobRef),
+		refs:      make(map[string]int),
+		pinned:    make(map[string]int),
+	}
+}
+
+// shouldSpill reports whether a value is large enough to be stored as a blob
+func (b *blobStore) shouldSpill(value []byte) bool {
+	return b.threshold > 0 && len(value) > b.threshold
+}
+
+// write stores value as a blob file (if it isn't already present) and
+// returns its reference. The file is fsynced before the record that refers
+// to it is written.
+func (b *blobStore) write(value []byte) (blobRef, error) {
+	ref := newBlobRef(value)
+	path := filepath.Join(b.dir, ref.name())
+
+	if _, err := b.fs.Stat(path); err == nil {
+		return ref, nil
+	}
+
+	if err := b.fs.MkdirAll(b.dir, 0755); err != nil {
+		return ref, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	tempPath := path + ".tmp"
+	file, err := vfs.Create(b.fs, tempPath)
+	if err != nil {
+		return ref, fmt.Errorf("failed to create blob file: %w", err)
+	}
+	if _, err := file.Write(value); err != nil {
+		file.Close()
+		b.fs.Remove(tempPath)
+		return ref, fmt.Errorf("failed to write blob file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		b.fs.Remove(tempPath)
+		return ref, fmt.Errorf("failed to sync blob file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		b.fs.Remove(tempPath)
+		return ref, err
+	}
+
+	if err := b.fs.Rename(tempPath, path); err != nil {
+		b.fs.Remove(tempPath)
+		return ref, fmt.Errorf("failed to rename blob file: %w", err)
+	}
+
+	return ref, nil
+}
+
+// read loads a blob and verifies it against its reference
+func (b *blobStore) read(ref blobRef) ([]byte, error) {
+	value, err := vfs.ReadFile(b.fs, filepath.Join(b.dir, ref.name()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", ref.name(), err)
+	}
+
+	if uint64(len(value)) != ref.size || sha256.Sum256(value) != ref.digest {
+		return nil, fmt.Errorf("%w: %s", ErrBlobChecksumMismatch, ref.name())
+	}
+
+	return value, nil
+}
+
+// track records that key now references ref (nil for an inline value),
+// releasing the blob its previous record referenced
+func (b *blobStore) track(key types.Key, ref *blobRef) {
+	if old, ok := b.keys[key]; ok {
+		delete(b.keys, key)
+		b.release(old)
+	}
+	if ref != nil {
+		b.keys[key] = *ref
+		b.refs[ref.name()]++
+	}
+}
+
+// untrack records that key no longer exists
+func (b *blobStore) untrack(key types.Key) {
+	b.track(key, nil)
+}
+
+// release drops a live reference, queueing the blob for removal once it is
+// no longer referenced
+func (b *blobStore) release(ref blobRef) {
+	name := ref.name()
+	if b.refs[name] <= 1 {
+		delete(b.refs, name)
+		b.pending = append(b.pending, name)
+		return
+	}
+	b.refs[name]--
+}
+
+// collect removes queued blobs that are still unreferenced. It must only be
+// called after the index no longer referencing them has been saved.
+func (b *blobStore) collect() error {
+	var errs []error
+	var kept []string
+	for _, name := range b.pending {
+		if b.refs[name] > 0 {
+			continue // Referenced again since it was released
+		}
+		if b.pinned[name] > 0 {
+			kept = append(kept, name) // Removed once the snapshot is done with it
+			continue
+		}
+		if err := b.fs.Remove(filepath.Join(b.dir, name)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	b.pending = kept
+
+	return errors.Join(errs...)
+}
+
+// sweep removes every blob file that has no live reference, including files
+// orphaned by a crash between writing a blob and saving the index
+func (b *blobStore) sweep() error {
+	entries, err := b.fs.ReadDir(b.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var errs []error
+	var kept []string
+	for _, entry := range entries {
+		if entry.IsDir() || b.refs[entry.Name()] > 0 {
+			continue
+		}
+		if b.pinned[entry.Name()] > 0 {
+			kept = append(kept, entry.Name())
+			continue
+		}
+		if err := b.fs.Remove(filepath.Join(b.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	b.pending = kept
+
+	return errors.Join(errs...)
+}
+
+// pin keeps the blobs referenced now on disk until unpin, whatever happens
+// to the references, and returns their names in order
+func (b *blobStore) pin() []string {
+	names := make([]string, 0, len(b.refs))
+	for name := range b.refs {
+		names = append(names, name)
+		b.pinned[name]++
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unpin releases blobs pinned by pin. Those that lost their last reference
+// meanwhile are removed by the next collect.
+func (b *blobStore) unpin(names []string) {
+	for _, name := range names {
+		if b.pinned[name] <= 1 {
+			delete(b.pinned, name)
+		} else {
+			b.pinned[name]--
+		}
+	}
+}
+
+// reset forgets all references, used when the data file is cleared
+func (b *blobStore) reset() {
+	for name := range b.refs {
+		b.pending = append(b.pending, name)
+	}
+	b.keys = make(map[types.Key]blobRef)
+	b.refs = make(map[string]int)
+}
+
+// hasBlobs reports whether the blob directory contains any files
+func (b *blobStore) hasBlobs() bool {
+	entries, err := b.fs.ReadDir(b.dir)
+	return err == nil && len(entries) > 0
+}
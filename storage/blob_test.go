@@ -0,0 +1,137 @@
+package storage_test
+
+import (
+	"bytes"
+	"database_engine/storage"
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blobFiles(t *testing.T, dataDir string) []string {
+	entries, err := os.ReadDir(filepath.Join(dataDir, "blobs"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestDiskStorageBlobSpill(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+
+	large := bytes.Repeat([]byte("x"), 8192)
+	require.NoError(t, diskStorage.Set("large", large))
+	require.NoError(t, diskStorage.Set("small", []byte("inline")))
+
+	// Only the large value is spilled, and the data file holds just a reference
+	assert.Len(t, blobFiles(t, tempDir), 1)
+	stat, err := os.Stat(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Less(t, stat.Size(), int64(len(large)))
+
+	value, err := diskStorage.Get("large")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(large), value)
+
+	require.NoError(t, diskStorage.Close())
+
+	// Spilled values survive a reopen
+	diskStorage, err = storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value, err = diskStorage.Get("large")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(large), value)
+}
+
+func TestDiskStorageBlobGarbageCollection(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	first := bytes.Repeat([]byte("a"), 4096)
+	second := bytes.Repeat([]byte("b"), 4096)
+
+	// Overwriting collects the old blob
+	require.NoError(t, diskStorage.Set("key", first))
+	firstBlobs := blobFiles(t, tempDir)
+	require.Len(t, firstBlobs, 1)
+
+	require.NoError(t, diskStorage.Set("key", second))
+	secondBlobs := blobFiles(t, tempDir)
+	require.Len(t, secondBlobs, 1)
+	assert.NotEqual(t, firstBlobs[0], secondBlobs[0])
+
+	// A blob shared by two keys is kept until both are gone
+	require.NoError(t, diskStorage.Set("other", second))
+	require.NoError(t, diskStorage.Delete("key"))
+	assert.Len(t, blobFiles(t, tempDir), 1)
+
+	value, err := diskStorage.Get("other")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(second), value)
+
+	require.NoError(t, diskStorage.Delete("other"))
+	assert.Empty(t, blobFiles(t, tempDir))
+}
+
+func TestDiskStorageBlobCompact(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	large := bytes.Repeat([]byte("c"), 4096)
+	require.NoError(t, diskStorage.Set("keep", large))
+
+	// A blob left behind by a crash is swept by Compact
+	orphan := filepath.Join(tempDir, "blobs", "orphan")
+	require.NoError(t, os.WriteFile(orphan, []byte("unreferenced"), 0644))
+
+	require.NoError(t, diskStorage.Compact())
+
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err))
+	assert.Len(t, blobFiles(t, tempDir), 1)
+
+	value, err := diskStorage.Get("keep")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(large), value)
+}
+
+func TestDiskStorageBlobChecksum(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key", bytes.Repeat([]byte("d"), 4096)))
+
+	names := blobFiles(t, tempDir)
+	require.Len(t, names, 1)
+
+	// Tamper with the blob without changing its size
+	path := filepath.Join(tempDir, "blobs", names[0])
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[100] = 'X'
+	require.NoError(t, os.WriteFile(path, data, 0644))
+
+	_, err = diskStorage.Get("key")
+	assert.ErrorIs(t, err, storage.ErrBlobChecksumMismatch)
+	assert.ErrorIs(t, err, storage.ErrCorruptRecord)
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"container/list"
+	"database_engine/types"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheEntryOverhead approximates the memory a cached entry takes beyond its
+// key and value
+const cacheEntryOverhead = 128
+
+// entryCache keeps recently read entries by the data file offset of their
+// record, so reads of hot keys skip reading and decoding it. A record never
+// changes once written, so a cached entry stays correct until the data file
+// is replaced or cut back, which clears the cache. Entries are copied in and
+// out, since callers may modify what they get. A nil cache caches nothing.
+type entryCache struct {
+	mu       sync.Mutex
+	capacity int64 // Bytes of entries kept at most
+	size     int64
+	entries  map[int64]*list.Element
+	order    *list.List // Of *cachedEntry, most recently used first
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type cachedEntry struct {
+	offset int64
+	entry  types.Entry
+	size   int64
+}
+
+// newEntryCache returns a cache holding up to capacity bytes of entries, or
+// nil if capacity isn't positive
+func newEntryCache(capacity int64) *entryCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &entryCache{
+		capacity: capacity,
+		entries:  make(map[int64]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns a copy of the entry cached for the record at offset
+func (c *entryCache) get(offset int64) (*types.Entry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[offset]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(element)
+	return copyEntry(&element.Value.(*cachedEntry).entry), true
+}
+
+// add caches a copy of entry, read from the record at offset, evicting the
+// least recently used entries to make room. Entries larger than the whole
+// cache aren't cached.
+func (c *entryCache) add(offset int64, entry *types.Entry) {
+	if c == nil {
+		return
+	}
+	size := int64(len(entry.Key)+len(entry.Value)) + cacheEntryOverhead
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[offset]; ok {
+		return
+	}
+	for c.size+size > c.capacity {
+		oldest := c.order.Back()
+		c.remove(oldest)
+	}
+	cached := &cachedEntry{offset: offset, entry: *copyEntry(entry), size: size}
+	c.entries[offset] = c.order.PushFront(cached)
+	c.size += size
+}
+
+// remove drops a cached entry. The caller must hold c.mu.
+func (c *entryCache) remove(element *list.Element) {
+	cached := c.order.Remove(element).(*cachedEntry)
+	delete(c.entries, cached.offset)
+	c.size -= cached.size
+}
+
+// clear drops every cached entry
+func (c *entryCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int64]*list.Element)
+	c.order.Init()
+	c.size = 0
+}
+
+// addTo adds the cache's hits and misses to stats
+func (c *entryCache) addTo(stats *types.StorageStats) {
+	if c == nil {
+		return
+	}
+	stats.CacheHits += c.hits.Load()
+	stats.CacheMisses += c.misses.Load()
+}
+
+// copyEntry returns a copy of entry that shares no memory with it
+func copyEntry(entry *types.Entry) *types.Entry {
+	copied := *entry
+	if entry.Value != nil {
+		copied.Value = append(make(types.Value, 0, len(entry.Value)), entry.Value...)
+	}
+	if entry.TTL != nil {
+		ttl := *entry.TTL
+		copied.TTL = &ttl
+	}
+	return &copied
+}
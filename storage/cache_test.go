@@ -0,0 +1,96 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStorageCache(t *testing.T) {
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(t.TempDir(), withCache(1<<20)))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key", types.Value("value")))
+	value, err := diskStorage.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, 1, diskStorage.CachedEntries())
+
+	// Changing what a read returned doesn't change the cached entry
+	value[0] = 'X'
+	value, err = diskStorage.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	// An overwrite is a new record, read from the file
+	require.NoError(t, diskStorage.Set("key", types.Value("second")))
+	value, err = diskStorage.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("second"), value)
+}
+
+func TestDiskStorageCacheEvicts(t *testing.T) {
+	const size = 4096
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(t.TempDir(), withCache(size)))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	for i := 0; i < 100; i++ {
+		key := types.Key(fmt.Sprintf("key%03d", i))
+		require.NoError(t, diskStorage.Set(key, make(types.Value, 100)))
+		_, err := diskStorage.Get(key)
+		require.NoError(t, err)
+	}
+	assert.Greater(t, diskStorage.CachedEntries(), 0)
+	assert.Less(t, diskStorage.CachedEntries(), size/100)
+
+	// Values larger than the cache aren't cached
+	require.NoError(t, diskStorage.Set("huge", make(types.Value, 2*size)))
+	_, err = diskStorage.Get("huge")
+	require.NoError(t, err)
+	value, err := diskStorage.Get("huge")
+	require.NoError(t, err)
+	assert.Len(t, value, 2*size)
+}
+
+// Compaction writes records at offsets the old file used for other keys, so
+// the cache must not outlive the file it was filled from
+func TestDiskStorageCacheAcrossCompaction(t *testing.T) {
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(t.TempDir(), withCache(1<<20)))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	for i := 0; i < 20; i++ {
+		key := types.Key(fmt.Sprintf("key%02d", i))
+		require.NoError(t, diskStorage.Set(key, types.Value(fmt.Sprintf("old%02d", i))))
+	}
+	for i := 0; i < 20; i++ {
+		key := types.Key(fmt.Sprintf("key%02d", i))
+		if i%2 == 0 {
+			require.NoError(t, diskStorage.Delete(key))
+			continue
+		}
+		_, err := diskStorage.Get(key)
+		require.NoError(t, err)
+	}
+	require.NoError(t, diskStorage.Compact())
+
+	for i := 1; i < 20; i += 2 {
+		key := types.Key(fmt.Sprintf("key%02d", i))
+		value, err := diskStorage.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, types.Value(fmt.Sprintf("old%02d", i)), value)
+	}
+
+	require.NoError(t, diskStorage.Clear())
+	require.NoError(t, diskStorage.Set("new", types.Value("after clear")))
+	value, err := diskStorage.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("after clear"), value)
+	_, err = diskStorage.Get("key01")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database_engine/types"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// compressionOptions controls how values are compressed before they are
+// written to the data file. Compression is applied to the value bytes only
+// and happens before the record checksum is computed, so the checksum
+// covers what is actually stored on disk.
+type compressionOptions struct {
+	algorithm string
+	minSize   int
+}
+
+// CompressionStats describes how much space value compression saves across
+// the live records of a data file
+type CompressionStats struct {
+	Algorithm        string `json:"algorithm"`
+	LiveValues       int64  `json:"live_values"`
+	CompressedValues int64  `json:"compressed_values"`
+	RawValueBytes    int64  `json:"raw_value_bytes"`
+	StoredValueBytes int64  `json:"stored_value_bytes"`
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// validateCompression checks that the configured algorithm is supported
+func validateCompression(algorithm string) error {
+	switch algorithm {
+	case "", types.CompressionNone, types.CompressionGzip:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
+
+// compressValue returns the compressed form of value and true, or the value
+// unchanged and false when it is below the size threshold or doesn't shrink
+func (c compressionOptions) compressValue(value []byte) ([]byte, bool, error) {
+	if c.algorithm != types.CompressionGzip || len(value) < c.minSize {
+		return value, false, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+	zw.Reset(&buf)
+
+	if _, err := zw.Write(value); err != nil {
+		return nil, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+
+	// Incompressible data is stored raw
+	if buf.Len() >= len(value) {
+		return value, false, nil
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+// maxDecompressedSize is the largest value a compressed record may inflate
+// to: the configured MaxValueSize, or the default one if that isn't set
+func maxDecompressedSize(config types.Config) int {
+	if config.MaxValueSize > 0 {
+		return config.MaxValueSize
+	}
+	return types.DefaultConfig().MaxValueSize
+}
+
+// decompressValue reverses compressValue for a gzip-flagged record. It reads
+// at most limit bytes, so a damaged record can't inflate without bound, and
+// fails if the value is any longer.
+func decompressValue(stored []byte, limit int) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	value, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(value) > limit {
+		return nil, fmt.Errorf("value inflates past %d bytes", limit)
+	}
+
+	return value, nil
+}
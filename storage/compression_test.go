@@ -0,0 +1,164 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/wal"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStorageCompressionRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withGzip))
+	require.NoError(t, err)
+
+	compressible := bytes.Repeat([]byte(`{"name":"alice","role":"admin"},`), 200)
+	random := make([]byte, 4096)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	small := []byte("tiny")
+
+	require.NoError(t, diskStorage.Set("compressible", compressible))
+	require.NoError(t, diskStorage.Set("random", random))
+	require.NoError(t, diskStorage.Set("small", small))
+
+	stats, err := diskStorage.GetCompressionStats()
+	require.NoError(t, err)
+	assert.Equal(t, types.CompressionGzip, stats.Algorithm)
+	assert.Equal(t, int64(3), stats.LiveValues)
+	assert.Equal(t, int64(1), stats.CompressedValues) // Random and small values are stored raw
+	assert.Equal(t, int64(len(compressible)+len(random)+len(small)), stats.RawValueBytes)
+	assert.Less(t, stats.StoredValueBytes, stats.RawValueBytes)
+
+	usage, err := diskStorage.GetDiskUsageDetailed()
+	require.NoError(t, err)
+	assert.Equal(t, stats.RawValueBytes, usage.RawValueBytes)
+	assert.Equal(t, stats.StoredValueBytes, usage.StoredValueBytes)
+	require.NoError(t, diskStorage.Close())
+
+	// Mixed files stay readable with compression turned off
+	config := diskTestConfig(tempDir, withoutWriteBuffer, withGzip)
+	config.Compression = types.CompressionNone
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("uncompressed", compressible))
+
+	values, err := diskStorage.BatchGet([]types.Key{"compressible", "random", "small", "uncompressed"})
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(compressible), values["compressible"])
+	assert.Equal(t, types.Value(random), values["random"])
+	assert.Equal(t, types.Value(small), values["small"])
+	assert.Equal(t, types.Value(compressible), values["uncompressed"])
+}
+
+func TestDiskStorageCompressionReducesFileSize(t *testing.T) {
+	compressible := bytes.Repeat([]byte("verbose json document "), 100)
+
+	sizeWith := func(config types.Config) int64 {
+		diskStorage, err := storage.NewDiskStorageWithConfig(config)
+		require.NoError(t, err)
+		require.NoError(t, diskStorage.Set("doc", compressible))
+		require.NoError(t, diskStorage.Close())
+
+		stat, err := os.Stat(filepath.Join(config.DataDirectory, "data.db"))
+		require.NoError(t, err)
+		return stat.Size()
+	}
+
+	compressed := sizeWith(diskTestConfig(t.TempDir(), withoutWriteBuffer, withGzip))
+	rawConfig := diskTestConfig(t.TempDir(), withoutWriteBuffer, withGzip)
+	rawConfig.Compression = types.CompressionNone
+	raw := sizeWith(rawConfig)
+
+	assert.Less(t, compressed*5, raw)
+}
+
+func TestDiskStorageCompressionSurvivesCompact(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withGzip))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	value := bytes.Repeat([]byte("abc"), 1000)
+	require.NoError(t, diskStorage.Set("key", value))
+	require.NoError(t, diskStorage.Set("deleted", value))
+	require.NoError(t, diskStorage.Delete("deleted"))
+	require.NoError(t, diskStorage.Compact())
+
+	retrieved, err := diskStorage.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value(value), retrieved)
+}
+
+func TestDiskStorageInvalidCompression(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withGzip)
+	config.Compression = "lz4"
+
+	_, err := storage.NewDiskStorageWithConfig(config)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported compression algorithm")
+}
+
+func TestDiskStorageDecompressionIsBounded(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withoutWriteBuffer, withGzip))
+	require.NoError(t, err)
+
+	// Gzip shrinks this to a few hundred bytes
+	require.NoError(t, diskStorage.Set("large", bytes.Repeat([]byte("a"), 64*1024)))
+	require.NoError(t, diskStorage.Set("small", bytes.Repeat([]byte("b"), 512)))
+	require.NoError(t, diskStorage.Close())
+
+	// A record inflating past MaxValueSize is corrupt rather than read whole
+	config := diskTestConfig(tempDir, withoutWriteBuffer, withGzip)
+	config.MaxValueSize = 1024
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	_, err = diskStorage.Get("large")
+	assert.ErrorIs(t, err, storage.ErrCorruptRecord)
+
+	retrieved, err := diskStorage.Get("small")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(bytes.Repeat([]byte("b"), 512)), retrieved)
+}
+
+func TestDiskStorageCompressionReplay(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withGzip, withWAL)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("key", bytes.Repeat([]byte("a"), 4096)))
+	written, err := diskStorage.GetEntry("key")
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Close())
+
+	// A SET logged without a version, as WALs written before versions
+	// have, is replayed as a plain Set that reads the compressed record it
+	// replaces
+	w, err := wal.NewWALWithOptions(config.WALFilePath(), wal.Options{MaxSize: config.MaxWALSize})
+	require.NoError(t, err)
+	_, err = w.LogSet("key", bytes.Repeat([]byte("b"), 4096), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	replayed, err := diskStorage.GetEntry("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(bytes.Repeat([]byte("b"), 4096)), replayed.Value)
+	assert.True(t, written.CreatedAt.Equal(replayed.CreatedAt))
+	assert.Equal(t, written.Revision+1, replayed.Revision)
+}
@@ -0,0 +1,889 @@
+package storage_test
+
+import (
+	"context"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// crashOp is one step of the workload the crash tests interrupt
+type crashOp struct {
+	name  string
+	run   func(s *storage.DiskStorage) error
+	apply func(state map[types.Key]string)
+}
+
+func setOp(key types.Key, value string) crashOp {
+	return crashOp{
+		name: fmt.Sprintf("set %s", key),
+		run:  func(s *storage.DiskStorage) error { return s.Set(key, types.Value(value)) },
+		apply: func(state map[types.Key]string) {
+			state[key] = value
+		},
+	}
+}
+
+func deleteOp(key types.Key) crashOp {
+	return crashOp{
+		name: fmt.Sprintf("delete %s", key),
+		run:  func(s *storage.DiskStorage) error { return s.Delete(key) },
+		apply: func(state map[types.Key]string) {
+			delete(state, key)
+		},
+	}
+}
+
+func batchSetOp(keys ...types.Key) crashOp {
+	return crashOp{
+		name: fmt.Sprintf("batch set %v", keys),
+		run: func(s *storage.DiskStorage) error {
+			var entries []types.Entry
+			for _, key := range keys {
+				entries = append(entries, types.Entry{Key: key, Value: types.Value("batch-" + key)})
+			}
+			return s.BatchSet(entries)
+		},
+		apply: func(state map[types.Key]string) {
+			for _, key := range keys {
+				state[key] = "batch-" + string(key)
+			}
+		},
+	}
+}
+
+func batchDeleteOp(keys ...types.Key) crashOp {
+	return crashOp{
+		name: fmt.Sprintf("batch delete %v", keys),
+		run:  func(s *storage.DiskStorage) error { return s.BatchDelete(keys) },
+		apply: func(state map[types.Key]string) {
+			for _, key := range keys {
+				delete(state, key)
+			}
+		},
+	}
+}
+
+var crashOps = []crashOp{
+	setOp("a", "a1"),
+	setOp("b", "b1"),
+	setOp("a", "a2"),
+	deleteOp("b"),
+	batchSetOp("c", "d", "e"),
+	setOp("f", "f1"),
+	deleteOp("c"),
+	batchDeleteOp("d", "f"),
+	setOp("b", "b2"),
+}
+
+// crashState returns the data after the first n crashOps
+func crashState(n int) map[types.Key]string {
+	state := make(map[types.Key]string)
+	for _, op := range crashOps[:n] {
+		op.apply(state)
+	}
+	return state
+}
+
+// readCrashState reopens dataDir on the real filesystem and returns its data
+func readCrashState(t *testing.T, config types.Config) map[types.Key]string {
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err, "database must reopen after a crash")
+	defer diskStorage.Close()
+
+	keys, err := diskStorage.Keys()
+	require.NoError(t, err)
+
+	state := make(map[types.Key]string)
+	for _, key := range keys {
+		value, err := diskStorage.Get(key)
+		require.NoError(t, err, "key %q is indexed but unreadable", key)
+		state[key] = string(value)
+	}
+	return state
+}
+
+// runCrashOps runs crashOps until one fails and returns how many succeeded
+func runCrashOps(diskStorage *storage.DiskStorage) int {
+	for i, op := range crashOps {
+		if err := op.run(diskStorage); err != nil {
+			return i
+		}
+	}
+	return len(crashOps)
+}
+
+// crashMode is a storage configuration the crash tests run under
+type crashMode struct {
+	name        string
+	walEnabled  bool
+	syncOnWrite bool
+	hints       bool // Write an index hint after every operation
+}
+
+var crashModes = []crashMode{
+	{"NoWAL", false, false, false},
+	{"WAL", true, false, false},
+	{"SyncOnWrite", false, true, false},
+	{"Hints", false, false, true},
+}
+
+func (mode crashMode) config(dataDir string) types.Config {
+	config := diskTestConfig(dataDir, withoutWriteBuffer, withoutHints)
+	config.WALEnabled = mode.walEnabled
+	config.SyncOnWrite = mode.syncOnWrite
+	if mode.hints {
+		config.IndexHintInterval = 1
+	}
+	return config
+}
+
+func TestDiskStorageCrashMidWrite(t *testing.T) {
+	for _, mode := range crashModes {
+		mode := mode
+		t.Run(mode.name, func(t *testing.T) {
+			// Count the writes the workload makes so every one of them can
+			// be interrupted
+			fsys := vfs.NewFaultFS(vfs.OS)
+			diskStorage, err := storage.NewDiskStorageWithFS(mode.config(t.TempDir()), fsys)
+			require.NoError(t, err)
+			start := fsys.Writes()
+			require.Equal(t, len(crashOps), runCrashOps(diskStorage))
+			totalWrites := fsys.Writes() - start
+			require.NoError(t, diskStorage.Close())
+
+			for write := 0; write < totalWrites; write++ {
+				config := mode.config(t.TempDir())
+				fsys := vfs.NewFaultFS(vfs.OS)
+				diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+				require.NoError(t, err)
+
+				// Tear the write in half and kill the process
+				fsys.InjectWriteFault(vfs.WriteFault{After: write, Err: vfs.ErrCrashed, Torn: true, Crash: true})
+				acked := runCrashOps(diskStorage)
+				require.NoError(t, fsys.Crash())
+
+				state := readCrashState(t, config)
+				if acked < len(crashOps) && assert.ObjectsAreEqual(crashState(acked+1), state) {
+					continue // The interrupted operation reached disk in full
+				}
+				assert.Equal(t, crashState(acked), state, "crash at write %d after %d acknowledged operations", write, acked)
+			}
+		})
+	}
+}
+
+func TestDiskStoragePowerFailure(t *testing.T) {
+	for acked := 0; acked <= len(crashOps); acked++ {
+		config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withSyncOnWrite)
+		fsys := vfs.NewFaultFS(vfs.OS)
+		diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+		require.NoError(t, err)
+
+		for _, op := range crashOps[:acked] {
+			require.NoError(t, op.run(diskStorage), op.name)
+		}
+		require.NoError(t, fsys.PowerFailure())
+
+		// SyncOnWrite makes every acknowledged operation durable
+		assert.Equal(t, crashState(acked), readCrashState(t, config), "power failure after %d operations", acked)
+	}
+}
+
+func TestDiskStoragePowerFailureDroppedSyncs(t *testing.T) {
+	for synced := 0; synced <= len(crashOps); synced++ {
+		config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL, withSyncOnWrite)
+		fsys := vfs.NewFaultFS(vfs.OS)
+		diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+		require.NoError(t, err)
+
+		for _, op := range crashOps[:synced] {
+			require.NoError(t, op.run(diskStorage), op.name)
+		}
+
+		// A disk that lies about fsync loses the rest, but what survives
+		// must still be a consistent prefix
+		fsys.DropSyncs(true)
+		for _, op := range crashOps[synced:] {
+			require.NoError(t, op.run(diskStorage), op.name)
+		}
+		require.NoError(t, fsys.PowerFailure())
+
+		state := readCrashState(t, config)
+		matched := false
+		for n := synced; n <= len(crashOps); n++ {
+			if assert.ObjectsAreEqual(crashState(n), state) {
+				matched = true
+				break
+			}
+		}
+		assert.True(t, matched, "state %v after %d synced operations is not a prefix of the workload", state, synced)
+	}
+}
+
+func TestDiskStorageWriteENOSPC(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("before", types.Value("value")))
+
+	// The disk fills up halfway through the next record
+	fsys.InjectWriteFault(vfs.WriteFault{Torn: true})
+	err = diskStorage.Set("full", types.Value("value"))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+	// Once space is freed the storage carries on where it left off
+	require.NoError(t, diskStorage.Set("after", types.Value("value")))
+	value, err := diskStorage.Get("after")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	_, err = diskStorage.Get("full")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+	require.NoError(t, diskStorage.Close())
+
+	assert.Equal(t, map[types.Key]string{"before": "value", "after": "value"}, readCrashState(t, config))
+}
+
+func TestDiskStorageReadOnlyAfterENOSPC(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("before", types.Value("value")))
+	dataPath := filepath.Join(config.DataDirectory, "data.db")
+	before, err := os.Stat(dataPath)
+	require.NoError(t, err)
+
+	// The disk stays full
+	fsys.InjectWriteFault(vfs.WriteFault{Torn: true, Sticky: true})
+	err = diskStorage.Set("full", types.Value("value"))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+
+	// The torn record is cut off and no more writes are attempted
+	after, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+
+	for _, err := range []error{
+		diskStorage.Set("more", types.Value("value")),
+		diskStorage.Delete("before"),
+		diskStorage.BatchSet([]types.Entry{{Key: "batch", Value: types.Value("value")}}),
+		diskStorage.Health(),
+	} {
+		assert.True(t, errors.Is(err, types.ErrReadOnly), "got %v", err)
+		assert.True(t, errors.Is(err, syscall.ENOSPC), "got %v", err)
+	}
+
+	// Reads carry on
+	value, err := diskStorage.Get("before")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	// Freeing space ends read-only mode
+	fsys.ClearWriteFault()
+	require.NoError(t, diskStorage.Health())
+	require.NoError(t, diskStorage.Set("after", types.Value("value")))
+	require.NoError(t, diskStorage.Close())
+
+	assert.Equal(t, map[types.Key]string{"before": "value", "after": "value"}, readCrashState(t, config))
+}
+
+func TestDiskStorageBufferedENOSPC(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 256
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// Fill the buffer until a flush hits the full disk the data file is on;
+	// the WAL is elsewhere and still has room
+	dataPath := filepath.Join(config.DataDirectory, "data.db")
+	fsys.InjectWriteFault(vfs.WriteFault{Torn: true, Sticky: true, Path: dataPath})
+	want := make(map[types.Key]string)
+	for i := 0; ; i++ {
+		key := types.Key(fmt.Sprintf("key%03d", i))
+		err := diskStorage.Set(key, types.Value("value"))
+		if err != nil {
+			assert.True(t, errors.Is(err, syscall.ENOSPC))
+			break
+		}
+		want[key] = "value"
+	}
+	require.NotEmpty(t, want)
+
+	// Acknowledged records are still buffered and readable
+	for key := range want {
+		value, err := diskStorage.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, types.Value("value"), value)
+	}
+	assert.True(t, errors.Is(diskStorage.Sync(), types.ErrReadOnly))
+
+	// Once space is freed the buffered records are written out
+	fsys.ClearWriteFault()
+	require.NoError(t, diskStorage.Sync())
+	require.NoError(t, diskStorage.Close())
+
+	assert.Equal(t, want, readCrashState(t, config))
+}
+
+func TestDiskStorageIndexSaveENOSPC(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("before", types.Value("value")))
+
+	// The record is appended but the index can't be saved
+	fsys.InjectWriteFault(vfs.WriteFault{After: 1, Torn: true})
+	err = diskStorage.Set("unsaved", types.Value("value"))
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+	require.NoError(t, diskStorage.Health())
+
+	// The old index is intact and the failed save was retried
+	data, err := os.ReadFile(filepath.Join(config.DataDirectory, "index.db"))
+	require.NoError(t, err)
+	index, err := storage.DecodeIndex(data)
+	require.NoError(t, err)
+	assert.Len(t, index, 2)
+	require.NoError(t, diskStorage.Close())
+}
+
+func TestDiskStorageMinFreeBytes(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	config.MinFreeBytes = 1 << 20
+	fsys := vfs.NewFaultFS(vfs.OS)
+	fsys.SetFreeSpace(1<<20 + 100<<10)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	// Small writes aren't checked
+	require.NoError(t, diskStorage.Set("small", types.Value("value")))
+
+	large := make(types.Value, 128<<10)
+	err = diskStorage.BatchSet([]types.Entry{{Key: "large", Value: large}})
+	assert.True(t, errors.Is(err, storage.ErrInsufficientSpace))
+	err = diskStorage.Set("large", large)
+	assert.True(t, errors.Is(err, storage.ErrInsufficientSpace))
+
+	// Refusing a write up front doesn't make the storage read-only
+	require.NoError(t, diskStorage.Health())
+	_, err = diskStorage.Get("large")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+
+	fsys.SetFreeSpace(1<<20 + 10)
+	assert.True(t, errors.Is(diskStorage.Compact(), storage.ErrInsufficientSpace))
+
+	fsys.SetFreeSpace(10 << 20)
+	require.NoError(t, diskStorage.BatchSet([]types.Entry{{Key: "large", Value: large}}))
+	require.NoError(t, diskStorage.Compact())
+}
+
+func TestDiskStorageWALTornMidEntry(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 1 << 20
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// Every acknowledged operation is only in the WAL; the buffered data
+	// file writes die with the process
+	n := runCrashOps(diskStorage)
+	require.Equal(t, len(crashOps), n)
+	require.NoError(t, fsys.Crash())
+
+	// The last WAL entry is cut short as if the crash hit it mid-write
+	walPath := config.WALFilePath()
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(walPath, info.Size()-5))
+
+	assert.Equal(t, crashState(n-1), readCrashState(t, config))
+}
+
+func TestDiskStorageWALTornBatch(t *testing.T) {
+	// crashOps[4] sets c, d and e in one batch
+	const batch = 4
+
+	for _, cut := range []string{"start", "middle", "end"} {
+		t.Run(cut, func(t *testing.T) {
+			config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+			config.WriteBufferSize = 1 << 20
+			fsys := vfs.NewFaultFS(vfs.OS)
+			diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+			require.NoError(t, err)
+
+			for _, op := range crashOps[:batch] {
+				require.NoError(t, op.run(diskStorage))
+			}
+			start := diskStorage.GetWALSize()
+			require.NoError(t, crashOps[batch].run(diskStorage))
+			end := diskStorage.GetWALSize()
+			require.NoError(t, fsys.Crash())
+
+			// Cut the batch's WAL entry short; none of the batch may
+			// survive recovery
+			size := map[string]int64{
+				"start":  start + 1,
+				"middle": (start + end) / 2,
+				"end":    end - 1,
+			}[cut]
+			require.NoError(t, os.Truncate(config.WALFilePath(), size))
+
+			assert.Equal(t, crashState(batch), readCrashState(t, config))
+		})
+	}
+}
+
+func TestDiskStorageWALTornCommit(t *testing.T) {
+	// The transaction commits after crashOps[:4], when a is set
+	const before = 4
+
+	for _, cut := range []string{"start", "middle", "end"} {
+		t.Run(cut, func(t *testing.T) {
+			config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+			config.WriteBufferSize = 1 << 20
+			fsys := vfs.NewFaultFS(vfs.OS)
+			diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+			require.NoError(t, err)
+
+			for _, op := range crashOps[:before] {
+				require.NoError(t, op.run(diskStorage))
+			}
+			entry, err := diskStorage.GetEntry("a")
+			require.NoError(t, err)
+			start := diskStorage.GetWALSize()
+			require.NoError(t, diskStorage.CommitIfVersions(
+				map[types.Key]uint64{"a": entry.Version},
+				[]types.Entry{{Key: "c", Value: types.Value("c1")}, {Key: "d", Value: types.Value("d1")}},
+				[]types.Key{"a"}))
+			end := diskStorage.GetWALSize()
+			require.NoError(t, fsys.Crash())
+
+			// Cut the commit's WAL entry short; none of the transaction
+			// may survive recovery
+			size := map[string]int64{
+				"start":  start + 1,
+				"middle": (start + end) / 2,
+				"end":    end - 1,
+			}[cut]
+			require.NoError(t, os.Truncate(config.WALFilePath(), size))
+
+			assert.Equal(t, crashState(before), readCrashState(t, config))
+		})
+	}
+}
+
+func TestDiskStorageWALRecoveryAcrossRotation(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 1 << 20
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// The operations are only in the WAL, split across a rotation
+	for i, op := range crashOps {
+		require.NoError(t, op.run(diskStorage))
+		if i == len(crashOps)/2 {
+			require.NoError(t, diskStorage.RotateWAL())
+		}
+	}
+	require.NoError(t, fsys.Crash())
+
+	assert.Equal(t, crashState(len(crashOps)), readCrashState(t, config))
+}
+
+func TestDiskStorageCheckpointWAL(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 1 << 20
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	n := len(crashOps) / 2
+	for _, op := range crashOps[:n] {
+		require.NoError(t, op.run(diskStorage))
+	}
+	require.NoError(t, diskStorage.RotateWAL())
+
+	// The checkpoint makes the data durable, so the segments can go
+	require.NoError(t, diskStorage.Checkpoint())
+	stats, err := diskStorage.GetWALStats()
+	require.NoError(t, err)
+	assert.Len(t, stats.Segments, 1) // Just the active file
+
+	for _, op := range crashOps[n:] {
+		require.NoError(t, op.run(diskStorage))
+	}
+	require.NoError(t, fsys.Crash())
+
+	assert.Equal(t, crashState(len(crashOps)), readCrashState(t, config))
+}
+
+func TestDiskStorageCheckpointCrash(t *testing.T) {
+	for _, step := range []string{"synced", "recorded"} {
+		t.Run(step, func(t *testing.T) {
+			config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+			config.WriteBufferSize = 1 << 20
+			fsys := vfs.NewFaultFS(vfs.OS)
+			diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+			require.NoError(t, err)
+
+			for i, op := range crashOps {
+				require.NoError(t, op.run(diskStorage))
+				if i == len(crashOps)/2 {
+					require.NoError(t, diskStorage.RotateWAL())
+				}
+			}
+
+			restore := storage.SetCheckpointStepFunc(func(s string) {
+				if s == step {
+					fsys.Crash()
+				}
+			})
+			defer restore()
+			assert.Error(t, diskStorage.Checkpoint())
+
+			// Nothing is lost either way. Once the checkpoint is recorded
+			// nothing is replayed, so the data file doesn't grow.
+			dataPath := filepath.Join(config.DataDirectory, "data.db")
+			before, err := os.Stat(dataPath)
+			require.NoError(t, err)
+			assert.Equal(t, crashState(len(crashOps)), readCrashState(t, config))
+			after, err := os.Stat(dataPath)
+			require.NoError(t, err)
+			if step == "recorded" {
+				assert.Equal(t, before.Size(), after.Size())
+			} else {
+				assert.Greater(t, after.Size(), before.Size())
+			}
+		})
+	}
+}
+
+func TestDiskStorageAutomaticCheckpoint(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 1 << 20
+	config.MaxWALSize = 1024
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// Concurrent writers fill the WAL past MaxWALSize many times over
+	const writers, perWriter = 4, 50
+	expected := make(map[types.Key]string)
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		for j := 0; j < perWriter; j++ {
+			expected[types.Key(fmt.Sprintf("key-%d-%d", i, j))] = "value"
+		}
+		go func(i int) {
+			for j := 0; j < perWriter; j++ {
+				if err := diskStorage.Set(types.Key(fmt.Sprintf("key-%d-%d", i, j)), types.Value("value")); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	stats, err := diskStorage.GetWALStats()
+	require.NoError(t, err)
+	assert.Greater(t, stats.Rotations, uint64(0))
+	assert.Equal(t, stats.Rotations, stats.Checkpoints)
+	assert.Len(t, stats.Segments, 1) // Checkpointed segments are deleted
+	assert.Less(t, stats.Size, config.MaxWALSize)
+
+	require.NoError(t, fsys.Crash())
+	assert.Equal(t, expected, readCrashState(t, config))
+}
+
+func TestDiskStorageCheckpointInterval(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 1 << 20
+	config.WALCheckpointInterval = time.Nanosecond
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	// Every write finds the interval passed
+	for _, op := range crashOps {
+		require.NoError(t, op.run(diskStorage))
+	}
+	stats, err := diskStorage.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(crashOps)), stats.Checkpoints)
+	assert.Zero(t, stats.Size)
+}
+
+func TestDiskStorageWALClear(t *testing.T) {
+	// The clear's WAL entry is written first, then the index; "midway"
+	// dies writing the index
+	for _, crash := range []string{"after", "midway"} {
+		t.Run(crash, func(t *testing.T) {
+			config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+			config.WriteBufferSize = 1 << 20
+			fsys := vfs.NewFaultFS(vfs.OS)
+			diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+			require.NoError(t, err)
+
+			// The operations are only in the WAL; replaying them must not
+			// bring back what the clear removed
+			n := runCrashOps(diskStorage)
+			require.Equal(t, len(crashOps), n)
+			if crash == "midway" {
+				fsys.InjectWriteFault(vfs.WriteFault{After: 1, Crash: true})
+				assert.Error(t, diskStorage.Clear())
+			} else {
+				require.NoError(t, diskStorage.Clear())
+				require.NoError(t, fsys.Crash())
+			}
+
+			assert.Empty(t, readCrashState(t, config))
+		})
+	}
+}
+
+func TestDiskStorageWALCompactMarker(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	n := runCrashOps(diskStorage)
+	require.NoError(t, diskStorage.Compact())
+	require.NoError(t, diskStorage.Set("after", types.Value("value")))
+
+	// The compaction is logged between the writes around it
+	tailer, err := diskStorage.TailWAL(context.Background(), 1)
+	require.NoError(t, err)
+	var ops []wal.OperationType
+	for len(ops) < n+2 {
+		entry, err := tailer.Next()
+		require.NoError(t, err)
+		ops = append(ops, entry.Type)
+	}
+	assert.Equal(t, []wal.OperationType{wal.OpCompact, wal.OpSet}, ops[n:])
+
+	// Recovery skips over it
+	require.NoError(t, fsys.Crash())
+	expected := crashState(n)
+	expected["after"] = "value"
+	assert.Equal(t, expected, readCrashState(t, config))
+}
+
+func TestDiskStorageReplayOnce(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	config.WriteBufferSize = 1 << 20
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	// The operations are only in the WAL when the process dies
+	n := runCrashOps(diskStorage)
+	require.NoError(t, fsys.Crash())
+
+	// The first open replays them into the data file and checkpoints;
+	// later ones, even without a clean close, have nothing to replay
+	dataPath := filepath.Join(config.DataDirectory, "data.db")
+	var size int64
+	for i := 0; i < 3; i++ {
+		fsys := vfs.NewFaultFS(vfs.OS)
+		_, err := storage.NewDiskStorageWithFS(config, fsys)
+		require.NoError(t, err)
+		require.NoError(t, fsys.Crash())
+
+		info, err := os.Stat(dataPath)
+		require.NoError(t, err)
+		if i == 0 {
+			size = info.Size()
+		}
+		assert.Equal(t, size, info.Size(), "data.db grew on reopen %d", i+1)
+	}
+	assert.Equal(t, crashState(n), readCrashState(t, config))
+}
+
+func TestDiskStorageCompactSyncsDirectory(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key1", types.Value("old")))
+	require.NoError(t, diskStorage.Set("key1", types.Value("new")))
+	require.NoError(t, vfs.SyncDir(fsys, config.DataDirectory))
+
+	// The renames that put the compacted files in place survive a power
+	// failure
+	require.NoError(t, diskStorage.Compact())
+	assert.NotContains(t, fsys.UnsyncedDirs(), filepath.Clean(config.DataDirectory))
+}
+
+// compactState sets count keys twice, so that Compact has garbage to drop,
+// and returns what they leave in the storage
+func compactState(t *testing.T, diskStorage *storage.DiskStorage, count int) map[types.Key]string {
+	state := make(map[types.Key]string)
+	for i := 0; i < count; i++ {
+		key := types.Key(fmt.Sprintf("key%03d", i))
+		require.NoError(t, diskStorage.Set(key, types.Value("old")))
+		require.NoError(t, diskStorage.Set(key, types.Value("new")))
+		state[key] = "new"
+	}
+	return state
+}
+
+func TestDiskStorageCompactENOSPC(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	state := compactState(t, diskStorage, 50)
+
+	// The disk fills up partway through the compacted data file
+	fsys.InjectWriteFault(vfs.WriteFault{After: 10, Torn: true})
+	err = diskStorage.Compact()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.ENOSPC), "got %v", err)
+
+	// The original files are still in use and the temporary ones are gone
+	for key, want := range state {
+		value, err := diskStorage.Get(key)
+		require.NoError(t, err, "key %q", key)
+		assert.Equal(t, types.Value(want), value)
+	}
+	for _, name := range []string{"data.db.tmp", "index.db.tmp"} {
+		_, err := os.Stat(filepath.Join(config.DataDirectory, name))
+		assert.True(t, os.IsNotExist(err), "%s was left behind", name)
+	}
+	require.NoError(t, diskStorage.Close())
+
+	assert.Equal(t, state, readCrashState(t, config))
+}
+
+func TestDiskStorageCompactPowerFailure(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withSyncOnWrite)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	state := compactState(t, diskStorage, 50)
+
+	// Once Compact returns the compacted files survive a power failure
+	require.NoError(t, diskStorage.Compact())
+	require.NoError(t, fsys.PowerFailure())
+	assert.Equal(t, state, readCrashState(t, config))
+}
+
+// bulkEntries returns count entries of about 10KB, which take several of
+// BulkLoad's batches, and what they leave in the storage
+func bulkEntries(count int) ([]types.Entry, map[types.Key]string) {
+	value := strings.Repeat("x", 10*1024)
+	entries := make([]types.Entry, count)
+	state := make(map[types.Key]string)
+	for i := range entries {
+		key := types.Key(fmt.Sprintf("key%03d", i))
+		entries[i] = types.Entry{Key: key, Value: types.Value(value)}
+		state[key] = value
+	}
+	return entries, state
+}
+
+func TestDiskStorageBulkLoad(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("key000", types.Value("old")))
+	before, err := diskStorage.GetWALStats()
+	require.NoError(t, err)
+
+	entries, state := bulkEntries(1000)
+	require.NoError(t, diskStorage.BulkLoad(entries))
+
+	// Nothing is logged, and once the load returns it survives a power
+	// failure without the Set logged before it being replayed over it
+	after, err := diskStorage.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, before.LastLSN, after.LastLSN)
+	require.NoError(t, fsys.PowerFailure())
+	assert.Equal(t, state, readCrashState(t, config))
+}
+
+func TestDiskStorageBulkLoader(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key000", types.Value("old")))
+
+	entries, state := bulkEntries(1000)
+	loader, err := diskStorage.StartBulkLoad()
+	require.NoError(t, err)
+	for start := 0; start < len(entries); start += 300 {
+		require.NoError(t, loader.Load(entries[start:min(start+300, len(entries))]))
+	}
+	value, err := diskStorage.Get("key999")
+	require.NoError(t, err)
+	assert.Len(t, value, 10*1024)
+
+	// Writes wait for the load to finish
+	set := make(chan error, 1)
+	go func() { set <- diskStorage.Set("after", types.Value("value")) }()
+	select {
+	case <-set:
+		t.Fatal("Set didn't wait for the bulk load")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, loader.Finish())
+	require.NoError(t, <-set)
+	assert.Error(t, loader.Load(entries[:1]))
+	require.NoError(t, loader.Finish())
+
+	state["after"] = "value"
+	require.NoError(t, diskStorage.Sync())
+	require.NoError(t, fsys.PowerFailure())
+	assert.Equal(t, state, readCrashState(t, config))
+}
+
+func TestDiskStorageBulkLoadCrash(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key000", types.Value("old")))
+
+	// The process dies writing the second batch, after the checkpoint
+	// wrote the index and the WAL marker and the first batch went out
+	fsys.InjectWriteFault(vfs.WriteFault{After: 3, Crash: true})
+	entries, _ := bulkEntries(1000)
+	assert.ErrorContains(t, diskStorage.BulkLoad(entries), "failed to write bulk load")
+
+	// The load is lost, what came before it isn't
+	assert.Equal(t, map[types.Key]string{"key000": "old"}, readCrashState(t, config))
+}
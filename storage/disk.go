@@ -1,31 +1,106 @@
 package storage
 
 import (
+	"context"
 	"database_engine/types"
+	"database_engine/vfs"
 	"database_engine/wal"
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// DiskStorage implements the StorageEngine interface using disk-based storage
+// DiskStorage implements the StorageEngine interface using disk-based storage.
+//
+// When a write buffer is configured, appends to the data file are collected
+// in memory and the index is only saved once the buffered records have been
+// flushed, so the on-disk index never references bytes that are not in the
+// data file. Writes that are still buffered (and index changes not yet saved)
+// are lost if the process dies before the next flush; enable the WAL to keep
+// them durable, since under the default WAL sync policy every write is
+// fsynced to the WAL before it returns. Writes append their WAL entry under
+// the locks but wait for its fsync after releasing them, so concurrent
+// writers share fsyncs.
+// SyncOnWrite trades throughput for durability without a WAL by flushing and
+// fsyncing both files after every write.
+//
+// Reads go through their own read-only descriptor, and every append or
+// replacement of the data file is serialized by appendMu before mu is taken.
+// A batch is therefore written and fsynced holding only appendMu, and the
+// exclusive lock is taken just to publish it, so reads carry on during a
+// long BatchSet.
+//
+// A failed append is cut off the data file, and the storage then turns
+// read-only: writes fail with types.ErrReadOnly, while reads keep working,
+// until a retry of what failed succeeds (see Health).
+//
+// Storage opened with Config.ReadOnly never writes to its directory: every
+// write fails with types.ErrReadOnly, an index that has to be rebuilt is
+// only kept in memory, and Close leaves the files as they were.
 type DiskStorage struct {
+	fs         vfs.FS
 	dataDir    string
-	dataFile   *os.File
-	indexFile  *os.File
+	lock       io.Closer       // Held on the data directory until Close, nil when read-only
+	dataFile   vfs.File        // Only appended to
+	readGen    *dataGeneration // The data file as opened for reading, see dataGeneration
 	wal        *wal.WAL
+	walPath    string
 	mu         sync.RWMutex
+	keys       keyLocks   // Serializes the writes of each key; taken before appendMu
+	appendMu   sync.Mutex // Serializes appends to and replacement of the data file; taken before mu
 	closed     bool
 	index      map[types.Key]int64 // Maps key to file offset
 	nextOffset int64
 	walEnabled bool
+
+	formatVersion uint32             // Record encoding used by the data file
+	compression   compressionOptions // Value compression for new records
+	maxValueSize  int                // Largest value a compressed record may inflate to
+	blobs         *blobStore         // Values spilled to separate blob files
+
+	writer        *writeBuffer // Buffers appends to dataFile, nil when unbuffered
+	writerMu      sync.Mutex   // Guards writer and flushedOffset
+	flushedOffset atomic.Int64 // Data file bytes that have left the write buffer
+	indexDirty    bool         // Index changes not yet saved because of buffering
+	ttlDisabled   atomic.Bool  // Entries never expire, see SetTTLEnabled
+	onExpire      expiryCallback
+	versions      versionClock // Hands out entry versions, see versionClock
+	syncOnWrite   bool
+
+	hintInterval int64 // Data file bytes appended between hint files, 0 disables them
+	hintOffset   int64 // Data file offset covered by the last hint written
+
+	degraded     error // Write failure that made the storage read-only, guarded by appendMu
+	held         error // Why HoldWrites refuses writes adding data, guarded by appendMu
+	minFreeBytes int64 // Free space large writes must leave, 0 disables the check
+	readOnly     bool  // Opened with Config.ReadOnly
+
+	cache *entryCache // Recently read entries, nil unless Config.CacheSize is set
+
+	counters  *opCounters  // Reads, writes and deletes, see Stats
+	diskStats diskCounters // Data file reads, index saves and compactions
+
+	log *slog.Logger // Config.Logger, or a logger discarding everything
+
+	checkpointInterval time.Duration // Time after which a write checkpoints, 0 disables it
+	lastCheckpoint     time.Time
 }
 
+// LockFileName is the file in the data directory that writable storage
+// holds a lock on while it is open. Opening a directory that writable
+// storage already has open, in this process or another, fails with an
+// error matching vfs.ErrLocked; read-only storage doesn't take the lock.
+const LockFileName = "LOCK"
+
 // NewDiskStorage creates a new disk-based storage instance
 func NewDiskStorage(dataDir string) (*DiskStorage, error) {
 	return NewDiskStorageWithWAL(dataDir, false, 0)
@@ -33,34 +108,116 @@ func NewDiskStorage(dataDir string) (*DiskStorage, error) {
 
 // NewDiskStorageWithWAL creates a new disk-based storage instance with optional WAL
 func NewDiskStorageWithWAL(dataDir string, enableWAL bool, maxWALSize int64) (*DiskStorage, error) {
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = dataDir
+	config.WALEnabled = enableWAL
+	config.MaxWALSize = maxWALSize
+	config.WriteBufferSize = 0 // Every write reaches the data file before returning
+
+	return NewDiskStorageWithConfig(config)
+}
+
+// NewDiskStorageWithConfig creates a new disk-based storage instance using the
+// data directory, WAL, write buffering and sync settings from config. Writes
+// are only buffered with the WAL enabled, since it is what recovers them
+// after a crash.
+func NewDiskStorageWithConfig(config types.Config) (*DiskStorage, error) {
+	return NewDiskStorageWithFS(config, vfs.OS)
+}
+
+// NewDiskStorageWithFS is NewDiskStorageWithConfig with every file, including
+// the WAL and blob files, accessed through fsys
+func NewDiskStorageWithFS(config types.Config, fsys vfs.FS) (*DiskStorage, error) {
+	dataDir := config.DataDirectory
+	enableWAL := config.WALEnabled
+	maxWALSize := config.MaxWALSize
+
+	if err := validateCompression(config.Compression); err != nil {
+		return nil, err
 	}
+	if err := config.ValidatePermissions(); err != nil {
+		return nil, err
+	}
+
+	if err := checkReadOnly(config); err != nil {
+		return nil, err
+	}
+
+	// Every file and directory created from here on gets the configured mode
+	fsys = vfs.WithModes(fsys, config.FilePermissions(), config.DirPermissions())
 
 	dataPath := filepath.Join(dataDir, "data.db")
-	indexPath := filepath.Join(dataDir, "index.db")
 
-	// Open or create data file
-	dataFile, err := os.OpenFile(dataPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	// Open or create data file; read-only storage needs an existing one.
+	// Writable storage locks the directory first, so two processes never
+	// write to it at once.
+	var dataFile vfs.File
+	var lock io.Closer
+	var err error
+	if config.ReadOnly {
+		dataFile, err = vfs.Open(fsys, dataPath)
+	} else if err = fsys.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	} else if lock, err = vfs.Lock(fsys, filepath.Join(dataDir, LockFileName), 0644); err != nil {
+		return nil, fmt.Errorf("failed to lock data directory %s: %w", dataDir, err)
+	} else {
+		dataFile, err = fsys.OpenFile(dataPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	}
 	if err != nil {
+		releaseLock(lock)
 		return nil, fmt.Errorf("failed to open data file: %w", err)
 	}
 
-	// Open or create index file
-	indexFile, err := os.OpenFile(indexPath, os.O_CREATE|os.O_RDWR, 0644)
+	formatVersion, err := initDataFile(dataFile)
 	if err != nil {
 		dataFile.Close()
-		return nil, fmt.Errorf("failed to open index file: %w", err)
+		releaseLock(lock)
+		return nil, fmt.Errorf("failed to initialize data file: %w", err)
+	}
+
+	// Reads get their own descriptor so they never share one with appends
+	readFile, err := vfs.Open(fsys, dataPath)
+	if err != nil {
+		dataFile.Close()
+		releaseLock(lock)
+		return nil, fmt.Errorf("failed to open data file for reading: %w", err)
 	}
 
 	storage := &DiskStorage{
-		dataDir:    dataDir,
-		dataFile:   dataFile,
-		indexFile:  indexFile,
-		index:      make(map[types.Key]int64),
-		nextOffset: 0,
-		closed:     false,
-		walEnabled: enableWAL,
+		fs:            fsys,
+		dataDir:       dataDir,
+		lock:          lock,
+		walPath:       config.WALFilePath(),
+		dataFile:      dataFile,
+		readGen:       newDataGeneration(1, readFile),
+		index:         make(map[types.Key]int64),
+		nextOffset:    0,
+		closed:        false,
+		walEnabled:    enableWAL,
+		formatVersion: formatVersion,
+		compression: compressionOptions{
+			algorithm: config.Compression,
+			minSize:   config.CompressionMinSize,
+		},
+		maxValueSize: maxDecompressedSize(config),
+		blobs:        newBlobStore(fsys, dataDir, config.BlobThreshold),
+		syncOnWrite:  config.SyncOnWrite,
+		hintInterval: config.IndexHintInterval,
+		minFreeBytes: config.MinFreeBytes,
+		readOnly:     config.ReadOnly,
+		cache:        newEntryCache(config.CacheSize),
+		counters:     &opCounters{},
+		log:          types.LoggerOrDiscard(config.Logger),
+
+		checkpointInterval: config.WALCheckpointInterval,
+		lastCheckpoint:     time.Now(),
+	}
+
+	// Buffered records are only acknowledged once the WAL has them, so
+	// without one writes go straight to the data file
+	if config.WriteBufferSize > 0 && enableWAL {
+		storage.writer = newWriteBuffer(dataFile, config.WriteBufferSize)
 	}
 
 	// Initialize WAL if enabled
@@ -68,9 +225,20 @@ func NewDiskStorageWithWAL(dataDir string, enableWAL bool, maxWALSize int64) (*D
 		if maxWALSize <= 0 {
 			maxWALSize = 10 * 1024 * 1024 // Default 10MB
 		}
-		
-		walPath := filepath.Join(dataDir, "wal.log")
-		walInstance, err := wal.NewWAL(walPath, maxWALSize)
+
+		walInstance, err := wal.NewWALWithOptions(storage.walPath, wal.Options{
+			MaxSize:     maxWALSize,
+			FS:          fsys,
+			Logger:      config.Logger,
+			SkipCorrupt: config.WALSkipCorrupt,
+			SyncPolicy:  config.WALSyncPolicy,
+			SyncPeriod:  config.WALSyncPeriod,
+			SyncEvery:   config.WALSyncEvery,
+
+			RetainSegments: config.WALRetainSegments,
+			MaxKeySize:     config.MaxKeySize,
+			MaxValueSize:   config.MaxValueSize,
+		})
 		if err != nil {
 			storage.Close()
 			return nil, fmt.Errorf("failed to create WAL: %w", err)
@@ -84,305 +252,815 @@ func NewDiskStorageWithWAL(dataDir string, enableWAL bool, maxWALSize int64) (*D
 		return nil, fmt.Errorf("failed to load index: %w", err)
 	}
 
+	// Count blob references before replay so replayed deletes can't
+	// collect a blob the loaded index still uses
+	hasBlobs := storage.blobs.hasBlobs()
+	if hasBlobs {
+		storage.loadBlobRefs()
+	}
+
+	// Persist an index that had to be rebuilt
+	if storage.indexDirty && !storage.readOnly {
+		if err := storage.flush(); err != nil {
+			storage.Close()
+			return nil, fmt.Errorf("failed to save rebuilt index: %w", err)
+		}
+	}
+
 	// Replay WAL if enabled and exists
 	if enableWAL && storage.wal != nil {
-		if err := storage.replayWAL(); err != nil {
+		replayed, err := storage.replayWAL()
+		if err != nil {
 			storage.Close()
 			return nil, fmt.Errorf("failed to replay WAL: %w", err)
 		}
+		if hasBlobs {
+			storage.loadBlobRefs()
+		}
+
+		// The replayed operations are in the data file again, so a
+		// checkpoint keeps the next open from appending them once more
+		if replayed > 0 {
+			storage.log.Info("replayed WAL", "dir", dataDir, "operations", replayed)
+			if err := storage.checkpoint(); err != nil {
+				storage.log.Error("failed to checkpoint replayed WAL", "dir", dataDir, "error", err)
+			}
+		}
 	}
 
 	return storage, nil
 }
 
-// loadIndex loads the index from disk
-func (s *DiskStorage) loadIndex() error {
-	// Get file size to check if index file is empty
-	stat, err := s.indexFile.Stat()
+// initDataFile writes the format header to a new data file, or detects the
+// format version of an existing one. Legacy files keep their JSON encoding
+// until they are rewritten by Compact or Clear.
+func initDataFile(file vfs.File) (uint32, error) {
+	stat, err := file.Stat()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if stat.Size() == 0 {
-		return nil // Empty index file, start fresh
+		if _, err := file.Write(encodeFileHeader(currentFormatVersion)); err != nil {
+			return 0, err
+		}
+		return currentFormatVersion, nil
+	}
+
+	header := make([]byte, fileHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
 	}
 
-	// Read index data
-	indexData, err := io.ReadAll(s.indexFile)
+	return decodeFileHeader(header[:n])
+}
+
+// loadIndex loads the index from disk
+func (s *DiskStorage) loadIndex() error {
+	// Calculate next offset based on data file size. This must happen even
+	// when the index is empty: buffered writes may have reached the data
+	// file before the index was ever saved.
+	dataStat, err := s.dataFile.Stat()
 	if err != nil {
 		return err
 	}
+	s.nextOffset = dataStat.Size()
+	s.flushedOffset.Store(s.nextOffset)
 
-	// Parse JSON index
-	if len(indexData) > 0 {
-		if err := json.Unmarshal(indexData, &s.index); err != nil {
-			return err
+	indexPath := filepath.Join(s.dataDir, "index.db")
+
+	// A hint file avoids parsing the whole index
+	if s.loadHint() {
+		// Still write index.db if it is missing
+		if _, err := s.fs.Stat(indexPath); os.IsNotExist(err) {
+			s.indexDirty = true
 		}
+		return nil
 	}
 
-	// Calculate next offset based on data file size
-	dataStat, err := s.dataFile.Stat()
-	if err != nil {
+	indexData, err := vfs.ReadFile(s.fs, indexPath)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	s.nextOffset = dataStat.Size()
+
+	// A missing, empty or corrupt index is rebuilt by scanning the data file
+	// and saved again once the storage is open
+	index, err := DecodeIndex(indexData)
+	if err != nil {
+		if len(indexData) > 0 {
+			s.log.Warn("rebuilding corrupt index from the data file", "dir", s.dataDir, "error", err)
+		}
+		s.rebuildIndex()
+		s.indexDirty = true
+		return nil
+	}
+	s.index = index
 
 	return nil
 }
 
-// replayWAL replays WAL entries to restore state
-func (s *DiskStorage) replayWAL() error {
+// rebuildIndex recreates the index by scanning the data file. Legacy JSON
+// files have no tombstones, so keys deleted from them come back.
+func (s *DiskStorage) rebuildIndex() {
+	start := int64(0)
+	if s.formatVersion != formatVersionJSON {
+		start = fileHeaderSize
+	}
+
+	replayRecords(s.readGen.file, start, s.nextOffset, s.formatVersion, s.maxValueSize, s.index)
+}
+
+// replayRecords applies the records between start and end to index: the
+// last record written for a key wins and tombstones delete it. A batch is
+// only applied once its last record has been read, so one cut short by a
+// crash is dropped as a whole.
+func replayRecords(r io.ReaderAt, start, end int64, version uint32, maxValue int, index map[types.Key]int64) {
+	apply := func(scanned scannedRecord) {
+		if scanned.record.tombstone {
+			delete(index, scanned.record.entry.Key)
+			return
+		}
+		index[scanned.record.entry.Key] = scanned.offset
+	}
+
+	var batch []scannedRecord
+	next := start
+	scanDataFile(r, start, end, version, maxValue, func(scanned scannedRecord) {
+		if scanned.offset != next {
+			batch = batch[:0] // Unreadable bytes interrupted the batch
+		}
+		next = scanned.offset + scanned.size
+
+		if scanned.record.batched {
+			batch = append(batch, scanned)
+			return
+		}
+		for _, member := range batch {
+			apply(member)
+		}
+		batch = batch[:0]
+		apply(scanned)
+	})
+}
+
+// replayWAL replays the WAL entries after the last checkpoint to restore
+// state and returns how many there were
+func (s *DiskStorage) replayWAL() (int, error) {
 	if s.wal == nil {
-		return nil
+		return 0, nil
+	}
+
+	entries, err := s.wal.ReadEntries()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read WAL entries: %w", err)
+	}
+	if len(entries) == 0 {
+		return 0, nil
 	}
 
-	// Create a temporary storage to replay into
+	// Create a temporary storage to replay into. It starts from the loaded
+	// index, since a checkpoint may have removed the WAL segments that
+	// wrote part of it.
 	tempStorage := &DiskStorage{
+		fs:         s.fs,
 		dataDir:    s.dataDir,
 		dataFile:   s.dataFile,
-		indexFile:  s.indexFile,
-		index:      make(map[types.Key]int64),
+		readGen:    s.readGen,
+		index:      maps.Clone(s.index),
 		nextOffset: s.nextOffset,
 		closed:     false,
+		writer:     s.writer,
+
+		formatVersion: s.formatVersion,
+		compression:   s.compression,
+		maxValueSize:  s.maxValueSize,
+		blobs:         s.blobs,
+		cache:         s.cache,
+		counters:      s.counters,
+		log:           s.log,
 	}
+	tempStorage.flushedOffset.Store(s.flushedOffset.Load())
 
 	// Replay WAL entries
-	if err := s.wal.ReplayEntries(tempStorage); err != nil {
-		return fmt.Errorf("failed to replay WAL: %w", err)
+	if err := wal.Replay(entries, tempStorage); err != nil {
+		return 0, fmt.Errorf("failed to replay WAL: %w", err)
 	}
 
-	// Update our state with the replayed data
+	// Update our state with the replayed data. A replayed clear replaces
+	// the data file, so take over the temporary storage's handles.
+	s.dataFile = tempStorage.dataFile
+	s.readGen = tempStorage.readGen
+	s.formatVersion = tempStorage.formatVersion
 	s.index = tempStorage.index
 	s.nextOffset = tempStorage.nextOffset
+	s.flushedOffset.Store(tempStorage.flushedOffset.Load())
+	s.indexDirty = tempStorage.indexDirty
+	s.versions.observe(tempStorage.versions.last.Load())
 
-	return nil
+	return len(entries), nil
+}
+
+// loadBlobRefs rebuilds the blob reference counts from the live records.
+// Only the flags byte of inline records is inspected; records that fail to
+// decode are skipped and reported when they are read.
+func (s *DiskStorage) loadBlobRefs() {
+	s.blobs.keys = make(map[types.Key]blobRef)
+	s.blobs.refs = make(map[string]int)
+
+	if s.formatVersion == formatVersionJSON {
+		return // Legacy files can't reference blobs
+	}
+
+	for key, offset := range s.index {
+		data, err := s.readRecordData(offset)
+		if err != nil || len(data) == 0 || data[0]&recordFlagBlob == 0 {
+			continue
+		}
+		record, err := decodeRecord(data, s.formatVersion, s.maxValueSize)
+		if err != nil {
+			continue
+		}
+		s.blobs.track(key, record.blob)
+	}
 }
 
-// saveIndex saves the index to disk
+// saveIndex saves the index to disk. If that fails the storage turns
+// read-only and the save is retried when it recovers.
 func (s *DiskStorage) saveIndex() error {
-	// Seek to beginning of index file
-	if _, err := s.indexFile.Seek(0, 0); err != nil {
+	if err := s.writeIndex(); err != nil {
+		s.indexDirty = true
+		s.degrade(err)
 		return err
 	}
 
-	// Truncate file to remove old data
-	if err := s.indexFile.Truncate(0); err != nil {
+	// Blobs released by the saved changes are no longer referenced on disk
+	return s.blobs.collect()
+}
+
+// writeIndex writes the index to index.db
+func (s *DiskStorage) writeIndex() error {
+	indexData, err := encodeIndex(s.index)
+	if err != nil {
 		return err
 	}
 
-	// Marshal index to JSON
-	indexData, err := json.Marshal(s.index)
-	if err != nil {
+	// Replace index.db atomically so a crash leaves either the old or the
+	// new index, never a torn one
+	indexPath := filepath.Join(s.dataDir, "index.db")
+	if err := writeFileSync(s.fs, indexPath+".tmp", indexData); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(indexPath+".tmp", indexPath); err != nil {
+		s.fs.Remove(indexPath + ".tmp")
 		return err
 	}
+	if err := vfs.SyncDir(s.fs, s.dataDir); err != nil {
+		return err
+	}
+	s.diskStats.indexSaves.Add(1)
+	return nil
+}
 
-	// Write index data
-	_, err = s.indexFile.Write(indexData)
-	return err
+// encodeRecord serializes an entry using the given format version, first
+// spilling the value to a blob file when it is over the blob threshold
+func (s *DiskStorage) encodeRecord(entry *types.Entry, version uint32) ([]byte, *blobRef, error) {
+	if version != formatVersionJSON && s.blobs.shouldSpill(entry.Value) {
+		ref, err := s.blobs.write(entry.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		return encodeBlobEntry(entry, ref), &ref, nil
+	}
+
+	entryData, err := encodeEntry(entry, version, s.compression)
+	return entryData, nil, err
 }
 
-// writeEntry writes an entry to the data file
-func (s *DiskStorage) writeEntry(entry *types.Entry) (int64, error) {
+// writeEntry writes an entry to the data file, returning its offset and the
+// blob its value was spilled to, if any
+func (s *DiskStorage) writeEntry(entry *types.Entry) (int64, *blobRef, error) {
 	// Serialize entry
-	entryData, err := json.Marshal(entry)
+	entryData, ref, err := s.encodeRecord(entry, s.formatVersion)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
-	// Write length prefix
-	length := uint32(len(entryData))
-	if err := binary.Write(s.dataFile, binary.LittleEndian, length); err != nil {
-		return 0, err
+	offset, err := s.appendRecord(entryData)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return offset, ref, nil
+}
+
+// writeTombstone appends a tombstone for key. Legacy JSON files have no way
+// to represent one, so nothing is written for them.
+func (s *DiskStorage) writeTombstone(key types.Key) error {
+	if s.formatVersion == formatVersionJSON {
+		return nil
 	}
 
-	// Write entry data
+	_, err := s.appendRecord(encodeTombstone(key, time.Now()))
+	return err
+}
+
+// appendRecord appends an encoded record to the data file (through the
+// write buffer when enabled) and returns its offset
+func (s *DiskStorage) appendRecord(entryData []byte) (int64, error) {
+	// Length prefix followed by the entry data, written with a single call
+	// so a buffered record is never split across flushes
+	record := make([]byte, 4+len(entryData))
+	binary.LittleEndian.PutUint32(record, uint32(len(entryData)))
+	copy(record[4:], entryData)
+
 	offset := s.nextOffset
-	if _, err := s.dataFile.Write(entryData); err != nil {
-		return 0, err
+	if s.writer != nil {
+		if err := s.writeBuffered(record); err != nil {
+			return 0, err
+		}
+	} else {
+		if _, err := s.dataFile.Write(record); err != nil {
+			// Drop any part of the record that made it to the file so the
+			// next record starts at nextOffset
+			return 0, s.writeFailed(err)
+		}
+		s.flushedOffset.Store(offset + int64(len(record)))
 	}
 
 	// Update next offset
-	s.nextOffset += int64(4 + len(entryData)) // 4 bytes for length + data
+	s.nextOffset += int64(len(record)) // 4 bytes for length + data
 
 	return offset, nil
 }
 
-// readEntry reads an entry from the data file at the given offset
+// writeBuffered appends a record to the write buffer, flushing first when
+// the record would not fit so that whole records reach the file together
+func (s *DiskStorage) writeBuffered(record []byte) error {
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+
+	if s.writer.Buffered() > 0 && len(record) > s.writer.Available() {
+		if err := s.writer.Flush(); err != nil {
+			return s.writeFailed(err)
+		}
+		s.flushedOffset.Store(s.nextOffset)
+
+		// Everything the index references is on disk now
+		if s.indexDirty {
+			if err := s.saveIndex(); err != nil {
+				return err
+			}
+			s.indexDirty = false
+		}
+	}
+
+	if _, err := s.writer.Write(record); err != nil {
+		return s.writeFailed(err)
+	}
+	if s.writer.Buffered() == 0 {
+		// Records larger than the buffer are written straight through
+		s.flushedOffset.Store(s.nextOffset + int64(len(record)))
+	}
+
+	return nil
+}
+
+// flushWriter writes any buffered records to the data file. The caller must
+// hold appendMu.
+func (s *DiskStorage) flushWriter() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	s.writerMu.Lock()
+	defer s.writerMu.Unlock()
+
+	if s.writer.Buffered() == 0 {
+		return nil
+	}
+
+	buffered := int64(s.writer.Buffered())
+	if err := s.writer.Flush(); err != nil {
+		return s.writeFailed(err)
+	}
+	s.flushedOffset.Store(s.flushedOffset.Load() + buffered)
+
+	return nil
+}
+
+// flush writes buffered records to the data file and saves the index if it
+// has changes that were deferred while the records were buffered
+func (s *DiskStorage) flush() error {
+	if err := s.flushWriter(); err != nil {
+		return err
+	}
+
+	if s.indexDirty {
+		if err := s.saveIndex(); err != nil {
+			return err
+		}
+		s.indexDirty = false
+	}
+
+	return nil
+}
+
+// sync flushes buffered records and the index and fsyncs both files
+func (s *DiskStorage) sync() error {
+	if err := s.flushWriter(); err != nil {
+		return err
+	}
+	if err := s.dataFile.Sync(); err != nil {
+		s.degrade(err)
+		return err
+	}
+
+	if err := s.saveIndex(); err != nil {
+		return err
+	}
+	s.indexDirty = false
+
+	return nil
+}
+
+// commit persists the index after a mutation according to the durability
+// settings: unbuffered storage saves it immediately, buffered storage defers
+// it to the next flush, and SyncOnWrite flushes and fsyncs everything
+func (s *DiskStorage) commit() error {
+	defer s.maybeWriteHint()
+	defer s.maybeCheckpoint()
+
+	if s.syncOnWrite {
+		return s.sync()
+	}
+
+	if s.writer != nil {
+		s.indexDirty = true
+		return nil
+	}
+
+	return s.saveIndex()
+}
+
+// readEntry reads an entry from the data file at the given offset, loading
+// its value from the blob file if it was spilled
 func (s *DiskStorage) readEntry(offset int64) (*types.Entry, error) {
-	// Seek to offset
-	if _, err := s.dataFile.Seek(offset, 0); err != nil {
+	if entry, ok := s.cache.get(offset); ok {
+		return entry, nil
+	}
+
+	record, err := s.readRecord(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.blob != nil {
+		value, err := s.blobs.read(*record.blob)
+		if err != nil {
+			return nil, err
+		}
+		record.entry.Value = value
+	}
+
+	s.cache.add(offset, record.entry)
+	return record.entry, nil
+}
+
+// readRecord reads and decodes the record at the given offset without
+// loading a spilled value, for callers that only need key, TTL and timestamp
+func (s *DiskStorage) readRecord(offset int64) (*decodedRecord, error) {
+	entryData, err := s.readRecordData(offset)
+	if err != nil {
 		return nil, err
 	}
 
+	// Deserialize entry
+	return decodeRecord(entryData, s.formatVersion, s.maxValueSize)
+}
+
+// readRecordData reads the raw bytes of the record at the given offset
+func (s *DiskStorage) readRecordData(offset int64) ([]byte, error) {
 	// Read length prefix
-	var length uint32
-	if err := binary.Read(s.dataFile, binary.LittleEndian, &length); err != nil {
+	var prefix [4]byte
+	if err := s.readAt(prefix[:], offset); err != nil {
 		return nil, err
 	}
+	length := binary.LittleEndian.Uint32(prefix[:])
+
+	// A damaged prefix must not make us allocate up to 4GB
+	if int64(length) > maxRecordSize(s.maxValueSize) {
+		return nil, fmt.Errorf("%w: record at offset %d claims %d bytes", ErrCorruptRecord, offset, length)
+	}
 
 	// Read entry data
 	entryData := make([]byte, length)
-	if _, err := io.ReadFull(s.dataFile, entryData); err != nil {
+	if err := s.readAt(entryData, offset+4); err != nil {
 		return nil, err
 	}
 
-	// Deserialize entry
-	var entry types.Entry
-	if err := json.Unmarshal(entryData, &entry); err != nil {
-		return nil, err
+	s.diskStats.reads.Add(1)
+	s.diskStats.bytesRead.Add(int64(len(prefix) + len(entryData)))
+	return entryData, nil
+}
+
+// readAt reads len(p) bytes of the data file at off, taking them from the
+// write buffer if they haven't been flushed yet. A record is never split
+// between the buffer and the file.
+func (s *DiskStorage) readAt(p []byte, off int64) error {
+	if s.writer != nil && off >= s.flushedOffset.Load() {
+		s.writerMu.Lock()
+		if flushed := s.flushedOffset.Load(); off >= flushed {
+			_, err := s.writer.ReadAt(p, off-flushed)
+			s.writerMu.Unlock()
+			return err
+		}
+		s.writerMu.Unlock()
 	}
 
-	return &entry, nil
+	_, err := s.readGen.file.ReadAt(p, off)
+	return err
 }
 
 // Get retrieves a value by key
 func (s *DiskStorage) Get(key types.Key) (types.Value, error) {
+	entry, err := s.GetEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry retrieves the whole entry stored for key, with the timestamp and
+// TTL it was written with
+func (s *DiskStorage) GetEntry(key types.Key) (*types.Entry, error) {
+	entry, err := s.liveEntry(key)
+	s.counters.read(err)
+	return entry, err
+}
+
+// liveEntry implements GetEntry, apart from counting the read
+func (s *DiskStorage) liveEntry(key types.Key) (*types.Entry, error) {
+	entry, offset, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if entry has expired; the index can't change under the read
+	// lock, so the cleanup happens once it is released
+	if s.expired(entry) {
+		s.removeExpired(key, offset)
+		return nil, types.ErrKeyExpired
+	}
+
+	return entry, nil
+}
+
+// getEntry reads the entry stored for key under the read lock, along with
+// its offset
+func (s *DiskStorage) getEntry(key types.Key) (*types.Entry, int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	if s.closed {
-		return nil, types.ErrDatabaseClosed
+		return nil, 0, types.ErrDatabaseClosed
 	}
 
 	offset, exists := s.index[key]
 	if !exists {
-		return nil, types.ErrKeyNotFound
+		return nil, 0, types.ErrKeyNotFound
 	}
 
 	entry, err := s.readEntry(offset)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	s.versions.observe(entry.Version)
 
-	// Check if entry has expired
-	if entry.IsExpired() {
-		// Clean up expired entry
-		delete(s.index, key)
+	return entry, offset, nil
+}
+
+// removeExpired drops an expired key from the index, unless it was written
+// again since it was found expired at offset. With buffering the index save
+// is left to the next flush since buffered records may not be on disk yet.
+func (s *DiskStorage) removeExpired(key types.Key, offset int64) {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.degraded != nil || s.readOnly || s.index[key] != offset {
+		return
+	}
+
+	entry := s.expiredEntry(key, offset)
+	delete(s.index, key)
+	s.blobs.untrack(key)
+	if s.writer == nil {
 		s.saveIndex()
-		return nil, types.ErrKeyExpired
+	} else {
+		s.indexDirty = true
+	}
+	if entry != nil {
+		s.onExpire.notify(entry)
 	}
+}
 
-	return entry.Value, nil
+// expiredEntry reads the entry at offset, which is about to be removed
+// because it expired, if the expiry callback needs it. An entry that can't
+// be read is passed on without its value. The caller must hold mu.
+func (s *DiskStorage) expiredEntry(key types.Key, offset int64) *types.Entry {
+	if !s.onExpire.active() {
+		return nil
+	}
+	entry, err := s.readEntry(offset)
+	if err != nil {
+		return &types.Entry{Key: key}
+	}
+	return entry
 }
 
 // Set stores a key-value pair
-func (s *DiskStorage) Set(key types.Key, value types.Value) error {
+func (s *DiskStorage) Set(key types.Key, value types.Value) (err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+	defer s.keys.lock(key)()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return types.ErrDatabaseClosed
 	}
+	if err := s.checkGrowth(int64(len(key) + len(value))); err != nil {
+		return err
+	}
 
 	entry := &types.Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now(),
+		UpdatedAt: time.Now(),
 		TTL:       nil, // No TTL by default
 	}
+	s.versions.stamp(entry)
+	s.revise(entry, nil)
 
-	offset, err := s.writeEntry(entry)
+	offset, ref, err := s.writeEntry(entry)
 	if err != nil {
 		return err
 	}
 
 	// Update index
 	s.index[key] = offset
+	s.blobs.track(key, ref)
+	s.counters.wrote(1)
 
 	// Log to WAL if enabled
 	if s.walEnabled && s.wal != nil {
-		if err := s.wal.LogSet(key, value, nil); err != nil {
-			// If WAL logging fails, we should still save the index
-			// but log the error
-			fmt.Printf("Warning: Failed to log to WAL: %v\n", err)
+		var err error
+		if walWrite, err = s.wal.AppendSetEntry(entry); err != nil {
+			return s.commitUnlogged(err)
 		}
 	}
 
 	// Save index
-	return s.saveIndex()
+	return s.commit()
 }
 
 // SetWithTTL stores a key-value pair with a time-to-live
 func (s *DiskStorage) SetWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+	return s.SetWithExpiry(key, value, ttl, time.Now().Add(ttl))
+}
+
+// SetWithExpiry stores a key-value pair that expires at expiresAt. The
+// expiry is kept in the data file and the WAL, so neither replay nor a
+// restore extends it.
+func (s *DiskStorage) SetWithExpiry(key types.Key, value types.Value, ttl time.Duration, expiresAt time.Time) (err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+	defer s.keys.lock(key)()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return types.ErrDatabaseClosed
 	}
+	if err := s.checkGrowth(int64(len(key) + len(value))); err != nil {
+		return err
+	}
 
 	entry := &types.Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now(),
+		UpdatedAt: time.Now(),
 		TTL:       &ttl,
+		ExpiresAt: expiresAt,
 	}
+	s.versions.stamp(entry)
+	s.revise(entry, nil)
 
-	offset, err := s.writeEntry(entry)
+	offset, ref, err := s.writeEntry(entry)
 	if err != nil {
 		return err
 	}
 
 	// Update index
 	s.index[key] = offset
+	s.blobs.track(key, ref)
+	s.counters.wrote(1)
 
 	// Log to WAL if enabled
 	if s.walEnabled && s.wal != nil {
-		if err := s.wal.LogSet(key, value, &ttl); err != nil {
-			fmt.Printf("Warning: Failed to log to WAL: %v\n", err)
+		var err error
+		if walWrite, err = s.wal.AppendSetEntry(entry); err != nil {
+			return s.commitUnlogged(err)
 		}
 	}
 
 	// Save index
-	return s.saveIndex()
+	return s.commit()
 }
 
-// Delete removes a key-value pair
-func (s *DiskStorage) Delete(key types.Key) error {
+// Delete removes a key-value pair. A tombstone is appended so that a scan
+// of the data file (such as Repair) doesn't resurrect the key.
+func (s *DiskStorage) Delete(key types.Key) (err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+	defer s.keys.lock(key)()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return types.ErrDatabaseClosed
 	}
+	if err := s.checkWritable(0); err != nil {
+		return err
+	}
 
-	delete(s.index, key)
+	if _, exists := s.index[key]; exists {
+		if err := s.writeTombstone(key); err != nil {
+			return err
+		}
+		s.counters.deleted(1)
+	}
+
+	delete(s.index, key)
+	s.blobs.untrack(key)
 
 	// Log to WAL if enabled
 	if s.walEnabled && s.wal != nil {
-		if err := s.wal.LogDelete(key); err != nil {
-			fmt.Printf("Warning: Failed to log to WAL: %v\n", err)
+		var err error
+		if walWrite, err = s.wal.AppendDelete(key); err != nil {
+			return s.commitUnlogged(err)
 		}
 	}
 
-	return s.saveIndex()
+	return s.commit()
 }
 
 // Exists checks if a key exists
 func (s *DiskStorage) Exists(key types.Key) (bool, error) {
+	offset, expired, err := s.exists(key)
+	if err != nil || offset < 0 {
+		return false, err
+	}
+
+	// Expired entries are cleaned up once the read lock is released, as
+	// in GetEntry
+	if expired {
+		s.removeExpired(key, offset)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// exists looks key up under the read lock, returning its offset, -1 if it
+// isn't stored, and whether it has expired
+func (s *DiskStorage) exists(key types.Key) (int64, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	if s.closed {
-		return false, types.ErrDatabaseClosed
+		return -1, false, types.ErrDatabaseClosed
 	}
 
 	offset, exists := s.index[key]
 	if !exists {
-		return false, nil
+		return -1, false, nil
 	}
 
-	entry, err := s.readEntry(offset)
+	record, err := s.readRecord(offset)
 	if err != nil {
-		return false, err
-	}
-
-	// Check if entry has expired
-	if entry.IsExpired() {
-		return false, nil
+		return -1, false, err
 	}
 
-	return true, nil
+	return offset, s.expired(record.entry), nil
 }
 
 // BatchGet retrieves multiple values by keys
@@ -396,84 +1074,684 @@ func (s *DiskStorage) BatchGet(keys []types.Key) (map[types.Key]types.Value, err
 
 	result := make(map[types.Key]types.Value)
 
+	// Resolve offsets first and read them in file order so the reads
+	// sweep forward through the data file instead of seeking randomly
+	type keyOffset struct {
+		key    types.Key
+		offset int64
+	}
+	located := make([]keyOffset, 0, len(keys))
+	seen := make(map[types.Key]bool, len(keys))
 	for _, key := range keys {
 		offset, exists := s.index[key]
-		if exists {
-			entry, err := s.readEntry(offset)
-			if err == nil && !entry.IsExpired() {
-				result[key] = entry.Value
-			}
+		if !exists {
+			s.counters.read(types.ErrKeyNotFound)
+		} else if !seen[key] {
+			seen[key] = true
+			located = append(located, keyOffset{key: key, offset: offset})
+		}
+	}
+	sort.Slice(located, func(i, j int) bool {
+		return located[i].offset < located[j].offset
+	})
+
+	for _, loc := range located {
+		entry, err := s.readEntry(loc.offset)
+		switch {
+		case err != nil:
+		case s.expired(entry):
+			s.counters.read(types.ErrKeyExpired)
+		default:
+			result[loc.key] = entry.Value
+			s.counters.read(nil)
 		}
 	}
 
 	return result, nil
 }
 
-// BatchSet stores multiple key-value pairs
-func (s *DiskStorage) BatchSet(entries []types.Entry) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+// BatchSet stores multiple key-value pairs. The batch is all or nothing:
+// every entry is encoded before anything is written, the records are
+// appended with a single write and fsynced, and only then is the index
+// updated. If the write fails the data file is truncated back to where the
+// batch started and the index is left untouched. Only the update of the
+// index blocks readers.
+func (s *DiskStorage) BatchSet(entries []types.Entry) (err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+	defer s.keys.lock(entryKeys(entries)...)()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+
+	// Everything up to the write only changes under appendMu, which is held
 	if s.closed {
 		return types.ErrDatabaseClosed
 	}
+	return s.batchSet(entries, nil, &walWrite)
+}
 
-	now := time.Now()
+// batchSet implements BatchSet, setting walWrite to the WAL write to wait
+// for. Any keys in deletes that exist are deleted in the same batch, which
+// the WAL then logs as a commit rather than a batch set. The caller holds
+// appendMu and has checked the storage is open.
+func (s *DiskStorage) batchSet(entries []types.Entry, deletes []types.Key, walWrite *wal.Pending) error {
+	size := int64(0)
 	for _, entry := range entries {
+		size += int64(len(entry.Key) + len(entry.Value))
+	}
+	check := s.checkWritable
+	if len(entries) > 0 {
+		check = s.checkGrowth
+	}
+	if err := check(size); err != nil {
+		return err
+	}
+
+	// Buffered records must reach the file first so the batch starts at a
+	// known offset that can be truncated back to
+	if err := s.flushWriter(); err != nil {
+		return err
+	}
+	start := s.nextOffset
+
+	// The index only changes under appendMu, so this stays true
+	var deleted []types.Key
+	for _, key := range deletes {
+		if _, exists := s.index[key]; exists {
+			deleted = append(deleted, key)
+		}
+	}
+	// Legacy JSON files have no way to represent a tombstone
+	tombstones := deleted
+	if s.formatVersion == formatVersionJSON {
+		tombstones = nil
+	}
+
+	// Encode the whole batch up front
+	var batch []byte
+	offsets := make([]int64, len(entries))
+	refs := make([]*blobRef, len(entries))
+	stamped := make([]types.Entry, len(entries))
+	latest := make(map[types.Key]*types.Entry, len(entries))
+	records := len(entries) + len(tombstones)
+	now := time.Now()
+	for i, entry := range entries {
 		// Create a copy of the entry to avoid pointer issues
 		entryCopy := entry
 		// Set timestamp if not already set
-		if entryCopy.Timestamp.IsZero() {
-			entryCopy.Timestamp = now
+		if entryCopy.UpdatedAt.IsZero() {
+			entryCopy.UpdatedAt = now
 		}
-
-		offset, err := s.writeEntry(&entryCopy)
+		entryCopy.ExpiresAt = entryCopy.Expiry()
+		s.versions.stamp(&entryCopy)
+		s.mu.RLock()
+		s.revise(&entryCopy, latest)
+		s.mu.RUnlock()
+		stamped[i] = entryCopy
+		latest[entryCopy.Key] = &stamped[i]
+
+		entryData, ref, err := s.encodeRecord(&entryCopy, s.formatVersion)
 		if err != nil {
+			return fmt.Errorf("failed to encode entry %q: %w", entryCopy.Key, err)
+		}
+
+		offsets[i] = start + int64(len(batch))
+		refs[i] = ref
+		batch = s.appendBatchRecord(batch, entryData, i < records-1)
+	}
+	for i, key := range tombstones {
+		batch = s.appendBatchRecord(batch, encodeTombstone(key, now), len(entries)+i < records-1)
+	}
+
+	// The WAL is appended to after the data file, so a batch it would
+	// refuse must be turned away before the write
+	if s.walEnabled && s.wal != nil {
+		if err := s.wal.CheckBatch(stamped, deletes); err != nil {
 			return err
 		}
+	}
 
-		s.index[entryCopy.Key] = offset
+	if err := s.writeBatch(start, batch); err != nil {
+		return err
 	}
 
-	return s.saveIndex()
+	// The batch is on disk, publish it
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextOffset = start + int64(len(batch))
+	s.flushedOffset.Store(s.nextOffset)
+	for i := range entries {
+		s.index[entries[i].Key] = offsets[i]
+		s.blobs.track(entries[i].Key, refs[i])
+	}
+	for _, key := range deleted {
+		delete(s.index, key)
+		s.blobs.untrack(key)
+	}
+	s.counters.wrote(len(entries))
+	s.counters.deleted(len(deleted))
+
+	// Log to WAL if enabled
+	if s.walEnabled && s.wal != nil {
+		var err error
+		if len(deletes) == 0 {
+			*walWrite, err = s.wal.AppendBatchSet(stamped)
+		} else {
+			*walWrite, err = s.wal.AppendCommit(stamped, deletes)
+		}
+		if err != nil {
+			return s.commitUnlogged(err)
+		}
+	}
+
+	return s.commit()
+}
+
+// bulkLoadChunkSize is about how many bytes of records BulkLoad writes at
+// a time
+const bulkLoadChunkSize = 4 << 20
+
+// BulkLoad writes entries to the data file without logging them to the
+// WAL, for loading large amounts of data without writing it twice. It
+// checkpoints first, so no WAL entry from before the load can be replayed
+// over it, writes the entries in batches of about bulkLoadChunkSize bytes
+// without fsyncing each one, and checkpoints again at the end, which
+// fsyncs them and moves the point recovery replays the WAL from past the
+// load. Other writes wait until it is done.
+//
+// The entries are only durable once BulkLoad returns: a crash during the
+// load loses some or all of them. If it fails part way, the entries written
+// so far are visible but may not survive a crash.
+func (s *DiskStorage) BulkLoad(entries []types.Entry) error {
+	loader, err := s.StartBulkLoad()
+	if err != nil {
+		return err
+	}
+	if err := loader.Load(entries); err != nil {
+		loader.Finish()
+		return err
+	}
+	return loader.Finish()
+}
+
+// BulkLoader is a bulk load in progress, for loads too large to hold in
+// memory at once: each Load writes some of the entries the way BulkLoad
+// does, and Finish checkpoints once at the end. Other writes wait from
+// StartBulkLoad until Finish, which must be called. A BulkLoader isn't safe
+// for concurrent use.
+type BulkLoader struct {
+	s      *DiskStorage
+	unlock func()
+	failed bool // A write failed, so Finish doesn't checkpoint
+	done   bool
+}
+
+// StartBulkLoad checkpoints, so no WAL entry from before the load can be
+// replayed over it, and returns the loader to write the load with
+func (s *DiskStorage) StartBulkLoad() (*BulkLoader, error) {
+	unlockKeys := s.keys.lockAll()
+	s.appendMu.Lock()
+	unlock := func() {
+		s.appendMu.Unlock()
+		unlockKeys()
+	}
+
+	// Everything up to the writes only changes under appendMu, which is held
+	if s.closed {
+		unlock()
+		return nil, types.ErrDatabaseClosed
+	}
+	if err := s.checkGrowth(0); err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := s.lockedCheckpoint(); err != nil {
+		unlock()
+		return nil, fmt.Errorf("failed to checkpoint before bulk load: %w", err)
+	}
+	return &BulkLoader{s: s, unlock: unlock}, nil
+}
+
+// Load writes entries to the data file in batches of about
+// bulkLoadChunkSize bytes, without fsyncing them, and indexes them. They
+// are visible once it returns but only durable once Finish does.
+func (l *BulkLoader) Load(entries []types.Entry) error {
+	if l.done {
+		return errors.New("bulk load already finished")
+	}
+	if l.failed {
+		return errors.New("bulk load failed writing an earlier batch")
+	}
+	s := l.s
+	size := int64(0)
+	for _, entry := range entries {
+		size += int64(len(entry.Key) + len(entry.Value))
+	}
+	if err := s.checkGrowth(size); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	latest := make(map[types.Key]*types.Entry)
+	for len(entries) > 0 {
+		start := s.nextOffset
+		var batch []byte
+		var offsets []int64
+		var refs []*blobRef
+		for _, entry := range entries {
+			loaded := entry
+			if loaded.UpdatedAt.IsZero() {
+				loaded.UpdatedAt = now
+			}
+			s.versions.stamp(&loaded)
+			s.mu.RLock()
+			s.revise(&loaded, latest)
+			s.mu.RUnlock()
+			latest[loaded.Key] = &loaded
+			entryData, ref, err := s.encodeRecord(&loaded, s.formatVersion)
+			if err != nil {
+				return fmt.Errorf("failed to encode entry %q: %w", loaded.Key, err)
+			}
+
+			last := len(offsets) == len(entries)-1 || len(batch)+4+len(entryData) >= bulkLoadChunkSize
+			offsets = append(offsets, start+int64(len(batch)))
+			refs = append(refs, ref)
+			batch = s.appendBatchRecord(batch, entryData, !last)
+			if last {
+				break
+			}
+		}
+
+		if _, err := s.dataFile.Write(batch); err != nil {
+			l.failed = true
+			return s.writeFailed(fmt.Errorf("failed to write bulk load: %w", err))
+		}
+
+		s.mu.Lock()
+		s.nextOffset = start + int64(len(batch))
+		s.flushedOffset.Store(s.nextOffset)
+		for i, offset := range offsets {
+			s.index[entries[i].Key] = offset
+			s.blobs.track(entries[i].Key, refs[i])
+		}
+		s.indexDirty = true
+		s.counters.wrote(len(offsets))
+		s.mu.Unlock()
+
+		entries = entries[len(offsets):]
+	}
+	return nil
+}
+
+// Finish ends the load, checkpointing unless a Load failed writing, which
+// fsyncs the data and index and records that recovery starts replaying the
+// WAL after the load. Other writes go on once it returns, whether or not it
+// fails; later calls do nothing.
+func (l *BulkLoader) Finish() error {
+	if l.done {
+		return nil
+	}
+	l.done = true
+	defer l.unlock()
+
+	if l.failed {
+		return nil
+	}
+	if err := l.s.lockedCheckpoint(); err != nil {
+		return fmt.Errorf("failed to checkpoint after bulk load: %w", err)
+	}
+	return nil
+}
+
+// lockedCheckpoint runs checkpoint under mu. The caller holds appendMu.
+func (s *DiskStorage) lockedCheckpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.maybeWriteHint()
+
+	return s.checkpoint()
 }
 
-// BatchDelete removes multiple key-value pairs
-func (s *DiskStorage) BatchDelete(keys []types.Key) error {
+// BatchDelete removes multiple key-value pairs. Like BatchSet, the
+// tombstones are appended with a single write and fsynced before any key is
+// removed from the index.
+func (s *DiskStorage) BatchDelete(keys []types.Key) (err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+	defer s.keys.lock(keys...)()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return types.ErrDatabaseClosed
 	}
+	return s.batchDelete(keys, &walWrite)
+}
 
+// batchDelete implements BatchDelete, setting walWrite to the WAL write to
+// wait for. The caller holds appendMu and mu and has checked the storage is
+// open.
+func (s *DiskStorage) batchDelete(keys []types.Key, walWrite *wal.Pending) error {
+	if err := s.checkWritable(0); err != nil {
+		return err
+	}
+	if s.walEnabled && s.wal != nil {
+		if err := s.wal.CheckBatch(nil, keys); err != nil {
+			return err
+		}
+	}
+
+	var deleted []types.Key
 	for _, key := range keys {
+		if _, exists := s.index[key]; exists {
+			deleted = append(deleted, key)
+		}
+	}
+
+	// Legacy JSON files have no way to represent a tombstone
+	if s.formatVersion != formatVersionJSON && len(deleted) > 0 {
+		if err := s.flushWriter(); err != nil {
+			return err
+		}
+
+		var batch []byte
+		now := time.Now()
+		for i, key := range deleted {
+			batch = s.appendBatchRecord(batch, encodeTombstone(key, now), i < len(deleted)-1)
+		}
+		if err := s.writeBatch(s.nextOffset, batch); err != nil {
+			return err
+		}
+		s.nextOffset += int64(len(batch))
+		s.flushedOffset.Store(s.nextOffset)
+	}
+
+	for _, key := range deleted {
 		delete(s.index, key)
+		s.blobs.untrack(key)
 	}
+	s.counters.deleted(len(deleted))
 
-	return s.saveIndex()
+	// Log to WAL if enabled
+	if s.walEnabled && s.wal != nil {
+		var err error
+		if *walWrite, err = s.wal.AppendBatchDelete(keys); err != nil {
+			return s.commitUnlogged(err)
+		}
+	}
+
+	return s.commit()
+}
+
+// ExpireBatch gives each of keys that exists ttl to live from now, or
+// deletes them if ttl <= 0, and returns the keys that weren't found;
+// expired keys count as missing. The entries are rewritten with their
+// values as one batch, like BatchSet's or BatchDelete's, so the index is
+// saved once and the WAL logs a single batch entry.
+func (s *DiskStorage) ExpireBatch(keys []types.Key, ttl time.Duration) (missing []types.Key, err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+
+	// With the keys locked the entries read stay current, so only the
+	// write has to wait for appendMu
+	defer s.keys.lock(keys...)()
+
+	var found []types.Key
+	var entries []types.Entry
+	now := time.Now()
+	for _, key := range keys {
+		entry, _, err := s.getEntry(key)
+		switch {
+		case errors.Is(err, types.ErrKeyNotFound):
+			missing = append(missing, key)
+		case err != nil:
+			return nil, err
+		case s.expired(entry):
+			missing = append(missing, key)
+		default:
+			found = append(found, key)
+			entries = append(entries, *withTTL(entry, ttl, now))
+		}
+	}
+	if len(found) == 0 {
+		return missing, nil
+	}
+
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+	if ttl <= 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return missing, s.batchDelete(found, &walWrite)
+	}
+	return missing, s.batchSet(entries, nil, &walWrite)
+}
+
+// CommitIfVersions stores sets and deletes deletes if every key in expected
+// is still at the version given. Every key involved is locked, so no other
+// write of them comes in between checking the versions and appending the
+// records and tombstones as one batch, like BatchSet's; commits of
+// disjoint keys only wait for each other's append. The WAL logs the
+// commit as a single entry.
+func (s *DiskStorage) CommitIfVersions(expected map[types.Key]uint64, sets []types.Entry, deletes []types.Key) (err error) {
+	var walWrite wal.Pending
+	defer s.waitWAL(&walWrite, &err)
+
+	keys := append(entryKeys(sets), deletes...)
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	defer s.keys.lock(keys...)()
+
+	for key, version := range expected {
+		current, err := s.currentVersion(key)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(key, version, current); err != nil {
+			return err
+		}
+	}
+	if len(sets) == 0 && len(deletes) == 0 {
+		return nil
+	}
+
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+	return s.batchSet(unversioned(sets), deletes, &walWrite)
+}
+
+// revise fills in entry's CreatedAt and Revision from the live entry it
+// replaces, which is the latest one written for its key earlier in the same
+// batch if there is one in latest, and is otherwise read back from the data
+// file without its value, as CommitIfVersions does for versions. An entry
+// that already has a revision is left alone without a read. If the entry
+// replaced can't be read, the key starts over as if it were new. The
+// caller must hold appendMu and at least a read lock on mu.
+func (s *DiskStorage) revise(entry *types.Entry, latest map[types.Key]*types.Entry) {
+	if entry.Revision != 0 {
+		revise(entry, nil)
+		return
+	}
+	if previous, ok := latest[entry.Key]; ok {
+		revise(entry, previous)
+		return
+	}
+
+	var previous *types.Entry
+	if offset, exists := s.index[entry.Key]; exists {
+		if cached, ok := s.cache.get(offset); ok {
+			previous = cached
+		} else if record, err := s.readRecord(offset); err == nil {
+			previous = record.entry
+		}
+	}
+	if previous != nil && s.expired(previous) {
+		previous = nil
+	}
+	revise(entry, previous)
+}
+
+// currentVersion returns the version of the entry stored for key, 0 if
+// there is none or it expired, without loading a spilled value
+func (s *DiskStorage) currentVersion(key types.Key) (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+	offset, exists := s.index[key]
+	if !exists {
+		return 0, nil
+	}
+	record, err := s.readRecord(offset)
+	if err != nil {
+		return 0, err
+	}
+	if s.expired(record.entry) {
+		return 0, nil
+	}
+	s.versions.observe(record.entry.Version)
+	return record.entry.Version, nil
 }
 
-// Clear removes all key-value pairs
+// appendBatchRecord adds a length-prefixed record to an encoded batch. All
+// but the last record of a batch are flagged so that a scan can tell a
+// complete batch from one cut short.
+func (s *DiskStorage) appendBatchRecord(batch, entryData []byte, more bool) []byte {
+	if more && s.formatVersion != formatVersionJSON {
+		setBatched(entryData, true)
+	}
+	batch = binary.LittleEndian.AppendUint32(batch, uint32(len(entryData)))
+	return append(batch, entryData...)
+}
+
+// writeBatch appends an encoded batch at start, which must be the end of
+// the flushed data file, with a single write and fsyncs it. If either fails
+// the data file is truncated back to start and the storage turns
+// read-only. The caller advances nextOffset and flushedOffset past the
+// batch.
+func (s *DiskStorage) writeBatch(start int64, batch []byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	_, err := s.dataFile.Write(batch)
+	if err == nil {
+		err = s.dataFile.Sync()
+	}
+	if err != nil {
+		// Drop the partial batch so sequential scans never see it
+		return s.writeFailed(fmt.Errorf("failed to write batch: %w", err))
+	}
+
+	return nil
+}
+
+// Clear removes all key-value pairs. The clear is logged to the WAL first,
+// then a fresh data file and empty index are written beside the originals,
+// fsynced and renamed into place; the in-memory state is only swapped once
+// both files are durable. The index is replaced before the data file, so a
+// crash in between leaves an empty index over the old records rather than
+// an index pointing past the end of a new file.
 func (s *DiskStorage) Clear() error {
+	defer s.keys.lockAll()()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return types.ErrDatabaseClosed
 	}
+	if s.readOnly {
+		return errOpenedReadOnly
+	}
 
-	// Clear index
-	s.index = make(map[types.Key]int64)
-	s.nextOffset = 0
+	// Log to WAL if enabled so replay reproduces the empty state
+	if s.walEnabled && s.wal != nil {
+		if _, err := s.wal.LogClear(); err != nil {
+			return fmt.Errorf("failed to log clear to WAL: %w", err)
+		}
+	}
+
+	dataPath := filepath.Join(s.dataDir, "data.db")
+	indexPath := filepath.Join(s.dataDir, "index.db")
 
-	// Truncate data file
-	if err := s.dataFile.Truncate(0); err != nil {
+	if err := s.removeHint(); err != nil {
+		return err
+	}
+	emptyIndex, err := encodeIndex(map[types.Key]int64{})
+	if err != nil {
 		return err
 	}
+	if err := writeFileSync(s.fs, indexPath+".tmp", emptyIndex); err != nil {
+		return fmt.Errorf("failed to write empty index: %w", err)
+	}
+	if err := writeFileSync(s.fs, dataPath+".tmp", encodeFileHeader(currentFormatVersion)); err != nil {
+		s.fs.Remove(indexPath + ".tmp")
+		return fmt.Errorf("failed to write empty data file: %w", err)
+	}
 
-	// Save empty index
-	return s.saveIndex()
+	if err := s.fs.Rename(indexPath+".tmp", indexPath); err != nil {
+		s.fs.Remove(dataPath + ".tmp")
+		return err
+	}
+	if err := s.fs.Rename(dataPath+".tmp", dataPath); err != nil {
+		return err
+	}
+	if err := vfs.SyncDir(s.fs, s.dataDir); err != nil {
+		return err
+	}
+
+	// Reopen the new data file and drop everything that referred to the
+	// old one, including buffered records
+	if err := s.reopenDataFile(); err != nil {
+		return err
+	}
+
+	s.index = make(map[types.Key]int64)
+	s.indexDirty = false
+	s.diskStats.indexSaves.Add(1)
+	s.formatVersion = currentFormatVersion
+	s.nextOffset = fileHeaderSize
+	s.flushedOffset.Store(fileHeaderSize)
+
+	// Nothing is left of whatever a failed write couldn't persist
+	s.degraded = nil
+
+	// Every blob is unreferenced now that the empty index is on disk
+	s.blobs.reset()
+	return s.blobs.collect()
+}
+
+// writeFileSync writes data to a new file at path and fsyncs it
+func writeFileSync(fsys vfs.FS, path string, data []byte) error {
+	file, err := fsys.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		fsys.Remove(path)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		fsys.Remove(path)
+		return err
+	}
+	return file.Close()
 }
 
 // Size returns the number of key-value pairs
@@ -488,8 +1766,8 @@ func (s *DiskStorage) Size() (int64, error) {
 	// Count only non-expired entries
 	count := int64(0)
 	for _, offset := range s.index {
-		entry, err := s.readEntry(offset)
-		if err == nil && !entry.IsExpired() {
+		record, err := s.readRecord(offset)
+		if err == nil && !s.expired(record.entry) {
 			count++
 		}
 	}
@@ -508,8 +1786,8 @@ func (s *DiskStorage) Keys() ([]types.Key, error) {
 
 	var keys []types.Key
 	for key, offset := range s.index {
-		entry, err := s.readEntry(offset)
-		if err == nil && !entry.IsExpired() {
+		record, err := s.readRecord(offset)
+		if err == nil && !s.expired(record.entry) {
 			keys = append(keys, key)
 		}
 	}
@@ -519,6 +1797,8 @@ func (s *DiskStorage) Keys() ([]types.Key, error) {
 
 // Close closes the storage
 func (s *DiskStorage) Close() error {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -527,23 +1807,72 @@ func (s *DiskStorage) Close() error {
 	}
 
 	s.closed = true
+	if s.readOnly {
+		return s.closeReadOnly()
+	}
+
+	// Persist buffered records and any deferred index changes, then leave
+	// a hint covering everything so the next open is fast. With a WAL the
+	// data is synced and checkpointed, so the next open has nothing to
+	// replay. The files are closed even if that fails.
+	var err error
+	if s.wal != nil && s.degraded == nil {
+		err = s.checkpoint()
+	} else {
+		err = s.flush()
+	}
+	if err == nil && s.hintInterval > 0 && s.formatVersion != formatVersionJSON && s.nextOffset != s.hintOffset {
+		err = s.writeHint()
+	}
 
 	// Close WAL if enabled
 	if s.wal != nil {
-		if err := s.wal.Close(); err != nil {
-			return err
+		if walErr := s.wal.Close(); err == nil {
+			err = walErr
 		}
 	}
 
-	// Close files
-	if err := s.dataFile.Close(); err != nil {
-		return err
+	// Close the data file; views and snapshots still reading it keep it open
+	s.readGen.release()
+	if closeErr := s.dataFile.Close(); err == nil {
+		err = closeErr
 	}
+	releaseLock(s.lock)
+	return err
+}
+
+// releaseLock releases the lock on a data directory, if there is one
+func releaseLock(lock io.Closer) {
+	if lock != nil {
+		lock.Close()
+	}
+}
+
+// reopenDataFile opens data.db again after it was replaced as a new
+// generation, closing the append descriptor of the old file, releasing its
+// generation and pointing the write buffer at the new one
+func (s *DiskStorage) reopenDataFile() error {
+	dataPath := filepath.Join(s.dataDir, "data.db")
 
-	if err := s.indexFile.Close(); err != nil {
+	dataFile, err := s.fs.OpenFile(dataPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	readFile, err := vfs.Open(s.fs, dataPath)
+	if err != nil {
+		dataFile.Close()
 		return err
 	}
 
+	s.dataFile.Close()
+	s.readGen.release()
+	s.dataFile = dataFile
+	s.readGen = newDataGeneration(s.readGen.id+1, readFile)
+	s.cache.clear()
+
+	if s.writer != nil {
+		s.writer.Reset(s.dataFile)
+	}
 	return nil
 }
 
@@ -576,6 +1905,192 @@ func (s *DiskStorage) RotateWAL() error {
 	return s.wal.Rotate()
 }
 
+// GetWALStats returns the WAL's size, sync policy and fsync counts if enabled
+func (s *DiskStorage) GetWALStats() (wal.Stats, error) {
+	if s.wal == nil {
+		return wal.Stats{}, fmt.Errorf("WAL is not enabled")
+	}
+	return s.wal.Stats(), nil
+}
+
+// TailWAL streams the WAL entries from fromLSN on as they are committed, if
+// the WAL is enabled
+func (s *DiskStorage) TailWAL(ctx context.Context, fromLSN uint64) (*wal.Tailer, error) {
+	if s.wal == nil {
+		return nil, fmt.Errorf("WAL is not enabled")
+	}
+	return s.wal.Tail(ctx, fromLSN)
+}
+
+// ReadWALFrom reads the WAL entries with an LSN of at least lsn from every
+// segment still on disk, if the WAL is enabled
+func (s *DiskStorage) ReadWALFrom(lsn uint64) ([]*wal.WALEntry, error) {
+	if s.wal == nil {
+		return nil, fmt.Errorf("WAL is not enabled")
+	}
+	return s.wal.ReadEntriesFrom(lsn)
+}
+
+// LastWALLSN returns the LSN of the last WAL entry logged, 0 if there is
+// none or the WAL is disabled
+func (s *DiskStorage) LastWALLSN() uint64 {
+	if s.wal == nil {
+		return 0
+	}
+	return s.wal.LastLSN()
+}
+
+// DumpWAL prints every record of the WAL files on disk in format, if the
+// WAL is enabled
+func (s *DiskStorage) DumpWAL(out io.Writer, format wal.DumpFormat) error {
+	if s.wal == nil {
+		return fmt.Errorf("WAL is not enabled")
+	}
+	return s.wal.Dump(out, format)
+}
+
+// commitUnlogged commits a write whose WAL entry couldn't be appended and
+// fails it with walErr, as waitWAL fails one whose entry couldn't be
+// written. The record is in the data file either way, so the index still
+// has to be committed to match it.
+func (s *DiskStorage) commitUnlogged(walErr error) error {
+	if err := s.commit(); err != nil {
+		return err
+	}
+	return fmt.Errorf("failed to log to WAL: %w", walErr)
+}
+
+// waitWAL waits for a write's WAL entry to be written and synced as the
+// sync policy requires, and fails the write if it couldn't be, since the
+// WAL is what makes it durable. Writers defer it before taking their
+// locks, so it runs once they are released and concurrent writers can
+// share a WAL write and an fsync.
+func (s *DiskStorage) waitWAL(pending *wal.Pending, err *error) {
+	if walErr := pending.Wait(); walErr != nil {
+		if *err == nil {
+			*err = fmt.Errorf("failed to log to WAL: %w", walErr)
+		}
+		return
+	}
+
+	// The entry may have been written after commit checked the WAL's size
+	if pending.LSN() != 0 && s.wal.ShouldRotate() {
+		s.appendMu.Lock()
+		defer s.appendMu.Unlock()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if !s.closed {
+			s.maybeCheckpoint()
+		}
+	}
+}
+
+// checkpointStep runs after each step of Checkpoint, "synced" and
+// "recorded". It is a variable so tests can crash between the steps.
+var checkpointStep = func(step string) {}
+
+// Checkpoint flushes and fsyncs the data file and index, so the WAL
+// entries logged so far are no longer needed for recovery. With the WAL
+// enabled it then records a checkpoint, which recovery replays only the
+// entries after, and deletes the checkpointed segments beyond
+// Config.WALRetainSegments. A crash at any point loses nothing: before the
+// checkpoint is recorded the entries are replayed again, which applies
+// them in the same order on top of data that already holds them.
+func (s *DiskStorage) Checkpoint() error {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+	if err := s.checkWritable(0); err != nil {
+		return err
+	}
+
+	return s.checkpoint()
+}
+
+// checkpoint implements Checkpoint. The caller holds appendMu and mu.
+func (s *DiskStorage) checkpoint() error {
+	// Writes append to the WAL under appendMu, so nothing is logged
+	// between the sync and the checkpoint
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if s.wal == nil {
+		return nil
+	}
+	checkpointStep("synced")
+
+	if err := s.wal.Checkpoint(); err != nil {
+		return err
+	}
+	s.lastCheckpoint = time.Now()
+	checkpointStep("recorded")
+
+	_, err := s.wal.CleanupSegments()
+	return err
+}
+
+// maybeCheckpoint checkpoints once the WAL reaches Config.MaxWALSize or
+// Config.WALCheckpointInterval has passed since the last checkpoint.
+// Writers call it through commit, holding appendMu and mu, so the rotation
+// can't separate a write from its WAL entry. A failure is only reported,
+// since the write itself succeeded.
+func (s *DiskStorage) maybeCheckpoint() {
+	if s.wal == nil || s.degraded != nil {
+		return
+	}
+
+	due := s.wal.ShouldRotate() || s.checkpointInterval > 0 &&
+		time.Since(s.lastCheckpoint) >= s.checkpointInterval && !s.wal.IsEmpty()
+	if !due {
+		return
+	}
+
+	if err := s.checkpoint(); err != nil {
+		s.log.Error("automatic WAL checkpoint failed", "dir", s.dataDir, "error", err)
+	}
+}
+
+// ReplayWAL replays the WAL entries after the last checkpoint, as opening
+// the storage does, and returns how many there were. It repairs an open
+// storage whose index has fallen behind the WAL; entries it already holds
+// are applied again, which changes nothing. A checkpoint follows, so they
+// aren't replayed once more.
+func (s *DiskStorage) ReplayWAL() (int, error) {
+	defer s.keys.lockAll()()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+	if s.wal == nil {
+		return 0, fmt.Errorf("WAL is not enabled")
+	}
+	if err := s.checkWritable(0); err != nil {
+		return 0, err
+	}
+
+	replayed, err := s.replayWAL()
+	if err != nil {
+		return 0, err
+	}
+	if replayed == 0 {
+		return 0, nil
+	}
+	if s.blobs.hasBlobs() {
+		s.loadBlobRefs()
+	}
+	return replayed, s.checkpoint()
+}
+
 // ClearWAL clears the WAL if enabled
 func (s *DiskStorage) ClearWAL() error {
 	if s.wal == nil {
@@ -584,27 +2099,63 @@ func (s *DiskStorage) ClearWAL() error {
 	return s.wal.Clear()
 }
 
+// SetTTLEnabled turns expiry on or off. While it is off every entry is
+// kept and read as if it had no TTL; expiry times stay stored, and entries
+// past theirs expire once it is turned back on.
+func (s *DiskStorage) SetTTLEnabled(enabled bool) {
+	s.ttlDisabled.Store(!enabled)
+}
+
+// expired reports whether entry has expired, which it never has while
+// expiry is off
+func (s *DiskStorage) expired(entry *types.Entry) bool {
+	return !s.ttlDisabled.Load() && entry.IsExpired()
+}
+
 // CleanupExpired removes all expired entries
 func (s *DiskStorage) CleanupExpired() int {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed || s.checkWritable(0) != nil {
+		return 0
+	}
+
+	var expired []*types.Entry
 	count := 0
 	for key, offset := range s.index {
-		entry, err := s.readEntry(offset)
-		if err == nil && entry.IsExpired() {
+		record, err := s.readRecord(offset)
+		if err == nil && s.expired(record.entry) {
+			if entry := s.expiredEntry(key, offset); entry != nil {
+				expired = append(expired, entry)
+			}
 			delete(s.index, key)
+			s.blobs.untrack(key)
 			count++
 		}
 	}
 
 	if count > 0 {
-		s.saveIndex()
+		s.commit()
+	}
+	for _, entry := range expired {
+		s.onExpire.notify(entry)
 	}
 
 	return count
 }
 
+// SetExpiryCallback registers fn to be called with the key and value of
+// every entry removed because it expired, whether by a read,
+// CleanupExpired or Compact. Each removal calls it once. It runs with the
+// storage locks held, so it must return quickly and not use the storage;
+// pass nil to remove it.
+func (s *DiskStorage) SetExpiryCallback(fn func(key types.Key, value types.Value)) {
+	s.onExpire.set(fn)
+}
+
 // GetDiskUsage returns approximate disk usage in bytes
 func (s *DiskStorage) GetDiskUsage() (int64, error) {
 	s.mu.RLock()
@@ -615,16 +2166,184 @@ func (s *DiskStorage) GetDiskUsage() (int64, error) {
 		return 0, err
 	}
 
-	indexStat, err := s.indexFile.Stat()
+	indexStat, err := s.fs.Stat(filepath.Join(s.dataDir, "index.db"))
 	if err != nil {
 		return 0, err
 	}
 
-	return dataStat.Size() + indexStat.Size(), nil
+	// Count records that are still sitting in the write buffer
+	unflushed := s.nextOffset - s.flushedOffset.Load()
+
+	return dataStat.Size() + unflushed + indexStat.Size() + s.hintSize(), nil
+}
+
+// DiskUsage breaks down the space used by a disk storage data directory
+type DiskUsage struct {
+	DataFileSize     int64 `json:"data_file_size"`
+	BufferedBytes    int64 `json:"buffered_bytes"` // Records still in the write buffer
+	IndexSize        int64 `json:"index_size"`
+	WALSize          int64 `json:"wal_size"`
+	ArchivedWALSize  int64 `json:"archived_wal_size"`
+	ArchivedWALFiles int   `json:"archived_wal_files"`
+	BlobSize         int64 `json:"blob_size"`
+	BlobFiles        int   `json:"blob_files"`
+	LiveBytes        int64 `json:"live_bytes"`         // Data file bytes held by records the index references
+	DeadBytes        int64 `json:"dead_bytes"`         // Data file bytes Compact would reclaim
+	RawValueBytes    int64 `json:"raw_value_bytes"`    // Size of the live values before compression
+	StoredValueBytes int64 `json:"stored_value_bytes"` // Size of the live values as stored, after compression
+}
+
+// Total returns the combined size of every component
+func (u DiskUsage) Total() int64 {
+	return u.DataFileSize + u.BufferedBytes + u.IndexSize + u.WALSize + u.ArchivedWALSize + u.BlobSize
+}
+
+// GetDiskUsageDetailed reports the size of each file the storage keeps in
+// its data directory. Live and dead bytes and the raw and stored value
+// sizes are computed from every live record, so it costs as much as a full
+// scan.
+func (s *DiskStorage) GetDiskUsageDetailed() (DiskUsage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var usage DiskUsage
+	if s.closed {
+		return usage, types.ErrDatabaseClosed
+	}
+
+	dataStat, err := s.dataFile.Stat()
+	if err != nil {
+		return usage, err
+	}
+	indexStat, err := s.fs.Stat(filepath.Join(s.dataDir, "index.db"))
+	if err != nil {
+		return usage, err
+	}
+	usage.DataFileSize = dataStat.Size()
+	usage.BufferedBytes = s.nextOffset - s.flushedOffset.Load()
+	usage.IndexSize = indexStat.Size() + s.hintSize()
+	usage.WALSize = s.GetWALSize()
+
+	segments, err := wal.ArchivedSegments(s.fs, s.walPath)
+	if err != nil {
+		return usage, err
+	}
+	for _, segment := range segments {
+		usage.ArchivedWALSize += segment.Size
+		usage.ArchivedWALFiles++
+	}
+
+	if entries, err := s.fs.ReadDir(s.blobs.dir); err == nil {
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+				usage.BlobSize += info.Size()
+				usage.BlobFiles++
+			}
+		}
+	}
+
+	for _, offset := range s.index {
+		data, err := s.readRecordData(offset)
+		if err != nil {
+			return usage, err
+		}
+		record, err := decodeRecord(data, s.formatVersion, s.maxValueSize)
+		if err != nil {
+			return usage, err
+		}
+		usage.LiveBytes += 4 + int64(len(data))
+		usage.RawValueBytes += rawValueSize(record)
+		usage.StoredValueBytes += int64(record.storedValue)
+	}
+
+	headerSize := int64(0)
+	if s.formatVersion != formatVersionJSON {
+		headerSize = fileHeaderSize
+	}
+	usage.DeadBytes = s.nextOffset - headerSize - usage.LiveBytes
+
+	return usage, nil
+}
+
+// Stats returns the storage's read, write and delete counts along with its
+// reads of the data file, index saves, compactions and read cache hits and
+// misses
+func (s *DiskStorage) Stats() types.StorageStats {
+	stats := types.StorageStats{
+		DiskReads:   s.diskStats.reads.Load(),
+		BytesRead:   s.diskStats.bytesRead.Load(),
+		IndexSaves:  s.diskStats.indexSaves.Load(),
+		Compactions: s.diskStats.compactions.Load(),
+	}
+	s.counters.addTo(&stats)
+	s.cache.addTo(&stats)
+	return stats
+}
+
+// rawValueSize returns the size of a record's value before compression
+func rawValueSize(record *decodedRecord) int64 {
+	if record.blob != nil {
+		return int64(record.blob.size)
+	}
+	return int64(len(record.entry.Value))
+}
+
+// GetCompressionStats reports raw versus stored value sizes across all live
+// records. It reads every live record, so it costs as much as a full scan.
+func (s *DiskStorage) GetCompressionStats() (CompressionStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := CompressionStats{Algorithm: s.compression.algorithm}
+	if stats.Algorithm == "" {
+		stats.Algorithm = types.CompressionNone
+	}
+
+	if s.closed {
+		return stats, types.ErrDatabaseClosed
+	}
+
+	for _, offset := range s.index {
+		record, err := s.readRecord(offset)
+		if err != nil {
+			return stats, err
+		}
+		if s.expired(record.entry) {
+			continue
+		}
+
+		stats.LiveValues++
+		stats.RawValueBytes += rawValueSize(record)
+		stats.StoredValueBytes += int64(record.storedValue)
+		if record.compressed {
+			stats.CompressedValues++
+		}
+	}
+
+	return stats, nil
+}
+
+// Sync flushes buffered writes and the index to disk and fsyncs both files
+func (s *DiskStorage) Sync() error {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+	if err := s.checkWritable(0); err != nil {
+		return err
+	}
+
+	return s.sync()
 }
 
 // Compact performs garbage collection by removing deleted entries
 func (s *DiskStorage) Compact() error {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -632,86 +2351,162 @@ func (s *DiskStorage) Compact() error {
 		return types.ErrDatabaseClosed
 	}
 
+	// The rewritten file is at most as large as the current one
+	if err := s.checkWritable(0); err != nil {
+		return err
+	}
+	if err := s.checkFreeSpace(s.nextOffset); err != nil {
+		return err
+	}
+
+	// Compaction reads every live record from the data file
+	if err := s.flushWriter(); err != nil {
+		return err
+	}
+
 	// Create temporary files for compaction
 	tempDataPath := filepath.Join(s.dataDir, "data.db.tmp")
 	tempIndexPath := filepath.Join(s.dataDir, "index.db.tmp")
 
-	tempDataFile, err := os.Create(tempDataPath)
+	tempDataFile, err := vfs.Create(s.fs, tempDataPath)
 	if err != nil {
 		return err
 	}
-	defer tempDataFile.Close()
+	// Nothing has replaced the original files until the renames, so a
+	// failure before them only has to remove the temporary ones
+	abort := func(err error) error {
+		tempDataFile.Close()
+		s.fs.Remove(tempDataPath)
+		s.fs.Remove(tempIndexPath)
+		return fmt.Errorf("failed to write compacted data file: %w", err)
+	}
 
-	tempIndexFile, err := os.Create(tempIndexPath)
-	if err != nil {
-		return err
+	// Compacted files are always written in the current format
+	if _, err := tempDataFile.Write(encodeFileHeader(currentFormatVersion)); err != nil {
+		return abort(err)
 	}
-	defer tempIndexFile.Close()
 
-	// Write valid entries to temporary files
+	// Write valid entries to temporary files; expired ones are dropped and
+	// passed to the expiry callback once the compaction is done
 	newIndex := make(map[types.Key]int64)
-	newOffset := int64(0)
+	newOffset := int64(fileHeaderSize)
+	var expired []*types.Entry
 
 	for key, offset := range s.index {
-		entry, err := s.readEntry(offset)
-		if err == nil && !entry.IsExpired() {
-			// Write entry to temp file
-			entryData, err := json.Marshal(entry)
+		entryData, err := s.readRecordData(offset)
+		if err != nil {
+			s.log.Error("dropping unreadable record while compacting", "key", key, "offset", offset, "error", err)
+			s.blobs.untrack(key)
+			continue
+		}
+		record, err := decodeRecord(entryData, s.formatVersion, s.maxValueSize)
+		if err != nil {
+			s.log.Error("dropping undecodable record while compacting", "key", key, "offset", offset, "error", err)
+			s.blobs.untrack(key)
+			continue
+		}
+		if s.expired(record.entry) {
+			if entry := s.expiredEntry(key, offset); entry != nil {
+				expired = append(expired, entry)
+			}
+			s.blobs.untrack(key)
+			continue
+		}
+
+		// Blob references are copied as they are, minus any batch flag;
+		// inline values are re-encoded in the current format
+		if record.blob != nil && record.batched {
+			setBatched(entryData, false)
+		}
+		if record.blob == nil {
+			var ref *blobRef
+			entryData, ref, err = s.encodeRecord(record.entry, currentFormatVersion)
 			if err != nil {
+				s.log.Error("dropping record that can't be re-encoded while compacting", "key", key, "error", err)
+				s.blobs.untrack(key)
 				continue
 			}
+			s.blobs.track(key, ref)
+		}
 
-			length := uint32(len(entryData))
-			binary.Write(tempDataFile, binary.LittleEndian, length)
-			tempDataFile.Write(entryData)
-
-			newIndex[key] = newOffset
-			newOffset += int64(4 + len(entryData))
+		// Length prefix and entry data in a single write, as appendRecord
+		// does
+		data := make([]byte, 4+len(entryData))
+		binary.LittleEndian.PutUint32(data, uint32(len(entryData)))
+		copy(data[4:], entryData)
+		if _, err := tempDataFile.Write(data); err != nil {
+			return abort(err)
 		}
+
+		newIndex[key] = newOffset
+		newOffset += int64(len(data))
+	}
+
+	// The compacted data must be durable before it replaces the original
+	if err := tempDataFile.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := tempDataFile.Close(); err != nil {
+		s.fs.Remove(tempDataPath)
+		return fmt.Errorf("failed to write compacted data file: %w", err)
 	}
 
 	// Save new index
-	indexData, err := json.Marshal(newIndex)
+	indexData, err := encodeIndex(newIndex)
 	if err != nil {
+		s.fs.Remove(tempDataPath)
 		return err
 	}
-	tempIndexFile.Write(indexData)
-
-	// Close temp files
-	tempDataFile.Close()
-	tempIndexFile.Close()
+	if err := writeFileSync(s.fs, tempIndexPath, indexData); err != nil {
+		s.fs.Remove(tempDataPath)
+		return fmt.Errorf("failed to write compacted index: %w", err)
+	}
 
-	// Close original files
-	s.dataFile.Close()
-	s.indexFile.Close()
+	// The hint describes the old data file
+	if err := s.removeHint(); err != nil {
+		s.fs.Remove(tempDataPath)
+		s.fs.Remove(tempIndexPath)
+		return err
+	}
 
 	// Replace original files with compacted ones
-	if err := os.Rename(tempDataPath, filepath.Join(s.dataDir, "data.db")); err != nil {
+	if err := s.fs.Rename(tempDataPath, filepath.Join(s.dataDir, "data.db")); err != nil {
 		return err
 	}
 
-	if err := os.Rename(tempIndexPath, filepath.Join(s.dataDir, "index.db")); err != nil {
+	if err := s.fs.Rename(tempIndexPath, filepath.Join(s.dataDir, "index.db")); err != nil {
 		return err
 	}
-
-	// Reopen files
-	dataPath := filepath.Join(s.dataDir, "data.db")
-	indexPath := filepath.Join(s.dataDir, "index.db")
-
-	s.dataFile, err = os.OpenFile(dataPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
+	if err := vfs.SyncDir(s.fs, s.dataDir); err != nil {
 		return err
 	}
 
-	s.indexFile, err = os.OpenFile(indexPath, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		s.dataFile.Close()
+	if err := s.reopenDataFile(); err != nil {
 		return err
 	}
 
 	// Update state
+	s.log.Info("compacted data file", "dir", s.dataDir, "keys", len(newIndex), "size_before", s.nextOffset, "size_after", newOffset)
 	s.index = newIndex
+	s.formatVersion = currentFormatVersion
 	s.nextOffset = newOffset
+	s.flushedOffset.Store(newOffset)
+	s.indexDirty = false
+	s.diskStats.indexSaves.Add(1)
+	s.diskStats.compactions.Add(1)
+	for _, entry := range expired {
+		s.onExpire.notify(entry)
+	}
 
-	return nil
+	// Mark the compaction in the WAL for tailers. It is done either way,
+	// so failing to log it doesn't fail it.
+	if s.walEnabled && s.wal != nil {
+		if _, err := s.wal.LogCompact(); err != nil {
+			s.log.Error("failed to log compaction to WAL", "error", err)
+		}
+	}
+
+	// Remove blobs that are no longer referenced, including any orphaned
+	// by a crash before their record's index was saved
+	return s.blobs.sweep()
 }
@@ -1,10 +1,18 @@
 package storage_test
 
 import (
+	"bytes"
+	"context"
 	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +20,37 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// diskTestConfig returns the default config for disk storage in dataDir,
+// changed by each of opts in turn
+func diskTestConfig(dataDir string, opts ...func(*types.Config)) types.Config {
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = dataDir
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return config
+}
+
+// Options for diskTestConfig
+func withWriteBuffer(config *types.Config)    { config.WriteBufferSize = 4096 }
+func withoutWriteBuffer(config *types.Config) { config.WriteBufferSize = 0 }
+func withWAL(config *types.Config)            { config.WALEnabled = true }
+func withSyncOnWrite(config *types.Config)    { config.SyncOnWrite = true }
+func withHints(config *types.Config)          { config.IndexHintInterval = 1024 }
+func withoutHints(config *types.Config)       { config.IndexHintInterval = 0 }
+func withBlobs(config *types.Config)          { config.BlobThreshold = 1024 }
+func withReadOnly(config *types.Config)       { config.ReadOnly = true }
+
+func withGzip(config *types.Config) {
+	config.Compression = types.CompressionGzip
+	config.CompressionMinSize = 64
+}
+
+func withCache(size int64) func(*types.Config) {
+	return func(config *types.Config) { config.CacheSize = size }
+}
+
 func TestNewDiskStorage(t *testing.T) {
 	tempDir := t.TempDir()
 
@@ -158,6 +197,91 @@ func TestDiskStoragePersistence(t *testing.T) {
 	assert.True(t, exists)
 }
 
+func TestDiskStorageDamagedIndex(t *testing.T) {
+	damage := map[string]func(data []byte) []byte{
+		"Truncated": func(data []byte) []byte { return data[:len(data)/2] },
+		"Empty":     func(data []byte) []byte { return nil },
+		"ChecksumMismatch": func(data []byte) []byte {
+			// Still valid JSON, but an offset no longer matches
+			i := bytes.LastIndexAny(data[:bytes.LastIndexByte(data, '}')], "123456789")
+			data[i]--
+			return data
+		},
+	}
+
+	for name, fn := range damage {
+		t.Run(name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			config.EnablePersistence = true
+			config.DataDirectory = t.TempDir()
+			config.IndexHintInterval = 0
+
+			diskStorage, err := storage.NewDiskStorageWithConfig(config)
+			require.NoError(t, err)
+			for i := 0; i < 50; i++ {
+				require.NoError(t, diskStorage.Set(types.Key(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+			}
+			require.NoError(t, diskStorage.Delete("key0"))
+			require.NoError(t, diskStorage.Close())
+
+			indexPath := filepath.Join(config.DataDirectory, "index.db")
+			data, err := os.ReadFile(indexPath)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(indexPath, fn(data), 0644))
+
+			// The index is rebuilt from the data file and saved again
+			diskStorage, err = storage.NewDiskStorageWithConfig(config)
+			require.NoError(t, err)
+			defer diskStorage.Close()
+
+			size, err := diskStorage.Size()
+			require.NoError(t, err)
+			assert.Equal(t, int64(49), size)
+			for i := 1; i < 50; i++ {
+				value, err := diskStorage.Get(types.Key(fmt.Sprintf("key%d", i)))
+				require.NoError(t, err)
+				assert.Equal(t, types.Value(fmt.Sprintf("value%d", i)), value)
+			}
+
+			data, err = os.ReadFile(indexPath)
+			require.NoError(t, err)
+			index, err := storage.DecodeIndex(data)
+			require.NoError(t, err)
+			assert.Len(t, index, 49)
+		})
+	}
+}
+
+func TestDiskStorageLockedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no advisory locks")
+	}
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+
+	// A second writable open in the same process is refused
+	_, err = storage.NewDiskStorage(tempDir)
+	assert.ErrorIs(t, err, vfs.ErrLocked)
+
+	require.NoError(t, diskStorage.Close())
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Close())
+}
+
+func TestDecodeIndex(t *testing.T) {
+	// Indexes written before the checksum was added still load
+	index, err := storage.DecodeIndex([]byte(`{"key":8}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[types.Key]int64{"key": 8}, index)
+
+	_, err = storage.DecodeIndex([]byte(`{"key":8}` + "\n00000000"))
+	assert.ErrorIs(t, err, storage.ErrCorruptIndex)
+	_, err = storage.DecodeIndex([]byte(`{"key":`))
+	assert.ErrorIs(t, err, storage.ErrCorruptIndex)
+}
+
 func TestDiskStorageTTL(t *testing.T) {
 	tempDir := t.TempDir()
 	diskStorage, err := storage.NewDiskStorage(tempDir)
@@ -218,6 +342,156 @@ func TestDiskStorageClear(t *testing.T) {
 	assert.Len(t, keys, 0)
 }
 
+func TestDiskStorageClearRecoveredFromWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(tempDir, withWriteBuffer, withWAL)
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("old1", []byte("value1")))
+	require.NoError(t, diskStorage.Set("old2", []byte("value2")))
+	require.NoError(t, diskStorage.Sync())
+	require.NoError(t, diskStorage.Clear())
+	require.NoError(t, diskStorage.Set("new", []byte("value3")))
+
+	// Only the empty data file and index are left behind
+	for _, name := range []string{"data.db.tmp", "index.db.tmp"} {
+		_, err := os.Stat(filepath.Join(tempDir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Simulate a crash: replay must reproduce the clear instead of
+	// resurrecting the keys written before it
+	require.NoError(t, fsys.Crash())
+	recovered, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	keys, err := recovered.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"new"}, keys)
+
+	value, err := recovered.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value3"), value)
+}
+
+func TestDiskStorageExpireBatch(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(tempDir, withWriteBuffer, withWAL)
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.BatchSet([]types.Entry{
+		{Key: "a", Value: types.Value("1")},
+		{Key: "b", Value: types.Value("2")},
+		{Key: "c", Value: types.Value("3")},
+	}))
+	lsn := diskStorage.LastWALLSN()
+
+	missing, err := diskStorage.ExpireBatch([]types.Key{"a", "b", "missing"}, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"missing"}, missing)
+	missing, err = diskStorage.ExpireBatch([]types.Key{"c"}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// Each call is logged as one batch entry
+	entries, err := diskStorage.ReadWALFrom(lsn + 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, wal.OpBatchSet, entries[0].Type)
+	assert.Len(t, entries[0].Entries, 2)
+	assert.Equal(t, wal.OpBatchDelete, entries[1].Type)
+	assert.Equal(t, []types.Key{"c"}, entries[1].Keys)
+
+	// Simulate a crash: replay restores the new expiry times and the delete
+	require.NoError(t, fsys.Crash())
+	recovered, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	for key, value := range map[types.Key]string{"a": "1", "b": "2"} {
+		entry, err := recovered.GetEntry(key)
+		require.NoError(t, err)
+		assert.Equal(t, types.Value(value), entry.Value)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), entry.ExpiresAt, time.Minute)
+	}
+	_, err = recovered.Get("c")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+}
+
+func TestDiskStorageVersions(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(tempDir, withWriteBuffer, withWAL)
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("a", types.Value("1")))
+	require.NoError(t, diskStorage.SetWithTTL("b", types.Value("2"), time.Hour))
+	require.NoError(t, diskStorage.BatchSet([]types.Entry{{Key: "c", Value: types.Value("3")}}))
+
+	// Each write gets a later version than the one before
+	versions := make(map[types.Key]uint64)
+	var last uint64
+	for _, key := range []types.Key{"a", "b", "c"} {
+		entry, err := diskStorage.GetEntry(key)
+		require.NoError(t, err)
+		assert.Greater(t, entry.Version, last, "%s", key)
+		versions[key] = entry.Version
+		last = entry.Version
+	}
+
+	// A stale version writes nothing
+	err = diskStorage.CommitIfVersions(map[types.Key]uint64{"a": versions["a"] - 1},
+		[]types.Entry{{Key: "a", Value: types.Value("stale")}}, nil)
+	assert.ErrorIs(t, err, types.ErrConflict)
+
+	lsn := diskStorage.LastWALLSN()
+	require.NoError(t, diskStorage.CommitIfVersions(map[types.Key]uint64{"a": versions["a"], "missing": 0},
+		[]types.Entry{{Key: "a", Value: types.Value("4"), Version: 1}}, []types.Key{"c"}))
+	entry, err := diskStorage.GetEntry("a")
+	require.NoError(t, err)
+	assert.Greater(t, entry.Version, versions["c"])
+	versions["a"] = entry.Version
+	delete(versions, "c")
+
+	// The commit is logged as one entry
+	entries, err := diskStorage.ReadWALFrom(lsn + 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, wal.OpCommit, entries[0].Type)
+	assert.Equal(t, []types.Key{"c"}, entries[0].Keys)
+
+	// Simulate a crash: replay keeps the versions, and so does the data
+	// file once the recovered storage is closed and reopened
+	require.NoError(t, fsys.Crash())
+	for _, reopen := range []string{"replayed", "reopened"} {
+		recovered, err := storage.NewDiskStorageWithConfig(config)
+		require.NoError(t, err)
+
+		for key, version := range versions {
+			entry, err := recovered.GetEntry(key)
+			require.NoError(t, err, reopen)
+			assert.Equal(t, version, entry.Version, "%s %s", reopen, key)
+		}
+		_, err = recovered.Get("c")
+		assert.ErrorIs(t, err, types.ErrKeyNotFound, reopen)
+
+		// New writes still get later versions
+		require.NoError(t, recovered.Set("d", types.Value("5")))
+		entry, err := recovered.GetEntry("d")
+		require.NoError(t, err)
+		assert.Greater(t, entry.Version, versions["a"], reopen)
+		require.NoError(t, recovered.Delete("d"))
+		require.NoError(t, recovered.Close())
+	}
+}
+
 func TestDiskStorageCleanupExpired(t *testing.T) {
 	tempDir := t.TempDir()
 	diskStorage, err := storage.NewDiskStorage(tempDir)
@@ -377,3 +651,502 @@ func TestDiskStorageConcurrentOperations(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, int64(10), size)
 }
+
+func TestDiskStorageWriteBuffering(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withWriteBuffer, withWAL))
+	require.NoError(t, err)
+
+	before, err := os.Stat(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+
+	err = diskStorage.Set("buffered-key", []byte("buffered-value"))
+	require.NoError(t, err)
+
+	// The record is still buffered, so nothing has reached the data file yet
+	stat, err := os.Stat(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), stat.Size())
+
+	// Reads must see buffered writes
+	value, err := diskStorage.Get("buffered-key")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("buffered-value"), value)
+
+	// Fill past the buffer size to force a flush of whole records
+	for i := 0; i < 200; i++ {
+		key := types.Key(fmt.Sprintf("key-%d", i))
+		require.NoError(t, diskStorage.Set(key, []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	for i := 0; i < 200; i++ {
+		key := types.Key(fmt.Sprintf("key-%d", i))
+		value, err := diskStorage.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, types.Value(fmt.Sprintf("value-%d", i)), value)
+	}
+
+	require.NoError(t, diskStorage.Close())
+
+	// Everything is persisted on close
+	diskStorage, err = storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withWriteBuffer, withWAL))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	size, err := diskStorage.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(201), size)
+}
+
+func TestDiskStorageWriteBufferNeedsWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withWriteBuffer))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	before, err := os.Stat(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+
+	// Without a WAL to recover them from, writes aren't buffered
+	require.NoError(t, diskStorage.Set("key", []byte("value")))
+	after, err := os.Stat(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Greater(t, after.Size(), before.Size())
+}
+
+func TestDiskStorageSync(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withWriteBuffer, withWAL))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key1", []byte("value1")))
+	require.NoError(t, diskStorage.Sync())
+
+	// A read-only instance sees the synced state without the first being closed
+	reader, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withReadOnly))
+	require.NoError(t, err)
+	defer reader.Close()
+
+	value, err := reader.Get("key1")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value1"), value)
+}
+
+func TestDiskStorageBufferedWritesRecoveredFromWAL(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(tempDir, withWriteBuffer, withWAL)
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("key1", []byte("value1")))
+	require.NoError(t, diskStorage.Set("key2", []byte("value2")))
+	require.NoError(t, diskStorage.Delete("key1"))
+
+	// Simulate a crash: the buffer is never flushed and the index never
+	// saved, but every write was fsynced to the WAL
+	require.NoError(t, fsys.Crash())
+	recovered, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	_, err = recovered.Get("key1")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+
+	value, err := recovered.Get("key2")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value2"), value)
+}
+
+func TestDiskStorageWALAppendErrors(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withWAL)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	// The storage doesn't limit key sizes itself, but the WAL refuses keys
+	// over MaxKeySize, and a write it can't log isn't durable
+	key := types.Key(strings.Repeat("k", config.MaxKeySize+1))
+	assert.ErrorIs(t, diskStorage.Set(key, []byte("value")), types.ErrInvalidKey)
+	assert.ErrorIs(t, diskStorage.SetWithTTL(key, []byte("value"), time.Hour), types.ErrInvalidKey)
+	assert.ErrorIs(t, diskStorage.Delete(key), types.ErrInvalidKey)
+}
+
+func TestDiskStorageSyncOnWrite(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(tempDir, withWriteBuffer, withWAL)
+	config.SyncOnWrite = true
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key1", []byte("value1")))
+
+	// SyncOnWrite takes precedence over buffering, so a read-only instance
+	// sees the write
+	reader, err := storage.NewDiskStorageWithConfig(diskTestConfig(tempDir, withReadOnly))
+	require.NoError(t, err)
+	defer reader.Close()
+
+	value, err := reader.Get("key1")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value1"), value)
+}
+
+func TestDiskStorageBatchGetOrder(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, diskStorage.Set(types.Key(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(t, diskStorage.SetWithTTL("expired", []byte("gone"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	// Keys out of file order, duplicated, missing and expired
+	keys := []types.Key{"key19", "key3", "missing", "key11", "key3", "expired", "key0"}
+	values, err := diskStorage.BatchGet(keys)
+	require.NoError(t, err)
+
+	assert.Len(t, values, 4)
+	assert.Equal(t, types.Value("value19"), values["key19"])
+	assert.Equal(t, types.Value("value3"), values["key3"])
+	assert.Equal(t, types.Value("value11"), values["key11"])
+	assert.Equal(t, types.Value("value0"), values["key0"])
+}
+
+func TestDiskStorageBatchSetPartialFailure(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("existing", []byte("value")))
+	dataPath := filepath.Join(config.DataDirectory, "data.db")
+	before, err := os.Stat(dataPath)
+	require.NoError(t, err)
+
+	// Write half of the batch, then fail
+	fsys.InjectWriteFault(vfs.WriteFault{Torn: true})
+	err = diskStorage.BatchSet(testBatch(100))
+	require.Error(t, err)
+
+	// The partial batch was truncated away and none of it is visible
+	after, err := os.Stat(dataPath)
+	require.NoError(t, err)
+	assert.Equal(t, before.Size(), after.Size())
+
+	_, err = diskStorage.Get("batch0")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+	size, err := diskStorage.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), size)
+
+	// Writes after the failure land where the batch would have
+	require.NoError(t, diskStorage.Set("later", []byte("ok")))
+	value, err := diskStorage.Get("later")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("ok"), value)
+}
+
+func TestDiskStorageBatchTooLargeForWAL(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints, withWAL)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("existing", []byte("value")))
+	dataPath := filepath.Join(config.DataDirectory, "data.db")
+	before, err := os.Stat(dataPath)
+	require.NoError(t, err)
+
+	// Each value is within MaxValueSize, but together they encode to more
+	// than the WAL's MaxRecordSize
+	value := bytes.Repeat([]byte("x"), config.MaxValueSize)
+	var entries []types.Entry
+	for i := 0; i < 60; i++ {
+		entries = append(entries, types.Entry{Key: types.Key(fmt.Sprintf("big%02d", i)), Value: value})
+	}
+	for name, write := range map[string]func() error{
+		"batch set": func() error { return diskStorage.BatchSet(entries) },
+		"commit":    func() error { return diskStorage.CommitIfVersions(nil, entries, []types.Key{"existing"}) },
+	} {
+		assert.ErrorIs(t, write(), wal.ErrRecordTooLarge, name)
+
+		// Nothing was written
+		after, err := os.Stat(dataPath)
+		require.NoError(t, err)
+		assert.Equal(t, before.Size(), after.Size(), name)
+		_, err = diskStorage.Get("big00")
+		assert.Equal(t, types.ErrKeyNotFound, err, name)
+		_, err = diskStorage.Get("existing")
+		assert.NoError(t, err, name)
+	}
+}
+
+func TestDiskStorageBatchSetCrash(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("existing", []byte("value")))
+
+	// The process dies with half of the batch written
+	fsys.InjectWriteFault(vfs.WriteFault{Err: vfs.ErrCrashed, Torn: true, Crash: true})
+	require.Error(t, diskStorage.BatchSet(testBatch(100)))
+	// The directory as left by the crash reopens without the batch
+	require.NoError(t, fsys.Crash())
+	assert.Equal(t, map[types.Key]string{"existing": "value"}, readCrashState(t, config))
+}
+
+// testBatch returns n entries with keys batch0, batch1, ...
+func testBatch(n int) []types.Entry {
+	var entries []types.Entry
+	for i := 0; i < n; i++ {
+		entries = append(entries, types.Entry{
+			Key:   types.Key(fmt.Sprintf("batch%d", i)),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		})
+	}
+	return entries
+}
+
+// holdFS holds the next write to a data file until release is closed,
+// closing writing once the write has started
+type holdFS struct {
+	vfs.FS
+	writing chan struct{}
+	release chan struct{}
+}
+
+func newHoldFS() *holdFS {
+	return &holdFS{FS: vfs.OS, writing: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (fsys *holdFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	file, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(name) != "data.db" || flag&os.O_APPEND == 0 {
+		return file, err
+	}
+	return &holdFile{File: file, fsys: fsys}, nil
+}
+
+type holdFile struct {
+	vfs.File
+	fsys *holdFS
+	held bool
+}
+
+func (f *holdFile) Write(p []byte) (int, error) {
+	if !f.held {
+		f.held = true
+		close(f.fsys.writing)
+		<-f.fsys.release
+	}
+	return f.File.Write(p)
+}
+
+func TestDiskStorageReadsDuringBatchSet(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withoutWriteBuffer, withoutHints)
+	diskStorage, err := storage.NewDiskStorage(config.DataDirectory)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("existing", []byte("value")))
+	require.NoError(t, diskStorage.Close())
+
+	// Hold the batch in the middle of its write
+	fsys := newHoldFS()
+	diskStorage, err = storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- diskStorage.BatchSet([]types.Entry{{Key: "batch", Value: []byte("batch")}})
+	}()
+	<-fsys.writing
+
+	// Reads carry on and don't see the unpublished batch
+	value, err := diskStorage.Get("existing")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	_, err = diskStorage.Get("batch")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+	exists, err := diskStorage.Exists("existing")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	close(fsys.release)
+	require.NoError(t, <-done)
+
+	value, err = diskStorage.Get("batch")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("batch"), value)
+}
+
+func TestDiskStorageFileLayout(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(filepath.Join(tempDir, "data"), withoutWriteBuffer, withBlobs)
+	config.FileMode = 0600
+	config.DirMode = 0700
+	config.WALEnabled = true
+	config.WALPath = filepath.Join(tempDir, "fast", "wal", "db.wal")
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("small", []byte("value")))
+	require.NoError(t, diskStorage.Set("large", make([]byte, 2048)))
+	require.NoError(t, diskStorage.RotateWAL())
+	require.NoError(t, diskStorage.Compact())
+
+	// The WAL lives outside the data directory
+	assert.NoFileExists(t, filepath.Join(config.DataDirectory, "wal.log"))
+	usage, err := diskStorage.GetDiskUsageDetailed()
+	require.NoError(t, err)
+	assert.Equal(t, 1, usage.ArchivedWALFiles)
+
+	blobs := blobFiles(t, config.DataDirectory)
+	require.Len(t, blobs, 1)
+
+	for _, dir := range []string{
+		config.DataDirectory,
+		filepath.Join(config.DataDirectory, "blobs"),
+		filepath.Join(tempDir, "fast"),
+		filepath.Dir(config.WALPath),
+	} {
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), dir)
+	}
+	for _, file := range []string{
+		filepath.Join(config.DataDirectory, "data.db"),
+		filepath.Join(config.DataDirectory, "index.db"),
+		filepath.Join(config.DataDirectory, "blobs", blobs[0]),
+		config.WALPath,
+	} {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), file)
+	}
+}
+
+func TestDiskStorageInvalidFileLayout(t *testing.T) {
+	tempDir := t.TempDir()
+
+	config := diskTestConfig(tempDir, withoutWriteBuffer, withBlobs)
+	config.FileMode = 0400
+	_, err := storage.NewDiskStorageWithConfig(config)
+	assert.Error(t, err)
+
+	config = diskTestConfig(tempDir, withoutWriteBuffer, withBlobs)
+	config.DirMode = os.ModeDir | 0755
+	_, err = storage.NewDiskStorageWithConfig(config)
+	assert.Error(t, err)
+
+	// The WAL directory can't be created below a regular file
+	blocker := filepath.Join(tempDir, "blocker")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+	config = diskTestConfig(filepath.Join(tempDir, "data"), withoutWriteBuffer, withBlobs)
+	config.WALEnabled = true
+	config.WALPath = filepath.Join(blocker, "wal.log")
+	_, err = storage.NewDiskStorageWithConfig(config)
+	assert.Error(t, err)
+}
+
+func TestDiskStorageWALShipping(t *testing.T) {
+	config := types.DefaultConfig()
+	config.DataDirectory = filepath.Join(t.TempDir(), "primary")
+	config.WALEnabled = true
+	primary, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer primary.Close()
+
+	config.DataDirectory = filepath.Join(t.TempDir(), "replica")
+	replica, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer replica.Close()
+
+	// connect ships the primary's WAL after lastLSN to the replica until
+	// the returned function disconnects them, which returns the LSN the
+	// replica got to
+	connect := func(lastLSN uint64) func() uint64 {
+		ctx, cancel := context.WithCancel(context.Background())
+		tailer, err := primary.TailWAL(ctx, lastLSN+1)
+		require.NoError(t, err)
+
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(wal.NewShipper(writer).Ship(tailer))
+		}()
+		applied := make(chan uint64, 1)
+		go func() {
+			lsn, _ := wal.ApplyFrom(reader, replica, lastLSN)
+			applied <- lsn
+		}()
+
+		return func() uint64 {
+			cancel()
+			return <-applied
+		}
+	}
+
+	contents := func(s *storage.DiskStorage) map[types.Key]string {
+		keys, err := s.Keys()
+		require.NoError(t, err)
+		data := make(map[types.Key]string)
+		for _, key := range keys {
+			value, err := s.Get(key)
+			require.NoError(t, err)
+			data[key] = string(value)
+		}
+		return data
+	}
+
+	converged := func() {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(contents(primary), contents(replica))
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			key := types.Key(fmt.Sprintf("key%03d", i))
+			require.NoError(t, primary.Set(key, []byte(fmt.Sprintf("value%d", i))))
+			if i%5 == 4 {
+				require.NoError(t, primary.Delete(types.Key(fmt.Sprintf("key%03d", i-2))))
+			}
+		}
+		require.NoError(t, primary.BatchSet([]types.Entry{
+			{Key: types.Key(fmt.Sprintf("batch%03d", from)), Value: []byte("a")},
+			{Key: types.Key(fmt.Sprintf("batch%03d", from+1)), Value: []byte("b")},
+		}))
+	}
+
+	// Writes made before and while the replica is connected reach it
+	write(0, 20)
+	disconnect := connect(0)
+	write(20, 40)
+	converged()
+	lastLSN := disconnect()
+	stats, err := primary.GetWALStats()
+	require.NoError(t, err)
+	assert.Equal(t, stats.LastLSN, lastLSN)
+
+	// After a disconnect it resumes where it left off
+	write(40, 60)
+	require.NoError(t, primary.Compact())
+	disconnect = connect(lastLSN)
+	write(60, 80)
+	converged()
+	assert.Greater(t, disconnect(), lastLSN)
+	assert.Len(t, contents(replica), 72)
+}
@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"database_engine/types"
+	"sync/atomic"
+	"time"
+)
+
+// expiryCallback holds the function a storage calls with each entry it
+// removes because the entry expired
+type expiryCallback struct {
+	fn atomic.Pointer[func(key types.Key, value types.Value)]
+}
+
+// set registers fn, or removes the callback if fn is nil
+func (c *expiryCallback) set(fn func(key types.Key, value types.Value)) {
+	if fn == nil {
+		c.fn.Store(nil)
+		return
+	}
+	c.fn.Store(&fn)
+}
+
+// active reports whether a callback is registered, for callers that would
+// otherwise not read the value of an expired entry
+func (c *expiryCallback) active() bool {
+	return c.fn.Load() != nil
+}
+
+// notify calls the callback, if any, with entry
+func (c *expiryCallback) notify(entry *types.Entry) {
+	if fn := c.fn.Load(); fn != nil {
+		(*fn)(entry.Key, entry.Value)
+	}
+}
+
+// withTTL returns a copy of entry, written at now, that expires ttl later.
+// Storing it counts as another write of the key.
+func withTTL(entry *types.Entry, ttl time.Duration, now time.Time) *types.Entry {
+	return &types.Entry{
+		Key:       entry.Key,
+		Value:     entry.Value,
+		UpdatedAt: now,
+		TTL:       &ttl,
+		ExpiresAt: now.Add(ttl),
+	}
+}
@@ -0,0 +1,42 @@
+package storage
+
+// SetCheckpointStepFunc replaces the function Checkpoint calls after each
+// step and returns a function that restores the original
+func SetCheckpointStepFunc(fn func(step string)) (restore func()) {
+	original := checkpointStep
+	checkpointStep = fn
+	return func() { checkpointStep = original }
+}
+
+// DataGeneration returns the id of the data file generation reads go to
+// and how many references it has
+func (s *DiskStorage) DataGeneration() (id uint64, refs int32) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readGen.id, s.readGen.refs.Load()
+}
+
+// CachedEntries returns how many entries the read cache holds
+func (s *DiskStorage) CachedEntries() int {
+	if s.cache == nil {
+		return 0
+	}
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+
+	return len(s.cache.entries)
+}
+
+// DisableStats stops the storage counting its reads, writes and deletes,
+// so benchmarks can measure what counting costs
+func (s *InMemoryStorage) DisableStats() {
+	for _, shard := range s.shards {
+		shard.counters = nil
+	}
+}
+
+// DisableStats stops the storage counting its reads, writes and deletes
+func (s *DiskStorage) DisableStats() {
+	s.counters = nil
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"database_engine/vfs"
+	"sync/atomic"
+)
+
+// dataGeneration is one data file opened for reading. Compaction, Clear and
+// Repair replace the data file, starting a new generation. Readers that go
+// on reading a generation after releasing the storage locks, like read
+// views and snapshots, acquire it; its descriptor is closed, which lets the
+// filesystem free a replaced file, only once the storage and the last of
+// them have released it. Reads that hold mu throughout use the storage's
+// current generation directly, since it can't be replaced under them.
+type dataGeneration struct {
+	id   uint64 // Counts the data files the storage has had since it opened
+	file vfs.File
+	refs atomic.Int32
+}
+
+// newDataGeneration returns generation id reading file, held by the storage
+func newDataGeneration(id uint64, file vfs.File) *dataGeneration {
+	g := &dataGeneration{id: id, file: file}
+	g.refs.Store(1)
+	return g
+}
+
+// acquire takes a reference to the generation, which the caller must
+// release. The caller must hold mu, so it isn't the storage's last
+// reference being released meanwhile.
+func (g *dataGeneration) acquire() *dataGeneration {
+	g.refs.Add(1)
+	return g
+}
+
+// release drops a reference, closing the file with the last one
+func (g *dataGeneration) release() error {
+	if g.refs.Add(-1) == 0 {
+		return g.file.Close()
+	}
+	return nil
+}
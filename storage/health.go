@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"database_engine/types"
+	"database_engine/vfs"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// ErrInsufficientSpace is returned when a write would leave less free disk
+// space than Config.MinFreeBytes
+var ErrInsufficientSpace = errors.New("insufficient free disk space")
+
+// largeWriteSize is the size from which a write first checks that it leaves
+// Config.MinFreeBytes free. Compaction and repair always check.
+const largeWriteSize = 64 * 1024
+
+// probeSize is the size of the file a read-only storage writes to find out
+// whether there is space again
+const probeSize = 4096
+
+// writeFailed handles a failed append to the data file: whatever part of it
+// reached the file is cut off, so the file ends at flushedOffset again, and
+// the storage turns read-only until the failure clears. It returns err. The
+// caller must hold appendMu.
+func (s *DiskStorage) writeFailed(err error) error {
+	if truncErr := s.dataFile.Truncate(s.flushedOffset.Load()); truncErr != nil {
+		err = fmt.Errorf("%w (rollback failed: %v)", err, truncErr)
+	}
+	// Offsets past the cut are written again by later records
+	s.cache.clear()
+	s.degrade(err)
+	return err
+}
+
+// degrade makes the storage read-only after a write failure. Writes keep
+// failing with types.ErrReadOnly until a retry of what failed succeeds.
+// The caller must hold appendMu.
+func (s *DiskStorage) degrade(err error) {
+	if s.degraded == nil {
+		s.log.Error("storage is read-only after a write failure", "dir", s.dataDir, "error", err)
+	}
+	s.degraded = err
+}
+
+// checkWritable is called before a mutation that writes about size bytes.
+// Storage opened read-only refuses it, storage made read-only by a write
+// failure first retries the write that failed, and large writes check that
+// they leave Config.MinFreeBytes free. The caller must hold appendMu.
+func (s *DiskStorage) checkWritable(size int64) error {
+	if s.readOnly {
+		return errOpenedReadOnly
+	}
+	if s.degraded != nil {
+		if err := s.recoverWrites(); err != nil {
+			return fmt.Errorf("%w: %w", types.ErrReadOnly, err)
+		}
+	}
+
+	if size >= largeWriteSize {
+		return s.checkFreeSpace(size)
+	}
+	return nil
+}
+
+// checkGrowth is checkWritable for a mutation adding size bytes of data,
+// which HoldWrites refuses too. The caller must hold appendMu.
+func (s *DiskStorage) checkGrowth(size int64) error {
+	if s.held != nil && !s.readOnly {
+		return fmt.Errorf("%w: %w", types.ErrReadOnly, s.held)
+	}
+	return s.checkWritable(size)
+}
+
+// HoldWrites makes writes that add data (sets, batches and bulk loads)
+// fail with an error wrapping types.ErrReadOnly and reason, until
+// ReleaseWrites. Deletes, compaction and checkpoints, which free space, go
+// on. It is for stopping writes before the disk fills rather than when it
+// has.
+func (s *DiskStorage) HoldWrites(reason error) {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+
+	if s.held == nil {
+		s.log.Error("storage is read-only", "dir", s.dataDir, "reason", reason)
+	}
+	s.held = reason
+}
+
+// ReleaseWrites lets writes held by HoldWrites through again
+func (s *DiskStorage) ReleaseWrites() {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+
+	if s.held != nil {
+		s.log.Info("storage is writable again", "dir", s.dataDir)
+	}
+	s.held = nil
+}
+
+// VolumeSpace returns the free and total bytes of the filesystem holding
+// the data directory, or errors.ErrUnsupported if its FS can't tell
+func (s *DiskStorage) VolumeSpace() (free, total uint64, err error) {
+	if free, err = vfs.FreeSpace(s.fs, s.dataDir); err != nil {
+		return 0, 0, err
+	}
+	if total, err = vfs.TotalSpace(s.fs, s.dataDir); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
+
+// recoverWrites checks that the disk takes writes again by writing and
+// fsyncing a probe file, then retries what the write failure left undone:
+// it drops any leftover partial record, flushes the records still buffered
+// and saves the index. The storage is writable again if all of that
+// succeeds. The caller must hold appendMu.
+func (s *DiskStorage) recoverWrites() error {
+	if err := s.checkFreeSpace(0); err != nil {
+		return err
+	}
+
+	probePath := filepath.Join(s.dataDir, "space.probe")
+	err := writeFileSync(s.fs, probePath, make([]byte, probeSize))
+	s.fs.Remove(probePath)
+	if err != nil {
+		return err
+	}
+
+	info, err := s.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	if flushed := s.flushedOffset.Load(); info.Size() != flushed {
+		if err := s.dataFile.Truncate(flushed); err != nil {
+			return err
+		}
+	}
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	s.log.Info("storage is writable again", "dir", s.dataDir)
+	s.degraded = nil
+	return nil
+}
+
+// checkFreeSpace returns ErrInsufficientSpace if writing size bytes would
+// leave less than Config.MinFreeBytes free. Filesystems that can't report
+// their free space are not checked.
+func (s *DiskStorage) checkFreeSpace(size int64) error {
+	if s.minFreeBytes <= 0 {
+		return nil
+	}
+
+	free, err := vfs.FreeSpace(s.fs, s.dataDir)
+	if err != nil {
+		return nil
+	}
+
+	if needed := uint64(size + s.minFreeBytes); free < needed {
+		return fmt.Errorf("%w: %d bytes free, %d needed", ErrInsufficientSpace, free, needed)
+	}
+	return nil
+}
+
+// Health returns nil while the storage accepts writes. After a write
+// failure it retries the write, so the storage recovers as soon as space is
+// available again, and returns an error wrapping types.ErrReadOnly if the
+// retry fails too, or while HoldWrites holds writes.
+func (s *DiskStorage) Health() error {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	if err := s.checkWritable(0); err != nil {
+		return err
+	}
+	if s.held != nil {
+		return fmt.Errorf("%w: %w", types.ErrReadOnly, s.held)
+	}
+	return nil
+}
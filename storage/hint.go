@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// hintFileName is the index snapshot that lets DiskStorage open without
+// parsing index.db
+const hintFileName = "index.hint"
+
+// hintTailSize is how many data file bytes before the covered offset a hint
+// checksums, so a hint left over from a data file that was since replaced
+// is rejected
+const hintTailSize = 64
+
+// hintFileMagic identifies a hint file
+var hintFileMagic = [4]byte{'K', 'V', 'H', 'T'}
+
+// Hint file layout (all integers little-endian):
+//
+//	magic    [4]byte
+//	offset   int64   data file bytes the snapshot covers
+//	tailCRC  uint32  CRC-32C of the hintTailSize data file bytes before offset
+//	count    uint64
+//	entries  count × (keyLen uvarint, key, offset uvarint)
+//	checksum uint32  CRC-32C of everything above
+//
+// The data file is append-only between rewrites, so its records after the
+// covered offset are the log of every index change since the snapshot.
+const hintHeaderSize = 4 + 8 + 4 + 8
+
+var errInvalidHint = errors.New("invalid hint file")
+
+// hint is a decoded hint file
+type hint struct {
+	offset  int64
+	tailCRC uint32
+	index   map[types.Key]int64
+}
+
+func encodeHint(h *hint) []byte {
+	buf := make([]byte, 0, hintHeaderSize+len(h.index)*24+4)
+	buf = append(buf, hintFileMagic[:]...)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(h.offset))
+	buf = binary.LittleEndian.AppendUint32(buf, h.tailCRC)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(h.index)))
+	for key, offset := range h.index {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(offset))
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+func decodeHint(data []byte) (*hint, error) {
+	if len(data) < hintHeaderSize+4 || [4]byte(data[:4]) != hintFileMagic {
+		return nil, errInvalidHint
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errInvalidHint)
+	}
+
+	h := &hint{
+		offset:  int64(binary.LittleEndian.Uint64(body[4:])),
+		tailCRC: binary.LittleEndian.Uint32(body[12:]),
+	}
+	count := binary.LittleEndian.Uint64(body[16:])
+
+	// Every entry takes at least two bytes, which bounds a corrupt count
+	rest := body[hintHeaderSize:]
+	if count > uint64(len(rest)/2) {
+		return nil, fmt.Errorf("%w: bad entry count", errInvalidHint)
+	}
+
+	h.index = make(map[types.Key]int64, count)
+	for i := uint64(0); i < count; i++ {
+		keyLen, n := binary.Uvarint(rest)
+		if n <= 0 || keyLen > uint64(len(rest)-n) {
+			return nil, fmt.Errorf("%w: truncated entry", errInvalidHint)
+		}
+		key := types.Key(rest[n : n+int(keyLen)])
+		rest = rest[n+int(keyLen):]
+
+		offset, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: truncated entry", errInvalidHint)
+		}
+		rest = rest[n:]
+		h.index[key] = int64(offset)
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", errInvalidHint)
+	}
+
+	return h, nil
+}
+
+// dataTailCRC checksums the data file bytes just before offset
+func (s *DiskStorage) dataTailCRC(offset int64) (uint32, error) {
+	start := offset - hintTailSize
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, offset-start)
+	if _, err := s.readGen.file.ReadAt(tail, start); err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(tail, crcTable), nil
+}
+
+// loadHint replaces the index with the hint file's snapshot and the records
+// written after it. It reports false, leaving the index alone, when there is
+// no usable hint.
+func (s *DiskStorage) loadHint() bool {
+	if s.hintInterval <= 0 || s.formatVersion == formatVersionJSON {
+		return false // Legacy files have no tombstones to replay deletes from
+	}
+
+	data, err := vfs.ReadFile(s.fs, filepath.Join(s.dataDir, hintFileName))
+	if err != nil {
+		return false
+	}
+	h, err := decodeHint(data)
+	if err != nil || h.offset < fileHeaderSize || h.offset > s.nextOffset {
+		return false
+	}
+	if tailCRC, err := s.dataTailCRC(h.offset); err != nil || tailCRC != h.tailCRC {
+		return false
+	}
+
+	// Apply the records written since the snapshot
+	replayRecords(s.readGen.file, h.offset, s.nextOffset, s.formatVersion, s.maxValueSize, h.index)
+
+	s.index = h.index
+	s.hintOffset = h.offset
+	return true
+}
+
+// writeHint snapshots the index to the hint file. Buffered records are
+// flushed and the data file fsynced first so the snapshot never covers
+// bytes that could still be lost.
+func (s *DiskStorage) writeHint() error {
+	if err := s.flushWriter(); err != nil {
+		return err
+	}
+	if err := s.dataFile.Sync(); err != nil {
+		return err
+	}
+
+	offset := s.nextOffset
+	tailCRC, err := s.dataTailCRC(offset)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dataDir, hintFileName)
+	if err := writeFileSync(s.fs, path+".tmp", encodeHint(&hint{offset: offset, tailCRC: tailCRC, index: s.index})); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(path+".tmp", path); err != nil {
+		s.fs.Remove(path + ".tmp")
+		return err
+	}
+
+	s.hintOffset = offset
+	return nil
+}
+
+// maybeWriteHint writes a new hint once hintInterval bytes have been
+// appended since the last one. Hints only speed up opening, so a failure
+// doesn't fail the write that triggered it; the next attempt waits for
+// another interval.
+func (s *DiskStorage) maybeWriteHint() {
+	if s.hintInterval <= 0 || s.formatVersion == formatVersionJSON {
+		return
+	}
+	if s.nextOffset-s.hintOffset < s.hintInterval {
+		return
+	}
+	if err := s.writeHint(); err != nil {
+		s.hintOffset = s.nextOffset
+	}
+}
+
+// removeHint deletes the hint file before the data file is replaced
+func (s *DiskStorage) removeHint() error {
+	err := s.fs.Remove(filepath.Join(s.dataDir, hintFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.hintOffset = 0
+	return nil
+}
+
+// hintSize returns the size of the hint file, or 0 when there is none
+func (s *DiskStorage) hintSize() int64 {
+	stat, err := s.fs.Stat(filepath.Join(s.dataDir, hintFileName))
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
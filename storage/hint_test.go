@@ -0,0 +1,121 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// populateHintStorage writes count keys and closes the storage, leaving a
+// hint covering all of them
+func populateHintStorage(t *testing.T, config types.Config, count int) map[types.Key]string {
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+
+	want := make(map[types.Key]string)
+	for i := 0; i < count; i++ {
+		key := types.Key(fmt.Sprintf("key%03d", i))
+		value := fmt.Sprintf("value%d", i)
+		require.NoError(t, diskStorage.Set(key, types.Value(value)))
+		want[key] = value
+	}
+	require.NoError(t, diskStorage.Close())
+
+	_, err = os.Stat(filepath.Join(config.DataDirectory, "index.hint"))
+	require.NoError(t, err, "closing should leave a hint")
+	return want
+}
+
+func TestDiskStorageIndexHintReplaysTail(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withHints)
+	want := populateHintStorage(t, config, 100)
+
+	// Write past the hint and die before it is refreshed
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key000", types.Value("updated")))
+	require.NoError(t, diskStorage.Delete("key001"))
+	require.NoError(t, diskStorage.BatchSet([]types.Entry{{Key: "new1", Value: types.Value("batch")}, {Key: "new2", Value: types.Value("batch")}}))
+	require.NoError(t, diskStorage.BatchDelete([]types.Key{"key002", "key003"}))
+	require.NoError(t, fsys.Crash())
+
+	want["key000"] = "updated"
+	want["new1"] = "batch"
+	want["new2"] = "batch"
+	for _, key := range []types.Key{"key001", "key002", "key003"} {
+		delete(want, key)
+	}
+
+	// An empty index.db would lose everything, so the state can only come
+	// from the hint and the records after it
+	require.NoError(t, os.WriteFile(filepath.Join(config.DataDirectory, "index.db"), []byte("{}"), 0644))
+	assert.Equal(t, want, readCrashState(t, config))
+}
+
+func TestDiskStorageIndexHintCorrupt(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withHints)
+	want := populateHintStorage(t, config, 100)
+
+	hintPath := filepath.Join(config.DataDirectory, "index.hint")
+	data, err := os.ReadFile(hintPath)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xFF
+	require.NoError(t, os.WriteFile(hintPath, data, 0644))
+
+	// The damaged hint is ignored in favour of index.db
+	assert.Equal(t, want, readCrashState(t, config))
+
+	require.NoError(t, os.WriteFile(hintPath, []byte("garbage"), 0644))
+	assert.Equal(t, want, readCrashState(t, config))
+}
+
+func TestDiskStorageIndexHintStale(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withHints)
+	want := populateHintStorage(t, config, 100)
+
+	hintPath := filepath.Join(config.DataDirectory, "index.hint")
+	staleHint, err := os.ReadFile(hintPath)
+	require.NoError(t, err)
+
+	// Compaction moves every record, so the old hint's offsets are wrong
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		key := types.Key(fmt.Sprintf("key%03d", i))
+		require.NoError(t, diskStorage.Delete(key))
+		delete(want, key)
+	}
+	require.NoError(t, diskStorage.Compact())
+
+	// Grow the new file past the offset the old hint covers
+	for i := 0; i < 100; i++ {
+		key := types.Key(fmt.Sprintf("more%03d", i))
+		require.NoError(t, diskStorage.Set(key, types.Value("more")))
+		want[key] = "more"
+	}
+	require.NoError(t, diskStorage.Close())
+
+	require.NoError(t, os.WriteFile(hintPath, staleHint, 0644))
+	assert.Equal(t, want, readCrashState(t, config))
+}
+
+func TestDiskStorageIndexHintDisabled(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withHints)
+	config.IndexHintInterval = 0
+
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", types.Value("value")))
+	require.NoError(t, diskStorage.Close())
+
+	_, err = os.Stat(filepath.Join(config.DataDirectory, "index.hint"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"database_engine/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+// ErrCorruptIndex is returned when index.db is empty, torn or fails its checksum
+var ErrCorruptIndex = errors.New("corrupt index")
+
+// indexChecksumSize is the length of the index.db trailer: a newline and
+// the CRC-32C of the JSON as 8 hex digits
+const indexChecksumSize = 1 + 8
+
+// encodeIndex serializes an index for index.db: the JSON-encoded map
+// followed by its checksum
+func encodeIndex(index map[types.Key]int64) ([]byte, error) {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+
+	data = append(data, '\n')
+	return fmt.Appendf(data, "%08x", crc32.Checksum(data[:len(data)-1], crcTable)), nil
+}
+
+// DecodeIndex parses the contents of index.db, verifying the checksum.
+// Files written before the checksum was added are plain JSON and are
+// accepted as long as they parse.
+func DecodeIndex(data []byte) (map[types.Key]int64, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty index file", ErrCorruptIndex)
+	}
+
+	// A JSON object ends with '}', so a trailer can't be mistaken for JSON
+	body := data
+	if n := len(data) - indexChecksumSize; n >= 0 && data[n] == '\n' {
+		if expected, err := strconv.ParseUint(string(data[n+1:]), 16, 32); err == nil {
+			body = data[:n]
+			if crc32.Checksum(body, crcTable) != uint32(expected) {
+				return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptIndex)
+			}
+		}
+	}
+
+	var index map[types.Key]int64
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptIndex, err)
+	}
+	if index == nil {
+		index = make(map[types.Key]int64)
+	}
+	return index, nil
+}
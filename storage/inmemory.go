@@ -1,97 +1,772 @@
 package storage
 
 import (
+	"container/heap"
 	"database_engine/types"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// InMemoryStorage implements the StorageEngine interface using in-memory storage
+// DefaultInMemoryShards is the number of shards used by NewInMemoryStorage
+const DefaultInMemoryShards = 64
+
+// entryOverhead approximates the per-entry memory cost beyond key and value
+const entryOverhead = 64
+
+// evictionPolicy is the parsed form of Config.EvictionPolicy
+type evictionPolicy int
+
+const (
+	policyLRU evictionPolicy = iota
+	policyLFU
+	policyExpiredFirst
+	policyReject
+)
+
+// parseEvictionPolicy maps a Config.EvictionPolicy name to its policy. An
+// empty name selects LRU.
+func parseEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case "", types.EvictionLRU:
+		return policyLRU, nil
+	case types.EvictionLFU:
+		return policyLFU, nil
+	case types.EvictionExpiredFirst:
+		return policyExpiredFirst, nil
+	case types.EvictionReject:
+		return policyReject, nil
+	default:
+		return policyLRU, fmt.Errorf("unknown eviction policy %q", name)
+	}
+}
+
+func (p evictionPolicy) String() string {
+	switch p {
+	case policyLFU:
+		return types.EvictionLFU
+	case policyExpiredFirst:
+		return types.EvictionExpiredFirst
+	case policyReject:
+		return types.EvictionReject
+	default:
+		return types.EvictionLRU
+	}
+}
+
+// MemoryStats describes the memory accounting of an InMemoryStorage
+type MemoryStats struct {
+	UsedBytes  int64  `json:"used_bytes"`
+	LimitBytes int64  `json:"limit_bytes"` // 0 means unlimited
+	Policy     string `json:"policy"`
+	Evictions  int64  `json:"evictions"`
+}
+
+// InMemoryStorage implements the StorageEngine interface using in-memory storage.
+//
+// The key space is split across shards, each a map with its own lock, so
+// writes to different keys don't contend. Operations on a single key lock
+// one shard; Size, Keys and Clear visit every shard.
+//
+// Memory usage is tracked on every write. When a memory limit is set and a
+// write takes usage over it, entries are evicted according to the eviction
+// policy until usage is back under the limit. Each shard keeps its entries
+// in a heap ordered by the policy, so the next victim overall is the best
+// of the shard heap roots. Entries that expire are also kept in a heap per
+// shard ordered by expiry time, so expired entries are found without
+// visiting the ones that haven't expired or never will.
+//
+// closed is only set while every shard is locked, so operations that check
+// it under a shard lock never touch a closed storage.
 type InMemoryStorage struct {
-	data map[types.Key]*types.Entry
-	mu   sync.RWMutex
+	shards []*memoryShard
+	mask   uint32
+	closed atomic.Bool
+
+	ttlDisabled atomic.Bool // Entries never expire, see SetTTLEnabled
+	onExpire    expiryCallback
+	views       memoryViews
+	versions    versionClock
+
+	usage     atomic.Int64
+	limit     atomic.Int64
+	policy    atomic.Int32 // evictionPolicy
+	clock     atomic.Uint64
+	evictions atomic.Int64
+	onEvict   atomic.Pointer[func(key types.Key, value types.Value)]
+	counts    atomic.Pointer[func(key types.Key) uint64]
+	evictMu   sync.Mutex // Serializes eviction passes
+}
+
+// memoryShard is one partition of the key space
+type memoryShard struct {
+	mu          sync.RWMutex
+	data        map[types.Key]*memEntry
+	heap        evictionHeap
+	expiries    expiryHeap    // Entries that expire, soonest first
+	views       *memoryViews  // The storage's read views, told of every change
+	versions    *versionClock // The storage's clock, which stamps every entry put
+	ttlDisabled *atomic.Bool  // The storage's switch keeping entries from expiring
+	counters    *opCounters   // Kept per shard so readers of different shards don't share them
+}
+
+// memEntry is a stored entry with its accounting and eviction metadata
+type memEntry struct {
+	entry      *types.Entry
+	size       int64
+	lastAccess uint64 // Logical clock value of the last read or write
+	hits       uint64 // Reads and writes since the key was inserted
+	heapIndex  int
+	expiresAt  time.Time // entry.Expiry(), zero if the entry doesn't expire
+	expiryIdx  int       // Index in the shard's expiry heap, -1 if not in it
+}
+
+// evictionHeap orders a shard's entries so the root is the next to evict
+type evictionHeap struct {
+	items []*memEntry
+	lfu   bool
+}
+
+// evictsBefore reports whether a should be evicted before b
+func evictsBefore(a, b *memEntry, lfu bool) bool {
+	if lfu && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastAccess < b.lastAccess
+}
+
+func (h *evictionHeap) Len() int { return len(h.items) }
+
+func (h *evictionHeap) Less(i, j int) bool {
+	return evictsBefore(h.items[i], h.items[j], h.lfu)
+}
+
+func (h *evictionHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].heapIndex = i
+	h.items[j].heapIndex = j
+}
+
+func (h *evictionHeap) Push(x any) {
+	e := x.(*memEntry)
+	e.heapIndex = len(h.items)
+	h.items = append(h.items, e)
+}
+
+func (h *evictionHeap) Pop() any {
+	n := len(h.items)
+	e := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return e
+}
+
+// expiryHeap orders a shard's expiring entries so the root expires first.
+// It holds the memEntry itself, which put updates in place when its key is
+// overwritten, so no stale deadline is left behind for a key whose TTL was
+// changed or removed.
+type expiryHeap []*memEntry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIdx = i
+	h[j].expiryIdx = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	e := x.(*memEntry)
+	e.expiryIdx = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.expiryIdx = -1
+	*h = old[:n-1]
+	return e
+}
+
+// entrySize approximates the memory used by an entry
+func entrySize(key types.Key, value types.Value) int64 {
+	return int64(len(key)) + int64(len(value)) + entryOverhead
+}
+
+// put stores entry, stamping it with a version and revision unless it has
+// them, replacing any existing entry for its key, and returns the change in
+// memory usage. A new key's hit count starts from counts when it is set.
+// The caller must hold the shard write lock.
+func (shard *memoryShard) put(entry *types.Entry, stamp uint64, counts func(types.Key) uint64) int64 {
+	shard.versions.stamp(entry)
+	shard.counters.wrote(1)
+	size := entrySize(entry.Key, entry.Value)
+
+	if e, exists := shard.data[entry.Key]; exists {
+		if !shard.ttlDisabled.Load() && e.entry.IsExpired() {
+			revise(entry, nil)
+		} else {
+			revise(entry, e.entry)
+		}
+		shard.views.save(entry.Key, e.entry)
+		delta := size - e.size
+		e.entry = entry
+		e.size = size
+		e.lastAccess = stamp
+		e.hits++
+		heap.Fix(&shard.heap, e.heapIndex)
+		shard.setExpiry(e, entry.Expiry())
+		return delta
+	}
+
+	revise(entry, nil)
+	shard.views.save(entry.Key, nil)
+	e := &memEntry{entry: entry, size: size, lastAccess: stamp, hits: 1, expiryIdx: -1}
+	if counts != nil {
+		e.hits += counts(entry.Key)
+	}
+	shard.data[entry.Key] = e
+	heap.Push(&shard.heap, e)
+	shard.setExpiry(e, entry.Expiry())
+	return size
+}
+
+// setExpiry moves e to expiresAt in the expiry heap, adding or removing it
+// as needed. The caller must hold the shard write lock.
+func (shard *memoryShard) setExpiry(e *memEntry, expiresAt time.Time) {
+	e.expiresAt = expiresAt
+	switch {
+	case expiresAt.IsZero() && e.expiryIdx >= 0:
+		heap.Remove(&shard.expiries, e.expiryIdx)
+	case expiresAt.IsZero():
+	case e.expiryIdx >= 0:
+		heap.Fix(&shard.expiries, e.expiryIdx)
+	default:
+		heap.Push(&shard.expiries, e)
+	}
+}
+
+// popExpired removes the entries of the shard that expired before now,
+// soonest first, and returns them with the memory they used. Only the
+// expired entries and the root after them are visited. The caller must
+// hold the shard write lock.
+func (shard *memoryShard) popExpired(now time.Time) ([]*types.Entry, int64) {
+	var expired []*types.Entry
+	var freed int64
+	for len(shard.expiries) > 0 && shard.expiries[0].expiresAt.Before(now) {
+		e := shard.expiries[0]
+		freed += shard.remove(e)
+		expired = append(expired, e.entry)
+	}
+	return expired, freed
+}
+
+// remove deletes e from the shard and returns its size. The caller must
+// hold the shard write lock.
+func (shard *memoryShard) remove(e *memEntry) int64 {
+	shard.views.save(e.entry.Key, e.entry)
+	heap.Remove(&shard.heap, e.heapIndex)
+	delete(shard.data, e.entry.Key)
+	if e.expiryIdx >= 0 {
+		heap.Remove(&shard.expiries, e.expiryIdx)
+	}
+	return e.size
+}
+
+// touch records a read of e. The caller must hold the shard write lock.
+func (shard *memoryShard) touch(e *memEntry, stamp uint64) {
+	e.lastAccess = stamp
+	e.hits++
+	heap.Fix(&shard.heap, e.heapIndex)
+}
+
+// reset removes every entry from the shard. The caller must hold the shard
+// write lock.
+func (shard *memoryShard) reset() {
+	if shard.views.open.Load() > 0 {
+		for key, e := range shard.data {
+			shard.views.save(key, e.entry)
+		}
+	}
+	shard.data = make(map[types.Key]*memEntry)
+	shard.heap.items = nil
+	shard.expiries = nil
 }
 
 // NewInMemoryStorage creates a new in-memory storage instance
 func NewInMemoryStorage() *InMemoryStorage {
-	return &InMemoryStorage{
-		data: make(map[types.Key]*types.Entry),
+	return NewInMemoryStorageWithShards(DefaultInMemoryShards)
+}
+
+// NewInMemoryStorageWithShards creates a new in-memory storage instance with
+// the given number of shards, rounded up to a power of two. Values below one
+// use DefaultInMemoryShards.
+func NewInMemoryStorageWithShards(shardCount int) *InMemoryStorage {
+	if shardCount < 1 {
+		shardCount = DefaultInMemoryShards
+	}
+
+	n := 1
+	for n < shardCount {
+		n <<= 1
+	}
+
+	s := &InMemoryStorage{
+		shards: make([]*memoryShard, n),
+		mask:   uint32(n - 1),
+	}
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{data: make(map[types.Key]*memEntry), views: &s.views, versions: &s.versions, ttlDisabled: &s.ttlDisabled, counters: &opCounters{}}
+	}
+
+	return s
+}
+
+// NewInMemoryStorageWithConfig creates a new in-memory storage instance using
+// the shard count, memory limit and eviction policy from config. An unknown
+// eviction policy falls back to LRU.
+func NewInMemoryStorageWithConfig(config types.Config) *InMemoryStorage {
+	s := NewInMemoryStorageWithShards(config.InMemoryShards)
+
+	policy, _ := parseEvictionPolicy(config.EvictionPolicy)
+	s.setPolicy(policy)
+	if config.MaxMemorySize > 0 {
+		s.limit.Store(config.MaxMemorySize)
+	}
+
+	return s
+}
+
+// SetMemoryLimit changes the memory limit and eviction policy. A limit of
+// zero or less disables the limit. Lowering the limit below the current
+// usage evicts immediately, except with the reject policy, which only
+// refuses further writes until usage drops.
+func (s *InMemoryStorage) SetMemoryLimit(limit int64, policyName string) error {
+	if s.closed.Load() {
+		return types.ErrDatabaseClosed
+	}
+
+	policy, err := parseEvictionPolicy(policyName)
+	if err != nil {
+		return err
+	}
+
+	if limit < 0 {
+		limit = 0
+	}
+	s.setPolicy(policy)
+	s.limit.Store(limit)
+	s.enforceLimit()
+
+	return nil
+}
+
+// setPolicy switches the eviction policy, reordering the shard heaps if the
+// ordering changed
+func (s *InMemoryStorage) setPolicy(policy evictionPolicy) {
+	lfu := policy == policyLFU
+
+	s.lockAll()
+	defer s.unlockAll()
+
+	s.policy.Store(int32(policy))
+	for _, shard := range s.shards {
+		if shard.heap.lfu != lfu {
+			shard.heap.lfu = lfu
+			heap.Init(&shard.heap)
+		}
+	}
+}
+
+// SetEvictionCallback registers fn to be called with the key and value of
+// every evicted entry. The callback runs after the entry is removed and
+// without any storage locks held; pass nil to remove it.
+func (s *InMemoryStorage) SetEvictionCallback(fn func(key types.Key, value types.Value)) {
+	if fn == nil {
+		s.onEvict.Store(nil)
+		return
+	}
+	s.onEvict.Store(&fn)
+}
+
+// SetExpiryCallback registers fn to be called with the key and value of
+// every entry removed because it expired, whether by a read, CleanupExpired
+// or expired-first eviction. Each removal calls it once. It may run with a
+// shard lock held, so it must return quickly and not use the storage; pass
+// nil to remove it.
+func (s *InMemoryStorage) SetExpiryCallback(fn func(key types.Key, value types.Value)) {
+	s.onExpire.set(fn)
+}
+
+// SetAccessCounts registers fn as the source of each key's access count
+// from before it was inserted, so LFU eviction favours keys that were busy
+// before being evicted or deleted. fn is called with a shard lock held and
+// must not call back into the storage; pass nil to remove it.
+func (s *InMemoryStorage) SetAccessCounts(fn func(key types.Key) uint64) {
+	if fn == nil {
+		s.counts.Store(nil)
+		return
+	}
+	s.counts.Store(&fn)
+}
+
+// accessCounts returns the function registered with SetAccessCounts, if any
+func (s *InMemoryStorage) accessCounts() func(types.Key) uint64 {
+	if fn := s.counts.Load(); fn != nil {
+		return *fn
+	}
+	return nil
+}
+
+// GetMemoryStats returns the current memory accounting
+func (s *InMemoryStorage) GetMemoryStats() MemoryStats {
+	return MemoryStats{
+		UsedBytes:  s.usage.Load(),
+		LimitBytes: s.limit.Load(),
+		Policy:     evictionPolicy(s.policy.Load()).String(),
+		Evictions:  s.evictions.Load(),
+	}
+}
+
+// Stats returns the storage's read, write and delete counts, summed over
+// its shards, and how many entries it evicted
+func (s *InMemoryStorage) Stats() types.StorageStats {
+	stats := types.StorageStats{Evictions: s.evictions.Load()}
+	for _, shard := range s.shards {
+		shard.counters.addTo(&stats)
+	}
+	return stats
+}
+
+// tracksAccess reports whether reads need to update eviction order
+func (s *InMemoryStorage) tracksAccess() bool {
+	return s.limit.Load() > 0 && evictionPolicy(s.policy.Load()) != policyReject
+}
+
+// checkLimit returns an error if a write that grows usage by delta can't be
+// accepted. Entries larger than the limit never fit; with the reject policy
+// any write that would take usage over the limit is refused.
+func (s *InMemoryStorage) checkLimit(largest, delta int64) error {
+	limit := s.limit.Load()
+	if limit <= 0 {
+		return nil
+	}
+	if largest > limit {
+		return fmt.Errorf("%w: entry of %d bytes exceeds limit of %d bytes", types.ErrMemoryLimitExceeded, largest, limit)
+	}
+	if evictionPolicy(s.policy.Load()) == policyReject && delta > 0 && s.usage.Load()+delta > limit {
+		return types.ErrMemoryLimitExceeded
+	}
+	return nil
+}
+
+// enforceLimit evicts entries until usage is back under the limit
+func (s *InMemoryStorage) enforceLimit() {
+	limit := s.limit.Load()
+	if limit <= 0 || s.usage.Load() <= limit {
+		return
+	}
+
+	policy := evictionPolicy(s.policy.Load())
+	if policy == policyReject {
+		return
+	}
+
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+
+	if policy == policyExpiredFirst {
+		for _, shard := range s.shards {
+			if s.usage.Load() <= limit {
+				return
+			}
+			s.evictExpired(shard)
+		}
+	}
+
+	for s.usage.Load() > limit {
+		if !s.evictOne() {
+			return
+		}
+	}
+}
+
+// evictExpired evicts every expired entry in shard
+func (s *InMemoryStorage) evictExpired(shard *memoryShard) {
+	if s.ttlDisabled.Load() {
+		return
+	}
+
+	shard.mu.Lock()
+	evicted, freed := shard.popExpired(time.Now())
+	s.usage.Add(-freed)
+	shard.mu.Unlock()
+
+	for _, entry := range evicted {
+		s.evicted(entry)
+		s.onExpire.notify(entry)
+	}
+}
+
+// evictOne evicts the entry that comes first in eviction order across all
+// shards. It returns false if the storage is empty.
+func (s *InMemoryStorage) evictOne() bool {
+	for {
+		// Compare against a copy of the best root so far, since the
+		// original can change once its shard is unlocked
+		var victim *memEntry
+		var best memEntry
+		var victimShard *memoryShard
+		for _, shard := range s.shards {
+			shard.mu.RLock()
+			if shard.heap.Len() > 0 {
+				root := shard.heap.items[0]
+				if victim == nil || evictsBefore(root, &best, shard.heap.lfu) {
+					victim = root
+					best = *root
+					victimShard = shard
+				}
+			}
+			shard.mu.RUnlock()
+		}
+		if victim == nil {
+			return false
+		}
+
+		// The entry may have been read, replaced or deleted since the scan
+		victimShard.mu.Lock()
+		current, exists := victimShard.data[victim.entry.Key]
+		if !exists || current != victim || victim.heapIndex != 0 {
+			victimShard.mu.Unlock()
+			continue
+		}
+		entry := victim.entry
+		s.usage.Add(-victimShard.remove(victim))
+		victimShard.mu.Unlock()
+
+		s.evicted(entry)
+		return true
+	}
+}
+
+// evicted counts an eviction and notifies the callback
+func (s *InMemoryStorage) evicted(entry *types.Entry) {
+	s.evictions.Add(1)
+	if fn := s.onEvict.Load(); fn != nil {
+		(*fn)(entry.Key, entry.Value)
+	}
+}
+
+// shardIndex hashes a key with FNV-1a to pick its shard
+func (s *InMemoryStorage) shardIndex(key types.Key) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash & s.mask)
+}
+
+func (s *InMemoryStorage) shardFor(key types.Key) *memoryShard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// lockAll write-locks every shard in order; unlockAll releases them
+func (s *InMemoryStorage) lockAll() {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+	}
+}
+
+func (s *InMemoryStorage) unlockAll() {
+	for _, shard := range s.shards {
+		shard.mu.Unlock()
 	}
 }
 
 // Get retrieves a value by key
 func (s *InMemoryStorage) Get(key types.Key) (types.Value, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	entry, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry retrieves a copy of the whole entry stored for key, with the
+// timestamp and expiry it was written with
+func (s *InMemoryStorage) GetEntry(key types.Key) (*types.Entry, error) {
+	entry, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+// getEntry finds the live entry stored for key, removing it if it expired,
+// and counts the read
+func (s *InMemoryStorage) getEntry(key types.Key) (*types.Entry, error) {
+	shard := s.shardFor(key)
+	entry, err := s.findEntry(shard, key)
+	shard.counters.read(err)
+	return entry, err
+}
+
+// findEntry implements getEntry for key, which is in shard
+func (s *InMemoryStorage) findEntry(shard *memoryShard, key types.Key) (*types.Entry, error) {
+	if s.tracksAccess() {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		if s.closed.Load() {
+			return nil, types.ErrDatabaseClosed
+		}
+
+		e, exists := shard.data[key]
+		if !exists {
+			return nil, types.ErrKeyNotFound
+		}
+		if s.expired(e.entry) {
+			s.usage.Add(-shard.remove(e))
+			s.onExpire.notify(e.entry)
+			return nil, types.ErrKeyExpired
+		}
+
+		shard.touch(e, s.clock.Add(1))
+		return e.entry, nil
+	}
+
+	shard.mu.RLock()
+	if s.closed.Load() {
+		shard.mu.RUnlock()
+		return nil, types.ErrDatabaseClosed
+	}
+	e, exists := shard.data[key]
+	shard.mu.RUnlock()
 
-	entry, exists := s.data[key]
 	if !exists {
 		return nil, types.ErrKeyNotFound
 	}
 
 	// Check if entry has expired
-	if entry.IsExpired() {
-		// Clean up expired entry
-		delete(s.data, key)
+	if s.expired(e.entry) {
+		s.removeExpired(shard, e)
 		return nil, types.ErrKeyExpired
 	}
 
-	return entry.Value, nil
+	return e.entry, nil
+}
+
+// removeExpired removes e, found expired in shard without the write lock,
+// unless it was replaced or removed in the meantime
+func (s *InMemoryStorage) removeExpired(shard *memoryShard, e *memEntry) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if current, ok := shard.data[e.entry.Key]; ok && current == e {
+		s.usage.Add(-shard.remove(e))
+		s.onExpire.notify(e.entry)
+	}
 }
 
 // Set stores a key-value pair
 func (s *InMemoryStorage) Set(key types.Key, value types.Value) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	entry := &types.Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now(),
+		UpdatedAt: time.Now(),
 		TTL:       nil, // No TTL by default
 	}
 
-	s.data[key] = entry
-	return nil
+	return s.store(entry)
 }
 
 // SetWithTTL stores a key-value pair with a time-to-live
 func (s *InMemoryStorage) SetWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.SetWithExpiry(key, value, ttl, time.Now().Add(ttl))
+}
 
+// SetWithExpiry stores a key-value pair that expires at expiresAt
+func (s *InMemoryStorage) SetWithExpiry(key types.Key, value types.Value, ttl time.Duration, expiresAt time.Time) error {
 	entry := &types.Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now(),
+		UpdatedAt: time.Now(),
 		TTL:       &ttl,
+		ExpiresAt: expiresAt,
+	}
+
+	return s.store(entry)
+}
+
+// store writes a single entry and enforces the memory limit
+func (s *InMemoryStorage) store(entry *types.Entry) error {
+	size := entrySize(entry.Key, entry.Value)
+	shard := s.shardFor(entry.Key)
+
+	shard.mu.Lock()
+	if s.closed.Load() {
+		shard.mu.Unlock()
+		return types.ErrDatabaseClosed
+	}
+	delta := size
+	if e, exists := shard.data[entry.Key]; exists {
+		delta -= e.size
+	}
+	if err := s.checkLimit(size, delta); err != nil {
+		shard.mu.Unlock()
+		return err
 	}
+	s.usage.Add(shard.put(entry, s.clock.Add(1), s.accessCounts()))
+	shard.mu.Unlock()
 
-	s.data[key] = entry
+	s.enforceLimit()
 	return nil
 }
 
 // Delete removes a key-value pair
 func (s *InMemoryStorage) Delete(key types.Key) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	shard := s.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if s.closed.Load() {
+		return types.ErrDatabaseClosed
+	}
+
+	if e, exists := shard.data[key]; exists {
+		s.usage.Add(-shard.remove(e))
+		shard.counters.deleted(1)
+	}
 
-	delete(s.data, key)
 	return nil
 }
 
 // Exists checks if a key exists
 func (s *InMemoryStorage) Exists(key types.Key) (bool, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	shard := s.shardFor(key)
+	shard.mu.RLock()
+	if s.closed.Load() {
+		shard.mu.RUnlock()
+		return false, types.ErrDatabaseClosed
+	}
+	e, exists := shard.data[key]
+	shard.mu.RUnlock()
 
-	entry, exists := s.data[key]
 	if !exists {
 		return false, nil
 	}
 
 	// Check if entry has expired
-	if entry.IsExpired() {
+	if s.expired(e.entry) {
+		s.removeExpired(shard, e)
 		return false, nil
 	}
 
@@ -100,48 +775,199 @@ func (s *InMemoryStorage) Exists(key types.Key) (bool, error) {
 
 // BatchGet retrieves multiple values by keys
 func (s *InMemoryStorage) BatchGet(keys []types.Key) (map[types.Key]types.Value, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	result := make(map[types.Key]types.Value)
 
 	for _, key := range keys {
-		entry, exists := s.data[key]
-		if exists && !entry.IsExpired() {
-			result[key] = entry.Value
+		value, err := s.Get(key)
+		if err == types.ErrDatabaseClosed {
+			return nil, err
+		}
+		if err == nil {
+			result[key] = value
 		}
 	}
 
 	return result, nil
 }
 
-// BatchSet stores multiple key-value pairs
+// BatchSet stores multiple key-value pairs. Every shard the batch touches is
+// locked (in shard order) while it is applied, so readers never observe
+// part of a batch. With the reject eviction policy the whole batch is
+// refused if it would take usage over the memory limit.
 func (s *InMemoryStorage) BatchSet(entries []types.Entry) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := s.batchSet(entries); err != nil {
+		return err
+	}
+
+	s.enforceLimit()
+	return nil
+}
+
+func (s *InMemoryStorage) batchSet(entries []types.Entry) error {
+	keys := make([]types.Key, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].Key
+	}
+	defer s.lockShards(keys)()
+
+	if s.closed.Load() {
+		return types.ErrDatabaseClosed
+	}
+	return s.putBatch(entries)
+}
+
+// lockShards write-locks the shards holding keys, in shard order so that
+// batches can't deadlock, and returns a function that unlocks them
+func (s *InMemoryStorage) lockShards(keys []types.Key) func() {
+	touched := make([]bool, len(s.shards))
+	for _, key := range keys {
+		touched[s.shardIndex(key)] = true
+	}
+	for i, shard := range s.shards {
+		if touched[i] {
+			shard.mu.Lock()
+		}
+	}
+
+	return func() {
+		for i, shard := range s.shards {
+			if touched[i] {
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// putBatch stores entries, or none of them if they would take usage over
+// the memory limit under the reject policy. The caller must hold the write
+// locks of their shards.
+func (s *InMemoryStorage) putBatch(entries []types.Entry) error {
+	// Work out the net change in usage, counting only the last write of a
+	// key that appears more than once
+	var largest, delta int64
+	sizes := make(map[types.Key]int64, len(entries))
+	for _, entry := range entries {
+		size := entrySize(entry.Key, entry.Value)
+		if size > largest {
+			largest = size
+		}
+		sizes[entry.Key] = size
+	}
+	for key, size := range sizes {
+		delta += size
+		if e, exists := s.shardFor(key).data[key]; exists {
+			delta -= e.size
+		}
+	}
+	if err := s.checkLimit(largest, delta); err != nil {
+		return err
+	}
 
 	now := time.Now()
 	for _, entry := range entries {
 		// Create a copy of the entry to avoid pointer issues
 		entryCopy := entry
 		// Set timestamp if not already set
-		if entryCopy.Timestamp.IsZero() {
-			entryCopy.Timestamp = now
+		if entryCopy.UpdatedAt.IsZero() {
+			entryCopy.UpdatedAt = now
 		}
 
-		s.data[entryCopy.Key] = &entryCopy
+		s.usage.Add(s.shardFor(entryCopy.Key).put(&entryCopy, s.clock.Add(1), s.accessCounts()))
+	}
+
+	return nil
+}
+
+// ExpireBatch gives each of keys that exists ttl to live from now, or
+// removes them if ttl <= 0, and returns the keys that weren't found;
+// expired keys count as missing. The shards holding keys are locked once
+// for the whole batch, like BatchSet's.
+func (s *InMemoryStorage) ExpireBatch(keys []types.Key, ttl time.Duration) ([]types.Key, error) {
+	defer s.lockShards(keys)()
+
+	if s.closed.Load() {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	var missing []types.Key
+	now := time.Now()
+	for _, key := range keys {
+		shard := s.shardFor(key)
+		e, exists := shard.data[key]
+		switch {
+		case !exists || s.expired(e.entry):
+			missing = append(missing, key)
+		case ttl <= 0:
+			s.usage.Add(-shard.remove(e))
+			shard.counters.deleted(1)
+		default:
+			s.usage.Add(shard.put(withTTL(e.entry, ttl, now), s.clock.Add(1), nil))
+		}
+	}
+
+	return missing, nil
+}
+
+// CommitIfVersions stores sets and removes deletes if every key in expected
+// is still at the version given, with the shards of all the keys locked
+// throughout, so readers see all of the writes or none of them
+func (s *InMemoryStorage) CommitIfVersions(expected map[types.Key]uint64, sets []types.Entry, deletes []types.Key) error {
+	if err := s.commitIfVersions(expected, sets, deletes); err != nil {
+		return err
+	}
+
+	s.enforceLimit()
+	return nil
+}
+
+func (s *InMemoryStorage) commitIfVersions(expected map[types.Key]uint64, sets []types.Entry, deletes []types.Key) error {
+	keys := make([]types.Key, 0, len(expected)+len(sets)+len(deletes))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	for i := range sets {
+		keys = append(keys, sets[i].Key)
+	}
+	keys = append(keys, deletes...)
+	defer s.lockShards(keys)()
+
+	if s.closed.Load() {
+		return types.ErrDatabaseClosed
 	}
 
+	for key, version := range expected {
+		var current uint64
+		if e, exists := s.shardFor(key).data[key]; exists && !s.expired(e.entry) {
+			current = e.entry.Version
+		}
+		if err := checkVersion(key, version, current); err != nil {
+			return err
+		}
+	}
+
+	if err := s.putBatch(unversioned(sets)); err != nil {
+		return err
+	}
+	for _, key := range deletes {
+		shard := s.shardFor(key)
+		if e, exists := shard.data[key]; exists {
+			s.usage.Add(-shard.remove(e))
+			shard.counters.deleted(1)
+		}
+	}
 	return nil
 }
 
 // BatchDelete removes multiple key-value pairs
 func (s *InMemoryStorage) BatchDelete(keys []types.Key) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return types.ErrDatabaseClosed
+	}
 
 	for _, key := range keys {
-		delete(s.data, key)
+		if err := s.Delete(key); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -149,24 +975,36 @@ func (s *InMemoryStorage) BatchDelete(keys []types.Key) error {
 
 // Clear removes all key-value pairs
 func (s *InMemoryStorage) Clear() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.closed.Load() {
+		return types.ErrDatabaseClosed
+	}
 
-	s.data = make(map[types.Key]*types.Entry)
+	for _, shard := range s.shards {
+		shard.reset()
+	}
+	s.usage.Store(0)
 	return nil
 }
 
 // Size returns the number of key-value pairs
 func (s *InMemoryStorage) Size() (int64, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if s.closed.Load() {
+		return 0, types.ErrDatabaseClosed
+	}
 
 	// Count only non-expired entries
 	count := int64(0)
-	for _, entry := range s.data {
-		if !entry.IsExpired() {
-			count++
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for _, e := range shard.data {
+			if !s.expired(e.entry) {
+				count++
+			}
 		}
+		shard.mu.RUnlock()
 	}
 
 	return count, nil
@@ -174,61 +1012,110 @@ func (s *InMemoryStorage) Size() (int64, error) {
 
 // Keys returns all keys in the storage
 func (s *InMemoryStorage) Keys() ([]types.Key, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	if s.closed.Load() {
+		return nil, types.ErrDatabaseClosed
+	}
 
 	var keys []types.Key
-	for key, entry := range s.data {
-		if !entry.IsExpired() {
-			keys = append(keys, key)
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for key, e := range shard.data {
+			if !s.expired(e.entry) {
+				keys = append(keys, key)
+			}
 		}
+		shard.mu.RUnlock()
 	}
 
 	return keys, nil
 }
 
-// Close closes the storage (no-op for in-memory storage)
+// Close closes the storage and releases its data. Every later operation
+// returns types.ErrDatabaseClosed; closing again is a no-op.
 func (s *InMemoryStorage) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.lockAll()
+	defer s.unlockAll()
 
-	// Clear all data
-	s.data = make(map[types.Key]*types.Entry)
+	if s.closed.Load() {
+		return nil
+	}
+
+	s.closed.Store(true)
+	for _, shard := range s.shards {
+		shard.reset()
+	}
+	s.usage.Store(0)
 	return nil
 }
 
-// IsClosed returns false for in-memory storage (always available)
+// IsClosed returns true if the storage is closed
 func (s *InMemoryStorage) IsClosed() bool {
-	return false
+	return s.closed.Load()
 }
 
-// CleanupExpired removes all expired entries
+// SetTTLEnabled turns expiry on or off. While it is off every entry is
+// kept and read as if it had no TTL; expiry times stay stored, and entries
+// past theirs expire once it is turned back on.
+func (s *InMemoryStorage) SetTTLEnabled(enabled bool) {
+	s.ttlDisabled.Store(!enabled)
+}
+
+// expired reports whether entry has expired, which it never has while
+// expiry is off
+func (s *InMemoryStorage) expired(entry *types.Entry) bool {
+	return !s.ttlDisabled.Load() && entry.IsExpired()
+}
+
+// CleanupExpired removes all expired entries. Shards are cleaned one at a
+// time so the rest of the storage stays available, and only their expired
+// entries are visited.
 func (s *InMemoryStorage) CleanupExpired() int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.closed.Load() {
+		return 0
+	}
+
+	if s.ttlDisabled.Load() {
+		return 0
+	}
 
 	count := 0
-	for key, entry := range s.data {
-		if entry.IsExpired() {
-			delete(s.data, key)
-			count++
+	now := time.Now()
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		expired, freed := shard.popExpired(now)
+		s.usage.Add(-freed)
+		for _, entry := range expired {
+			s.onExpire.notify(entry)
 		}
+		shard.mu.Unlock()
+		count += len(expired)
 	}
 
 	return count
 }
 
-// GetMemoryUsage returns approximate memory usage in bytes
-func (s *InMemoryStorage) GetMemoryUsage() int64 {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// NextExpiry returns the earliest time a stored entry expires at, and false
+// if no entry expires or expiry is off. The time is in the past while
+// expired entries are waiting to be removed.
+func (s *InMemoryStorage) NextExpiry() (time.Time, bool) {
+	if s.ttlDisabled.Load() {
+		return time.Time{}, false
+	}
 
-	var total int64
-	for key, entry := range s.data {
-		total += int64(len(key))
-		total += int64(len(entry.Value))
-		total += 64 // Approximate overhead per entry
+	var next time.Time
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		if len(shard.expiries) > 0 {
+			if at := shard.expiries[0].expiresAt; next.IsZero() || at.Before(next) {
+				next = at
+			}
+		}
+		shard.mu.RUnlock()
 	}
+	return next, !next.IsZero()
+}
 
-	return total
+// GetMemoryUsage returns approximate memory usage in bytes
+func (s *InMemoryStorage) GetMemoryUsage() int64 {
+	return s.usage.Load()
 }
@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStorageClose(t *testing.T) {
+	memStorage := storage.NewInMemoryStorage()
+	require.NoError(t, memStorage.Set("key", types.Value("value")))
+	assert.False(t, memStorage.IsClosed())
+
+	require.NoError(t, memStorage.Close())
+	assert.True(t, memStorage.IsClosed())
+	assert.Equal(t, int64(0), memStorage.GetMemoryUsage())
+
+	// Closing again is a no-op
+	assert.NoError(t, memStorage.Close())
+
+	// Every operation fails once closed
+	_, err := memStorage.Get("key")
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.Set("key", types.Value("value"))
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.SetWithTTL("key", types.Value("value"), time.Hour)
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.Delete("key")
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	_, err = memStorage.Exists("key")
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	_, err = memStorage.BatchGet([]types.Key{"key"})
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.BatchSet([]types.Entry{{Key: "key", Value: types.Value("value")}})
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.BatchDelete([]types.Key{"key"})
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.Clear()
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	_, err = memStorage.Size()
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	_, err = memStorage.Keys()
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	err = memStorage.SetMemoryLimit(1024, types.EvictionLRU)
+	assert.Equal(t, types.ErrDatabaseClosed, err)
+
+	assert.Equal(t, 0, memStorage.CleanupExpired())
+}
+
+func TestInMemoryStorageExpiryHeap(t *testing.T) {
+	memStorage := storage.NewInMemoryStorage()
+	defer memStorage.Close()
+
+	_, ok := memStorage.NextExpiry()
+	assert.False(t, ok)
+
+	require.NoError(t, memStorage.SetWithTTL("overwritten", types.Value("v"), time.Millisecond))
+	require.NoError(t, memStorage.SetWithTTL("extended", types.Value("v"), time.Millisecond))
+	require.NoError(t, memStorage.SetWithTTL("deleted", types.Value("v"), time.Millisecond))
+	require.NoError(t, memStorage.SetWithTTL("expired", types.Value("v"), time.Millisecond))
+	next, ok := memStorage.NextExpiry()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Millisecond), next, 10*time.Millisecond)
+
+	// Overwriting or deleting a key leaves no stale deadline behind
+	require.NoError(t, memStorage.Set("overwritten", types.Value("kept")))
+	require.NoError(t, memStorage.SetWithTTL("extended", types.Value("kept"), time.Hour))
+	require.NoError(t, memStorage.Delete("deleted"))
+	require.NoError(t, memStorage.Set("deleted", types.Value("kept")))
+	time.Sleep(5 * time.Millisecond)
+
+	assert.Equal(t, 1, memStorage.CleanupExpired())
+	for _, key := range []types.Key{"overwritten", "extended", "deleted"} {
+		value, err := memStorage.Get(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, types.Value("kept"), value, key)
+	}
+	_, err := memStorage.Get("expired")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+	size, err := memStorage.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), size)
+
+	next, ok = memStorage.NextExpiry()
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), next, time.Second)
+	require.NoError(t, memStorage.Clear())
+	_, ok = memStorage.NextExpiry()
+	assert.False(t, ok)
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// IntegrityReport describes the state of a data file and its index as found
+// by CheckIntegrity. Superseded versions of a key are normal in an
+// append-only file and are only counted; orphaned records (the latest record
+// of a key the index doesn't contain and that isn't a tombstone, such as a
+// write made after the index was last saved or a key deleted before
+// tombstones were written) are listed but don't make the report unhealthy.
+type IntegrityReport struct {
+	FormatVersion     uint32          `json:"format_version"`
+	DataFileSize      int64           `json:"data_file_size"`
+	BufferedBytes     int64           `json:"buffered_bytes"` // Records still in the write buffer, not scanned
+	ValidRecords      int             `json:"valid_records"`  // Records that parse and pass their checksum
+	LiveRecords       int             `json:"live_records"`   // Valid records referenced by the index
+	StaleRecords      int             `json:"stale_records"`  // Superseded versions of a key
+	Tombstones        int             `json:"tombstones"`     // Records marking a key as deleted
+	IndexEntries      int             `json:"index_entries"`
+	OrphanedRecords   []RecordInfo    `json:"orphaned_records"`
+	DanglingEntries   []DanglingEntry `json:"dangling_entries"`
+	UnreadableRegions []Region        `json:"unreadable_regions"`
+}
+
+// RecordInfo locates a record in the data file
+type RecordInfo struct {
+	Key    types.Key `json:"key"`
+	Offset int64     `json:"offset"`
+	Size   int64     `json:"size"` // Including the length prefix
+}
+
+// DanglingEntry is an index entry that doesn't point at a readable record
+// for its key
+type DanglingEntry struct {
+	Key    types.Key `json:"key"`
+	Offset int64     `json:"offset"`
+	Reason string    `json:"reason"`
+}
+
+// Region is a byte range of the data file that holds no readable records
+type Region struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Healthy reports whether every index entry resolves and the data file has
+// no unreadable regions
+func (r *IntegrityReport) Healthy() bool {
+	return len(r.DanglingEntries) == 0 && len(r.UnreadableRegions) == 0
+}
+
+// Issues describes each problem in the report as a human readable line
+func (r *IntegrityReport) Issues() []string {
+	var issues []string
+	for _, entry := range r.DanglingEntries {
+		issues = append(issues, fmt.Sprintf("Index entry %q at offset %d: %s", entry.Key, entry.Offset, entry.Reason))
+	}
+	for _, region := range r.UnreadableRegions {
+		issues = append(issues, fmt.Sprintf("Unreadable data at offset %d (%d bytes)", region.Offset, region.Length))
+	}
+	return issues
+}
+
+// scannedRecord is a valid record found by scanDataFile
+type scannedRecord struct {
+	offset int64
+	size   int64 // Including the length prefix
+	record *decodedRecord
+}
+
+// scanDataFile walks the records between start and end, calling fn for each
+// one that decodes and passes its checksum. When a record can't be read the
+// scan resynchronizes by trying each following byte as a record start, and
+// the skipped bytes are returned as unreadable regions.
+func scanDataFile(r io.ReaderAt, start, end int64, version uint32, maxValue int, fn func(scannedRecord)) []Region {
+	var regions []Region
+	badStart := int64(-1)
+
+	for offset := start; offset < end; {
+		scanned, ok := readScannedRecord(r, offset, end, version, maxValue)
+		if !ok {
+			if badStart < 0 {
+				badStart = offset
+			}
+			offset++
+			continue
+		}
+
+		if badStart >= 0 {
+			regions = append(regions, Region{Offset: badStart, Length: offset - badStart})
+			badStart = -1
+		}
+		fn(scanned)
+		offset += scanned.size
+	}
+
+	if badStart >= 0 {
+		regions = append(regions, Region{Offset: badStart, Length: end - badStart})
+	}
+
+	return regions
+}
+
+// readScannedRecord reads and decodes the record at offset, rejecting
+// length prefixes that run past end
+func readScannedRecord(r io.ReaderAt, offset, end int64, version uint32, maxValue int) (scannedRecord, bool) {
+	var prefix [4]byte
+	if end-offset < 4 {
+		return scannedRecord{}, false
+	}
+	if _, err := r.ReadAt(prefix[:], offset); err != nil {
+		return scannedRecord{}, false
+	}
+
+	length := int64(binary.LittleEndian.Uint32(prefix[:]))
+	if length == 0 || length > end-offset-4 {
+		return scannedRecord{}, false
+	}
+	if version != formatVersionJSON && length < recordFixedSize {
+		return scannedRecord{}, false
+	}
+
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset+4); err != nil {
+		return scannedRecord{}, false
+	}
+
+	record, err := decodeRecord(data, version, maxValue)
+	if err != nil {
+		return scannedRecord{}, false
+	}
+
+	return scannedRecord{offset: offset, size: 4 + length, record: record}, true
+}
+
+// checkIntegrity scans the first end bytes of a data file and cross-checks
+// the index against the records found. Index entries at or past end refer
+// to records that are still buffered and are not checked.
+func checkIntegrity(r io.ReaderAt, end int64, version uint32, maxValue int, index map[types.Key]int64, blobs *blobStore) *IntegrityReport {
+	report := &IntegrityReport{
+		FormatVersion: version,
+		DataFileSize:  end,
+		IndexEntries:  len(index),
+	}
+
+	start := int64(0)
+	if version != formatVersionJSON {
+		start = fileHeaderSize
+	}
+
+	records := make(map[int64]scannedRecord)
+	latestOrphan := make(map[types.Key]scannedRecord)
+	report.UnreadableRegions = scanDataFile(r, start, end, version, maxValue, func(scanned scannedRecord) {
+		report.ValidRecords++
+		records[scanned.offset] = scanned
+
+		key := scanned.record.entry.Key
+		if scanned.record.tombstone {
+			report.Tombstones++
+			delete(latestOrphan, key)
+			return
+		}
+
+		// The scan moves forward, so the last record seen for a key is its latest
+		if _, indexed := index[key]; !indexed {
+			latestOrphan[key] = scanned
+		}
+	})
+
+	for key, offset := range index {
+		if offset >= end {
+			continue // Still in the write buffer
+		}
+
+		scanned, ok := records[offset]
+		switch {
+		case !ok:
+			report.DanglingEntries = append(report.DanglingEntries, DanglingEntry{Key: key, Offset: offset, Reason: "no valid record at offset"})
+		case scanned.record.entry.Key != key:
+			report.DanglingEntries = append(report.DanglingEntries, DanglingEntry{Key: key, Offset: offset, Reason: fmt.Sprintf("record belongs to key %q", scanned.record.entry.Key)})
+		case scanned.record.blob != nil:
+			if _, err := blobs.read(*scanned.record.blob); err != nil {
+				report.DanglingEntries = append(report.DanglingEntries, DanglingEntry{Key: key, Offset: offset, Reason: err.Error()})
+				continue
+			}
+			report.LiveRecords++
+		default:
+			report.LiveRecords++
+		}
+	}
+	report.StaleRecords = report.ValidRecords - report.LiveRecords - report.Tombstones - len(latestOrphan)
+
+	for key, scanned := range latestOrphan {
+		report.OrphanedRecords = append(report.OrphanedRecords, RecordInfo{Key: key, Offset: scanned.offset, Size: scanned.size})
+	}
+	sort.Slice(report.OrphanedRecords, func(i, j int) bool {
+		return report.OrphanedRecords[i].Offset < report.OrphanedRecords[j].Offset
+	})
+	sort.Slice(report.DanglingEntries, func(i, j int) bool {
+		return report.DanglingEntries[i].Offset < report.DanglingEntries[j].Offset
+	})
+
+	return report
+}
+
+// CheckIntegrity scans the data file record by record and cross-checks the
+// in-memory index against it. Records still in the write buffer are counted
+// in BufferedBytes but not scanned. Files are only read, never modified.
+func (s *DiskStorage) CheckIntegrity() (*IntegrityReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	end := s.flushedOffset.Load()
+	report := checkIntegrity(s.readGen.file, end, s.formatVersion, s.maxValueSize, s.index, s.blobs)
+	report.BufferedBytes = s.nextOffset - end
+
+	return report, nil
+}
+
+// CheckIntegrity scans the data file in dataDir and cross-checks the saved
+// index against it without opening the storage. Files are only read, never
+// modified, so it is safe to run against a directory that is in use; the
+// saved index may lag behind the data file, which shows up as orphaned
+// records rather than problems.
+func CheckIntegrity(dataDir string) (*IntegrityReport, error) {
+	config := types.DefaultConfig()
+	config.DataDirectory = dataDir
+	return CheckIntegrityWithConfig(config)
+}
+
+// CheckIntegrityWithConfig is CheckIntegrity for the data directory in
+// config, whose MaxValueSize bounds the values compressed records may
+// inflate to.
+func CheckIntegrityWithConfig(config types.Config) (*IntegrityReport, error) {
+	dataDir := config.DataDirectory
+	dataFile, err := os.Open(filepath.Join(dataDir, "data.db"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer dataFile.Close()
+
+	stat, err := dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, fileHeaderSize)
+	n, err := dataFile.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	version, err := decodeFileHeader(header[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[types.Key]int64)
+	indexData, err := os.ReadFile(filepath.Join(dataDir, "index.db"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read index file: %w", err)
+	}
+	if len(indexData) > 0 {
+		if index, err = DecodeIndex(indexData); err != nil {
+			return nil, fmt.Errorf("index file corrupted: %w", err)
+		}
+	}
+
+	return checkIntegrity(dataFile, stat.Size(), version, maxDecompressedSize(config), index, newBlobStore(vfs.OS, dataDir, 0)), nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"database_engine/types"
+	"sort"
+	"sync"
+)
+
+// keyLockStripes is how many locks keyLocks spreads keys over
+const keyLockStripes = 256
+
+// keyLocks serializes the writes of each key without serializing writes of
+// different keys: every key hashes to one of keyLockStripes locks, so two
+// keys rarely share one. A write that touches several keys locks their
+// stripes in ascending order, so multi-key writes can't deadlock each
+// other.
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+// stripe hashes a key with FNV-1a to pick its lock
+func (l *keyLocks) stripe(key types.Key) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % keyLockStripes)
+}
+
+// lock locks the stripes of keys and returns a function that unlocks them
+func (l *keyLocks) lock(keys ...types.Key) func() {
+	if len(keys) == 1 {
+		mu := &l.stripes[l.stripe(keys[0])]
+		mu.Lock()
+		return mu.Unlock
+	}
+
+	var touched [keyLockStripes]bool
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		if i := l.stripe(key); !touched[i] {
+			touched[i] = true
+			stripes = append(stripes, i)
+		}
+	}
+	sort.Ints(stripes)
+	for _, i := range stripes {
+		l.stripes[i].Lock()
+	}
+
+	return func() {
+		for _, i := range stripes {
+			l.stripes[i].Unlock()
+		}
+	}
+}
+
+// lockAll locks every stripe, for writes that may touch any key, and
+// returns a function that unlocks them
+func (l *keyLocks) lockAll() func() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+
+	return func() {
+		for i := range l.stripes {
+			l.stripes[i].Unlock()
+		}
+	}
+}
+
+// entryKeys returns the keys of entries
+func entryKeys(entries []types.Entry) []types.Key {
+	keys := make([]types.Key, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	return keys
+}
@@ -0,0 +1,126 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// metadataStorage is what the entry metadata tests need of a storage
+type metadataStorage interface {
+	types.StorageEngine
+	types.EntryReader
+	types.TTLStorage
+}
+
+// requireEntry returns the entry stored for key
+func requireEntry(t *testing.T, s types.EntryReader, key types.Key) *types.Entry {
+	t.Helper()
+	entry, err := s.GetEntry(key)
+	require.NoError(t, err, key)
+	return entry
+}
+
+func TestEntryMetadata(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) metadataStorage{
+		"InMemory": func(*testing.T) metadataStorage { return storage.NewInMemoryStorage() },
+		"Ordered":  func(*testing.T) metadataStorage { return storage.NewOrderedInMemoryStorage() },
+		"Disk": func(t *testing.T) metadataStorage {
+			diskStorage, err := storage.NewDiskStorage(t.TempDir())
+			require.NoError(t, err)
+			return diskStorage
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+
+			require.NoError(t, s.Set("key", types.Value("1")))
+			first := requireEntry(t, s, "key")
+			assert.Equal(t, uint64(1), first.Revision)
+			assert.True(t, first.CreatedAt.Equal(first.UpdatedAt))
+
+			// Overwrites keep the creation time and count up
+			time.Sleep(time.Millisecond)
+			require.NoError(t, s.Set("key", types.Value("2")))
+			second := requireEntry(t, s, "key")
+			assert.Equal(t, uint64(2), second.Revision)
+			assert.True(t, first.CreatedAt.Equal(second.CreatedAt))
+			assert.True(t, second.UpdatedAt.After(first.UpdatedAt))
+
+			require.NoError(t, s.BatchSet([]types.Entry{
+				{Key: "key", Value: types.Value("3")},
+				{Key: "other", Value: types.Value("other")},
+				{Key: "key", Value: types.Value("4")},
+			}))
+			require.NoError(t, s.SetWithTTL("key", types.Value("5"), time.Hour))
+			fifth := requireEntry(t, s, "key")
+			assert.Equal(t, types.Value("5"), fifth.Value)
+			assert.Equal(t, uint64(5), fifth.Revision)
+			assert.True(t, first.CreatedAt.Equal(fifth.CreatedAt))
+			assert.Equal(t, uint64(1), requireEntry(t, s, "other").Revision)
+
+			// A deleted key starts over
+			require.NoError(t, s.Delete("key"))
+			require.NoError(t, s.Set("key", types.Value("6")))
+			recreated := requireEntry(t, s, "key")
+			assert.Equal(t, uint64(1), recreated.Revision)
+			assert.True(t, recreated.CreatedAt.After(first.CreatedAt))
+
+			// and so does an expired one
+			require.NoError(t, s.SetWithTTL("short", types.Value("1"), time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+			require.NoError(t, s.Set("short", types.Value("2")))
+			assert.Equal(t, uint64(1), requireEntry(t, s, "short").Revision)
+		})
+	}
+}
+
+func TestDiskStorageEntryMetadataRecovery(t *testing.T) {
+	config := diskTestConfig(t.TempDir(), withWriteBuffer, withWAL)
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("a", types.Value("1")))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, diskStorage.SetWithTTL("a", types.Value("2"), time.Hour))
+	require.NoError(t, diskStorage.BatchSet([]types.Entry{{Key: "b", Value: types.Value("1")}}))
+	require.NoError(t, diskStorage.BatchSet([]types.Entry{{Key: "b", Value: types.Value("2")}}))
+	written := map[types.Key]*types.Entry{
+		"a": requireEntry(t, diskStorage, "a"),
+		"b": requireEntry(t, diskStorage, "b"),
+	}
+	assert.Equal(t, uint64(2), written["a"].Revision)
+	assert.True(t, written["a"].UpdatedAt.After(written["a"].CreatedAt))
+
+	// Simulate a crash: replay keeps the metadata, and so does the data
+	// file once the recovered storage is closed and reopened
+	require.NoError(t, fsys.Crash())
+	for _, reopen := range []string{"replayed", "reopened"} {
+		recovered, err := storage.NewDiskStorageWithConfig(config)
+		require.NoError(t, err)
+
+		for key, want := range written {
+			entry := requireEntry(t, recovered, key)
+			assert.True(t, want.CreatedAt.Equal(entry.CreatedAt), "%s %s", reopen, key)
+			assert.True(t, want.UpdatedAt.Equal(entry.UpdatedAt), "%s %s", reopen, key)
+			assert.Equal(t, want.Revision, entry.Revision, "%s %s", reopen, key)
+		}
+		require.NoError(t, recovered.Close())
+	}
+
+	// Writes after recovery carry on counting
+	recovered, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer recovered.Close()
+	require.NoError(t, recovered.Set("a", types.Value("3")))
+	entry := requireEntry(t, recovered, "a")
+	assert.Equal(t, uint64(3), entry.Revision)
+	assert.True(t, written["a"].CreatedAt.Equal(entry.CreatedAt))
+}
@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"database_engine/types"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	skipListMaxLevel = 24 // Enough for well over 2^24 keys at skipListP = 4
+	skipListP        = 4  // One in skipListP nodes is promoted to the next level
+)
+
+// skipNode is a node of the skip list; next[i] is the following node at level i
+type skipNode struct {
+	entry *types.Entry
+	size  int64
+	next  []*skipNode
+}
+
+// OrderedInMemoryStorage implements the StorageEngine interface with an
+// in-memory skip list, keeping keys sorted so Range and KeysWithPrefix cost
+// O(log n + k) instead of a scan of every key. Point lookups and writes are
+// O(log n) and slower than InMemoryStorage's hash map, and a single lock
+// guards the whole list. The memory limit is not enforced.
+type OrderedInMemoryStorage struct {
+	mu     sync.RWMutex
+	head   *skipNode
+	level  int // Levels currently in use
+	length int
+	usage  int64
+	rng    *rand.Rand
+	closed bool
+
+	ttlDisabled atomic.Bool // Entries never expire, see SetTTLEnabled
+	onExpire    expiryCallback
+	views       memoryViews
+	versions    versionClock
+	counters    *opCounters
+}
+
+// NewOrderedInMemoryStorage creates a new ordered in-memory storage instance
+func NewOrderedInMemoryStorage() *OrderedInMemoryStorage {
+	return &OrderedInMemoryStorage{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rng:   rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		counters: &opCounters{},
+	}
+}
+
+// randomLevel picks the height of a new node. The caller must hold the
+// write lock, which also guards rng.
+func (s *OrderedInMemoryStorage) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && s.rng.Intn(skipListP) == 0 {
+		level++
+	}
+	return level
+}
+
+// seek returns the first node whose key is at least key, or nil
+func (s *OrderedInMemoryStorage) seek(key types.Key) *skipNode {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].entry.Key < key {
+			node = node.next[i]
+		}
+	}
+	return node.next[0]
+}
+
+// find returns the node holding key, or nil
+func (s *OrderedInMemoryStorage) find(key types.Key) *skipNode {
+	node := s.seek(key)
+	if node != nil && node.entry.Key == key {
+		return node
+	}
+	return nil
+}
+
+// predecessors fills update with the last node before key at every level
+func (s *OrderedInMemoryStorage) predecessors(key types.Key, update *[skipListMaxLevel]*skipNode) {
+	node := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].entry.Key < key {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+}
+
+// put inserts or replaces entry, stamping it with a version and revision
+// unless it has them. The caller must hold the write lock.
+func (s *OrderedInMemoryStorage) put(entry *types.Entry) {
+	s.versions.stamp(entry)
+	s.counters.wrote(1)
+	var update [skipListMaxLevel]*skipNode
+	s.predecessors(entry.Key, &update)
+
+	size := entrySize(entry.Key, entry.Value)
+	if node := update[0].next[0]; node != nil && node.entry.Key == entry.Key {
+		if s.expired(node.entry) {
+			revise(entry, nil)
+		} else {
+			revise(entry, node.entry)
+		}
+		s.views.save(entry.Key, node.entry)
+		s.usage += size - node.size
+		node.entry = entry
+		node.size = size
+		return
+	}
+
+	revise(entry, nil)
+	s.views.save(entry.Key, nil)
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+
+	node := &skipNode{entry: entry, size: size, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	s.length++
+	s.usage += size
+}
+
+// remove unlinks the node holding key, returning it if one was found. The
+// caller must hold the write lock.
+func (s *OrderedInMemoryStorage) remove(key types.Key) *skipNode {
+	var update [skipListMaxLevel]*skipNode
+	s.predecessors(key, &update)
+
+	node := update[0].next[0]
+	if node == nil || node.entry.Key != key {
+		return nil
+	}
+
+	s.views.save(key, node.entry)
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	s.usage -= node.size
+	return node
+}
+
+// deleteKey removes key for a delete, counting it if it existed. The caller
+// must hold the write lock.
+func (s *OrderedInMemoryStorage) deleteKey(key types.Key) {
+	if s.remove(key) != nil {
+		s.counters.deleted(1)
+	}
+}
+
+// Get retrieves a value by key
+func (s *OrderedInMemoryStorage) Get(key types.Key) (types.Value, error) {
+	entry, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value, nil
+}
+
+// GetEntry retrieves a copy of the whole entry stored for key, with the
+// timestamp and expiry it was written with
+func (s *OrderedInMemoryStorage) GetEntry(key types.Key) (*types.Entry, error) {
+	entry, err := s.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+// getEntry finds the live entry stored for key, removing it if it expired,
+// and counts the read
+func (s *OrderedInMemoryStorage) getEntry(key types.Key) (*types.Entry, error) {
+	entry, err := s.findEntry(key)
+	s.counters.read(err)
+	return entry, err
+}
+
+// findEntry implements getEntry
+func (s *OrderedInMemoryStorage) findEntry(key types.Key) (*types.Entry, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, types.ErrDatabaseClosed
+	}
+	node := s.find(key)
+	var entry *types.Entry
+	if node != nil {
+		entry = node.entry
+	}
+	s.mu.RUnlock()
+
+	if entry == nil {
+		return nil, types.ErrKeyNotFound
+	}
+
+	// Check if entry has expired
+	if s.expired(entry) {
+		s.removeExpired(entry)
+		return nil, types.ErrKeyExpired
+	}
+
+	return entry, nil
+}
+
+// removeExpired removes entry, found expired without the write lock,
+// unless it was replaced or removed in the meantime
+func (s *OrderedInMemoryStorage) removeExpired(entry *types.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if node := s.find(entry.Key); node != nil && node.entry == entry {
+		s.remove(entry.Key)
+		s.onExpire.notify(entry)
+	}
+}
+
+// Set stores a key-value pair
+func (s *OrderedInMemoryStorage) Set(key types.Key, value types.Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	s.put(&types.Entry{
+		Key:       key,
+		Value:     value,
+		UpdatedAt: time.Now(),
+		TTL:       nil, // No TTL by default
+	})
+	return nil
+}
+
+// SetWithTTL stores a key-value pair with a time-to-live
+func (s *OrderedInMemoryStorage) SetWithTTL(key types.Key, value types.Value, ttl time.Duration) error {
+	return s.SetWithExpiry(key, value, ttl, time.Now().Add(ttl))
+}
+
+// SetWithExpiry stores a key-value pair that expires at expiresAt
+func (s *OrderedInMemoryStorage) SetWithExpiry(key types.Key, value types.Value, ttl time.Duration, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	s.put(&types.Entry{
+		Key:       key,
+		Value:     value,
+		UpdatedAt: time.Now(),
+		TTL:       &ttl,
+		ExpiresAt: expiresAt,
+	})
+	return nil
+}
+
+// Delete removes a key-value pair
+func (s *OrderedInMemoryStorage) Delete(key types.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	s.deleteKey(key)
+	return nil
+}
+
+// Exists checks if a key exists
+func (s *OrderedInMemoryStorage) Exists(key types.Key) (bool, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false, types.ErrDatabaseClosed
+	}
+	node := s.find(key)
+	var entry *types.Entry
+	if node != nil {
+		entry = node.entry
+	}
+	s.mu.RUnlock()
+
+	if entry == nil {
+		return false, nil
+	}
+	if s.expired(entry) {
+		s.removeExpired(entry)
+		return false, nil
+	}
+	return true, nil
+}
+
+// BatchGet retrieves multiple values by keys
+func (s *OrderedInMemoryStorage) BatchGet(keys []types.Key) (map[types.Key]types.Value, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	result := make(map[types.Key]types.Value)
+	for _, key := range keys {
+		node := s.find(key)
+		switch {
+		case node == nil:
+			s.counters.read(types.ErrKeyNotFound)
+		case s.expired(node.entry):
+			s.counters.read(types.ErrKeyExpired)
+		default:
+			result[key] = node.entry.Value
+			s.counters.read(nil)
+		}
+	}
+
+	return result, nil
+}
+
+// BatchSet stores multiple key-value pairs under a single lock, so readers
+// never observe part of a batch
+func (s *OrderedInMemoryStorage) BatchSet(entries []types.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		// Create a copy of the entry to avoid pointer issues
+		entryCopy := entry
+		// Set timestamp if not already set
+		if entryCopy.UpdatedAt.IsZero() {
+			entryCopy.UpdatedAt = now
+		}
+		s.put(&entryCopy)
+	}
+
+	return nil
+}
+
+// BatchDelete removes multiple key-value pairs
+func (s *OrderedInMemoryStorage) BatchDelete(keys []types.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	for _, key := range keys {
+		s.deleteKey(key)
+	}
+
+	return nil
+}
+
+// ExpireBatch gives each of keys that exists ttl to live from now, or
+// removes them if ttl <= 0, under a single lock, and returns the keys that
+// weren't found; expired keys count as missing
+func (s *OrderedInMemoryStorage) ExpireBatch(keys []types.Key, ttl time.Duration) ([]types.Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	var missing []types.Key
+	now := time.Now()
+	for _, key := range keys {
+		node := s.find(key)
+		switch {
+		case node == nil || s.expired(node.entry):
+			missing = append(missing, key)
+		case ttl <= 0:
+			s.deleteKey(key)
+		default:
+			s.put(withTTL(node.entry, ttl, now))
+		}
+	}
+
+	return missing, nil
+}
+
+// CommitIfVersions stores sets and removes deletes under a single lock if
+// every key in expected is still at the version given
+func (s *OrderedInMemoryStorage) CommitIfVersions(expected map[types.Key]uint64, sets []types.Entry, deletes []types.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	for key, version := range expected {
+		var current uint64
+		if node := s.find(key); node != nil && !s.expired(node.entry) {
+			current = node.entry.Version
+		}
+		if err := checkVersion(key, version, current); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	entries := unversioned(sets)
+	for i := range entries {
+		if entries[i].UpdatedAt.IsZero() {
+			entries[i].UpdatedAt = now
+		}
+		s.put(&entries[i])
+	}
+	for _, key := range deletes {
+		s.deleteKey(key)
+	}
+	return nil
+}
+
+// Clear removes all key-value pairs
+func (s *OrderedInMemoryStorage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return types.ErrDatabaseClosed
+	}
+
+	s.reset()
+	return nil
+}
+
+func (s *OrderedInMemoryStorage) reset() {
+	if s.views.open.Load() > 0 {
+		for node := s.head.next[0]; node != nil; node = node.next[0] {
+			s.views.save(node.entry.Key, node.entry)
+		}
+	}
+	s.head = &skipNode{next: make([]*skipNode, skipListMaxLevel)}
+	s.level = 1
+	s.length = 0
+	s.usage = 0
+}
+
+// Size returns the number of key-value pairs
+func (s *OrderedInMemoryStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return 0, types.ErrDatabaseClosed
+	}
+
+	// Count only non-expired entries
+	count := int64(0)
+	for node := s.head.next[0]; node != nil; node = node.next[0] {
+		if !s.expired(node.entry) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Keys returns all keys in the storage in ascending order
+func (s *OrderedInMemoryStorage) Keys() ([]types.Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	keys := make([]types.Key, 0, s.length)
+	for node := s.head.next[0]; node != nil; node = node.next[0] {
+		if !s.expired(node.entry) {
+			keys = append(keys, node.entry.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Range returns the entries with keys in [start, end) in ascending key
+// order. An empty end means no upper bound and a limit of zero or less
+// means no limit.
+func (s *OrderedInMemoryStorage) Range(start, end types.Key, limit int) ([]types.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	var entries []types.Entry
+	for node := s.seek(start); node != nil; node = node.next[0] {
+		if end != "" && node.entry.Key >= end {
+			break
+		}
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		if !s.expired(node.entry) {
+			entries = append(entries, *node.entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// KeysWithPrefix returns the keys starting with prefix in ascending order
+func (s *OrderedInMemoryStorage) KeysWithPrefix(prefix types.Key) ([]types.Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	var keys []types.Key
+	for node := s.seek(prefix); node != nil; node = node.next[0] {
+		if !strings.HasPrefix(string(node.entry.Key), string(prefix)) {
+			break
+		}
+		if !s.expired(node.entry) {
+			keys = append(keys, node.entry.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Close closes the storage and releases its data. Every later operation
+// returns types.ErrDatabaseClosed; closing again is a no-op.
+func (s *OrderedInMemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.reset()
+	return nil
+}
+
+// IsClosed returns true if the storage is closed
+func (s *OrderedInMemoryStorage) IsClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closed
+}
+
+// SetTTLEnabled turns expiry on or off. While it is off every entry is
+// kept and read as if it had no TTL; expiry times stay stored, and entries
+// past theirs expire once it is turned back on.
+func (s *OrderedInMemoryStorage) SetTTLEnabled(enabled bool) {
+	s.ttlDisabled.Store(!enabled)
+}
+
+// expired reports whether entry has expired, which it never has while
+// expiry is off
+func (s *OrderedInMemoryStorage) expired(entry *types.Entry) bool {
+	return !s.ttlDisabled.Load() && entry.IsExpired()
+}
+
+// SetExpiryCallback registers fn to be called with the key and value of
+// every entry removed because it expired, whether by a read or
+// CleanupExpired. Each removal calls it once. It runs with the storage
+// lock held, so it must return quickly and not use the storage; pass nil
+// to remove it.
+func (s *OrderedInMemoryStorage) SetExpiryCallback(fn func(key types.Key, value types.Value)) {
+	s.onExpire.set(fn)
+}
+
+// CleanupExpired removes all expired entries
+func (s *OrderedInMemoryStorage) CleanupExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0
+	}
+
+	var expired []*types.Entry
+	for node := s.head.next[0]; node != nil; node = node.next[0] {
+		if s.expired(node.entry) {
+			expired = append(expired, node.entry)
+		}
+	}
+	for _, entry := range expired {
+		s.remove(entry.Key)
+		s.onExpire.notify(entry)
+	}
+
+	return len(expired)
+}
+
+// Stats returns the storage's read, write and delete counts
+func (s *OrderedInMemoryStorage) Stats() types.StorageStats {
+	var stats types.StorageStats
+	s.counters.addTo(&stats)
+	return stats
+}
+
+// GetMemoryUsage returns approximate memory usage in bytes
+func (s *OrderedInMemoryStorage) GetMemoryUsage() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.usage
+}
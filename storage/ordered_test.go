@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderedInMemoryStorageMatchesMap(t *testing.T) {
+	orderedStorage := storage.NewOrderedInMemoryStorage()
+	defer orderedStorage.Close()
+
+	// Apply the same random writes to the skip list and a plain map
+	model := make(map[types.Key]types.Value)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := types.Key(fmt.Sprintf("key-%04d", rng.Intn(1000)))
+		if rng.Intn(3) == 0 {
+			require.NoError(t, orderedStorage.Delete(key))
+			delete(model, key)
+			continue
+		}
+		value := types.Value(fmt.Sprintf("value-%d", i))
+		require.NoError(t, orderedStorage.Set(key, value))
+		model[key] = value
+	}
+
+	var expected []types.Key
+	for key := range model {
+		expected = append(expected, key)
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+
+	keys, err := orderedStorage.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, expected, keys)
+
+	size, err := orderedStorage.Size()
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(model)), size)
+
+	for key, value := range model {
+		got, err := orderedStorage.Get(key)
+		require.NoError(t, err)
+		assert.Equal(t, value, got)
+	}
+
+	// Ranges return the same keys as filtering the sorted model
+	entries, err := orderedStorage.Range("key-0200", "key-0300", 0)
+	require.NoError(t, err)
+	var inRange []types.Key
+	for _, key := range expected {
+		if key >= "key-0200" && key < "key-0300" {
+			inRange = append(inRange, key)
+		}
+	}
+	require.Len(t, entries, len(inRange))
+	for i, entry := range entries {
+		assert.Equal(t, inRange[i], entry.Key)
+		assert.Equal(t, model[entry.Key], entry.Value)
+	}
+
+	entries, err = orderedStorage.Range("", "", 5)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	assert.Equal(t, expected[0], entries[0].Key)
+
+	// Memory usage drops back to zero once everything is removed
+	require.NoError(t, orderedStorage.BatchDelete(expected))
+	assert.Equal(t, int64(0), orderedStorage.GetMemoryUsage())
+}
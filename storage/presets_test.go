@@ -0,0 +1,140 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/vfs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// presetConfig returns the preset with its data in dataDir
+func presetConfig(preset func() types.Config, dataDir string) types.Config {
+	config := preset()
+	config.DataDirectory = dataDir
+	return config
+}
+
+// powerFailAfter runs the first n crashOps under config and cuts the power
+func powerFailAfter(t *testing.T, config types.Config, n int) {
+	fsys := vfs.NewFaultFS(vfs.OS)
+	diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+	require.NoError(t, err)
+	for _, op := range crashOps[:n] {
+		require.NoError(t, op.run(diskStorage), op.name)
+	}
+	require.NoError(t, fsys.PowerFailure())
+}
+
+// dataFileSize returns the size of the data file in dataDir
+func dataFileSize(t *testing.T, dataDir string) int64 {
+	info, err := os.Stat(filepath.Join(dataDir, "data.db"))
+	require.NoError(t, err)
+	return info.Size()
+}
+
+// writeBuffered writes a few keys and checks none of them reached the data
+// file. Batches flush the buffer on their own, so only single writes are
+// made.
+func writeBuffered(t *testing.T, diskStorage *storage.DiskStorage, dataDir string) {
+	before := dataFileSize(t, dataDir)
+	for _, key := range []types.Key{"a", "b", "c"} {
+		require.NoError(t, diskStorage.Set(key, types.Value("value")))
+	}
+	require.NoError(t, diskStorage.Delete("b"))
+	assert.Equal(t, before, dataFileSize(t, dataDir), "data file writes are buffered")
+}
+
+func TestDurableConfig(t *testing.T) {
+	t.Run("PowerFailure", func(t *testing.T) {
+		for acked := 0; acked <= len(crashOps); acked++ {
+			config := presetConfig(types.DurableConfig, t.TempDir())
+			powerFailAfter(t, config, acked)
+
+			// The data file holds every acknowledged write by itself, so
+			// nothing depends on replaying the WAL
+			withoutWAL := config
+			withoutWAL.WALEnabled = false
+			assert.Equal(t, crashState(acked), readCrashState(t, withoutWAL), "data file after power failure after %d operations", acked)
+			assert.Equal(t, crashState(acked), readCrashState(t, config), "power failure after %d operations", acked)
+		}
+	})
+
+	t.Run("CrashMidWrite", func(t *testing.T) {
+		fsys := vfs.NewFaultFS(vfs.OS)
+		diskStorage, err := storage.NewDiskStorageWithFS(presetConfig(types.DurableConfig, t.TempDir()), fsys)
+		require.NoError(t, err)
+		start := fsys.Writes()
+		require.Equal(t, len(crashOps), runCrashOps(diskStorage))
+		totalWrites := fsys.Writes() - start
+		require.NoError(t, diskStorage.Close())
+
+		for write := 0; write < totalWrites; write++ {
+			config := presetConfig(types.DurableConfig, t.TempDir())
+			fsys := vfs.NewFaultFS(vfs.OS)
+			diskStorage, err := storage.NewDiskStorageWithFS(config, fsys)
+			require.NoError(t, err)
+
+			fsys.InjectWriteFault(vfs.WriteFault{After: write, Err: vfs.ErrCrashed, Torn: true, Crash: true})
+			acked := runCrashOps(diskStorage)
+			require.NoError(t, fsys.Crash())
+
+			state := readCrashState(t, config)
+			if acked < len(crashOps) && assert.ObjectsAreEqual(crashState(acked+1), state) {
+				continue // The interrupted operation reached disk in full
+			}
+			assert.Equal(t, crashState(acked), state, "crash at write %d after %d acknowledged operations", write, acked)
+		}
+	})
+}
+
+func TestBalancedConfig(t *testing.T) {
+	// Every acknowledged write survives a power failure through the WAL
+	for acked := 0; acked <= len(crashOps); acked++ {
+		config := presetConfig(types.BalancedConfig, t.TempDir())
+		powerFailAfter(t, config, acked)
+		assert.Equal(t, crashState(acked), readCrashState(t, config), "power failure after %d operations", acked)
+	}
+
+	// while the data file is left to catch up
+	dir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorageWithConfig(presetConfig(types.BalancedConfig, dir))
+	require.NoError(t, err)
+	before := dataFileSize(t, dir)
+	writeBuffered(t, diskStorage, dir)
+	require.NoError(t, diskStorage.Sync())
+	assert.Greater(t, dataFileSize(t, dir), before)
+	require.NoError(t, diskStorage.Close())
+}
+
+func TestFastConfig(t *testing.T) {
+	// A power failure can lose acknowledged writes, but what survives is a
+	// consistent prefix of them
+	for acked := 0; acked <= len(crashOps); acked++ {
+		config := presetConfig(types.FastConfig, t.TempDir())
+		powerFailAfter(t, config, acked)
+
+		state := readCrashState(t, config)
+		matched := false
+		for n := 0; n <= acked; n++ {
+			if assert.ObjectsAreEqual(crashState(n), state) {
+				matched = true
+				break
+			}
+		}
+		assert.True(t, matched, "state %v after %d acknowledged operations is not a prefix of the workload", state, acked)
+	}
+
+	// Data file writes are buffered, and a clean close keeps everything
+	dir := t.TempDir()
+	config := presetConfig(types.FastConfig, dir)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	writeBuffered(t, diskStorage, dir)
+	require.NoError(t, diskStorage.Close())
+	assert.Equal(t, map[types.Key]string{"a": "value", "c": "value"}, readCrashState(t, config))
+}
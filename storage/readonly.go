@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"database_engine/types"
+	"fmt"
+)
+
+// errOpenedReadOnly is returned by writes to storage opened with
+// Config.ReadOnly
+var errOpenedReadOnly = fmt.Errorf("%w: opened read-only", types.ErrReadOnly)
+
+// checkReadOnly rejects configs that would make read-only storage write:
+// opening with a WAL replays and checkpoints it
+func checkReadOnly(config types.Config) error {
+	if config.ReadOnly && config.WALEnabled {
+		return fmt.Errorf("read-only storage can't use a WAL")
+	}
+	return nil
+}
+
+// closeReadOnly closes storage opened with Config.ReadOnly, which has
+// nothing to flush. The caller holds appendMu and mu.
+func (s *DiskStorage) closeReadOnly() error {
+	s.readGen.release()
+	return s.dataFile.Close()
+}
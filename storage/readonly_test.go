@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"database_engine/storage"
+	"database_engine/types"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dirContents returns the names and contents of the files in dir
+func dirContents(t *testing.T, dir string) map[string]string {
+	contents := make(map[string]string)
+	require.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		contents[path] = string(data)
+		return err
+	}))
+	return contents
+}
+
+func TestDiskStorageReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	config := diskTestConfig(dir)
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", types.Value("value")))
+	require.NoError(t, diskStorage.SetWithExpiry("expired", types.Value("gone"), 0, time.Now().Add(-time.Second)))
+	require.NoError(t, diskStorage.Close())
+
+	// Without index.db the index is rebuilt, but only in memory
+	require.NoError(t, os.Remove(filepath.Join(dir, "index.db")))
+	before := dirContents(t, dir)
+
+	config.ReadOnly = true
+	readOnly, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+
+	value, err := readOnly.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+	_, err = readOnly.Get("expired")
+	assert.ErrorIs(t, err, types.ErrKeyExpired)
+
+	for name, write := range map[string]func() error{
+		"Set":     func() error { return readOnly.Set("new", types.Value("value")) },
+		"Delete":  func() error { return readOnly.Delete("key") },
+		"Clear":   readOnly.Clear,
+		"Compact": readOnly.Compact,
+		"BatchSet": func() error {
+			return readOnly.BatchSet([]types.Entry{{Key: "a", Value: types.Value("b")}})
+		},
+	} {
+		err := write()
+		assert.ErrorIs(t, err, types.ErrReadOnly, name)
+	}
+	assert.Zero(t, readOnly.CleanupExpired())
+	require.NoError(t, readOnly.Close())
+
+	assert.Equal(t, before, dirContents(t, dir))
+}
+
+func TestDiskStorageReadOnlyNeedsData(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	config := diskTestConfig(dir, withReadOnly)
+
+	_, err := storage.NewDiskStorageWithConfig(config)
+	assert.True(t, errors.Is(err, os.ErrNotExist), "got %v", err)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	config.DataDirectory = t.TempDir()
+	config.WALEnabled = true
+	_, err = storage.NewDiskStorageWithConfig(config)
+	assert.ErrorContains(t, err, "read-only storage can't use a WAL")
+}
+
+func TestDiskStorageReadOnlyBesideWriter(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := storage.NewDiskStorageWithConfig(diskTestConfig(dir, withoutWriteBuffer))
+	require.NoError(t, err)
+	defer writer.Close()
+	require.NoError(t, writer.Set("key", types.Value("value")))
+	require.NoError(t, writer.Sync())
+
+	// Read-only storage doesn't take the directory lock
+	reader, err := storage.NewDiskStorageWithConfig(diskTestConfig(dir, withReadOnly))
+	require.NoError(t, err)
+	defer reader.Close()
+
+	value, err := reader.Get("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+}
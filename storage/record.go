@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"database_engine/types"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Data file format versions. Version 1 files have no header and store each
+// entry as a length-prefixed JSON document. Version 2 files start with
+// fileHeaderSize bytes (dataFileMagic followed by the version) and store
+// length-prefixed binary records.
+const (
+	formatVersionJSON   uint32 = 1
+	formatVersionBinary uint32 = 2
+
+	currentFormatVersion = formatVersionBinary
+
+	fileHeaderSize = 8
+)
+
+// dataFileMagic identifies a versioned data file. Read as a little-endian
+// length prefix it would announce a ~1.1GB legacy record, so it can't be
+// confused with the start of a version 1 file.
+var dataFileMagic = [4]byte{'K', 'V', 'D', 'B'}
+
+// Record flags
+const (
+	recordFlagTTL       uint8 = 1 << iota // TTL field is present
+	recordFlagGzip                        // Value is gzip-compressed
+	recordFlagBlob                        // Value is a reference to a blob file
+	recordFlagTombstone                   // Key was deleted, the record has no value
+	recordFlagBatch                       // More records of the same batch follow
+	recordFlagExpiry                      // Expiry field is present
+	recordFlagVersion                     // Version field is present
+	recordFlagRevision                    // Created and revision fields are present
+)
+
+// Binary record layout (all integers little-endian):
+//
+//	flags     uint8
+//	timestamp int64   unix nanoseconds the entry was updated at
+//	ttl       int64   nanoseconds, only present when recordFlagTTL is set
+//	expiresAt int64   unix nanoseconds, only present when recordFlagExpiry
+//	                  is set; records without it that have a TTL expire
+//	                  that long after their timestamp
+//	version   uint64  only present when recordFlagVersion is set; records
+//	                  without it were written before entries had versions
+//	created   int64   unix nanoseconds, only present when recordFlagRevision
+//	                  is set; records without it were created at their
+//	                  timestamp as far as anyone can tell
+//	revision  uint64  only present when recordFlagRevision is set
+//	keyLen    uint32
+//	key       [keyLen]byte
+//	valueLen  uint32
+//	value     [valueLen]byte  compressed when recordFlagGzip is set, a
+//	                          blobRef when recordFlagBlob is set
+//	checksum  uint32  CRC-32C of everything above
+const recordFixedSize = 1 + 8 + 4 + 4 + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// maxRecordSize is the longest entry data a record holding a value of at most
+// maxValue bytes can have, in either format. Keys are no longer than values,
+// JSON records may escape every key byte as \u00XX and base64-encode the
+// value, and the optional fields fit in the remaining slack.
+func maxRecordSize(maxValue int) int64 {
+	return 6*int64(maxValue) + 4*(int64(maxValue)+2)/3 + 1024
+}
+
+// ErrCorruptRecord is returned when a data file record fails to decode or
+// its checksum doesn't match
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// encodeFileHeader returns the header written at the start of a data file
+func encodeFileHeader(version uint32) []byte {
+	header := make([]byte, fileHeaderSize)
+	copy(header, dataFileMagic[:])
+	binary.LittleEndian.PutUint32(header[4:], version)
+	return header
+}
+
+// decodeFileHeader returns the format version of a data file given its first
+// bytes. Files without the magic are legacy version 1 files.
+func decodeFileHeader(header []byte) (uint32, error) {
+	if len(header) < fileHeaderSize || [4]byte(header[:4]) != dataFileMagic {
+		return formatVersionJSON, nil
+	}
+
+	version := binary.LittleEndian.Uint32(header[4:])
+	if version != formatVersionBinary {
+		return 0, fmt.Errorf("unsupported data file format version %d", version)
+	}
+
+	return version, nil
+}
+
+// encodeEntry serializes an entry using the given format version. Legacy
+// JSON records are never compressed.
+func encodeEntry(entry *types.Entry, version uint32, compression compressionOptions) ([]byte, error) {
+	if version == formatVersionJSON {
+		return json.Marshal(entry)
+	}
+
+	value, compressed, err := compression.compressValue(entry.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress value: %w", err)
+	}
+
+	var flags uint8
+	if compressed {
+		flags |= recordFlagGzip
+	}
+
+	return encodeBinaryRecord(entry, value, flags), nil
+}
+
+// encodeBlobEntry serializes an entry whose value has been spilled to a blob file
+func encodeBlobEntry(entry *types.Entry, ref blobRef) []byte {
+	return encodeBinaryRecord(entry, ref.encode(), recordFlagBlob)
+}
+
+// encodeTombstone serializes a record marking key as deleted. Tombstones are
+// never referenced by the index; they let a scan of the data file tell a
+// deleted key from a live one.
+func encodeTombstone(key types.Key, timestamp time.Time) []byte {
+	return encodeBinaryRecord(&types.Entry{Key: key, UpdatedAt: timestamp}, nil, recordFlagTombstone)
+}
+
+// encodeBinaryRecord builds a binary record storing value, which may already
+// be compressed or be a blob reference as indicated by flags
+func encodeBinaryRecord(entry *types.Entry, value []byte, flags uint8) []byte {
+	size := recordFixedSize + len(entry.Key) + len(value)
+	if entry.TTL != nil {
+		flags |= recordFlagTTL
+		size += 8
+	}
+	expiresAt := entry.Expiry()
+	if !expiresAt.IsZero() {
+		flags |= recordFlagExpiry
+		size += 8
+	}
+	if entry.Version != 0 {
+		flags |= recordFlagVersion
+		size += 8
+	}
+	if entry.Revision != 0 {
+		flags |= recordFlagRevision
+		size += 16
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, flags)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.UpdatedAt.UnixNano()))
+	if entry.TTL != nil {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(*entry.TTL))
+	}
+	if !expiresAt.IsZero() {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(expiresAt.UnixNano()))
+	}
+	if entry.Version != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, entry.Version)
+	}
+	if entry.Revision != 0 {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(entry.CreatedAt.UnixNano()))
+		buf = binary.LittleEndian.AppendUint64(buf, entry.Revision)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(entry.Key)))
+	buf = append(buf, entry.Key...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+	buf = append(buf, value...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	return buf
+}
+
+// setBatched sets or clears recordFlagBatch on an encoded binary record
+func setBatched(data []byte, batched bool) {
+	if batched {
+		data[0] |= recordFlagBatch
+	} else {
+		data[0] &^= recordFlagBatch
+	}
+	body := data[:len(data)-4]
+	binary.LittleEndian.PutUint32(data[len(body):], crc32.Checksum(body, crcTable))
+}
+
+// decodedRecord is a decoded entry along with how its value was stored
+type decodedRecord struct {
+	entry       *types.Entry
+	storedValue int      // Size of the value as stored on disk
+	compressed  bool     // Value was stored compressed
+	blob        *blobRef // Blob holding the value; entry.Value is nil until resolved
+	tombstone   bool     // Record marks the key as deleted
+	batched     bool     // More records of the same batch follow
+}
+
+// decodeRecord deserializes a record, verifying its checksum before the
+// value is decompressed. A compressed value inflating past maxValue bytes
+// makes the record corrupt.
+func decodeRecord(data []byte, version uint32, maxValue int) (*decodedRecord, error) {
+	if version == formatVersionJSON {
+		var entry types.Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+		}
+		entry.ExpiresAt = entry.Expiry()
+		return &decodedRecord{entry: &entry, storedValue: len(entry.Value)}, nil
+	}
+
+	if len(data) < recordFixedSize {
+		return nil, fmt.Errorf("%w: record too short (%d bytes)", ErrCorruptRecord, len(data))
+	}
+
+	body := data[:len(data)-4]
+	expected := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if actual := crc32.Checksum(body, crcTable); actual != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch (expected %08x, got %08x)", ErrCorruptRecord, expected, actual)
+	}
+
+	r := recordReader{buf: body}
+	flags := r.uint8()
+	entry := &types.Entry{
+		UpdatedAt: time.Unix(0, int64(r.uint64())),
+	}
+	if flags&recordFlagTTL != 0 {
+		ttl := time.Duration(r.uint64())
+		entry.TTL = &ttl
+	}
+	if flags&recordFlagExpiry != 0 {
+		entry.ExpiresAt = time.Unix(0, int64(r.uint64()))
+	} else {
+		// Written before expiry times were stored
+		entry.ExpiresAt = entry.Expiry()
+	}
+	if flags&recordFlagVersion != 0 {
+		entry.Version = r.uint64()
+	}
+	if flags&recordFlagRevision != 0 {
+		entry.CreatedAt = time.Unix(0, int64(r.uint64()))
+		entry.Revision = r.uint64()
+	} else {
+		entry.CreatedAt = entry.UpdatedAt
+	}
+	entry.Key = types.Key(r.bytes(int(r.uint32())))
+	storedValue := int(r.uint32())
+	if storedValue > 0 {
+		entry.Value = types.Value(r.bytes(storedValue))
+	}
+
+	if r.err != nil || len(r.buf) != 0 {
+		return nil, fmt.Errorf("%w: malformed binary record", ErrCorruptRecord)
+	}
+
+	batched := flags&recordFlagBatch != 0
+	if flags&recordFlagTombstone != 0 {
+		return &decodedRecord{entry: entry, tombstone: true, batched: batched}, nil
+	}
+
+	if flags&recordFlagBlob != 0 {
+		ref, err := decodeBlobRef(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = nil
+		return &decodedRecord{entry: entry, storedValue: int(ref.size), blob: &ref, batched: batched}, nil
+	}
+
+	compressed := flags&recordFlagGzip != 0
+	if compressed {
+		value, err := decompressValue(entry.Value, maxValue)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to decompress value: %v", ErrCorruptRecord, err)
+		}
+		entry.Value = value
+	}
+
+	return &decodedRecord{entry: entry, storedValue: storedValue, compressed: compressed, batched: batched}, nil
+}
+
+// recordReader consumes fixed-size fields from a record, remembering the
+// first out-of-bounds read instead of panicking
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) next(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf) {
+		r.err = ErrCorruptRecord
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *recordReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *recordReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *recordReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *recordReader) bytes(n int) []byte {
+	if b := r.next(n); b != nil {
+		out := make([]byte, n)
+		copy(out, b)
+		return out
+	}
+	return nil
+}
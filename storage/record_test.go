@@ -0,0 +1,291 @@
+package storage_test
+
+import (
+	"crypto/rand"
+	"database_engine/storage"
+	"database_engine/types"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLegacyDataDir writes entries in the headerless JSON format used before
+// binary records were introduced
+func writeLegacyDataDir(t *testing.T, dir string, entries []types.Entry) {
+	t.Helper()
+
+	var data []byte
+	index := make(map[types.Key]int64)
+	for i := range entries {
+		record, err := json.Marshal(&entries[i])
+		require.NoError(t, err)
+
+		index[entries[i].Key] = int64(len(data))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(record)))
+		data = append(data, record...)
+	}
+
+	indexData, err := json.Marshal(index)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.db"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.db"), indexData, 0644))
+}
+
+func TestDiskStorageBinaryValues(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+
+	value := make([]byte, 1024)
+	_, err = rand.Read(value)
+	require.NoError(t, err)
+
+	require.NoError(t, diskStorage.Set("binary", value))
+	require.NoError(t, diskStorage.SetWithTTL("ttl", value, time.Hour))
+	require.NoError(t, diskStorage.Close())
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	retrieved, err := diskStorage.Get("binary")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value(value), retrieved)
+
+	retrieved, err = diskStorage.Get("ttl")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value(value), retrieved)
+
+	// Binary records carry no base64 or JSON overhead
+	stat, err := os.Stat(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Less(t, stat.Size(), int64(2*1024+200))
+}
+
+func TestDiskStorageLegacyJSONFormat(t *testing.T) {
+	tempDir := t.TempDir()
+	ttl := time.Hour
+	writeLegacyDataDir(t, tempDir, []types.Entry{
+		{Key: "legacy1", Value: []byte("value1"), UpdatedAt: time.Now()},
+		{Key: "legacy2", Value: []byte("value2"), UpdatedAt: time.Now(), TTL: &ttl},
+	})
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+
+	value, err := diskStorage.Get("legacy1")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value1"), value)
+
+	// New writes to a legacy file keep its encoding
+	require.NoError(t, diskStorage.Set("new", []byte("new-value")))
+	value, err = diskStorage.Get("new")
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("new-value"), value)
+
+	// Compaction migrates the file to the binary format
+	require.NoError(t, diskStorage.Compact())
+	require.NoError(t, diskStorage.Close())
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Equal(t, "KVDB", string(data[:4]))
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	values, err := diskStorage.BatchGet([]types.Key{"legacy1", "legacy2", "new"})
+	assert.NoError(t, err)
+	assert.Equal(t, types.Value("value1"), values["legacy1"])
+	assert.Equal(t, types.Value("value2"), values["legacy2"])
+	assert.Equal(t, types.Value("new-value"), values["new"])
+}
+
+func TestDiskStorageExpiry(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Records written before expiry times were stored carry only a TTL
+	then := time.Now().Add(-2 * time.Hour)
+	long, short := 3*time.Hour, time.Hour
+	writeLegacyDataDir(t, tempDir, []types.Entry{
+		{Key: "legacy", Value: []byte("value"), UpdatedAt: then, TTL: &long},
+		{Key: "expired", Value: []byte("value"), UpdatedAt: then, TTL: &short},
+	})
+
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.SetWithTTL("new", []byte("value"), time.Hour))
+	entry, err := diskStorage.GetEntry("new")
+	require.NoError(t, err)
+	expiresAt := entry.ExpiresAt
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Second)
+
+	// Compaction rewrites the legacy records with their expiry times
+	require.NoError(t, diskStorage.Compact())
+	require.NoError(t, diskStorage.Close())
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	entry, err = diskStorage.GetEntry("new")
+	require.NoError(t, err)
+	assert.True(t, expiresAt.Equal(entry.ExpiresAt))
+	entry, err = diskStorage.GetEntry("legacy")
+	require.NoError(t, err)
+	assert.True(t, then.Add(long).Equal(entry.ExpiresAt))
+	_, err = diskStorage.Get("expired")
+	assert.Error(t, err)
+}
+
+func TestDiskStorageRecordChecksum(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("checksummed-value")))
+	require.NoError(t, diskStorage.Close())
+
+	// Flip a byte inside the stored value
+	dataPath := filepath.Join(tempDir, "data.db")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[len(data)-6] ^= 0xff
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	_, err = diskStorage.Get("key")
+	assert.ErrorIs(t, err, storage.ErrCorruptRecord)
+}
+
+func TestDiskStorageRecordLengthBound(t *testing.T) {
+	tempDir := t.TempDir()
+	diskStorage, err := storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	require.NoError(t, diskStorage.Set("key", []byte("value")))
+	require.NoError(t, diskStorage.Close())
+
+	// Damage the length prefix of the only record, just past the file header
+	dataPath := filepath.Join(tempDir, "data.db")
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	binary.LittleEndian.PutUint32(data[8:], 0xfffffff0)
+	require.NoError(t, os.WriteFile(dataPath, data, 0644))
+
+	diskStorage, err = storage.NewDiskStorage(tempDir)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	_, err = diskStorage.Get("key")
+	assert.ErrorIs(t, err, storage.ErrCorruptRecord)
+}
+
+// TestDiskStorageOpensSchema1Fixture opens testdata/schema1, written before
+// entries had JSON tags: a legacy JSON data file, and a WAL with a batch and
+// a commit whose entries are keyed by Go field names
+func TestDiskStorageOpensSchema1Fixture(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"data.db", "index.db", types.WALFileName} {
+		data, err := os.ReadFile(filepath.Join("testdata", "schema1", name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, name), data, 0644))
+	}
+
+	config := types.DefaultConfig()
+	config.EnablePersistence = true
+	config.DataDirectory = tempDir
+	config.WALEnabled = true
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+
+	timestamp := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	expires := time.Date(2124, 4, 12, 7, 8, 9, 0, time.UTC)
+	check := func(key types.Key, value string, version uint64, expiring bool) {
+		t.Helper()
+		entry, err := diskStorage.GetEntry(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, types.Value(value), entry.Value, key)
+		assert.True(t, timestamp.Equal(entry.UpdatedAt), key)
+		assert.True(t, timestamp.Equal(entry.CreatedAt), key)
+		assert.Equal(t, version, entry.Version, key)
+		if expiring {
+			require.NotNil(t, entry.TTL, key)
+			assert.True(t, expires.Equal(entry.ExpiresAt), key)
+		} else {
+			assert.Nil(t, entry.TTL, key)
+			assert.True(t, entry.ExpiresAt.IsZero(), key)
+		}
+	}
+	check("expiring", "expiring value", 0, true)
+	check("versioned", "versioned value", 42, false)
+	check("batched", "batched value", 43, true)
+	check("plain", "rewritten", 44, false)
+	check("committed", "committed value", 45, false)
+	_, err = diskStorage.Get("binary")
+	assert.ErrorIs(t, err, types.ErrKeyNotFound)
+
+	// New records go into the same legacy file in the current schema, and
+	// both read back after a restart
+	require.NoError(t, diskStorage.Set("new", []byte("new value")))
+	require.NoError(t, diskStorage.Close())
+	data, err := os.ReadFile(filepath.Join(tempDir, "data.db"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"schema":3,"key":"new"`)
+
+	diskStorage, err = storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+	check("versioned", "versioned value", 42, false)
+	value, err := diskStorage.Get("new")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("new value"), value)
+}
+
+func TestEntryJSONSchema(t *testing.T) {
+	ttl := time.Minute
+	timestamp := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	created := timestamp.Add(-time.Hour)
+	entry := types.Entry{Key: "key", Value: []byte("value"), CreatedAt: created, UpdatedAt: timestamp, TTL: &ttl, ExpiresAt: timestamp.Add(ttl), Version: 7, Revision: 3}
+
+	data, err := json.Marshal(entry)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"schema":3,"key":"key","value":"dmFsdWU=","created_at":"2024-05-06T06:08:09Z",`+
+		`"updated_at":"2024-05-06T07:08:09Z","ttl":60000000000,"expires_at":"2024-05-06T07:09:09Z","version":7,"revision":3}`, string(data))
+	var decoded types.Entry
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, entry, decoded)
+
+	// A zero expiry is left out
+	data, err = json.Marshal(types.Entry{Key: "key", CreatedAt: timestamp, UpdatedAt: timestamp})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"schema":3,"key":"key","value":null,"created_at":"2024-05-06T07:08:09Z","updated_at":"2024-05-06T07:08:09Z"}`, string(data))
+
+	// Older schemas had a single timestamp, which the entry was both
+	// created and updated at, and no revision
+	entry.CreatedAt = timestamp
+	entry.Revision = 0
+	schema2 := `{"schema":2,"key":"key","value":"dmFsdWU=","timestamp":"2024-05-06T07:08:09Z",` +
+		`"ttl":60000000000,"expires_at":"2024-05-06T07:09:09Z","version":7}`
+	decoded = types.Entry{}
+	require.NoError(t, json.Unmarshal([]byte(schema2), &decoded))
+	assert.Equal(t, entry, decoded)
+
+	// Schema 1 used the Go field names
+	legacy := `{"Key":"key","Value":"dmFsdWU=","Timestamp":"2024-05-06T07:08:09Z","TTL":60000000000,` +
+		`"ExpiresAt":"2024-05-06T07:09:09Z","Version":7}`
+	decoded = types.Entry{}
+	require.NoError(t, json.Unmarshal([]byte(legacy), &decoded))
+	assert.Equal(t, entry, decoded)
+
+	assert.ErrorContains(t, json.Unmarshal([]byte(`{"schema":4,"key":"key"}`), &decoded), "schema version 4")
+}
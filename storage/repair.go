@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// quarantineDirName is the data directory subdirectory where Repair moves
+// the damaged original files
+const quarantineDirName = "quarantine"
+
+// RepairSummary describes what Repair salvaged from the data file
+type RepairSummary struct {
+	EntriesRecovered  int    `json:"entries_recovered"` // Live entries written to the new data file
+	EntriesSkipped    int    `json:"entries_skipped"`   // Readable records not carried over: superseded, deleted, expired or missing their blob
+	UnreadableRegions int    `json:"unreadable_regions"`
+	UnreadableBytes   int64  `json:"unreadable_bytes"`
+	BytesQuarantined  int64  `json:"bytes_quarantined"` // Size of the original files moved to QuarantineDir
+	QuarantineDir     string `json:"quarantine_dir"`
+}
+
+// Repair rebuilds the data file and index from every record in the data
+// file that still parses and passes its checksum. The last record written
+// for a key wins, tombstones delete the key and expired entries are dropped;
+// the saved index is ignored since it may be damaged too. The originals are
+// moved into a timestamped quarantine subdirectory rather than deleted.
+func (s *DiskStorage) Repair() (*RepairSummary, error) {
+	defer s.keys.lockAll()()
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	// The repaired file is at most as large as the current one
+	if err := s.checkWritable(0); err != nil {
+		return nil, err
+	}
+	if err := s.checkFreeSpace(s.nextOffset); err != nil {
+		return nil, err
+	}
+
+	// The scan reads every record from the data file
+	if err := s.flushWriter(); err != nil {
+		return nil, err
+	}
+
+	start := int64(0)
+	if s.formatVersion != formatVersionJSON {
+		start = fileHeaderSize
+	}
+
+	// Find the latest readable record of every key
+	latest := make(map[types.Key]scannedRecord)
+	validRecords := 0
+	regions := scanDataFile(s.readGen.file, start, s.nextOffset, s.formatVersion, s.maxValueSize, func(scanned scannedRecord) {
+		validRecords++
+		latest[scanned.record.entry.Key] = scanned
+	})
+
+	summary := &RepairSummary{UnreadableRegions: len(regions)}
+	for _, region := range regions {
+		summary.UnreadableBytes += region.Length
+	}
+
+	survivors := make([]scannedRecord, 0, len(latest))
+	for _, scanned := range latest {
+		if scanned.record.tombstone || s.expired(scanned.record.entry) {
+			continue
+		}
+		if scanned.record.blob != nil {
+			if _, err := s.blobs.read(*scanned.record.blob); err != nil {
+				continue
+			}
+		}
+		survivors = append(survivors, scanned)
+	}
+	sort.Slice(survivors, func(i, j int) bool {
+		return survivors[i].offset < survivors[j].offset
+	})
+
+	// Write the salvaged records to a new data file in the current format
+	dataPath := filepath.Join(s.dataDir, "data.db")
+	indexPath := filepath.Join(s.dataDir, "index.db")
+
+	newData := encodeFileHeader(currentFormatVersion)
+	newIndex := make(map[types.Key]int64, len(survivors))
+	newBlobs := newBlobStore(s.fs, s.dataDir, s.blobs.threshold)
+	for _, scanned := range survivors {
+		entry := scanned.record.entry
+
+		var entryData []byte
+		if scanned.record.blob != nil {
+			entryData = encodeBlobEntry(entry, *scanned.record.blob)
+			newBlobs.track(entry.Key, scanned.record.blob)
+		} else {
+			var ref *blobRef
+			var err error
+			entryData, ref, err = s.encodeRecord(entry, currentFormatVersion)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode entry %q: %w", entry.Key, err)
+			}
+			newBlobs.track(entry.Key, ref)
+		}
+
+		newIndex[entry.Key] = int64(len(newData))
+		newData = binary.LittleEndian.AppendUint32(newData, uint32(len(entryData)))
+		newData = append(newData, entryData...)
+	}
+	summary.EntriesRecovered = len(newIndex)
+	summary.EntriesSkipped = validRecords - summary.EntriesRecovered
+
+	indexData, err := encodeIndex(newIndex)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileSync(s.fs, dataPath+".repair", newData); err != nil {
+		return nil, fmt.Errorf("failed to write repaired data file: %w", err)
+	}
+	if err := writeFileSync(s.fs, indexPath+".repair", indexData); err != nil {
+		s.fs.Remove(dataPath + ".repair")
+		return nil, fmt.Errorf("failed to write repaired index: %w", err)
+	}
+
+	// The hint describes the damaged data file
+	if err := s.removeHint(); err != nil {
+		return nil, err
+	}
+
+	// Move the originals aside, then put the repaired files in their place
+	quarantineDir := filepath.Join(s.dataDir, quarantineDirName, time.Now().Format("20060102_150405.000000000"))
+	if err := s.fs.MkdirAll(quarantineDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	for _, name := range []string{"data.db", "index.db"} {
+		path := filepath.Join(s.dataDir, name)
+		if stat, err := s.fs.Stat(path); err == nil {
+			summary.BytesQuarantined += stat.Size()
+		}
+		if err := s.fs.Rename(path, filepath.Join(quarantineDir, name)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to quarantine %s: %w", name, err)
+		}
+	}
+	if err := s.fs.Rename(indexPath+".repair", indexPath); err != nil {
+		return nil, err
+	}
+	if err := s.fs.Rename(dataPath+".repair", dataPath); err != nil {
+		return nil, err
+	}
+	if err := vfs.SyncDir(s.fs, s.dataDir); err != nil {
+		return nil, err
+	}
+	summary.QuarantineDir = quarantineDir
+
+	if err := s.reopenDataFile(); err != nil {
+		return nil, err
+	}
+
+	// Update state. Blobs only the damaged records referenced are left for
+	// Compact to sweep.
+	s.index = newIndex
+	s.blobs = newBlobs
+	s.formatVersion = currentFormatVersion
+	s.nextOffset = int64(len(newData))
+	s.flushedOffset.Store(s.nextOffset)
+	s.indexDirty = false
+
+	return summary, nil
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"database_engine/types"
+	"database_engine/vfs"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"path/filepath"
+)
+
+// Snapshot is a consistent view of a DiskStorage's files at one point in
+// time, for backing it up while it stays open. OpenSnapshot holds the
+// write locks only to flush and fsync everything and capture the files;
+// writers carry on while the snapshot is read. The data file and WAL are
+// only ever appended to or replaced, so reading them up to their size at
+// the snapshot sees them as they were: the snapshot holds the data file's
+// generation and a descriptor of the WAL opened then. The index is copied
+// in memory, and the blobs it references are kept on disk until the
+// snapshot is closed.
+type Snapshot struct {
+	LSN   uint64         // Last WAL entry logged when the snapshot was taken, 0 without a WAL
+	Files []SnapshotFile // data.db, index.db, the WAL and the blobs, in that order
+
+	storage *DiskStorage
+	gen     *dataGeneration // nil once released
+	handles []vfs.File
+	blobs   []string // Pinned blob names
+	closed  bool
+}
+
+// SnapshotFile is one file of a Snapshot
+type SnapshotFile struct {
+	Name string // Slash-separated path within a backup: data.db, wal.log, blobs/<digest>
+	Size int64
+
+	open func() (io.ReadCloser, error)
+}
+
+// Open returns a reader of the file's contents at the snapshot
+func (f SnapshotFile) Open() (io.ReadCloser, error) {
+	return f.open()
+}
+
+// OpenSnapshot flushes and fsyncs the data file, index and WAL and returns
+// a snapshot of them, which the caller must close. It doesn't include the
+// hint file, which the index makes redundant.
+func (s *DiskStorage) OpenSnapshot() (snapshot *Snapshot, err error) {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+	if err := s.checkWritable(0); err != nil {
+		return nil, err
+	}
+
+	if err := s.sync(); err != nil {
+		return nil, err
+	}
+	if s.wal != nil {
+		if err := s.wal.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot = &Snapshot{storage: s}
+	defer func() {
+		if err != nil {
+			snapshot.closeHandles()
+		}
+	}()
+
+	snapshot.gen = s.readGen.acquire()
+	snapshot.addSection("data.db", snapshot.gen.file, s.nextOffset)
+
+	indexData, err := encodeIndex(s.index)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Files = append(snapshot.Files, SnapshotFile{
+		Name: "index.db",
+		Size: int64(len(indexData)),
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(indexData)), nil
+		},
+	})
+
+	if s.wal != nil {
+		snapshot.LSN = s.wal.LastLSN()
+		if err := snapshot.addFile(types.WALFileName, s.walPath, s.wal.GetSize()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Blobs are written before the records that reference them and never
+	// change, so the pinned files can be read whenever the backup gets to
+	// them
+	snapshot.blobs = s.blobs.pin()
+	for _, name := range snapshot.blobs {
+		blobPath := filepath.Join(s.blobs.dir, name)
+		info, err := s.fs.Stat(blobPath)
+		if err != nil {
+			s.blobs.unpin(snapshot.blobs)
+			return nil, err
+		}
+		snapshot.Files = append(snapshot.Files, SnapshotFile{
+			Name: path.Join(blobDirName, name),
+			Size: info.Size(),
+			open: func() (io.ReadCloser, error) {
+				return vfs.Open(s.fs, blobPath)
+			},
+		})
+	}
+
+	return snapshot, nil
+}
+
+// addFile opens the file at filePath and adds its first size bytes to the
+// snapshot as name
+func (snapshot *Snapshot) addFile(name, filePath string, size int64) error {
+	file, err := vfs.Open(snapshot.storage.fs, filePath)
+	if err != nil {
+		return err
+	}
+	snapshot.handles = append(snapshot.handles, file)
+	snapshot.addSection(name, file, size)
+	return nil
+}
+
+// addSection adds the first size bytes of file to the snapshot as name
+func (snapshot *Snapshot) addSection(name string, file vfs.File, size int64) {
+	snapshot.Files = append(snapshot.Files, SnapshotFile{
+		Name: name,
+		Size: size,
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(io.NewSectionReader(file, 0, size)), nil
+		},
+	})
+}
+
+// Close releases the snapshot's files. Blobs that lost their last
+// reference while it was open are removed with the next index save.
+func (snapshot *Snapshot) Close() error {
+	s := snapshot.storage
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if snapshot.closed {
+		return nil
+	}
+	snapshot.closed = true
+
+	s.blobs.unpin(snapshot.blobs)
+	return snapshot.closeHandles()
+}
+
+func (snapshot *Snapshot) closeHandles() error {
+	var errs []error
+	if snapshot.gen != nil {
+		errs = append(errs, snapshot.gen.release())
+		snapshot.gen = nil
+	}
+	for _, file := range snapshot.handles {
+		errs = append(errs, file.Close())
+	}
+	snapshot.handles = nil
+	return errors.Join(errs...)
+}
+
+// diskView is a read view of a DiskStorage. Like a Snapshot it copies the
+// index and holds the data file generation current when it was taken, so
+// the records the copy points at stay readable after compaction or Clear
+// replace the file, and it pins the blobs they reference.
+type diskView struct {
+	storage *DiskStorage
+	index   map[types.Key]int64
+	gen     *dataGeneration
+	end     int64
+	version uint32
+	blobs   []string
+	closed  bool // Guarded by storage.mu
+}
+
+// ReadView returns a view of the entries as they are now, which the caller
+// must close. Unlike OpenSnapshot it doesn't fsync anything, but it holds
+// a copy of the index, as much memory again as the index itself, for as
+// long as it is open.
+func (s *DiskStorage) ReadView() (types.ReadView, error) {
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	// The view reads buffered records from the file, so they must be in it
+	if err := s.flushWriter(); err != nil {
+		return nil, err
+	}
+
+	return &diskView{
+		storage: s,
+		index:   maps.Clone(s.index),
+		gen:     s.readGen.acquire(),
+		end:     s.nextOffset,
+		version: s.formatVersion,
+		blobs:   s.blobs.pin(),
+	}, nil
+}
+
+// GetEntry returns the entry key had when the view was taken
+func (v *diskView) GetEntry(key types.Key) (*types.Entry, error) {
+	s := v.storage
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed || v.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+
+	offset, exists := v.index[key]
+	if !exists {
+		return nil, types.ErrKeyNotFound
+	}
+	scanned, ok := readScannedRecord(v.gen.file, offset, v.end, v.version, v.storage.maxValueSize)
+	if !ok {
+		return nil, fmt.Errorf("failed to read record of %q at offset %d", key, offset)
+	}
+
+	entry := scanned.record.entry
+	if scanned.record.blob != nil {
+		value, err := s.blobs.read(*scanned.record.blob)
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = value
+	}
+	if s.expired(entry) {
+		return nil, types.ErrKeyExpired
+	}
+	return entry, nil
+}
+
+// Close releases the view's data file and blobs
+func (v *diskView) Close() error {
+	s := v.storage
+	s.appendMu.Lock()
+	defer s.appendMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+
+	s.blobs.unpin(v.blobs)
+	return v.gen.release()
+}
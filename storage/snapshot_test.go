@@ -0,0 +1,244 @@
+package storage_test
+
+import (
+	"bytes"
+	"database_engine/storage"
+	"database_engine/types"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readSnapshotFiles reads every file of snapshot, by name
+func readSnapshotFiles(t *testing.T, snapshot *storage.Snapshot) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	for _, file := range snapshot.Files {
+		r, err := file.Open()
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, r.Close())
+		require.NoError(t, err)
+		require.Len(t, data, int(file.Size), file.Name)
+		files[file.Name] = data
+	}
+	return files
+}
+
+func TestDiskStorageSnapshot(t *testing.T) {
+	tempDir := t.TempDir()
+	config := diskTestConfig(tempDir, withoutWriteBuffer, withBlobs, withWAL)
+	config.WriteBufferSize = 4096
+	diskStorage, err := storage.NewDiskStorageWithConfig(config)
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	blob := bytes.Repeat([]byte("b"), 2048)
+	require.NoError(t, diskStorage.Set("small", []byte("before")))
+	require.NoError(t, diskStorage.Set("large", blob))
+
+	snapshot, err := diskStorage.OpenSnapshot()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), snapshot.LSN)
+
+	var names []string
+	for _, file := range snapshot.Files {
+		names = append(names, file.Name)
+	}
+	require.Len(t, names, 4)
+	assert.Equal(t, []string{"data.db", "index.db", types.WALFileName}, names[:3])
+	assert.Equal(t, "blobs/", names[3][:6])
+
+	// Writes after the snapshot, including one dropping the only reference
+	// to the blob and a compaction replacing the data file, don't show
+	require.NoError(t, diskStorage.Set("small", []byte("after")))
+	require.NoError(t, diskStorage.Delete("large"))
+	require.NoError(t, diskStorage.Set("later", []byte("value")))
+	require.NoError(t, diskStorage.Compact())
+	require.NoError(t, diskStorage.Sync())
+
+	// Copied out, the snapshot opens as the storage was when it was taken
+	files := readSnapshotFiles(t, snapshot)
+	copyDir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(copyDir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, data, 0644))
+	}
+	report, err := storage.CheckIntegrity(copyDir)
+	require.NoError(t, err)
+	assert.True(t, report.Healthy(), report.Issues())
+	assert.Equal(t, 2, report.IndexEntries)
+
+	// The blob is only removed once the snapshot is closed and the index
+	// saved again
+	assert.Len(t, blobFiles(t, tempDir), 1)
+	require.NoError(t, snapshot.Close())
+	require.NoError(t, snapshot.Close())
+	require.NoError(t, diskStorage.Set("small", []byte("again")))
+	require.NoError(t, diskStorage.Sync())
+	assert.Empty(t, blobFiles(t, tempDir))
+
+	copyConfig := types.DefaultConfig()
+	copyConfig.EnablePersistence = true
+	copyConfig.DataDirectory = copyDir
+	copyStorage, err := storage.NewDiskStorageWithConfig(copyConfig)
+	require.NoError(t, err)
+	defer copyStorage.Close()
+
+	value, err := copyStorage.Get("small")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("before"), value)
+	value, err = copyStorage.Get("large")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value(blob), value)
+	_, err = copyStorage.Get("later")
+	assert.Equal(t, types.ErrKeyNotFound, err)
+}
+
+func TestDiskStorageViewHoldsDataGeneration(t *testing.T) {
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(t.TempDir(), withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key", []byte("before")))
+	first, refs := diskStorage.DataGeneration()
+	assert.Equal(t, int32(1), refs)
+
+	view, err := diskStorage.ReadView()
+	require.NoError(t, err)
+	_, refs = diskStorage.DataGeneration()
+	assert.Equal(t, int32(2), refs)
+
+	// Compaction starts a new generation, and the view keeps reading the
+	// one it holds
+	require.NoError(t, diskStorage.Set("key", []byte("after")))
+	require.NoError(t, diskStorage.Compact())
+	second, refs := diskStorage.DataGeneration()
+	assert.Equal(t, first+1, second)
+	assert.Equal(t, int32(1), refs)
+
+	entry, err := view.GetEntry("key")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("before"), entry.Value)
+	require.NoError(t, view.Close())
+	require.NoError(t, view.Close())
+}
+
+// TestDiskStorageViewsDuringCompactions reads every key through read views
+// and snapshots, slowly, while a writer rewrites them all, compacts and
+// clears over and over. Every view must see all keys from a single round
+// of writes, however many data files were swapped in meanwhile.
+func TestDiskStorageViewsDuringCompactions(t *testing.T) {
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(t.TempDir(), withoutWriteBuffer, withBlobs))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	const keys, rounds = 40, 30
+	key := func(i int) types.Key { return types.Key(fmt.Sprintf("key-%02d", i)) }
+	writeRound := func(round int) error {
+		entries := make([]types.Entry, keys)
+		for i := range entries {
+			value := []byte(fmt.Sprintf("round-%d", round))
+			if i%8 == 0 {
+				// Spilled to a blob
+				value = append(value, bytes.Repeat([]byte{'.'}, 2048)...)
+			}
+			entries[i] = types.Entry{Key: key(i), Value: value}
+		}
+		return diskStorage.BatchSet(entries)
+	}
+	require.NoError(t, writeRound(0))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for round := 1; round <= rounds; round++ {
+			if round%10 == 0 {
+				assert.NoError(t, diskStorage.Clear())
+			}
+			assert.NoError(t, writeRound(round))
+			assert.NoError(t, diskStorage.Compact())
+		}
+	}()
+
+	var spanned atomic.Int32
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				view, err := diskStorage.ReadView()
+				if !assert.NoError(t, err) {
+					return
+				}
+				before, _ := diskStorage.DataGeneration()
+				seen := make(map[string]int)
+				for i := 0; i < keys; i++ {
+					entry, err := view.GetEntry(key(i))
+					if errors.Is(err, types.ErrKeyNotFound) {
+						seen["<missing>"]++
+					} else if assert.NoError(t, err) {
+						seen[string(bytes.TrimRight(entry.Value, "."))]++
+					}
+					time.Sleep(100 * time.Microsecond)
+				}
+				if after, _ := diskStorage.DataGeneration(); after != before {
+					spanned.Add(1)
+				}
+				assert.Len(t, seen, 1, "view saw several rounds: %v", seen)
+				assert.NoError(t, view.Close())
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			snapshot, err := diskStorage.OpenSnapshot()
+			if !assert.NoError(t, err) {
+				return
+			}
+			data := snapshot.Files[0]
+			r, err := data.Open()
+			if assert.NoError(t, err) {
+				read, err := io.Copy(io.Discard, r)
+				assert.NoError(t, err)
+				assert.Equal(t, data.Size, read)
+				assert.NoError(t, r.Close())
+			}
+			assert.NoError(t, snapshot.Close())
+		}
+	}()
+	wg.Wait()
+
+	assert.NotZero(t, spanned.Load(), "no view was open across a compaction")
+	_, refs := diskStorage.DataGeneration()
+	assert.Equal(t, int32(1), refs, "a view or snapshot didn't release its generation")
+}
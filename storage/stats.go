@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"database_engine/types"
+	"sync/atomic"
+)
+
+// opCounters counts reads, writes and deletes. They are atomics so reads
+// under a read lock, or after it is released, can count without a write
+// lock. A nil opCounters counts nothing.
+type opCounters struct {
+	hits          atomic.Int64
+	misses        atomic.Int64
+	expiredOnRead atomic.Int64
+	writes        atomic.Int64
+	deletes       atomic.Int64
+}
+
+// read counts a read that returned err
+func (c *opCounters) read(err error) {
+	if c == nil {
+		return
+	}
+	switch err {
+	case nil:
+		c.hits.Add(1)
+	case types.ErrKeyExpired:
+		c.expiredOnRead.Add(1)
+		c.misses.Add(1)
+	case types.ErrKeyNotFound:
+		c.misses.Add(1)
+	}
+}
+
+// wrote counts n entries stored
+func (c *opCounters) wrote(n int) {
+	if c == nil {
+		return
+	}
+	c.writes.Add(int64(n))
+}
+
+// deleted counts n keys deleted
+func (c *opCounters) deleted(n int) {
+	if c == nil || n == 0 {
+		return
+	}
+	c.deletes.Add(int64(n))
+}
+
+// addTo adds the counters to stats
+func (c *opCounters) addTo(stats *types.StorageStats) {
+	if c == nil {
+		return
+	}
+	stats.Hits += c.hits.Load()
+	stats.Misses += c.misses.Load()
+	stats.ExpiredOnRead += c.expiredOnRead.Load()
+	stats.Writes += c.writes.Load()
+	stats.Deletes += c.deletes.Load()
+}
+
+// diskCounters counts the disk storage's reads of the data file and other
+// work beyond its operations. Each is dwarfed by the I/O it counts.
+type diskCounters struct {
+	reads       atomic.Int64
+	bytesRead   atomic.Int64
+	indexSaves  atomic.Int64
+	compactions atomic.Int64
+}
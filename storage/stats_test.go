@@ -0,0 +1,168 @@
+package storage_test
+
+import (
+	"database_engine/engine"
+	"database_engine/storage"
+	"database_engine/types"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageStats(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) metadataStorage{
+		"InMemory": func(*testing.T) metadataStorage { return storage.NewInMemoryStorage() },
+		"Ordered":  func(*testing.T) metadataStorage { return storage.NewOrderedInMemoryStorage() },
+		"Disk": func(t *testing.T) metadataStorage {
+			diskStorage, err := storage.NewDiskStorage(t.TempDir())
+			require.NoError(t, err)
+			return diskStorage
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			reporter := s.(types.StatsReporter)
+
+			require.NoError(t, s.Set("a", types.Value("1")))
+			require.NoError(t, s.BatchSet([]types.Entry{{Key: "b", Value: types.Value("2")}, {Key: "c", Value: types.Value("3")}}))
+			require.NoError(t, s.SetWithTTL("short", types.Value("4"), time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+
+			_, err := s.Get("a")
+			require.NoError(t, err)
+			_, err = s.Get("missing")
+			assert.ErrorIs(t, err, types.ErrKeyNotFound)
+			_, err = s.Get("short")
+			assert.ErrorIs(t, err, types.ErrKeyExpired)
+			_, err = s.BatchGet([]types.Key{"b", "c", "missing"})
+			require.NoError(t, err)
+
+			require.NoError(t, s.Delete("a"))
+			require.NoError(t, s.Delete("missing"))
+			require.NoError(t, s.BatchDelete([]types.Key{"b", "missing"}))
+
+			stats := reporter.Stats()
+			assert.Equal(t, int64(3), stats.Hits)
+			assert.Equal(t, int64(3), stats.Misses)
+			assert.Equal(t, int64(1), stats.ExpiredOnRead)
+			assert.Equal(t, int64(4), stats.Writes)
+			assert.Equal(t, int64(2), stats.Deletes)
+		})
+	}
+}
+
+func TestDiskStorageStats(t *testing.T) {
+	diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(t.TempDir(), withCache(1<<20)))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+
+	require.NoError(t, diskStorage.Set("key", types.Value("value")))
+	saves := diskStorage.Stats().IndexSaves
+
+	// The first read goes to the file, the second to the cache
+	for i := 0; i < 2; i++ {
+		_, err = diskStorage.Get("key")
+		require.NoError(t, err)
+	}
+	stats := diskStorage.Stats()
+	assert.Equal(t, int64(1), stats.DiskReads)
+	assert.Positive(t, stats.BytesRead)
+	assert.Equal(t, int64(1), stats.CacheHits)
+	assert.Equal(t, int64(1), stats.CacheMisses)
+	assert.Equal(t, int64(2), stats.Hits)
+
+	// Compaction writes a new index
+	require.NoError(t, diskStorage.Set("key", types.Value("second")))
+	require.NoError(t, diskStorage.Compact())
+	stats = diskStorage.Stats()
+	assert.Equal(t, int64(1), stats.Compactions)
+	assert.Greater(t, stats.IndexSaves, saves)
+}
+
+func TestInMemoryStorageEvictionStats(t *testing.T) {
+	memStorage := storage.NewInMemoryStorage()
+	defer memStorage.Close()
+	require.NoError(t, memStorage.SetMemoryLimit(400, "lru"))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, memStorage.Set(types.Key(fmt.Sprintf("key-%d", i)), make(types.Value, 50)))
+	}
+	stats := memStorage.Stats()
+	assert.Positive(t, stats.Evictions)
+	assert.Equal(t, memStorage.GetMemoryStats().Evictions, stats.Evictions)
+	assert.Equal(t, int64(10), stats.Writes)
+}
+
+// statsOverheadLimit is the share of a database read's time counting it
+// in the storage may take
+const statsOverheadLimit = 0.05
+
+// benchmarkStatsOverhead runs the loop of engine's BenchmarkGet on a
+// database over storage that counts its operations and on one over storage
+// that doesn't, opened by open, and fails if counting adds
+// statsOverheadLimit or more. The two take turns every statsOverheadChunk
+// reads so that both see the same noise from the rest of the machine.
+func benchmarkStatsOverhead(b *testing.B, open func(b *testing.B, stats bool) types.StorageEngine) {
+	const statsOverheadChunk = 1000
+	run := func(db *engine.Database, from, to int) time.Duration {
+		start := time.Now()
+		for i := from; i < to; i++ {
+			key := types.Key(fmt.Sprintf("key-%d", i%1000))
+			db.Get(key)
+		}
+		return time.Since(start)
+	}
+
+	var dbs [2]*engine.Database
+	for i, stats := range []bool{true, false} {
+		db, err := engine.NewWithStorage(open(b, stats), types.DefaultConfig())
+		require.NoError(b, err)
+		b.Cleanup(func() { db.Close() })
+		for j := 0; j < 1000; j++ {
+			key := types.Key(fmt.Sprintf("key-%d", j))
+			require.NoError(b, db.Set(key, types.Value(fmt.Sprintf("value-%d", j))))
+		}
+		dbs[i] = db
+	}
+
+	b.ResetTimer()
+	var elapsed [2]time.Duration
+	for from := 0; from < b.N; from += statsOverheadChunk {
+		to := min(from+statsOverheadChunk, b.N)
+		for i, db := range dbs {
+			elapsed[i] += run(db, from, to)
+		}
+	}
+	b.StopTimer()
+
+	overhead := float64(elapsed[0]-elapsed[1]) / float64(elapsed[1])
+	b.ReportMetric(overhead*100, "%overhead")
+	if b.N >= 100000 && overhead >= statsOverheadLimit {
+		b.Fatalf("counting operations added %.1f%% to Get", overhead*100)
+	}
+}
+
+func BenchmarkInMemoryGetStatsOverhead(b *testing.B) {
+	benchmarkStatsOverhead(b, func(b *testing.B, stats bool) types.StorageEngine {
+		memStorage := storage.NewInMemoryStorage()
+		if !stats {
+			memStorage.DisableStats()
+		}
+		return memStorage
+	})
+}
+
+func BenchmarkDiskGetStatsOverhead(b *testing.B) {
+	benchmarkStatsOverhead(b, func(b *testing.B, stats bool) types.StorageEngine {
+		diskStorage, err := storage.NewDiskStorageWithConfig(diskTestConfig(b.TempDir(), withCache(64<<20)))
+		require.NoError(b, err)
+		if !stats {
+			diskStorage.DisableStats()
+		}
+		return diskStorage
+	})
+}
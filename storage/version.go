@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"database_engine/types"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// versionClock hands out entry versions. A version is the time it was
+// handed out in unix nanoseconds, or one more than the last version if that
+// is later, so versions grow with every write and keep growing across
+// restarts even though only the versions replayed or read back are
+// remembered.
+type versionClock struct {
+	last atomic.Uint64
+}
+
+// next returns a version greater than every one handed out or observed
+func (c *versionClock) next() uint64 {
+	for {
+		last := c.last.Load()
+		version := max(last+1, uint64(time.Now().UnixNano()))
+		if c.last.CompareAndSwap(last, version) {
+			return version
+		}
+	}
+}
+
+// observe makes sure versions handed out from now on are greater than
+// version, one read back from disk or the WAL
+func (c *versionClock) observe(version uint64) {
+	for {
+		last := c.last.Load()
+		if version <= last || c.last.CompareAndSwap(last, version) {
+			return
+		}
+	}
+}
+
+// stamp gives entry a new version, unless it already has one because it is
+// being replayed or restored, in which case the clock learns of it
+func (c *versionClock) stamp(entry *types.Entry) {
+	if entry.Version != 0 {
+		c.observe(entry.Version)
+		return
+	}
+	entry.Version = c.next()
+}
+
+// revise fills in entry's CreatedAt and Revision as the write following
+// previous, the live entry it replaces, or nil if its key is new. An entry
+// that already has a revision, because it is being replayed or restored,
+// keeps it. An entry replacing one from before revisions were counts that
+// one as the key's first write.
+func revise(entry, previous *types.Entry) {
+	switch {
+	case entry.Revision != 0:
+	case previous == nil:
+		entry.CreatedAt = entry.UpdatedAt
+		entry.Revision = 1
+	default:
+		entry.CreatedAt = previous.CreatedAt
+		entry.Revision = max(previous.Revision, 1) + 1
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = entry.UpdatedAt
+	}
+}
+
+// checkVersion returns a types.ErrConflict if key is at current rather
+// than the expected version
+func checkVersion(key types.Key, expected, current uint64) error {
+	if current != expected {
+		return fmt.Errorf("%w: %q is at version %d, not %d", types.ErrConflict, key, current, expected)
+	}
+	return nil
+}
+
+// unversioned returns copies of entries without versions or revisions, so a
+// commit stamps them with new ones
+func unversioned(entries []types.Entry) []types.Entry {
+	copied := make([]types.Entry, len(entries))
+	for i, entry := range entries {
+		entry.Version = 0
+		entry.Revision = 0
+		copied[i] = entry
+	}
+	return copied
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"database_engine/types"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryViews tracks the open read views of an in-memory storage engine.
+// Views are copy-on-write: before a key is written or removed, the entry it
+// had is saved in every open view that hasn't saved one for it yet, so a
+// view costs memory only for the keys written while it is open and reads
+// the rest from the storage itself.
+type memoryViews struct {
+	mu    sync.Mutex
+	views map[*memoryView]struct{}
+	open  atomic.Int32 // len(views), so writers skip the lock when it is 0
+}
+
+// memoryView is the part of a read view that holds what the keys written
+// since it was taken looked like then
+type memoryView struct {
+	mu     sync.Mutex
+	before map[types.Key]*types.Entry // nil for keys that didn't exist
+}
+
+// add opens a view. The caller must hold every lock writers take, so no
+// write is half done when the view starts.
+func (v *memoryViews) add() *memoryView {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	view := &memoryView{before: make(map[types.Key]*types.Entry)}
+	if v.views == nil {
+		v.views = make(map[*memoryView]struct{})
+	}
+	v.views[view] = struct{}{}
+	v.open.Add(1)
+	return view
+}
+
+// remove closes a view; closing one twice does nothing
+func (v *memoryViews) remove(view *memoryView) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.views[view]; ok {
+		delete(v.views, view)
+		v.open.Add(-1)
+	}
+}
+
+// save records that key had entry, nil if it didn't exist, in the views
+// that don't already know what it had. Writers call it before changing the
+// key, holding the lock the views' readers take for it.
+func (v *memoryViews) save(key types.Key, entry *types.Entry) {
+	if v.open.Load() == 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for view := range v.views {
+		view.mu.Lock()
+		if _, saved := view.before[key]; !saved {
+			view.before[key] = entry
+		}
+		view.mu.Unlock()
+	}
+}
+
+// saved returns the entry key had when the view was taken, if it was
+// written since. The caller must hold the lock writers of key take.
+func (view *memoryView) saved(key types.Key) (*types.Entry, bool) {
+	view.mu.Lock()
+	defer view.mu.Unlock()
+
+	entry, ok := view.before[key]
+	return entry, ok
+}
+
+// viewEntry returns a copy of entry as a read view returns it: missing if
+// nil and expired if expired says so
+func viewEntry(entry *types.Entry, expired func(*types.Entry) bool) (*types.Entry, error) {
+	if entry == nil {
+		return nil, types.ErrKeyNotFound
+	}
+	if expired(entry) {
+		return nil, types.ErrKeyExpired
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+// inMemoryView is a read view of InMemoryStorage
+type inMemoryView struct {
+	storage *InMemoryStorage
+	view    *memoryView
+}
+
+// ReadView returns a view of the entries as they are now, which the caller
+// must close. Taking it locks every shard briefly; after that it only
+// holds the entries written while it is open.
+func (s *InMemoryStorage) ReadView() (types.ReadView, error) {
+	s.lockAll()
+	defer s.unlockAll()
+
+	if s.closed.Load() {
+		return nil, types.ErrDatabaseClosed
+	}
+	return &inMemoryView{storage: s, view: s.views.add()}, nil
+}
+
+// GetEntry returns the entry key had when the view was taken
+func (v *inMemoryView) GetEntry(key types.Key) (*types.Entry, error) {
+	s := v.storage
+	shard := s.shardFor(key)
+	shard.mu.RLock()
+	if s.closed.Load() {
+		shard.mu.RUnlock()
+		return nil, types.ErrDatabaseClosed
+	}
+	entry, saved := v.view.saved(key)
+	if !saved {
+		if e, exists := shard.data[key]; exists {
+			entry = e.entry
+		}
+	}
+	shard.mu.RUnlock()
+
+	return viewEntry(entry, s.expired)
+}
+
+// Close releases the view
+func (v *inMemoryView) Close() error {
+	v.storage.views.remove(v.view)
+	return nil
+}
+
+// orderedView is a read view of OrderedInMemoryStorage
+type orderedView struct {
+	storage *OrderedInMemoryStorage
+	view    *memoryView
+}
+
+// ReadView returns a view of the entries as they are now, which the caller
+// must close. It only holds the entries written while it is open.
+func (s *OrderedInMemoryStorage) ReadView() (types.ReadView, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, types.ErrDatabaseClosed
+	}
+	return &orderedView{storage: s, view: s.views.add()}, nil
+}
+
+// GetEntry returns the entry key had when the view was taken
+func (v *orderedView) GetEntry(key types.Key) (*types.Entry, error) {
+	s := v.storage
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, types.ErrDatabaseClosed
+	}
+	entry, saved := v.view.saved(key)
+	if !saved {
+		if node := s.find(key); node != nil {
+			entry = node.entry
+		}
+	}
+	s.mu.RUnlock()
+
+	return viewEntry(entry, s.expired)
+}
+
+// Close releases the view
+func (v *orderedView) Close() error {
+	v.storage.views.remove(v.view)
+	return nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"database_engine/vfs"
+	"io"
+)
+
+// writeBuffer collects appends to the data file. Unlike bufio.Writer it
+// keeps its contents when a flush fails, so the flush can be retried once
+// the cause (typically a full disk) is gone, and it can serve reads of
+// records that haven't reached the file yet.
+type writeBuffer struct {
+	file vfs.File
+	buf  []byte
+}
+
+func newWriteBuffer(file vfs.File, size int) *writeBuffer {
+	return &writeBuffer{file: file, buf: make([]byte, 0, size)}
+}
+
+// Buffered returns the number of bytes waiting to be flushed
+func (b *writeBuffer) Buffered() int {
+	return len(b.buf)
+}
+
+// Available returns the number of bytes that can be buffered before a flush
+func (b *writeBuffer) Available() int {
+	return cap(b.buf) - len(b.buf)
+}
+
+// Write buffers p, flushing first if it doesn't fit. Data larger than the
+// whole buffer is written straight to the file.
+func (b *writeBuffer) Write(p []byte) (int, error) {
+	if len(p) > b.Available() {
+		if err := b.Flush(); err != nil {
+			return 0, err
+		}
+		if len(p) > cap(b.buf) {
+			return b.file.Write(p)
+		}
+	}
+
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// Flush writes the buffered data to the file with a single write. If the
+// write fails the data stays buffered; removing whatever part of it reached
+// the file is up to the caller.
+func (b *writeBuffer) Flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	if _, err := b.file.Write(b.buf); err != nil {
+		return err
+	}
+	b.buf = b.buf[:0]
+
+	return nil
+}
+
+// ReadAt reads buffered data starting off bytes into the buffer
+func (b *writeBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Reset discards the buffered data and directs later flushes to file
+func (b *writeBuffer) Reset(file vfs.File) {
+	b.file = file
+	b.buf = b.buf[:0]
+}
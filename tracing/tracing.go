@@ -0,0 +1,118 @@
+// Package tracing creates OpenTelemetry spans for the operations of a
+// database. It is a module of its own, so only programs that trace pull in
+// the OpenTelemetry dependencies.
+package tracing
+
+import (
+	"context"
+	"database_engine/engine"
+	"database_engine/types"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope the spans are created under
+const tracerName = "database_engine/tracing"
+
+// Span attributes
+const (
+	dbSystem       = attribute.Key("db.system")
+	dbOperation    = attribute.Key("db.operation")
+	attrKey        = attribute.Key("database_engine.key")
+	attrKeys       = attribute.Key("database_engine.keys")
+	attrValueBytes = attribute.Key("database_engine.value_bytes")
+	attrStorage    = attribute.Key("database_engine.storage")
+	attrWAL        = attribute.Key("database_engine.wal")
+	attrFound      = attribute.Key("database_engine.found")
+)
+
+// Option configures a Hook
+type Option func(*Hook)
+
+// WithKeys records the key of single-key operations on their spans, as
+// database_engine.key. Keys are left out by default since they may hold
+// personal data.
+func WithKeys() Option {
+	return func(h *Hook) {
+		h.keys = true
+	}
+}
+
+// Hook is an engine.Hook creating a span for each operation, named after
+// it (database_engine.Get, database_engine.Backup...), with attributes for
+// the keys and value bytes involved, the storage backend and whether it
+// went through the WAL. A failed operation records its error and sets the
+// span's status to error. Gets set database_engine.found instead: a missing
+// key isn't a failure.
+//
+// Backups and restores are children of the span in the context they are
+// given. The other operations take no context yet, so their spans are
+// roots.
+type Hook struct {
+	tracer trace.Tracer
+	keys   bool
+}
+
+// spanKey is the context key a Hook keeps the span of an operation under,
+// so a hook added after it can't hide it
+type spanKey struct{ hook *Hook }
+
+// NewHook returns a hook creating spans with tracers from tp
+func NewHook(tp trace.TracerProvider, opts ...Option) *Hook {
+	h := &Hook{tracer: tp.Tracer(tracerName)}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Instrument adds a hook creating spans with tracers from tp to db
+func Instrument(db *engine.Database, tp trace.TracerProvider, opts ...Option) error {
+	return db.AddHook(NewHook(tp, opts...))
+}
+
+// BeforeOp starts the span of the operation
+func (h *Hook) BeforeOp(ctx context.Context, info engine.OpInfo) context.Context {
+	attrs := []attribute.KeyValue{
+		dbSystem.String("database_engine"),
+		dbOperation.String(info.Op),
+		attrStorage.String(info.Storage),
+		attrWAL.Bool(info.WAL),
+	}
+	if h.keys && info.Key != "" {
+		attrs = append(attrs, attrKey.String(string(info.Key)))
+	}
+	ctx, span := h.tracer.Start(ctx, "database_engine."+info.Op, trace.WithAttributes(attrs...))
+	return context.WithValue(ctx, spanKey{h}, span)
+}
+
+// AfterOp ends the span of the operation, recording the keys and bytes it
+// ended up on and its error
+func (h *Hook) AfterOp(ctx context.Context, info engine.OpInfo, err error) {
+	span, ok := ctx.Value(spanKey{h}).(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		attrKeys.Int(info.Keys),
+		attrValueBytes.Int(info.ValueSize),
+	)
+	if info.Op == "Get" && (err == nil || isNotFound(err)) {
+		span.SetAttributes(attrFound.Bool(err == nil))
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// isNotFound reports whether err is a Get finding no value for its key
+func isNotFound(err error) bool {
+	return errors.Is(err, types.ErrKeyNotFound) || errors.Is(err, types.ErrKeyExpired)
+}
@@ -0,0 +1,145 @@
+package tracing_test
+
+import (
+	"context"
+	"database_engine/engine"
+	"database_engine/tracing"
+	"database_engine/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newProvider returns a tracer provider exporting spans to an in-memory
+// exporter as soon as they end
+func newProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return tp, exporter
+}
+
+// attrs returns the attributes of span by key
+func attrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	values := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		values[kv.Key] = kv.Value
+	}
+	return values
+}
+
+func TestSpans(t *testing.T) {
+	tp, exporter := newProvider(t)
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+	require.NoError(t, tracing.Instrument(db, tp, tracing.WithKeys()))
+
+	require.NoError(t, db.Set("user:1", types.Value("alice")))
+	_, err := db.Get("user:1")
+	require.NoError(t, err)
+	_, err = db.Get("user:2")
+	require.Error(t, err)
+	require.NoError(t, db.BatchSet([]types.Entry{
+		{Key: "a", Value: types.Value("1")},
+		{Key: "b", Value: types.Value("22")},
+	}))
+	_, err = db.BatchGet([]types.Key{"a", "b"})
+	require.NoError(t, err)
+	require.NoError(t, db.BatchDelete([]types.Key{"a", "b"}))
+	require.Error(t, db.Compact())
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 7)
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+		assert.Equal(t, "database_engine/tracing", span.InstrumentationLibrary.Name)
+		assert.False(t, span.Parent.IsValid())
+	}
+	assert.Equal(t, []string{
+		"database_engine.Set",
+		"database_engine.Get",
+		"database_engine.Get",
+		"database_engine.BatchSet",
+		"database_engine.BatchGet",
+		"database_engine.BatchDelete",
+		"database_engine.Compact",
+	}, names)
+
+	set := attrs(spans[0])
+	assert.Equal(t, "database_engine", set["db.system"].AsString())
+	assert.Equal(t, "Set", set["db.operation"].AsString())
+	assert.Equal(t, "user:1", set["database_engine.key"].AsString())
+	assert.Equal(t, int64(1), set["database_engine.keys"].AsInt64())
+	assert.Equal(t, int64(5), set["database_engine.value_bytes"].AsInt64())
+	assert.Equal(t, "memory", set["database_engine.storage"].AsString())
+	assert.False(t, set["database_engine.wal"].AsBool())
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+
+	// A missing key is found false, not an error
+	assert.True(t, attrs(spans[1])["database_engine.found"].AsBool())
+	assert.Equal(t, int64(5), attrs(spans[1])["database_engine.value_bytes"].AsInt64())
+	assert.False(t, attrs(spans[2])["database_engine.found"].AsBool())
+	assert.Equal(t, codes.Unset, spans[2].Status.Code)
+	assert.Empty(t, spans[2].Events)
+
+	batch := attrs(spans[3])
+	assert.Equal(t, int64(2), batch["database_engine.keys"].AsInt64())
+	assert.Equal(t, int64(3), batch["database_engine.value_bytes"].AsInt64())
+	assert.NotContains(t, batch, attribute.Key("database_engine.key"))
+	assert.Equal(t, int64(3), attrs(spans[4])["database_engine.value_bytes"].AsInt64())
+
+	// In-memory storage can't compact
+	assert.Equal(t, codes.Error, spans[6].Status.Code)
+	require.Len(t, spans[6].Events, 1)
+	assert.Equal(t, "exception", spans[6].Events[0].Name)
+}
+
+func TestSpansWithoutKeys(t *testing.T) {
+	tp, exporter := newProvider(t)
+	db := engine.NewInMemoryDB()
+	defer db.Close()
+	require.NoError(t, tracing.Instrument(db, tp))
+
+	require.NoError(t, db.Set("user:1", types.Value("alice")))
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.NotContains(t, attrs(spans[0]), attribute.Key("database_engine.key"))
+}
+
+func TestSpansDiskBackupRestore(t *testing.T) {
+	tp, exporter := newProvider(t)
+	db, err := engine.Open(t.TempDir(), engine.WithWAL(0), engine.WithBackups())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, tracing.Instrument(db, tp))
+
+	require.NoError(t, db.Set("key", types.Value("value")))
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	metadata, err := db.CreateBackupContext(ctx, "traced", nil)
+	require.NoError(t, err)
+	require.NoError(t, db.RestoreFromBackupContext(ctx, metadata.Name, nil))
+	parent.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 4)
+	set, backup, restore := spans[0], spans[1], spans[2]
+	assert.Equal(t, "database_engine.Set", set.Name)
+	assert.Equal(t, "disk", attrs(set)["database_engine.storage"].AsString())
+	assert.True(t, attrs(set)["database_engine.wal"].AsBool())
+
+	// Backups and restores are children of the caller's span
+	assert.Equal(t, "database_engine.Backup", backup.Name)
+	assert.Equal(t, "database_engine.Restore", restore.Name)
+	for _, span := range []tracetest.SpanStub{backup, restore} {
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+		assert.Equal(t, parent.SpanContext().TraceID(), span.SpanContext.TraceID())
+		assert.Equal(t, "disk", attrs(span)["database_engine.storage"].AsString())
+		assert.True(t, attrs(span)["database_engine.wal"].AsBool())
+	}
+}
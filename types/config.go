@@ -0,0 +1,328 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrConfigImmutable is matched by an *ImmutableConfigError
+var ErrConfigImmutable = errors.New("config field can't change on an open database")
+
+// ImmutableConfigError is returned by SetConfig for a config changing fields
+// that are fixed once the database is open
+type ImmutableConfigError struct {
+	Fields []string // Names of the changed fields, in the order Config declares them
+}
+
+func (e *ImmutableConfigError) Error() string {
+	return fmt.Sprintf("%s can't change on an open database; reopen it with the new config", strings.Join(e.Fields, ", "))
+}
+
+// Is makes errors.Is(err, ErrConfigImmutable) true for an
+// *ImmutableConfigError
+func (e *ImmutableConfigError) Is(target error) bool {
+	return target == ErrConfigImmutable
+}
+
+// mutableConfigFields are the Config fields SetConfig changes on an open
+// database: limits the database checks on each call and settings of
+// components it can reconfigure, like the janitor and the access tracker.
+// The rest, such as paths, persistence, WAL and file format settings, are
+// read when storage is opened, so fields added to Config are fixed unless
+// listed here.
+var mutableConfigFields = map[string]bool{
+	"MaxMemorySize":               true,
+	"EvictionPolicy":              true,
+	"MaxKeySize":                  true,
+	"MaxValueSize":                true,
+	"AutoBackupBeforeDestructive": true,
+	"TrackAccessStats":            true,
+	"AccessStatsMaxKeys":          true,
+	"EnableLatencyTracking":       true,
+	"SlowOpThreshold":             true,
+	"EnableTTL":                   true,
+	"CleanupInterval":             true,
+	"TTLJitterFraction":           true,
+	"LogLevel":                    true,
+	"Logger":                      true,
+}
+
+// IsMutableConfigField reports whether SetConfig can change the Config field
+// with the Go name name on an open database
+func IsMutableConfigField(name string) bool {
+	return mutableConfigFields[name]
+}
+
+// ImmutableChanges returns the names of the fields fixed once a database is
+// open that differ between c and next
+func (c Config) ImmutableChanges(next Config) []string {
+	var changed []string
+	current, updated := reflect.ValueOf(c), reflect.ValueOf(next)
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Name
+		if !mutableConfigFields[name] && current.Field(i).Interface() != updated.Field(i).Interface() {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Config file formats, picked by the file's extension
+const (
+	ConfigFormatJSON = "json" // .json
+	ConfigFormatYAML = "yaml" // .yaml or .yml
+)
+
+// configFormat returns the format of the config file at path
+func configFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ConfigFormatJSON, nil
+	case ".yaml", ".yml":
+		return ConfigFormatYAML, nil
+	default:
+		return "", fmt.Errorf("unknown config file extension %q, expected .json, .yaml or .yml", filepath.Ext(path))
+	}
+}
+
+// LoadConfig reads a JSON or YAML config file, naming fields by the JSON tags
+// of Config, like "max_key_size" or "wal_sync_policy". Durations are strings
+// such as "5m" or "100ms" and file modes octal strings such as "0644" (or in
+// YAML plain octal numbers). Fields the file leaves out keep the values of
+// the preset its "profile" field names, or of DefaultConfig without one, so
+// a file can pick a preset and override a few of its settings. Fields
+// Config doesn't have are an error. The loaded config gets ApplyDefaults and
+// must pass Validate.
+func LoadConfig(path string) (Config, error) {
+	format, err := configFormat(path)
+	if err != nil {
+		return Config{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	config, err := ParseConfig(data, format)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig parses a config in format, one of ConfigFormatJSON and
+// ConfigFormatYAML, the way LoadConfig parses a file
+func ParseConfig(data []byte, format string) (Config, error) {
+	switch format {
+	case ConfigFormatJSON:
+	case ConfigFormatYAML:
+		// YAML goes through JSON, so both formats share one set of field
+		// names, value encodings and checks for unknown fields
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return Config{}, err
+		}
+		var err error
+		if data, err = json.Marshal(document); err != nil {
+			return Config{}, fmt.Errorf("config must be a mapping of field names to values: %w", err)
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown config format %q", format)
+	}
+
+	// The profile picks the preset the other fields override
+	var profile struct {
+		Profile string `json:"profile"`
+	}
+	base := DefaultConfig()
+	if err := json.Unmarshal(data, &profile); err == nil && profile.Profile != "" {
+		preset, err := ProfileConfig(profile.Profile)
+		if err != nil {
+			return Config{}, err
+		}
+		base = preset
+	}
+
+	file := newConfigFile(base)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(file); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			if typeErr.Field == "" {
+				return Config{}, errors.New("config must be a mapping of field names to values")
+			}
+			return Config{}, fmt.Errorf("%s must be %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return Config{}, err
+	}
+
+	config := Config(file.configFields)
+	config.ApplyDefaults()
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Save writes the config to path as JSON or YAML, by the extension, in the
+// form LoadConfig reads, so a running database can dump its effective
+// config with GetConfig().Save(path). Every field is written, including
+// those at their defaults.
+func (c Config) Save(path string) error {
+	format, err := configFormat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(newConfigFile(c), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if format == ConfigFormatYAML {
+		if data, err = jsonToYAML(data); err != nil {
+			return fmt.Errorf("failed to encode config: %w", err)
+		}
+	} else {
+		data = append(data, '\n')
+	}
+
+	if err := os.WriteFile(path, data, c.FilePermissions()); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// jsonToYAML rewrites a JSON document in YAML's block style, keeping the
+// order of its fields
+func jsonToYAML(data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	var unstyle func(node *yaml.Node)
+	unstyle = func(node *yaml.Node) {
+		node.Style = 0
+		for _, child := range node.Content {
+			unstyle(child)
+		}
+	}
+	unstyle(&document)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// configFields has Config's fields without its methods, for configFile to
+// embed
+type configFields Config
+
+// configFile is Config as it is stored in config files. Its fields shadow
+// the durations and file modes of the embedded config to encode them as
+// strings, and point into it so decoding fills it in.
+type configFile struct {
+	configFields
+	WALSyncPeriod          configDuration `json:"wal_sync_period"`
+	WALCheckpointInterval  configDuration `json:"wal_checkpoint_interval"`
+	CleanupInterval        configDuration `json:"cleanup_interval"`
+	SlowOpThreshold        configDuration `json:"slow_op_threshold"`
+	DiskUsageCheckInterval configDuration `json:"disk_usage_check_interval"`
+	StatsSnapshotInterval  configDuration `json:"stats_snapshot_interval"`
+	FileMode               configFileMode `json:"file_mode"`
+	DirMode                configFileMode `json:"dir_mode"`
+}
+
+// newConfigFile returns the file form of c
+func newConfigFile(c Config) *configFile {
+	file := &configFile{configFields: configFields(c)}
+	fields := &file.configFields
+	file.WALSyncPeriod = configDuration{"wal_sync_period", &fields.WALSyncPeriod}
+	file.WALCheckpointInterval = configDuration{"wal_checkpoint_interval", &fields.WALCheckpointInterval}
+	file.CleanupInterval = configDuration{"cleanup_interval", &fields.CleanupInterval}
+	file.SlowOpThreshold = configDuration{"slow_op_threshold", &fields.SlowOpThreshold}
+	file.DiskUsageCheckInterval = configDuration{"disk_usage_check_interval", &fields.DiskUsageCheckInterval}
+	file.StatsSnapshotInterval = configDuration{"stats_snapshot_interval", &fields.StatsSnapshotInterval}
+	file.FileMode = configFileMode{"file_mode", &fields.FileMode}
+	file.DirMode = configFileMode{"dir_mode", &fields.DirMode}
+	return file
+}
+
+// configDuration is a time.Duration field written as a string like "5m0s".
+// It carries the field's name because encoding/json doesn't add it to the
+// errors of UnmarshalJSON methods.
+type configDuration struct {
+	name  string
+	value *time.Duration
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.value.String())
+}
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("%s must be a duration string like \"5m\", got %s", d.name, data)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%s: %w", d.name, err)
+	}
+	*d.value = duration
+	return nil
+}
+
+// configFileMode is an os.FileMode field written as an octal string like
+// "0644"
+type configFileMode struct {
+	name  string
+	value *os.FileMode
+}
+
+func (m configFileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%04o", uint32(*m.value)))
+}
+
+func (m *configFileMode) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// YAML octal numbers arrive here as plain numbers
+		var mode uint32
+		if err := json.Unmarshal(data, &mode); err != nil {
+			return fmt.Errorf("%s must be an octal string like \"0644\", got %s", m.name, data)
+		}
+		*m.value = os.FileMode(mode)
+		return nil
+	}
+
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("%s must be octal like \"0644\", got %q", m.name, s)
+	}
+	*m.value = os.FileMode(mode)
+	return nil
+}
@@ -0,0 +1,343 @@
+package types_test
+
+import (
+	"database_engine/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	require.NoError(t, types.DefaultConfig().Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *types.Config)
+		want   string // Part of the error; empty if the config is valid
+	}{
+		{"MaxKeySize zero", func(c *types.Config) { c.MaxKeySize = 0 }, "MaxKeySize must be positive, got 0"},
+		{"MaxKeySize negative", func(c *types.Config) { c.MaxKeySize = -1 }, "MaxKeySize must be positive"},
+		{"MaxValueSize zero", func(c *types.Config) { c.MaxValueSize = 0 }, "MaxValueSize must be positive"},
+		{"MaxValueSize below MaxKeySize", func(c *types.Config) { c.MaxKeySize, c.MaxValueSize = 100, 10 }, "MaxValueSize 10 is smaller than MaxKeySize 100"},
+		{"MaxValueSize equal to MaxKeySize", func(c *types.Config) { c.MaxKeySize, c.MaxValueSize = 100, 100 }, ""},
+		{"EvictionPolicy unknown", func(c *types.Config) { c.EvictionPolicy = "fifo" }, `unknown EvictionPolicy "fifo"`},
+		{"EvictionPolicy reject", func(c *types.Config) { c.EvictionPolicy = types.EvictionReject }, ""},
+		{"MaxMemorySize zero disables the limit", func(c *types.Config) { c.MaxMemorySize = 0 }, ""},
+		{"WriteBufferSize negative", func(c *types.Config) { c.WriteBufferSize = -1 }, "WriteBufferSize can't be negative"},
+		{"ReadBufferSize negative", func(c *types.Config) { c.ReadBufferSize = -1 }, "ReadBufferSize can't be negative"},
+		{"InMemoryShards negative", func(c *types.Config) { c.InMemoryShards = -1 }, "InMemoryShards can't be negative"},
+		{"DataDirectory empty with persistence", func(c *types.Config) { c.EnablePersistence, c.DataDirectory = true, "" }, "DataDirectory must be set"},
+		{"DataDirectory empty without persistence", func(c *types.Config) { c.DataDirectory = "" }, ""},
+		{"MaxWALSize negative", func(c *types.Config) { c.MaxWALSize = -1 }, "MaxWALSize can't be negative"},
+		{"WALSyncPolicy unknown", func(c *types.Config) { c.WALSyncPolicy = "sometimes" }, `unknown WALSyncPolicy "sometimes"`},
+		{"WALSyncPeriod zero under interval", func(c *types.Config) { c.WALSyncPolicy, c.WALSyncPeriod = types.WALSyncInterval, 0 }, "WALSyncPeriod must be positive"},
+		{"WALSyncPeriod zero under always", func(c *types.Config) { c.WALSyncPeriod = 0 }, ""},
+		{"WALSyncEvery zero under everyN", func(c *types.Config) { c.WALSyncPolicy, c.WALSyncEvery = types.WALSyncEveryN, 0 }, "WALSyncEvery must be positive"},
+		{"WALRetainSegments negative", func(c *types.Config) { c.WALRetainSegments = -1 }, "WALRetainSegments can't be negative"},
+		{"WALCheckpointInterval negative", func(c *types.Config) { c.WALCheckpointInterval = -time.Second }, "WALCheckpointInterval can't be negative"},
+		{"IndexHintInterval negative", func(c *types.Config) { c.IndexHintInterval = -1 }, "IndexHintInterval can't be negative"},
+		{"MinFreeBytes negative", func(c *types.Config) { c.MinFreeBytes = -1 }, "MinFreeBytes can't be negative"},
+		{"Profile unknown", func(c *types.Config) { c.Profile = "safe" }, `unknown Profile "safe"`},
+		{"Profile empty", func(c *types.Config) { c.Profile = "" }, ""},
+		{"QuarantineRetain negative", func(c *types.Config) { c.QuarantineRetain = -1 }, "QuarantineRetain can't be negative"},
+		{"CacheSize negative", func(c *types.Config) { c.CacheSize = -1 }, "CacheSize can't be negative"},
+		{"ReadOnly without persistence", func(c *types.Config) { c.ReadOnly = true }, "ReadOnly needs EnablePersistence"},
+		{"ReadOnly with WAL", func(c *types.Config) { c.EnablePersistence, c.ReadOnly, c.WALEnabled = true, true, true }, "ReadOnly can't be combined with WALEnabled"},
+		{"ReadOnly with persistence", func(c *types.Config) { c.EnablePersistence, c.ReadOnly = true, true }, ""},
+		{"FileMode without owner access", func(c *types.Config) { c.FileMode = 0400 }, "invalid file mode"},
+		{"DirMode without owner access", func(c *types.Config) { c.DirMode = 0600 }, "invalid directory mode"},
+		{"Compression unknown", func(c *types.Config) { c.Compression = "zstd" }, `unknown Compression "zstd"`},
+		{"Compression gzip", func(c *types.Config) { c.Compression = types.CompressionGzip }, ""},
+		{"CompressionMinSize negative", func(c *types.Config) { c.CompressionMinSize = -1 }, "CompressionMinSize can't be negative"},
+		{"BlobThreshold negative", func(c *types.Config) { c.BlobThreshold = -1 }, "BlobThreshold can't be negative"},
+		{"AccessStatsMaxKeys negative", func(c *types.Config) { c.AccessStatsMaxKeys = -1 }, "AccessStatsMaxKeys can't be negative"},
+		{"CleanupInterval negative", func(c *types.Config) { c.CleanupInterval = -time.Second }, "CleanupInterval can't be negative"},
+		{"CleanupInterval zero disables cleanup", func(c *types.Config) { c.CleanupInterval = 0 }, ""},
+		{"TTLJitterFraction negative", func(c *types.Config) { c.TTLJitterFraction = -0.1 }, "TTLJitterFraction must be between 0 and 1"},
+		{"TTLJitterFraction above one", func(c *types.Config) { c.TTLJitterFraction = 1.5 }, "TTLJitterFraction must be between 0 and 1"},
+		{"DiskUsageWarnBytes negative", func(c *types.Config) { c.DiskUsageWarnBytes = -1 }, "DiskUsageWarnBytes can't be negative"},
+		{"DiskUsageWarnBytes above DiskUsageErrorBytes", func(c *types.Config) { c.DiskUsageWarnBytes, c.DiskUsageErrorBytes = 2, 1 }, "DiskUsageWarnBytes (2) can't be above DiskUsageErrorBytes (1)"},
+		{"DiskUsageErrorBytes alone", func(c *types.Config) { c.DiskUsageErrorBytes = 1 }, ""},
+		{"DiskUsageErrorFraction above one", func(c *types.Config) { c.DiskUsageErrorFraction = 1.5 }, "DiskUsageErrorFraction must be between 0 and 1"},
+		{"DiskUsageWarnFraction above DiskUsageErrorFraction", func(c *types.Config) { c.DiskUsageWarnFraction, c.DiskUsageErrorFraction = 0.9, 0.8 }, "DiskUsageWarnFraction (0.9) can't be above DiskUsageErrorFraction (0.8)"},
+		{"DiskUsageCheckInterval negative", func(c *types.Config) { c.DiskUsageCheckInterval = -time.Second }, "DiskUsageCheckInterval can't be negative"},
+		{"LogLevel unknown", func(c *types.Config) { c.LogLevel = "verbose" }, `unknown LogLevel "verbose"`},
+		{"LogLevel debug", func(c *types.Config) { c.LogLevel = types.LogLevelDebug }, ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			config := types.DefaultConfig()
+			test.modify(&config)
+			err := config.Validate()
+			if test.want == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidateListsEveryProblem(t *testing.T) {
+	config := types.DefaultConfig()
+	config.MaxKeySize = 0
+	config.LogLevel = "loud"
+	config.CleanupInterval = -time.Minute
+
+	err := config.Validate()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "MaxKeySize must be positive")
+	assert.ErrorContains(t, err, `unknown LogLevel "loud"`)
+	assert.ErrorContains(t, err, "CleanupInterval can't be negative")
+}
+
+func TestConfigApplyDefaults(t *testing.T) {
+	var config types.Config
+	config.ApplyDefaults()
+	require.NoError(t, config.Validate())
+
+	defaults := types.DefaultConfig()
+	assert.Equal(t, defaults.MaxKeySize, config.MaxKeySize)
+	assert.Equal(t, defaults.MaxValueSize, config.MaxValueSize)
+	assert.Equal(t, defaults.EvictionPolicy, config.EvictionPolicy)
+	assert.Equal(t, defaults.WALSyncPolicy, config.WALSyncPolicy)
+	assert.Equal(t, defaults.MaxWALSize, config.MaxWALSize)
+	assert.Equal(t, defaults.Compression, config.Compression)
+	assert.Equal(t, defaults.LogLevel, config.LogLevel)
+
+	// Zero values that turn something off stay zero
+	assert.Zero(t, config.MaxMemorySize)
+	assert.Zero(t, config.WriteBufferSize)
+	assert.Zero(t, config.CleanupInterval)
+	assert.Zero(t, config.BlobThreshold)
+
+	// and values that are set are kept, valid or not
+	config = types.Config{MaxKeySize: 16, MaxValueSize: -1}
+	config.ApplyDefaults()
+	assert.Equal(t, 16, config.MaxKeySize)
+	assert.Equal(t, -1, config.MaxValueSize)
+}
+
+func TestLoadConfigExamples(t *testing.T) {
+	config, err := types.LoadConfig(filepath.Join("..", "examples", "config.yaml"))
+	require.NoError(t, err)
+	assert.True(t, config.EnablePersistence)
+	assert.True(t, config.WALEnabled)
+	assert.Equal(t, types.WALSyncInterval, config.WALSyncPolicy)
+	assert.Equal(t, 100*time.Millisecond, config.WALSyncPeriod)
+	assert.Equal(t, 10*time.Minute, config.WALCheckpointInterval)
+	assert.Equal(t, int64(64<<20), config.MaxWALSize)
+	assert.Equal(t, types.CompressionGzip, config.Compression)
+	assert.Equal(t, os.FileMode(0640), config.FileMode)
+	assert.Equal(t, os.FileMode(0750), config.DirMode)
+	assert.Equal(t, time.Minute, config.CleanupInterval)
+	assert.Equal(t, 0.1, config.TTLJitterFraction)
+	assert.Equal(t, types.LogLevelWarn, config.LogLevel)
+	// Left out, so at its default
+	assert.Equal(t, types.DefaultConfig().WALSyncEvery, config.WALSyncEvery)
+
+	config, err = types.LoadConfig(filepath.Join("..", "examples", "config.json"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(256<<20), config.MaxMemorySize)
+	assert.Equal(t, types.EvictionLFU, config.EvictionPolicy)
+	assert.Equal(t, 128, config.InMemoryShards)
+	assert.True(t, config.TrackAccessStats)
+	assert.Equal(t, 50000, config.AccessStatsMaxKeys)
+	assert.Equal(t, 30*time.Second, config.CleanupInterval)
+	assert.False(t, config.EnablePersistence)
+
+	config, err = types.LoadConfig(filepath.Join("..", "examples", "durable.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, types.ProfileDurable, config.Profile)
+	assert.Equal(t, int64(16<<20), config.MaxWALSize)
+	assert.Equal(t, 5*time.Minute, config.WALCheckpointInterval)
+	// Left out, so from the preset
+	assert.True(t, config.SyncOnWrite)
+	assert.Zero(t, config.WriteBufferSize)
+}
+
+func TestConfigPresets(t *testing.T) {
+	presets := map[string]types.Config{
+		types.ProfileDefault:  types.DefaultConfig(),
+		types.ProfileDurable:  types.DurableConfig(),
+		types.ProfileBalanced: types.BalancedConfig(),
+		types.ProfileFast:     types.FastConfig(),
+	}
+	for profile, config := range presets {
+		assert.Equal(t, profile, config.Profile)
+		require.NoError(t, config.Validate(), profile)
+
+		// Fully populated, so ApplyDefaults has nothing to fill in
+		filled := config
+		filled.ApplyDefaults()
+		assert.Equal(t, config, filled, profile)
+
+		byName, err := types.ProfileConfig(profile)
+		require.NoError(t, err)
+		assert.Equal(t, config, byName, profile)
+	}
+	_, err := types.ProfileConfig("safe")
+	assert.ErrorContains(t, err, `unknown profile "safe"`)
+
+	durable, balanced, fast := presets[types.ProfileDurable], presets[types.ProfileBalanced], presets[types.ProfileFast]
+	for _, config := range []types.Config{durable, balanced, fast} {
+		assert.True(t, config.EnablePersistence)
+		assert.True(t, config.WALEnabled)
+	}
+	assert.Equal(t, types.WALSyncAlways, durable.WALSyncPolicy)
+	assert.True(t, durable.SyncOnWrite)
+	assert.Zero(t, durable.WriteBufferSize)
+	assert.Equal(t, types.WALSyncAlways, balanced.WALSyncPolicy)
+	assert.False(t, balanced.SyncOnWrite)
+	assert.Positive(t, balanced.WriteBufferSize)
+	assert.Equal(t, types.WALSyncInterval, fast.WALSyncPolicy)
+	assert.False(t, fast.SyncOnWrite)
+	assert.Greater(t, fast.WriteBufferSize, balanced.WriteBufferSize)
+
+	// Settings the presets don't mention stay at their defaults
+	assert.Equal(t, types.DefaultConfig().MaxKeySize, fast.MaxKeySize)
+	assert.Equal(t, types.DefaultConfig().QuarantineRetain, durable.QuarantineRetain)
+}
+
+func TestParseConfigProfile(t *testing.T) {
+	config, err := types.ParseConfig([]byte(`{"profile": "fast", "wal_sync_period": "250ms"}`), types.ConfigFormatJSON)
+	require.NoError(t, err)
+	expected := types.FastConfig()
+	expected.WALSyncPeriod = 250 * time.Millisecond
+	assert.Equal(t, expected, config)
+
+	// A config built from scratch saves an empty profile, which loads as
+	// the default config
+	config, err = types.ParseConfig([]byte(`{"profile": "", "max_key_size": 64}`), types.ConfigFormatJSON)
+	require.NoError(t, err)
+	assert.Empty(t, config.Profile)
+	assert.Equal(t, types.DefaultConfig().MaxValueSize, config.MaxValueSize)
+
+	_, err = types.ParseConfig([]byte("profile: safe\n"), types.ConfigFormatYAML)
+	assert.ErrorContains(t, err, `unknown profile "safe"`)
+}
+
+func TestConfigSaveRoundTrip(t *testing.T) {
+	config := types.DefaultConfig()
+	config.DataDirectory = "/var/lib/db"
+	config.WALSyncPolicy = types.WALSyncEveryN
+	config.WALCheckpointInterval = 90 * time.Second
+	config.FileMode = 0600
+	config.TTLJitterFraction = 0.25
+
+	for _, name := range []string{"config.json", "config.yaml", "config.yml"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			require.NoError(t, config.Save(path))
+
+			loaded, err := types.LoadConfig(path)
+			require.NoError(t, err)
+			assert.Equal(t, config, loaded)
+		})
+	}
+
+	// Durations and file modes are written the way people write them
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, config.Save(path))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"wal_checkpoint_interval": "1m30s"`)
+	assert.Contains(t, string(data), `"file_mode": "0600"`)
+}
+
+func TestParseConfigRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   string
+	}{
+		{"unknown JSON field", types.ConfigFormatJSON, `{"max_key_sise": 10}`, `unknown field "max_key_sise"`},
+		{"unknown YAML field", types.ConfigFormatYAML, "log_level: info\ncolour: blue\n", `unknown field "colour"`},
+		{"Go field name", types.ConfigFormatJSON, `{"MaxKeySize": 10}`, `unknown field "MaxKeySize"`},
+		{"duration as a number", types.ConfigFormatJSON, `{"cleanup_interval": 300}`, `cleanup_interval must be a duration string like "5m", got 300`},
+		{"malformed duration", types.ConfigFormatYAML, "wal_sync_period: 5 minutes\n", `wal_sync_period: time: unknown unit`},
+		{"non-octal file mode", types.ConfigFormatJSON, `{"file_mode": "0689"}`, `file_mode must be octal like "0644", got "0689"`},
+		{"wrong type", types.ConfigFormatJSON, `{"max_key_size": "big"}`, "max_key_size must be int, got string"},
+		{"invalid value", types.ConfigFormatYAML, "max_key_size: -1\nlog_level: loud\n", `MaxKeySize must be positive`},
+		{"not a mapping", types.ConfigFormatYAML, "- one\n- two\n", "config must be a mapping"},
+		{"malformed JSON", types.ConfigFormatJSON, `{"log_level": `, "unexpected EOF"},
+		{"unknown format", "toml", ``, `unknown config format "toml"`},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := types.ParseConfig([]byte(test.data), test.format)
+			assert.ErrorContains(t, err, test.want)
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := types.LoadConfig(filepath.Join(dir, "config.toml"))
+	assert.ErrorContains(t, err, `unknown config file extension ".toml"`)
+	assert.ErrorContains(t, types.DefaultConfig().Save(filepath.Join(dir, "config.ini")), `unknown config file extension ".ini"`)
+
+	_, err = types.LoadConfig(filepath.Join(dir, "missing.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Errors name the file and every invalid field
+	path := filepath.Join(dir, "bad.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("max_key_size: 0\nmax_value_size: -5\n"), 0644))
+	_, err = types.LoadConfig(path)
+	assert.ErrorContains(t, err, path)
+	assert.ErrorContains(t, err, "MaxValueSize must be positive")
+}
+
+func TestConfigImmutableChanges(t *testing.T) {
+	config := types.DefaultConfig()
+	assert.Empty(t, config.ImmutableChanges(config))
+
+	// Changing any one field is reported unless SetConfig can change it
+	fields := reflect.TypeOf(config)
+	mutable := 0
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Name
+		next := config
+		field := reflect.ValueOf(&next).Elem().Field(i)
+		switch field.Kind() {
+		case reflect.Bool:
+			field.SetBool(!field.Bool())
+		case reflect.String:
+			field.SetString(field.String() + "x")
+		case reflect.Int, reflect.Int64:
+			field.SetInt(field.Int() + 1)
+		case reflect.Uint32:
+			field.SetUint(field.Uint() + 1)
+		case reflect.Float64:
+			field.SetFloat(field.Float() + 0.5)
+		case reflect.Pointer:
+			field.Set(reflect.New(field.Type().Elem()))
+		default:
+			t.Fatalf("no way to change %s of kind %s", name, field.Kind())
+		}
+
+		if types.IsMutableConfigField(name) {
+			mutable++
+			assert.Empty(t, config.ImmutableChanges(next), name)
+		} else {
+			assert.Equal(t, []string{name}, config.ImmutableChanges(next), name)
+		}
+	}
+	assert.Equal(t, 14, mutable)
+	assert.False(t, types.IsMutableConfigField("NoSuchField"))
+
+	next := config
+	next.DataDirectory = "/elsewhere"
+	next.MaxKeySize = 10
+	next.WALEnabled = true
+	assert.Equal(t, []string{"DataDirectory", "WALEnabled"}, config.ImmutableChanges(next))
+}
@@ -0,0 +1,83 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OpError records the operation and key an error happened on. The database
+// returns errors wrapped in it, so errors.Is(err, ErrKeyNotFound) and the
+// like still match while logs show which key failed; storage engines return
+// the bare errors.
+type OpError struct {
+	Op  string // Method that failed, like "Get", "BatchSet" or "Tx.Get"
+	Key Key    // Key it failed on; empty for failures not about one key
+	Err error
+}
+
+func (e *OpError) Error() string {
+	if e.Key == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return fmt.Sprintf("%s %q: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// NewOpError wraps err in an *OpError for op on key, or returns nil if err
+// is nil. Errors that already carry an operation, an *OpError or a
+// *MultiError, are returned as they are.
+func NewOpError(op string, key Key, err error) error {
+	if err == nil {
+		return nil
+	}
+	var opErr *OpError
+	var multiErr *MultiError
+	if errors.As(err, &opErr) || errors.As(err, &multiErr) {
+		return err
+	}
+	return &OpError{Op: op, Key: key, Err: err}
+}
+
+// MultiError lists the keys a batch operation failed on, each with its own
+// error. errors.Is and errors.As match against every one of them.
+type MultiError struct {
+	Op     string     // Database method that failed
+	Errors []*OpError // One per failing key, in the order the keys were given
+}
+
+func (e *MultiError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		problems[i] = fmt.Sprintf("%q: %v", err.Key, err.Err)
+	}
+	noun := "keys"
+	if len(e.Errors) == 1 {
+		noun = "key"
+	}
+	return fmt.Sprintf("%s: %d %s failed: %s", e.Op, len(e.Errors), noun, strings.Join(problems, "; "))
+}
+
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Add records that op failed on key with err
+func (e *MultiError) Add(key Key, err error) {
+	e.Errors = append(e.Errors, &OpError{Op: e.Op, Key: key, Err: err})
+}
+
+// Err returns e, or nil if no key failed
+func (e *MultiError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
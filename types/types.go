@@ -1,7 +1,13 @@
 package types
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -11,38 +17,125 @@ type Key string
 // Value represents a database value
 type Value []byte
 
-// Entry represents a key-value pair with metadata
+// EntrySchemaVersion is the version of the JSON encoding of Entry, which
+// every encoded entry carries in its "schema" field. Entries without one are
+// schema 1, from before Entry had JSON tags, and are keyed by the Go field
+// names. Schema 2 entries have a single "timestamp" rather than created_at
+// and updated_at. Legacy data files and WAL batches store entries this way,
+// so changing the encoding means bumping the version and decoding the old
+// one.
+const EntrySchemaVersion = 3
+
+// Entry represents a key-value pair with metadata. In JSON the value is
+// base64 encoded, as encoding/json does for byte slices.
 type Entry struct {
-	Key       Key
-	Value     Value
-	Timestamp time.Time
-	TTL       *time.Duration // Optional time-to-live
+	Key       Key            `json:"key"`
+	Value     Value          `json:"value"`
+	CreatedAt time.Time      `json:"created_at"`         // When the key was first written, kept when it is overwritten
+	UpdatedAt time.Time      `json:"updated_at"`         // When this value was written
+	TTL       *time.Duration `json:"ttl,omitempty"`      // Optional time-to-live
+	ExpiresAt time.Time      `json:"expires_at"`         // When the entry expires, zero if it doesn't
+	Version   uint64         `json:"version,omitempty"`  // Grows with every write of the key, 0 if written before versions were
+	Revision  uint64         `json:"revision,omitempty"` // Number of times the key was written since it was created, 0 if written before revisions were
 }
 
-// IsExpired checks if the entry has expired based on TTL
-func (e *Entry) IsExpired() bool {
-	if e.TTL == nil {
-		return false
+// MarshalJSON encodes the entry in the current schema, leaving out a zero
+// ExpiresAt
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	if !e.ExpiresAt.IsZero() {
+		return json.Marshal(struct {
+			Schema int `json:"schema"`
+			entry
+		}{EntrySchemaVersion, entry(e)})
+	}
+	return json.Marshal(struct {
+		Schema int `json:"schema"`
+		entry
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}{Schema: EntrySchemaVersion, entry: entry(e)})
+}
+
+// UnmarshalJSON decodes an entry in the current schema or an older one.
+// encoding/json matches keys to fields case-insensitively, so the schema 1
+// names Key, Value, TTL and Version fill their tagged fields; only
+// ExpiresAt needs a field of its own. The timestamp of schemas 1 and 2
+// becomes both CreatedAt and UpdatedAt.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	type entry Entry
+	var decoded struct {
+		Schema int `json:"schema"`
+		entry
+		LegacyExpiresAt time.Time `json:"ExpiresAt"`
+		LegacyTimestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if decoded.Schema > EntrySchemaVersion {
+		return fmt.Errorf("unsupported entry schema version %d", decoded.Schema)
+	}
+
+	*e = Entry(decoded.entry)
+	if e.ExpiresAt.IsZero() {
+		e.ExpiresAt = decoded.LegacyExpiresAt
+	}
+	if e.UpdatedAt.IsZero() {
+		e.UpdatedAt = decoded.LegacyTimestamp
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = e.UpdatedAt
 	}
-	return time.Since(e.Timestamp) > *e.TTL
+	return nil
+}
+
+// Expiry returns when the entry expires, or the zero time if it doesn't.
+// Entries written before expiry times were stored only carry a TTL, and
+// expire that long after they were written.
+func (e *Entry) Expiry() time.Time {
+	if !e.ExpiresAt.IsZero() {
+		return e.ExpiresAt
+	}
+	if e.TTL != nil {
+		return e.UpdatedAt.Add(*e.TTL)
+	}
+	return time.Time{}
+}
+
+// IsExpired checks if the entry has passed its expiry time
+func (e *Entry) IsExpired() bool {
+	expiresAt := e.Expiry()
+	return !expiresAt.IsZero() && time.Now().After(expiresAt)
 }
 
 // Database errors
 var (
-	ErrKeyNotFound        = errors.New("key not found")
-	ErrKeyExpired         = errors.New("key has expired")
-	ErrInvalidKey         = errors.New("invalid key")
-	ErrInvalidValue       = errors.New("invalid value")
-	ErrDatabaseClosed     = errors.New("database is closed")
-	ErrTransactionAborted = errors.New("transaction aborted")
+	ErrKeyNotFound         = errors.New("key not found")
+	ErrKeyExpired          = errors.New("key has expired")
+	ErrInvalidKey          = errors.New("invalid key")
+	ErrInvalidValue        = errors.New("invalid value")
+	ErrDatabaseClosed      = errors.New("database is closed")
+	ErrTransactionAborted  = errors.New("transaction aborted")
+	ErrTransactionDone     = errors.New("transaction has already been committed or rolled back")
+	ErrTransactionExpired  = errors.New("transaction expired")
+	ErrSavepointNotFound   = errors.New("savepoint not found")
+	ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+	ErrReadOnly            = errors.New("storage is read-only after a write failure")
+	ErrTTLDisabled         = errors.New("TTL is disabled in the database config")
+	ErrConflict            = errors.New("key was written since the version expected")
 )
 
-// StorageEngine represents the interface for different storage engines
+// StorageEngine represents the interface for different storage engines.
+// Features only some engines have are optional capability interfaces
+// (TTLStorage, ExpiryStorage, EntryReader, SnapshotReader,
+// VersionedStorage, Expirer, TTLToggler, ExpiryNotifier, ExpiryScheduler,
+// ExpiredCleaner, Compacter, DiskUsager, HealthChecker, StatsReporter,
+// OrderedStorageEngine)
+// that the database checks for at run time.
 type StorageEngine interface {
 	// Basic operations
 	Get(key Key) (Value, error)
 	Set(key Key, value Value) error
-	SetWithTTL(key Key, value Value, ttl time.Duration) error
 	Delete(key Key) error
 	Exists(key Key) (bool, error)
 
@@ -61,6 +154,158 @@ type StorageEngine interface {
 	IsClosed() bool
 }
 
+// TTLStorage is implemented by storage engines that can expire entries
+type TTLStorage interface {
+	SetWithTTL(key Key, value Value, ttl time.Duration) error
+}
+
+// ExpiryStorage is implemented by storage engines that can store an entry
+// expiring at a given time rather than a TTL from now, so that replaying
+// or copying an entry doesn't extend its life
+type ExpiryStorage interface {
+	// SetWithExpiry stores a key-value pair that expires at expiresAt,
+	// recording ttl as the time-to-live it was written with
+	SetWithExpiry(key Key, value Value, ttl time.Duration, expiresAt time.Time) error
+}
+
+// EntryReader is implemented by storage engines that can return an entry
+// along with its timestamp and expiry, read together so they belong to the
+// same write
+type EntryReader interface {
+	// GetEntry returns the entry stored for key, failing like Get does
+	// when it is missing or expired
+	GetEntry(key Key) (*Entry, error)
+}
+
+// SnapshotReader is implemented by storage engines that can serve reads as
+// of one point in time while writes carry on, for transactions
+type SnapshotReader interface {
+	// ReadView returns a view of the entries stored now, which the caller
+	// must close
+	ReadView() (ReadView, error)
+}
+
+// ReadView is a storage engine's entries as they were at one point in time
+type ReadView interface {
+	// GetEntry returns the entry key had when the view was taken, failing
+	// with ErrKeyNotFound if it had none and ErrKeyExpired if it has
+	// expired since
+	GetEntry(key Key) (*Entry, error)
+	// Close releases what the view holds
+	Close() error
+}
+
+// VersionedStorage is implemented by storage engines that give every write
+// of an entry a new Entry.Version, for optimistic concurrency
+type VersionedStorage interface {
+	// CommitIfVersions stores sets and deletes deletes as a single write,
+	// provided every key in expected is still at the version given, 0
+	// meaning it doesn't exist or has expired. Otherwise nothing is
+	// written and it fails with ErrConflict. Versions in sets are ignored.
+	CommitIfVersions(expected map[Key]uint64, sets []Entry, deletes []Key) error
+}
+
+// Expirer is implemented by storage engines that can change how long many
+// stored entries live as a single write
+type Expirer interface {
+	// ExpireBatch gives each of keys that exists ttl to live from now,
+	// keeping its value, or deletes it if ttl <= 0. It returns the keys
+	// that weren't found; expired keys count as missing.
+	ExpireBatch(keys []Key, ttl time.Duration) (missing []Key, err error)
+}
+
+// TTLToggler is implemented by storage engines that can stop expiring
+// entries, for databases configured with EnableTTL off
+type TTLToggler interface {
+	// SetTTLEnabled turns expiry on or off. While it is off entries are
+	// kept and read as if they had no TTL.
+	SetTTLEnabled(enabled bool)
+}
+
+// ExpiryNotifier is implemented by storage engines that can report the
+// entries they remove because they expired
+type ExpiryNotifier interface {
+	// SetExpiryCallback registers fn to be called once with the key and
+	// value of every entry removed because it expired; nil removes it. fn
+	// may be called with storage locks held, so it must return quickly and
+	// not use the storage.
+	SetExpiryCallback(fn func(key Key, value Value))
+}
+
+// ExpiryScheduler is implemented by storage engines that know when their
+// next entry expires, so background cleanup can wake up for it instead of
+// only polling
+type ExpiryScheduler interface {
+	// NextExpiry returns the earliest expiry time of the stored entries,
+	// and false if none expire
+	NextExpiry() (time.Time, bool)
+}
+
+// ExpiredCleaner is implemented by storage engines that can drop expired
+// entries in bulk instead of waiting for them to be read
+type ExpiredCleaner interface {
+	// CleanupExpired removes every expired entry and returns how many
+	CleanupExpired() int
+}
+
+// Compacter is implemented by storage engines that can reclaim the space of
+// overwritten and deleted entries
+type Compacter interface {
+	Compact() error
+}
+
+// DiskUsager is implemented by storage engines that keep data on disk
+type DiskUsager interface {
+	// GetDiskUsage returns the bytes the engine occupies on disk
+	GetDiskUsage() (int64, error)
+}
+
+// HealthChecker is implemented by storage engines that stop accepting writes
+// after a failure they can't safely continue from, such as a full disk
+type HealthChecker interface {
+	// Health returns nil while the engine accepts writes, and an error
+	// wrapping ErrReadOnly once it has stopped
+	Health() error
+}
+
+// StatsReporter is implemented by storage engines that count the work they
+// do
+type StatsReporter interface {
+	// Stats returns the engine's counters since it was opened
+	Stats() StorageStats
+}
+
+// StorageStats counts the work a storage engine has done since it was
+// opened. Engines leave the counters that don't apply to them at zero.
+type StorageStats struct {
+	Hits          int64 `json:"hits"`            // Reads that found a live value
+	Misses        int64 `json:"misses"`          // Reads of keys that were missing or expired
+	ExpiredOnRead int64 `json:"expired_on_read"` // Misses that found the key expired
+	Writes        int64 `json:"writes"`          // Entries stored, counting each entry of a batch
+	Deletes       int64 `json:"deletes"`         // Keys deleted that existed
+	Evictions     int64 `json:"evictions,omitempty"`
+
+	// Disk storage
+	DiskReads   int64 `json:"disk_reads,omitempty"` // Records read from the data file
+	BytesRead   int64 `json:"bytes_read,omitempty"` // Bytes read from the data file
+	IndexSaves  int64 `json:"index_saves,omitempty"`
+	Compactions int64 `json:"compactions,omitempty"`
+	CacheHits   int64 `json:"cache_hits,omitempty"`   // Reads served by the read cache
+	CacheMisses int64 `json:"cache_misses,omitempty"` // Reads the read cache couldn't serve
+}
+
+// OrderedStorageEngine is a StorageEngine that keeps its keys sorted and can
+// serve range and prefix scans without visiting every key
+type OrderedStorageEngine interface {
+	StorageEngine
+
+	// Range returns the entries with keys in [start, end) in ascending key
+	// order; an empty end means no upper bound, a limit <= 0 means no limit
+	Range(start, end Key, limit int) ([]Entry, error)
+	// KeysWithPrefix returns the keys starting with prefix in ascending order
+	KeysWithPrefix(prefix Key) ([]Key, error)
+}
+
 // Transaction represents a database transaction
 type Transaction interface {
 	Get(key Key) (Value, error)
@@ -68,11 +313,30 @@ type Transaction interface {
 	Delete(key Key) error
 	Commit() error
 	Rollback() error
+
+	// Savepoints undo part of a transaction's writes
+	Savepoint(name string) error
+	RollbackTo(name string) error
+	ReleaseSavepoint(name string) error
+}
+
+// TxOptions configures a transaction
+type TxOptions struct {
+	// Optimistic makes Commit fail with ErrConflict if keys the
+	// transaction read were written since it began
+	Optimistic bool
+	// Timeout rolls the transaction back once it has been open this long
+	// (0 leaves it open until it ends)
+	Timeout time.Duration
+	// Context rolls the transaction back when it is canceled or its
+	// deadline passes (nil for none)
+	Context context.Context
 }
 
 // Database represents the main database interface
 type Database interface {
 	StorageEngine
+	TTLStorage
 
 	// Transaction support
 	Begin() (Transaction, error)
@@ -82,43 +346,533 @@ type Database interface {
 	GetConfig() Config
 }
 
-// Config represents database configuration
+// Config represents database configuration. Config files name the fields
+// by their JSON tags; see LoadConfig. Only the size limits, eviction, access
+// statistics, TTL, automatic backup and logging settings can be changed with
+// SetConfig once a database is open; see IsMutableConfigField.
 type Config struct {
 	// Storage settings
-	MaxMemorySize int64 // Maximum memory usage in bytes
-	MaxKeySize    int   // Maximum key size in bytes
-	MaxValueSize  int   // Maximum value size in bytes
+	MaxMemorySize  int64  `json:"max_memory_size"` // Maximum memory usage in bytes for in-memory storage (0 disables the limit)
+	EvictionPolicy string `json:"eviction_policy"` // What to do when MaxMemorySize is reached ("lru", "lfu", "expired-first", "reject")
+	MaxKeySize     int    `json:"max_key_size"`    // Maximum key size in bytes
+	MaxValueSize   int    `json:"max_value_size"`  // Maximum value size in bytes
 
 	// Performance settings
-	WriteBufferSize int // Write buffer size
-	ReadBufferSize  int // Read buffer size
+	WriteBufferSize int   `json:"write_buffer_size"` // Write buffer size for the data file (0 disables buffering); only used with WALEnabled
+	ReadBufferSize  int   `json:"read_buffer_size"`  // Read buffer size
+	InMemoryShards  int   `json:"in_memory_shards"`  // Number of lock shards for in-memory storage (rounded up to a power of two)
+	CacheSize       int64 `json:"cache_size"`        // Bytes of recently read entries disk storage keeps in memory (0 disables the cache)
 
 	// Persistence settings
-	EnablePersistence bool   // Enable disk persistence
-	DataDirectory     string // Directory for persistent data
-	WALEnabled        bool   // Enable write-ahead logging
+	EnablePersistence     bool          `json:"enable_persistence"`      // Enable disk persistence
+	DataDirectory         string        `json:"data_directory"`          // Directory for persistent data
+	WALEnabled            bool          `json:"wal_enabled"`             // Enable write-ahead logging
+	MaxWALSize            int64         `json:"max_wal_size"`            // WAL size in bytes at which it is rotated and checkpointed
+	WALSkipCorrupt        bool          `json:"wal_skip_corrupt"`        // Skip corrupt WAL entries followed by valid ones instead of failing to open
+	WALSyncPolicy         string        `json:"wal_sync_policy"`         // When WAL entries are fsynced ("always", "interval", "everyN", "never")
+	WALSyncPeriod         time.Duration `json:"wal_sync_period"`         // Time between fsyncs under the "interval" policy
+	WALSyncEvery          int           `json:"wal_sync_every"`          // Entries between fsyncs under the "everyN" policy
+	WALRetainSegments     int           `json:"wal_retain_segments"`     // Checkpointed WAL segments kept by Checkpoint
+	WALCheckpointInterval time.Duration `json:"wal_checkpoint_interval"` // Time after which a write checkpoints (0 checkpoints on MaxWALSize only)
+	SyncOnWrite           bool          `json:"sync_on_write"`           // Flush and fsync data and index after every write
+	IndexHintInterval     int64         `json:"index_hint_interval"`     // Data file bytes written between index hint snapshots (0 disables them)
+	MinFreeBytes          int64         `json:"min_free_bytes"`          // Free disk space large writes must leave behind (0 disables the check)
+	QuarantineRetain      int           `json:"quarantine_retain"`       // Sets of data files replaced by recovery kept in quarantine (0 keeps none)
+	ReadOnly              bool          `json:"read_only"`               // Open existing disk storage without ever writing to it; can't be combined with WALEnabled
+
+	// Back up before Clear and Compact on databases that support backups
+	AutoBackupBeforeDestructive bool `json:"auto_backup_before_destructive"`
+
+	// File layout settings (zero values select the defaults below)
+	FileMode        os.FileMode `json:"file_mode"`        // Permissions for created files
+	DirMode         os.FileMode `json:"dir_mode"`         // Permissions for created directories
+	WALPath         string      `json:"wal_path"`         // WAL file path, e.g. on a separate disk
+	BackupDirectory string      `json:"backup_directory"` // Directory holding backups
+
+	// Compression settings (disk storage only; the WAL always stores raw values)
+	Compression        string `json:"compression"`          // Value compression algorithm ("none", "gzip")
+	CompressionMinSize int    `json:"compression_min_size"` // Values smaller than this are stored uncompressed
+
+	// Blob settings (disk storage only)
+	BlobThreshold int `json:"blob_threshold"` // Values larger than this are stored in separate blob files (0 disables)
+
+	// Disk usage alerts (disk storage only): the space the data directory,
+	// WAL and backups take, and the fraction of their volume in use, are
+	// checked against these thresholds every DiskUsageCheckInterval and
+	// after large writes. Zero thresholds are off.
+	DiskUsageWarnBytes     int64         `json:"disk_usage_warn_bytes"`     // Space used from which the status is "warn"
+	DiskUsageErrorBytes    int64         `json:"disk_usage_error_bytes"`    // Space used from which the status is "error"
+	DiskUsageWarnFraction  float64       `json:"disk_usage_warn_fraction"`  // Fraction of the volume in use from which the status is "warn" (at most 1)
+	DiskUsageErrorFraction float64       `json:"disk_usage_error_fraction"` // Fraction of the volume in use from which the status is "error" (at most 1)
+	DiskUsageCheckInterval time.Duration `json:"disk_usage_check_interval"` // Time between background checks
+	DiskUsageReadOnly      bool          `json:"disk_usage_read_only"`      // Refuse writes adding data while the status is "error"
+
+	// Access statistics
+	TrackAccessStats   bool `json:"track_access_stats"`    // Record per-key read and write counts
+	AccessStatsMaxKeys int  `json:"access_stats_max_keys"` // Keys tracked at most; 0 selects DefaultAccessStatsMaxKeys
+
+	// Latency tracking
+	EnableLatencyTracking bool          `json:"enable_latency_tracking"` // Record latency histograms of core operations for GetStats
+	SlowOpThreshold       time.Duration `json:"slow_op_threshold"`       // Core operations taking at least this long are logged and counted (0 disables)
+
+	// Stats snapshots: disk databases append GetStats as a JSON line to
+	// stats.log in DataDirectory, so the counters outlive a crash
+	StatsSnapshotInterval time.Duration `json:"stats_snapshot_interval"` // Time between snapshots (0 disables)
+	StatsLogMaxSize       int64         `json:"stats_log_max_size"`      // Size from which stats.log is rotated to stats.log.1
+	StatsLogMaxFiles      int           `json:"stats_log_max_files"`     // Rotated stats logs kept
+
+	// Change events: Database.Events reads them from the WAL when it is
+	// enabled, and otherwise from an in-memory journal of this many writes
+	EventJournalSize int `json:"event_journal_size"` // Writes the in-memory journal keeps (0 disables it)
 
 	// Cleanup settings
-	EnableTTL       bool          // Enable TTL support
-	CleanupInterval time.Duration // TTL cleanup interval
+	EnableTTL         bool          `json:"enable_ttl"`          // Enable TTL support; when off TTL writes fail and stored TTLs are ignored
+	CleanupInterval   time.Duration `json:"cleanup_interval"`    // Longest wait between background removals of expired entries (0 disables)
+	TTLJitterFraction float64       `json:"ttl_jitter_fraction"` // Randomly moves each written TTL by up to this fraction of it either way (0 disables, at most 1)
+
+	// Logging: the database and its storage log to Logger, dropping records
+	// below LogLevel. A nil Logger discards everything. Logger isn't written
+	// to or read from config files.
+	LogLevel string       `json:"log_level"` // Log level (debug, info, warn, error)
+	Logger   *slog.Logger `json:"-"`
+
+	// Profile names the preset the config started from ("default",
+	// "durable", "balanced", "fast"; empty for a config built from scratch).
+	// It changes nothing by itself and is only recorded for diagnostics.
+	Profile string `json:"profile"`
+}
+
+// Compression algorithms for Config.Compression
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// WAL sync policies for Config.WALSyncPolicy. Each trades durability for
+// write throughput; the WAL is always synced on a clean Close.
+const (
+	WALSyncAlways   = "always"   // Every entry is on disk before its write returns
+	WALSyncInterval = "interval" // Entries are synced in the background; up to WALSyncPeriod of writes can be lost
+	WALSyncEveryN   = "everyN"   // Every WALSyncEvery-th write syncs; up to WALSyncEvery-1 writes can be lost
+	WALSyncNever    = "never"    // Syncing is left to the OS; an OS crash can lose any unsynced writes
+)
 
-	// Logging
-	LogLevel string // Log level (debug, info, warn, error)
+// DefaultAccessStatsMaxKeys is the number of keys access statistics track
+// when Config.AccessStatsMaxKeys is unset
+const DefaultAccessStatsMaxKeys = 10000
+
+// Default file layout, used when the corresponding Config fields are unset
+const (
+	DefaultFileMode   os.FileMode = 0644
+	DefaultDirMode    os.FileMode = 0755
+	WALFileName                   = "wal.log"    // WAL file name inside DataDirectory
+	BackupDirName                 = "backups"    // Backup directory name inside DataDirectory
+	QuarantineDirName             = "quarantine" // Directory inside DataDirectory for data files replaced by recovery
+)
+
+// FilePermissions returns the mode for files the database creates
+func (c Config) FilePermissions() os.FileMode {
+	if c.FileMode == 0 {
+		return DefaultFileMode
+	}
+	return c.FileMode
 }
 
+// DirPermissions returns the mode for directories the database creates
+func (c Config) DirPermissions() os.FileMode {
+	if c.DirMode == 0 {
+		return DefaultDirMode
+	}
+	return c.DirMode
+}
+
+// WALFilePath returns the path of the WAL file
+func (c Config) WALFilePath() string {
+	if c.WALPath == "" {
+		return filepath.Join(c.DataDirectory, WALFileName)
+	}
+	return c.WALPath
+}
+
+// BackupPath returns the directory holding backups
+func (c Config) BackupPath() string {
+	if c.BackupDirectory == "" {
+		return filepath.Join(c.DataDirectory, BackupDirName)
+	}
+	return c.BackupDirectory
+}
+
+// ValidatePermissions checks that FileMode and DirMode are plain permission
+// bits that leave the owner able to reopen what the database creates
+func (c Config) ValidatePermissions() error {
+	fileMode, dirMode := c.FilePermissions(), c.DirPermissions()
+	if fileMode&^os.ModePerm != 0 || fileMode&0600 != 0600 {
+		return fmt.Errorf("invalid file mode %#o: must be permission bits including 0600", fileMode)
+	}
+	if dirMode&^os.ModePerm != 0 || dirMode&0700 != 0700 {
+		return fmt.Errorf("invalid directory mode %#o: must be permission bits including 0700", dirMode)
+	}
+	return nil
+}
+
+// ApplyDefaults replaces zero values that can't be meant literally, like a
+// MaxKeySize of 0 or an empty WALSyncPolicy, with the DefaultConfig ones.
+// Fields whose zero value turns a feature off, like MaxMemorySize,
+// WriteBufferSize or CleanupInterval, are left alone, as are the booleans
+// and DataDirectory.
+func (c *Config) ApplyDefaults() {
+	defaults := DefaultConfig()
+	if c.EvictionPolicy == "" {
+		c.EvictionPolicy = defaults.EvictionPolicy
+	}
+	if c.MaxKeySize == 0 {
+		c.MaxKeySize = defaults.MaxKeySize
+	}
+	if c.MaxValueSize == 0 {
+		c.MaxValueSize = defaults.MaxValueSize
+	}
+	if c.ReadBufferSize == 0 {
+		c.ReadBufferSize = defaults.ReadBufferSize
+	}
+	if c.InMemoryShards == 0 {
+		c.InMemoryShards = defaults.InMemoryShards
+	}
+	if c.MaxWALSize == 0 {
+		c.MaxWALSize = defaults.MaxWALSize
+	}
+	if c.WALSyncPolicy == "" {
+		c.WALSyncPolicy = defaults.WALSyncPolicy
+	}
+	if c.WALSyncPeriod == 0 {
+		c.WALSyncPeriod = defaults.WALSyncPeriod
+	}
+	if c.WALSyncEvery == 0 {
+		c.WALSyncEvery = defaults.WALSyncEvery
+	}
+	if c.FileMode == 0 {
+		c.FileMode = defaults.FileMode
+	}
+	if c.DirMode == 0 {
+		c.DirMode = defaults.DirMode
+	}
+	if c.Compression == "" {
+		c.Compression = defaults.Compression
+	}
+	if c.AccessStatsMaxKeys == 0 {
+		c.AccessStatsMaxKeys = defaults.AccessStatsMaxKeys
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = defaults.LogLevel
+	}
+	if c.DiskUsageCheckInterval == 0 {
+		c.DiskUsageCheckInterval = defaults.DiskUsageCheckInterval
+	}
+	if c.StatsLogMaxSize == 0 {
+		c.StatsLogMaxSize = defaults.StatsLogMaxSize
+	}
+	if c.StatsLogMaxFiles == 0 {
+		c.StatsLogMaxFiles = defaults.StatsLogMaxFiles
+	}
+}
+
+// Validate checks the config and returns an error listing every problem
+// with it, joined with errors.Join, or nil if there are none. It checks
+// the values as given, so a config with zero values ApplyDefaults would
+// fill in fails it.
+func (c Config) Validate() error {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.MaxKeySize <= 0 {
+		problem("MaxKeySize must be positive, got %d", c.MaxKeySize)
+	}
+	if c.MaxValueSize <= 0 {
+		problem("MaxValueSize must be positive, got %d", c.MaxValueSize)
+	} else if c.MaxValueSize < c.MaxKeySize {
+		problem("MaxValueSize %d is smaller than MaxKeySize %d", c.MaxValueSize, c.MaxKeySize)
+	}
+	switch c.EvictionPolicy {
+	case EvictionLRU, EvictionLFU, EvictionExpiredFirst, EvictionReject:
+	default:
+		problem("unknown EvictionPolicy %q, want one of %q, %q, %q or %q",
+			c.EvictionPolicy, EvictionLRU, EvictionLFU, EvictionExpiredFirst, EvictionReject)
+	}
+
+	for _, field := range []struct {
+		name  string
+		value int64
+	}{
+		{"WriteBufferSize", int64(c.WriteBufferSize)},
+		{"ReadBufferSize", int64(c.ReadBufferSize)},
+		{"InMemoryShards", int64(c.InMemoryShards)},
+		{"CacheSize", c.CacheSize},
+		{"MaxWALSize", c.MaxWALSize},
+		{"WALRetainSegments", int64(c.WALRetainSegments)},
+		{"WALCheckpointInterval", int64(c.WALCheckpointInterval)},
+		{"IndexHintInterval", c.IndexHintInterval},
+		{"MinFreeBytes", c.MinFreeBytes},
+		{"QuarantineRetain", int64(c.QuarantineRetain)},
+		{"CompressionMinSize", int64(c.CompressionMinSize)},
+		{"BlobThreshold", int64(c.BlobThreshold)},
+		{"DiskUsageWarnBytes", c.DiskUsageWarnBytes},
+		{"DiskUsageErrorBytes", c.DiskUsageErrorBytes},
+		{"DiskUsageCheckInterval", int64(c.DiskUsageCheckInterval)},
+		{"AccessStatsMaxKeys", int64(c.AccessStatsMaxKeys)},
+		{"CleanupInterval", int64(c.CleanupInterval)},
+		{"SlowOpThreshold", int64(c.SlowOpThreshold)},
+		{"StatsSnapshotInterval", int64(c.StatsSnapshotInterval)},
+		{"StatsLogMaxSize", c.StatsLogMaxSize},
+		{"StatsLogMaxFiles", int64(c.StatsLogMaxFiles)},
+		{"EventJournalSize", int64(c.EventJournalSize)},
+	} {
+		if field.value < 0 {
+			problem("%s can't be negative, got %d", field.name, field.value)
+		}
+	}
+
+	if c.EnablePersistence && c.DataDirectory == "" {
+		problem("DataDirectory must be set when EnablePersistence is on")
+	}
+	if c.ReadOnly && !c.EnablePersistence {
+		problem("ReadOnly needs EnablePersistence")
+	}
+	if c.ReadOnly && c.WALEnabled {
+		problem("ReadOnly can't be combined with WALEnabled, since opening replays and checkpoints the WAL")
+	}
+	switch c.WALSyncPolicy {
+	case WALSyncAlways, WALSyncNever:
+	case WALSyncInterval:
+		if c.WALSyncPeriod <= 0 {
+			problem("WALSyncPeriod must be positive under the %q WAL sync policy, got %s", c.WALSyncPolicy, c.WALSyncPeriod)
+		}
+	case WALSyncEveryN:
+		if c.WALSyncEvery <= 0 {
+			problem("WALSyncEvery must be positive under the %q WAL sync policy, got %d", c.WALSyncPolicy, c.WALSyncEvery)
+		}
+	default:
+		problem("unknown WALSyncPolicy %q, want one of %q, %q, %q or %q",
+			c.WALSyncPolicy, WALSyncAlways, WALSyncInterval, WALSyncEveryN, WALSyncNever)
+	}
+	switch c.Compression {
+	case CompressionNone, CompressionGzip:
+	default:
+		problem("unknown Compression %q, want %q or %q", c.Compression, CompressionNone, CompressionGzip)
+	}
+	if err := c.ValidatePermissions(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.TTLJitterFraction < 0 || c.TTLJitterFraction > 1 {
+		problem("TTLJitterFraction must be between 0 and 1, got %g", c.TTLJitterFraction)
+	}
+	for _, field := range []struct {
+		name  string
+		value float64
+	}{
+		{"DiskUsageWarnFraction", c.DiskUsageWarnFraction},
+		{"DiskUsageErrorFraction", c.DiskUsageErrorFraction},
+	} {
+		if field.value < 0 || field.value > 1 {
+			problem("%s must be between 0 and 1, got %g", field.name, field.value)
+		}
+	}
+	if c.DiskUsageWarnBytes > 0 && c.DiskUsageErrorBytes > 0 && c.DiskUsageWarnBytes > c.DiskUsageErrorBytes {
+		problem("DiskUsageWarnBytes (%d) can't be above DiskUsageErrorBytes (%d)", c.DiskUsageWarnBytes, c.DiskUsageErrorBytes)
+	}
+	if c.DiskUsageWarnFraction > 0 && c.DiskUsageErrorFraction > 0 && c.DiskUsageWarnFraction > c.DiskUsageErrorFraction {
+		problem("DiskUsageWarnFraction (%g) can't be above DiskUsageErrorFraction (%g)", c.DiskUsageWarnFraction, c.DiskUsageErrorFraction)
+	}
+	switch c.LogLevel {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		problem("unknown LogLevel %q, want one of %q, %q, %q or %q",
+			c.LogLevel, LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError)
+	}
+	if _, ok := profiles[c.Profile]; c.Profile != "" && !ok {
+		problem("unknown Profile %q, want one of %q, %q, %q or %q",
+			c.Profile, ProfileDefault, ProfileDurable, ProfileBalanced, ProfileFast)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Log levels for Config.LogLevel
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// SlogLevel returns the slog.Level of a Config.LogLevel, LevelInfo for an
+// unknown one
+func SlogLevel(level string) slog.Level {
+	switch level {
+	case LogLevelDebug:
+		return slog.LevelDebug
+	case LogLevelWarn:
+		return slog.LevelWarn
+	case LogLevelError:
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// LoggerOrDiscard returns logger, or a logger discarding every record if it
+// is nil, so components given an optional logger can log unconditionally
+func LoggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// discardLogger is the logger LoggerOrDiscard returns for nil
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler enabled for no level
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Eviction policies for Config.EvictionPolicy
+const (
+	EvictionLRU          = "lru"           // Evict the least recently used entries
+	EvictionLFU          = "lfu"           // Evict the least frequently used entries
+	EvictionExpiredFirst = "expired-first" // Evict expired entries, then fall back to LRU
+	EvictionReject       = "reject"        // Refuse writes that would exceed the limit
+)
+
 // DefaultConfig returns a default configuration
 func DefaultConfig() Config {
 	return Config{
-		MaxMemorySize:     1024 * 1024 * 1024, // 1GB
-		MaxKeySize:        1024,               // 1KB
-		MaxValueSize:      1024 * 1024,        // 1MB
-		WriteBufferSize:   64 * 1024,          // 64KB
-		ReadBufferSize:    64 * 1024,          // 64KB
-		EnablePersistence: false,
-		DataDirectory:     "./data",
-		WALEnabled:        false,
-		EnableTTL:         true,
-		CleanupInterval:   time.Minute * 5,
-		LogLevel:          "info",
+		MaxMemorySize:          1024 * 1024 * 1024, // 1GB
+		EvictionPolicy:         EvictionLRU,
+		MaxKeySize:             1024,        // 1KB
+		MaxValueSize:           1024 * 1024, // 1MB
+		WriteBufferSize:        64 * 1024,   // 64KB
+		ReadBufferSize:         64 * 1024,   // 64KB
+		InMemoryShards:         64,
+		EnablePersistence:      false,
+		DataDirectory:          "./data",
+		WALEnabled:             false,
+		MaxWALSize:             10 * 1024 * 1024, // 10MB
+		WALSkipCorrupt:         false,
+		WALSyncPolicy:          WALSyncAlways,
+		WALSyncPeriod:          100 * time.Millisecond,
+		WALSyncEvery:           100,
+		WALRetainSegments:      0,
+		WALCheckpointInterval:  0,
+		SyncOnWrite:            false,
+		IndexHintInterval:      16 * 1024 * 1024, // 16MB
+		MinFreeBytes:           0,
+		QuarantineRetain:       3,
+		FileMode:               DefaultFileMode,
+		DirMode:                DefaultDirMode,
+		Compression:            CompressionNone,
+		CompressionMinSize:     512,
+		BlobThreshold:          0,
+		DiskUsageCheckInterval: time.Minute,
+		TrackAccessStats:       false,
+		AccessStatsMaxKeys:     DefaultAccessStatsMaxKeys,
+		EnableLatencyTracking:  false,
+		SlowOpThreshold:        0,
+		StatsSnapshotInterval:  0,
+		StatsLogMaxSize:        1024 * 1024, // 1MB
+		StatsLogMaxFiles:       3,
+		EventJournalSize:       0,
+		EnableTTL:              true,
+		CleanupInterval:        time.Minute * 5,
+		LogLevel:               LogLevelInfo,
+		Profile:                ProfileDefault,
+	}
+}
+
+// Config profiles for Config.Profile, each named after the preset returning
+// it
+const (
+	ProfileDefault  = "default"  // DefaultConfig
+	ProfileDurable  = "durable"  // DurableConfig
+	ProfileBalanced = "balanced" // BalancedConfig
+	ProfileFast     = "fast"     // FastConfig
+)
+
+// profiles maps each profile to its preset
+var profiles = map[string]func() Config{
+	ProfileDefault:  DefaultConfig,
+	ProfileDurable:  DurableConfig,
+	ProfileBalanced: BalancedConfig,
+	ProfileFast:     FastConfig,
+}
+
+// ProfileConfig returns the preset of the named profile
+func ProfileConfig(profile string) (Config, error) {
+	preset, ok := profiles[profile]
+	if !ok {
+		return Config{}, fmt.Errorf("unknown profile %q, want one of %q, %q, %q or %q",
+			profile, ProfileDefault, ProfileDurable, ProfileBalanced, ProfileFast)
 	}
+	return preset(), nil
+}
+
+// The presets below trade durability for speed on disk databases. Each
+// starts from DefaultConfig and overrides only the settings the trade-off
+// is about, so fields added to Config get their defaults in every preset.
+// They keep the default DataDirectory; set it, or pass the preset to
+// engine.Open with WithConfig, which sets it.
+
+// DurableConfig returns a disk config that loses no acknowledged write,
+// even to a power failure: every WAL entry is fsynced before its write
+// returns, the data file and index are unbuffered and fsynced after every
+// write too, and the WAL is checkpointed often to keep recovery short.
+func DurableConfig() Config {
+	config := DefaultConfig()
+	config.Profile = ProfileDurable
+	config.EnablePersistence = true
+	config.WALEnabled = true
+	config.WALSyncPolicy = WALSyncAlways
+	config.SyncOnWrite = true
+	config.WriteBufferSize = 0
+	config.MaxWALSize = 4 * 1024 * 1024 // 4MB
+	config.WALCheckpointInterval = time.Minute
+	return config
+}
+
+// BalancedConfig returns a disk config that loses no acknowledged write
+// while leaving the data file to catch up: every WAL entry is fsynced
+// before its write returns, but data file writes and index saves are
+// buffered and replayed from the WAL after a crash.
+func BalancedConfig() Config {
+	config := DefaultConfig()
+	config.Profile = ProfileBalanced
+	config.EnablePersistence = true
+	config.WALEnabled = true
+	config.WALSyncPolicy = WALSyncAlways
+	config.WriteBufferSize = 256 * 1024 // 256KB
+	config.WALCheckpointInterval = 5 * time.Minute
+	return config
+}
+
+// FastConfig returns a disk config for write throughput: the WAL is fsynced
+// in the background every second, so a power failure can lose up to a
+// second of acknowledged writes, and data file writes, index saves and
+// index hints are deferred behind large buffers. What survives a crash is
+// always a consistent prefix of the writes.
+func FastConfig() Config {
+	config := DefaultConfig()
+	config.Profile = ProfileFast
+	config.EnablePersistence = true
+	config.WALEnabled = true
+	config.WALSyncPolicy = WALSyncInterval
+	config.WALSyncPeriod = time.Second
+	config.WriteBufferSize = 1024 * 1024        // 1MB
+	config.MaxWALSize = 64 * 1024 * 1024        // 64MB
+	config.IndexHintInterval = 64 * 1024 * 1024 // 64MB
+	config.CacheSize = 32 * 1024 * 1024         // 32MB
+	return config
 }
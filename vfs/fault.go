@@ -0,0 +1,524 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ErrCrashed is returned by every operation on a FaultFS after a crash
+var ErrCrashed = errors.New("vfs: simulated crash")
+
+// WriteFault describes a write failure for FaultFS to inject
+type WriteFault struct {
+	After  int   // Writes allowed through before the fault fires
+	Err    error // Error returned by the failing write; ENOSPC when nil
+	Torn   bool  // Write the first half of the buffer before failing
+	Sticky bool  // Keep failing every later write instead of just one
+	Crash  bool  // Crash right after the failing write, as if the process died in it
+
+	// Path limits the fault to writes to one file; writes to other files
+	// still count towards After but go through. Empty for every file.
+	Path string
+}
+
+// FaultFS wraps another FS for tests, injecting write failures, dropping
+// fsyncs and simulating crashes.
+//
+// Its power failure model treats metadata operations (create, rename,
+// remove) as durable immediately and file contents as durable only once
+// fsynced: PowerFailure rewinds every file written through the FaultFS to
+// its contents at its last successful Sync, or at the time it was first
+// opened for writing. It does track which directories have had entries
+// created, renamed or removed since they were last fsynced, so tests can
+// check that metadata operations are made durable.
+type FaultFS struct {
+	base FS
+
+	mu         sync.Mutex
+	writes     int
+	fault      *WriteFault
+	dropSyncs  bool
+	crashed    bool
+	freeSpace  *uint64               // Reported by FreeSpace in place of the base FS's figure
+	totalSpace *uint64               // Reported by TotalSpace in place of the base FS's figure
+	nodes      map[string]*faultNode // Files opened for writing, by current path
+	open       map[*faultFile]bool
+	unsynced   map[string]bool // Directories changed since their last fsync
+}
+
+// faultNode tracks the durable contents of a file
+type faultNode struct {
+	path    string
+	durable []byte
+}
+
+// NewFaultFS creates a FaultFS on top of base
+func NewFaultFS(base FS) *FaultFS {
+	return &FaultFS{
+		base:     base,
+		nodes:    make(map[string]*faultNode),
+		open:     make(map[*faultFile]bool),
+		unsynced: make(map[string]bool),
+	}
+}
+
+// InjectWriteFault arms a write failure, replacing any armed before
+func (f *FaultFS) InjectWriteFault(fault WriteFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fault.Err == nil {
+		fault.Err = syscall.ENOSPC
+	}
+	fault.After += f.writes
+	if fault.Path != "" {
+		fault.Path = filepath.Clean(fault.Path)
+	}
+	f.fault = &fault
+}
+
+// ClearWriteFault disarms any pending write failure
+func (f *FaultFS) ClearWriteFault() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fault = nil
+}
+
+// DropSyncs makes Sync report success without making anything durable
+func (f *FaultFS) DropSyncs(drop bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.dropSyncs = drop
+}
+
+// SetFreeSpace makes FreeSpace report n bytes free, regardless of the base
+// FS. It only changes what is reported: use InjectWriteFault to make writes
+// fail.
+func (f *FaultFS) SetFreeSpace(n uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.freeSpace = &n
+}
+
+// SetTotalSpace makes TotalSpace report n bytes, regardless of the base FS
+func (f *FaultFS) SetTotalSpace(n uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.totalSpace = &n
+}
+
+// Writes returns the number of Write calls made through the FaultFS
+func (f *FaultFS) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writes
+}
+
+// UnsyncedDirs returns, sorted, the directories in which a file or
+// directory was created, renamed or removed through the FaultFS since they
+// were last fsynced. A sync dropped by DropSyncs doesn't count.
+func (f *FaultFS) UnsyncedDirs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dirs := make([]string, 0, len(f.unsynced))
+	for dir := range f.unsynced {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// changed records that an entry of the directory holding name was created,
+// renamed or removed. The caller must hold f.mu.
+func (f *FaultFS) changed(name string) {
+	f.unsynced[filepath.Dir(filepath.Clean(name))] = true
+}
+
+// Crash simulates the process dying: open files are closed without
+// flushing anything more and all later operations fail with ErrCrashed.
+// Everything already written survives, as it would in the page cache.
+// Reopen the directory with a new FS to observe the result.
+func (f *FaultFS) Crash() error {
+	return f.crash(false)
+}
+
+// PowerFailure is like Crash, but every file written through the FaultFS
+// also loses whatever wasn't fsynced
+func (f *FaultFS) PowerFailure() error {
+	return f.crash(true)
+}
+
+func (f *FaultFS) crash(loseUnsynced bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.crashLocked(loseUnsynced)
+}
+
+// crashLocked implements crash. The caller must hold f.mu.
+func (f *FaultFS) crashLocked(loseUnsynced bool) error {
+	if f.crashed {
+		return nil
+	}
+	f.crashed = true
+
+	for file := range f.open {
+		file.File.Close()
+	}
+	f.open = nil
+
+	if !loseUnsynced {
+		return nil
+	}
+
+	for path, node := range f.nodes {
+		if _, err := f.base.Stat(path); err != nil {
+			continue
+		}
+		file, err := f.base.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(node.durable)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// track returns the node for a file about to be written, recording its
+// current contents as durable the first time it is seen. The caller must
+// hold f.mu.
+func (f *FaultFS) track(name string) (*faultNode, error) {
+	name = filepath.Clean(name)
+	if node, ok := f.nodes[name]; ok {
+		return node, nil
+	}
+
+	data, err := ReadFile(f.base, name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	node := &faultNode{path: name, durable: data}
+	f.nodes[name] = node
+	return node, nil
+}
+
+// untrack forgets the files at or below name. The caller must hold f.mu.
+func (f *FaultFS) untrack(name string) {
+	name = filepath.Clean(name)
+	for path := range f.nodes {
+		if path == name || strings.HasPrefix(path, name+string(filepath.Separator)) {
+			delete(f.nodes, path)
+		}
+	}
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+
+	var node *faultNode
+	info, statErr := f.base.Stat(name)
+	isDir := statErr == nil && info.IsDir()
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && !isDir {
+		var trackErr error
+		if node, trackErr = f.track(name); trackErr != nil {
+			return nil, trackErr
+		}
+	}
+
+	file, err := f.base.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&os.O_CREATE != 0 && os.IsNotExist(statErr) {
+		f.changed(name)
+	}
+
+	faultFile := &faultFile{File: file, fs: f, node: node}
+	if isDir {
+		faultFile.dir = filepath.Clean(name)
+	}
+	f.open[faultFile] = true
+	return faultFile, nil
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	if err := f.base.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f.changed(oldpath)
+	f.changed(newpath)
+	node, ok := f.nodes[oldpath]
+	f.untrack(newpath)
+	if ok {
+		delete(f.nodes, oldpath)
+		node.path = newpath
+		f.nodes[newpath] = node
+	}
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	if err := f.base.Remove(name); err != nil {
+		return err
+	}
+	f.changed(name)
+	f.untrack(name)
+	return nil
+}
+
+func (f *FaultFS) RemoveAll(path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	_, statErr := f.base.Stat(path)
+	if err := f.base.RemoveAll(path); err != nil {
+		return err
+	}
+	if statErr == nil {
+		f.changed(path)
+	}
+	f.untrack(path)
+	return nil
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+
+	// Each directory created changes its parent
+	var created []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := f.base.Stat(dir); !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			break
+		}
+		created = append(created, dir)
+	}
+
+	if err := f.base.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	for _, dir := range created {
+		f.changed(dir)
+	}
+	return nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.base.Stat(name)
+}
+
+func (f *FaultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f.base.ReadDir(name)
+}
+
+func (f *FaultFS) FreeSpace(path string) (uint64, error) {
+	f.mu.Lock()
+	crashed, freeSpace := f.crashed, f.freeSpace
+	f.mu.Unlock()
+
+	if crashed {
+		return 0, ErrCrashed
+	}
+	if freeSpace != nil {
+		return *freeSpace, nil
+	}
+	return FreeSpace(f.base, path)
+}
+
+func (f *FaultFS) TotalSpace(path string) (uint64, error) {
+	f.mu.Lock()
+	crashed, totalSpace := f.crashed, f.totalSpace
+	f.mu.Unlock()
+
+	if crashed {
+		return 0, ErrCrashed
+	}
+	if totalSpace != nil {
+		return *totalSpace, nil
+	}
+	return TotalSpace(f.base, path)
+}
+
+// check returns ErrCrashed once the FaultFS has crashed
+func (f *FaultFS) check() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// faultFile is a File opened through a FaultFS
+type faultFile struct {
+	File
+	fs   *FaultFS
+	node *faultNode // nil for files opened read-only
+	dir  string     // Path of the directory, if the file is one
+}
+
+func (file *faultFile) Write(p []byte) (int, error) {
+	f := file.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return 0, ErrCrashed
+	}
+
+	f.writes++
+	if fault := f.fault; fault != nil && f.writes > fault.After && file.faulty(fault) {
+		if !fault.Sticky {
+			f.fault = nil
+		}
+		n := 0
+		if fault.Torn {
+			n, _ = file.File.Write(p[:len(p)/2])
+		}
+		if fault.Crash {
+			f.crashLocked(false)
+		}
+		return n, fault.Err
+	}
+
+	return file.File.Write(p)
+}
+
+// faulty reports whether fault applies to writes to file
+func (file *faultFile) faulty(fault *WriteFault) bool {
+	return fault.Path == "" || (file.node != nil && file.node.path == fault.Path)
+}
+
+func (file *faultFile) Sync() error {
+	f := file.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed
+	}
+	if err := file.File.Sync(); err != nil {
+		return err
+	}
+	if f.dropSyncs {
+		return nil
+	}
+	if file.dir != "" {
+		delete(f.unsynced, file.dir)
+	}
+	if file.node == nil {
+		return nil
+	}
+
+	data, err := ReadFile(f.base, file.node.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // Removed since it was opened
+		}
+		return err
+	}
+	file.node.durable = data
+	return nil
+}
+
+func (file *faultFile) Read(p []byte) (int, error) {
+	if err := file.fs.check(); err != nil {
+		return 0, err
+	}
+	return file.File.Read(p)
+}
+
+func (file *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := file.fs.check(); err != nil {
+		return 0, err
+	}
+	return file.File.ReadAt(p, off)
+}
+
+func (file *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := file.fs.check(); err != nil {
+		return 0, err
+	}
+	return file.File.Seek(offset, whence)
+}
+
+func (file *faultFile) Truncate(size int64) error {
+	if err := file.fs.check(); err != nil {
+		return err
+	}
+	return file.File.Truncate(size)
+}
+
+func (file *faultFile) Stat() (os.FileInfo, error) {
+	if err := file.fs.check(); err != nil {
+		return nil, err
+	}
+	return file.File.Stat()
+}
+
+func (file *faultFile) Close() error {
+	f := file.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return ErrCrashed // Crash already closed the underlying file
+	}
+	delete(f.open, file)
+	return file.File.Close()
+}
@@ -0,0 +1,163 @@
+package vfs_test
+
+import (
+	"database_engine/vfs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultFSWriteFault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	fsys := vfs.NewFaultFS(vfs.OS)
+
+	file, err := vfs.Create(fsys, path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	fsys.InjectWriteFault(vfs.WriteFault{After: 1, Torn: true})
+	_, err = file.Write([]byte("ab"))
+	require.NoError(t, err)
+
+	n, err := file.Write([]byte("cdef"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	assert.Equal(t, 2, n)
+
+	// A fault that isn't sticky only fails once
+	_, err = file.Write([]byte("gh"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, fsys.Writes())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdgh", string(data))
+}
+
+func TestFaultFSWriteFaultPath(t *testing.T) {
+	dir := t.TempDir()
+	fsys := vfs.NewFaultFS(vfs.OS)
+
+	full, err := vfs.Create(fsys, filepath.Join(dir, "full"))
+	require.NoError(t, err)
+	defer full.Close()
+	other, err := vfs.Create(fsys, filepath.Join(dir, "other"))
+	require.NoError(t, err)
+	defer other.Close()
+
+	// Only writes to the faulty file fail
+	fsys.InjectWriteFault(vfs.WriteFault{Sticky: true, Path: filepath.Join(dir, ".", "full")})
+	_, err = other.Write([]byte("ok"))
+	require.NoError(t, err)
+	_, err = full.Write([]byte("lost"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	_, err = full.Write([]byte("lost"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	_, err = other.Write([]byte("ok"))
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dir, "other"))
+	require.NoError(t, err)
+	assert.Equal(t, "okok", string(data))
+}
+
+func TestFaultFSPowerFailure(t *testing.T) {
+	dir := t.TempDir()
+	fsys := vfs.NewFaultFS(vfs.OS)
+
+	synced, err := vfs.Create(fsys, filepath.Join(dir, "synced"))
+	require.NoError(t, err)
+	_, err = synced.Write([]byte("durable"))
+	require.NoError(t, err)
+	require.NoError(t, synced.Sync())
+	_, err = synced.Write([]byte(" lost"))
+	require.NoError(t, err)
+
+	// Renames are durable and the file keeps its synced contents
+	renamed, err := vfs.Create(fsys, filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	_, err = renamed.Write([]byte("renamed"))
+	require.NoError(t, err)
+	require.NoError(t, renamed.Sync())
+	require.NoError(t, fsys.Rename(filepath.Join(dir, "tmp"), filepath.Join(dir, "renamed")))
+
+	fsys.DropSyncs(true)
+	dropped, err := vfs.Create(fsys, filepath.Join(dir, "dropped"))
+	require.NoError(t, err)
+	_, err = dropped.Write([]byte("never durable"))
+	require.NoError(t, err)
+	require.NoError(t, dropped.Sync())
+
+	require.NoError(t, fsys.PowerFailure())
+	_, err = synced.Write([]byte("after"))
+	assert.Equal(t, vfs.ErrCrashed, err)
+
+	for name, want := range map[string]string{"synced": "durable", "renamed": "renamed", "dropped": ""} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data), name)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	free, err := vfs.FreeSpace(vfs.OS, dir)
+	require.NoError(t, err)
+	assert.Greater(t, free, uint64(0))
+
+	// Wrappers pass the question on
+	fsys := vfs.NewFaultFS(vfs.WithModes(vfs.OS, 0600, 0700))
+	_, err = vfs.FreeSpace(fsys, dir)
+	require.NoError(t, err)
+
+	fsys.SetFreeSpace(1234)
+	free, err = vfs.FreeSpace(vfs.WithModes(fsys, 0600, 0700), dir)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1234), free)
+
+	total, err := vfs.TotalSpace(vfs.OS, dir)
+	require.NoError(t, err)
+	assert.Greater(t, total, uint64(0))
+	fsys.SetTotalSpace(5678)
+	total, err = vfs.TotalSpace(vfs.WithModes(fsys, 0600, 0700), dir)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5678), total)
+}
+
+func TestFaultFSUnsyncedDirs(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	fsys := vfs.NewFaultFS(vfs.OS)
+
+	// Creating a directory changes its parent, creating a file its own
+	require.NoError(t, fsys.MkdirAll(sub, 0755))
+	file, err := vfs.Create(fsys, filepath.Join(sub, "file"))
+	require.NoError(t, err)
+	require.NoError(t, file.Sync())
+	require.NoError(t, file.Close())
+	assert.Equal(t, []string{dir, sub}, fsys.UnsyncedDirs())
+
+	// Rewriting an existing file doesn't
+	require.NoError(t, vfs.SyncDir(fsys, dir))
+	require.NoError(t, vfs.SyncDir(fsys, sub+"/"))
+	file, err = vfs.Create(fsys, filepath.Join(sub, "file"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	assert.Empty(t, fsys.UnsyncedDirs())
+
+	// A rename changes both directories, a removal the one it was in
+	require.NoError(t, fsys.Rename(filepath.Join(sub, "file"), filepath.Join(dir, "file")))
+	assert.Equal(t, []string{dir, sub}, fsys.UnsyncedDirs())
+	require.NoError(t, vfs.SyncDir(fsys, sub))
+	require.NoError(t, fsys.Remove(filepath.Join(dir, "file")))
+	assert.Equal(t, []string{dir}, fsys.UnsyncedDirs())
+
+	// A dropped sync doesn't make the change durable
+	fsys.DropSyncs(true)
+	require.NoError(t, vfs.SyncDir(fsys, dir))
+	assert.Equal(t, []string{dir}, fsys.UnsyncedDirs())
+}
@@ -0,0 +1,75 @@
+package vfs_test
+
+import (
+	"database_engine/vfs"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockHelperEnv names the file TestLockHelper locks when the test binary
+// is run as another process
+const lockHelperEnv = "VFS_LOCK_HELPER"
+
+// TestLockHelper is the other process of TestLock: it exits with 3 if the
+// file is locked
+func TestLockHelper(t *testing.T) {
+	path := os.Getenv(lockHelperEnv)
+	if path == "" {
+		t.Skip("only run by TestLock")
+	}
+	lock, err := vfs.Lock(vfs.OS, path, 0644)
+	if errors.Is(err, vfs.ErrLocked) {
+		os.Exit(3)
+	}
+	require.NoError(t, err)
+	lock.Close()
+}
+
+// lockedByOther reports whether another process finds path locked
+func lockedByOther(t *testing.T, path string) bool {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), lockHelperEnv+"="+path)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		return true
+	}
+	require.NoError(t, err)
+	return false
+}
+
+func TestLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no advisory locks")
+	}
+	path := filepath.Join(t.TempDir(), "LOCK")
+
+	lock, err := vfs.Lock(vfs.WithModes(vfs.OS, 0600, 0700), path, 0644)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.True(t, lockedByOther(t, path))
+
+	// The lock belongs to the open file, so the process can't take it again
+	_, err = vfs.Lock(vfs.OS, path, 0644)
+	assert.ErrorIs(t, err, vfs.ErrLocked)
+
+	require.NoError(t, lock.Close())
+	assert.False(t, lockedByOther(t, path))
+	again, err := vfs.Lock(vfs.OS, path, 0644)
+	require.NoError(t, err)
+	require.NoError(t, again.Close())
+
+	// Filesystems that can't lock guard nothing
+	nop, err := vfs.Lock(vfs.NewFaultFS(vfs.OS), filepath.Join(t.TempDir(), "LOCK"), 0644)
+	require.NoError(t, err)
+	assert.NoError(t, nop.Close())
+}
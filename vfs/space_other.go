@@ -0,0 +1,15 @@
+//go:build !unix
+
+package vfs
+
+import "errors"
+
+// freeSpace is not implemented on this platform
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// totalSpace is not implemented on this platform
+func totalSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
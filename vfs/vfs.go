@@ -0,0 +1,216 @@
+// Package vfs is the small filesystem abstraction the storage layer is
+// written against, so tests can substitute a filesystem that fails on
+// demand.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// File is the subset of *os.File the storage layer uses
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is the set of filesystem operations the storage layer uses
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+}
+
+// SpaceReporter is implemented by filesystems that can tell how much space
+// is left on them
+type SpaceReporter interface {
+	FreeSpace(path string) (uint64, error)
+}
+
+// FreeSpace returns the bytes available for new data on the filesystem
+// holding path, or errors.ErrUnsupported if fsys can't tell
+func FreeSpace(fsys FS, path string) (uint64, error) {
+	if reporter, ok := fsys.(SpaceReporter); ok {
+		return reporter.FreeSpace(path)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+// SizeReporter is implemented by filesystems that can tell how large they
+// are
+type SizeReporter interface {
+	TotalSpace(path string) (uint64, error)
+}
+
+// TotalSpace returns the size in bytes of the filesystem holding path, or
+// errors.ErrUnsupported if fsys can't tell
+func TotalSpace(fsys FS, path string) (uint64, error) {
+	if reporter, ok := fsys.(SizeReporter); ok {
+		return reporter.TotalSpace(path)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+// ErrLocked is returned by Lock when the lock is already held, by another
+// process or through another Lock in this one
+var ErrLocked = errors.New("already locked")
+
+// Locker is implemented by filesystems that can lock a file against other
+// processes
+type Locker interface {
+	Lock(name string, perm os.FileMode) (io.Closer, error)
+}
+
+// Lock takes an exclusive lock on the named file, creating it with perm if
+// needed, and returns what releases it. It fails with ErrLocked while the
+// lock is held, even by an earlier Lock in the same process. The lock is
+// advisory and goes away with the process that holds it. Filesystems that can't lock return a lock that
+// guards nothing.
+func Lock(fsys FS, name string, perm os.FileMode) (io.Closer, error) {
+	if locker, ok := fsys.(Locker); ok {
+		return locker.Lock(name, perm)
+	}
+	return nopLock{}, nil
+}
+
+// nopLock is the lock of filesystems that can't lock
+type nopLock struct{}
+
+func (nopLock) Close() error { return nil }
+
+// OS is the real filesystem
+var OS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // Avoid returning a non-nil File holding a nil *os.File
+	}
+	return file, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (osFS) FreeSpace(path string) (uint64, error)        { return freeSpace(path) }
+func (osFS) TotalSpace(path string) (uint64, error)       { return totalSpace(path) }
+
+func (osFS) Lock(name string, perm os.FileMode) (io.Closer, error) { return lockFile(name, perm) }
+
+// WithModes returns an FS that creates files with fileMode and directories
+// with dirMode in place of whatever mode the caller asks for. As with
+// os.OpenFile, the modes are subject to the umask and only apply to files
+// and directories that don't exist yet.
+func WithModes(base FS, fileMode, dirMode os.FileMode) FS {
+	return modeFS{FS: base, fileMode: fileMode, dirMode: dirMode}
+}
+
+type modeFS struct {
+	FS
+	fileMode os.FileMode
+	dirMode  os.FileMode
+}
+
+func (m modeFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return m.FS.OpenFile(name, flag, m.fileMode)
+}
+
+func (m modeFS) MkdirAll(path string, perm os.FileMode) error {
+	return m.FS.MkdirAll(path, m.dirMode)
+}
+
+func (m modeFS) FreeSpace(path string) (uint64, error) {
+	return FreeSpace(m.FS, path)
+}
+
+func (m modeFS) TotalSpace(path string) (uint64, error) {
+	return TotalSpace(m.FS, path)
+}
+
+func (m modeFS) Lock(name string, perm os.FileMode) (io.Closer, error) {
+	return Lock(m.FS, name, m.fileMode)
+}
+
+// Open opens the named file for reading
+func Open(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file, like os.Create
+func Create(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// SyncDir fsyncs the directory dir, so files created, renamed or removed in
+// it stay that way after a power failure
+func SyncDir(fsys FS, dir string) error {
+	d, err := Open(fsys, dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ReadFile reads the whole named file
+func ReadFile(fsys FS, name string) ([]byte, error) {
+	file, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+// Walk calls fn for every regular file below root, in lexical order. A
+// missing root is not an error.
+func Walk(fsys FS, root string, fn func(path string, info os.FileInfo) error) error {
+	entries, err := fsys.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if entry.IsDir() {
+			if err := Walk(fsys, path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := fn(path, info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
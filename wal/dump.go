@@ -0,0 +1,371 @@
+package wal
+
+import (
+	"database_engine/types"
+	"database_engine/vfs"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DumpFormat selects how Dump prints records
+type DumpFormat string
+
+const (
+	DumpText DumpFormat = "text" // One line per record, preceded by a line per file
+	DumpJSON DumpFormat = "json" // One JSON object per record, per line
+)
+
+// dumpValueLimit is the size up to which Dump prints a value, rather than
+// only its size
+const dumpValueLimit = 64
+
+// Statuses of the records Dump prints
+const (
+	dumpOK      = "ok"      // The checksum holds
+	dumpNoCRC   = "no-crc"  // Written before checksums existed
+	dumpCorrupt = "corrupt" // Damaged, with valid entries after it
+	dumpTorn    = "torn"    // Damaged, with nothing valid after it; opening the WAL drops it
+)
+
+// dumpRecord is one record as Dump prints it. A damaged record describes
+// the bytes up to the next valid entry, with whatever of its entry still
+// parses.
+type dumpRecord struct {
+	File      string       `json:"file"`
+	Offset    int64        `json:"offset"`
+	Size      int64        `json:"size"`
+	Status    string       `json:"status"`
+	Error     string       `json:"error,omitempty"`
+	LSN       uint64       `json:"lsn,omitempty"`
+	Op        string       `json:"op,omitempty"`
+	Key       types.Key    `json:"key,omitempty"`
+	Value     *string      `json:"value,omitempty"`
+	ValueSize int          `json:"value_size,omitempty"`
+	Timestamp *time.Time   `json:"timestamp,omitempty"`
+	TTL       string       `json:"ttl,omitempty"`
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+	Version   uint64       `json:"version,omitempty"`
+	Entries   []dumpMember `json:"entries,omitempty"` // OpBatchSet and OpCommit
+	Keys      []types.Key  `json:"keys,omitempty"`    // OpBatchDelete and OpCommit
+}
+
+// dumpMember is one entry of a batch set
+type dumpMember struct {
+	Key       types.Key  `json:"key"`
+	Value     *string    `json:"value,omitempty"`
+	ValueSize int        `json:"value_size,omitempty"`
+	TTL       string     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   uint64     `json:"version,omitempty"`
+}
+
+// String returns the name Dump prints for the operation
+func (op OperationType) String() string {
+	switch op {
+	case OpSet:
+		return "set"
+	case OpDelete:
+		return "delete"
+	case OpClear:
+		return "clear"
+	case OpBatchSet:
+		return "batch-set"
+	case OpBatchDelete:
+		return "batch-delete"
+	case OpCompact:
+		return "compact"
+	case OpCommit:
+		return "commit"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(op))
+	}
+}
+
+// Dump prints every record of the WAL files still on disk, archived
+// segments first and the active file last, in format. Damaged records are
+// reported and the dump carries on after them, so it shows the files as
+// recovery will find them.
+func (w *WAL) Dump(out io.Writer, format DumpFormat) error {
+	d, err := newDumper(out, format)
+	if err != nil {
+		return err
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return fmt.Errorf("WAL is closed")
+	}
+
+	for _, segment := range w.segments {
+		data, err := vfs.ReadFile(w.fs, segment.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read WAL segment: %w", err)
+		}
+		title := fmt.Sprintf("segment %d", segment.Number)
+		if segment.Number <= w.checkpoint {
+			title += ", checkpointed"
+		}
+		if err := d.dumpFile(segment.Path, title, data, w.read.maxRecordSize); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, w.currentSize)
+	if _, err := io.ReadFull(io.NewSectionReader(w.file, 0, w.currentSize), data); err != nil {
+		return fmt.Errorf("failed to read WAL: %w", err)
+	}
+	return d.dumpFile(w.filePath, "active", data, w.read.maxRecordSize)
+}
+
+// DumpFile prints every record of the WAL file at path, archived segment
+// or active file, in format. It reads the file without opening the WAL,
+// which would drop a damaged tail.
+func DumpFile(fsys vfs.FS, path string, out io.Writer, format DumpFormat) error {
+	d, err := newDumper(out, format)
+	if err != nil {
+		return err
+	}
+
+	data, err := vfs.ReadFile(fsys, path)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL: %w", err)
+	}
+	return d.dumpFile(path, "", data, DefaultMaxRecordSize)
+}
+
+// dumper prints records in one format
+type dumper struct {
+	out    io.Writer
+	format DumpFormat
+}
+
+func newDumper(out io.Writer, format DumpFormat) (*dumper, error) {
+	if format != DumpText && format != DumpJSON {
+		return nil, fmt.Errorf("unknown WAL dump format %q", format)
+	}
+	return &dumper{out: out, format: format}, nil
+}
+
+// dumpFile prints the records of the WAL file at path, whose contents are
+// data, under a heading naming it and what it is
+func (d *dumper) dumpFile(path, title string, data []byte, maxRecordSize int64) error {
+	name := filepath.Base(path)
+	version, offset, err := decodeWALHeader(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	if d.format == DumpText {
+		heading := name
+		if title != "" {
+			heading += " (" + title + ")"
+		}
+		if _, err := fmt.Fprintf(d.out, "# %s: format %d, %d bytes\n", heading, version, len(data)); err != nil {
+			return err
+		}
+	}
+
+	for offset < len(data) {
+		record := dumpRecord{File: name, Offset: int64(offset)}
+		entry, size, ok := decodeWALEntry(data[offset:], version, maxRecordSize)
+		if ok {
+			record.Size = int64(size)
+			record.Status = dumpOK
+			if version == walFormatLegacy {
+				record.Status = dumpNoCRC
+			}
+		} else {
+			next := findWALEntry(data, offset+1, version, maxRecordSize)
+			record.Status = dumpCorrupt
+			if next < 0 {
+				next = len(data)
+				record.Status = dumpTorn
+			}
+			record.Size = int64(next - offset)
+			entry, record.Error = diagnoseWALEntry(data[offset:], version, maxRecordSize)
+			size = next - offset
+		}
+		if entry != nil {
+			record.describe(entry)
+		}
+
+		if err := d.print(record); err != nil {
+			return err
+		}
+		offset += size
+	}
+
+	return nil
+}
+
+// describe fills in what record says about entry
+func (record *dumpRecord) describe(entry *WALEntry) {
+	record.LSN = entry.LSN
+	record.Op = entry.Type.String()
+	record.Key = entry.Key
+	if entry.Type == OpSet {
+		record.Value, record.ValueSize = dumpValue(entry.Value)
+	}
+	if !entry.Timestamp.IsZero() {
+		timestamp := entry.Timestamp
+		record.Timestamp = &timestamp
+	}
+	record.TTL = dumpTTL(entry.TTL)
+	record.ExpiresAt = entry.ExpiresAt
+	record.Version = entry.Version
+	for _, member := range entry.Entries {
+		value, valueSize := dumpValue(member.Value)
+		record.Entries = append(record.Entries, dumpMember{
+			Key:       member.Key,
+			Value:     value,
+			ValueSize: valueSize,
+			TTL:       dumpTTL(member.TTL),
+			ExpiresAt: dumpExpiry(member.ExpiresAt),
+			Version:   member.Version,
+		})
+	}
+	record.Keys = entry.Keys
+}
+
+// dumpValue returns value as Dump prints it, if it is small and text, and
+// its size
+func dumpValue(value types.Value) (*string, int) {
+	if len(value) > dumpValueLimit || !utf8.Valid(value) {
+		return nil, len(value)
+	}
+	s := string(value)
+	return &s, len(value)
+}
+
+func dumpTTL(ttl *time.Duration) string {
+	if ttl == nil {
+		return ""
+	}
+	return ttl.String()
+}
+
+func dumpExpiry(expiresAt time.Time) *time.Time {
+	if expiresAt.IsZero() {
+		return nil
+	}
+	return &expiresAt
+}
+
+// print writes record in the dumper's format
+func (d *dumper) print(record dumpRecord) error {
+	if d.format == DumpJSON {
+		return json.NewEncoder(d.out).Encode(record)
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "offset=%d size=%d", record.Offset, record.Size)
+	if record.LSN > 0 {
+		fmt.Fprintf(&line, " lsn=%d", record.LSN)
+	}
+	if record.Op != "" {
+		fmt.Fprintf(&line, " op=%s", record.Op)
+	}
+	if record.Key != "" {
+		fmt.Fprintf(&line, " key=%q", record.Key)
+	}
+	writeTextValue(&line, record.Value, record.ValueSize)
+	if record.Timestamp != nil {
+		fmt.Fprintf(&line, " timestamp=%s", record.Timestamp.Format(time.RFC3339Nano))
+	}
+	if record.TTL != "" {
+		fmt.Fprintf(&line, " ttl=%s", record.TTL)
+	}
+	if record.ExpiresAt != nil {
+		fmt.Fprintf(&line, " expires=%s", record.ExpiresAt.Format(time.RFC3339Nano))
+	}
+	if record.Version != 0 {
+		fmt.Fprintf(&line, " version=%d", record.Version)
+	}
+	if len(record.Entries) > 0 {
+		fmt.Fprintf(&line, " entries=%d", len(record.Entries))
+	}
+	if len(record.Keys) > 0 {
+		fmt.Fprintf(&line, " keys=%d", len(record.Keys))
+	}
+	fmt.Fprintf(&line, " status=%s", record.Status)
+	if record.Error != "" {
+		fmt.Fprintf(&line, " error=%q", record.Error)
+	}
+	line.WriteString("\n")
+
+	// Batch members follow on their own lines
+	for _, member := range record.Entries {
+		fmt.Fprintf(&line, "  key=%q", member.Key)
+		writeTextValue(&line, member.Value, member.ValueSize)
+		if member.TTL != "" {
+			fmt.Fprintf(&line, " ttl=%s", member.TTL)
+		}
+		if member.ExpiresAt != nil {
+			fmt.Fprintf(&line, " expires=%s", member.ExpiresAt.Format(time.RFC3339Nano))
+		}
+		if member.Version != 0 {
+			fmt.Fprintf(&line, " version=%d", member.Version)
+		}
+		line.WriteString("\n")
+	}
+	for _, key := range record.Keys {
+		fmt.Fprintf(&line, "  key=%q\n", key)
+	}
+
+	_, err := io.WriteString(d.out, line.String())
+	return err
+}
+
+// writeTextValue writes a value, or its size if it isn't printed
+func writeTextValue(line *strings.Builder, value *string, size int) {
+	if value != nil {
+		fmt.Fprintf(line, " value=%q", *value)
+	} else if size > 0 {
+		fmt.Fprintf(line, " value_size=%d", size)
+	}
+}
+
+// diagnoseWALEntry explains why the entry at the start of buf doesn't
+// decode, returning as much of it as still parses
+func diagnoseWALEntry(buf []byte, version uint32, maxRecordSize int64) (*WALEntry, string) {
+	if len(buf) < 4 {
+		return nil, fmt.Sprintf("%d bytes left, too few for a length prefix", len(buf))
+	}
+
+	length := int64(binary.LittleEndian.Uint32(buf))
+	if length > maxRecordSize {
+		return nil, fmt.Sprintf("length %d exceeds the limit of %d bytes", length, maxRecordSize)
+	}
+	size := 4 + length
+	if version != walFormatLegacy {
+		size += 4
+	}
+	if size > int64(len(buf)) {
+		return nil, fmt.Sprintf("length %d runs past the end of the file", length)
+	}
+
+	var entry WALEntry
+	parseErr := json.Unmarshal(buf[4:4+length], &entry)
+	if version != walFormatLegacy {
+		checksum := binary.LittleEndian.Uint32(buf[4+length:])
+		if crc32.Checksum(buf[:4+length], crcTable) != checksum {
+			if parseErr != nil {
+				return nil, "checksum mismatch"
+			}
+			return &entry, "checksum mismatch"
+		}
+	}
+	if parseErr != nil {
+		return nil, fmt.Sprintf("entry doesn't parse: %v", parseErr)
+	}
+	return nil, "unreadable entry"
+}
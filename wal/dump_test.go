@@ -0,0 +1,151 @@
+package wal_test
+
+import (
+	"bytes"
+	"database_engine/types"
+	"database_engine/vfs"
+	"database_engine/wal"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// encodeEntry returns entry as a WAL file stores it: length prefix, JSON
+// and CRC-32C
+func encodeEntry(t *testing.T, entry wal.WALEntry) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(entry)
+	require.NoError(t, err)
+	record := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	record = append(record, data...)
+	return binary.LittleEndian.AppendUint32(record, crc32.Checksum(record, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// writeDumpWAL writes a WAL file holding every kind of entry, a damaged
+// one, garbage and a torn tail
+func writeDumpWAL(t *testing.T, path string) {
+	t.Helper()
+
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ttl := time.Minute
+	entry := func(lsn uint64, op wal.OperationType, key types.Key) wal.WALEntry {
+		return wal.WALEntry{LSN: lsn, Type: op, Key: key, Timestamp: timestamp.Add(time.Duration(lsn) * time.Second)}
+	}
+
+	set := entry(1, wal.OpSet, "key000")
+	set.Value = types.Value("value")
+	withTTL := entry(2, wal.OpSet, "key001")
+	withTTL.Value = types.Value("expiring")
+	withTTL.TTL = &ttl
+	large := entry(3, wal.OpSet, "key002")
+	large.Value = bytes.Repeat([]byte("x"), 100)
+	binaryValue := entry(4, wal.OpSet, "key003")
+	binaryValue.Value = types.Value{0xff, 0xfe}
+	batchSet := entry(5, wal.OpBatchSet, "")
+	batchSet.Entries = []types.Entry{
+		{Key: "key004", Value: types.Value("a")},
+		{Key: "key005", Value: types.Value("b"), TTL: &ttl},
+	}
+	batchDelete := entry(6, wal.OpBatchDelete, "")
+	batchDelete.Keys = []types.Key{"key004", "key005"}
+
+	data := append([]byte("KVWL"), 2, 0, 0, 0)
+	for _, e := range []wal.WALEntry{set, withTTL, large, binaryValue, batchSet, batchDelete} {
+		data = append(data, encodeEntry(t, e)...)
+	}
+
+	// A delete whose checksum was damaged still shows what it was
+	damaged := encodeEntry(t, entry(7, wal.OpDelete, "key000"))
+	damaged[len(damaged)-1] ^= 0xff
+	data = append(data, damaged...)
+	data = append(data, encodeEntry(t, entry(8, wal.OpClear, ""))...)
+	data = append(data, "garbage!"...)
+	data = append(data, encodeEntry(t, entry(9, wal.OpCompact, ""))...)
+
+	torn := encodeEntry(t, entry(10, wal.OpDelete, "key001"))
+	data = append(data, torn[:len(torn)/2]...)
+
+	require.NoError(t, os.WriteFile(path, data, 0644))
+}
+
+func TestDumpFileText(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	writeDumpWAL(t, walPath)
+
+	var out bytes.Buffer
+	require.NoError(t, wal.DumpFile(vfs.OS, walPath, &out, wal.DumpText))
+
+	golden := filepath.Join("testdata", "dump.golden")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, out.Bytes(), 0644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), out.String())
+}
+
+func TestDumpFileJSON(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	writeDumpWAL(t, walPath)
+
+	var out bytes.Buffer
+	require.NoError(t, wal.DumpFile(vfs.OS, walPath, &out, wal.DumpJSON))
+
+	var statuses []string
+	var lsns []uint64
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record struct {
+			File   string `json:"file"`
+			Status string `json:"status"`
+			LSN    uint64 `json:"lsn"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, "test.wal", record.File)
+		statuses = append(statuses, record.Status)
+		lsns = append(lsns, record.LSN)
+	}
+
+	// Damage is reported in place and the dump carries on past it
+	assert.Equal(t, []string{"ok", "ok", "ok", "ok", "ok", "ok", "corrupt", "ok", "corrupt", "ok", "torn"}, statuses)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7, 8, 0, 9, 0}, lsns)
+
+	assert.Error(t, wal.DumpFile(vfs.OS, walPath, &out, "xml"))
+}
+
+func TestWALDump(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for _, key := range testKeys(0, 2) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Checkpoint())
+	_, err = w.LogDelete("key000")
+	require.NoError(t, err)
+
+	// Every file on disk is dumped, segments first
+	var out bytes.Buffer
+	require.NoError(t, w.Dump(&out, wal.DumpText))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.True(t, strings.HasPrefix(lines[0], "# test-000001.wal (segment 1, checkpointed): format 2"), lines[0])
+	assert.Contains(t, lines[1], `lsn=1 op=set key="key000" value="value"`)
+	assert.Contains(t, lines[2], `lsn=2 op=set key="key001" value="value"`)
+	assert.True(t, strings.HasPrefix(lines[3], "# test.wal (active): format 2"), lines[3])
+	assert.Contains(t, lines[4], `lsn=3 op=delete key="key000"`)
+	assert.True(t, strings.HasSuffix(lines[4], "status=ok"), lines[4])
+}
@@ -0,0 +1,393 @@
+package wal
+
+import (
+	"database_engine/vfs"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment is one file of the WAL. Rotate archives the active file as the
+// next numbered segment, so entries are read from the archived segments in
+// number order and then from the active file.
+type Segment struct {
+	Path   string `json:"path"`
+	Number uint64 `json:"number"` // 0 for the active file
+	Size   int64  `json:"size"`
+	Active bool   `json:"active"`
+
+	generation uint64 // Generation of the WAL the segment was active in
+}
+
+// segmentDigits is the minimum width of the number in a segment's file name
+const segmentDigits = 6
+
+// legacyArchiveLayout is the timestamp Rotate appended to the WAL file name
+// before segments were numbered
+const legacyArchiveLayout = "20060102_150405"
+
+// SegmentPath returns the path of archived segment n of the WAL at
+// filePath. The segments of wal.log are wal-000001.log, wal-000002.log and
+// so on.
+func SegmentPath(filePath string, n uint64) string {
+	ext := filepath.Ext(filePath)
+	return fmt.Sprintf("%s-%0*d%s", strings.TrimSuffix(filePath, ext), segmentDigits, n, ext)
+}
+
+// SegmentNumber returns the number of the segment of the WAL at filePath
+// named name, and false if name isn't one
+func SegmentNumber(filePath, name string) (uint64, bool) {
+	base := filepath.Base(filePath)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+	if len(name) < len(prefix)+segmentDigits+len(ext) ||
+		!strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return 0, false
+	}
+
+	n, err := strconv.ParseUint(name[len(prefix):len(name)-len(ext)], 10, 64)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// ArchivedSegments returns the archived segments of the WAL at filePath,
+// oldest first. It doesn't need the WAL to be open.
+func ArchivedSegments(fsys vfs.FS, filePath string) ([]Segment, error) {
+	dir := filepath.Dir(filePath)
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list WAL segments: %w", err)
+	}
+
+	var segments []Segment
+	for _, entry := range entries {
+		n, ok := SegmentNumber(filePath, entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		segments = append(segments, Segment{
+			Path:   filepath.Join(dir, entry.Name()),
+			Number: n,
+			Size:   info.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Number < segments[j].Number
+	})
+
+	return segments, nil
+}
+
+// checkpointMarker is the content of the checkpoint file
+type checkpointMarker struct {
+	Segment uint64 `json:"segment"` // Newest segment whose entries are applied
+	LSN     uint64 `json:"lsn"`     // Last LSN assigned when the marker was written
+}
+
+// CheckpointPath returns the path of the file recording the last checkpoint
+// of the WAL at filePath: wal.checkpoint for wal.log
+func CheckpointPath(filePath string) string {
+	return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".checkpoint"
+}
+
+// readCheckpoint returns the marker written by the last checkpoint of the
+// WAL at filePath, or a zero marker if there is none. An unreadable marker
+// is ignored: replaying entries that were already applied is harmless,
+// skipping ones that weren't is not.
+func readCheckpoint(fsys vfs.FS, filePath string, log *slog.Logger) checkpointMarker {
+	data, err := vfs.ReadFile(fsys, CheckpointPath(filePath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("failed to read WAL checkpoint", "path", CheckpointPath(filePath), "error", err)
+		}
+		return checkpointMarker{}
+	}
+
+	var marker checkpointMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		log.Warn("ignoring corrupt WAL checkpoint", "path", CheckpointPath(filePath), "error", err)
+		return checkpointMarker{}
+	}
+	return marker
+}
+
+// writeCheckpoint atomically replaces the checkpoint file of the WAL at
+// filePath with marker
+func writeCheckpoint(fsys vfs.FS, filePath string, marker checkpointMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+
+	path := CheckpointPath(filePath)
+	file, err := vfs.Create(fsys, path+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return vfs.SyncDir(fsys, filepath.Dir(path))
+}
+
+// migrateLegacyArchives renames archives named <WAL file>.<timestamp>,
+// which nothing used to read, to numbered segments after the existing
+// ones and the checkpoint, oldest first, so their entries are replayed
+func migrateLegacyArchives(fsys vfs.FS, filePath string, checkpoint uint64) error {
+	legacy, err := legacyArchives(fsys, filePath)
+	if err != nil || len(legacy) == 0 {
+		return err
+	}
+
+	segments, err := ArchivedSegments(fsys, filePath)
+	if err != nil {
+		return err
+	}
+	next := checkpoint + 1
+	if len(segments) > 0 {
+		next = max(next, segments[len(segments)-1].Number+1)
+	}
+
+	for _, name := range legacy {
+		oldPath := filepath.Join(filepath.Dir(filePath), name)
+		if err := fsys.Rename(oldPath, SegmentPath(filePath, next)); err != nil {
+			return fmt.Errorf("failed to rename WAL archive %s: %w", name, err)
+		}
+		next++
+	}
+
+	return nil
+}
+
+// legacyArchives returns the names of the archives of the WAL at filePath
+// named <WAL file>.<timestamp>, oldest first
+func legacyArchives(fsys vfs.FS, filePath string) ([]string, error) {
+	entries, err := fsys.ReadDir(filepath.Dir(filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list WAL archives: %w", err)
+	}
+
+	prefix := filepath.Base(filePath) + "."
+	var legacy []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(legacyArchiveLayout, name[len(prefix):]); err == nil {
+			legacy = append(legacy, name)
+		}
+	}
+	sort.Strings(legacy) // The timestamps sort chronologically
+	return legacy, nil
+}
+
+// PendingEntries returns the entries of the WAL at filePath that opening
+// it would replay, those after the last checkpoint, and how many corrupt
+// ones were skipped under Options.SkipCorrupt. Unlike opening the WAL it
+// changes nothing: legacy archives are read where they would be renamed
+// to, and a torn or corrupt tail is left in place rather than truncated.
+func PendingEntries(filePath string, options Options) ([]*WALEntry, int, error) {
+	if err := options.validate(); err != nil {
+		return nil, 0, err
+	}
+	fsys := options.FS
+	if fsys == nil {
+		fsys = vfs.OS
+	}
+	read := options.readOptions()
+
+	checkpoint := readCheckpoint(fsys, filePath, read.log).Segment
+	segments, err := ArchivedSegments(fsys, filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	legacy, err := legacyArchives(fsys, filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var paths []string
+	for _, segment := range segments {
+		if segment.Number > checkpoint {
+			paths = append(paths, segment.Path)
+		}
+	}
+	for _, name := range legacy {
+		paths = append(paths, filepath.Join(filepath.Dir(filePath), name))
+	}
+
+	var all []*WALEntry
+	for _, path := range paths {
+		entries, err := readSegmentEntries(fsys, path, read)
+		if err != nil {
+			return nil, int(read.skipped.Load()), err
+		}
+		all = append(all, entries...)
+	}
+
+	file, err := vfs.Open(fsys, filePath)
+	if os.IsNotExist(err) {
+		return all, int(read.skipped.Load()), nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer file.Close()
+
+	entries, _, _, err := readEntries(file, read)
+	if err != nil {
+		return nil, int(read.skipped.Load()), err
+	}
+	return append(all, entries...), int(read.skipped.Load()), nil
+}
+
+// readSegment reads every entry of an archived segment
+func (w *WAL) readSegment(path string) ([]*WALEntry, error) {
+	return readSegmentEntries(w.fs, path, w.read)
+}
+
+// readSegmentEntries reads every entry of the archived segment at path
+func readSegmentEntries(fsys vfs.FS, path string, read readOptions) ([]*WALEntry, error) {
+	file, err := vfs.Open(fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer file.Close()
+
+	entries, _, _, err := readEntries(file, read)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL segment %s: %w", filepath.Base(path), err)
+	}
+	return entries, nil
+}
+
+// ListSegments returns the archived segments, oldest first, followed by
+// the active file
+func (w *WAL) ListSegments() []Segment {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.listSegments()
+}
+
+// listSegments implements ListSegments. The caller holds mu.
+func (w *WAL) listSegments() []Segment {
+	segments := make([]Segment, 0, len(w.segments)+1)
+	segments = append(segments, w.segments...)
+	return append(segments, Segment{Path: w.filePath, Size: w.currentSize, Active: true})
+}
+
+// TotalSize returns the size of the active file and every archived segment
+func (w *WAL) TotalSize() int64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.totalSize()
+}
+
+// totalSize implements TotalSize. The caller holds mu.
+func (w *WAL) totalSize() int64 {
+	size := w.currentSize
+	for _, segment := range w.segments {
+		size += segment.Size
+	}
+	return size
+}
+
+// Checkpoint records that every entry logged so far has been applied to
+// durable storage elsewhere and is no longer needed for recovery. The
+// active file is rotated so those entries all sit in archived segments,
+// and the newest of them is recorded in the checkpoint file. ReadEntries
+// skips the segments it covers from then on, including after a reopen, and
+// CleanupSegments may delete them.
+func (w *WAL) Checkpoint() error {
+	w.flush()
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("WAL is closed")
+	}
+
+	if w.currentSize > 0 {
+		if err := w.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if len(w.segments) == 0 || w.segments[len(w.segments)-1].Number == w.checkpoint {
+		return nil
+	}
+
+	segment := w.segments[len(w.segments)-1].Number
+	if err := writeCheckpoint(w.fs, w.filePath, checkpointMarker{Segment: segment, LSN: w.nextLSN - 1}); err != nil {
+		return fmt.Errorf("failed to write WAL checkpoint: %w", err)
+	}
+	w.checkpoint = segment
+	w.checkpointLSN = w.nextLSN - 1
+	w.checkpoints.Add(1)
+	w.read.log.Info("checkpointed WAL", "segment", segment, "lsn", w.checkpointLSN)
+
+	return nil
+}
+
+// CleanupSegments deletes the archived segments the last Checkpoint
+// covered, except for the newest Options.RetainSegments of them, and
+// returns how many it deleted
+func (w *WAL) CleanupSegments() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fmt.Errorf("WAL is closed")
+	}
+
+	covered := 0
+	for covered < len(w.segments) && w.segments[covered].Number <= w.checkpoint {
+		covered++
+	}
+
+	removed := 0
+	for removed < covered-w.retainSegments {
+		if err := w.fs.Remove(w.segments[0].Path); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+		w.segments = w.segments[1:]
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,152 @@
+package wal
+
+import (
+	"bufio"
+	"database_engine/types"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+)
+
+// ErrLSNOrder is returned by Apply for an entry whose LSN doesn't follow
+// the last one applied
+var ErrLSNOrder = errors.New("WAL entry out of order")
+
+// Shipper streams a WAL's committed entries to a writer, for a warm
+// standby that applies them with Apply. The stream has the format of a WAL
+// file: a header, then each entry length-prefixed and followed by a CRC-32C.
+type Shipper struct {
+	dst      io.Writer
+	started  bool          // The header has been written
+	position atomic.Uint64 // LSN of the last entry written
+}
+
+// NewShipper returns a Shipper that writes to dst
+func NewShipper(dst io.Writer) *Shipper {
+	return &Shipper{dst: dst}
+}
+
+// Ship writes each entry tailer returns to dst until the tailer fails, for
+// instance because its context is done, or a write does, and returns the
+// error it stopped with. After a disconnect, shipping resumes from a
+// Tailer that starts at the LSN after the last one the replica applied.
+func (s *Shipper) Ship(tailer *Tailer) error {
+	if !s.started {
+		if _, err := s.dst.Write(encodeWALHeader()); err != nil {
+			return fmt.Errorf("failed to ship WAL header: %w", err)
+		}
+		s.started = true
+	}
+
+	for {
+		entry, err := tailer.Next()
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal WAL entry: %w", err)
+		}
+		frame := make([]byte, 0, 4+len(data)+4)
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(data)))
+		frame = append(frame, data...)
+		frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(frame, crcTable))
+		if _, err := s.dst.Write(frame); err != nil {
+			return fmt.Errorf("failed to ship WAL entry %d: %w", entry.LSN, err)
+		}
+		s.position.Store(entry.LSN)
+	}
+}
+
+// Position returns the LSN of the last entry shipped, 0 if there is none
+func (s *Shipper) Position() uint64 {
+	return s.position.Load()
+}
+
+// Apply applies the entries of a stream written by a Shipper to storage,
+// in order, until the stream ends. Each entry must carry the LSN after the
+// one before it. It returns the LSN of the last entry applied, also when it
+// fails, so a replica can have shipping resume after it. Entries are
+// accepted up to DefaultMaxRecordSize.
+func Apply(src io.Reader, storage types.StorageEngine) (uint64, error) {
+	return ApplyFrom(src, storage, 0)
+}
+
+// ApplyFrom is Apply for a replica that has already applied the entries up
+// to lastLSN. Entries up to it are skipped, and the first one after them
+// must be the next LSN.
+func ApplyFrom(src io.Reader, storage types.StorageEngine, lastLSN uint64) (uint64, error) {
+	r := bufio.NewReader(src)
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return lastLSN, nil
+		}
+		return lastLSN, fmt.Errorf("failed to read shipped WAL header: %w", err)
+	}
+	version, _, err := decodeWALHeader(header)
+	if err != nil {
+		return lastLSN, err
+	}
+	if version != walFormatCRC {
+		return lastLSN, fmt.Errorf("%w: shipped stream has no WAL header", ErrCorruptWAL)
+	}
+
+	for {
+		entry, err := readShippedEntry(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return lastLSN, nil
+			}
+			return lastLSN, err
+		}
+
+		if entry.LSN <= lastLSN {
+			continue // Applied before the stream was resumed
+		}
+		if lastLSN > 0 && entry.LSN != lastLSN+1 {
+			return lastLSN, fmt.Errorf("%w: got %d after %d", ErrLSNOrder, entry.LSN, lastLSN)
+		}
+		if err := Replay([]*WALEntry{entry}, storage); err != nil {
+			return lastLSN, err
+		}
+		lastLSN = entry.LSN
+	}
+}
+
+// readShippedEntry reads the next entry of a shipped stream. It returns
+// io.EOF if the stream ends before the entry starts.
+func readShippedEntry(r io.Reader) (*WALEntry, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read shipped WAL entry: %w", err)
+	}
+
+	length := int64(binary.LittleEndian.Uint32(prefix[:]))
+	if length > DefaultMaxRecordSize {
+		return nil, fmt.Errorf("%w: shipped entry of %d bytes", ErrRecordTooLarge, length)
+	}
+	buf := make([]byte, 4+length+4)
+	copy(buf, prefix[:])
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read shipped WAL entry: %w", err)
+	}
+
+	entry, _, ok := decodeWALEntry(buf, walFormatCRC, DefaultMaxRecordSize)
+	if !ok {
+		return nil, fmt.Errorf("%w: shipped entry fails its checksum or doesn't parse", ErrCorruptWAL)
+	}
+	return entry, nil
+}
@@ -0,0 +1,121 @@
+package wal_test
+
+import (
+	"bytes"
+	"context"
+	"database_engine/storage"
+	"database_engine/types"
+	"database_engine/wal"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// shipAll returns the stream a Shipper writes for w's entries from
+// fromLSN on
+func shipAll(t *testing.T, w *wal.WAL, fromLSN uint64) []byte {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tailer, err := w.Tail(ctx, fromLSN)
+	require.NoError(t, err)
+
+	var stream bytes.Buffer
+	assert.ErrorIs(t, wal.NewShipper(&stream).Ship(tailer), context.DeadlineExceeded)
+	return stream.Bytes()
+}
+
+func TestShipApply(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+
+	tailer, err := w.Tail(context.Background(), 1)
+	require.NoError(t, err)
+	reader, writer := io.Pipe()
+	shipper := wal.NewShipper(writer)
+	shipped := make(chan error, 1)
+	go func() {
+		err := shipper.Ship(tailer)
+		writer.Close()
+		shipped <- err
+	}()
+
+	replica := storage.NewInMemoryStorage()
+	type result struct {
+		lsn uint64
+		err error
+	}
+	applied := make(chan result, 1)
+	go func() {
+		lsn, err := wal.Apply(reader, replica)
+		applied <- result{lsn, err}
+	}()
+
+	// Entries reach the replica as they are logged
+	_, err = w.LogSet("key000", types.Value("value"), nil)
+	require.NoError(t, err)
+	_, err = w.LogBatchSet([]types.Entry{{Key: "key001", Value: types.Value("a")}, {Key: "key002", Value: types.Value("b")}})
+	require.NoError(t, err)
+	_, err = w.LogDelete("key001")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return shipper.Position() == 3 }, 5*time.Second, time.Millisecond)
+
+	// Closing the WAL ends the stream
+	require.NoError(t, w.Close())
+	assert.ErrorIs(t, <-shipped, wal.ErrClosed)
+	r := <-applied
+	require.NoError(t, r.err)
+	assert.Equal(t, uint64(3), r.lsn)
+
+	keys, err := replica.Keys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []types.Key{"key000", "key002"}, keys)
+}
+
+func TestApplyFrom(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	for _, key := range testKeys(0, 5) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	stream := shipAll(t, w, 1)
+
+	// A replica that is part way through skips what it already applied
+	replica := storage.NewInMemoryStorage()
+	lsn, err := wal.ApplyFrom(bytes.NewReader(stream), replica, 2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), lsn)
+	keys, err := replica.Keys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, testKeys(2, 5), keys)
+
+	// but won't jump over entries it hasn't
+	lsn, err = wal.ApplyFrom(bytes.NewReader(shipAll(t, w, 4)), storage.NewInMemoryStorage(), 2)
+	assert.ErrorIs(t, err, wal.ErrLSNOrder)
+	assert.Equal(t, uint64(2), lsn)
+
+	// A stream cut short applies the entries that arrived whole
+	lsn, err = wal.Apply(bytes.NewReader(stream[:len(stream)-3]), storage.NewInMemoryStorage())
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, uint64(4), lsn)
+
+	// and a damaged one stops at the damage
+	damaged := bytes.Clone(stream)
+	damaged[len(damaged)-10] ^= 0xff
+	lsn, err = wal.Apply(bytes.NewReader(damaged), storage.NewInMemoryStorage())
+	assert.ErrorIs(t, err, wal.ErrCorruptWAL)
+	assert.Equal(t, uint64(4), lsn)
+
+	lsn, err = wal.Apply(bytes.NewReader(nil), storage.NewInMemoryStorage())
+	require.NoError(t, err)
+	assert.Zero(t, lsn)
+	_, err = wal.Apply(bytes.NewReader([]byte("not a WAL stream")), storage.NewInMemoryStorage())
+	assert.ErrorIs(t, err, wal.ErrCorruptWAL)
+}
@@ -0,0 +1,229 @@
+package wal
+
+import (
+	"context"
+	"database_engine/types"
+	"database_engine/vfs"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ErrClosed is returned by a Tailer whose WAL was closed
+var ErrClosed = errors.New("WAL is closed")
+
+// ErrLSNUnavailable is returned by a Tailer that has to deliver an entry
+// the WAL no longer holds, because a Clear or CleanupSegments removed it
+var ErrLSNUnavailable = errors.New("WAL entry no longer available")
+
+// Tailer reads a WAL's entries in LSN order as they are committed, for
+// change data capture. An entry is returned once it is as durable as the
+// sync policy promises: once fsynced under the always, interval and everyN
+// policies, and once written under the never policy. Rotation doesn't
+// interrupt it. A Tailer is meant for one goroutine.
+type Tailer struct {
+	wal      *WAL
+	ctx      context.Context
+	cursor   tailCursor
+	pending  []*WALEntry   // Read but not yet returned
+	next     uint64        // LSN of the next entry to return, 0 for the oldest on disk
+	position atomic.Uint64 // LSN of the last entry returned
+	err      error         // Why tailing stopped
+}
+
+// tailCursor is where a Tailer stopped reading: offset bytes into the file
+// that was active in the given generation, which is archived as segment
+type tailCursor struct {
+	started    bool
+	generation uint64
+	segment    uint64
+	offset     int64
+	version    uint32
+}
+
+// Tail returns a Tailer that returns the committed entries with an LSN of
+// at least fromLSN, starting with those already on disk, and then waits for
+// new ones until ctx is done. A fromLSN of 0 starts at the oldest entry on
+// disk. A consumer that records the LSN of the last entry it processed can
+// resume after a restart by tailing from the one after it.
+func (w *WAL) Tail(ctx context.Context, fromLSN uint64) (*Tailer, error) {
+	if w.IsClosed() {
+		return nil, ErrClosed
+	}
+
+	t := &Tailer{wal: w, ctx: ctx, next: fromLSN}
+	if fromLSN > 0 {
+		t.position.Store(fromLSN - 1)
+	}
+	return t, nil
+}
+
+// Next returns the next committed entry, waiting for one if the Tailer has
+// caught up. Once it fails it keeps returning the same error: the
+// context's, ErrClosed once the WAL is closed, ErrLSNUnavailable if the
+// next entry has been removed, or the error reading the WAL failed with.
+func (t *Tailer) Next() (*WALEntry, error) {
+	for t.err == nil {
+		for len(t.pending) > 0 {
+			entry := t.pending[0]
+			t.pending = t.pending[1:]
+			if entry.LSN < t.next || entry.LSN == 0 {
+				continue
+			}
+			if t.next > 0 && entry.LSN > t.next {
+				t.err = fmt.Errorf("%w: next entry is %d, wanted %d", ErrLSNUnavailable, entry.LSN, t.next)
+				return nil, t.err
+			}
+			t.next = entry.LSN + 1
+			t.position.Store(entry.LSN)
+			return entry, nil
+		}
+
+		if err := t.ctx.Err(); err != nil {
+			t.err = err
+			break
+		}
+
+		// Taken before reading, so a commit after the read still wakes us
+		wake := t.wal.tailSignal()
+
+		entries, err := t.wal.readTail(&t.cursor)
+		if err != nil {
+			t.err = err
+			break
+		}
+		if len(entries) > 0 {
+			t.pending = entries
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-t.ctx.Done():
+			t.err = t.ctx.Err()
+		case <-t.wal.stopped:
+			t.err = ErrClosed
+		}
+	}
+
+	return nil, t.err
+}
+
+// Position returns the LSN of the last entry Next returned, or the one
+// before the LSN tailing started from if it hasn't returned any
+func (t *Tailer) Position() uint64 {
+	return t.position.Load()
+}
+
+// readTail reads the committed entries after cursor and moves it past them.
+// A cursor that hasn't started reads every segment on disk; one whose file
+// has since been archived finishes that segment and reads the ones after it.
+func (w *WAL) readTail(cursor *tailCursor) ([]*WALEntry, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return nil, ErrClosed
+	}
+
+	var all []*WALEntry
+	if !cursor.started || cursor.generation != w.generation {
+		for _, segment := range w.segments {
+			if cursor.started && segment.Number < cursor.segment {
+				continue
+			}
+			var from tailCursor
+			if cursor.started && segment.Number == cursor.segment && segment.generation == cursor.generation {
+				from = *cursor
+			}
+			entries, err := w.readTailSegment(segment.Path, &from, segment.Size)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, entries...)
+		}
+		*cursor = tailCursor{started: true, generation: w.generation}
+	}
+	cursor.segment = w.nextSegment
+
+	entries, err := readTailFile(w.file, cursor, w.committedSize(), w.read)
+	if err != nil {
+		return nil, err
+	}
+	return append(all, entries...), nil
+}
+
+// readTailSegment reads the entries of the archived segment at path, which
+// is size bytes long, from cursor on
+func (w *WAL) readTailSegment(path string, cursor *tailCursor, size int64) ([]*WALEntry, error) {
+	file, err := vfs.Open(w.fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL segment: %w", err)
+	}
+	defer file.Close()
+
+	return readTailFile(file, cursor, size, w.read)
+}
+
+// readTailFile reads the entries of file between cursor and end and moves
+// cursor past them. A cursor at offset 0 reads the header first.
+func readTailFile(file vfs.File, cursor *tailCursor, end int64, read readOptions) ([]*WALEntry, error) {
+	if end <= cursor.offset {
+		return nil, nil
+	}
+
+	data := make([]byte, end-cursor.offset)
+	if n, err := file.ReadAt(data, cursor.offset); err != nil && !(errors.Is(err, io.EOF) && n == len(data)) {
+		return nil, fmt.Errorf("failed to read WAL: %w", err)
+	}
+
+	offset := 0
+	if cursor.offset == 0 {
+		version, start, err := decodeWALHeader(data)
+		if err != nil {
+			return nil, err
+		}
+		cursor.version, offset = version, start
+	}
+
+	entries, next, err := decodeEntries(data, offset, cursor.offset, cursor.version, read)
+	if err != nil {
+		return nil, err
+	}
+	cursor.offset = next
+	return entries, nil
+}
+
+// committedSize returns how much of the active file tailers may read: what
+// has been synced, or everything written under the never policy, which
+// promises no more than that. The caller holds mu.
+func (w *WAL) committedSize() int64 {
+	if w.syncPolicy == types.WALSyncNever {
+		return w.currentSize
+	}
+	return min(w.synced.Load(), w.currentSize)
+}
+
+// tailSignal returns a channel that is closed the next time entries are
+// committed or the WAL is replaced or closed
+func (w *WAL) tailSignal() <-chan struct{} {
+	w.tailMu.Lock()
+	defer w.tailMu.Unlock()
+
+	if w.tailWait == nil {
+		w.tailWait = make(chan struct{})
+	}
+	return w.tailWait
+}
+
+// wakeTailers wakes the tailers waiting for entries to be committed
+func (w *WAL) wakeTailers() {
+	w.tailMu.Lock()
+	defer w.tailMu.Unlock()
+
+	if w.tailWait != nil {
+		close(w.tailWait)
+		w.tailWait = nil
+	}
+}
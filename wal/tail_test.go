@@ -0,0 +1,162 @@
+package wal_test
+
+import (
+	"context"
+	"database_engine/types"
+	"database_engine/wal"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// next returns the next n entries from tailer
+func next(t *testing.T, tailer *wal.Tailer, n int) []*wal.WALEntry {
+	t.Helper()
+
+	entries := make([]*wal.WALEntry, 0, n)
+	for len(entries) < n {
+		entry, err := tailer.Next()
+		require.NoError(t, err)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestWALTail(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.LogSet("key000", types.Value("value"), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tailer, err := w.Tail(ctx, 0)
+	require.NoError(t, err)
+
+	// A writer rotates the WAL as it goes; the tailer sees every entry once,
+	// in order
+	const total = 200
+	errs := make(chan error, 1)
+	go func() {
+		for i, key := range testKeys(1, total) {
+			if _, err := w.LogSet(key, types.Value("value"), nil); err != nil {
+				errs <- err
+				return
+			}
+			if i%30 == 0 {
+				if err := w.Rotate(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+		errs <- nil
+	}()
+
+	entries := next(t, tailer, total)
+	require.NoError(t, <-errs)
+	assert.Equal(t, testKeys(0, total), walKeys(entries))
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.LSN)
+	}
+	assert.Equal(t, uint64(total), tailer.Position())
+
+	// Once caught up it waits until the context is done
+	cancel()
+	_, err = tailer.Next()
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestWALTailResume(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+
+	for _, key := range testKeys(0, 5) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	tailer, err := w.Tail(context.Background(), 0)
+	require.NoError(t, err)
+	next(t, tailer, 3)
+	position := tailer.Position()
+	assert.Equal(t, uint64(3), position)
+
+	// Closing the WAL stops a tailer that is waiting
+	next(t, tailer, 2)
+	done := make(chan error)
+	go func() {
+		_, err := tailer.Next()
+		done <- err
+	}()
+	require.NoError(t, w.Close())
+	assert.ErrorIs(t, <-done, wal.ErrClosed)
+
+	// After a restart it picks up after the last entry processed
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	require.NoError(t, w.Rotate())
+	_, err = w.LogSet("key005", types.Value("value"), nil)
+	require.NoError(t, err)
+
+	tailer, err = w.Tail(context.Background(), position+1)
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(3, 6), walKeys(next(t, tailer, 3)))
+}
+
+func TestWALTailSyncPolicy(t *testing.T) {
+	w, err := wal.NewWALWithOptions(filepath.Join(t.TempDir(), "test.wal"), wal.Options{
+		MaxSize:    1024 * 1024,
+		SyncPolicy: types.WALSyncEveryN,
+		SyncEvery:  3,
+	})
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Entries are only returned once the sync that makes them durable has
+	// happened
+	for _, key := range testKeys(0, 2) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tailer, err := w.Tail(ctx, 1)
+	require.NoError(t, err)
+	_, err = tailer.Next()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	tailer, err = w.Tail(context.Background(), 1)
+	require.NoError(t, err)
+	_, err = w.LogSet("key002", types.Value("value"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(0, 3), walKeys(next(t, tailer, 3)))
+}
+
+func TestWALTailUnavailable(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	for _, key := range testKeys(0, 3) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Checkpoint())
+	_, err = w.CleanupSegments()
+	require.NoError(t, err)
+	_, err = w.LogSet("key003", types.Value("value"), nil)
+	require.NoError(t, err)
+
+	// The entries it would start with are gone
+	tailer, err := w.Tail(context.Background(), 2)
+	require.NoError(t, err)
+	_, err = tailer.Next()
+	assert.ErrorIs(t, err, wal.ErrLSNUnavailable)
+}
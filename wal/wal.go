@@ -1,14 +1,22 @@
 package wal
 
 import (
+	"bytes"
 	"database_engine/types"
+	"database_engine/vfs"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,41 +26,316 @@ type OperationType uint8
 const (
 	OpSet    OperationType = 1
 	OpDelete OperationType = 2
+	OpClear  OperationType = 3
+
+	// OpBatchSet and OpBatchDelete log a whole batch as one entry, so a
+	// crash can't leave part of a batch to be replayed
+	OpBatchSet    OperationType = 4
+	OpBatchDelete OperationType = 5
+
+	// OpCompact marks where the data file was compacted. It changes no
+	// data, so replay skips it; tailers see where compactions happened.
+	OpCompact OperationType = 6
+
+	// OpCommit logs the sets and deletes of a transaction as one entry.
+	// Like a batch, a commit cut short by a crash fails its checksum and
+	// is dropped whole, so no begin or commit markers are needed to keep
+	// replay from applying part of a transaction.
+	OpCommit OperationType = 7
+)
+
+// WAL file formats. Legacy files have no header and store each entry as a
+// length-prefixed JSON document. Current files start with walHeaderSize
+// bytes (walFileMagic followed by the version) and follow every entry with
+// a CRC-32C of its length prefix and JSON. The header is written with the
+// first entry, so an empty file is a current one. Legacy files keep their
+// format until Clear or Rotate starts a new file.
+const (
+	walFormatLegacy uint32 = 1
+	walFormatCRC    uint32 = 2
+
+	walHeaderSize = 8
 )
 
+// walFileMagic identifies a versioned WAL file. Read as a legacy length
+// prefix it would announce a ~1.3GB entry.
+var walFileMagic = [4]byte{'K', 'V', 'W', 'L'}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrRecordTooLarge is returned for an entry larger than the WAL's
+// Options.MaxRecordSize
+var ErrRecordTooLarge = errors.New("WAL entry too large")
+
+// ErrCorruptWAL is returned when a WAL entry that is followed by valid ones
+// fails its length or checksum check and Options.SkipCorrupt is not set
+var ErrCorruptWAL = errors.New("corrupt WAL")
+
 // WALEntry represents a single entry in the Write-Ahead Log
 type WALEntry struct {
-	Type      OperationType `json:"type"`
-	Key       types.Key     `json:"key"`
-	Value     types.Value   `json:"value,omitempty"`
-	Timestamp time.Time     `json:"timestamp"`
+	Type      OperationType  `json:"type"`
+	Key       types.Key      `json:"key"`
+	Value     types.Value    `json:"value,omitempty"`
+	LSN       uint64         `json:"lsn,omitempty"` // 0 for entries written before LSNs
+	Timestamp time.Time      `json:"timestamp"`
 	TTL       *time.Duration `json:"ttl,omitempty"`
+	ExpiresAt *time.Time     `json:"expires_at,omitempty"` // OpSet with a TTL
+	Version   uint64         `json:"version,omitempty"`    // OpSet, 0 for entries written before versions
+	CreatedAt *time.Time     `json:"created_at,omitempty"` // OpSet, when the key was first written
+	Revision  uint64         `json:"revision,omitempty"`   // OpSet, 0 for entries written before revisions
+	Entries   []types.Entry  `json:"entries,omitempty"`    // OpBatchSet and OpCommit
+	Keys      []types.Key    `json:"keys,omitempty"`       // OpBatchDelete and OpCommit
 }
 
 // WAL represents the Write-Ahead Log
+//
+// Appends are queued for a single writer goroutine, which takes everything
+// queued at once, writes it with one write under mu, fsyncs it with one
+// fsync if the sync policy requires it, and then releases the appenders in
+// the order they queued. Appends that arrive during an fsync make up the
+// next batch, so concurrent writers share fsyncs and don't contend for mu.
+// The writer holds syncMu for a whole batch; syncMu is always taken before
+// mu.
 type WAL struct {
-	file        *os.File
-	mu          sync.RWMutex
-	closed      bool
-	filePath    string
-	maxSize     int64
-	currentSize int64
+	fs           vfs.FS
+	file         vfs.File
+	mu           sync.RWMutex
+	closed       bool
+	filePath     string
+	maxSize      int64
+	currentSize  int64
+	version      uint32 // Format of the current file
+	read         readOptions
+	maxKeySize   int
+	maxValueSize int
+
+	segments       []Segment // Archived segments, oldest first
+	nextSegment    uint64    // Number the next rotation archives the active file as
+	checkpoint     uint64    // Newest segment covered by the last Checkpoint, read from the checkpoint file
+	checkpointLSN  uint64    // Last LSN assigned when that Checkpoint was recorded
+	retainSegments int
+
+	nextLSN uint64 // LSN of the next entry, guarded by mu
+
+	syncPolicy string
+	syncEvery  int
+	unsynced   int    // Entries since the last everyN sync, guarded by mu
+	generation uint64 // Bumped when Clear or Rotate replaces the file, guarded by mu and syncMu
+
+	syncMu sync.Mutex
+	synced atomic.Int64 // Bytes of the current file known to be on disk, written under syncMu
+
+	entries      atomic.Uint64
+	bytes        atomic.Uint64
+	appendNanos  atomic.Uint64 // Time appends spent queued and being written, for the average latency
+	syncs        atomic.Uint64
+	rotations    atomic.Uint64
+	lastRotation atomic.Int64 // Unix nanoseconds, 0 before the first rotation
+	checkpoints  atomic.Uint64
+
+	stopped    chan struct{} // Closed by Close to stop the interval syncer and tailers
+	syncerDone chan struct{}
+
+	queue      chan *walRequest // Appends waiting for the writer, closed by Close
+	queueMu    sync.RWMutex     // Held to send on queue, and by Close to close it
+	draining   bool             // queue is closed, guarded by queueMu
+	queued     atomic.Int64     // Entries appended but not yet written
+	writerDone chan struct{}    // Closed once the writer has written everything queued
+
+	tailMu   sync.Mutex
+	tailWait chan struct{} // Closed to wake tailers, created by the first one to wait
+}
+
+// Stats describes a WAL's activity since it was opened
+type Stats struct {
+	SyncPolicy    string `json:"sync_policy"`
+	Size          int64  `json:"size"`           // Size of the active file
+	UnsyncedBytes int64  `json:"unsynced_bytes"` // Written but not yet fsynced
+	Entries       uint64 `json:"entries"`        // Entries written
+	BytesWritten  uint64 `json:"bytes_written"`  // Bytes of entries and headers written
+	Syncs         uint64 `json:"syncs"`          // fsync calls made
+
+	// CorruptSkipped counts the corrupt entries reads have skipped under
+	// Options.SkipCorrupt, each time they were read
+	CorruptSkipped uint64 `json:"corrupt_skipped"`
+
+	// AvgAppendLatency is the mean time an append took to write its entry,
+	// including waiting in the queue but not for the fsync
+	AvgAppendLatency time.Duration `json:"avg_append_latency"`
+
+	Rotations    uint64    `json:"rotations"`     // Rotations performed, including by Checkpoint
+	LastRotation time.Time `json:"last_rotation"` // Zero if there has been none since opening
+	Checkpoints  uint64    `json:"checkpoints"`   // Checkpoints recorded
+
+	Segments         []Segment `json:"segments"`          // Archived segments, oldest first, then the active file
+	ArchivedSegments int       `json:"archived_segments"` // Number of archived segments
+	ArchivedSize     int64     `json:"archived_size"`     // Size of the archived segments
+	TotalSize        int64     `json:"total_size"`        // Size of all segments
+	Checkpoint       uint64    `json:"checkpoint"`        // Newest segment covered by the last Checkpoint
+	CheckpointLSN    uint64    `json:"checkpoint_lsn"`    // Last LSN assigned when it was recorded
+	LastLSN          uint64    `json:"last_lsn"`          // LSN of the last entry logged
+}
+
+// Pending is an entry appended to the WAL that may not be written or on
+// disk yet
+type Pending struct {
+	req *walRequest
+}
+
+// walRequest is an append waiting for the writer. done is closed once its
+// entry is as durable as the sync policy promises, or has failed. A request
+// without an entry only waits for the ones queued before it.
+type walRequest struct {
+	entry  *WALEntry
+	queued time.Time
+	lsn    uint64 // Set once the entry is written
+	err    error
+	done   chan struct{}
+}
+
+// The writer's queue holds up to writeQueueSize appends, and it writes up
+// to maxWriteBatch of them at once
+const (
+	writeQueueSize = 1024
+	maxWriteBatch  = 256
+)
+
+// Options configures a WAL opened with NewWALWithOptions
+type Options struct {
+	MaxSize int64        // Size in bytes from which ShouldRotate reports true
+	FS      vfs.FS       // Filesystem the WAL's files are accessed through, vfs.OS when nil
+	Logger  *slog.Logger // Logs recovered damage, rotations and checkpoints; nil discards them
+
+	// SkipCorrupt skips a corrupt entry that is followed by valid ones
+	// instead of failing with ErrCorruptWAL. A corrupt or torn tail is
+	// always truncated.
+	SkipCorrupt bool
+
+	// SyncPolicy decides when entries are fsynced, one of the
+	// types.WALSync* policies; empty selects types.WALSyncAlways.
+	// SyncPeriod is the interval policy's period and SyncEvery the number
+	// of entries between fsyncs under the everyN policy.
+	SyncPolicy string
+	SyncPeriod time.Duration
+	SyncEvery  int
+
+	// RetainSegments is the number of checkpointed segments that
+	// CleanupSegments keeps, newest first
+	RetainSegments int
+
+	// MaxKeySize and MaxValueSize reject keys and values larger than
+	// this before anything is written; 0 allows any size. MaxRecordSize
+	// bounds a whole entry, batches included, when it is written and
+	// when it is read back, where a longer length prefix is treated as
+	// damage. It defaults to DefaultMaxRecordSize, raised if needed to fit
+	// a single entry of the maximum key and value sizes.
+	MaxKeySize    int
+	MaxValueSize  int
+	MaxRecordSize int64
+}
+
+// DefaultMaxRecordSize is the largest entry a WAL writes or reads unless
+// Options.MaxRecordSize says otherwise
+const DefaultMaxRecordSize = 64 << 20
+
+// recordSizeFor returns the size of the largest entry holding a key and a
+// value of the given sizes: JSON escapes a key byte to at most six bytes
+// and base64 takes four for every three value bytes, with room left for
+// the other fields
+func recordSizeFor(maxKeySize, maxValueSize int) int64 {
+	return 6*int64(maxKeySize) + 4*(int64(maxValueSize)+2)/3 + 1024
+}
+
+// validate checks the sync policy settings and size limits
+func (o Options) validate() error {
+	switch o.SyncPolicy {
+	case "", types.WALSyncAlways, types.WALSyncNever:
+	case types.WALSyncInterval:
+		if o.SyncPeriod <= 0 {
+			return fmt.Errorf("WAL sync policy %q requires a positive sync period", o.SyncPolicy)
+		}
+	case types.WALSyncEveryN:
+		if o.SyncEvery <= 0 {
+			return fmt.Errorf("WAL sync policy %q requires a positive entry count", o.SyncPolicy)
+		}
+	default:
+		return fmt.Errorf("unknown WAL sync policy %q", o.SyncPolicy)
+	}
+	if o.MaxKeySize < 0 || o.MaxValueSize < 0 || o.MaxRecordSize < 0 {
+		return fmt.Errorf("WAL size limits can't be negative")
+	}
+	return nil
+}
+
+// readOptions returns how entries are read under o
+func (o Options) readOptions() readOptions {
+	read := readOptions{skipCorrupt: o.SkipCorrupt, maxRecordSize: o.MaxRecordSize, skipped: new(atomic.Uint64), log: types.LoggerOrDiscard(o.Logger)}
+	if read.maxRecordSize == 0 {
+		read.maxRecordSize = max(DefaultMaxRecordSize, recordSizeFor(o.MaxKeySize, o.MaxValueSize))
+	}
+	return read
 }
 
 // NewWAL creates a new Write-Ahead Log
 func NewWAL(filePath string, maxSize int64) (*WAL, error) {
+	return NewWALWithFS(filePath, maxSize, vfs.OS)
+}
+
+// NewWALWithFS creates a new Write-Ahead Log whose files are accessed through fsys
+func NewWALWithFS(filePath string, maxSize int64, fsys vfs.FS) (*WAL, error) {
+	return NewWALWithOptions(filePath, Options{MaxSize: maxSize, FS: fsys})
+}
+
+// NewWALWithOptions creates a new Write-Ahead Log configured by options
+func NewWALWithOptions(filePath string, options Options) (*WAL, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	if options.SyncPolicy == "" {
+		options.SyncPolicy = types.WALSyncAlways
+	}
+	read := options.readOptions()
+
+	fsys := options.FS
+	if fsys == nil {
+		fsys = vfs.OS
+	}
+
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(filePath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
 	}
 
+	// Segments are numbered past the checkpoint even once the ones it
+	// covers are gone, so a new segment is never mistaken for an old one
+	marker := readCheckpoint(fsys, filePath, read.log)
+	checkpoint := marker.Segment
+	if err := migrateLegacyArchives(fsys, filePath, checkpoint); err != nil {
+		return nil, err
+	}
+	segments, err := ArchivedSegments(fsys, filePath)
+	if err != nil {
+		return nil, err
+	}
+	nextSegment := checkpoint + 1
+	if len(segments) > 0 {
+		nextSegment = max(nextSegment, segments[len(segments)-1].Number+1)
+	}
+
 	// Open or create WAL file
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	file, err := fsys.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL file: %w", err)
 	}
 
+	// Keep a newly created file, and any archives migrated above, in the
+	// directory after a power failure
+	if err := vfs.SyncDir(fsys, dir); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
+
 	// Get current file size
 	stat, err := file.Stat()
 	if err != nil {
@@ -60,86 +343,576 @@ func NewWAL(filePath string, maxSize int64) (*WAL, error) {
 		return nil, fmt.Errorf("failed to get WAL file stats: %w", err)
 	}
 
+	// Drop an entry torn by a crash, or a damaged tail, so new entries
+	// don't land behind it
+	entries, version, end, err := readEntries(file, read)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if end < stat.Size() {
+		read.log.Warn("discarded torn or corrupt WAL tail", "path", filePath, "offset", end, "bytes", stat.Size()-end)
+		if err := file.Truncate(end); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate torn WAL entry: %w", err)
+		}
+	}
+
+	// Carry on from the last LSN assigned: the newest entry, or the one the
+	// checkpoint recorded when no entry after it is left
+	lastLSN := marker.LSN
+	if len(entries) == 0 && len(segments) > 0 {
+		entries, err = readSegmentEntries(fsys, segments[len(segments)-1].Path, read)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	for _, entry := range entries {
+		lastLSN = max(lastLSN, entry.LSN)
+	}
+
 	wal := &WAL{
-		file:        file,
-		filePath:    filePath,
-		maxSize:     maxSize,
-		currentSize: stat.Size(),
-		closed:      false,
+		fs:           fsys,
+		file:         file,
+		filePath:     filePath,
+		maxSize:      options.MaxSize,
+		currentSize:  end,
+		version:      version,
+		read:         read,
+		maxKeySize:   options.MaxKeySize,
+		maxValueSize: options.MaxValueSize,
+		syncPolicy:   options.SyncPolicy,
+		syncEvery:    options.SyncEvery,
+		closed:       false,
+
+		segments:       segments,
+		nextSegment:    nextSegment,
+		checkpoint:     checkpoint,
+		checkpointLSN:  marker.LSN,
+		retainSegments: options.RetainSegments,
+		nextLSN:        lastLSN + 1,
+		stopped:        make(chan struct{}),
+		queue:          make(chan *walRequest, writeQueueSize),
+		writerDone:     make(chan struct{}),
+	}
+	wal.synced.Store(end)
+	go wal.runWriter()
+
+	if wal.syncPolicy == types.WALSyncInterval {
+		wal.syncerDone = make(chan struct{})
+		go wal.runSyncer(options.SyncPeriod)
 	}
 
 	return wal, nil
 }
 
-// writeEntry writes a WAL entry to the file
-func (w *WAL) writeEntry(entry *WALEntry) error {
-	// Serialize entry
-	entryData, err := json.Marshal(entry)
-	if err != nil {
-		return fmt.Errorf("failed to marshal WAL entry: %w", err)
+// runSyncer fsyncs the WAL every period until Close, for the interval policy
+func (w *WAL) runSyncer(period time.Duration) {
+	defer close(w.syncerDone)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-ticker.C:
+			w.syncMu.Lock()
+			if err := w.syncLocked(); err != nil && !w.IsClosed() {
+				w.read.log.Error("failed to sync WAL", "path", w.filePath, "error", err)
+			}
+			w.syncMu.Unlock()
+		}
+	}
+}
+
+// runWriter writes the entries appended to the queue until Close closes it.
+// Whatever has queued up while it wrote and fsynced the last batch makes up
+// the next one.
+func (w *WAL) runWriter() {
+	defer close(w.writerDone)
+
+	batch := make([]*walRequest, 0, maxWriteBatch)
+	for req := range w.queue {
+		// After a batch of several, other appenders are likely ready to
+		// run; let them queue up behind this one before taking the batch
+		concurrent := len(batch) > 1
+		batch = append(batch[:0], req)
+		if concurrent {
+			runtime.Gosched()
+		}
+	collect:
+		for len(batch) < maxWriteBatch {
+			select {
+			case req, ok := <-w.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+		w.writeBatch(batch)
+	}
+}
+
+// writeBatch writes the entries of batch, fsyncs them once if the sync
+// policy requires it, and then completes the requests in the order they
+// were queued
+func (w *WAL) writeBatch(batch []*walRequest) {
+	w.syncMu.Lock()
+	needSync, err := w.writeEntries(batch)
+	written := time.Now()
+	if err == nil && needSync {
+		err = w.syncLocked()
+	}
+	w.syncMu.Unlock()
+
+	for _, req := range batch {
+		if req.entry != nil {
+			w.queued.Add(-1)
+		}
+		if req.lsn != 0 {
+			w.appendNanos.Add(uint64(written.Sub(req.queued)))
+		}
+		if req.entry != nil && req.err == nil {
+			req.err = err
+		}
+		close(req.done)
 	}
+}
+
+// writeEntries assigns the entries of batch the next LSNs and writes them
+// to the file with a single call, so a failure can't separate them. An
+// entry that can't be encoded fails alone and takes no LSN. It reports
+// whether the sync policy wants the entries fsynced. The caller holds
+// syncMu.
+func (w *WAL) writeEntries(batch []*walRequest) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	// Write length prefix (4 bytes)
-	length := uint32(len(entryData))
-	if err := binary.Write(w.file, binary.LittleEndian, length); err != nil {
-		return fmt.Errorf("failed to write WAL entry length: %w", err)
+	if w.closed {
+		return false, fmt.Errorf("WAL is closed")
 	}
 
-	// Write entry data
-	if _, err := w.file.Write(entryData); err != nil {
-		return fmt.Errorf("failed to write WAL entry data: %w", err)
+	// The first entry of a file carries the header
+	var record []byte
+	if w.currentSize == 0 && w.version != walFormatLegacy {
+		record = encodeWALHeader()
+	}
+
+	lsn, count := w.nextLSN, 0
+	for _, req := range batch {
+		if req.entry == nil {
+			continue
+		}
+		req.entry.LSN = lsn
+
+		// Serialize entry
+		entryData, err := json.Marshal(req.entry)
+		if err != nil {
+			req.err = fmt.Errorf("failed to marshal WAL entry: %w", err)
+			continue
+		}
+		if int64(len(entryData)) > w.read.maxRecordSize {
+			req.err = fmt.Errorf("%w: %d bytes, limit %d", ErrRecordTooLarge, len(entryData), w.read.maxRecordSize)
+			continue
+		}
+
+		// Length prefix (4 bytes) followed by the entry data and its checksum
+		start := len(record)
+		record = binary.LittleEndian.AppendUint32(record, uint32(len(entryData)))
+		record = append(record, entryData...)
+		if w.version != walFormatLegacy {
+			record = binary.LittleEndian.AppendUint32(record, crc32.Checksum(record[start:], crcTable))
+		}
+		req.lsn = lsn
+		lsn++
+		count++
+	}
+	if count == 0 {
+		return false, nil
+	}
+
+	if _, err := w.file.Write(record); err != nil {
+		for _, req := range batch {
+			req.lsn = 0
+		}
+		// Drop any partial entry so later entries stay readable
+		if truncErr := w.file.Truncate(w.currentSize); truncErr != nil {
+			return false, fmt.Errorf("failed to write WAL entry: %w (rollback failed: %v)", err, truncErr)
+		}
+		return false, fmt.Errorf("failed to write WAL entry: %w", err)
 	}
 
 	// Update current size
-	w.currentSize += int64(4 + len(entryData))
+	w.currentSize += int64(len(record))
+	w.nextLSN = lsn
+	w.entries.Add(uint64(count))
+	w.bytes.Add(uint64(len(record)))
+
+	needSync := false
+	switch w.syncPolicy {
+	case types.WALSyncAlways:
+		needSync = true
+	case types.WALSyncEveryN:
+		w.unsynced += count
+		if w.unsynced >= w.syncEvery {
+			w.unsynced = 0
+			needSync = true
+		}
+	case types.WALSyncNever:
+		w.wakeTailers()
+	}
+
+	return needSync, nil
+}
+
+// append queues entry for the writer and returns what its caller has to
+// wait for
+func (w *WAL) append(entry *WALEntry) (Pending, error) {
+	w.queueMu.RLock()
+	defer w.queueMu.RUnlock()
+
+	if w.draining {
+		return Pending{}, fmt.Errorf("WAL is closed")
+	}
+
+	req := &walRequest{entry: entry, queued: time.Now(), done: make(chan struct{})}
+	w.queued.Add(1)
+	w.queue <- req
+	return Pending{req: req}, nil
+}
+
+// flush waits until the entries appended so far have been written
+func (w *WAL) flush() {
+	w.queueMu.RLock()
+	if w.draining {
+		w.queueMu.RUnlock()
+		<-w.writerDone
+		return
+	}
+	req := &walRequest{done: make(chan struct{})}
+	w.queue <- req
+	w.queueMu.RUnlock()
+
+	<-req.done
+}
+
+// LSN waits until the entry is written and returns its log sequence
+// number, 0 if it couldn't be written
+func (p Pending) LSN() uint64 {
+	if p.req == nil {
+		return 0
+	}
+	<-p.req.done
+	return p.req.lsn
+}
 
-	// Sync to disk for durability
-	if err := w.file.Sync(); err != nil {
+// Wait blocks until the entry is as durable as the WAL's sync policy
+// promises and returns the error writing or syncing it failed with: on
+// disk under the always policy, on disk together with every entry before
+// it when it completes a group of the everyN policy, and written under the
+// interval and never policies.
+func (p Pending) Wait() error {
+	if p.req == nil {
+		return nil
+	}
+	<-p.req.done
+	return p.req.err
+}
+
+// syncLocked fsyncs everything written so far. The caller holds syncMu,
+// which keeps the file from being replaced or closed underneath it.
+func (w *WAL) syncLocked() error {
+	w.mu.RLock()
+	file, size, closed := w.file, w.currentSize, w.closed
+	w.mu.RUnlock()
+
+	if closed {
+		return fmt.Errorf("WAL is closed")
+	}
+	if w.synced.Load() >= size {
+		return nil
+	}
+
+	if err := file.Sync(); err != nil {
 		return fmt.Errorf("failed to sync WAL to disk: %w", err)
 	}
+	w.syncs.Add(1)
+	w.synced.Store(size)
+	w.wakeTailers()
 
 	return nil
 }
 
-// LogSet logs a SET operation
-func (w *WAL) LogSet(key types.Key, value types.Value, ttl *time.Duration) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// Sync fsyncs every entry appended so far, whatever the sync policy
+func (w *WAL) Sync() error {
+	w.flush()
 
-	if w.closed {
-		return fmt.Errorf("WAL is closed")
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	return w.syncLocked()
+}
+
+// Stats returns the WAL's size, sync policy and write and fsync counts
+func (w *WAL) Stats() Stats {
+	w.mu.RLock()
+	size := w.currentSize
+	segments, totalSize := w.listSegments(), w.totalSize()
+	checkpoint, checkpointLSN, lastLSN := w.checkpoint, w.checkpointLSN, w.nextLSN-1
+	w.mu.RUnlock()
+
+	stats := Stats{
+		SyncPolicy:       w.syncPolicy,
+		Size:             size,
+		UnsyncedBytes:    max(size-w.synced.Load(), 0),
+		Entries:          w.entries.Load(),
+		BytesWritten:     w.bytes.Load(),
+		Syncs:            w.syncs.Load(),
+		CorruptSkipped:   w.read.skipped.Load(),
+		Rotations:        w.rotations.Load(),
+		Checkpoints:      w.checkpoints.Load(),
+		Segments:         segments,
+		ArchivedSegments: len(segments) - 1,
+		ArchivedSize:     totalSize - size,
+		TotalSize:        totalSize,
+		Checkpoint:       checkpoint,
+		CheckpointLSN:    checkpointLSN,
+		LastLSN:          lastLSN,
+	}
+	if stats.Entries > 0 {
+		stats.AvgAppendLatency = time.Duration(w.appendNanos.Load() / stats.Entries)
+	}
+	if rotated := w.lastRotation.Load(); rotated != 0 {
+		stats.LastRotation = time.Unix(0, rotated)
 	}
 
-	entry := &WALEntry{
+	return stats
+}
+
+// LogSet logs a SET operation, waits for it to be synced as the sync
+// policy requires and returns its LSN
+func (w *WAL) LogSet(key types.Key, value types.Value, ttl *time.Duration) (uint64, error) {
+	return logged(w.AppendSet(key, value, ttl))
+}
+
+// AppendSet queues a SET operation for the writer without waiting for it
+// to be written or synced; Wait on the result returns the error either
+// failed with. Entries are logged in the order they are appended, so a
+// caller can append under its own lock and wait after releasing it,
+// letting concurrent writers share a write and an fsync.
+func (w *WAL) AppendSet(key types.Key, value types.Value, ttl *time.Duration) (Pending, error) {
+	var expiresAt time.Time
+	if ttl != nil {
+		expiresAt = time.Now().Add(*ttl)
+	}
+	return w.AppendSetWithExpiry(key, value, ttl, expiresAt)
+}
+
+// AppendSetWithExpiry queues a SET operation for a key that expires at
+// expiresAt, or never if it is zero, like AppendSet. Replay gives the key
+// that expiry rather than ttl from when it is replayed.
+func (w *WAL) AppendSetWithExpiry(key types.Key, value types.Value, ttl *time.Duration, expiresAt time.Time) (Pending, error) {
+	return w.AppendSetEntry(&types.Entry{Key: key, Value: value, TTL: ttl, ExpiresAt: expiresAt})
+}
+
+// AppendSetEntry queues a SET operation for entry like AppendSetWithExpiry,
+// keeping its version, revision and creation and update times as well as
+// its expiry for replay
+func (w *WAL) AppendSetEntry(entry *types.Entry) (Pending, error) {
+	if err := w.checkEntry(entry.Key, entry.Value); err != nil {
+		return Pending{}, err
+	}
+	logged := &WALEntry{
 		Type:      OpSet,
+		Key:       entry.Key,
+		Value:     entry.Value,
+		Timestamp: entry.UpdatedAt,
+		TTL:       entry.TTL,
+		Version:   entry.Version,
+		Revision:  entry.Revision,
+	}
+	if logged.Timestamp.IsZero() {
+		logged.Timestamp = time.Now()
+	}
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt := entry.ExpiresAt
+		logged.ExpiresAt = &expiresAt
+	}
+	if !entry.CreatedAt.IsZero() {
+		createdAt := entry.CreatedAt
+		logged.CreatedAt = &createdAt
+	}
+	return w.append(logged)
+}
+
+// LogDelete logs a DELETE operation, waits for it to be synced as the sync
+// policy requires and returns its LSN
+func (w *WAL) LogDelete(key types.Key) (uint64, error) {
+	return logged(w.AppendDelete(key))
+}
+
+// AppendDelete queues a DELETE operation without waiting for it to be
+// written, like AppendSet
+func (w *WAL) AppendDelete(key types.Key) (Pending, error) {
+	if err := w.checkEntry(key, nil); err != nil {
+		return Pending{}, err
+	}
+	return w.append(&WALEntry{
+		Type:      OpDelete,
 		Key:       key,
-		Value:     value,
 		Timestamp: time.Now(),
-		TTL:       ttl,
-	}
+	})
+}
 
-	return w.writeEntry(entry)
+// LogBatchSet logs a batch of SET operations as a single entry, waits for
+// it to be synced as the sync policy requires and returns its LSN
+func (w *WAL) LogBatchSet(entries []types.Entry) (uint64, error) {
+	return logged(w.AppendBatchSet(entries))
 }
 
-// LogDelete logs a DELETE operation
-func (w *WAL) LogDelete(key types.Key) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+// AppendBatchSet queues a batch of SET operations as a single entry
+// without waiting for it to be written, like AppendSet
+func (w *WAL) AppendBatchSet(entries []types.Entry) (Pending, error) {
+	return w.appendBatch(OpBatchSet, entries, nil)
+}
 
-	if w.closed {
-		return fmt.Errorf("WAL is closed")
-	}
+// LogBatchDelete logs a batch of DELETE operations as a single entry,
+// waits for it to be synced as the sync policy requires and returns its LSN
+func (w *WAL) LogBatchDelete(keys []types.Key) (uint64, error) {
+	return logged(w.AppendBatchDelete(keys))
+}
+
+// AppendBatchDelete queues a batch of DELETE operations as a single entry
+// without waiting for it to be written, like AppendSet
+func (w *WAL) AppendBatchDelete(keys []types.Key) (Pending, error) {
+	return w.appendBatch(OpBatchDelete, nil, keys)
+}
+
+// AppendCommit queues the sets and deletes of a transaction as a single
+// entry without waiting for it to be written, like AppendSet. Replay
+// applies the sets and then the deletes.
+func (w *WAL) AppendCommit(entries []types.Entry, keys []types.Key) (Pending, error) {
+	return w.appendBatch(OpCommit, entries, keys)
+}
+
+// CheckBatch checks the sets and deletes of a batch or commit against the
+// size limits AppendBatchSet, AppendBatchDelete and AppendCommit apply, so a
+// caller that must write elsewhere before it logs can reject an entry the
+// WAL would refuse before anything is written
+func (w *WAL) CheckBatch(entries []types.Entry, keys []types.Key) error {
+	return w.checkBatch(&WALEntry{Type: OpCommit, Timestamp: time.Now(), Entries: entries, Keys: keys})
+}
 
+// appendBatch checks and queues a single entry of type op holding entries
+// and keys
+func (w *WAL) appendBatch(op OperationType, entries []types.Entry, keys []types.Key) (Pending, error) {
 	entry := &WALEntry{
-		Type:      OpDelete,
-		Key:       key,
+		Type:      op,
 		Timestamp: time.Now(),
+		Entries:   entries,
+		Keys:      keys,
+	}
+	if err := w.checkBatch(entry); err != nil {
+		return Pending{}, err
+	}
+	return w.append(entry)
+}
+
+// checkBatch checks the sets and deletes of entry with checkEntry, and the
+// whole entry against Options.MaxRecordSize. Entries that are clearly small
+// enough aren't marshalled; the rest are, with the largest LSN they could
+// be given.
+func (w *WAL) checkBatch(entry *WALEntry) error {
+	for _, e := range entry.Entries {
+		if err := w.checkEntry(e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	for _, key := range entry.Keys {
+		if err := w.checkEntry(key, nil); err != nil {
+			return err
+		}
 	}
 
-	return w.writeEntry(entry)
+	if maxEncodedSize(entry) <= w.read.maxRecordSize {
+		return nil
+	}
+	probe := *entry
+	probe.LSN = math.MaxUint64
+	data, err := json.Marshal(&probe)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WAL entry: %w", err)
+	}
+	if int64(len(data)) > w.read.maxRecordSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrRecordTooLarge, len(data), w.read.maxRecordSize)
+	}
+	return nil
+}
+
+// maxEncodedSize is an upper bound on the size entry marshals to: keys may
+// have every byte escaped as \u00XX, values are base64-encoded and the
+// remaining fields of each entry fit in a fixed allowance
+func maxEncodedSize(entry *WALEntry) int64 {
+	const allowance = 512
+	size := allowance + 6*int64(len(entry.Key)) + 4*(int64(len(entry.Value))+2)/3
+	for _, e := range entry.Entries {
+		size += allowance + 6*int64(len(e.Key)) + 4*(int64(len(e.Value))+2)/3
+	}
+	for _, key := range entry.Keys {
+		size += 8 + 6*int64(len(key))
+	}
+	return size
+}
+
+// LogClear logs a CLEAR operation that removes every key, waits for it to
+// be synced as the sync policy requires and returns its LSN
+func (w *WAL) LogClear() (uint64, error) {
+	return logged(w.append(&WALEntry{
+		Type:      OpClear,
+		Timestamp: time.Now(),
+	}))
 }
 
-// ReadEntries reads all entries from the WAL file
+// LogCompact logs that the data file was compacted, waits for it to be
+// synced as the sync policy requires and returns its LSN
+func (w *WAL) LogCompact() (uint64, error) {
+	return logged(w.append(&WALEntry{
+		Type:      OpCompact,
+		Timestamp: time.Now(),
+	}))
+}
+
+// checkEntry checks a key and value against Options.MaxKeySize and
+// Options.MaxValueSize
+func (w *WAL) checkEntry(key types.Key, value types.Value) error {
+	if w.maxKeySize > 0 && len(key) > w.maxKeySize {
+		return fmt.Errorf("%w: key of %d bytes exceeds the limit of %d", types.ErrInvalidKey, len(key), w.maxKeySize)
+	}
+	if w.maxValueSize > 0 && len(value) > w.maxValueSize {
+		return fmt.Errorf("%w: value of %d bytes exceeds the limit of %d", types.ErrInvalidValue, len(value), w.maxValueSize)
+	}
+	return nil
+}
+
+// logged waits for an appended entry and returns its LSN
+func logged(pending Pending, err error) (uint64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if err := pending.Wait(); err != nil {
+		return 0, err
+	}
+	return pending.LSN(), nil
+}
+
+// ReadEntries reads all entries from the archived segments after the last
+// checkpoint, oldest first, and then from the active file
 func (w *WAL) ReadEntries() ([]*WALEntry, error) {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
@@ -148,39 +921,213 @@ func (w *WAL) ReadEntries() ([]*WALEntry, error) {
 		return nil, fmt.Errorf("WAL is closed")
 	}
 
-	// Seek to beginning of file
-	if _, err := w.file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("failed to seek to beginning of WAL: %w", err)
+	var all []*WALEntry
+	for _, segment := range w.segments {
+		if segment.Number <= w.checkpoint {
+			continue // Already applied
+		}
+		entries, err := w.readSegment(segment.Path)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, entries...)
 	}
 
-	var entries []*WALEntry
+	entries, _, _, err := readEntries(w.file, w.read)
+	if err != nil {
+		return nil, err
+	}
+	return append(all, entries...), nil
+}
 
-	for {
-		// Read length prefix
-		var length uint32
-		if err := binary.Read(w.file, binary.LittleEndian, &length); err != nil {
-			if err == io.EOF {
-				break // End of file
+// ReadEntriesFrom reads the entries with an LSN of at least lsn from every
+// segment still on disk, including those a checkpoint covers, in order
+func (w *WAL) ReadEntriesFrom(lsn uint64) ([]*WALEntry, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return nil, fmt.Errorf("WAL is closed")
+	}
+
+	var all []*WALEntry
+	keep := func(entries []*WALEntry) {
+		for _, entry := range entries {
+			if entry.LSN >= lsn {
+				all = append(all, entry)
 			}
-			return nil, fmt.Errorf("failed to read WAL entry length: %w", err)
 		}
+	}
 
-		// Read entry data
-		entryData := make([]byte, length)
-		if _, err := io.ReadFull(w.file, entryData); err != nil {
-			return nil, fmt.Errorf("failed to read WAL entry data: %w", err)
+	for _, segment := range w.segments {
+		entries, err := w.readSegment(segment.Path)
+		if err != nil {
+			return nil, err
 		}
+		keep(entries)
+	}
+
+	entries, _, _, err := readEntries(w.file, w.read)
+	if err != nil {
+		return nil, err
+	}
+	keep(entries)
+
+	return all, nil
+}
+
+// LastLSN returns the LSN of the last entry logged, 0 if there is none
+func (w *WAL) LastLSN() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.nextLSN - 1
+}
+
+// encodeWALHeader returns the header written at the start of a WAL file
+func encodeWALHeader() []byte {
+	header := make([]byte, walHeaderSize)
+	copy(header, walFileMagic[:])
+	binary.LittleEndian.PutUint32(header[4:], walFormatCRC)
+	return header
+}
 
-		// Deserialize entry
-		var entry WALEntry
-		if err := json.Unmarshal(entryData, &entry); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal WAL entry: %w", err)
+// readOptions are the Options that decide how entries are read back
+type readOptions struct {
+	skipCorrupt   bool
+	maxRecordSize int64
+	skipped       *atomic.Uint64 // Counts the corrupt entries skipped, if set
+	log           *slog.Logger   // Logs the corrupt data skipped or discarded
+}
+
+// readEntries reads every valid entry from the start of file and returns
+// them with the file's format and the offset just past the last one. An
+// entry whose length or checksum doesn't check out, with nothing valid
+// after it, is the tail of a write the process died in; it was never
+// acknowledged, so reading stops before it. A bad entry followed by valid
+// ones is damage to acknowledged data: it is skipped if skipCorrupt is set
+// and fails the read with ErrCorruptWAL otherwise.
+func readEntries(file vfs.File, read readOptions) ([]*WALEntry, uint32, int64, error) {
+	// Read with ReadAt, which leaves the descriptor's offset alone, so
+	// concurrent readers don't move it under each other or the writer
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to read WAL: %w", err)
+	}
+
+	version, offset, err := decodeWALHeader(data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	entries, end, err := decodeEntries(data, offset, 0, version, read)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return entries, version, end, nil
+}
+
+// decodeWALHeader returns the format of the WAL file that starts with data
+// and the offset of its first entry
+func decodeWALHeader(data []byte) (uint32, int, error) {
+	// A header cut short is the torn first write of a new file
+	header := encodeWALHeader()
+	if len(data) < walHeaderSize && bytes.HasPrefix(header, data) {
+		return walFormatCRC, 0, nil
+	}
+
+	if len(data) >= walHeaderSize && [4]byte(data[:4]) == walFileMagic {
+		version := binary.LittleEndian.Uint32(data[4:])
+		if version != walFormatCRC {
+			return 0, 0, fmt.Errorf("unsupported WAL format version %d", version)
 		}
+		return version, walHeaderSize, nil
+	}
+
+	return walFormatLegacy, 0, nil
+}
 
-		entries = append(entries, &entry)
+// decodeEntries decodes the entries in data from offset on, where data
+// starts base bytes into its file, and returns them with the file offset
+// just past the last one, as readEntries describes
+func decodeEntries(data []byte, offset int, base int64, version uint32, read readOptions) ([]*WALEntry, int64, error) {
+	var entries []*WALEntry
+	end := base + int64(offset)
+
+	for offset < len(data) {
+		if entry, size, ok := decodeWALEntry(data[offset:], version, read.maxRecordSize); ok {
+			entries = append(entries, entry)
+			offset += size
+			end = base + int64(offset)
+			continue
+		}
+
+		next := findWALEntry(data, offset+1, version, read.maxRecordSize)
+		if next < 0 {
+			break // Torn or corrupt tail
+		}
+		if !read.skipCorrupt {
+			return nil, 0, fmt.Errorf("%w: bad entry at offset %d, followed by valid entries from offset %d", ErrCorruptWAL, base+int64(offset), base+int64(next))
+		}
+		read.log.Warn("skipped corrupt WAL data", "offset", base+int64(offset), "bytes", next-offset)
+		if read.skipped != nil {
+			read.skipped.Add(1)
+		}
+		offset = next
+	}
+
+	return entries, end, nil
+}
+
+// decodeWALEntry decodes the entry at the start of buf and returns its size
+// on disk. It reports false if the entry is longer than maxRecordSize,
+// runs past the end of buf, fails its checksum or doesn't parse.
+func decodeWALEntry(buf []byte, version uint32, maxRecordSize int64) (*WALEntry, int, bool) {
+	if len(buf) < 4 {
+		return nil, 0, false
 	}
 
-	return entries, nil
+	// No entry this large was written, so the length is damaged
+	length := int64(binary.LittleEndian.Uint32(buf))
+	if length > maxRecordSize {
+		return nil, 0, false
+	}
+	size := 4 + length
+	if version != walFormatLegacy {
+		size += 4
+	}
+	if size > int64(len(buf)) {
+		return nil, 0, false
+	}
+
+	if version != walFormatLegacy {
+		checksum := binary.LittleEndian.Uint32(buf[4+length:])
+		if crc32.Checksum(buf[:4+length], crcTable) != checksum {
+			return nil, 0, false
+		}
+	}
+
+	var entry WALEntry
+	if err := json.Unmarshal(buf[4:4+length], &entry); err != nil {
+		return nil, 0, false
+	}
+
+	return &entry, int(size), true
+}
+
+// findWALEntry returns the offset of the first valid entry in data at or
+// after from, or -1 if there is none. Entries are JSON objects, so only
+// offsets whose length prefix is followed by '{' are tried.
+func findWALEntry(data []byte, from int, version uint32, maxRecordSize int64) int {
+	for offset := from; offset+4 < len(data); offset++ {
+		if data[offset+4] != '{' {
+			continue
+		}
+		if _, _, ok := decodeWALEntry(data[offset:], version, maxRecordSize); ok {
+			return offset
+		}
+	}
+	return -1
 }
 
 // ReplayEntries replays WAL entries to a storage engine
@@ -190,26 +1137,27 @@ func (w *WAL) ReplayEntries(storage types.StorageEngine) error {
 		return fmt.Errorf("failed to read WAL entries: %w", err)
 	}
 
+	return Replay(entries, storage)
+}
+
+// ReplayFrom replays the entries with an LSN of at least lsn to a storage
+// engine, ignoring the checkpoint
+func (w *WAL) ReplayFrom(lsn uint64, storage types.StorageEngine) error {
+	entries, err := w.ReadEntriesFrom(lsn)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL entries: %w", err)
+	}
+
+	return Replay(entries, storage)
+}
+
+// Replay applies entries to a storage engine in order
+func Replay(entries []*WALEntry, storage types.StorageEngine) error {
 	for _, entry := range entries {
 		switch entry.Type {
 		case OpSet:
-			// Use SetWithTTL if TTL is provided, otherwise use Set
-			if entry.TTL != nil {
-				if setter, ok := storage.(interface {
-					SetWithTTL(key types.Key, value types.Value, ttl time.Duration) error
-				}); ok {
-					if err := setter.SetWithTTL(entry.Key, entry.Value, *entry.TTL); err != nil {
-						return fmt.Errorf("failed to replay SET operation for key %s: %w", entry.Key, err)
-					}
-				} else {
-					if err := storage.Set(entry.Key, entry.Value); err != nil {
-						return fmt.Errorf("failed to replay SET operation for key %s: %w", entry.Key, err)
-					}
-				}
-			} else {
-				if err := storage.Set(entry.Key, entry.Value); err != nil {
-					return fmt.Errorf("failed to replay SET operation for key %s: %w", entry.Key, err)
-				}
+			if err := replaySet(entry, storage); err != nil {
+				return fmt.Errorf("failed to replay SET operation for key %s: %w", entry.Key, err)
 			}
 
 		case OpDelete:
@@ -217,16 +1165,111 @@ func (w *WAL) ReplayEntries(storage types.StorageEngine) error {
 				return fmt.Errorf("failed to replay DELETE operation for key %s: %w", entry.Key, err)
 			}
 
+		case OpClear:
+			if err := storage.Clear(); err != nil {
+				return fmt.Errorf("failed to replay CLEAR operation: %w", err)
+			}
+
+		case OpBatchSet:
+			if err := storage.BatchSet(entry.batchEntries()); err != nil {
+				return fmt.Errorf("failed to replay BATCH SET operation: %w", err)
+			}
+
+		case OpBatchDelete:
+			if err := storage.BatchDelete(entry.Keys); err != nil {
+				return fmt.Errorf("failed to replay BATCH DELETE operation: %w", err)
+			}
+
+		case OpCommit:
+			if err := storage.BatchSet(entry.batchEntries()); err != nil {
+				return fmt.Errorf("failed to replay COMMIT operation: %w", err)
+			}
+			if err := storage.BatchDelete(entry.Keys); err != nil {
+				return fmt.Errorf("failed to replay COMMIT operation: %w", err)
+			}
+
+		case OpCompact:
+			// Nothing to apply
+
 		default:
-			return fmt.Errorf("unknown WAL operation type: %d", entry.Type)
+			return fmt.Errorf("unknown WAL operation type %d in entry with LSN %d", entry.Type, entry.LSN)
 		}
 	}
 
 	return nil
 }
 
-// Clear clears the WAL file
+// expiry returns when the key of a SET entry expires, or the zero time if
+// it doesn't. Entries logged before expiry times were expire their TTL
+// after they were logged.
+func (entry *WALEntry) expiry() time.Time {
+	if entry.ExpiresAt != nil {
+		return *entry.ExpiresAt
+	}
+	if entry.TTL != nil {
+		return entry.Timestamp.Add(*entry.TTL)
+	}
+	return time.Time{}
+}
+
+// replaySet applies a SET entry to storage, keeping the expiry the key was
+// logged with. Storage that can only take a TTL gets the time left until
+// then. An entry logged with a version is replayed as a batch of one, which
+// keeps it along with the entry's revision and creation time.
+func replaySet(entry *WALEntry, storage types.StorageEngine) error {
+	expiresAt := entry.expiry()
+	if entry.Version != 0 {
+		replayed := types.Entry{
+			Key:       entry.Key,
+			Value:     entry.Value,
+			UpdatedAt: entry.Timestamp,
+			TTL:       entry.TTL,
+			ExpiresAt: expiresAt,
+			Version:   entry.Version,
+			Revision:  entry.Revision,
+		}
+		if entry.CreatedAt != nil {
+			replayed.CreatedAt = *entry.CreatedAt
+		}
+		return storage.BatchSet([]types.Entry{replayed})
+	}
+	if expiresAt.IsZero() {
+		return storage.Set(entry.Key, entry.Value)
+	}
+
+	var ttl time.Duration
+	if entry.TTL != nil {
+		ttl = *entry.TTL
+	}
+	switch setter := storage.(type) {
+	case types.ExpiryStorage:
+		return setter.SetWithExpiry(entry.Key, entry.Value, ttl, expiresAt)
+	case types.TTLStorage:
+		return setter.SetWithTTL(entry.Key, entry.Value, time.Until(expiresAt))
+	default:
+		return storage.Set(entry.Key, entry.Value)
+	}
+}
+
+// batchEntries returns the members of a BATCH SET entry to replay. Members
+// logged with a TTL but neither an expiry time nor a timestamp are given
+// the entry's timestamp, so they expire their TTL after they were logged.
+func (entry *WALEntry) batchEntries() []types.Entry {
+	entries := append([]types.Entry(nil), entry.Entries...)
+	for i := range entries {
+		if entries[i].TTL != nil && entries[i].ExpiresAt.IsZero() && entries[i].UpdatedAt.IsZero() {
+			entries[i].UpdatedAt = entry.Timestamp
+		}
+	}
+	return entries
+}
+
+// Clear empties the WAL, removing its archived segments
 func (w *WAL) Clear() error {
+	w.flush()
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -234,24 +1277,46 @@ func (w *WAL) Clear() error {
 		return fmt.Errorf("WAL is closed")
 	}
 
+	// Record the last LSN assigned first, so it isn't handed out again
+	// once the entries that carry it are gone
+	if err := writeCheckpoint(w.fs, w.filePath, checkpointMarker{Segment: w.checkpoint, LSN: w.nextLSN - 1}); err != nil {
+		return fmt.Errorf("failed to write WAL checkpoint: %w", err)
+	}
+
 	// Close current file
 	if err := w.file.Close(); err != nil {
 		return fmt.Errorf("failed to close WAL file: %w", err)
 	}
 
 	// Remove the file
-	if err := os.Remove(w.filePath); err != nil {
+	if err := w.fs.Remove(w.filePath); err != nil {
 		return fmt.Errorf("failed to remove WAL file: %w", err)
 	}
+	for len(w.segments) > 0 {
+		if err := w.fs.Remove(w.segments[0].Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+		w.segments = w.segments[1:]
+	}
 
 	// Create new empty file
-	file, err := os.Create(w.filePath)
+	file, err := vfs.Create(w.fs, w.filePath)
 	if err != nil {
 		return fmt.Errorf("failed to create new WAL file: %w", err)
 	}
 
 	w.file = file
 	w.currentSize = 0
+	w.version = walFormatCRC
+	w.unsynced = 0
+	w.generation++
+	w.synced.Store(0)
+	w.wakeTailers()
+
+	// Make the removals and the new file durable
+	if err := vfs.SyncDir(w.fs, filepath.Dir(w.filePath)); err != nil {
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
 
 	return nil
 }
@@ -264,8 +1329,15 @@ func (w *WAL) ShouldRotate() bool {
 	return w.currentSize >= w.maxSize
 }
 
-// Rotate rotates the WAL file
+// Rotate archives the active file as the next numbered segment and starts
+// a new one. The archived file is synced first, so entries still waiting
+// for an fsync are on disk when it is replaced, and the directory last, so
+// the rename survives a power failure.
 func (w *WAL) Rotate() error {
+	w.flush()
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -273,9 +1345,19 @@ func (w *WAL) Rotate() error {
 		return fmt.Errorf("WAL is closed")
 	}
 
-	// Generate new file path with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	newPath := fmt.Sprintf("%s.%s", w.filePath, timestamp)
+	return w.rotateLocked()
+}
+
+// rotateLocked implements Rotate. The caller holds syncMu and mu.
+func (w *WAL) rotateLocked() error {
+	if w.synced.Load() < w.currentSize {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync WAL to disk: %w", err)
+		}
+		w.syncs.Add(1)
+	}
+
+	newPath := SegmentPath(w.filePath, w.nextSegment)
 
 	// Close current file
 	if err := w.file.Close(); err != nil {
@@ -283,18 +1365,33 @@ func (w *WAL) Rotate() error {
 	}
 
 	// Rename current file to archived name
-	if err := os.Rename(w.filePath, newPath); err != nil {
+	if err := w.fs.Rename(w.filePath, newPath); err != nil {
 		return fmt.Errorf("failed to rename WAL file: %w", err)
 	}
+	w.segments = append(w.segments, Segment{Path: newPath, Number: w.nextSegment, Size: w.currentSize, generation: w.generation})
+	w.nextSegment++
+	w.rotations.Add(1)
+	w.lastRotation.Store(time.Now().UnixNano())
+	w.read.log.Info("rotated WAL", "segment", newPath, "size", w.currentSize)
 
 	// Create new WAL file
-	file, err := os.Create(w.filePath)
+	file, err := vfs.Create(w.fs, w.filePath)
 	if err != nil {
 		return fmt.Errorf("failed to create new WAL file: %w", err)
 	}
 
 	w.file = file
 	w.currentSize = 0
+	w.version = walFormatCRC
+	w.unsynced = 0
+	w.generation++
+	w.synced.Store(0)
+	w.wakeTailers()
+
+	// Make the rename and the new file durable
+	if err := vfs.SyncDir(w.fs, filepath.Dir(w.filePath)); err != nil {
+		return fmt.Errorf("failed to sync WAL directory: %w", err)
+	}
 
 	return nil
 }
@@ -307,22 +1404,67 @@ func (w *WAL) GetSize() int64 {
 	return w.currentSize
 }
 
+// IsEmpty reports whether the active file holds no entries and none are
+// waiting to be written to it
+func (w *WAL) IsEmpty() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return w.currentSize == 0 && w.queued.Load() == 0
+}
+
 // GetMaxSize returns the maximum size before rotation
 func (w *WAL) GetMaxSize() int64 {
 	return w.maxSize
 }
 
-// Close closes the WAL
+// Close writes the entries still queued, then syncs and closes the WAL, so
+// entries the sync policy left unsynced are on disk after a clean shutdown
 func (w *WAL) Close() error {
+	// Appends after this fail, and the writer exits once it has written
+	// the ones queued before
+	w.queueMu.Lock()
+	if !w.draining {
+		w.draining = true
+		close(w.queue)
+	}
+	w.queueMu.Unlock()
+	<-w.writerDone
+
+	w.syncMu.Lock()
 	w.mu.Lock()
-	defer w.mu.Unlock()
 
 	if w.closed {
+		w.mu.Unlock()
+		w.syncMu.Unlock()
 		return nil
 	}
 
+	var err error
+	if w.synced.Load() < w.currentSize {
+		if err = w.file.Sync(); err != nil {
+			err = fmt.Errorf("failed to sync WAL to disk: %w", err)
+		} else {
+			w.syncs.Add(1)
+			w.synced.Store(w.currentSize)
+		}
+	}
+
 	w.closed = true
-	return w.file.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.mu.Unlock()
+	w.syncMu.Unlock()
+
+	// The syncer may be waiting for syncMu, so it is stopped after the
+	// locks are released
+	close(w.stopped)
+	if w.syncerDone != nil {
+		<-w.syncerDone
+	}
+
+	return err
 }
 
 // IsClosed returns true if the WAL is closed
@@ -0,0 +1,51 @@
+package wal_test
+
+import (
+	"database_engine/types"
+	"database_engine/wal"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkWALConcurrentLogSet logs 100-byte values from 1, 8 and 32
+// goroutines at once under the always and never sync policies
+func BenchmarkWALConcurrentLogSet(b *testing.B) {
+	for _, policy := range []string{types.WALSyncAlways, types.WALSyncNever} {
+		for _, writers := range []int{1, 8, 32} {
+			b.Run(fmt.Sprintf("%s/writers=%d", policy, writers), func(b *testing.B) {
+				w, err := wal.NewWALWithOptions(filepath.Join(b.TempDir(), "bench.wal"), wal.Options{
+					MaxSize:    1 << 40,
+					SyncPolicy: policy,
+				})
+				if err != nil {
+					b.Fatalf("Failed to create WAL: %v", err)
+				}
+				defer w.Close()
+
+				value := make(types.Value, 100)
+				var next atomic.Int64
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for i := 0; i < writers; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for n := next.Add(1); n <= int64(b.N); n = next.Add(1) {
+							if _, err := w.LogSet(types.Key(fmt.Sprintf("key-%d", n)), value, nil); err != nil {
+								b.Errorf("Failed to log set: %v", err)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				b.StopTimer()
+
+				b.ReportMetric(float64(w.Stats().Syncs)/float64(b.N), "fsyncs/op")
+			})
+		}
+	}
+}
@@ -3,9 +3,15 @@ package wal_test
 import (
 	"database_engine/storage"
 	"database_engine/types"
+	"database_engine/vfs"
 	"database_engine/wal"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -42,7 +48,7 @@ func TestWALLogSet(t *testing.T) {
 	value := types.Value("test-value")
 	ttl := time.Hour
 
-	err = w.LogSet(key, value, &ttl)
+	_, err = w.LogSet(key, value, &ttl)
 	assert.NoError(t, err)
 
 	// Verify file size increased
@@ -50,7 +56,7 @@ func TestWALLogSet(t *testing.T) {
 	assert.Greater(t, size, int64(0))
 
 	// Test logging without TTL
-	err = w.LogSet("key2", []byte("value2"), nil)
+	_, err = w.LogSet("key2", []byte("value2"), nil)
 	assert.NoError(t, err)
 }
 
@@ -65,7 +71,7 @@ func TestWALLogDelete(t *testing.T) {
 	// Test logging a DELETE operation
 	key := types.Key("test-key")
 
-	err = w.LogDelete(key)
+	_, err = w.LogDelete(key)
 	assert.NoError(t, err)
 
 	// Verify file size increased
@@ -89,13 +95,13 @@ func TestWALReadEntries(t *testing.T) {
 	key2 := types.Key("key2")
 	value2 := types.Value("value2")
 
-	err = w.LogSet(key1, value1, &ttl1)
+	_, err = w.LogSet(key1, value1, &ttl1)
 	assert.NoError(t, err)
 
-	err = w.LogSet(key2, value2, nil)
+	_, err = w.LogSet(key2, value2, nil)
 	assert.NoError(t, err)
 
-	err = w.LogDelete(key1)
+	_, err = w.LogDelete(key1)
 	assert.NoError(t, err)
 
 	// Read entries
@@ -141,13 +147,13 @@ func TestWALReplayEntries(t *testing.T) {
 	key2 := types.Key("key2")
 	value2 := types.Value("value2")
 
-	err = w.LogSet(key1, value1, &ttl1)
+	_, err = w.LogSet(key1, value1, &ttl1)
 	assert.NoError(t, err)
 
-	err = w.LogSet(key2, value2, nil)
+	_, err = w.LogSet(key2, value2, nil)
 	assert.NoError(t, err)
 
-	err = w.LogDelete(key1)
+	_, err = w.LogDelete(key1)
 	assert.NoError(t, err)
 
 	// Replay entries
@@ -171,6 +177,38 @@ func TestWALReplayEntries(t *testing.T) {
 	assert.Equal(t, int64(1), size)
 }
 
+func TestWALReplayClear(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	storage := storage.NewInMemoryStorage()
+
+	_, err = w.LogSet("before1", types.Value("value"), nil)
+	require.NoError(t, err)
+	_, err = w.LogSet("before2", types.Value("value"), nil)
+	require.NoError(t, err)
+	_, err = w.LogClear()
+	require.NoError(t, err)
+	_, err = w.LogSet("after", types.Value("value"), nil)
+	require.NoError(t, err)
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	assert.Equal(t, wal.OpClear, entries[2].Type)
+
+	// Only writes logged after the clear survive replay
+	require.NoError(t, w.ReplayEntries(storage))
+
+	keys, err := storage.Keys()
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"after"}, keys)
+}
+
 func TestWALReplayEntriesWithDiskStorage(t *testing.T) {
 	tempDir := t.TempDir()
 	walPath := filepath.Join(tempDir, "test.wal")
@@ -193,13 +231,13 @@ func TestWALReplayEntriesWithDiskStorage(t *testing.T) {
 	key2 := types.Key("key2")
 	value2 := types.Value("value2")
 
-	err = w.LogSet(key1, value1, &ttl1)
+	_, err = w.LogSet(key1, value1, &ttl1)
 	assert.NoError(t, err)
 
-	err = w.LogSet(key2, value2, nil)
+	_, err = w.LogSet(key2, value2, nil)
 	assert.NoError(t, err)
 
-	err = w.LogDelete(key1)
+	_, err = w.LogDelete(key1)
 	assert.NoError(t, err)
 
 	// Replay entries
@@ -223,6 +261,56 @@ func TestWALReplayEntriesWithDiskStorage(t *testing.T) {
 	assert.Equal(t, int64(1), size)
 }
 
+func TestWALReplayKeepsExpiry(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	ttl := time.Hour
+	_, err = w.LogSet("logged", []byte("value"), &ttl)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NotNil(t, entries[0].ExpiresAt)
+	logged := *entries[0].ExpiresAt
+	assert.WithinDuration(t, entries[0].Timestamp.Add(ttl), logged, time.Second)
+
+	// Entries logged two hours ago, before expiry times were, expire their
+	// TTL after they were logged
+	then := time.Now().Add(-2 * time.Hour)
+	long, short := 3*time.Hour, time.Hour
+	entries = append(entries,
+		&wal.WALEntry{Type: wal.OpSet, Key: "legacy", Value: []byte("value"), Timestamp: then, TTL: &long},
+		&wal.WALEntry{Type: wal.OpSet, Key: "expired", Value: []byte("value"), Timestamp: then, TTL: &short},
+		&wal.WALEntry{Type: wal.OpBatchSet, Timestamp: then, Entries: []types.Entry{
+			{Key: "batched", Value: []byte("value"), TTL: &long},
+		}},
+	)
+
+	diskStorage, err := storage.NewDiskStorage(filepath.Join(tempDir, "storage"))
+	require.NoError(t, err)
+	defer diskStorage.Close()
+	require.NoError(t, wal.Replay(entries, diskStorage))
+
+	entry, err := diskStorage.GetEntry("logged")
+	require.NoError(t, err)
+	assert.True(t, logged.Equal(entry.ExpiresAt))
+	for _, key := range []types.Key{"legacy", "batched"} {
+		entry, err = diskStorage.GetEntry(key)
+		require.NoError(t, err, key)
+		assert.True(t, then.Add(long).Equal(entry.ExpiresAt), key)
+	}
+	_, err = diskStorage.Get("expired")
+	assert.Error(t, err)
+}
+
 func TestWALClear(t *testing.T) {
 	tempDir := t.TempDir()
 	walPath := filepath.Join(tempDir, "test.wal")
@@ -232,10 +320,10 @@ func TestWALClear(t *testing.T) {
 	defer w.Close()
 
 	// Log some operations
-	err = w.LogSet("key1", []byte("value1"), nil)
+	_, err = w.LogSet("key1", []byte("value1"), nil)
 	assert.NoError(t, err)
 
-	err = w.LogSet("key2", []byte("value2"), nil)
+	_, err = w.LogSet("key2", []byte("value2"), nil)
 	assert.NoError(t, err)
 
 	// Verify file has content
@@ -251,7 +339,7 @@ func TestWALClear(t *testing.T) {
 	assert.Equal(t, int64(0), size)
 
 	// Verify we can still log after clear
-	err = w.LogSet("key3", []byte("value3"), nil)
+	_, err = w.LogSet("key3", []byte("value3"), nil)
 	assert.NoError(t, err)
 
 	size = w.GetSize()
@@ -271,7 +359,7 @@ func TestWALRotation(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		key := types.Key(fmt.Sprintf("key-%d", i))
 		value := types.Value(fmt.Sprintf("value-%d", i))
-		err = w.LogSet(key, value, nil)
+		_, err = w.LogSet(key, value, nil)
 		assert.NoError(t, err)
 
 		if w.ShouldRotate() {
@@ -290,10 +378,12 @@ func TestWALRotation(t *testing.T) {
 	size := w.GetSize()
 	assert.Equal(t, int64(0), size)
 
-	// Verify old file exists
-	files, err := filepath.Glob(filepath.Join(tempDir, "test.wal.*"))
-	assert.NoError(t, err)
-	assert.Len(t, files, 1)
+	// Verify old file exists as the first segment
+	assert.FileExists(t, filepath.Join(tempDir, "test-000001.wal"))
+	segments := w.ListSegments()
+	require.Len(t, segments, 2)
+	assert.Equal(t, uint64(1), segments[0].Number)
+	assert.True(t, segments[1].Active)
 }
 
 func TestWALClosedOperations(t *testing.T) {
@@ -309,11 +399,11 @@ func TestWALClosedOperations(t *testing.T) {
 	assert.True(t, w.IsClosed())
 
 	// Test operations on closed WAL
-	err = w.LogSet("key", []byte("value"), nil)
+	_, err = w.LogSet("key", []byte("value"), nil)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "WAL is closed")
 
-	err = w.LogDelete("key")
+	_, err = w.LogDelete("key")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "WAL is closed")
 
@@ -346,7 +436,7 @@ func TestWALConcurrentOperations(t *testing.T) {
 			key := types.Key(fmt.Sprintf("concurrent-key-%d", i))
 			value := types.Value(fmt.Sprintf("concurrent-value-%d", i))
 			
-			err := w.LogSet(key, value, nil)
+			_, err := w.LogSet(key, value, nil)
 			assert.NoError(t, err)
 			
 			done <- true
@@ -372,10 +462,10 @@ func TestWALPersistence(t *testing.T) {
 	w1, err := wal.NewWAL(walPath, 1024*1024)
 	require.NoError(t, err)
 
-	err = w1.LogSet("persistent-key", []byte("persistent-value"), nil)
+	_, err = w1.LogSet("persistent-key", []byte("persistent-value"), nil)
 	assert.NoError(t, err)
 
-	err = w1.LogDelete("persistent-key")
+	_, err = w1.LogDelete("persistent-key")
 	assert.NoError(t, err)
 
 	err = w1.Close()
@@ -397,3 +487,916 @@ func TestWALPersistence(t *testing.T) {
 	assert.Equal(t, wal.OpDelete, entries[1].Type)
 	assert.Equal(t, types.Key("persistent-key"), entries[1].Key)
 }
+
+func TestWALTornTail(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+
+	fsys := vfs.NewFaultFS(vfs.OS)
+	w, err := wal.NewWALWithFS(walPath, 1024*1024, fsys)
+	require.NoError(t, err)
+	_, err = w.LogSet("key1", []byte("value1"), nil)
+	require.NoError(t, err)
+
+	// Die halfway through writing the second entry
+	fsys.InjectWriteFault(vfs.WriteFault{Err: vfs.ErrCrashed, Torn: true})
+	_, err = w.LogSet("key2", []byte("value2"), nil)
+	require.Error(t, err)
+	require.NoError(t, fsys.Crash())
+
+	// The torn entry is dropped and new entries follow the last good one
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.LogSet("key3", []byte("value3"), nil)
+	require.NoError(t, err)
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, types.Key("key1"), entries[0].Key)
+	assert.Equal(t, types.Key("key3"), entries[1].Key)
+}
+
+func TestWALBatchEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.LogBatchSet([]types.Entry{
+		{Key: "key1", Value: []byte("value1")},
+		{Key: "key2", Value: []byte("value2")},
+	})
+	require.NoError(t, err)
+	_, err = w.LogBatchDelete([]types.Key{"key1"})
+	require.NoError(t, err)
+
+	memStorage := storage.NewInMemoryStorage()
+	require.NoError(t, w.ReplayEntries(memStorage))
+
+	values, err := memStorage.BatchGet([]types.Key{"key1", "key2"})
+	require.NoError(t, err)
+	assert.Equal(t, map[types.Key]types.Value{"key2": types.Value("value2")}, values)
+}
+
+// writeTestWAL logs count SETs to a new WAL at walPath and returns the file
+// offset at which each entry starts
+func writeTestWAL(t *testing.T, walPath string, count int) []int64 {
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+
+	var offsets []int64
+	for i := 0; i < count; i++ {
+		offset := w.GetSize()
+		if offset == 0 {
+			offset = 8 // The header is written with the first entry
+		}
+		offsets = append(offsets, offset)
+		_, err = w.LogSet(types.Key(fmt.Sprintf("key%03d", i)), []byte("value"), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return offsets
+}
+
+func walKeys(entries []*wal.WALEntry) []types.Key {
+	var keys []types.Key
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+func testKeys(from, to int) []types.Key {
+	var keys []types.Key
+	for i := from; i < to; i++ {
+		keys = append(keys, types.Key(fmt.Sprintf("key%03d", i)))
+	}
+	return keys
+}
+
+func TestWALTruncatedMidEntry(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	offsets := writeTestWAL(t, walPath, 100)
+
+	// Cut the last entry in half
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(walPath, (offsets[99]+info.Size())/2))
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, offsets[99], w.GetSize())
+
+	_, err = w.LogSet("key100", []byte("value"), nil)
+	require.NoError(t, err)
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, append(testKeys(0, 99), "key100"), walKeys(entries))
+}
+
+func TestWALCorruptTail(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	offsets := writeTestWAL(t, walPath, 10)
+
+	// A flipped bit in the last entry still parses as JSON; only the
+	// checksum catches it
+	data, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	data[offsets[9]+int64(len(`....{"type":1,"key":"key`))] ^= 0x01
+	require.NoError(t, os.WriteFile(walPath, data, 0644))
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(0, 9), walKeys(entries))
+	assert.Equal(t, offsets[9], w.GetSize())
+}
+
+func TestWALCorruptMiddle(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	offsets := writeTestWAL(t, walPath, 10)
+
+	// Garble the length prefix of an entry in the middle
+	data, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	binary.LittleEndian.PutUint32(data[offsets[4]:], 0xFFFFFF)
+	require.NoError(t, os.WriteFile(walPath, data, 0644))
+
+	// Entries after the damage were acknowledged, so by default the WAL
+	// refuses to open rather than drop them
+	_, err = wal.NewWAL(walPath, 1024*1024)
+	assert.True(t, errors.Is(err, wal.ErrCorruptWAL))
+
+	w, err := wal.NewWALWithOptions(walPath, wal.Options{MaxSize: 1024 * 1024, SkipCorrupt: true})
+	require.NoError(t, err)
+	defer w.Close()
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, append(testKeys(0, 4), testKeys(5, 10)...), walKeys(entries))
+
+	// Nothing valid was truncated
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), w.GetSize())
+}
+
+func TestWALLegacyFormat(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	// A WAL written before entries had checksums
+	var data []byte
+	for _, key := range []types.Key{"key1", "key2"} {
+		entryData, err := json.Marshal(&wal.WALEntry{Type: wal.OpSet, Key: key, Value: []byte("value")})
+		require.NoError(t, err)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(entryData)))
+		data = append(data, entryData...)
+	}
+	require.NoError(t, os.WriteFile(walPath, data[:len(data)-3], 0644))
+
+	// The torn legacy entry is dropped and new entries keep the old format
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.LogSet("key3", []byte("value"), nil)
+	require.NoError(t, err)
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"key1", "key3"}, walKeys(entries))
+
+	// Rotating starts a file in the current format
+	require.NoError(t, w.Rotate())
+	_, err = w.LogSet("key4", []byte("value"), nil)
+	require.NoError(t, err)
+	rotated, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	assert.Equal(t, "KVWL", string(rotated[:4]))
+
+	// The legacy file is still read as an archived segment
+	entries, err = w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"key1", "key3", "key4"}, walKeys(entries))
+}
+
+func TestWALSyncPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		every  int
+		syncs  uint64 // After 10 entries
+	}{
+		{types.WALSyncAlways, 0, 10},
+		{types.WALSyncEveryN, 4, 2},
+		{types.WALSyncNever, 0, 0},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			w, err := wal.NewWALWithOptions(filepath.Join(t.TempDir(), "test.wal"), wal.Options{
+				MaxSize:    1024 * 1024,
+				SyncPolicy: tc.policy,
+				SyncEvery:  tc.every,
+			})
+			require.NoError(t, err)
+			defer w.Close()
+
+			for _, key := range testKeys(0, 10) {
+				_, err = w.LogSet(key, types.Value("value"), nil)
+				require.NoError(t, err)
+			}
+
+			stats := w.Stats()
+			assert.Equal(t, tc.policy, stats.SyncPolicy)
+			assert.Equal(t, uint64(10), stats.Entries)
+			assert.Equal(t, tc.syncs, stats.Syncs)
+
+			// Sync covers whatever the policy left behind
+			require.NoError(t, w.Sync())
+			assert.Zero(t, w.Stats().UnsyncedBytes)
+		})
+	}
+}
+
+func TestWALSyncInterval(t *testing.T) {
+	w, err := wal.NewWALWithOptions(filepath.Join(t.TempDir(), "test.wal"), wal.Options{
+		MaxSize:    1024 * 1024,
+		SyncPolicy: types.WALSyncInterval,
+		SyncPeriod: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, err = w.LogSet("key", types.Value("value"), nil)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		stats := w.Stats()
+		return stats.UnsyncedBytes == 0 && stats.Syncs == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestWALSyncPolicyValidation(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	_, err := wal.NewWALWithOptions(walPath, wal.Options{SyncPolicy: "sometimes"})
+	assert.Error(t, err)
+	_, err = wal.NewWALWithOptions(walPath, wal.Options{SyncPolicy: types.WALSyncInterval})
+	assert.Error(t, err)
+	_, err = wal.NewWALWithOptions(walPath, wal.Options{SyncPolicy: types.WALSyncEveryN})
+	assert.Error(t, err)
+}
+
+func TestWALSyncPolicyPowerFailure(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		kept   int // Entries surviving a power failure after 10 writes
+	}{
+		{types.WALSyncAlways, 10},
+		{types.WALSyncEveryN, 8},
+		{types.WALSyncNever, 0},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			walPath := filepath.Join(t.TempDir(), "test.wal")
+			fsys := vfs.NewFaultFS(vfs.OS)
+
+			w, err := wal.NewWALWithOptions(walPath, wal.Options{
+				MaxSize:    1024 * 1024,
+				FS:         fsys,
+				SyncPolicy: tc.policy,
+				SyncEvery:  4,
+			})
+			require.NoError(t, err)
+			for _, key := range testKeys(0, 10) {
+				_, err = w.LogSet(key, types.Value("value"), nil)
+				require.NoError(t, err)
+			}
+			require.NoError(t, fsys.PowerFailure())
+
+			w, err = wal.NewWAL(walPath, 1024*1024)
+			require.NoError(t, err)
+			defer w.Close()
+
+			entries, err := w.ReadEntries()
+			require.NoError(t, err)
+			assert.Equal(t, testKeys(0, tc.kept), walKeys(entries))
+		})
+	}
+}
+
+// slowSyncFS makes every fsync take a while, so concurrent writers pile up
+// behind one
+type slowSyncFS struct {
+	vfs.FS
+}
+
+type slowSyncFile struct {
+	vfs.File
+}
+
+func (fsys slowSyncFS) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	file, err := fsys.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return slowSyncFile{file}, nil
+}
+
+func (file slowSyncFile) Sync() error {
+	time.Sleep(5 * time.Millisecond)
+	return file.File.Sync()
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	w, err := wal.NewWALWithFS(filepath.Join(t.TempDir(), "test.wal"), 1024*1024, slowSyncFS{vfs.OS})
+	require.NoError(t, err)
+	defer w.Close()
+
+	const writers = 20
+	errs := make(chan error, writers)
+	for _, key := range testKeys(0, writers) {
+		go func(key types.Key) {
+			_, err := w.LogSet(key, types.Value("value"), nil)
+			errs <- err
+		}(key)
+	}
+	for i := 0; i < writers; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// Every entry was synced before its LogSet returned, with writers
+	// sharing fsyncs
+	stats := w.Stats()
+	assert.Equal(t, uint64(writers), stats.Entries)
+	assert.Zero(t, stats.UnsyncedBytes)
+	assert.Less(t, stats.Syncs, uint64(writers/2))
+}
+
+func TestWALSegments(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+
+	w, err := wal.NewWALWithOptions(walPath, wal.Options{MaxSize: 1024 * 1024, RetainSegments: 1})
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Three segments of two entries each, and one entry in the active file
+	keys := testKeys(0, 7)
+	for i, key := range keys {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+		if i%2 == 1 {
+			require.NoError(t, w.Rotate())
+		}
+	}
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, keys, walKeys(entries))
+
+	stats := w.Stats()
+	require.Len(t, stats.Segments, 4)
+	total := int64(0)
+	for i, segment := range stats.Segments[:3] {
+		assert.Equal(t, wal.SegmentPath(walPath, uint64(i+1)), segment.Path)
+		assert.Equal(t, uint64(i+1), segment.Number)
+		total += segment.Size
+	}
+	assert.True(t, stats.Segments[3].Active)
+	assert.Equal(t, total+stats.Size, stats.TotalSize)
+
+	// Nothing is checkpointed yet
+	removed, err := w.CleanupSegments()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+
+	// The checkpoint archives the active file as segment 4 and all but
+	// the newest retained segment can go
+	require.NoError(t, w.Checkpoint())
+	removed, err = w.CleanupSegments()
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.Equal(t, uint64(4), w.Stats().Checkpoint)
+
+	segments, err := wal.ArchivedSegments(vfs.OS, walPath)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	assert.Equal(t, uint64(4), segments[0].Number)
+
+	// The retained segment is skipped, since the checkpoint covers it
+	_, err = w.LogSet("key007", types.Value("value"), nil)
+	require.NoError(t, err)
+	entries, err = w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(7, 8), walKeys(entries))
+
+	// Clear removes the segments as well
+	require.NoError(t, w.Clear())
+	segments, err = wal.ArchivedSegments(vfs.OS, walPath)
+	require.NoError(t, err)
+	assert.Empty(t, segments)
+}
+
+func TestWALLegacyArchives(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+	writeTestWAL(t, walPath, 2)
+	require.NoError(t, os.Rename(walPath, walPath+".20240101_120000"))
+	writeTestWAL(t, walPath, 3)
+	require.NoError(t, os.Rename(walPath, walPath+".20240102_120000"))
+
+	// Archives from before segments were numbered are renumbered and read
+	// ahead of the active file
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.LogSet("active", types.Value("value"), nil)
+	require.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(tempDir, "test-000001.wal"))
+	assert.FileExists(t, filepath.Join(tempDir, "test-000002.wal"))
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	expected := append(testKeys(0, 2), testKeys(0, 3)...)
+	assert.Equal(t, append(expected, "active"), walKeys(entries))
+}
+
+func TestWALCheckpointReopen(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	for _, key := range testKeys(0, 3) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Checkpoint())
+	_, err = w.LogSet("key003", types.Value("value"), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.FileExists(t, filepath.Join(tempDir, "test.checkpoint"))
+
+	// The checkpointed segment is still there but isn't replayed
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(3, 4), walKeys(entries))
+
+	// Once the segments are gone, new ones are still numbered past the
+	// checkpoint
+	require.NoError(t, w.Clear())
+	require.NoError(t, w.Close())
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	_, err = w.LogSet("key004", types.Value("value"), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Rotate())
+	assert.FileExists(t, wal.SegmentPath(walPath, 2))
+
+	entries, err = w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(4, 5), walKeys(entries))
+}
+
+func TestWALPendingEntries(t *testing.T) {
+	tempDir := t.TempDir()
+	walPath := filepath.Join(tempDir, "test.wal")
+	writeTestWAL(t, walPath, 2)
+	require.NoError(t, os.Rename(walPath, walPath+".20240101_120000"))
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	require.NoError(t, w.Checkpoint())
+	for _, key := range testKeys(2, 4) {
+		_, err = w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Rotate())
+	_, err = w.LogSet("active", types.Value("value"), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// A legacy archive left behind after the WAL was opened, and a torn tail
+	writeTestWAL(t, filepath.Join(tempDir, "other.wal"), 1)
+	require.NoError(t, os.Rename(filepath.Join(tempDir, "other.wal"), walPath+".20240102_120000"))
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0x01, 0x02, 0x03})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	before, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	stat, err := os.Stat(walPath)
+	require.NoError(t, err)
+
+	// The entries opening the WAL would replay, with nothing changed on disk
+	entries, skipped, err := wal.PendingEntries(walPath, wal.Options{})
+	require.NoError(t, err)
+	assert.Zero(t, skipped)
+	expected := append(testKeys(2, 4), testKeys(0, 1)...)
+	assert.Equal(t, append(expected, "active"), walKeys(entries))
+
+	after, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	assert.Equal(t, len(before), len(after))
+	for i := range before {
+		assert.Equal(t, before[i].Name(), after[i].Name())
+	}
+	unchanged, err := os.Stat(walPath)
+	require.NoError(t, err)
+	assert.Equal(t, stat.Size(), unchanged.Size())
+
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	replayed, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, walKeys(replayed), walKeys(entries))
+}
+
+func TestWALRotateConcurrentWriters(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Entries logged while rotations happen land in one segment or the
+	// next, never in neither
+	const writers, perWriter = 8, 50
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			for _, key := range testKeys(i*perWriter, (i+1)*perWriter) {
+				if _, err := w.LogSet(key, types.Value("value"), nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	rotations := 0
+	for done := 0; done < writers; {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+			done++
+		default:
+			require.NoError(t, w.Rotate())
+			rotations++
+		}
+	}
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, testKeys(0, writers*perWriter), walKeys(entries))
+	assert.Equal(t, uint64(rotations), w.Stats().Rotations)
+}
+
+func TestWALSequenceNumbers(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+
+	// LSNs count up from 1 across rotations
+	for i, key := range testKeys(0, 4) {
+		lsn, err := w.LogSet(key, types.Value("value"), nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), lsn)
+		if i == 1 {
+			require.NoError(t, w.Rotate())
+		}
+	}
+	lsn, err := w.LogDelete("key000")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), lsn)
+	assert.Equal(t, uint64(5), w.LastLSN())
+
+	// They carry on after a reopen
+	require.NoError(t, w.Close())
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	lsn, err = w.LogSet("key004", types.Value("value"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), lsn)
+
+	entries, err := w.ReadEntriesFrom(4)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+4), entry.LSN)
+	}
+
+	// ReadEntriesFrom still finds checkpointed entries that are on disk
+	require.NoError(t, w.Checkpoint())
+	entries, err = w.ReadEntries()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = w.ReadEntriesFrom(6)
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"key004"}, walKeys(entries))
+
+	memStorage := storage.NewInMemoryStorage()
+	require.NoError(t, w.ReplayFrom(5, memStorage))
+	value, err := memStorage.Get("key004")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+
+	// Nor are they reused once the segments holding them are deleted, or
+	// after a Clear
+	_, err = w.CleanupSegments()
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), w.LastLSN())
+	lsn, err = w.LogSet("key005", types.Value("value"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(7), lsn)
+
+	require.NoError(t, w.Clear())
+	require.NoError(t, w.Close())
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	lsn, err = w.LogSet("key006", types.Value("value"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), lsn)
+	assert.Equal(t, uint64(8), w.Stats().LastLSN)
+}
+
+func TestWALReadEntriesDuringWrites(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Readers share the WAL's descriptor with the writer and each other;
+	// none of them may disturb what the others read or write
+	const total = 300
+	done := make(chan struct{})
+	errs := make(chan error, 3)
+	go func() {
+		defer close(done)
+		for _, key := range testKeys(0, total) {
+			if _, err := w.LogSet(key, types.Value("value"), nil); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for r := 0; r < 2; r++ {
+		go func() {
+			for {
+				entries, err := w.ReadEntries()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if keys := walKeys(entries); !assert.Equal(t, testKeys(0, len(keys)), keys) {
+					errs <- nil
+					return
+				}
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+			}
+		}()
+	}
+
+	<-done
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-errs)
+	}
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(0, total), walKeys(entries))
+}
+
+func TestWALReplayUnknownOperation(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+
+	// An entry from a newer version with an operation this one lacks
+	var data []byte
+	for _, entry := range []*wal.WALEntry{
+		{Type: wal.OpSet, Key: "key1", Value: []byte("value"), LSN: 1},
+		{Type: wal.OpCompact, LSN: 2},
+		{Type: 99, Key: "key2", LSN: 3},
+	} {
+		entryData, err := json.Marshal(entry)
+		require.NoError(t, err)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(entryData)))
+		data = append(data, entryData...)
+	}
+	require.NoError(t, os.WriteFile(walPath, data, 0644))
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	memStorage := storage.NewInMemoryStorage()
+	err = w.ReplayEntries(memStorage)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown WAL operation type 99 in entry with LSN 3")
+
+	// Entries before it were applied; the compaction marker changes nothing
+	value, err := memStorage.Get("key1")
+	require.NoError(t, err)
+	assert.Equal(t, types.Value("value"), value)
+}
+
+func TestWALOversizedLengthPrefix(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	writeTestWAL(t, walPath, 10)
+	info, err := os.Stat(walPath)
+	require.NoError(t, err)
+
+	// A tail claiming to be a 4GB entry is damage to drop, not something
+	// to read
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	tail := binary.LittleEndian.AppendUint32(nil, 0xFFFFFFF0)
+	_, err = file.Write(append(tail, `{"type":1,"key":"bogus"}`...))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, info.Size(), w.GetSize())
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(0, 10), walKeys(entries))
+}
+
+func TestWALRecordOverLimit(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	_, err = w.LogSet("key000", []byte("value"), nil)
+	require.NoError(t, err)
+	_, err = w.LogSet("key001", make([]byte, 4096), nil)
+	require.NoError(t, err)
+	_, err = w.LogSet("key002", []byte("value"), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Under a lower limit the large entry reads as damage, even though
+	// its checksum holds
+	options := wal.Options{MaxSize: 1024 * 1024, MaxRecordSize: 1024}
+	_, err = wal.NewWALWithOptions(walPath, options)
+	assert.ErrorIs(t, err, wal.ErrCorruptWAL)
+
+	options.SkipCorrupt = true
+	w, err = wal.NewWALWithOptions(walPath, options)
+	require.NoError(t, err)
+	defer w.Close()
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, []types.Key{"key000", "key002"}, walKeys(entries))
+}
+
+func TestWALSizeLimits(t *testing.T) {
+	w, err := wal.NewWALWithOptions(filepath.Join(t.TempDir(), "test.wal"), wal.Options{
+		MaxSize:       1024 * 1024,
+		MaxKeySize:    8,
+		MaxValueSize:  16,
+		MaxRecordSize: 1024,
+	})
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Nothing too large reaches the file
+	_, err = w.LogSet("a-long-key", []byte("value"), nil)
+	assert.ErrorIs(t, err, types.ErrInvalidKey)
+	_, err = w.LogSet("key", make([]byte, 17), nil)
+	assert.ErrorIs(t, err, types.ErrInvalidValue)
+	_, err = w.LogBatchSet([]types.Entry{
+		{Key: "key1", Value: []byte("value")},
+		{Key: "key2", Value: make([]byte, 17)},
+	})
+	assert.ErrorIs(t, err, types.ErrInvalidValue)
+	_, err = w.LogBatchDelete([]types.Key{"key1", "a-long-key"})
+	assert.ErrorIs(t, err, types.ErrInvalidKey)
+
+	var batch []types.Entry
+	for i := 0; i < 50; i++ {
+		batch = append(batch, types.Entry{Key: types.Key(fmt.Sprintf("key%d", i)), Value: []byte("value")})
+	}
+	_, err = w.LogBatchSet(batch)
+	assert.ErrorIs(t, err, wal.ErrRecordTooLarge)
+
+	assert.Zero(t, w.GetSize())
+	lsn, err := w.LogSet("key", []byte("value"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), lsn)
+
+	_, err = wal.NewWALWithOptions(filepath.Join(t.TempDir(), "test.wal"), wal.Options{MaxRecordSize: -1})
+	assert.Error(t, err)
+}
+
+func TestWALSyncsDirectory(t *testing.T) {
+	fsys := vfs.NewFaultFS(vfs.OS)
+
+	// Creating, rotating and clearing the WAL each sync its directory, so
+	// the files they create, rename and remove stay that way after a power
+	// failure
+	w, err := wal.NewWALWithOptions(filepath.Join(t.TempDir(), "test.wal"), wal.Options{MaxSize: 1024 * 1024, FS: fsys})
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Empty(t, fsys.UnsyncedDirs())
+
+	_, err = w.LogSet("key000", []byte("value"), nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Rotate())
+	assert.Empty(t, fsys.UnsyncedDirs())
+
+	require.NoError(t, w.Clear())
+	assert.Empty(t, fsys.UnsyncedDirs())
+}
+
+func TestWALAppendOrder(t *testing.T) {
+	w, err := wal.NewWAL(filepath.Join(t.TempDir(), "test.wal"), 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+
+	// Writers append without waiting, so their entries share batches; each
+	// one's entries are logged in the order it appended them
+	const writers, perWriter = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			pending := make([]wal.Pending, 0, perWriter)
+			for j := 0; j < perWriter; j++ {
+				p, err := w.AppendSet(types.Key(fmt.Sprintf("w%d-%03d", writer, j)), []byte("value"), nil)
+				if !assert.NoError(t, err) {
+					return
+				}
+				pending = append(pending, p)
+			}
+			var last uint64
+			for _, p := range pending {
+				assert.NoError(t, p.Wait())
+				assert.Greater(t, p.LSN(), last)
+				last = p.LSN()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	require.Len(t, entries, writers*perWriter)
+	next := make(map[int]int)
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.LSN)
+		var writer, j int
+		_, err := fmt.Sscanf(string(entry.Key), "w%d-%03d", &writer, &j)
+		require.NoError(t, err)
+		assert.Equal(t, next[writer], j, "entry %d of writer %d", j, writer)
+		next[writer] = j + 1
+	}
+}
+
+func TestWALCloseDrainsQueue(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "test.wal")
+	w, err := wal.NewWALWithOptions(walPath, wal.Options{MaxSize: 1024 * 1024, SyncPolicy: types.WALSyncNever})
+	require.NoError(t, err)
+
+	// Entries still queued when Close is called are written before it
+	// returns
+	var pending []wal.Pending
+	for _, key := range testKeys(0, 100) {
+		p, err := w.AppendSet(key, []byte("value"), nil)
+		require.NoError(t, err)
+		pending = append(pending, p)
+	}
+	require.NoError(t, w.Close())
+	for _, p := range pending {
+		assert.NoError(t, p.Wait())
+	}
+
+	_, err = w.AppendSet("key100", []byte("value"), nil)
+	assert.Error(t, err)
+
+	w, err = wal.NewWAL(walPath, 1024*1024)
+	require.NoError(t, err)
+	defer w.Close()
+	entries, err := w.ReadEntries()
+	require.NoError(t, err)
+	assert.Equal(t, testKeys(0, 100), walKeys(entries))
+}